@@ -1074,6 +1074,10 @@ func (g *Generator) GenerateServiceImports(file *os.File, s *parser.Service) err
 	imports := "import (\n"
 	imports += "\t\"bytes\"\n"
 	imports += "\t\"fmt\"\n"
+	if len(s.StreamingMethods()) > 0 {
+		// Streaming methods end their requests with io.EOF.
+		imports += "\t\"io\"\n"
+	}
 	imports += "\t\"sync\"\n"
 	if len(s.TwowayMethods()) > 0 {
 		// Only non-oneway methods require the time package.
@@ -1521,9 +1525,17 @@ func (g *Generator) generateServiceInterface(service *parser.Service) string {
 			contents += "\t// Deprecated\n"
 		}
 
-		contents += fmt.Sprintf("\t%s(ctx frugal.FContext%s) %s\n",
+		switch stream, _ := method.Annotations.Stream(); stream {
+		case parser.ServerStream:
+			contents += "\t// Streaming: items are passed to responses before the call returns.\n"
+		case parser.BidiStream:
+			contents += "\t// Streaming: items are taken from requests until it returns io.EOF,\n"
+			contents += "\t// while items are passed to responses before the call returns.\n"
+		}
+
+		contents += fmt.Sprintf("\t%s(ctx frugal.FContext%s%s) %s\n",
 			snakeToCamel(method.Name), g.generateInterfaceArgs(method.Arguments),
-			g.generateReturnArgs(method))
+			g.generateStreamParams(method), g.generateReturnArgs(method))
 	}
 	contents += "}\n\n"
 	return contents
@@ -1584,7 +1596,12 @@ func (g *Generator) generateClient(service *parser.Service) string {
 	contents += "\ttransport       frugal.FTransport\n"
 	contents += "\tprotocolFactory *frugal.FProtocolFactory\n"
 	contents += "\tmethods         map[string]*frugal.Method\n"
+	contents += "\topts            []frugal.CallOption\n"
+	if g.generateAsync() {
+		contents += "\thasMiddleware   bool\n"
+	}
 	contents += "}\n\n"
+	contents += fmt.Sprintf("var _ F%s = (*F%sClient)(nil)\n\n", servTitle, servTitle)
 
 	contents += fmt.Sprintf(
 		"func NewF%sClient(provider *frugal.FServiceProvider, middleware ...frugal.ServiceMiddleware) *F%sClient {\n",
@@ -1600,6 +1617,9 @@ func (g *Generator) generateClient(service *parser.Service) string {
 	contents += "\t\tmethods:         methods,\n"
 	contents += "\t}\n"
 	contents += "\tmiddleware = append(middleware, provider.GetMiddleware()...)\n"
+	if g.generateAsync() {
+		contents += "\tclient.hasMiddleware = len(middleware) > 0\n"
+	}
 	for _, method := range service.Methods {
 		name := parser.LowercaseFirstLetter(method.Name)
 		contents += fmt.Sprintf("\tmethods[\"%s\"] = frugal.NewMethod(client, client.%s, \"%s\", middleware)\n", name, name, name)
@@ -1607,9 +1627,24 @@ func (g *Generator) generateClient(service *parser.Service) string {
 	contents += "\treturn client\n"
 	contents += "}\n\n"
 
+	contents += "// WithCallOptions returns a copy of the client which makes its calls with\n"
+	contents += "// the given options, in addition to those of the client.\n"
+	contents += fmt.Sprintf("func (f *F%sClient) WithCallOptions(opts ...frugal.CallOption) *F%sClient {\n", servTitle, servTitle)
+	contents += "\tclient := *f\n"
+	contents += "\tclient.opts = append(append([]frugal.CallOption(nil), f.opts...), opts...)\n"
+	if service.Extends != "" {
+		contents += fmt.Sprintf("\tclient.F%sClient = f.F%sClient.WithCallOptions(opts...)\n",
+			service.ExtendsService(), service.ExtendsService())
+	}
+	contents += "\treturn &client\n"
+	contents += "}\n\n"
+
 	for _, method := range service.Methods {
 		contents += g.generateClientMethod(service, method)
-		if g.generateAsync() {
+		if _, streaming := method.Annotations.Stream(); streaming {
+			// Streaming methods already handle each response as it arrives.
+			contents += g.generateRecvClientMethod(service, method)
+		} else if g.generateAsync() {
 			contents += g.generateAsyncClientMethod(service, method)
 		}
 	}
@@ -1632,23 +1667,105 @@ func (g *Generator) generateAsyncClientMethod(service *parser.Service, method *p
 	if method.ReturnType != nil {
 		contents += fmt.Sprintf("\tresultC := make(chan %s, 1)\n", g.getGoTypeFromThriftType(method.ReturnType))
 	}
-	contents += "\tgo func() {\n"
+	returnChannels := "\treturn errC\n"
+	if method.ReturnType != nil {
+		returnChannels = "\treturn resultC, errC\n"
+	}
+
+	// Middleware wraps synchronous calls, so calls made with it, and oneway
+	// calls which don't wait for a response, are made from a goroutine.
+	// Otherwise the response is read once it's delivered to the future.
+	indent := "\t"
+	if !method.Oneway {
+		contents += "\tif f.hasMiddleware {\n"
+		indent = "\t\t"
+	}
+	contents += indent + "go func() {\n"
 	if method.ReturnType == nil {
-		contents += fmt.Sprintf("\t\terrC <- f.%s(%s)\n", nameTitle, g.generateCallArgs(method))
+		contents += fmt.Sprintf(indent+"\terrC <- f.%s(%s)\n", nameTitle, g.generateCallArgs(method))
 	} else {
-		contents += fmt.Sprintf("\t\tresult, err := f.%s(%s)\n", nameTitle, g.generateCallArgs(method))
-		contents += "\t\tif err != nil {\n"
-		contents += "\t\t\terrC <- err\n"
-		contents += "\t\t} else {\n"
-		contents += "\t\t\tresultC <- result\n"
-		contents += "\t\t}\n"
+		contents += fmt.Sprintf(indent+"\tresult, err := f.%s(%s)\n", nameTitle, g.generateCallArgs(method))
+		contents += indent + "\tif err != nil {\n"
+		contents += indent + "\t\terrC <- err\n"
+		contents += indent + "\t} else {\n"
+		contents += indent + "\t\tresultC <- result\n"
+		contents += indent + "\t}\n"
+	}
+	contents += indent + "}()\n"
+	if method.Oneway {
+		contents += returnChannels
+		contents += "}\n\n"
+		return contents
+	}
+	contents += "\t" + returnChannels
+	contents += "\t}\n"
+
+	if _, deprecated := method.Annotations.Deprecated(); deprecated {
+		contents += fmt.Sprintf("\tlogrus.Warn(\"Call to deprecated function '%s.%s'\")\n", service.Name, nameTitle)
 	}
-	contents += "\t}()\n"
+	contents += "\tctx, finish := frugal.ApplyCallOptions(ctx, f.opts...)\n"
+	contents += fmt.Sprintf("\tfuture, sendErr := f.send%s(%s)\n", nameTitle, g.generateCallArgs(method))
+	contents += "\tif sendErr != nil {\n"
+	contents += "\t\tfinish()\n"
+	contents += "\t\terrC <- sendErr\n"
+	contents += "\t" + returnChannels
+	contents += "\t}\n"
+	contents += "\tfuture.OnResult(func(resultTransport thrift.TTransport, resultErr error) {\n"
 	if method.ReturnType == nil {
-		contents += "\treturn errC\n"
+		contents += "\t\tif resultErr == nil {\n"
+		contents += fmt.Sprintf("\t\t\tresultErr = f.recv%s(ctx, resultTransport)\n", nameTitle)
+		contents += "\t\t}\n"
+		contents += "\t\tfinish()\n"
+		contents += "\t\terrC <- resultErr\n"
 	} else {
-		contents += "\treturn resultC, errC\n"
+		contents += fmt.Sprintf("\t\tvar result %s\n", g.getGoTypeFromThriftType(method.ReturnType))
+		contents += "\t\tif resultErr == nil {\n"
+		contents += fmt.Sprintf("\t\t\tresult, resultErr = f.recv%s(ctx, resultTransport)\n", nameTitle)
+		contents += "\t\t}\n"
+		contents += "\t\tfinish()\n"
+		contents += "\t\tif resultErr != nil {\n"
+		contents += "\t\t\terrC <- resultErr\n"
+		contents += "\t\t} else {\n"
+		contents += "\t\t\tresultC <- result\n"
+		contents += "\t\t}\n"
 	}
+	contents += "\t})\n"
+	contents += returnChannels
+	contents += "}\n\n"
+	contents += g.generateSendClientMethod(service, method)
+	contents += g.generateRecvClientMethod(service, method)
+	return contents
+}
+
+// generateSendClientMethod generates the internal method an async client
+// method sends its request with, returning a future for the response.
+func (g *Generator) generateSendClientMethod(service *parser.Service, method *parser.Method) string {
+	var (
+		servTitle = snakeToCamel(service.Name)
+		nameTitle = snakeToCamel(method.Name)
+	)
+
+	contents := fmt.Sprintf("func (f *F%sClient) send%s(ctx frugal.FContext%s) (future *frugal.FFuture, err error) {\n",
+		servTitle, nameTitle, g.generateInputArgs(method.Arguments))
+	contents += g.generateWriteRequest(service, method)
+	contents += "\tfuture = frugal.RequestAsync(f.transport, ctx, buffer.Bytes())\n"
+	contents += "\treturn\n"
+	contents += "}\n\n"
+	return contents
+}
+
+// generateRecvClientMethod generates the internal method an async client
+// method reads its response with.
+func (g *Generator) generateRecvClientMethod(service *parser.Service, method *parser.Method) string {
+	var (
+		servTitle = snakeToCamel(service.Name)
+		nameTitle = snakeToCamel(method.Name)
+	)
+
+	contents := fmt.Sprintf("func (f *F%sClient) recv%s(ctx frugal.FContext, resultTransport thrift.TTransport) %s {\n",
+		servTitle, nameTitle, g.generateReturnArgs(method))
+	contents += g.generateReadResponse(service, method)
+	contents += "\treturn\n"
 	contents += "}\n\n"
 	return contents
 }
@@ -1673,12 +1790,15 @@ func (g *Generator) generateClientMethod(service *parser.Service, method *parser
 		contents += fmt.Sprintf("// Deprecated%s\n", deprecationValue)
 	}
 
-	contents += fmt.Sprintf("func (f *F%sClient) %s(ctx frugal.FContext%s) %s {\n",
-		servTitle, nameTitle, g.generateInputArgs(method.Arguments), g.generateReturnArgs(method))
+	contents += fmt.Sprintf("func (f *F%sClient) %s(ctx frugal.FContext%s%s) %s {\n",
+		servTitle, nameTitle, g.generateInputArgs(method.Arguments), g.generateStreamParams(method),
+		g.generateReturnArgs(method))
 
 	if deprecated {
 		contents += fmt.Sprintf("\tlogrus.Warn(\"Call to deprecated function '%s.%s'\")\n", service.Name, nameTitle)
 	}
+	contents += "\tctx, finish := frugal.ApplyCallOptions(ctx, f.opts...)\n"
+	contents += "\tdefer finish()\n"
 
 	contents += fmt.Sprintf("\tret := f.methods[\"%s\"].Invoke(%s)\n", nameLower, g.generateClientArgs(method))
 	numReturn := "2"
@@ -1708,15 +1828,125 @@ func (g *Generator) generateClientMethod(service *parser.Service, method *parser
 func (g *Generator) generateInternalClientMethod(service *parser.Service, method *parser.Method) string {
 	var (
 		servTitle = snakeToCamel(service.Name)
-		nameTitle = snakeToCamel(method.Name)
 		nameLower = parser.LowercaseFirstLetter(method.Name)
 	)
 
 	contents := ""
-	contents += fmt.Sprintf("func (f *F%sClient) %s(ctx frugal.FContext%s) %s {\n",
-		servTitle, nameLower, g.generateInputArgs(method.Arguments), g.generateReturnArgs(method))
+	contents += fmt.Sprintf("func (f *F%sClient) %s(ctx frugal.FContext%s%s) %s {\n",
+		servTitle, nameLower, g.generateInputArgs(method.Arguments), g.generateStreamParams(method),
+		g.generateReturnArgs(method))
+	contents += g.generateWriteRequest(service, method)
+
+	if _, streaming := method.Annotations.Stream(); streaming {
+		contents += g.generateStreamResponses(service, method)
+		contents += "}\n\n"
+		return contents
+	}
+	if method.Oneway {
+		contents += "\terr = f.transport.Oneway(ctx, buffer.Bytes())\n"
+		contents += "\treturn\n"
+		contents += "}\n\n"
+		return contents
+	}
+	contents += "\tvar resultTransport thrift.TTransport\n"
+	contents += "\tresultTransport, err = f.transport.Request(ctx, buffer.Bytes())\n"
+	contents += "\tif err != nil {\n"
+	contents += "\t\treturn\n"
+	contents += "\t}\n"
+	contents += g.generateReadResponse(service, method)
+	contents += "\treturn\n"
+	contents += "}\n\n"
+
+	return contents
+}
+
+// generateStreamResponses generates the body of a streaming client method
+// which opens the stream once its request is written, passes each item the
+// server sends to responses and reads the final response as an ordinary
+// one. A bidirectional method sends the items taken from requests from a
+// goroutine meanwhile.
+func (g *Generator) generateStreamResponses(service *parser.Service, method *parser.Method) string {
+	var (
+		servLower = strings.ToLower(service.Name)
+		nameTitle = snakeToCamel(method.Name)
+	)
+
+	stream, _ := method.Annotations.Stream()
+	contents := ""
+	if stream == parser.BidiStream {
+		contents += "\tvar stream *frugal.FBidiStream\n"
+		contents += "\tif stream, err = frugal.RequestBidiStream(f.transport, f.protocolFactory, ctx, buffer.Bytes()); err != nil {\n"
+	} else {
+		contents += "\tvar stream *frugal.FClientStream\n"
+		contents += "\tif stream, err = frugal.RequestStream(f.transport, ctx, buffer.Bytes()); err != nil {\n"
+	}
+	contents += "\t\treturn\n"
+	contents += "\t}\n"
+	contents += "\tdefer stream.Close()\n"
+	if stream == parser.BidiStream {
+		// An error taking an item ends the client's side of the stream, so
+		// it's received once the server responds.
+		contents += "\trequestsErr := make(chan error, 1)\n"
+		contents += "\tgo func() {\n"
+		contents += "\t\tdefer stream.CloseSend()\n"
+		contents += "\t\tfor {\n"
+		contents += "\t\t\titem, err := requests()\n"
+		contents += "\t\t\tif err != nil {\n"
+		contents += "\t\t\t\tif err != io.EOF {\n"
+		contents += "\t\t\t\t\trequestsErr <- err\n"
+		contents += "\t\t\t\t}\n"
+		contents += "\t\t\t\treturn\n"
+		contents += "\t\t\t}\n"
+		contents += "\t\t\tif err := stream.Send(func(oprot *frugal.FProtocol) error {\n"
+		contents += fmt.Sprintf("\t\t\t\treturn %sWrite%sItem(oprot, thrift.CALL, item)\n", servLower, nameTitle)
+		contents += "\t\t\t}); err != nil {\n"
+		contents += "\t\t\t\treturn\n"
+		contents += "\t\t\t}\n"
+		contents += "\t\t}\n"
+		contents += "\t}()\n"
+	}
+	contents += "\tfor {\n"
+	contents += "\t\tvar resultTransport thrift.TTransport\n"
+	contents += "\t\tvar item bool\n"
+	contents += "\t\tif resultTransport, item, err = stream.Recv(); err != nil {\n"
+	contents += "\t\t\treturn\n"
+	contents += "\t\t}\n"
+	if stream == parser.BidiStream {
+		contents += fmt.Sprintf("\t\tif r, err = f.recv%s(ctx, resultTransport); err != nil {\n", nameTitle)
+		contents += "\t\t\treturn\n"
+		contents += "\t\t}\n"
+		contents += "\t\tif !item {\n"
+		contents += "\t\t\tbreak\n"
+		contents += "\t\t}\n"
+	} else {
+		contents += fmt.Sprintf("\t\tif r, err = f.recv%s(ctx, resultTransport); err != nil || !item {\n", nameTitle)
+		contents += "\t\t\treturn\n"
+		contents += "\t\t}\n"
+	}
+	contents += "\t\tif err = responses(r); err != nil {\n"
+	contents += "\t\t\treturn\n"
+	contents += "\t\t}\n"
+	contents += "\t}\n"
+	if stream == parser.BidiStream {
+		contents += "\tselect {\n"
+		contents += "\tcase err = <-requestsErr:\n"
+		contents += "\tdefault:\n"
+		contents += "\t}\n"
+		contents += "\treturn\n"
+	}
+	return contents
+}
+
+// generateWriteRequest generates the body of a client method writing its
+// request to a buffer.
+func (g *Generator) generateWriteRequest(service *parser.Service, method *parser.Method) string {
+	var (
+		servTitle = snakeToCamel(service.Name)
+		nameTitle = snakeToCamel(method.Name)
+		nameLower = parser.LowercaseFirstLetter(method.Name)
+	)
 
-	contents += "\tbuffer := frugal.NewTMemoryOutputBuffer(f.transport.GetRequestSizeLimit())\n"
+	contents := "\tbuffer := frugal.NewTMemoryOutputBuffer(f.transport.GetRequestSizeLimit())\n"
 	contents += "\toprot := f.protocolFactory.GetProtocol(buffer)\n"
 	contents += "\tif err = oprot.WriteRequestHeader(ctx); err != nil {\n"
 	contents += "\t\treturn\n"
@@ -1741,20 +1971,19 @@ func (g *Generator) generateInternalClientMethod(service *parser.Service, method
 	contents += "\tif err = oprot.Flush(); err != nil {\n"
 	contents += "\t\treturn\n"
 	contents += "\t}\n"
+	return contents
+}
 
-	if method.Oneway {
-		contents += "\terr = f.transport.Oneway(ctx, buffer.Bytes())\n"
-		contents += "\treturn\n"
-		contents += "}\n\n"
-		return contents
-	}
-	contents += "\tvar resultTransport thrift.TTransport\n"
-	contents += "\tresultTransport, err = f.transport.Request(ctx, buffer.Bytes())\n"
-	contents += "\tif err != nil {\n"
-	contents += "\t\treturn\n"
-	contents += "\t}\n"
+// generateReadResponse generates the body of a client method reading its
+// result from the response transport.
+func (g *Generator) generateReadResponse(service *parser.Service, method *parser.Method) string {
+	var (
+		servTitle = snakeToCamel(service.Name)
+		nameTitle = snakeToCamel(method.Name)
+		nameLower = parser.LowercaseFirstLetter(method.Name)
+	)
 
-	contents += "\tiprot := f.protocolFactory.GetProtocol(resultTransport)\n"
+	contents := "\tiprot := f.protocolFactory.GetProtocol(resultTransport)\n"
 	contents += "\tif err = iprot.ReadResponseHeader(ctx); err != nil {\n"
 	contents += "\t\treturn\n"
 	contents += "\t}\n"
@@ -1806,9 +2035,6 @@ func (g *Generator) generateInternalClientMethod(service *parser.Service, method
 	if method.ReturnType != nil {
 		contents += "\tr = result.GetSuccess()\n"
 	}
-	contents += "\treturn\n"
-	contents += "}\n\n"
-
 	return contents
 }
 
@@ -1817,6 +2043,12 @@ func (g *Generator) generateServer(service *parser.Service) string {
 	contents += g.generateProcessor(service)
 	for _, method := range service.Methods {
 		contents += g.generateMethodProcessor(service, method)
+		if stream, ok := method.Annotations.Stream(); ok {
+			contents += g.generateWriteItem(service, method)
+			if stream == parser.BidiStream {
+				contents += g.generateReadItem(service, method)
+			}
+		}
 	}
 	contents += g.generateWriteApplicationError(service)
 	return contents
@@ -1903,6 +2135,9 @@ func (g *Generator) generateMethodProcessor(service *parser.Service, method *par
 	contents += "\tvar err2 error\n"
 	if method.ReturnType != nil {
 	}
+	if _, streaming := method.Annotations.Stream(); streaming {
+		contents += g.generateServerStream(service, method)
+	}
 	contents += fmt.Sprintf("\tret := p.InvokeMethod(%s)\n", g.generateHandlerArgs(method))
 	numReturn := "2"
 	if method.ReturnType == nil {
@@ -1985,11 +2220,110 @@ func (g *Generator) generateMethodProcessor(service *parser.Service, method *par
 	return contents
 }
 
+// generateServerStream generates the part of a streaming method's processor
+// which opens the stream and the functions its handler sends and, for a
+// bidirectional method, receives items with.
+func (g *Generator) generateServerStream(service *parser.Service, method *parser.Method) string {
+	var (
+		servLower = strings.ToLower(service.Name)
+		nameTitle = snakeToCamel(method.Name)
+		nameLower = parser.LowercaseFirstLetter(method.Name)
+		itemType  = g.getGoTypeFromThriftType(method.ReturnType)
+	)
+
+	stream, _ := method.Annotations.Stream()
+	contents := ""
+	if stream == parser.BidiStream {
+		contents += "\tstream, err := frugal.NewFServerBidiStream(ctx, oprot)\n"
+	} else {
+		contents += "\tstream, err := frugal.NewFServerStream(ctx, oprot)\n"
+	}
+	contents += "\tif err != nil {\n"
+	contents += "\t\tp.GetWriteMutex().Lock()\n"
+	contents += fmt.Sprintf("\t\t%sWriteApplicationError(ctx, oprot, frugal.APPLICATION_EXCEPTION_STREAMING_UNSUPPORTED, \"%s\", err.Error())\n", servLower, nameLower)
+	contents += "\t\tp.GetWriteMutex().Unlock()\n"
+	contents += "\t\treturn nil\n"
+	contents += "\t}\n"
+	if stream == parser.BidiStream {
+		contents += fmt.Sprintf("\trequests := func() (item %s, err error) {\n", itemType)
+		contents += "\t\tvar iprot *frugal.FProtocol\n"
+		contents += "\t\tif iprot, err = stream.Recv(); err != nil {\n"
+		contents += "\t\t\tif e, ok := err.(thrift.TTransportException); ok && e.TypeId() == frugal.TRANSPORT_EXCEPTION_END_OF_FILE {\n"
+		contents += "\t\t\t\terr = io.EOF\n"
+		contents += "\t\t\t}\n"
+		contents += "\t\t\treturn\n"
+		contents += "\t\t}\n"
+		contents += fmt.Sprintf("\t\treturn %sRead%sItem(iprot)\n", servLower, nameTitle)
+		contents += "\t}\n"
+	}
+	contents += fmt.Sprintf("\tresponses := func(item %s) error {\n", itemType)
+	contents += "\t\treturn stream.Send(func(oprot *frugal.FProtocol) error {\n"
+	contents += fmt.Sprintf("\t\t\treturn %sWrite%sItem(oprot, thrift.REPLY, item)\n", servLower, nameTitle)
+	contents += "\t\t})\n"
+	contents += "\t}\n"
+	return contents
+}
+
+// generateWriteItem generates the function writing an item of a streaming
+// method, which is sent as a message of its result.
+func (g *Generator) generateWriteItem(service *parser.Service, method *parser.Method) string {
+	var (
+		servTitle = snakeToCamel(service.Name)
+		servLower = strings.ToLower(service.Name)
+		nameTitle = snakeToCamel(method.Name)
+		nameLower = parser.LowercaseFirstLetter(method.Name)
+	)
+
+	contents := fmt.Sprintf("func %sWrite%sItem(oprot *frugal.FProtocol, typeID thrift.TMessageType, item %s) error {\n",
+		servLower, nameTitle, g.getGoTypeFromThriftType(method.ReturnType))
+	contents += fmt.Sprintf("\tif err := oprot.WriteMessageBegin(\"%s\", typeID, 0); err != nil {\n", nameLower)
+	contents += "\t\treturn err\n"
+	contents += "\t}\n"
+	if g.isPrimitive(method.ReturnType) || g.Frugal.IsEnum(method.ReturnType) {
+		contents += fmt.Sprintf("\tresult := %s%sResult{Success: &item}\n", servTitle, nameTitle)
+	} else {
+		contents += fmt.Sprintf("\tresult := %s%sResult{Success: item}\n", servTitle, nameTitle)
+	}
+	contents += "\tif err := result.Write(oprot); err != nil {\n"
+	contents += "\t\treturn err\n"
+	contents += "\t}\n"
+	contents += "\treturn oprot.WriteMessageEnd()\n"
+	contents += "}\n\n"
+	return contents
+}
+
+// generateReadItem generates the function reading an item a client sends on
+// a bidirectional streaming method.
+func (g *Generator) generateReadItem(service *parser.Service, method *parser.Method) string {
+	var (
+		servTitle = snakeToCamel(service.Name)
+		servLower = strings.ToLower(service.Name)
+		nameTitle = snakeToCamel(method.Name)
+	)
+
+	contents := fmt.Sprintf("func %sRead%sItem(iprot *frugal.FProtocol) (item %s, err error) {\n",
+		servLower, nameTitle, g.getGoTypeFromThriftType(method.ReturnType))
+	contents += "\tif _, _, _, err = iprot.ReadMessageBegin(); err != nil {\n"
+	contents += "\t\treturn\n"
+	contents += "\t}\n"
+	contents += fmt.Sprintf("\tresult := %s%sResult{}\n", servTitle, nameTitle)
+	contents += "\tif err = result.Read(iprot); err != nil {\n"
+	contents += "\t\treturn\n"
+	contents += "\t}\n"
+	contents += "\tif err = iprot.ReadMessageEnd(); err != nil {\n"
+	contents += "\t\treturn\n"
+	contents += "\t}\n"
+	contents += "\treturn result.GetSuccess(), nil\n"
+	contents += "}\n\n"
+	return contents
+}
+
 func (g *Generator) generateClientArgs(method *parser.Method) string {
 	args := "[]interface{}{ctx"
 	for _, arg := range method.Arguments {
 		args += ", " + strings.ToLower(arg.Name)
 	}
+	args += g.generateStreamArgs(method)
 	args += "}"
 	return args
 }
@@ -2009,9 +2343,39 @@ func (g *Generator) generateHandlerArgs(method *parser.Method) string {
 	for _, arg := range method.Arguments {
 		args += ", args." + snakeToCamel(arg.Name)
 	}
+	args += g.generateStreamArgs(method)
 	args += "}"
 	return args
 }
+
+// generateStreamParams generates the parameters a streaming method takes
+// after its arguments: the function items are passed to as they're received
+// and, for a bidirectional method, the function items to send are taken
+// from.
+func (g *Generator) generateStreamParams(method *parser.Method) string {
+	stream, ok := method.Annotations.Stream()
+	if !ok {
+		return ""
+	}
+	itemType := g.getGoTypeFromThriftType(method.ReturnType)
+	params := ""
+	if stream == parser.BidiStream {
+		params += fmt.Sprintf(", requests func() (%s, error)", itemType)
+	}
+	params += fmt.Sprintf(", responses func(%s) error", itemType)
+	return params
+}
+
+func (g *Generator) generateStreamArgs(method *parser.Method) string {
+	stream, ok := method.Annotations.Stream()
+	if !ok {
+		return ""
+	}
+	if stream == parser.BidiStream {
+		return ", requests, responses"
+	}
+	return ", responses"
+}
 func (g *Generator) generateCallArgs(method *parser.Method) string {
 	args := "ctx"
 	for _, arg := range method.Arguments {
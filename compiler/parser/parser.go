@@ -39,6 +39,19 @@ const (
 
 	// DeprecatedAnnotation is the annotation to mark a service method as deprecated.
 	DeprecatedAnnotation = "deprecated"
+
+	// StreamAnnotation is the annotation to mark a service method as
+	// streaming. With the ServerStream value, the server sends any number of
+	// items of the method's return type before its ordinary response. With
+	// the BidiStream value, the client also sends items of that type until
+	// it ends its side of the stream.
+	StreamAnnotation = "stream"
+)
+
+// Values of the "stream" annotation.
+const (
+	ServerStream = "server"
+	BidiStream   = "bidi"
 )
 
 // ParseFrugal parses the given Frugal file into its semantic representation.
@@ -299,6 +299,18 @@ func (s *Service) TwowayMethods() []*Method {
 	return methods
 }
 
+// StreamingMethods returns a slice of the methods defined in this Service
+// which are annotated as streaming.
+func (s *Service) StreamingMethods() []*Method {
+	methods := make([]*Method, 0, len(s.Methods))
+	for _, method := range s.Methods {
+		if _, ok := method.Annotations.Stream(); ok {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
 // ReferencedIncludes returns a slice containing the referenced includes which
 // will need to be imported in generated code for this Service.
 func (s *Service) ReferencedIncludes() ([]*Include, error) {
@@ -398,8 +410,8 @@ func (s *Service) ReferencedInternals() []string {
 	return internals
 }
 
-// validate ensures Service oneways don't return anything and field ids aren't
-// duplicated.
+// validate ensures Service oneways don't return anything, streaming methods
+// do, and field ids aren't duplicated.
 func (s *Service) validate() error {
 	for _, method := range s.Methods {
 		// Ensure oneways don't return anything.
@@ -414,6 +426,18 @@ func (s *Service) validate() error {
 			}
 		}
 
+		// Ensure streaming methods stream a result.
+		if stream, ok := method.Annotations.Stream(); ok {
+			if stream != ServerStream && stream != BidiStream {
+				return fmt.Errorf("Method %s.%s has invalid stream annotation %q, expected %q or %q",
+					s.Name, method.Name, stream, ServerStream, BidiStream)
+			}
+			if method.Oneway || method.ReturnType == nil {
+				return fmt.Errorf("Streaming method %s.%s must return a value",
+					s.Name, method.Name)
+			}
+		}
+
 		// Ensure field ids aren't duplicated.
 		ids := make(map[int]struct{})
 		for _, arg := range method.Arguments {
@@ -479,6 +503,12 @@ func (a Annotations) Deprecated() (string, bool) {
 	return a.Get(DeprecatedAnnotation)
 }
 
+// Stream returns true if the "stream" annotation is present and its
+// associated value, if any.
+func (a Annotations) Stream() (string, bool) {
+	return a.Get(StreamAnnotation)
+}
+
 func getImports(t *Type) []string {
 	list := []string{}
 	switch t.Name {
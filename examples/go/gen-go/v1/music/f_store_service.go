@@ -32,8 +32,11 @@ type FStoreClient struct {
 	transport       frugal.FTransport
 	protocolFactory *frugal.FProtocolFactory
 	methods         map[string]*frugal.Method
+	opts            []frugal.CallOption
 }
 
+var _ FStore = (*FStoreClient)(nil)
+
 func NewFStoreClient(provider *frugal.FServiceProvider, middleware ...frugal.ServiceMiddleware) *FStoreClient {
 	methods := make(map[string]*frugal.Method)
 	client := &FStoreClient{
@@ -47,7 +50,17 @@ func NewFStoreClient(provider *frugal.FServiceProvider, middleware ...frugal.Ser
 	return client
 }
 
+// WithCallOptions returns a copy of the client which makes its calls with
+// the given options, in addition to those of the client.
+func (f *FStoreClient) WithCallOptions(opts ...frugal.CallOption) *FStoreClient {
+	client := *f
+	client.opts = append(append([]frugal.CallOption(nil), f.opts...), opts...)
+	return &client
+}
+
 func (f *FStoreClient) BuyAlbum(ctx frugal.FContext, asin string, acct string) (r *Album, err error) {
+	ctx, finish := frugal.ApplyCallOptions(ctx, f.opts...)
+	defer finish()
 	ret := f.methods["buyAlbum"].Invoke([]interface{}{ctx, asin, acct})
 	if len(ret) != 2 {
 		panic(fmt.Sprintf("Middleware returned %d arguments, expected 2", len(ret)))
@@ -137,6 +150,8 @@ func (f *FStoreClient) buyAlbum(ctx frugal.FContext, asin string, acct string) (
 // Deprecated: use something else
 func (f *FStoreClient) EnterAlbumGiveaway(ctx frugal.FContext, email string, name string) (r bool, err error) {
 	logrus.Warn("Call to deprecated function 'Store.EnterAlbumGiveaway'")
+	ctx, finish := frugal.ApplyCallOptions(ctx, f.opts...)
+	defer finish()
 	ret := f.methods["enterAlbumGiveaway"].Invoke([]interface{}{ctx, email, name})
 	if len(ret) != 2 {
 		panic(fmt.Sprintf("Middleware returned %d arguments, expected 2", len(ret)))
@@ -213,6 +213,8 @@ func (f *fAdapterTransport) Request(ctx FContext, payload []byte) (thrift.TTrans
 		return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(result)}, nil
 	case err := <-errorC:
 		return nil, err
+	case <-contextDone(ctx):
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_CANCELLED, "frugal: request cancelled")
 	case <-time.After(ctx.Timeout()):
 		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: request timed out")
 	}
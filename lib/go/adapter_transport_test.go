@@ -42,6 +42,10 @@ func (m *mockFRegistry) Register(ctx FContext, resultC chan []byte) error {
 	return m.Called(ctx, resultC).Error(0)
 }
 
+func (m *mockFRegistry) RegisterStream(ctx FContext, queue *streamQueue) error {
+	return m.Called(ctx, queue).Error(0)
+}
+
 func (m *mockFRegistry) Unregister(ctx FContext) {
 	m.Called(ctx)
 }
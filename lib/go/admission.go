@@ -0,0 +1,115 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// FAdmissionRequest describes a request a server is deciding whether to
+// admit. Its body has not been decoded yet.
+type FAdmissionRequest struct {
+	// InFlight is the number of requests the server is processing or has
+	// queued for processing, including this one.
+	InFlight int
+
+	// QueueWait is how long the request waited for a worker, for servers
+	// with a worker pool.
+	QueueWait time.Duration
+
+	// Headers are the request headers.
+	Headers map[string]string
+}
+
+// FAdmissionController decides which requests a server admits, so it can shed
+// load when overloaded rather than let requests pile up. Requests which aren't
+// admitted are responded to with a TApplicationException of type
+// APPLICATION_EXCEPTION_SERVER_OVERLOADED, so clients can back off or retry
+// elsewhere. Cancellations are always admitted.
+type FAdmissionController interface {
+	// Admit returns nil if the request should be processed, or an error
+	// describing why it's rejected.
+	Admit(request *FAdmissionRequest) error
+}
+
+// FAdmissionFunc is an FAdmissionController implemented by a function.
+type FAdmissionFunc func(request *FAdmissionRequest) error
+
+// Admit calls the function.
+func (f FAdmissionFunc) Admit(request *FAdmissionRequest) error {
+	return f(request)
+}
+
+// NewFMaxInFlightAdmission returns an FAdmissionController which rejects
+// requests while the server has the given number of requests in flight.
+func NewFMaxInFlightAdmission(max int) FAdmissionController {
+	return FAdmissionFunc(func(request *FAdmissionRequest) error {
+		if request.InFlight > max {
+			return fmt.Errorf("%d requests in flight", request.InFlight-1)
+		}
+		return nil
+	})
+}
+
+// NewFMaxQueueWaitAdmission returns an FAdmissionController which rejects
+// requests which waited longer than the given duration for a worker, as
+// their clients are likely to have given up on them.
+func NewFMaxQueueWaitAdmission(max time.Duration) FAdmissionController {
+	return FAdmissionFunc(func(request *FAdmissionRequest) error {
+		if request.QueueWait > max {
+			return fmt.Errorf("request waited %s for a worker", request.QueueWait)
+		}
+		return nil
+	})
+}
+
+// admissionProcessor is an FProcessor which rejects the requests its
+// FAdmissionController doesn't admit before processing them.
+type admissionProcessor struct {
+	FProcessor
+	controller FAdmissionController
+	inFlight   int64
+}
+
+func newAdmissionProcessor(processor FProcessor, controller FAdmissionController) *admissionProcessor {
+	return &admissionProcessor{FProcessor: processor, controller: controller}
+}
+
+func (a *admissionProcessor) Process(iprot, oprot *FProtocol) error {
+	return a.process(iprot, oprot, 0, 0)
+}
+
+// process reads the request headers, then processes the request if it's
+// admitted, given how long it waited for a worker and how many requests are
+// still waiting.
+func (a *admissionProcessor) process(iprot, oprot *FProtocol, wait time.Duration, waiting int) error {
+	request, err := iprot.peekRequestHeaders()
+	if err != nil {
+		return err
+	}
+	replay := headerReplay(iprot)
+	if _, ok := request.header(cancelHeader); ok {
+		return a.FProcessor.Process(replay(), oprot)
+	}
+
+	inFlight := atomic.AddInt64(&a.inFlight, 1)
+	defer atomic.AddInt64(&a.inFlight, -1)
+	admission := &FAdmissionRequest{InFlight: int(inFlight) + waiting, QueueWait: wait, Headers: request.decoded()}
+	if err := a.controller.Admit(admission); err != nil {
+		return rejectRequest(replay(), oprot, overloaded(err.Error()))
+	}
+	return a.FProcessor.Process(replay(), oprot)
+}
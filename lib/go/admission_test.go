@@ -0,0 +1,142 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// shedAdmission rejects requests with a shed header.
+func shedAdmission(requests chan<- *FAdmissionRequest) FAdmissionController {
+	return FAdmissionFunc(func(request *FAdmissionRequest) error {
+		requests <- request
+		if _, ok := request.Headers["shed"]; ok {
+			return errors.New("shedding")
+		}
+		return nil
+	})
+}
+
+func assertOverloaded(t *testing.T, err error) {
+	ex, ok := err.(thrift.TApplicationException)
+	if assert.True(t, ok) {
+		assert.Equal(t, int32(APPLICATION_EXCEPTION_SERVER_OVERLOADED), ex.TypeId())
+		assert.Equal(t, "server overloaded: shedding", ex.Error())
+	}
+}
+
+// Ensures requests the admission controller rejects are responded to with an
+// overloaded error instead of being processed.
+func TestAdmissionProcessor(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	requests := make(chan *FAdmissionRequest, 2)
+	processor := newAdmissionProcessor(NewFHealthProcessor(NewFHealthServer()), shedAdmission(requests))
+	transport := NewFLoopbackTransport(processor, protocolFactory)
+	assert.Nil(transport.Open())
+	client := NewFHealthClient(NewFServiceProvider(transport, protocolFactory))
+
+	status, err := client.Check(NewFContext("cid"), "")
+	assert.Nil(err)
+	assert.Equal(HealthServing, status)
+	request := <-requests
+	assert.Equal(1, request.InFlight)
+	assert.Equal("cid", request.Headers[cidHeader])
+
+	ctx := NewFContext("")
+	ctx.AddRequestHeader("shed", "1")
+	_, err = client.Check(ctx, "")
+	assertOverloaded(t, err)
+}
+
+// Ensures the built-in admission controllers reject requests over their
+// limits.
+func TestAdmissionLimits(t *testing.T) {
+	assert := assert.New(t)
+	inFlight := NewFMaxInFlightAdmission(2)
+	assert.Nil(inFlight.Admit(&FAdmissionRequest{InFlight: 2}))
+	assert.Equal(errors.New("2 requests in flight"), inFlight.Admit(&FAdmissionRequest{InFlight: 3}))
+
+	queueWait := NewFMaxQueueWaitAdmission(time.Second)
+	assert.Nil(queueWait.Admit(&FAdmissionRequest{QueueWait: time.Second}))
+	assert.Equal(errors.New("request waited 2s for a worker"),
+		queueWait.Admit(&FAdmissionRequest{QueueWait: 2 * time.Second}))
+}
+
+// Ensures a NATS server rejects the requests its admission controller
+// doesn't admit.
+func TestFStatelessNatsServerAdmissionController(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	requests := make(chan *FAdmissionRequest, 2)
+	server := NewFNatsServerBuilder(conn, NewFHealthProcessor(NewFHealthServer()), protoFactory, []string{"foo"}).
+		WithAdmissionController(shedAdmission(requests)).
+		Build()
+	go func() {
+		assert.Nil(server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+
+	tr := NewFNatsTransport(conn, "foo", "")
+	assert.Nil(tr.Open())
+	defer tr.Close()
+	client := NewFHealthClient(NewFServiceProvider(tr, protoFactory))
+
+	status, err := client.Check(NewFContext("cid"), "")
+	assert.Nil(err)
+	assert.Equal(HealthServing, status)
+	request := <-requests
+	assert.Equal(1, request.InFlight)
+	assert.Equal("cid", request.Headers[cidHeader])
+
+	ctx := NewFContext("")
+	ctx.AddRequestHeader("shed", "1")
+	_, err = client.Check(ctx, "")
+	assertOverloaded(t, err)
+}
+
+// Ensures requests from plain Thrift clients are admitted and processed by
+// servers with interop enabled.
+func TestAdmissionProcessorThriftInterop(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithThriftInterop()
+	requests := make(chan *FAdmissionRequest, 1)
+	processor := newAdmissionProcessor(&serviceProcessor{name: "plain"}, shedAdmission(requests))
+	transport := NewFLoopbackTransport(processor, protocolFactory)
+	assert.Nil(transport.Open())
+
+	buffer := thrift.NewTMemoryBuffer()
+	assert.Nil(writeConformanceMessage(thrift.NewTBinaryProtocolFactoryDefault().GetProtocol(buffer), "conform", thrift.CALL))
+	result, err := transport.Request(NewFContext(""), prependFrameSize(buffer.Bytes()))
+	assert.Nil(err)
+	name, err := thrift.NewTBinaryProtocolTransport(result).ReadString()
+	assert.Nil(err)
+	assert.Equal("plain", name)
+	assert.Empty((<-requests).Headers)
+}
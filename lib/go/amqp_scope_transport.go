@@ -0,0 +1,262 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// amqpMaxMessageSize is the default maximum size of published AMQP messages.
+const amqpMaxMessageSize = 16 * 1024 * 1024
+
+// FAMQPChannel publishes and consumes AMQP messages, such as with RabbitMQ.
+// Frugal doesn't depend on an AMQP client, so implement it with the client of
+// your choice, such as by wrapping an amqp.Channel.
+type FAMQPChannel interface {
+	// Publish sends a message with the given body to the given exchange with
+	// the given routing key. Implementations should declare the exchange,
+	// typically as a topic exchange, if it doesn't exist.
+	Publish(exchange, routingKey string, body []byte) error
+
+	// Consume binds a queue to the given exchange with the given routing key
+	// and calls the handler with the body of each delivery until the
+	// returned io.Closer is closed. An empty queue name requests an
+	// exclusive, auto-deleted queue, so each subscriber receives every
+	// message. Consumers of a named queue share its messages. Deliveries
+	// should be acknowledged when the handler returns nil, and rejected to
+	// be redelivered otherwise.
+	Consume(exchange, routingKey, queue string, handler func(body []byte) error) (io.Closer, error)
+}
+
+// FAMQPExchangeMapper maps a scope topic to the exchange and routing key
+// messages on the topic are published with.
+type FAMQPExchangeMapper func(topic string) (exchange, routingKey string)
+
+// defaultAMQPExchangeMapper publishes each scope to its own exchange, named
+// for the topic up to its last ".", which is the scope prefix and name in
+// topics from generated code, with the whole topic as the routing key.
+func defaultAMQPExchangeMapper(topic string) (string, string) {
+	if i := strings.LastIndex(topic, "."); i > 0 {
+		return topic[:i], topic
+	}
+	return topic, topic
+}
+
+// FAMQPPublisherTransportFactory creates AMQP FPublisherTransports.
+type FAMQPPublisherTransportFactory struct {
+	channel          FAMQPChannel
+	mapper           FAMQPExchangeMapper
+	publishSizeLimit uint
+}
+
+// NewFAMQPPublisherTransportFactory creates an FAMQPPublisherTransportFactory
+// whose transports publish with the given channel. Each scope is published to
+// its own exchange, named for the topic up to its last "." (the scope prefix
+// and name for generated scopes), with the topic as the routing key.
+func NewFAMQPPublisherTransportFactory(channel FAMQPChannel) *FAMQPPublisherTransportFactory {
+	return &FAMQPPublisherTransportFactory{
+		channel:          channel,
+		mapper:           defaultAMQPExchangeMapper,
+		publishSizeLimit: amqpMaxMessageSize,
+	}
+}
+
+// WithExchangeMapper sets how scope topics are mapped to exchanges and
+// routing keys, such as when scopes are generated with a topic delimiter
+// other than ".". Subscribers must map topics the same way.
+func (a *FAMQPPublisherTransportFactory) WithExchangeMapper(mapper FAMQPExchangeMapper) *FAMQPPublisherTransportFactory {
+	a.mapper = mapper
+	return a
+}
+
+// WithPublishSizeLimit sets the maximum size of published messages. Defaults
+// to 16MB.
+func (a *FAMQPPublisherTransportFactory) WithPublishSizeLimit(limit uint) *FAMQPPublisherTransportFactory {
+	a.publishSizeLimit = limit
+	return a
+}
+
+// GetTransport creates a new AMQP FPublisherTransport.
+func (a *FAMQPPublisherTransportFactory) GetTransport() FPublisherTransport {
+	return &fAMQPPublisherTransport{
+		channel:          a.channel,
+		mapper:           a.mapper,
+		publishSizeLimit: a.publishSizeLimit,
+	}
+}
+
+// fAMQPPublisherTransport implements FPublisherTransport.
+type fAMQPPublisherTransport struct {
+	channel          FAMQPChannel
+	mapper           FAMQPExchangeMapper
+	publishSizeLimit uint
+
+	mu     sync.RWMutex
+	isOpen bool
+}
+
+// Open initializes the transport.
+func (a *fAMQPPublisherTransport) Open() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.isOpen = true
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (a *fAMQPPublisherTransport) IsOpen() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.isOpen
+}
+
+// Close closes the transport. The channel is owned by the caller and is not
+// closed.
+func (a *fAMQPPublisherTransport) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.isOpen = false
+	return nil
+}
+
+// GetPublishSizeLimit returns the maximum allowable size of a payload
+// to be published. A non-positive number is returned to indicate an
+// unbounded allowable size.
+func (a *fAMQPPublisherTransport) GetPublishSizeLimit() uint {
+	return a.publishSizeLimit
+}
+
+// Publish sends the given frame to the exchange and routing key for the
+// given topic.
+func (a *fAMQPPublisherTransport) Publish(topic string, data []byte) error {
+	if !a.IsOpen() {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: AMQP FPublisherTransport not open")
+	}
+	if limit := a.publishSizeLimit; limit > 0 && uint(len(data)) > limit {
+		return thrift.NewTTransportException(
+			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", limit, len(data)))
+	}
+	exchange, routingKey := a.mapper(topic)
+	if err := a.channel.Publish(exchange, routingKey, data); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	return nil
+}
+
+// FAMQPSubscriberTransportFactory creates AMQP FSubscriberTransports.
+type FAMQPSubscriberTransportFactory struct {
+	channel FAMQPChannel
+	queue   string
+	mapper  FAMQPExchangeMapper
+}
+
+// NewFAMQPSubscriberTransportFactory creates an
+// FAMQPSubscriberTransportFactory whose transports consume with the given
+// channel. Each subscriber consumes from its own exclusive queue, so every
+// subscriber receives every message.
+func NewFAMQPSubscriberTransportFactory(channel FAMQPChannel) *FAMQPSubscriberTransportFactory {
+	return &FAMQPSubscriberTransportFactory{channel: channel, mapper: defaultAMQPExchangeMapper}
+}
+
+// NewFAMQPSubscriberTransportFactoryWithQueue creates an
+// FAMQPSubscriberTransportFactory whose transports consume from the given
+// named queue, so each message is received by only one of its subscribers.
+func NewFAMQPSubscriberTransportFactoryWithQueue(channel FAMQPChannel, queue string) *FAMQPSubscriberTransportFactory {
+	return &FAMQPSubscriberTransportFactory{channel: channel, queue: queue, mapper: defaultAMQPExchangeMapper}
+}
+
+// WithExchangeMapper sets how scope topics are mapped to exchanges and
+// routing keys, matching the mapping used by publishers.
+func (a *FAMQPSubscriberTransportFactory) WithExchangeMapper(mapper FAMQPExchangeMapper) *FAMQPSubscriberTransportFactory {
+	a.mapper = mapper
+	return a
+}
+
+// GetTransport creates a new AMQP FSubscriberTransport.
+func (a *FAMQPSubscriberTransportFactory) GetTransport() FSubscriberTransport {
+	return &fAMQPSubscriberTransport{channel: a.channel, queue: a.queue, mapper: a.mapper}
+}
+
+// fAMQPSubscriberTransport implements FSubscriberTransport.
+type fAMQPSubscriberTransport struct {
+	channel FAMQPChannel
+	queue   string
+	mapper  FAMQPExchangeMapper
+
+	mu       sync.RWMutex
+	consumer io.Closer
+}
+
+// Subscribe starts consuming messages for the given topic.
+func (a *fAMQPSubscriberTransport) Subscribe(topic string, callback FAsyncCallback) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.consumer != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: AMQP transport already open")
+	}
+	if topic == "" {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"cannot subscribe to empty topic")
+	}
+
+	exchange, routingKey := a.mapper(topic)
+	consumer, err := a.channel.Consume(exchange, routingKey, a.queue, handleAMQPDelivery(callback))
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	a.consumer = consumer
+	return nil
+}
+
+// handleAMQPDelivery returns a handler executing the callback for each
+// delivered frame. Callback errors are returned so the delivery is rejected.
+func handleAMQPDelivery(callback FAsyncCallback) func([]byte) error {
+	return func(body []byte) error {
+		if len(body) < 4 {
+			logger().Warn("frugal: Discarding invalid scope message frame")
+			return nil
+		}
+		return invokeAcked(callback, body[4:])
+	}
+}
+
+// IsSubscribed returns true if the transport is subscribed to a topic, false
+// otherwise.
+func (a *fAMQPSubscriberTransport) IsSubscribed() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.consumer != nil
+}
+
+// Unsubscribe stops consuming messages.
+func (a *fAMQPSubscriberTransport) Unsubscribe() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.consumer == nil {
+		return nil
+	}
+	if err := a.consumer.Close(); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	a.consumer = nil
+	return nil
+}
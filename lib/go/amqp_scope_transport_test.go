@@ -0,0 +1,128 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+type amqpBinding struct {
+	exchange, routingKey, queue string
+	handler                     func([]byte) error
+}
+
+// mockAMQPChannel is an in-memory FAMQPChannel delivering each published
+// message to the consumers bound to its exchange and routing key.
+type mockAMQPChannel struct {
+	mu       sync.Mutex
+	bindings []*amqpBinding
+	rejected int
+}
+
+func (m *mockAMQPChannel) Publish(exchange, routingKey string, body []byte) error {
+	m.mu.Lock()
+	bindings := append([]*amqpBinding(nil), m.bindings...)
+	m.mu.Unlock()
+	for _, binding := range bindings {
+		if binding.exchange == exchange && binding.routingKey == routingKey && binding.handler(body) != nil {
+			m.mu.Lock()
+			m.rejected++
+			m.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+func (m *mockAMQPChannel) Consume(exchange, routingKey, queue string, handler func([]byte) error) (io.Closer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	binding := &amqpBinding{exchange: exchange, routingKey: routingKey, queue: queue, handler: handler}
+	m.bindings = append(m.bindings, binding)
+	return closerFunc(func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for i, b := range m.bindings {
+			if b == binding {
+				m.bindings = append(m.bindings[:i], m.bindings[i+1:]...)
+			}
+		}
+		return nil
+	}), nil
+}
+
+// Ensures scopes are published to their own exchange, routed by topic, and
+// delivered to subscribers of the topic.
+func TestAMQPScopeTransportPublishSubscribe(t *testing.T) {
+	assert := assert.New(t)
+	channel := &mockAMQPChannel{}
+	received := make(chan []byte, 1)
+	subscriber := NewFAMQPSubscriberTransportFactoryWithQueue(channel, "winners").GetTransport()
+	assert.Nil(subscriber.Subscribe("v1.music.AlbumWinners.Winner", func(transport thrift.TTransport) error {
+		payload, err := ioutil.ReadAll(transport)
+		received <- payload
+		return err
+	}))
+	assert.True(subscriber.IsSubscribed())
+	assert.Equal("v1.music.AlbumWinners", channel.bindings[0].exchange)
+	assert.Equal("v1.music.AlbumWinners.Winner", channel.bindings[0].routingKey)
+	assert.Equal("winners", channel.bindings[0].queue)
+
+	publisher := NewFAMQPPublisherTransportFactory(channel).GetTransport()
+	assert.Error(publisher.Publish("v1.music.AlbumWinners.Winner", []byte{0, 0, 0, 1, 1}))
+	assert.Nil(publisher.Open())
+	assert.Nil(publisher.Publish("v1.music.AlbumWinners.ContestStart", []byte{0, 0, 0, 1, 2}))
+	assert.Nil(publisher.Publish("v1.music.AlbumWinners.Winner", []byte{0, 0, 0, 1, 3}))
+	assert.Equal([]byte{3}, <-received)
+	assert.Len(received, 0)
+
+	assert.Nil(subscriber.Unsubscribe())
+	assert.False(subscriber.IsSubscribed())
+	assert.Len(channel.bindings, 0)
+	assert.Nil(publisher.Close())
+}
+
+// Ensures custom exchange mappers are used, callback errors reject the
+// delivery and frames over the size limit aren't published.
+func TestAMQPScopeTransportOptions(t *testing.T) {
+	assert := assert.New(t)
+	channel := &mockAMQPChannel{}
+	mapper := func(topic string) (string, string) {
+		i := strings.LastIndex(topic, ":")
+		return topic[:i], topic[i+1:]
+	}
+	subscriber := NewFAMQPSubscriberTransportFactory(channel).WithExchangeMapper(mapper).GetTransport()
+	assert.Nil(subscriber.Subscribe("scope:op", func(thrift.TTransport) error { return errors.New("failed") }))
+	assert.Equal("scope", channel.bindings[0].exchange)
+	assert.Equal("op", channel.bindings[0].routingKey)
+	assert.Equal("", channel.bindings[0].queue)
+
+	publisher := NewFAMQPPublisherTransportFactory(channel).
+		WithExchangeMapper(mapper).
+		WithPublishSizeLimit(10).
+		GetTransport()
+	assert.Nil(publisher.Open())
+	assert.Equal(uint(10), publisher.GetPublishSizeLimit())
+	assert.Nil(publisher.Publish("scope:op", []byte{0, 0, 0, 1, 1}))
+	assert.Equal(1, channel.rejected)
+	err := publisher.Publish("scope:op", make([]byte, 11))
+	assert.Equal(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, err.(thrift.TTransportException).TypeId())
+}
@@ -0,0 +1,431 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// Header marking the frame a client sends to end its side of a
+	// bidirectional stream.
+	streamEndHeader = "_stream_end"
+
+	// Header carrying the number of further items the sender of a flow
+	// control frame allows the other side of a bidirectional stream to
+	// send.
+	streamCreditHeader = "_stream_credit"
+
+	// streamWindow is the number of items either side of a bidirectional
+	// stream can send before waiting for the other side to receive them.
+	// Servers can send a window of items as soon as the stream is opened,
+	// while clients wait for the server to grant theirs, so items are never
+	// sent before the handler can receive them.
+	streamWindow = 32
+)
+
+// bidiTransport is implemented by transports which support bidirectional
+// streams. As it delivers responses as they arrive, it's also used for
+// asynchronous requests.
+type bidiTransport interface {
+	// openStream transmits the given request and delivers the frames
+	// received in response to the given queue.
+	openStream(ctx FContext, payload []byte, queue *streamQueue) (*streamConn, error)
+}
+
+// streamConn sends the frames of a stream after its request.
+type streamConn struct {
+	// send sends the given frame, including its frame size.
+	send func(frame []byte) error
+
+	// close stops receiving frames, given whether the final frame was
+	// received.
+	close func(finished bool)
+}
+
+// FBidiStream is a call to a bidirectional streaming method, which can keep
+// sending items while receiving the responses to them. Callers send items
+// with Send, end the stream with CloseSend, and receive responses with the
+// embedded FClientStream. Either side waits once it has sent a window of
+// items the other side hasn't received. Methods annotated with
+// (stream="bidi") in the IDL are generated as bidirectional streaming
+// methods, whose items in either direction are messages of the method's
+// result.
+type FBidiStream struct {
+	*FClientStream
+	protocolFactory *FProtocolFactory
+	conn            *streamConn
+	credits         *streamCredits
+	received        int
+
+	mu         sync.Mutex
+	sendClosed bool
+}
+
+// RequestBidiStream transmits the given data with the given FTransport and
+// returns the bidirectional stream it opens, whose items are written with the
+// given protocol factory. It fails with a TTransportException if the
+// transport doesn't support bidirectional streams.
+func RequestBidiStream(transport FTransport, protocolFactory *FProtocolFactory, ctx FContext,
+	payload []byte) (*FBidiStream, error) {
+	bidi, ok := transport.(bidiTransport)
+	if !ok {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"frugal: transport does not support bidirectional streams")
+	}
+
+	credits := newStreamCredits(0)
+	queue := newStreamQueue()
+	queue.control = func(frame []byte) bool {
+		if grantCredit(credits, frame) {
+			return true
+		}
+		// Nothing more can be sent once the server has responded.
+		if _, item, _ := frameHeader(frame, streamItemHeader); !item {
+			credits.end()
+		}
+		return false
+	}
+	conn, err := bidi.openStream(ctx, payload, queue)
+	if err != nil {
+		return nil, err
+	}
+	stream := &FBidiStream{
+		FClientStream:   newFClientStream(ctx, queue, conn.close),
+		protocolFactory: protocolFactory,
+		conn:            conn,
+		credits:         credits,
+	}
+	stream.FClientStream.consumed = stream.consumed
+	return stream, nil
+}
+
+// Send sends an item written to the protocol by the given function, which
+// writes the message and the item. It waits up to the context's timeout for
+// the server to have room for the item, and fails with a TTransportException
+// of type TRANSPORT_EXCEPTION_END_OF_FILE once the server has responded or
+// CloseSend has been called. Send is threadsafe.
+func (s *FBidiStream) Send(write func(*FProtocol) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sendClosed {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_END_OF_FILE,
+			"frugal: stream already closed for sending")
+	}
+	if err := s.credits.acquire(s.ctx, true); err != nil {
+		return err
+	}
+
+	opID, _ := s.ctx.RequestHeader(opIDHeader)
+	headers := map[string]string{
+		cidHeader:        s.ctx.CorrelationID(),
+		opIDHeader:       opID,
+		streamItemHeader: "1",
+	}
+	buffer := NewTMemoryOutputBuffer(0)
+	oprot := s.protocolFactory.GetProtocol(buffer)
+	if err := oprot.writeHeader(headers); err != nil {
+		return err
+	}
+	if err := write(oprot); err != nil {
+		return err
+	}
+	if err := oprot.Flush(); err != nil {
+		return err
+	}
+	return s.conn.send(buffer.Bytes())
+}
+
+// CloseSend ends the client's side of the stream, after which the server
+// receives no more items and the client continues receiving responses. It
+// waits up to the context's timeout for the server to open the stream.
+func (s *FBidiStream) CloseSend() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sendClosed {
+		return nil
+	}
+	s.sendClosed = true
+	if err := s.credits.acquire(s.ctx, false); err != nil {
+		return err
+	}
+	return s.conn.send(s.controlFrame(streamEndHeader, "1"))
+}
+
+// controlFrame returns a control frame with the given header for the stream.
+func (s *FBidiStream) controlFrame(name, value string) []byte {
+	opID, _ := s.ctx.RequestHeader(opIDHeader)
+	return newStreamControlFrame(s.ctx.CorrelationID(), opID, name, value)
+}
+
+// consumed grants the server a batch of credit once enough of the items it
+// sent have been received, unless the server has already responded.
+func (s *FBidiStream) consumed() {
+	if s.received++; s.received < streamWindow/2 || s.credits.isEnded() {
+		return
+	}
+	frame := s.controlFrame(streamCreditHeader, strconv.Itoa(s.received))
+	s.received = 0
+	if err := s.conn.send(frame); err != nil {
+		logger().Warnf("frugal: unable to grant stream credit for request with correlation id %s: %s",
+			s.ctx.CorrelationID(), err)
+	}
+}
+
+// FServerBidiStream is the server side of a call to a bidirectional
+// streaming method. The FProcessorFunction for the method creates one for
+// its handler to receive items from and send items with, and writes the
+// method's ordinary response once the handler returns to end the stream.
+type FServerBidiStream struct {
+	*FServerStream
+	inbox    *streamQueue
+	received int
+	ended    bool
+}
+
+// NewFServerBidiStream returns an FServerBidiStream for the request with the
+// given context, whose response is written to the given output protocol. It
+// fails with a TApplicationException of type
+// APPLICATION_EXCEPTION_STREAMING_UNSUPPORTED if the server doesn't support
+// bidirectional streams. It's called by the FProcessorFunction for the
+// method with the protocols it was given.
+func NewFServerBidiStream(ctx FContext, oprot *FProtocol) (*FServerBidiStream, error) {
+	sink := oprot.stream
+	if sink == nil || sink.inboxes == nil || isPlainThriftContext(ctx) {
+		return nil, thrift.NewTApplicationException(APPLICATION_EXCEPTION_STREAMING_UNSUPPORTED,
+			"frugal: server does not support bidirectional streams")
+	}
+	credits := newStreamCredits(streamWindow)
+	inbox := newStreamQueue()
+	inbox.control = func(frame []byte) bool {
+		return grantCredit(credits, frame)
+	}
+	sink.open(ctx, inbox)
+	stream := &FServerBidiStream{
+		FServerStream: &FServerStream{ctx: ctx, sink: sink, credits: credits},
+		inbox:         inbox,
+	}
+	if err := stream.grant(streamWindow); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Recv waits up to the context's timeout for the next item sent by the
+// client, returning a protocol to read the message and item from. Once the
+// client has ended its side of the stream, Recv returns a TTransportException
+// of type TRANSPORT_EXCEPTION_END_OF_FILE. Recv is not threadsafe.
+func (s *FServerBidiStream) Recv() (*FProtocol, error) {
+	if s.ended {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_END_OF_FILE,
+			"frugal: stream ended by client")
+	}
+	frame, err := s.inbox.next(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, end, _ := frameHeader(frame, streamEndHeader); end {
+		s.ended = true
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_END_OF_FILE,
+			"frugal: stream ended by client")
+	}
+	iprot := s.sink.protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame)})
+	if _, err := iprot.readHeader(); err != nil {
+		return nil, err
+	}
+	if s.received++; s.received >= streamWindow/2 {
+		if err := s.grant(s.received); err != nil {
+			logger().Warnf("frugal: unable to grant stream credit for request with correlation id %s: %s",
+				s.ctx.CorrelationID(), err)
+		}
+		s.received = 0
+	}
+	return iprot, nil
+}
+
+// grant allows the client to send the given number of further items.
+func (s *FServerBidiStream) grant(credit int) error {
+	opID, _ := s.ctx.ResponseHeader(opIDHeader)
+	return s.sink.send(newStreamControlFrame(s.ctx.CorrelationID(), opID, streamCreditHeader, strconv.Itoa(credit)))
+}
+
+// newStreamControlFrame returns a framed control frame with the given header
+// for the stream of the request with the given correlation id and opid.
+func newStreamControlFrame(cid, opID, name, value string) []byte {
+	headers := v0Marshaler.marshalHeaders(map[string]string{
+		cidHeader:  cid,
+		opIDHeader: opID,
+		name:       value,
+	})
+	return prependFrameSize(headers)
+}
+
+// isStreamFrame indicates if the given frame, including its frame size, was
+// sent by a client on a bidirectional stream after the request which opened
+// it. Servers deliver these to the stream rather than processing them.
+func isStreamFrame(frame []byte) bool {
+	if len(frame) < 5 || !bytes.Contains(frame, []byte("_stream_")) {
+		return false
+	}
+	for _, name := range []string{streamItemHeader, streamEndHeader, streamCreditHeader} {
+		if _, ok, err := frameHeader(frame[4:], name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// grantCredit grants the given credits the credit carried by the given frame,
+// returning false if it isn't a flow control frame.
+func grantCredit(credits *streamCredits, frame []byte) bool {
+	value, ok, err := frameHeader(frame, streamCreditHeader)
+	if err != nil || !ok {
+		return false
+	}
+	credit, err := strconv.Atoi(value)
+	if err != nil || credit <= 0 {
+		logger().Warnf("frugal: discarding invalid stream credit %q", value)
+		return true
+	}
+	credits.grant(credit)
+	return true
+}
+
+// streamInboxes are the queues of the bidirectional streams open on a
+// server, keyed by the correlation id and opid of the requests which opened
+// them.
+type streamInboxes struct {
+	mu      sync.Mutex
+	inboxes map[string]*streamQueue
+}
+
+func newStreamInboxes() *streamInboxes {
+	return &streamInboxes{inboxes: make(map[string]*streamQueue)}
+}
+
+func (s *streamInboxes) add(key string, inbox *streamQueue) {
+	s.mu.Lock()
+	s.inboxes[key] = inbox
+	s.mu.Unlock()
+}
+
+func (s *streamInboxes) remove(key string) {
+	s.mu.Lock()
+	delete(s.inboxes, key)
+	s.mu.Unlock()
+}
+
+// deliver queues the given stream frame, including its frame size, on the
+// stream it was sent on. Frames for streams which aren't open are dropped.
+func (s *streamInboxes) deliver(frame []byte) {
+	frame = frame[4:]
+	cid, _, err := frameHeader(frame, cidHeader)
+	if err != nil {
+		logger().Warnf("frugal: discarding invalid stream frame: %s", err)
+		return
+	}
+	opID, _, err := frameHeader(frame, opIDHeader)
+	if err != nil {
+		logger().Warnf("frugal: discarding invalid stream frame: %s", err)
+		return
+	}
+	s.mu.Lock()
+	inbox, ok := s.inboxes[cid+"/"+opID]
+	s.mu.Unlock()
+	if !ok {
+		// Flow control frames can race the end of the stream.
+		logger().Debugf("frugal: discarding frame for unknown stream with correlation id %s", cid)
+		return
+	}
+	inbox.push(frame)
+}
+
+// streamCredits counts the items one side of a bidirectional stream can send
+// before the other side grants it more.
+type streamCredits struct {
+	mu      sync.Mutex
+	credits int
+	granted bool
+	ended   bool
+	ready   chan struct{}
+}
+
+func newStreamCredits(credits int) *streamCredits {
+	return &streamCredits{credits: credits, granted: credits > 0, ready: make(chan struct{}, 1)}
+}
+
+// grant allows the given number of further items to be sent.
+func (c *streamCredits) grant(credits int) {
+	c.mu.Lock()
+	c.credits += credits
+	c.granted = true
+	c.mu.Unlock()
+	c.notify()
+}
+
+// end fails any further attempts to acquire credit, as the stream has ended.
+func (c *streamCredits) end() {
+	c.mu.Lock()
+	c.ended = true
+	c.mu.Unlock()
+	c.notify()
+}
+
+func (c *streamCredits) isEnded() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ended
+}
+
+func (c *streamCredits) notify() {
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// acquire waits up to the given context's timeout for credit to be granted,
+// taking one if take is true. Only one caller may wait at a time.
+func (c *streamCredits) acquire(ctx FContext, take bool) error {
+	timeout := time.NewTimer(ctx.Timeout())
+	defer timeout.Stop()
+	for {
+		c.mu.Lock()
+		if c.ended {
+			c.mu.Unlock()
+			return thrift.NewTTransportException(TRANSPORT_EXCEPTION_END_OF_FILE, "frugal: stream ended")
+		}
+		if c.credits > 0 || (!take && c.granted) {
+			if take {
+				c.credits--
+			}
+			c.mu.Unlock()
+			return nil
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.ready:
+		case <-contextDone(ctx):
+			return thrift.NewTTransportException(TRANSPORT_EXCEPTION_CANCELLED, "frugal: stream cancelled")
+		case <-timeout.C:
+			return thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT,
+				"frugal: timed out waiting for stream credit")
+		}
+	}
+}
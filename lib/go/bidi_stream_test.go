@@ -0,0 +1,174 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// doubleProcessor responds to each number sent on a bidirectional stream
+// with double the number, then responds with how many numbers were sent, as
+// generated code for a bidirectional streaming method would.
+type doubleProcessor struct {
+	processor
+}
+
+func (p *doubleProcessor) Process(iprot, oprot *FProtocol) error {
+	ctx, err := iprot.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	name, _, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	iprot.ReadMessageEnd()
+
+	stream, err := NewFServerBidiStream(ctx, oprot)
+	if err != nil {
+		return writeExceptionResponse(oprot, ctx, name, err.(thrift.TApplicationException))
+	}
+	count := int32(0)
+	for {
+		proto, err := stream.Recv()
+		if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		proto.ReadMessageBegin()
+		value, err := proto.ReadI32()
+		if err != nil {
+			return err
+		}
+		proto.ReadMessageEnd()
+		count++
+		if err := stream.Send(writeI32(name, 2*value)); err != nil {
+			return err
+		}
+	}
+	if err := oprot.WriteResponseHeader(ctx); err != nil {
+		return err
+	}
+	writeI32(name, count)(oprot)
+	return oprot.Flush()
+}
+
+// writeI32 returns a function writing a message carrying the given number.
+func writeI32(name string, value int32) func(*FProtocol) error {
+	return func(oprot *FProtocol) error {
+		if err := oprot.WriteMessageBegin(name, thrift.REPLY, 0); err != nil {
+			return err
+		}
+		if err := oprot.WriteI32(value); err != nil {
+			return err
+		}
+		return oprot.WriteMessageEnd()
+	}
+}
+
+// assertDoubleStream asserts the given transport carries a bidirectional
+// stream of more numbers than fit in a flow control window.
+func assertDoubleStream(t *testing.T, protoFactory *FProtocolFactory, transport FTransport) {
+	assert := assert.New(t)
+	const count = 3 * streamWindow
+	ctx := NewFContext("")
+	stream, err := RequestBidiStream(transport, protoFactory, ctx, requestCount(protoFactory, ctx, 0))
+	if !assert.Nil(err) {
+		return
+	}
+	defer stream.Close()
+
+	sendErr := make(chan error, 1)
+	go func() {
+		for i := int32(0); i < count; i++ {
+			if err := stream.Send(writeI32("double", i)); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- stream.CloseSend()
+	}()
+	for i := int32(0); i < count; i++ {
+		value, item := recvCount(t, protoFactory, ctx, stream.FClientStream)
+		assert.True(item)
+		assert.Equal(2*i, value)
+	}
+	assert.Nil(<-sendErr)
+	value, item := recvCount(t, protoFactory, ctx, stream.FClientStream)
+	assert.False(item)
+	assert.Equal(int32(count), value)
+
+	err = stream.Send(writeI32("double", 0))
+	assert.Equal(TRANSPORT_EXCEPTION_END_OF_FILE, err.(thrift.TTransportException).TypeId())
+}
+
+// Ensures bidirectional streams work over the loopback transport.
+func TestLoopbackTransportBidiStream(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFLoopbackTransport(&doubleProcessor{}, protoFactory)
+	assert.Nil(t, transport.Open())
+	defer transport.Close()
+	assertDoubleStream(t, protoFactory, transport)
+}
+
+// Ensures bidirectional streams work over NATS when the server supports
+// streaming.
+func TestNatsTransportBidiStream(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := serveNats(t, NewFNatsServerBuilder(conn, &doubleProcessor{}, protoFactory, []string{"double"}).
+		WithServerStreaming())
+	defer server.Stop()
+
+	transport := NewFNatsTransport(conn, "double", "")
+	assert.Nil(transport.Open())
+	defer transport.Close()
+	assertDoubleStream(t, protoFactory, transport)
+}
+
+// Ensures stream credit is waited for, taken, and fails once the stream
+// ends.
+func TestStreamCredits(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("").SetTimeout(10 * time.Millisecond)
+	credits := newStreamCredits(0)
+	err := credits.acquire(ctx, false)
+	assert.Equal(TRANSPORT_EXCEPTION_TIMED_OUT, err.(thrift.TTransportException).TypeId())
+
+	credits.grant(1)
+	assert.Nil(credits.acquire(ctx, true))
+	assert.Nil(credits.acquire(ctx, false))
+	err = credits.acquire(ctx, true)
+	assert.Equal(TRANSPORT_EXCEPTION_TIMED_OUT, err.(thrift.TTransportException).TypeId())
+
+	credits.grant(1)
+	credits.end()
+	err = credits.acquire(ctx, true)
+	assert.Equal(TRANSPORT_EXCEPTION_END_OF_FILE, err.(thrift.TTransportException).TypeId())
+}
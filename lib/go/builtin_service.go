@@ -0,0 +1,182 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// builtinFunction is the FProcessorFunction of a method of a service built
+// into the library, such as the health service, whose arguments and result
+// are read and written by hand in place of generated code.
+type builtinFunction struct {
+	*FBaseProcessorFunction
+	name string
+
+	// readArgs reads the arguments struct, returning the arguments to invoke
+	// the handler with after the FContext.
+	readArgs func(iprot *FProtocol) ([]interface{}, error)
+
+	// writeResult writes the result struct for the handler's return value.
+	writeResult func(oprot *FProtocol, result interface{}) error
+}
+
+func (p *builtinFunction) Process(ctx FContext, iprot, oprot *FProtocol) error {
+	args, err := p.readArgs(iprot)
+	if err != nil {
+		iprot.ReadMessageEnd()
+		ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_PROTOCOL_ERROR, err.Error())
+		p.GetWriteMutex().Lock()
+		defer p.GetWriteMutex().Unlock()
+		if err := writeExceptionResponse(oprot, ctx, p.name, ex); err != nil {
+			return err
+		}
+		return ex
+	}
+	iprot.ReadMessageEnd()
+
+	ret := p.InvokeMethod(append([]interface{}{ctx}, args...))
+	if len(ret) != 2 {
+		panic(fmt.Sprintf("Middleware returned %d arguments, expected 2", len(ret)))
+	}
+	p.GetWriteMutex().Lock()
+	defer p.GetWriteMutex().Unlock()
+	if err := ret.Error(); err != nil {
+		if ex, ok := err.(thrift.TApplicationException); ok {
+			return writeExceptionResponse(oprot, ctx, p.name, ex)
+		}
+		ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_INTERNAL_ERROR,
+			"Internal error processing "+p.name+": "+err.Error())
+		if err := writeExceptionResponse(oprot, ctx, p.name, ex); err != nil {
+			return err
+		}
+		return ex
+	}
+	if err := oprot.WriteResponseHeader(ctx); err != nil {
+		return err
+	}
+	if err := oprot.WriteMessageBegin(p.name, thrift.REPLY, 0); err != nil {
+		return err
+	}
+	if err := p.writeResult(oprot, ret[0]); err != nil {
+		return err
+	}
+	if err := oprot.WriteMessageEnd(); err != nil {
+		return err
+	}
+	return oprot.Flush()
+}
+
+// callBuiltin calls the given method of a service built into the library,
+// writing its arguments struct and reading its result struct with the given
+// functions.
+func callBuiltin(transport FTransport, protocolFactory *FProtocolFactory, ctx FContext, method string,
+	writeArgs func(oprot *FProtocol) error, readResult func(iprot *FProtocol) error) error {
+	buffer := NewTMemoryOutputBuffer(transport.GetRequestSizeLimit())
+	oprot := protocolFactory.GetProtocol(buffer)
+	if err := oprot.WriteRequestHeader(ctx); err != nil {
+		return err
+	}
+	if err := oprot.WriteMessageBegin(method, thrift.CALL, 0); err != nil {
+		return err
+	}
+	if err := writeArgs(oprot); err != nil {
+		return err
+	}
+	if err := oprot.WriteMessageEnd(); err != nil {
+		return err
+	}
+	if err := oprot.Flush(); err != nil {
+		return err
+	}
+	resultTransport, err := transport.Request(ctx, buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	iprot := protocolFactory.GetProtocol(resultTransport)
+	if err := iprot.ReadResponseHeader(ctx); err != nil {
+		return err
+	}
+	name, mTypeID, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	if name != method {
+		return thrift.NewTApplicationException(APPLICATION_EXCEPTION_WRONG_METHOD_NAME,
+			method+" failed: wrong method name")
+	}
+	if mTypeID == thrift.EXCEPTION {
+		ex, err := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN, "Unknown Exception").Read(iprot)
+		if err != nil {
+			return err
+		}
+		if err := iprot.ReadMessageEnd(); err != nil {
+			return err
+		}
+		return ex
+	}
+	if mTypeID != thrift.REPLY {
+		return thrift.NewTApplicationException(APPLICATION_EXCEPTION_INVALID_MESSAGE_TYPE,
+			method+" failed: invalid message type")
+	}
+	if err := readResult(iprot); err != nil {
+		return err
+	}
+	return iprot.ReadMessageEnd()
+}
+
+// writeEmptyStruct writes a struct without fields, such as the arguments
+// struct of a method without arguments.
+func writeEmptyStruct(oprot *FProtocol, name string) error {
+	if err := oprot.WriteStructBegin(name); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldStop(); err != nil {
+		return err
+	}
+	return oprot.WriteStructEnd()
+}
+
+// readStructFields reads a struct, passing each field to the given function,
+// which returns whether it read the field. Fields it doesn't read are
+// skipped.
+func readStructFields(iprot *FProtocol, readField func(int16, thrift.TType) (bool, error)) error {
+	if _, err := iprot.ReadStructBegin(); err != nil {
+		return err
+	}
+	for {
+		_, typeID, id, err := iprot.ReadFieldBegin()
+		if err != nil {
+			return err
+		}
+		if typeID == thrift.STOP {
+			break
+		}
+		read, err := readField(id, typeID)
+		if err != nil {
+			return err
+		}
+		if !read {
+			if err := iprot.Skip(typeID); err != nil {
+				return err
+			}
+		}
+		if err := iprot.ReadFieldEnd(); err != nil {
+			return err
+		}
+	}
+	return iprot.ReadStructEnd()
+}
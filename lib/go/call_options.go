@@ -0,0 +1,62 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import "time"
+
+// CallOption overrides a setting for calls made with a generated client, such
+// as their timeout or a request header. Options are bound to a copy of the
+// client with its WithCallOptions method:
+//
+//	client.WithCallOptions(frugal.WithCallTimeout(2*time.Second)).GetUser(ctx, id)
+type CallOption func(FContext)
+
+// WithCallTimeout overrides the timeout of the FContext for a single call.
+func WithCallTimeout(timeout time.Duration) CallOption {
+	return func(ctx FContext) {
+		ctx.SetTimeout(timeout)
+	}
+}
+
+// WithHeader adds a request header for a single call.
+func WithHeader(name, value string) CallOption {
+	return func(ctx FContext) {
+		ctx.AddRequestHeader(name, value)
+	}
+}
+
+// ApplyCallOptions returns the FContext a call should be made with given its
+// options, along with a function to call once the call completes. Without
+// options, the FContext is returned as is. Otherwise the options are applied
+// to a clone so the caller's FContext, which may be shared with other calls,
+// is left untouched, and the returned function copies the response headers of
+// the call from the clone back to the caller's FContext. Generated clients
+// call this before invoking middleware.
+func ApplyCallOptions(ctx FContext, opts ...CallOption) (FContext, func()) {
+	if len(opts) == 0 {
+		return ctx, func() {}
+	}
+	call := Clone(ctx)
+	for _, opt := range opts {
+		opt(call)
+	}
+	return call, func() {
+		RangeResponseHeaders(call, func(name, value string) bool {
+			if name != opIDHeader {
+				setResponseHeader(ctx, name, value)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures call options are applied to a clone of the FContext, leaving the
+// caller's FContext untouched.
+func TestApplyCallOptions(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("cid")
+	unchanged, _ := ApplyCallOptions(ctx)
+	assert.Equal(ctx, unchanged)
+
+	applied, _ := ApplyCallOptions(ctx, WithCallTimeout(time.Second), WithHeader("tenant", "acme"))
+	assert.Equal(time.Second, applied.Timeout())
+	assert.Equal("cid", applied.CorrelationID())
+	tenant, ok := applied.RequestHeader("tenant")
+	assert.True(ok)
+	assert.Equal("acme", tenant)
+
+	assert.Equal(defaultTimeout, ctx.Timeout())
+	_, ok = ctx.RequestHeader("tenant")
+	assert.False(ok)
+}
+
+// Ensures the response headers of a call made with call options are copied
+// back to the caller's FContext once the call completes.
+func TestApplyCallOptionsResponseHeaders(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("cid")
+	opID := ctx.ResponseHeaders()[opIDHeader]
+	applied, finish := ApplyCallOptions(ctx, WithCallTimeout(time.Second))
+	applied.AddResponseHeader("_cache_ttl", "30")
+	setResponseHeader(applied, opIDHeader, "123")
+	_, ok := ctx.ResponseHeader("_cache_ttl")
+	assert.False(ok)
+
+	finish()
+	ttl, ok := ctx.ResponseHeader("_cache_ttl")
+	assert.True(ok)
+	assert.Equal("30", ttl)
+	assert.Equal(opID, ctx.ResponseHeaders()[opIDHeader])
+}
+
+// Ensures clients pass the FContext with their call options applied to
+// middleware and the transport.
+func TestClientCallOptions(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFLoopbackTransport(NewFHealthProcessor(NewFHealthServer()), protocolFactory)
+	assert.Nil(transport.Open())
+	var called FContext
+	middleware := func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			called = args.Context()
+			return next(service, method, args)
+		}
+	}
+	client := NewFHealthClient(NewFServiceProvider(transport, protocolFactory), middleware)
+
+	status, err := client.WithCallOptions(WithCallTimeout(time.Second)).
+		WithCallOptions(WithHeader("tenant", "acme")).Check(NewFContext(""), "")
+	assert.Nil(err)
+	assert.Equal(HealthServing, status)
+	assert.Equal(time.Second, called.Timeout())
+	tenant, _ := called.RequestHeader("tenant")
+	assert.Equal("acme", tenant)
+}
@@ -0,0 +1,268 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Header marking a frame as a cancellation of the request with the same
+// correlation id and opid. Cancel frames carry no message payload.
+const cancelHeader = "_cancel"
+
+// closedChan is a reusable closed channel returned by Done for contexts which
+// were cancelled before Done was first called.
+var closedChan = make(chan struct{})
+
+func init() {
+	close(closedChan)
+}
+
+// Cancel marks the context as cancelled, closing the channel returned by
+// Done. On the client, cancelling a context abandons any request in flight
+// with it: the transport returns a TTransportException with type
+// TRANSPORT_EXCEPTION_CANCELLED and, for NATS transports built with
+// FNatsTransportBuilder.WithCancellation, notifies the server so it can stop
+// work on the request. On the server, the context is cancelled
+// when such a notification arrives. A cancelled context stays cancelled, so
+// use Clone to obtain a context for a new request. Calling Cancel more than
+// once has no further effect.
+func (c *FContextImpl) Cancel() {
+	c.mu.Lock()
+	if c.cancelled {
+		c.mu.Unlock()
+		return
+	}
+	c.cancelled = true
+	if c.done == nil {
+		c.done = closedChan
+	} else {
+		close(c.done)
+	}
+	funcs := c.cancelFuncs
+	c.cancelFuncs = nil
+	c.mu.Unlock()
+
+	for _, f := range funcs {
+		f()
+	}
+}
+
+// afterCancel arranges for the given function to be called once the context
+// is cancelled, without a goroutine waiting on Done. It returns a function
+// which stops the call if it hasn't happened yet. If the context is already
+// cancelled, the function is called immediately.
+func (c *FContextImpl) afterCancel(f func()) (stop func()) {
+	c.mu.Lock()
+	if c.cancelled {
+		c.mu.Unlock()
+		f()
+		return func() {}
+	}
+	if c.cancelFuncs == nil {
+		c.cancelFuncs = make(map[uint64]func())
+	}
+	c.cancelFuncID++
+	id := c.cancelFuncID
+	c.cancelFuncs[id] = f
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		delete(c.cancelFuncs, id)
+		c.mu.Unlock()
+	}
+}
+
+// Done returns a channel which is closed when the context is cancelled.
+// Server handlers can select on it to stop work on requests the client has
+// abandoned.
+func (c *FContextImpl) Done() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+	return c.done
+}
+
+// contextDone returns the Done channel of the given FContext, or nil if the
+// implementation does not support cancellation. Receiving from a nil channel
+// blocks forever, so the result is always safe to select on.
+func contextDone(ctx FContext) <-chan struct{} {
+	if c, ok := ctx.(interface {
+		Done() <-chan struct{}
+	}); ok {
+		return c.Done()
+	}
+	return nil
+}
+
+// contextAfterCancel calls the given function once the given FContext is
+// cancelled, if the implementation supports cancellation, returning a
+// function which stops the call.
+func contextAfterCancel(ctx FContext, f func()) (stop func()) {
+	if c, ok := ctx.(interface {
+		afterCancel(func()) func()
+	}); ok {
+		return c.afterCancel(f)
+	}
+	return func() {}
+}
+
+// newCancelFrame returns a framed cancellation for the request currently in
+// flight with the given context.
+func newCancelFrame(ctx FContext) []byte {
+	opID, _ := ctx.RequestHeader(opIDHeader)
+	headers := v0Marshaler.marshalHeaders(map[string]string{
+		cidHeader:    ctx.CorrelationID(),
+		opIDHeader:   opID,
+		cancelHeader: "1",
+	})
+	return prependFrameSize(headers)
+}
+
+// isCancelFrame indicates if the given frame, including its frame size, is a
+// cancellation. Servers use this to handle cancellations ahead of queued
+// requests.
+func isCancelFrame(frame []byte) bool {
+	if len(frame) < 5 || !bytes.Contains(frame, []byte(cancelHeader)) {
+		return false
+	}
+	_, ok, err := frameHeader(frame[4:], cancelHeader)
+	return err == nil && ok
+}
+
+// inFlightRequests tracks the server contexts of requests being processed so
+// they can be cancelled by the client.
+type inFlightRequests struct {
+	mu       sync.Mutex
+	contexts map[string]*FContextImpl
+}
+
+func newInFlightRequests() *inFlightRequests {
+	return &inFlightRequests{contexts: make(map[string]*FContextImpl)}
+}
+
+// inFlightKey returns the key identifying the request the given server
+// context was read for. Opids are only unique per client, so they are
+// qualified by the correlation id.
+func inFlightKey(ctx FContext) string {
+	opID, _ := ctx.ResponseHeader(opIDHeader)
+	return ctx.CorrelationID() + "/" + opID
+}
+
+// add tracks the given server context and returns the key to remove it with.
+// Contexts which don't support cancellation aren't tracked.
+func (r *inFlightRequests) add(ctx FContext) string {
+	c, ok := ctx.(*FContextImpl)
+	if !ok {
+		return ""
+	}
+	key := inFlightKey(ctx)
+	r.mu.Lock()
+	r.contexts[key] = c
+	r.mu.Unlock()
+	return key
+}
+
+func (r *inFlightRequests) remove(key string) {
+	if key == "" {
+		return
+	}
+	r.mu.Lock()
+	delete(r.contexts, key)
+	r.mu.Unlock()
+}
+
+// cancel cancels the in-flight request matching the given cancel frame
+// context. Cancellations for requests which have already completed, or have
+// not yet started, are ignored.
+func (r *inFlightRequests) cancel(ctx FContext) {
+	key := inFlightKey(ctx)
+	r.mu.Lock()
+	c, ok := r.contexts[key]
+	r.mu.Unlock()
+	if ok {
+		c.Cancel()
+	}
+}
+
+// queuedRequests tracks request frames waiting in a server's work queue so
+// cancellations arriving before a worker picks up the request aren't lost.
+type queuedRequests struct {
+	mu     sync.Mutex
+	frames map[string]*frameWrapper
+}
+
+func newQueuedRequests() *queuedRequests {
+	return &queuedRequests{frames: make(map[string]*frameWrapper)}
+}
+
+// queuedKey returns the key identifying the request carried by the given
+// frame, excluding its frame size, matching inFlightKey for the context read
+// from it. The ok result is false if the frame has no readable headers.
+func queuedKey(frame []byte) (string, bool) {
+	cid, _, err := frameHeader(frame, cidHeader)
+	if err != nil {
+		return "", false
+	}
+	opID, _, err := frameHeader(frame, opIDHeader)
+	if err != nil {
+		return "", false
+	}
+	return cid + "/" + opID, true
+}
+
+// add tracks the given queued frame.
+func (q *queuedRequests) add(frame *frameWrapper) {
+	key, ok := queuedKey(frame.frameBytes[4:])
+	if !ok {
+		return
+	}
+	frame.key = key
+	q.mu.Lock()
+	q.frames[key] = frame
+	q.mu.Unlock()
+}
+
+// take stops tracking the given frame as a worker picks it up, returning
+// false if the request was cancelled while queued.
+func (q *queuedRequests) take(frame *frameWrapper) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.frames[frame.key] == frame {
+		delete(q.frames, frame.key)
+	}
+	return !frame.cancelled
+}
+
+// cancel marks the queued request matching the given cancel frame, excluding
+// its frame size, as cancelled so workers skip it. It returns false if no
+// such request is queued.
+func (q *queuedRequests) cancel(frame []byte) bool {
+	key, ok := queuedKey(frame)
+	if !ok {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queued, ok := q.frames[key]
+	if !ok {
+		return false
+	}
+	delete(q.frames, key)
+	queued.cancelled = true
+	return true
+}
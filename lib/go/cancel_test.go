@@ -0,0 +1,177 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingProcessorFunction blocks until its context is cancelled.
+type blockingProcessorFunction struct {
+	started   chan FContext
+	cancelled chan struct{}
+}
+
+func (b *blockingProcessorFunction) Process(ctx FContext, in, out *FProtocol) error {
+	b.started <- ctx
+	<-contextDone(ctx)
+	close(b.cancelled)
+	return nil
+}
+
+func (b *blockingProcessorFunction) AddMiddleware(middleware ServiceMiddleware) {}
+
+// Ensures Cancel closes the Done channel whether or not Done was called
+// first, and that repeated calls are safe.
+func TestFContextImplCancel(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("").(*FContextImpl)
+	done := ctx.Done()
+	select {
+	case <-done:
+		t.Fatal("Expected context not to be cancelled")
+	default:
+	}
+	ctx.Cancel()
+	ctx.Cancel()
+	_, ok := <-done
+	assert.False(ok)
+
+	ctx = NewFContext("").(*FContextImpl)
+	ctx.Cancel()
+	_, ok = <-ctx.Done()
+	assert.False(ok)
+
+	// Clones are not cancelled.
+	clone := Clone(ctx).(*FContextImpl)
+	select {
+	case <-clone.Done():
+		t.Fatal("Expected clone not to be cancelled")
+	default:
+	}
+}
+
+// Ensures functions registered with afterCancel are called once when the
+// context is cancelled, unless stopped, and immediately once it has been.
+func TestFContextImplAfterCancel(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("").(*FContextImpl)
+	called, stopped := 0, 0
+	ctx.afterCancel(func() { called++ })
+	stop := ctx.afterCancel(func() { stopped++ })
+	stop()
+	ctx.Cancel()
+	ctx.Cancel()
+	assert.Equal(1, called)
+	assert.Equal(0, stopped)
+
+	ctx.afterCancel(func() { called++ })
+	assert.Equal(2, called)
+}
+
+// Ensures cancel frames carry the correlation id and opid of the request and
+// are recognized by isCancelFrame.
+func TestCancelFrame(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("cid")
+	frame := newCancelFrame(ctx)
+	assert.True(isCancelFrame(frame))
+	headers, err := getHeadersFromFrame(frame[4:])
+	assert.Nil(err)
+	opID, _ := ctx.RequestHeader(opIDHeader)
+	assert.Equal(map[string]string{cidHeader: "cid", opIDHeader: opID, cancelHeader: "1"}, headers)
+
+	assert.False(isCancelFrame(basicFrame))
+	assert.False(isCancelFrame([]byte("_cancel")))
+}
+
+// Ensures FBaseProcessor cancels the context of an in-flight request when a
+// cancel frame for it is processed, without writing a response.
+func TestFBaseProcessorCancel(t *testing.T) {
+	assert := assert.New(t)
+	processor := NewFBaseProcessor()
+	processorFunction := &blockingProcessorFunction{
+		started:   make(chan FContext, 1),
+		cancelled: make(chan struct{}),
+	}
+	processor.AddToProcessorMap("ping", processorFunction)
+
+	clientCtx := NewFContext("cid")
+	request := &thrift.TMemoryBuffer{Buffer: new(bytes.Buffer)}
+	proto := NewFProtocol(thrift.NewTBinaryProtocolTransport(request))
+	assert.Nil(proto.WriteRequestHeader(clientCtx))
+	assert.Nil(proto.WriteMessageBegin("ping", thrift.CALL, 0))
+	assert.Nil(proto.WriteMessageEnd())
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- processor.Process(proto, proto)
+	}()
+	serverCtx := <-processorFunction.started
+
+	// A cancel for a different client doesn't affect the request.
+	other := NewFContext("other")
+	setRequestOpID(other, mustGetOpID(t, clientCtx))
+	processCancelFrame(t, processor, other)
+	select {
+	case <-contextDone(serverCtx):
+		t.Fatal("Expected request not to be cancelled")
+	default:
+	}
+
+	processCancelFrame(t, processor, clientCtx)
+	select {
+	case <-processorFunction.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected request to be cancelled")
+	}
+	assert.Nil(<-errC)
+	assert.Empty(processor.inFlight.contexts)
+}
+
+// Ensures the context.Context returned by ToContext is cancelled when the
+// FContext is cancelled.
+func TestToContextCancel(t *testing.T) {
+	fctx := NewFContext("")
+	ctx, cancel := ToContext(fctx)
+	defer cancel()
+	fctx.(*FContextImpl).Cancel()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected context to be cancelled")
+	}
+}
+
+func processCancelFrame(t *testing.T, processor *FBaseProcessor, ctx FContext) {
+	buff := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(newCancelFrame(ctx)[4:])}
+	out := &thrift.TMemoryBuffer{Buffer: new(bytes.Buffer)}
+	assert.Nil(t, processor.Process(
+		NewFProtocol(thrift.NewTBinaryProtocolTransport(buff)),
+		NewFProtocol(thrift.NewTBinaryProtocolTransport(out))))
+	assert.Equal(t, 0, out.Len())
+}
+
+func mustGetOpID(t *testing.T, ctx FContext) uint64 {
+	opID, err := getOpID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opID
+}
@@ -0,0 +1,318 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	defaultCircuitWindowSize    = 20
+	defaultCircuitMinCalls      = 10
+	defaultCircuitFailureRate   = 0.5
+	defaultCircuitOpenDuration  = 5 * time.Second
+	defaultCircuitHalfOpenCalls = 1
+)
+
+// FCircuitState is the state of a circuit breaker.
+type FCircuitState int32
+
+const (
+	// CircuitClosed is the state in which calls are made and their outcomes
+	// recorded.
+	CircuitClosed FCircuitState = iota
+
+	// CircuitOpen is the state in which calls fail without being made, until
+	// the open duration elapses.
+	CircuitOpen
+
+	// CircuitHalfOpen is the state in which a limited number of trial calls
+	// are made to decide whether to close the circuit again.
+	CircuitHalfOpen
+)
+
+// String returns the name of the state.
+func (s FCircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "CLOSED"
+	case CircuitOpen:
+		return "OPEN"
+	case CircuitHalfOpen:
+		return "HALF_OPEN"
+	}
+	return fmt.Sprintf("FCircuitState(%d)", int32(s))
+}
+
+// FCircuitBreakerConfig configures NewCircuitBreakerMiddleware. Zero values
+// use the defaults.
+type FCircuitBreakerConfig struct {
+	// WindowSize is the number of most recent calls the failure and slow
+	// call rates are measured over. Defaults to 20.
+	WindowSize uint
+
+	// MinCalls is the number of calls which must be in the window before the
+	// circuit can open. Defaults to 10.
+	MinCalls uint
+
+	// FailureRate is the ratio of failed calls in the window at which the
+	// circuit opens. Defaults to 0.5.
+	FailureRate float64
+
+	// SlowCallDuration is how long a call can take before it's counted as
+	// slow. Zero disables counting slow calls.
+	SlowCallDuration time.Duration
+
+	// SlowCallRate is the ratio of slow calls in the window at which the
+	// circuit opens. Zero disables opening on slow calls.
+	SlowCallRate float64
+
+	// OpenDuration is how long the circuit stays open before trial calls are
+	// made. Defaults to 5s.
+	OpenDuration time.Duration
+
+	// HalfOpenCalls is the number of trial calls made while half-open, all
+	// of which must succeed, and not be slow, to close the circuit. Defaults
+	// to 1.
+	HalfOpenCalls uint
+
+	// IsFailure reports whether a call which returned the given error
+	// counts as failed. If nil, TTransportExceptions and
+	// TApplicationExceptions count as failures, but exceptions defined in
+	// the service IDL don't, as they are valid responses.
+	IsFailure func(err error) bool
+
+	// OnStateChange, if set, is called when the circuit of a method changes
+	// state.
+	OnStateChange func(method string, from, to FCircuitState)
+}
+
+// NewCircuitBreakerMiddleware returns ServiceMiddleware which stops making
+// calls to a method while they are failing, so clients stop hammering a
+// struggling dependency. Each method has its own circuit. While a circuit is
+// open, calls fail with a TTransportException of type
+// TRANSPORT_EXCEPTION_CIRCUIT_OPEN without being made. Apply it to a client
+// when creating it:
+//
+//	client := music.NewFStoreClient(provider, frugal.NewCircuitBreakerMiddleware(frugal.FCircuitBreakerConfig{}))
+func NewCircuitBreakerMiddleware(config FCircuitBreakerConfig) ServiceMiddleware {
+	if config.WindowSize == 0 {
+		config.WindowSize = defaultCircuitWindowSize
+	}
+	if config.MinCalls == 0 {
+		config.MinCalls = defaultCircuitMinCalls
+	}
+	if config.MinCalls > config.WindowSize {
+		config.MinCalls = config.WindowSize
+	}
+	if config.FailureRate <= 0 {
+		config.FailureRate = defaultCircuitFailureRate
+	}
+	if config.OpenDuration <= 0 {
+		config.OpenDuration = defaultCircuitOpenDuration
+	}
+	if config.HalfOpenCalls == 0 {
+		config.HalfOpenCalls = defaultCircuitHalfOpenCalls
+	}
+	if config.IsFailure == nil {
+		config.IsFailure = isCircuitFailure
+	}
+	var (
+		mu       sync.Mutex
+		breakers = make(map[string]*circuitBreaker)
+	)
+	return func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			mu.Lock()
+			breaker, ok := breakers[method.Name]
+			if !ok {
+				breaker = newCircuitBreaker(method.Name, &config)
+				breakers[method.Name] = breaker
+			}
+			mu.Unlock()
+
+			if !breaker.allow() {
+				return errorResults(method, thrift.NewTTransportException(TRANSPORT_EXCEPTION_CIRCUIT_OPEN,
+					"frugal: circuit open for "+method.Name))
+			}
+			start := time.Now()
+			results := next(service, method, args)
+			breaker.record(results.Error(), time.Since(start))
+			return results
+		}
+	}
+}
+
+// isCircuitFailure is the default FCircuitBreakerConfig.IsFailure.
+func isCircuitFailure(err error) bool {
+	switch err.(type) {
+	case nil:
+		return false
+	case thrift.TTransportException, thrift.TApplicationException:
+		return true
+	}
+	return false
+}
+
+// circuitBreaker is the circuit of a method.
+type circuitBreaker struct {
+	method string
+	config *FCircuitBreakerConfig
+
+	mu       sync.Mutex
+	state    FCircuitState
+	openedAt time.Time
+
+	// outcomes is a ring of the outcomes of the calls in the window, of
+	// which failures failed and slow were slow.
+	outcomes []circuitOutcome
+	next     int
+	calls    int
+	failures int
+	slow     int
+
+	// trials is the number of trial calls made while half-open, of which
+	// successes succeeded.
+	trials    uint
+	successes uint
+}
+
+type circuitOutcome struct {
+	failed bool
+	slow   bool
+}
+
+func newCircuitBreaker(method string, config *FCircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		method:   method,
+		config:   config,
+		outcomes: make([]circuitOutcome, config.WindowSize),
+	}
+}
+
+// allow indicates if a call can be made, in which case its outcome must be
+// recorded.
+func (c *circuitBreaker) allow() bool {
+	c.mu.Lock()
+	from := c.state
+	allowed := true
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < c.config.OpenDuration {
+			allowed = false
+			break
+		}
+		c.state = CircuitHalfOpen
+		c.trials, c.successes = 1, 0
+	case CircuitHalfOpen:
+		if c.trials >= c.config.HalfOpenCalls {
+			allowed = false
+			break
+		}
+		c.trials++
+	}
+	to := c.state
+	c.mu.Unlock()
+	c.changed(from, to)
+	return allowed
+}
+
+// record records the outcome of a call which returned the given error after
+// the given duration.
+func (c *circuitBreaker) record(err error, duration time.Duration) {
+	outcome := circuitOutcome{
+		failed: c.config.IsFailure(err),
+		slow:   c.config.SlowCallDuration > 0 && duration > c.config.SlowCallDuration,
+	}
+	c.mu.Lock()
+	from := c.state
+	switch c.state {
+	case CircuitClosed:
+		c.add(outcome)
+		if c.tripped() {
+			c.open()
+		}
+	case CircuitHalfOpen:
+		if outcome.failed || outcome.slow {
+			c.open()
+		} else if c.successes++; c.successes >= c.config.HalfOpenCalls {
+			c.state = CircuitClosed
+		}
+	}
+	to := c.state
+	c.mu.Unlock()
+	c.changed(from, to)
+}
+
+// add adds the given outcome to the window, replacing the oldest once it's
+// full. The caller must hold the lock.
+func (c *circuitBreaker) add(outcome circuitOutcome) {
+	if c.calls == len(c.outcomes) {
+		oldest := c.outcomes[c.next]
+		c.calls--
+		if oldest.failed {
+			c.failures--
+		}
+		if oldest.slow {
+			c.slow--
+		}
+	}
+	c.outcomes[c.next] = outcome
+	c.next = (c.next + 1) % len(c.outcomes)
+	c.calls++
+	if outcome.failed {
+		c.failures++
+	}
+	if outcome.slow {
+		c.slow++
+	}
+}
+
+// tripped indicates if the window's failure or slow call rate has reached its
+// threshold. The caller must hold the lock.
+func (c *circuitBreaker) tripped() bool {
+	if c.calls < int(c.config.MinCalls) {
+		return false
+	}
+	calls := float64(c.calls)
+	if float64(c.failures)/calls >= c.config.FailureRate {
+		return true
+	}
+	return c.config.SlowCallRate > 0 && float64(c.slow)/calls >= c.config.SlowCallRate
+}
+
+// open opens the circuit and clears the window. The caller must hold the
+// lock.
+func (c *circuitBreaker) open() {
+	c.state = CircuitOpen
+	c.openedAt = time.Now()
+	c.next, c.calls, c.failures, c.slow = 0, 0, 0, 0
+}
+
+// changed reports a state change to the OnStateChange callback, outside the
+// lock so the callback can't deadlock the circuit.
+func (c *circuitBreaker) changed(from, to FCircuitState) {
+	if from == to {
+		return
+	}
+	logger().Debugf("frugal: circuit for %s changed from %s to %s", c.method, from, to)
+	if c.config.OnStateChange != nil {
+		c.config.OnStateChange(c.method, from, to)
+	}
+}
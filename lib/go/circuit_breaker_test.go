@@ -0,0 +1,136 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// circuitMethod returns a reflect.Method with the given name returning a
+// string and an error.
+func circuitMethod(name string) reflect.Method {
+	return reflect.Method{Name: name, Type: reflect.TypeOf(func(FContext) (string, error) { return "", nil })}
+}
+
+func assertCircuitOpen(t *testing.T, results Results) {
+	assert.Equal(t, "", results[0])
+	ex, ok := results.Error().(thrift.TTransportException)
+	if assert.True(t, ok) {
+		assert.Equal(t, TRANSPORT_EXCEPTION_CIRCUIT_OPEN, ex.TypeId())
+	}
+}
+
+// Ensures a method's circuit opens once its failure rate is reached, makes a
+// trial call once the open duration elapses, and closes if it succeeds.
+func TestCircuitBreakerMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	type change struct {
+		method   string
+		from, to FCircuitState
+	}
+	var changes []change
+	var err error
+	calls := 0
+	handler := NewCircuitBreakerMiddleware(FCircuitBreakerConfig{
+		WindowSize:   4,
+		MinCalls:     2,
+		OpenDuration: 10 * time.Millisecond,
+		OnStateChange: func(method string, from, to FCircuitState) {
+			changes = append(changes, change{method, from, to})
+		},
+	})(func(service reflect.Value, method reflect.Method, args Arguments) Results {
+		calls++
+		return Results{"ok", err}
+	})
+	get := circuitMethod("Get")
+	invoke := func(method reflect.Method) Results {
+		return handler(reflect.Value{}, method, Arguments{NewFContext("")})
+	}
+
+	assert.Nil(invoke(get).Error())
+	err = thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "timeout")
+	assert.Equal(err, invoke(get).Error())
+	assertCircuitOpen(t, invoke(get))
+	assert.Equal(2, calls)
+	assert.Equal([]change{{"Get", CircuitClosed, CircuitOpen}}, changes)
+
+	// Other methods have their own circuit.
+	assert.Equal(err, invoke(circuitMethod("Put")).Error())
+	assert.Equal(3, calls)
+
+	time.Sleep(15 * time.Millisecond)
+	err = nil
+	assert.Nil(invoke(get).Error())
+	assert.Nil(invoke(get).Error())
+	assert.Equal(5, calls)
+	assert.Equal([]change{
+		{"Get", CircuitClosed, CircuitOpen},
+		{"Get", CircuitOpen, CircuitHalfOpen},
+		{"Get", CircuitHalfOpen, CircuitClosed},
+	}, changes)
+}
+
+// Ensures a failed trial call reopens the circuit, and that errors defined in
+// the IDL don't count as failures.
+func TestCircuitBreakerHalfOpenFailure(t *testing.T) {
+	assert := assert.New(t)
+	var err error = thrift.NewTApplicationException(APPLICATION_EXCEPTION_INTERNAL_ERROR, "error")
+	handler := NewCircuitBreakerMiddleware(FCircuitBreakerConfig{
+		WindowSize:   1,
+		OpenDuration: 10 * time.Millisecond,
+	})(func(service reflect.Value, method reflect.Method, args Arguments) Results {
+		return Results{"ok", err}
+	})
+	get := circuitMethod("Get")
+	invoke := func() Results {
+		return handler(reflect.Value{}, get, Arguments{NewFContext("")})
+	}
+
+	assert.Equal(err, invoke().Error())
+	assertCircuitOpen(t, invoke())
+	time.Sleep(15 * time.Millisecond)
+	assert.Equal(err, invoke().Error())
+	assertCircuitOpen(t, invoke())
+
+	time.Sleep(15 * time.Millisecond)
+	err = errors.New("not found")
+	for i := 0; i < 3; i++ {
+		assert.Equal(err, invoke().Error())
+	}
+}
+
+// Ensures the circuit opens once the slow call rate is reached.
+func TestCircuitBreakerSlowCalls(t *testing.T) {
+	assert := assert.New(t)
+	handler := NewCircuitBreakerMiddleware(FCircuitBreakerConfig{
+		WindowSize:       2,
+		SlowCallDuration: time.Millisecond,
+		SlowCallRate:     0.5,
+	})(func(service reflect.Value, method reflect.Method, args Arguments) Results {
+		time.Sleep(2 * time.Millisecond)
+		return Results{"ok", nil}
+	})
+	get := circuitMethod("Get")
+
+	assert.Nil(handler(reflect.Value{}, get, Arguments{NewFContext("")}).Error())
+	assert.Nil(handler(reflect.Value{}, get, Arguments{NewFContext("")}).Error())
+	assertCircuitOpen(t, handler(reflect.Value{}, get, Arguments{NewFContext("")}))
+	assert.Equal("HALF_OPEN", CircuitHalfOpen.String())
+}
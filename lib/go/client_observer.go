@@ -0,0 +1,217 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// FErrorClass classifies the error returned by a client call.
+type FErrorClass int32
+
+const (
+	// ErrorClassNone is the class of calls which succeeded.
+	ErrorClassNone FErrorClass = iota
+
+	// ErrorClassTimeout is the class of calls which timed out waiting for a
+	// response.
+	ErrorClassTimeout
+
+	// ErrorClassCancelled is the class of calls abandoned by cancelling
+	// their FContext.
+	ErrorClassCancelled
+
+	// ErrorClassTransport is the class of calls which failed with any other
+	// TTransportException, such as when the server couldn't be reached.
+	ErrorClassTransport
+
+	// ErrorClassApplication is the class of calls which failed with a
+	// TApplicationException, such as when the server rejected the request or
+	// its handler failed unexpectedly.
+	ErrorClassApplication
+
+	// ErrorClassService is the class of calls which failed with any other
+	// error, typically an exception declared by the method in the IDL.
+	ErrorClassService
+)
+
+// String returns the name of the error class.
+func (c FErrorClass) String() string {
+	switch c {
+	case ErrorClassNone:
+		return "NONE"
+	case ErrorClassTimeout:
+		return "TIMEOUT"
+	case ErrorClassCancelled:
+		return "CANCELLED"
+	case ErrorClassTransport:
+		return "TRANSPORT"
+	case ErrorClassApplication:
+		return "APPLICATION"
+	case ErrorClassService:
+		return "SERVICE"
+	}
+	return fmt.Sprintf("FErrorClass(%d)", int32(c))
+}
+
+// ClassifyError returns the class of the given error returned by a client
+// call.
+func ClassifyError(err error) FErrorClass {
+	switch e := err.(type) {
+	case nil:
+		return ErrorClassNone
+	case thrift.TTransportException:
+		switch e.TypeId() {
+		case TRANSPORT_EXCEPTION_TIMED_OUT:
+			return ErrorClassTimeout
+		case TRANSPORT_EXCEPTION_CANCELLED:
+			return ErrorClassCancelled
+		}
+		return ErrorClassTransport
+	case thrift.TApplicationException:
+		return ErrorClassApplication
+	}
+	return ErrorClassService
+}
+
+// FCallInfo describes a call made by a client, as reported to its
+// FClientObserver.
+type FCallInfo struct {
+	// Method is the name of the method called.
+	Method string
+
+	// CorrelationID is the correlation id of the call.
+	CorrelationID string
+
+	// Start and Finish are the times the call was made and returned.
+	Start  time.Time
+	Finish time.Time
+
+	// RequestBytes is the size of the request sent, including its frame
+	// size. It's the total size if middleware sent the request more than
+	// once, such as when retrying.
+	RequestBytes int
+
+	// ResponseBytes is the size of the response received, excluding its
+	// frame size. It's zero for oneway calls.
+	ResponseBytes int
+
+	// Err is the error returned by the call, if any, and ErrorClass its
+	// classification.
+	Err        error
+	ErrorClass FErrorClass
+}
+
+// Duration returns how long the call took.
+func (i FCallInfo) Duration() time.Duration {
+	return i.Finish.Sub(i.Start)
+}
+
+// FClientObserver is notified of every call made by the clients of an
+// FServiceProvider it's installed on with WithObserver. ObserveCall is
+// invoked by the goroutine making the call once it returns, so must be safe
+// for concurrent use and should not block.
+type FClientObserver interface {
+	ObserveCall(info FCallInfo)
+}
+
+// FClientObserverFunc is an adapter to allow the use of a function as an
+// FClientObserver.
+type FClientObserverFunc func(info FCallInfo)
+
+// ObserveCall calls f(info).
+func (f FClientObserverFunc) ObserveCall(info FCallInfo) {
+	f(info)
+}
+
+// callObserver tracks the calls in flight for an FClientObserver, keyed by
+// opid, so the sizes of the requests and responses seen by the transport can
+// be attributed to them.
+type callObserver struct {
+	observer FClientObserver
+	mu       sync.Mutex
+	calls    map[string]*FCallInfo
+}
+
+func newCallObserver(observer FClientObserver) *callObserver {
+	return &callObserver{observer: observer, calls: make(map[string]*FCallInfo)}
+}
+
+// middleware is the ServiceMiddleware which times calls and reports them.
+func (o *callObserver) middleware(next InvocationHandler) InvocationHandler {
+	return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+		ctx := args.Context()
+		opID, _ := ctx.RequestHeader(opIDHeader)
+		info := &FCallInfo{Method: method.Name, CorrelationID: ctx.CorrelationID(), Start: time.Now()}
+		o.mu.Lock()
+		o.calls[opID] = info
+		o.mu.Unlock()
+
+		results := next(service, method, args)
+
+		o.mu.Lock()
+		delete(o.calls, opID)
+		o.mu.Unlock()
+		info.Finish = time.Now()
+		info.Err = results.Error()
+		info.ErrorClass = ClassifyError(info.Err)
+		o.observer.ObserveCall(*info)
+		return results
+	}
+}
+
+// addBytes attributes the given request and response sizes to the call made
+// with the given FContext. Calls which aren't being observed, such as those
+// made with an FContext cloned by middleware, are ignored.
+func (o *callObserver) addBytes(ctx FContext, request, response int) {
+	opID, _ := ctx.RequestHeader(opIDHeader)
+	o.mu.Lock()
+	if info, ok := o.calls[opID]; ok {
+		info.RequestBytes += request
+		info.ResponseBytes += response
+	}
+	o.mu.Unlock()
+}
+
+// observedTransport is an FTransport which reports the sizes of the requests
+// and responses it sends and receives to a callObserver.
+type observedTransport struct {
+	FTransport
+	calls *callObserver
+}
+
+// Oneway sends the request, recording its size.
+func (t *observedTransport) Oneway(ctx FContext, payload []byte) error {
+	t.calls.addBytes(ctx, len(payload), 0)
+	return t.FTransport.Oneway(ctx, payload)
+}
+
+// Request sends the request, recording its size and that of its response.
+func (t *observedTransport) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	response, err := t.FTransport.Request(ctx, payload)
+	size := 0
+	if err == nil && response != nil {
+		// Transports which don't know their size report the largest uint64.
+		if remaining := response.RemainingBytes(); remaining != ^uint64(0) {
+			size = int(remaining)
+		}
+	}
+	t.calls.addBytes(ctx, len(payload), size)
+	return response, err
+}
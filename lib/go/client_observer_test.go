@@ -0,0 +1,74 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures errors returned by calls are classified.
+func TestClassifyError(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(ErrorClassNone, ClassifyError(nil))
+	assert.Equal(ErrorClassTimeout, ClassifyError(thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "")))
+	assert.Equal(ErrorClassCancelled, ClassifyError(thrift.NewTTransportException(TRANSPORT_EXCEPTION_CANCELLED, "")))
+	assert.Equal(ErrorClassTransport, ClassifyError(thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN, "")))
+	assert.Equal(ErrorClassApplication, ClassifyError(thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN_METHOD, "")))
+	assert.Equal(ErrorClassService, ClassifyError(errors.New("declared")))
+	assert.Equal("TIMEOUT", ErrorClassTimeout.String())
+}
+
+// Ensures calls made by clients of a provider with an observer are reported
+// with their timing, sizes, and errors.
+func TestFServiceProviderWithObserver(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFLoopbackTransport(NewFHealthProcessor(NewFHealthServer()), protocolFactory)
+	assert.Nil(transport.Open())
+	var calls []FCallInfo
+	provider := NewFServiceProvider(transport, protocolFactory).WithObserver(FClientObserverFunc(func(info FCallInfo) {
+		calls = append(calls, info)
+	}))
+	client := NewFHealthClient(provider)
+
+	before := time.Now()
+	_, err := client.Check(NewFContext("cid"), "")
+	assert.Nil(err)
+	assert.Nil(transport.Close())
+	_, err = client.Check(NewFContext("cid"), "")
+	assert.Equal(TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+
+	if !assert.Len(calls, 2) {
+		return
+	}
+	call := calls[0]
+	assert.Equal("check", call.Method)
+	assert.Equal("cid", call.CorrelationID)
+	assert.False(call.Start.Before(before))
+	assert.True(call.Duration() >= 0)
+	assert.True(call.RequestBytes > 0)
+	assert.True(call.ResponseBytes > 0)
+	assert.Nil(call.Err)
+	assert.Equal(ErrorClassNone, call.ErrorClass)
+
+	call = calls[1]
+	assert.Equal(err, call.Err)
+	assert.Equal(ErrorClassTransport, call.ErrorClass)
+	assert.Equal(0, call.ResponseBytes)
+}
@@ -0,0 +1,28 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import "git.apache.org/thrift.git/lib/go/thrift"
+
+// NewFCompactProtocolFactory returns an FProtocolFactory which serializes
+// messages with Thrift's compact protocol beneath the frugal headers. Compact
+// messages are usually smaller than binary ones, particularly for structs of
+// small integers and sparse optional fields, for a little more CPU. The
+// headers are encoded the same way regardless of the protocol, and every
+// frugal runtime supports compact, so it only needs to match between clients
+// and servers. The frames in testdata/compact_conformance.json pin the
+// encoding for other runtimes to check against.
+func NewFCompactProtocolFactory() *FProtocolFactory {
+	return NewFProtocolFactory(thrift.NewTCompactProtocolFactory())
+}
@@ -34,6 +34,13 @@ const (
 	// Header containing request timeout (milliseconds as string)
 	timeoutHeader = "_timeout"
 
+	// Header containing the request deadline (unix milliseconds as string)
+	deadlineHeader = "_deadline"
+
+	// Header containing the time remaining until the request deadline
+	// (milliseconds as string)
+	remainingHeader = "_remaining"
+
 	// Default request timeout
 	defaultTimeout = 5 * time.Second
 )
@@ -93,19 +100,80 @@ type FContext interface {
 
 	// Timeout returns the request timeout.
 	Timeout() time.Duration
+
+	// Deadline returns the time at which the client that sent the request
+	// will give up waiting for a response. The ok result is false if no
+	// deadline is known, which is always the case for contexts which were not
+	// read off the wire by a server.
+	Deadline() (deadline time.Time, ok bool)
+
+	// RemainingTimeout returns how long remains until the deadline, or the
+	// timeout if there is no deadline. It's never negative. Handlers can use
+	// it to bound the requests they make while processing a request, such as
+	// with NewChildFContext.
+	RemainingTimeout() time.Duration
+}
+
+// cloner allows an FContext implementation to provide its own deep copy.
+type cloner interface {
+	// Clone returns a deep copy of the FContext with a new opid.
+	Clone() FContext
 }
 
 // Clone performs a deep copy of an FContext while handling opids correctly.
+// The clone is given a fresh opid, so a single inbound context can safely be
+// used to spawn multiple concurrent outbound requests.
 // TODO 3.0 consider adding this to the FContext interface.
 func Clone(ctx FContext) FContext {
+	if c, ok := ctx.(cloner); ok {
+		return c.Clone()
+	}
 	clone := &FContextImpl{
-		requestHeaders: ctx.RequestHeaders(),
+		requestHeaders:  ctx.RequestHeaders(),
 		responseHeaders: ctx.ResponseHeaders(),
 	}
 	clone.requestHeaders[opIDHeader] = getNextOpID()
+	clone.deadline, _ = ctx.Deadline()
 	return clone
 }
 
+// headerRanger allows an FContext implementation to iterate its headers
+// without copying them.
+type headerRanger interface {
+	RangeRequestHeaders(f func(name, value string) bool)
+	RangeResponseHeaders(f func(name, value string) bool)
+}
+
+// RangeRequestHeaders calls f for each request header of the given FContext,
+// stopping if f returns false. Unlike RequestHeaders, this does not allocate a
+// copy of the headers for FContextImpl, making it suitable for hot paths such
+// as per-request logging. The context must not be modified from within f.
+func RangeRequestHeaders(ctx FContext, f func(name, value string) bool) {
+	if r, ok := ctx.(headerRanger); ok {
+		r.RangeRequestHeaders(f)
+		return
+	}
+	rangeHeaders(ctx.RequestHeaders(), f)
+}
+
+// RangeResponseHeaders calls f for each response header of the given
+// FContext, stopping if f returns false. See RangeRequestHeaders.
+func RangeResponseHeaders(ctx FContext, f func(name, value string) bool) {
+	if r, ok := ctx.(headerRanger); ok {
+		r.RangeResponseHeaders(f)
+		return
+	}
+	rangeHeaders(ctx.ResponseHeaders(), f)
+}
+
+func rangeHeaders(headers map[string]string, f func(name, value string) bool) {
+	for name, value := range headers {
+		if !f(name, value) {
+			return
+		}
+	}
+}
+
 var nextOpID uint64
 
 func getNextOpID() string {
@@ -116,7 +184,24 @@ func getNextOpID() string {
 type FContextImpl struct {
 	requestHeaders  map[string]string
 	responseHeaders map[string]string
+	deadline        time.Time
+	headerLimits    HeaderLimits
+	done            chan struct{}
+	cancelled       bool
+	cancelFuncs     map[uint64]func()
+	cancelFuncID    uint64
+	ack             *messageAck
 	mu              sync.RWMutex
+
+	// lazyRequestHeaders are the serialized request headers of a server
+	// context which have not been decoded yet, and lazy is set while there
+	// are any.
+	lazyRequestHeaders []byte
+	lazy               int32
+
+	// plainThrift is set on server contexts read for requests from plain
+	// Thrift clients.
+	plainThrift bool
 }
 
 // NewFContext returns a Context for the given correlation id. If an empty
@@ -139,33 +224,85 @@ func NewFContext(correlationID string) FContext {
 	return ctx
 }
 
+// Clone returns a deep copy of the context. The request and response headers
+// are copied and the clone is given a new opid, making it safe to use the
+// clone for a request while the original is still in use.
+func (c *FContextImpl) Clone() FContext {
+	c.materializeRequestHeaders()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	clone := &FContextImpl{
+		requestHeaders:  make(map[string]string, len(c.requestHeaders)),
+		responseHeaders: make(map[string]string, len(c.responseHeaders)),
+		deadline:        c.deadline,
+		headerLimits:    c.headerLimits,
+	}
+	for name, value := range c.requestHeaders {
+		clone.requestHeaders[name] = value
+	}
+	for name, value := range c.responseHeaders {
+		clone.responseHeaders[name] = value
+	}
+	clone.requestHeaders[opIDHeader] = getNextOpID()
+	return clone
+}
+
 // CorrelationID returns the correlation id for the context.
 func (c *FContextImpl) CorrelationID() string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.requestHeaders[cidHeader]
+	cid, _ := c.requestHeader(cidHeader)
+	return cid
 }
 
 // AddRequestHeader adds a request header to the context for the given name.
 // The headers _cid and _opid are reserved. Returns the same FContext to allow
-// for chaining calls.
+// for chaining calls. If reserved header protection is enabled, writes to
+// reserved headers are discarded and logged. Writes which would exceed the
+// context's HeaderLimits are also discarded and logged, use
+// TryAddRequestHeader to receive an error instead.
 func (c *FContextImpl) AddRequestHeader(name, value string) FContext {
+	if isProtectedRequestHeader(name) {
+		logger().Warnf("frugal: discarding write to reserved request header %s", name)
+		return c
+	}
+	if err := c.tryAddRequestHeader(name, value); err != nil {
+		logger().Warnf("frugal: discarding request header %s: %s", name, err)
+	}
+	return c
+}
+
+// tryAddRequestHeader sets a request header if doing so does not exceed the
+// context's HeaderLimits.
+func (c *FContextImpl) tryAddRequestHeader(name, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.materializeRequestHeadersLocked()
+	if err := c.headerLimits.checkAdd(c.requestHeaders, name, value); err != nil {
+		return err
+	}
+	c.requestHeaders[name] = value
+	return nil
+}
+
+// setRequestHeader sets a request header, bypassing reserved header
+// protection.
+func (c *FContextImpl) setRequestHeader(name, value string) {
 	c.mu.Lock()
 	c.requestHeaders[name] = value
 	c.mu.Unlock()
-	return c
 }
 
 // RequestHeader gets the named request header.
 func (c *FContextImpl) RequestHeader(name string) (string, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	val, ok := c.requestHeaders[name]
-	return val, ok
+	return c.requestHeader(name)
 }
 
 // RequestHeaders returns the request headers map.
 func (c *FContextImpl) RequestHeaders() map[string]string {
+	c.materializeRequestHeaders()
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	headers := make(map[string]string, len(c.requestHeaders))
@@ -175,14 +312,35 @@ func (c *FContextImpl) RequestHeaders() map[string]string {
 	return headers
 }
 
+// RangeRequestHeaders calls f for each request header without copying the
+// headers map, stopping if f returns false. The context must not be modified
+// from within f.
+func (c *FContextImpl) RangeRequestHeaders(f func(name, value string) bool) {
+	c.materializeRequestHeaders()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	rangeHeaders(c.requestHeaders, f)
+}
+
 // AddResponseHeader adds a response header to the context for the given name.
 // The _opid header is reserved. Returns the same FContext to allow for
-// chaining calls.
+// chaining calls. If reserved header protection is enabled, writes to reserved
+// headers are discarded and logged.
 func (c *FContextImpl) AddResponseHeader(name, value string) FContext {
+	if isProtectedResponseHeader(name) {
+		logger().Warnf("frugal: discarding write to reserved response header %s", name)
+		return c
+	}
+	c.setResponseHeader(name, value)
+	return c
+}
+
+// setResponseHeader sets a response header, bypassing reserved header
+// protection.
+func (c *FContextImpl) setResponseHeader(name, value string) {
 	c.mu.Lock()
 	c.responseHeaders[name] = value
 	c.mu.Unlock()
-	return c
 }
 
 // ResponseHeader gets the named response header.
@@ -204,6 +362,15 @@ func (c *FContextImpl) ResponseHeaders() map[string]string {
 	return headers
 }
 
+// RangeResponseHeaders calls f for each response header without copying the
+// headers map, stopping if f returns false. The context must not be modified
+// from within f.
+func (c *FContextImpl) RangeResponseHeaders(f func(name, value string) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	rangeHeaders(c.responseHeaders, f)
+}
+
 // SetTimeout sets the request timeout. Default is 5 seconds. Returns the same
 // FContext to allow for chaining calls.
 func (c *FContextImpl) SetTimeout(timeout time.Duration) FContext {
@@ -216,7 +383,7 @@ func (c *FContextImpl) SetTimeout(timeout time.Duration) FContext {
 // Timeout returns the request timeout.
 func (c *FContextImpl) Timeout() time.Duration {
 	c.mu.RLock()
-	timeoutMillisStr := c.requestHeaders[timeoutHeader]
+	timeoutMillisStr, _ := c.requestHeader(timeoutHeader)
 	c.mu.RUnlock()
 	timeoutMillis, err := strconv.ParseInt(timeoutMillisStr, 10, 64)
 	if err != nil {
@@ -225,10 +392,98 @@ func (c *FContextImpl) Timeout() time.Duration {
 	return time.Millisecond * time.Duration(timeoutMillis)
 }
 
+// Deadline returns the time at which the client that sent the request will
+// give up waiting for a response. The ok result is false if no deadline is
+// known, which is always the case for contexts which were not read off the
+// wire by a server.
+func (c *FContextImpl) Deadline() (time.Time, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.deadline, !c.deadline.IsZero()
+}
+
+// RemainingTimeout returns how long remains until the deadline, or the
+// timeout if there is no deadline. It's never negative.
+func (c *FContextImpl) RemainingTimeout() time.Duration {
+	return remainingTimeout(c)
+}
+
+// remainingTimeout returns how long remains until the deadline of the given
+// context, or its timeout if it has no deadline.
+func remainingTimeout(ctx interface {
+	Timeout() time.Duration
+	Deadline() (time.Time, bool)
+}) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ctx.Timeout()
+	}
+	if remaining := time.Until(deadline); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// setDeadline sets the deadline for the context.
+func (c *FContextImpl) setDeadline(deadline time.Time) {
+	c.mu.Lock()
+	c.deadline = deadline
+	c.mu.Unlock()
+}
+
+// requestDeadline returns the deadline to send with a request made using the
+// given context. This is the earlier of the context's own deadline, if it has
+// one, and the current time plus the context timeout.
+func requestDeadline(ctx FContext) time.Time {
+	deadline := time.Now().Add(ctx.Timeout())
+	if existing, ok := ctx.Deadline(); ok && existing.Before(deadline) {
+		deadline = existing
+	}
+	return deadline
+}
+
+// formatDeadline serializes the deadline as unix milliseconds.
+func formatDeadline(deadline time.Time) string {
+	return strconv.FormatInt(deadline.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// parseDeadline deserializes a deadline serialized by formatDeadline.
+func parseDeadline(deadlineStr string) (time.Time, error) {
+	deadlineMillis, err := strconv.ParseInt(deadlineStr, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, deadlineMillis*int64(time.Millisecond)), nil
+}
+
+// formatRemaining serializes the time remaining until the deadline as
+// milliseconds, so the receiver's deadline doesn't depend on the clocks of
+// the two hosts agreeing. It's never negative.
+func formatRemaining(deadline time.Time) string {
+	remaining := time.Until(deadline)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return strconv.FormatInt(int64(remaining/time.Millisecond), 10)
+}
+
+// parseRemaining deserializes the time remaining serialized by
+// formatRemaining into a deadline relative to now.
+func parseRemaining(remainingStr string) (time.Time, error) {
+	remainingMillis, err := strconv.ParseInt(remainingStr, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if remainingMillis < 0 {
+		return time.Time{}, fmt.Errorf("frugal: negative time remaining %d", remainingMillis)
+	}
+	return time.Now().Add(time.Duration(remainingMillis) * time.Millisecond), nil
+}
+
 // setRequestOpID sets the request operation id for context.
 func setRequestOpID(ctx FContext, id uint64) {
 	opIDStr := strconv.FormatUint(id, 10)
-	ctx.AddRequestHeader(opIDHeader, opIDStr)
+	setRequestHeader(ctx, opIDHeader, opIDStr)
 }
 
 // opID returns the request operation id for the given context.
@@ -249,11 +504,62 @@ func getOpID(ctx FContext) (uint64, error) {
 
 // setResponseOpID sets the response operation id for context.
 func setResponseOpID(ctx FContext, id string) {
-	ctx.AddResponseHeader(opIDHeader, id)
+	setResponseHeader(ctx, opIDHeader, id)
+}
+
+// setRequestHeader sets a request header on the context, bypassing reserved
+// header protection if the context supports it.
+func setRequestHeader(ctx FContext, name, value string) {
+	if c, ok := ctx.(*FContextImpl); ok {
+		c.setRequestHeader(name, value)
+		return
+	}
+	ctx.AddRequestHeader(name, value)
+}
+
+// setResponseHeader sets a response header on the context, bypassing reserved
+// header protection if the context supports it.
+func setResponseHeader(ctx FContext, name, value string) {
+	if c, ok := ctx.(*FContextImpl); ok {
+		c.setResponseHeader(name, value)
+		return
+	}
+	ctx.AddResponseHeader(name, value)
+}
+
+var (
+	correlationIDGeneratorMu sync.RWMutex
+	correlationIDGenerator   = randomCorrelationID
+)
+
+// SetCorrelationIDGenerator sets the function used to generate correlation ids
+// for FContexts created without one, such as one returning ULIDs or ids
+// derived from a trace id. Passing nil restores the default generator, which
+// returns random UUIDs without dashes. If the generator returns an empty
+// string, a default id is used instead. This is safe to call concurrently
+// with FContext creation, but is typically called once at startup.
+func SetCorrelationIDGenerator(generator func() string) {
+	if generator == nil {
+		generator = randomCorrelationID
+	}
+	correlationIDGeneratorMu.Lock()
+	correlationIDGenerator = generator
+	correlationIDGeneratorMu.Unlock()
+}
+
+// generateCorrelationID returns a correlation id from the configured
+// generator.
+func generateCorrelationID() string {
+	correlationIDGeneratorMu.RLock()
+	generator := correlationIDGenerator
+	correlationIDGeneratorMu.RUnlock()
+	if cid := generator(); cid != "" {
+		return cid
+	}
+	return randomCorrelationID()
 }
 
-// generateCorrelationID returns a random string id. It's assigned to a var for
-// testability purposes.
-var generateCorrelationID = func() string {
+// randomCorrelationID returns a random string id.
+func randomCorrelationID() string {
 	return strings.Replace(uuid.RandomUUID().String(), "-", "", -1)
 }
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"context"
+	"time"
+)
+
+// fContextKey is the context.Context value key under which an FContext is
+// stored.
+type fContextKey struct{}
+
+// HeaderKey is a context.Context value key which resolves to the request
+// header of the same name on the FContext wrapped by ToContext. For example,
+// ctx.Value(HeaderKey("_cid")) returns the correlation id.
+type HeaderKey string
+
+// fContextValueCtx is a context.Context which exposes the wrapped FContext
+// and its request headers as values.
+type fContextValueCtx struct {
+	context.Context
+	fctx FContext
+}
+
+// Value returns the wrapped FContext for the FContext key, request headers for
+// HeaderKeys, and otherwise defers to the parent context.
+func (c *fContextValueCtx) Value(key interface{}) interface{} {
+	switch k := key.(type) {
+	case fContextKey:
+		return c.fctx
+	case HeaderKey:
+		if value, ok := c.fctx.RequestHeader(string(k)); ok {
+			return value
+		}
+		return nil
+	}
+	return c.Context.Value(key)
+}
+
+// ToContext wraps the given FContext as a context.Context so it can be passed
+// to libraries which only accept context.Context. The returned context
+// expires at the FContext deadline if it has one, otherwise when the
+// FContext timeout elapses. Its request headers are available as values using
+// HeaderKey, and FromContext returns the original FContext. The returned
+// context is also cancelled when the FContext is cancelled, such as when the
+// client abandons the request. The returned CancelFunc should be called once
+// the context is no longer needed to release its resources.
+func ToContext(fctx FContext) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithDeadline(context.Background(), requestDeadline(fctx))
+	if done := contextDone(fctx); done != nil {
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return &fContextValueCtx{Context: ctx, fctx: fctx}, cancel
+}
+
+// FromContext returns the FContext carried by the given context.Context, as
+// wrapped by ToContext. If the context does not carry an FContext, a new one
+// is created with a timeout matching the time remaining until the context
+// deadline, if it has one.
+func FromContext(ctx context.Context) FContext {
+	if fctx, ok := ctx.Value(fContextKey{}).(FContext); ok {
+		return fctx
+	}
+	fctx := NewFContext("")
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := deadline.Sub(time.Now())
+		if timeout < 0 {
+			timeout = 0
+		}
+		fctx.SetTimeout(timeout)
+	}
+	return fctx
+}
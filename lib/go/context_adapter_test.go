@@ -0,0 +1,90 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testContextKey struct{}
+
+// Ensures ToContext exposes the FContext deadline and headers and FromContext
+// returns the original FContext.
+func TestToContext(t *testing.T) {
+	assert := assert.New(t)
+	fctx := NewFContext("cid")
+	fctx.AddRequestHeader("foo", "bar")
+	fctx.SetTimeout(time.Minute)
+
+	before := time.Now().Add(time.Minute - time.Millisecond)
+	ctx, cancel := ToContext(fctx)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(ok)
+	assert.False(deadline.Before(before))
+	assert.False(deadline.After(time.Now().Add(time.Minute)))
+
+	assert.Equal("bar", ctx.Value(HeaderKey("foo")))
+	assert.Equal("cid", ctx.Value(HeaderKey(cidHeader)))
+	assert.Nil(ctx.Value(HeaderKey("baz")))
+	assert.True(fctx == FromContext(ctx))
+
+	// Values should be resolvable through derived contexts.
+	derived := context.WithValue(ctx, testContextKey{}, "value")
+	assert.Equal("value", derived.Value(testContextKey{}))
+	assert.Equal("bar", derived.Value(HeaderKey("foo")))
+	assert.True(fctx == FromContext(derived))
+
+	cancel()
+	<-ctx.Done()
+	assert.Equal(context.Canceled, ctx.Err())
+}
+
+// Ensures ToContext uses the deadline of a server-side FContext.
+func TestToContextDeadline(t *testing.T) {
+	fctx := NewFContext("")
+	deadline := time.Now().Add(time.Millisecond)
+	fctx.(*FContextImpl).setDeadline(deadline)
+
+	ctx, cancel := ToContext(fctx)
+	defer cancel()
+	actual, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.Equal(t, deadline, actual)
+
+	select {
+	case <-ctx.Done():
+		assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+	case <-time.After(time.Second):
+		t.Fatal("expected context to expire")
+	}
+}
+
+// Ensures FromContext creates a new FContext using the context deadline when
+// the context does not carry an FContext.
+func TestFromContextNoFContext(t *testing.T) {
+	fctx := FromContext(context.Background())
+	assert.Equal(t, defaultTimeout, fctx.Timeout())
+	assert.NotEqual(t, "", fctx.CorrelationID())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	fctx = FromContext(ctx)
+	assert.True(t, fctx.Timeout() <= time.Minute)
+	assert.True(t, fctx.Timeout() > time.Minute-time.Second)
+}
@@ -0,0 +1,32 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import "time"
+
+// NewChildFContext returns a new FContext for a request made while processing
+// the request with the given parent FContext, such as a downstream call made
+// by a handler. The child has the parent's correlation id, so the requests
+// can be traced together, and its timeout is the parent's RemainingTimeout
+// less the given margin, leaving the handler time to respond before the
+// parent's client gives up. If the margin exceeds the time remaining, the
+// child's timeout is zero, so its request fails immediately instead of doing
+// work no one will wait for.
+func NewChildFContext(parent FContext, margin time.Duration) FContext {
+	timeout := parent.RemainingTimeout() - margin
+	if timeout < 0 {
+		timeout = 0
+	}
+	return NewFContext(parent.CorrelationID()).SetTimeout(timeout)
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures the remaining timeout is measured from the deadline if there is
+// one, and is the timeout otherwise.
+func TestRemainingTimeout(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("").SetTimeout(time.Second)
+	assert.Equal(time.Second, ctx.RemainingTimeout())
+
+	ctx.(*FContextImpl).setDeadline(time.Now().Add(time.Minute))
+	assert.InDelta(float64(time.Minute), float64(ctx.RemainingTimeout()), float64(time.Second))
+	assert.InDelta(float64(time.Minute), float64(NewFContextView(ctx).RemainingTimeout()), float64(time.Second))
+
+	ctx.(*FContextImpl).setDeadline(time.Now().Add(-time.Second))
+	assert.Equal(time.Duration(0), ctx.RemainingTimeout())
+}
+
+// Ensures child contexts share the parent's correlation id and are given
+// the parent's remaining budget less the margin.
+func TestNewChildFContext(t *testing.T) {
+	assert := assert.New(t)
+	parent := NewFContext("cid")
+	parent.(*FContextImpl).setDeadline(time.Now().Add(time.Second))
+
+	child := NewChildFContext(parent, 100*time.Millisecond)
+	assert.Equal("cid", child.CorrelationID())
+	assert.NotEqual(mustGetOpID(t, parent), mustGetOpID(t, child))
+	assert.InDelta(float64(900*time.Millisecond), float64(child.Timeout()), float64(50*time.Millisecond))
+
+	child = NewChildFContext(parent, time.Minute)
+	assert.Equal(time.Duration(0), child.Timeout())
+}
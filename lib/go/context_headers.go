@@ -0,0 +1,316 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Typed header accessors encode values as strings so they can be carried by
+// the header protocol and read by any language runtime. The encodings are:
+//
+//		int64, uint64	base 10 integer, e.g. "-42"
+//		float64		shortest decimal or exponent representation, e.g. "1.5"
+//		bool		"true" or "false" (parsing also accepts 1, t, 0, f, etc.)
+//		time.Time	RFC 3339 with nanoseconds in UTC, e.g. "2017-01-02T15:04:05.5Z"
+//		time.Duration	base 10 integer milliseconds, like _timeout, e.g. "90000"
+//				for 1m30s, truncating any sub-millisecond remainder
+//		[]string	comma separated values with "%", "," and '"' escaped as
+//				"%25", "%2C" and "%22", e.g. "admin,a%2Cb" for
+//				["admin", "a,b"], an empty list as "" and a list of
+//				one empty value as `""`
+//
+// Getters return ok false if the header is not present and a non-nil error
+// if it is present but cannot be parsed as the requested type.
+
+// AddRequestHeaderInt64 adds an int64 request header to the context.
+func AddRequestHeaderInt64(ctx FContext, name string, value int64) FContext {
+	return ctx.AddRequestHeader(name, strconv.FormatInt(value, 10))
+}
+
+// RequestHeaderInt64 gets the named request header as an int64.
+func RequestHeaderInt64(ctx FContext, name string) (int64, bool, error) {
+	value, ok := ctx.RequestHeader(name)
+	return parseInt64Header(name, value, ok)
+}
+
+// AddResponseHeaderInt64 adds an int64 response header to the context.
+func AddResponseHeaderInt64(ctx FContext, name string, value int64) FContext {
+	return ctx.AddResponseHeader(name, strconv.FormatInt(value, 10))
+}
+
+// ResponseHeaderInt64 gets the named response header as an int64.
+func ResponseHeaderInt64(ctx FContext, name string) (int64, bool, error) {
+	value, ok := ctx.ResponseHeader(name)
+	return parseInt64Header(name, value, ok)
+}
+
+// AddRequestHeaderUint64 adds a uint64 request header to the context.
+func AddRequestHeaderUint64(ctx FContext, name string, value uint64) FContext {
+	return ctx.AddRequestHeader(name, strconv.FormatUint(value, 10))
+}
+
+// RequestHeaderUint64 gets the named request header as a uint64.
+func RequestHeaderUint64(ctx FContext, name string) (uint64, bool, error) {
+	value, ok := ctx.RequestHeader(name)
+	return parseUint64Header(name, value, ok)
+}
+
+// AddResponseHeaderUint64 adds a uint64 response header to the context.
+func AddResponseHeaderUint64(ctx FContext, name string, value uint64) FContext {
+	return ctx.AddResponseHeader(name, strconv.FormatUint(value, 10))
+}
+
+// ResponseHeaderUint64 gets the named response header as a uint64.
+func ResponseHeaderUint64(ctx FContext, name string) (uint64, bool, error) {
+	value, ok := ctx.ResponseHeader(name)
+	return parseUint64Header(name, value, ok)
+}
+
+// AddRequestHeaderFloat64 adds a float64 request header to the context.
+func AddRequestHeaderFloat64(ctx FContext, name string, value float64) FContext {
+	return ctx.AddRequestHeader(name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// RequestHeaderFloat64 gets the named request header as a float64.
+func RequestHeaderFloat64(ctx FContext, name string) (float64, bool, error) {
+	value, ok := ctx.RequestHeader(name)
+	return parseFloat64Header(name, value, ok)
+}
+
+// AddResponseHeaderFloat64 adds a float64 response header to the context.
+func AddResponseHeaderFloat64(ctx FContext, name string, value float64) FContext {
+	return ctx.AddResponseHeader(name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// ResponseHeaderFloat64 gets the named response header as a float64.
+func ResponseHeaderFloat64(ctx FContext, name string) (float64, bool, error) {
+	value, ok := ctx.ResponseHeader(name)
+	return parseFloat64Header(name, value, ok)
+}
+
+// AddRequestHeaderBool adds a bool request header to the context.
+func AddRequestHeaderBool(ctx FContext, name string, value bool) FContext {
+	return ctx.AddRequestHeader(name, strconv.FormatBool(value))
+}
+
+// RequestHeaderBool gets the named request header as a bool.
+func RequestHeaderBool(ctx FContext, name string) (bool, bool, error) {
+	value, ok := ctx.RequestHeader(name)
+	return parseBoolHeader(name, value, ok)
+}
+
+// AddResponseHeaderBool adds a bool response header to the context.
+func AddResponseHeaderBool(ctx FContext, name string, value bool) FContext {
+	return ctx.AddResponseHeader(name, strconv.FormatBool(value))
+}
+
+// ResponseHeaderBool gets the named response header as a bool.
+func ResponseHeaderBool(ctx FContext, name string) (bool, bool, error) {
+	value, ok := ctx.ResponseHeader(name)
+	return parseBoolHeader(name, value, ok)
+}
+
+// AddRequestHeaderTime adds a time.Time request header to the context.
+func AddRequestHeaderTime(ctx FContext, name string, value time.Time) FContext {
+	return ctx.AddRequestHeader(name, value.UTC().Format(time.RFC3339Nano))
+}
+
+// RequestHeaderTime gets the named request header as a time.Time.
+func RequestHeaderTime(ctx FContext, name string) (time.Time, bool, error) {
+	value, ok := ctx.RequestHeader(name)
+	return parseTimeHeader(name, value, ok)
+}
+
+// AddResponseHeaderTime adds a time.Time response header to the context.
+func AddResponseHeaderTime(ctx FContext, name string, value time.Time) FContext {
+	return ctx.AddResponseHeader(name, value.UTC().Format(time.RFC3339Nano))
+}
+
+// ResponseHeaderTime gets the named response header as a time.Time.
+func ResponseHeaderTime(ctx FContext, name string) (time.Time, bool, error) {
+	value, ok := ctx.ResponseHeader(name)
+	return parseTimeHeader(name, value, ok)
+}
+
+// AddRequestHeaderDuration adds a time.Duration request header to the
+// context.
+func AddRequestHeaderDuration(ctx FContext, name string, value time.Duration) FContext {
+	return ctx.AddRequestHeader(name, formatDurationHeader(value))
+}
+
+// RequestHeaderDuration gets the named request header as a time.Duration.
+func RequestHeaderDuration(ctx FContext, name string) (time.Duration, bool, error) {
+	value, ok := ctx.RequestHeader(name)
+	return parseDurationHeader(name, value, ok)
+}
+
+// AddResponseHeaderDuration adds a time.Duration response header to the
+// context.
+func AddResponseHeaderDuration(ctx FContext, name string, value time.Duration) FContext {
+	return ctx.AddResponseHeader(name, formatDurationHeader(value))
+}
+
+// ResponseHeaderDuration gets the named response header as a time.Duration.
+func ResponseHeaderDuration(ctx FContext, name string) (time.Duration, bool, error) {
+	value, ok := ctx.ResponseHeader(name)
+	return parseDurationHeader(name, value, ok)
+}
+
+// AddRequestHeaderValues sets a multi-value request header on the context,
+// replacing any existing value. An empty list is encoded as an empty string
+// and a list of one empty value as `""`.
+func AddRequestHeaderValues(ctx FContext, name string, values ...string) FContext {
+	return ctx.AddRequestHeader(name, formatHeaderValues(values))
+}
+
+// RequestHeaderValues gets the named multi-value request header. A header
+// without separators, including one set by AddRequestHeader, is returned as a
+// single value.
+func RequestHeaderValues(ctx FContext, name string) ([]string, bool) {
+	value, ok := ctx.RequestHeader(name)
+	if !ok {
+		return nil, false
+	}
+	return parseHeaderValues(value), true
+}
+
+// AddResponseHeaderValues sets a multi-value response header on the context,
+// replacing any existing value. An empty list is encoded as an empty string
+// and a list of one empty value as `""`.
+func AddResponseHeaderValues(ctx FContext, name string, values ...string) FContext {
+	return ctx.AddResponseHeader(name, formatHeaderValues(values))
+}
+
+// ResponseHeaderValues gets the named multi-value response header. A header
+// without separators, including one set by AddResponseHeader, is returned as
+// a single value.
+func ResponseHeaderValues(ctx FContext, name string) ([]string, bool) {
+	value, ok := ctx.ResponseHeader(name)
+	if !ok {
+		return nil, false
+	}
+	return parseHeaderValues(value), true
+}
+
+// emptyHeaderValue encodes a list of one empty value, distinguishing it from
+// the empty list encoded as an empty string.
+const emptyHeaderValue = `""`
+
+var (
+	headerValueEscaper   = strings.NewReplacer("%", "%25", ",", "%2C", `"`, "%22")
+	headerValueUnescaper = strings.NewReplacer("%25", "%", "%2C", ",", "%2c", ",", "%22", `"`)
+)
+
+func formatHeaderValues(values []string) string {
+	if len(values) == 1 && values[0] == "" {
+		return emptyHeaderValue
+	}
+	escaped := make([]string, len(values))
+	for i, value := range values {
+		escaped[i] = headerValueEscaper.Replace(value)
+	}
+	return strings.Join(escaped, ",")
+}
+
+func parseHeaderValues(value string) []string {
+	switch value {
+	case "":
+		return []string{}
+	case emptyHeaderValue:
+		return []string{""}
+	}
+	values := strings.Split(value, ",")
+	for i, v := range values {
+		values[i] = headerValueUnescaper.Replace(v)
+	}
+	return values
+}
+
+func parseInt64Header(name, value string, ok bool) (int64, bool, error) {
+	if !ok {
+		return 0, false, nil
+	}
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, true, invalidHeaderError(name, value, "int64")
+	}
+	return v, true, nil
+}
+
+func parseUint64Header(name, value string, ok bool) (uint64, bool, error) {
+	if !ok {
+		return 0, false, nil
+	}
+	v, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, true, invalidHeaderError(name, value, "uint64")
+	}
+	return v, true, nil
+}
+
+func parseFloat64Header(name, value string, ok bool) (float64, bool, error) {
+	if !ok {
+		return 0, false, nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, true, invalidHeaderError(name, value, "float64")
+	}
+	return v, true, nil
+}
+
+func parseBoolHeader(name, value string, ok bool) (bool, bool, error) {
+	if !ok {
+		return false, false, nil
+	}
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, true, invalidHeaderError(name, value, "bool")
+	}
+	return v, true, nil
+}
+
+func parseTimeHeader(name, value string, ok bool) (time.Time, bool, error) {
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	v, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, true, invalidHeaderError(name, value, "time")
+	}
+	return v, true, nil
+}
+
+func formatDurationHeader(value time.Duration) string {
+	return strconv.FormatInt(int64(value/time.Millisecond), 10)
+}
+
+func parseDurationHeader(name, value string, ok bool) (time.Duration, bool, error) {
+	if !ok {
+		return 0, false, nil
+	}
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, true, invalidHeaderError(name, value, "duration")
+	}
+	return time.Duration(v) * time.Millisecond, true, nil
+}
+
+func invalidHeaderError(name, value, kind string) error {
+	return fmt.Errorf("frugal: header %s has value %q which is not a valid %s", name, value, kind)
+}
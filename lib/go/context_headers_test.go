@@ -0,0 +1,209 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures typed request header accessors round trip values using the
+// documented encoding.
+func TestTypedRequestHeaders(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("")
+	now := time.Date(2017, 1, 2, 15, 4, 5, 500, time.FixedZone("test", 3600))
+
+	AddRequestHeaderInt64(ctx, "int", -42)
+	AddRequestHeaderUint64(ctx, "uint", 42)
+	AddRequestHeaderFloat64(ctx, "float", 1.5)
+	AddRequestHeaderBool(ctx, "bool", true)
+	AddRequestHeaderTime(ctx, "time", now)
+	AddRequestHeaderDuration(ctx, "duration", 90*time.Second)
+
+	headers := ctx.RequestHeaders()
+	assert.Equal("-42", headers["int"])
+	assert.Equal("42", headers["uint"])
+	assert.Equal("1.5", headers["float"])
+	assert.Equal("true", headers["bool"])
+	assert.Equal("2017-01-02T14:04:05.0000005Z", headers["time"])
+	assert.Equal("90000", headers["duration"])
+
+	i, ok, err := RequestHeaderInt64(ctx, "int")
+	assert.Equal(int64(-42), i)
+	assert.True(ok)
+	assert.Nil(err)
+	u, ok, err := RequestHeaderUint64(ctx, "uint")
+	assert.Equal(uint64(42), u)
+	assert.True(ok)
+	assert.Nil(err)
+	f, ok, err := RequestHeaderFloat64(ctx, "float")
+	assert.Equal(1.5, f)
+	assert.True(ok)
+	assert.Nil(err)
+	b, ok, err := RequestHeaderBool(ctx, "bool")
+	assert.True(b)
+	assert.True(ok)
+	assert.Nil(err)
+	tm, ok, err := RequestHeaderTime(ctx, "time")
+	assert.True(now.Equal(tm))
+	assert.True(ok)
+	assert.Nil(err)
+	d, ok, err := RequestHeaderDuration(ctx, "duration")
+	assert.Equal(90*time.Second, d)
+	assert.True(ok)
+	assert.Nil(err)
+}
+
+// Ensures typed response header accessors round trip values.
+func TestTypedResponseHeaders(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("")
+	now := time.Now()
+
+	AddResponseHeaderInt64(ctx, "int", -42)
+	AddResponseHeaderUint64(ctx, "uint", 42)
+	AddResponseHeaderFloat64(ctx, "float", 1.5)
+	AddResponseHeaderBool(ctx, "bool", false)
+	AddResponseHeaderTime(ctx, "time", now)
+	AddResponseHeaderDuration(ctx, "duration", time.Millisecond)
+
+	i, _, err := ResponseHeaderInt64(ctx, "int")
+	assert.Equal(int64(-42), i)
+	assert.Nil(err)
+	u, _, err := ResponseHeaderUint64(ctx, "uint")
+	assert.Equal(uint64(42), u)
+	assert.Nil(err)
+	f, _, err := ResponseHeaderFloat64(ctx, "float")
+	assert.Equal(1.5, f)
+	assert.Nil(err)
+	b, ok, err := ResponseHeaderBool(ctx, "bool")
+	assert.False(b)
+	assert.True(ok)
+	assert.Nil(err)
+	tm, _, err := ResponseHeaderTime(ctx, "time")
+	assert.True(now.Equal(tm))
+	assert.Nil(err)
+	d, _, err := ResponseHeaderDuration(ctx, "duration")
+	assert.Equal(time.Millisecond, d)
+	assert.Nil(err)
+
+	// Durations are truncated to milliseconds.
+	AddResponseHeaderDuration(ctx, "duration", 1500*time.Microsecond)
+	d, _, err = ResponseHeaderDuration(ctx, "duration")
+	assert.Equal(time.Millisecond, d)
+	assert.Nil(err)
+}
+
+// Ensures typed header getters distinguish missing and malformed headers.
+func TestTypedHeadersMissingAndInvalid(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("")
+
+	_, ok, err := RequestHeaderInt64(ctx, "missing")
+	assert.False(ok)
+	assert.Nil(err)
+	_, ok, err = ResponseHeaderTime(ctx, "missing")
+	assert.False(ok)
+	assert.Nil(err)
+
+	ctx.AddRequestHeader("bad", "nope")
+	_, ok, err = RequestHeaderInt64(ctx, "bad")
+	assert.True(ok)
+	assert.Equal(fmt.Errorf(`frugal: header bad has value "nope" which is not a valid int64`), err)
+	_, _, err = RequestHeaderUint64(ctx, "bad")
+	assert.NotNil(err)
+	_, _, err = RequestHeaderFloat64(ctx, "bad")
+	assert.NotNil(err)
+	_, _, err = RequestHeaderBool(ctx, "bad")
+	assert.NotNil(err)
+	_, _, err = RequestHeaderTime(ctx, "bad")
+	assert.NotNil(err)
+	_, _, err = RequestHeaderDuration(ctx, "bad")
+	assert.NotNil(err)
+	ctx.AddRequestHeader("seconds", "1m30s")
+	_, _, err = RequestHeaderDuration(ctx, "seconds")
+	assert.NotNil(err)
+}
+
+// Ensures multi-value headers round trip values containing separators.
+func TestMultiValueHeaders(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("")
+
+	AddRequestHeaderValues(ctx, "roles", "admin", "a,b", "100%", `""`, "")
+	val, _ := ctx.RequestHeader("roles")
+	assert.Equal("admin,a%2Cb,100%25,%22%22,", val)
+	values, ok := RequestHeaderValues(ctx, "roles")
+	assert.True(ok)
+	assert.Equal([]string{"admin", "a,b", "100%", `""`, ""}, values)
+
+	AddResponseHeaderValues(ctx, "flags")
+	values, ok = ResponseHeaderValues(ctx, "flags")
+	assert.True(ok)
+	assert.Equal([]string{}, values)
+
+	// Plain comma separated headers are compatible.
+	ctx.AddResponseHeader("flags", "foo,bar")
+	values, _ = ResponseHeaderValues(ctx, "flags")
+	assert.Equal([]string{"foo", "bar"}, values)
+	ctx.AddRequestHeader("single", "foo%2c%252C")
+	values, _ = RequestHeaderValues(ctx, "single")
+	assert.Equal([]string{"foo,%2C"}, values)
+
+	_, ok = RequestHeaderValues(ctx, "missing")
+	assert.False(ok)
+	_, ok = ResponseHeaderValues(ctx, "missing")
+	assert.False(ok)
+}
+
+// Ensures multi-value headers survive the header protocol round trip.
+func TestMultiValueHeadersProtocol(t *testing.T) {
+	assert := assert.New(t)
+	transport := &thrift.TMemoryBuffer{Buffer: &bytes.Buffer{}}
+	proto := NewFProtocolFactory(tProtocolFactory).GetProtocol(transport)
+	ctx := NewFContext("")
+	AddRequestHeaderValues(ctx, "roles", "admin", "a,b")
+
+	assert.Nil(proto.WriteRequestHeader(ctx))
+	ctx, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	values, ok := RequestHeaderValues(ctx, "roles")
+	assert.True(ok)
+	assert.Equal([]string{"admin", "a,b"}, values)
+}
+
+// Ensures the empty list and a list of one empty value are distinguished
+// through the header protocol round trip.
+func TestEmptyMultiValueHeadersProtocol(t *testing.T) {
+	assert := assert.New(t)
+	for _, expected := range [][]string{{}, {""}, {"", ""}, {`""`}} {
+		transport := &thrift.TMemoryBuffer{Buffer: &bytes.Buffer{}}
+		proto := NewFProtocolFactory(tProtocolFactory).GetProtocol(transport)
+		ctx := NewFContext("")
+		AddRequestHeaderValues(ctx, "roles", expected...)
+
+		assert.Nil(proto.WriteRequestHeader(ctx))
+		ctx, err := proto.ReadRequestHeader()
+		assert.Nil(err)
+		values, ok := RequestHeaderValues(ctx, "roles")
+		assert.True(ok)
+		assert.Equal(expected, values)
+	}
+}
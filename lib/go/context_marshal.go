@@ -0,0 +1,73 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"fmt"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// MarshalFContext serializes the given FContext so it can be persisted or
+// handed off to another process and later restored with UnmarshalFContext.
+// The correlation id, opid, timeout, deadline, and all request and response
+// headers are preserved.
+//
+// The serialized form is the request headers followed by the response
+// headers, each encoded using the Frugal header protocol (including the
+// version byte). The deadline, if any, is carried as a request header.
+func MarshalFContext(ctx FContext) ([]byte, error) {
+	requestHeaders := ctx.RequestHeaders()
+	if deadline, ok := ctx.Deadline(); ok {
+		requestHeaders[deadlineHeader] = formatDeadline(deadline)
+	}
+	requestBuff := writeMarshaler.marshalHeaders(requestHeaders)
+	responseBuff := writeMarshaler.marshalHeaders(ctx.ResponseHeaders())
+	return append(requestBuff, responseBuff...), nil
+}
+
+// UnmarshalFContext deserializes an FContext serialized by MarshalFContext.
+// Unlike an FContext read by a server, the opid is restored as-is rather than
+// being replaced.
+func UnmarshalFContext(data []byte) (FContext, error) {
+	reader := bytes.NewReader(data)
+	requestHeaders, err := readHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	responseHeaders, err := readHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Len() != 0 {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: %d unexpected trailing bytes in serialized FContext", reader.Len()))
+	}
+
+	ctx := &FContextImpl{
+		requestHeaders:  requestHeaders,
+		responseHeaders: responseHeaders,
+	}
+	if deadlineStr, ok := requestHeaders[deadlineHeader]; ok {
+		deadline, err := parseDeadline(deadlineStr)
+		if err != nil {
+			return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+				fmt.Errorf("frugal: invalid %s header %q in serialized FContext", deadlineHeader, deadlineStr))
+		}
+		ctx.deadline = deadline
+		delete(requestHeaders, deadlineHeader)
+	}
+	return ctx, nil
+}
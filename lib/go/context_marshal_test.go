@@ -0,0 +1,76 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures MarshalFContext and UnmarshalFContext round trip an FContext.
+func TestMarshalUnmarshalFContext(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("cid")
+	ctx.SetTimeout(time.Minute)
+	ctx.AddRequestHeader("foo", "bar")
+	ctx.AddResponseHeader("baz", "qux")
+
+	data, err := MarshalFContext(ctx)
+	assert.Nil(err)
+	restored, err := UnmarshalFContext(data)
+	assert.Nil(err)
+	assert.Equal(ctx.RequestHeaders(), restored.RequestHeaders())
+	assert.Equal(ctx.ResponseHeaders(), restored.ResponseHeaders())
+	assert.Equal("cid", restored.CorrelationID())
+	assert.Equal(time.Minute, restored.Timeout())
+	_, ok := restored.Deadline()
+	assert.False(ok)
+
+	// Deadlines should be preserved to millisecond precision.
+	deadline := time.Unix(1500000000, 123000000)
+	ctx.(*FContextImpl).setDeadline(deadline)
+	data, err = MarshalFContext(ctx)
+	assert.Nil(err)
+	restored, err = UnmarshalFContext(data)
+	assert.Nil(err)
+	actual, ok := restored.Deadline()
+	assert.True(ok)
+	assert.True(deadline.Equal(actual))
+	assert.Equal(ctx.RequestHeaders(), restored.RequestHeaders())
+}
+
+// Ensures UnmarshalFContext rejects malformed data.
+func TestUnmarshalFContextInvalid(t *testing.T) {
+	data, err := MarshalFContext(NewFContext(""))
+	assert.Nil(t, err)
+
+	_, err = UnmarshalFContext(data[:len(data)-1])
+	assert.NotNil(t, err)
+
+	_, err = UnmarshalFContext(append(data, 0))
+	assert.Equal(t, thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+
+	_, err = UnmarshalFContext([]byte{2})
+	assert.Equal(t, thrift.BAD_VERSION, err.(thrift.TProtocolException).TypeId())
+
+	ctx := NewFContext("")
+	ctx.AddRequestHeader(deadlineHeader, "abc")
+	data, err = MarshalFContext(ctx)
+	assert.Nil(t, err)
+	_, err = UnmarshalFContext(data)
+	assert.Equal(t, thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+}
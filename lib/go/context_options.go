@@ -0,0 +1,93 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import "time"
+
+// FContextOption configures an FContext created by NewFContextWithOptions.
+type FContextOption func(*fContextOptions)
+
+// fContextOptions holds the configuration applied by FContextOptions.
+type fContextOptions struct {
+	correlationID  string
+	timeout        time.Duration
+	requestHeaders map[string]string
+	headerLimits   HeaderLimits
+}
+
+// WithCorrelationID sets the correlation id of the FContext. If not given, or
+// empty, one is generated.
+func WithCorrelationID(correlationID string) FContextOption {
+	return func(o *fContextOptions) {
+		o.correlationID = correlationID
+	}
+}
+
+// WithTimeout sets the request timeout of the FContext. If not given, the
+// default of five seconds is used. Non-positive timeouts are ignored.
+func WithTimeout(timeout time.Duration) FContextOption {
+	return func(o *fContextOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithRequestHeaders adds the given request headers to the FContext. Headers
+// are added as if by AddRequestHeader, so reserved headers and header limits
+// are respected. Multiple WithRequestHeaders options are merged, with later
+// values taking precedence.
+func WithRequestHeaders(headers map[string]string) FContextOption {
+	return func(o *fContextOptions) {
+		if o.requestHeaders == nil {
+			o.requestHeaders = make(map[string]string, len(headers))
+		}
+		for name, value := range headers {
+			o.requestHeaders[name] = value
+		}
+	}
+}
+
+// WithContextHeaderLimits sets the HeaderLimits enforced when request headers
+// are added to the FContext. See SetHeaderLimits.
+func WithContextHeaderLimits(limits HeaderLimits) FContextOption {
+	return func(o *fContextOptions) {
+		o.headerLimits = limits
+	}
+}
+
+// NewFContextWithOptions returns an FContext configured by the given options,
+// allowing a fully configured context to be built in one expression:
+//
+//	ctx := frugal.NewFContextWithOptions(
+//		frugal.WithCorrelationID(cid),
+//		frugal.WithTimeout(time.Second),
+//		frugal.WithRequestHeaders(map[string]string{"tenant": "acme"}),
+//	)
+//
+// With no options it is equivalent to NewFContext("").
+func NewFContextWithOptions(opts ...FContextOption) FContext {
+	options := &fContextOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	ctx := NewFContext(options.correlationID).(*FContextImpl)
+	ctx.SetHeaderLimits(options.headerLimits)
+	if options.timeout > 0 {
+		ctx.SetTimeout(options.timeout)
+	}
+	for name, value := range options.requestHeaders {
+		ctx.AddRequestHeader(name, value)
+	}
+	return ctx
+}
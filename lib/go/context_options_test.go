@@ -0,0 +1,62 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures NewFContextWithOptions applies each option.
+func TestNewFContextWithOptions(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContextWithOptions(
+		WithCorrelationID("cid"),
+		WithTimeout(time.Second),
+		WithRequestHeaders(map[string]string{"foo": "bar", "baz": "qux"}),
+		WithRequestHeaders(map[string]string{"foo": "buzz"}),
+	)
+	assert.Equal("cid", ctx.CorrelationID())
+	assert.Equal(time.Second, ctx.Timeout())
+	foo, _ := ctx.RequestHeader("foo")
+	assert.Equal("buzz", foo)
+	baz, _ := ctx.RequestHeader("baz")
+	assert.Equal("qux", baz)
+	_, ok := ctx.RequestHeader(opIDHeader)
+	assert.True(ok)
+}
+
+// Ensures NewFContextWithOptions with no options matches NewFContext.
+func TestNewFContextWithOptionsDefaults(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContextWithOptions(WithTimeout(-time.Second))
+	assert.NotEmpty(ctx.CorrelationID())
+	assert.Equal(defaultTimeout, ctx.Timeout())
+	assert.Len(ctx.RequestHeaders(), 3)
+}
+
+// Ensures header limits given as an option apply to the headers given as
+// options.
+func TestNewFContextWithOptionsHeaderLimits(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContextWithOptions(
+		WithRequestHeaders(map[string]string{"foo": "bar"}),
+		WithContextHeaderLimits(HeaderLimits{MaxCount: 3}),
+	)
+	_, ok := ctx.RequestHeader("foo")
+	assert.False(ok)
+	assert.Error(TryAddRequestHeader(ctx, "foo", "bar"))
+}
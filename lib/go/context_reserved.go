@@ -0,0 +1,131 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"strings"
+	"sync"
+)
+
+var (
+	reservedHeaderProtection bool
+	reservedHeaderPrefixes   []string
+	reservedHeaderMu         sync.RWMutex
+)
+
+// SetReservedHeaderProtection enables or disables reserved header protection.
+// It is disabled by default. When enabled, AddRequestHeader and
+// AddResponseHeader discard (and log) writes to headers reserved by Frugal,
+// such as _cid and _opid, and to headers matching a prefix registered with
+// RegisterReservedHeaderPrefix. Reserved headers can then only be written
+// through dedicated setters such as SetCorrelationID, AddReservedRequestHeader
+// and AddReservedResponseHeader.
+func SetReservedHeaderProtection(enabled bool) {
+	reservedHeaderMu.Lock()
+	reservedHeaderProtection = enabled
+	reservedHeaderMu.Unlock()
+}
+
+// RegisterReservedHeaderPrefix reserves all request and response headers
+// starting with the given prefix. This allows libraries built on Frugal to
+// protect their own headers from being clobbered by application code.
+func RegisterReservedHeaderPrefix(prefix string) {
+	if prefix == "" {
+		return
+	}
+	reservedHeaderMu.Lock()
+	defer reservedHeaderMu.Unlock()
+	for _, existing := range reservedHeaderPrefixes {
+		if existing == prefix {
+			return
+		}
+	}
+	reservedHeaderPrefixes = append(reservedHeaderPrefixes, prefix)
+}
+
+// IsReservedRequestHeader returns true if the named request header is
+// reserved, either by Frugal or by a registered prefix.
+func IsReservedRequestHeader(name string) bool {
+	switch name {
+	case cidHeader, opIDHeader, timeoutHeader, deadlineHeader, remainingHeader, priorityHeader, idempotentHeader,
+		idempotencyKeyHeader, deadLetterTopicHeader, deadLetterAttemptsHeader, deadLetterErrorHeader:
+		return true
+	}
+	return hasReservedPrefix(name)
+}
+
+// IsReservedResponseHeader returns true if the named response header is
+// reserved, either by Frugal or by a registered prefix.
+func IsReservedResponseHeader(name string) bool {
+	switch name {
+	case opIDHeader, cacheTTLHeader:
+		return true
+	}
+	return hasReservedPrefix(name)
+}
+
+// SetCorrelationID sets the correlation id for the context. Unlike
+// AddRequestHeader, this is permitted when reserved header protection is
+// enabled. Returns the same FContext to allow for chaining calls.
+func SetCorrelationID(ctx FContext, correlationID string) FContext {
+	setRequestHeader(ctx, cidHeader, correlationID)
+	return ctx
+}
+
+// AddReservedRequestHeader adds a request header to the context, bypassing
+// reserved header protection. This is intended for libraries writing headers
+// under a prefix they registered with RegisterReservedHeaderPrefix. Returns
+// the same FContext to allow for chaining calls.
+func AddReservedRequestHeader(ctx FContext, name, value string) FContext {
+	setRequestHeader(ctx, name, value)
+	return ctx
+}
+
+// AddReservedResponseHeader adds a response header to the context, bypassing
+// reserved header protection. This is intended for libraries writing headers
+// under a prefix they registered with RegisterReservedHeaderPrefix. Returns
+// the same FContext to allow for chaining calls.
+func AddReservedResponseHeader(ctx FContext, name, value string) FContext {
+	setResponseHeader(ctx, name, value)
+	return ctx
+}
+
+// isProtectedRequestHeader returns true if writes to the named request header
+// should be discarded.
+func isProtectedRequestHeader(name string) bool {
+	return protectionEnabled() && IsReservedRequestHeader(name)
+}
+
+// isProtectedResponseHeader returns true if writes to the named response
+// header should be discarded.
+func isProtectedResponseHeader(name string) bool {
+	return protectionEnabled() && IsReservedResponseHeader(name)
+}
+
+func protectionEnabled() bool {
+	reservedHeaderMu.RLock()
+	defer reservedHeaderMu.RUnlock()
+	return reservedHeaderProtection
+}
+
+func hasReservedPrefix(name string) bool {
+	reservedHeaderMu.RLock()
+	defer reservedHeaderMu.RUnlock()
+	for _, prefix := range reservedHeaderPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+func resetReservedHeaders() {
+	reservedHeaderMu.Lock()
+	reservedHeaderProtection = false
+	reservedHeaderPrefixes = nil
+	reservedHeaderMu.Unlock()
+}
+
+// Ensures reserved headers can be overwritten when protection is disabled.
+func TestReservedHeaderProtectionDisabled(t *testing.T) {
+	defer resetReservedHeaders()
+	RegisterReservedHeaderPrefix("x-lib-")
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader(cidHeader, "other")
+	ctx.AddRequestHeader("x-lib-foo", "bar")
+	assert.Equal(t, "other", ctx.CorrelationID())
+	val, _ := ctx.RequestHeader("x-lib-foo")
+	assert.Equal(t, "bar", val)
+}
+
+// Ensures writes to reserved headers are discarded when protection is
+// enabled, while dedicated setters still work.
+func TestReservedHeaderProtectionEnabled(t *testing.T) {
+	assert := assert.New(t)
+	defer resetReservedHeaders()
+	SetReservedHeaderProtection(true)
+	RegisterReservedHeaderPrefix("x-lib-")
+	RegisterReservedHeaderPrefix("x-lib-")
+	RegisterReservedHeaderPrefix("")
+	assert.Equal([]string{"x-lib-"}, reservedHeaderPrefixes)
+
+	ctx := NewFContext("cid")
+	opID, err := getOpID(ctx)
+	assert.Nil(err)
+	ctx.AddRequestHeader(cidHeader, "other")
+	ctx.AddRequestHeader(opIDHeader, "123")
+	ctx.AddRequestHeader(timeoutHeader, "1")
+	ctx.AddRequestHeader("x-lib-foo", "bar")
+	ctx.AddRequestHeader("foo", "bar")
+	ctx.AddResponseHeader(opIDHeader, "123")
+	ctx.AddResponseHeader("x-lib-foo", "bar")
+	ctx.AddResponseHeader(cidHeader, "cid")
+
+	assert.Equal("cid", ctx.CorrelationID())
+	actual, err := getOpID(ctx)
+	assert.Nil(err)
+	assert.Equal(opID, actual)
+	assert.Equal(defaultTimeout, ctx.Timeout())
+	_, ok := ctx.RequestHeader("x-lib-foo")
+	assert.False(ok)
+	val, _ := ctx.RequestHeader("foo")
+	assert.Equal("bar", val)
+	_, ok = ctx.ResponseHeader(opIDHeader)
+	assert.False(ok)
+	_, ok = ctx.ResponseHeader("x-lib-foo")
+	assert.False(ok)
+	val, _ = ctx.ResponseHeader(cidHeader)
+	assert.Equal("cid", val)
+
+	SetCorrelationID(ctx, "other")
+	AddReservedRequestHeader(ctx, "x-lib-foo", "bar")
+	AddReservedResponseHeader(ctx, "x-lib-foo", "baz")
+	assert.Equal("other", ctx.CorrelationID())
+	val, _ = ctx.RequestHeader("x-lib-foo")
+	assert.Equal("bar", val)
+	val, _ = ctx.ResponseHeader("x-lib-foo")
+	assert.Equal("baz", val)
+}
+
+// Ensures reserved header protection does not interfere with the protocol
+// reading and writing reserved headers.
+func TestReservedHeaderProtectionProtocol(t *testing.T) {
+	assert := assert.New(t)
+	defer resetReservedHeaders()
+	SetReservedHeaderProtection(true)
+	transport := &thrift.TMemoryBuffer{Buffer: &bytes.Buffer{}}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(transport))
+	ctx := NewFContext("123")
+	opID, _ := getOpID(ctx)
+
+	assert.Nil(proto.WriteRequestHeader(ctx))
+	serverCtx, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	assert.Equal("123", serverCtx.CorrelationID())
+	respOpID, _ := serverCtx.ResponseHeader(opIDHeader)
+	assert.Equal(strconv.FormatUint(opID, 10), respOpID)
+
+	setRequestOpID(ctx, 42)
+	actual, _ := getOpID(ctx)
+	assert.Equal(uint64(42), actual)
+}
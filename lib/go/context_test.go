@@ -32,15 +32,29 @@ func TestCorrelationID(t *testing.T) {
 // one is not supplied.
 func TestNewCorrelationID(t *testing.T) {
 	cid := "abc"
-	oldCID := generateCorrelationID
-	defer func() { generateCorrelationID = oldCID }()
-	generateCorrelationID = func() string { return cid }
+	SetCorrelationIDGenerator(func() string { return cid })
+	defer SetCorrelationIDGenerator(nil)
 
 	ctx := NewFContext("")
 
 	assert.Equal(t, cid, ctx.CorrelationID())
 }
 
+// Ensures the default correlation id generator is used when the configured
+// generator is reset or returns an empty id.
+func TestCorrelationIDGeneratorDefault(t *testing.T) {
+	assert := assert.New(t)
+	SetCorrelationIDGenerator(func() string { return "" })
+	defer SetCorrelationIDGenerator(nil)
+	assert.Len(NewFContext("").CorrelationID(), 32)
+
+	SetCorrelationIDGenerator(nil)
+	cid1 := NewFContext("").CorrelationID()
+	cid2 := NewFContext("").CorrelationID()
+	assert.Len(cid1, 32)
+	assert.NotEqual(cid1, cid2)
+}
+
 // Ensures the "_opid" request header for an FContext is returned for calls to
 // getOpID.
 func TestOpID(t *testing.T) {
@@ -140,3 +154,71 @@ func TestFContextClone(t *testing.T) {
 	_, ok := cloned.RequestHeader("baz")
 	assert.False(t, ok)
 }
+
+// Ensures the FContextImpl Clone method copies headers and the deadline while
+// assigning a new opid to each clone.
+func TestFContextImplClone(t *testing.T) {
+	ctx := NewFContext("some-id").(*FContextImpl)
+	ctx.AddRequestHeader("foo", "bar")
+	ctx.AddResponseHeader("baz", "qux")
+	deadline := time.Now().Add(time.Minute)
+	ctx.setDeadline(deadline)
+
+	clone1 := ctx.Clone()
+	clone2 := Clone(ctx)
+	origOpID, _ := getOpID(ctx)
+	opID1, _ := getOpID(clone1)
+	opID2, _ := getOpID(clone2)
+	assert.NotEqual(t, origOpID, opID1)
+	assert.NotEqual(t, origOpID, opID2)
+	assert.NotEqual(t, opID1, opID2)
+
+	for _, clone := range []FContext{clone1, clone2} {
+		assert.Equal(t, "some-id", clone.CorrelationID())
+		val, _ := clone.RequestHeader("foo")
+		assert.Equal(t, "bar", val)
+		val, _ = clone.ResponseHeader("baz")
+		assert.Equal(t, "qux", val)
+		cloneDeadline, ok := clone.Deadline()
+		assert.True(t, ok)
+		assert.Equal(t, deadline, cloneDeadline)
+	}
+
+	// Modifying a clone shouldn't affect the original.
+	clone1.AddResponseHeader("baz", "changed")
+	val, _ := ctx.ResponseHeader("baz")
+	assert.Equal(t, "qux", val)
+}
+
+// Ensures RangeRequestHeaders and RangeResponseHeaders visit every header,
+// stop early when asked, and work for other FContext implementations.
+func TestRangeHeaders(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("foo", "bar")
+	ctx.AddResponseHeader("baz", "qux")
+	wrapped := struct{ FContext }{ctx}
+
+	for _, c := range []FContext{ctx, wrapped} {
+		visited := make(map[string]string)
+		RangeRequestHeaders(c, func(name, value string) bool {
+			visited[name] = value
+			return true
+		})
+		assert.Equal(ctx.RequestHeaders(), visited)
+
+		visited = make(map[string]string)
+		RangeResponseHeaders(c, func(name, value string) bool {
+			visited[name] = value
+			return true
+		})
+		assert.Equal(map[string]string{"baz": "qux"}, visited)
+
+		count := 0
+		RangeRequestHeaders(c, func(name, value string) bool {
+			count++
+			return false
+		})
+		assert.Equal(1, count)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"reflect"
+	"time"
+)
+
+// FContextView is an immutable snapshot of an FContext. It exposes the
+// correlation id, headers, and timeout of the context it was taken from but
+// cannot be used to modify them, making it safe to hand to code which should
+// only observe a request, such as logging or telemetry.
+type FContextView struct {
+	correlationID   string
+	requestHeaders  map[string]string
+	responseHeaders map[string]string
+	timeout         time.Duration
+	deadline        time.Time
+	hasDeadline     bool
+}
+
+// NewFContextView returns a snapshot of the given FContext. Later changes to
+// the FContext are not reflected in the view.
+func NewFContextView(ctx FContext) FContextView {
+	deadline, ok := ctx.Deadline()
+	return FContextView{
+		correlationID:   ctx.CorrelationID(),
+		requestHeaders:  ctx.RequestHeaders(),
+		responseHeaders: ctx.ResponseHeaders(),
+		timeout:         ctx.Timeout(),
+		deadline:        deadline,
+		hasDeadline:     ok,
+	}
+}
+
+// CorrelationID returns the correlation id of the context.
+func (v FContextView) CorrelationID() string {
+	return v.correlationID
+}
+
+// RequestHeader gets the named request header.
+func (v FContextView) RequestHeader(name string) (string, bool) {
+	value, ok := v.requestHeaders[name]
+	return value, ok
+}
+
+// RequestHeaders returns a copy of the request headers map.
+func (v FContextView) RequestHeaders() map[string]string {
+	return copyHeaders(v.requestHeaders)
+}
+
+// RangeRequestHeaders calls f for each request header without copying the
+// headers map, stopping if f returns false.
+func (v FContextView) RangeRequestHeaders(f func(name, value string) bool) {
+	rangeHeaders(v.requestHeaders, f)
+}
+
+// ResponseHeader gets the named response header.
+func (v FContextView) ResponseHeader(name string) (string, bool) {
+	value, ok := v.responseHeaders[name]
+	return value, ok
+}
+
+// ResponseHeaders returns a copy of the response headers map.
+func (v FContextView) ResponseHeaders() map[string]string {
+	return copyHeaders(v.responseHeaders)
+}
+
+// RangeResponseHeaders calls f for each response header without copying the
+// headers map, stopping if f returns false.
+func (v FContextView) RangeResponseHeaders(f func(name, value string) bool) {
+	rangeHeaders(v.responseHeaders, f)
+}
+
+// Timeout returns the request timeout.
+func (v FContextView) Timeout() time.Duration {
+	return v.timeout
+}
+
+// Deadline returns the request deadline, if the context had one.
+func (v FContextView) Deadline() (time.Time, bool) {
+	return v.deadline, v.hasDeadline
+}
+
+// RemainingTimeout returns how long remains until the request deadline, or
+// the timeout if the context had no deadline.
+func (v FContextView) RemainingTimeout() time.Duration {
+	return remainingTimeout(v)
+}
+
+// ContextView returns a read-only snapshot of the FContext argument.
+func (a Arguments) ContextView() FContextView {
+	return NewFContextView(a.Context())
+}
+
+// NewObserverMiddleware returns ServiceMiddleware which calls the given
+// observer with a read-only view of the FContext once each invocation has
+// completed, so response headers set by the handler are included. The
+// observer cannot modify the FContext, arguments, or results.
+func NewObserverMiddleware(observer func(method reflect.Method, ctx FContextView)) ServiceMiddleware {
+	return func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			results := next(service, method, args)
+			observer(method, args.ContextView())
+			return results
+		}
+	}
+}
+
+func copyHeaders(headers map[string]string) map[string]string {
+	headersCopy := make(map[string]string, len(headers))
+	for name, value := range headers {
+		headersCopy[name] = value
+	}
+	return headersCopy
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures FContextView snapshots the FContext and can't be used to modify it.
+func TestFContextView(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("foo", "bar")
+	ctx.AddResponseHeader("baz", "qux")
+	ctx.SetTimeout(time.Second)
+	view := NewFContextView(ctx)
+
+	ctx.AddRequestHeader("foo", "buzz")
+	assert.Equal("cid", view.CorrelationID())
+	foo, ok := view.RequestHeader("foo")
+	assert.True(ok)
+	assert.Equal("bar", foo)
+	baz, ok := view.ResponseHeader("baz")
+	assert.True(ok)
+	assert.Equal("qux", baz)
+	assert.Equal(time.Second, view.Timeout())
+	_, ok = view.Deadline()
+	assert.False(ok)
+
+	view.RequestHeaders()["foo"] = "fizz"
+	view.ResponseHeaders()["baz"] = "fizz"
+	foo, _ = view.RequestHeader("foo")
+	assert.Equal("bar", foo)
+	baz, _ = view.ResponseHeader("baz")
+	assert.Equal("qux", baz)
+}
+
+// Ensures NewObserverMiddleware calls the observer after the invocation with
+// a view of the FContext.
+func TestObserverMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		observedMethod string
+		observedView   FContextView
+	)
+	observer := func(method reflect.Method, view FContextView) {
+		observedMethod = method.Name
+		observedView = view
+	}
+	handler := &testHandler{}
+	setHeader := func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			results := next(service, method, args)
+			args.Context().AddResponseHeader("foo", "bar")
+			return results
+		}
+	}
+	method := NewMethod(handler, handler.handlerMethod, "handlerMethod",
+		[]ServiceMiddleware{setHeader, NewObserverMiddleware(observer)})
+
+	ret := method.Invoke([]interface{}{NewFContext("cid"), 42})
+
+	assert.Equal("foo", ret[0])
+	assert.Equal("handlerMethod", observedMethod)
+	assert.Equal("cid", observedView.CorrelationID())
+	foo, _ := observedView.ResponseHeader("foo")
+	assert.Equal("bar", foo)
+}
+
+// Ensures FContextView header iteration visits the snapshot headers.
+func TestFContextViewRangeHeaders(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("cid")
+	ctx.AddResponseHeader("baz", "qux")
+	view := NewFContextView(ctx)
+
+	visited := make(map[string]string)
+	view.RangeRequestHeaders(func(name, value string) bool {
+		visited[name] = value
+		return true
+	})
+	assert.Equal(ctx.RequestHeaders(), visited)
+
+	visited = make(map[string]string)
+	view.RangeResponseHeaders(func(name, value string) bool {
+		visited[name] = value
+		return true
+	})
+	assert.Equal(map[string]string{"baz": "qux"}, visited)
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// Headers added to dead-lettered frames describing the failure.
+	deadLetterTopicHeader    = "_dl_topic"
+	deadLetterAttemptsHeader = "_dl_attempts"
+	deadLetterErrorHeader    = "_dl_error"
+
+	// maxDeadLetterTracked bounds the number of failing messages a
+	// subscription counts the attempts of, for transports which don't
+	// redeliver failed messages.
+	maxDeadLetterTracked = 1024
+)
+
+// FDeadLetterPolicy configures dead-lettering of messages whose subscriber
+// handler keeps failing. Once a message has failed MaxAttempts times, it's
+// published to Topic with headers describing the failure, which
+// DeadLetterInfo returns, and acknowledged so it stops being redelivered.
+type FDeadLetterPolicy struct {
+	// Topic is the topic dead-lettered messages are published to.
+	Topic string
+
+	// MaxAttempts is the number of times a message's handler may fail
+	// before it's dead-lettered. Zero dead-letters a message the first time
+	// its handler fails.
+	MaxAttempts uint
+}
+
+// FDeadLetterInfo describes why a message was dead-lettered.
+type FDeadLetterInfo struct {
+	// Topic is the topic the message was originally published to.
+	Topic string
+
+	// Attempts is the number of times the message's handler failed.
+	Attempts uint
+
+	// Error is the error returned by the last failed attempt.
+	Error string
+}
+
+// DeadLetterInfo returns how the message read with the given FContext came to
+// be dead-lettered. Returns false if the message wasn't dead-lettered.
+func DeadLetterInfo(ctx FContext) (FDeadLetterInfo, bool) {
+	topic, ok := ctx.RequestHeader(deadLetterTopicHeader)
+	if !ok {
+		return FDeadLetterInfo{}, false
+	}
+	info := FDeadLetterInfo{Topic: topic}
+	if attempts, ok := ctx.RequestHeader(deadLetterAttemptsHeader); ok {
+		n, _ := strconv.ParseUint(attempts, 10, 32)
+		info.Attempts = uint(n)
+	}
+	info.Error, _ = ctx.RequestHeader(deadLetterErrorHeader)
+	return info, true
+}
+
+// WithDeadLetterPolicy configures the FScopeProvider to dead-letter messages
+// received by its subscribers according to the given policy. Dead letters are
+// published with the FPublisherTransports of the FScopeProvider. Returns the
+// FScopeProvider for chaining.
+func (p *FScopeProvider) WithDeadLetterPolicy(policy FDeadLetterPolicy) *FScopeProvider {
+	p.deadLetter = &policy
+	return p
+}
+
+// deadLetterSubscriberTransport wraps an FSubscriberTransport, counting
+// failed attempts to handle each message and dead-lettering those which fail
+// too many times.
+type deadLetterSubscriberTransport struct {
+	FSubscriberTransport
+	policy   FDeadLetterPolicy
+	provider *FScopeProvider
+
+	mu        sync.Mutex
+	topic     string
+	attempts  map[[sha256.Size]byte]uint
+	publisher FPublisherTransport
+}
+
+func newDeadLetterSubscriberTransport(transport FSubscriberTransport, policy FDeadLetterPolicy,
+	provider *FScopeProvider) *deadLetterSubscriberTransport {
+	return &deadLetterSubscriberTransport{
+		FSubscriberTransport: transport,
+		policy:               policy,
+		provider:             provider,
+		attempts:             make(map[[sha256.Size]byte]uint),
+	}
+}
+
+// Subscribe subscribes to the given topic, dead-lettering messages the given
+// callback fails to handle.
+func (d *deadLetterSubscriberTransport) Subscribe(topic string, callback FAsyncCallback) error {
+	d.mu.Lock()
+	d.topic = topic
+	d.mu.Unlock()
+	return d.FSubscriberTransport.Subscribe(topic, func(transport thrift.TTransport) error {
+		return d.handle(transport, callback)
+	})
+}
+
+// Unsubscribe unsubscribes from the topic and closes the dead letter
+// publisher.
+func (d *deadLetterSubscriberTransport) Unsubscribe() error {
+	err := d.FSubscriberTransport.Unsubscribe()
+	d.closePublisher()
+	return err
+}
+
+// Remove unsubscribes and removes durably stored information on the broker,
+// if applicable, and closes the dead letter publisher.
+func (d *deadLetterSubscriberTransport) Remove() error {
+	var err error
+	if r, ok := d.FSubscriberTransport.(remover); ok {
+		err = r.Remove()
+	} else {
+		err = d.FSubscriberTransport.Unsubscribe()
+	}
+	d.closePublisher()
+	return err
+}
+
+func (d *deadLetterSubscriberTransport) handle(transport thrift.TTransport, callback FAsyncCallback) error {
+	frame, err := ioutil.ReadAll(transport)
+	if err != nil {
+		return err
+	}
+	buffer := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame)}
+	ack, acked := transport.(*ackTransport)
+	if acked {
+		transport = &ackTransport{TMemoryBuffer: buffer, ack: ack.ack}
+	} else {
+		transport = buffer
+	}
+
+	key := sha256.Sum256(frame)
+	cbErr := callback(transport)
+	d.mu.Lock()
+	if cbErr == nil {
+		delete(d.attempts, key)
+		d.mu.Unlock()
+		return nil
+	}
+	attempts := d.attempts[key] + 1
+	if attempts < d.policy.MaxAttempts {
+		if _, ok := d.attempts[key]; !ok && len(d.attempts) >= maxDeadLetterTracked {
+			for k := range d.attempts {
+				delete(d.attempts, k)
+				break
+			}
+		}
+		d.attempts[key] = attempts
+		d.mu.Unlock()
+		return cbErr
+	}
+	delete(d.attempts, key)
+	topic := d.topic
+	d.mu.Unlock()
+
+	if err := d.publish(topic, frame, attempts, cbErr); err != nil {
+		logger().Errorf("frugal: error publishing dead letter to %s: %s", d.policy.Topic, err)
+		return cbErr
+	}
+	if acked {
+		// The message was dead-lettered, so stop it being redelivered even
+		// if the handler asked for it to be.
+		ack.ack.decide(ackAlways, 0)
+	}
+	return nil
+}
+
+// publish publishes the given frame, excluding its frame size, to the dead
+// letter topic with headers describing the failure.
+func (d *deadLetterSubscriberTransport) publish(topic string, frame []byte, attempts uint, cbErr error) error {
+	publisher, err := d.getPublisher()
+	if err != nil {
+		return err
+	}
+	framed := prependFrameSize(frame)
+	deadLetter, err := addHeadersToFrame(framed, map[string]string{
+		deadLetterTopicHeader:    topic,
+		deadLetterAttemptsHeader: strconv.FormatUint(uint64(attempts), 10),
+		deadLetterErrorHeader:    cbErr.Error(),
+	})
+	if err != nil {
+		// Frames whose headers can't be rewritten, such as sealed frames,
+		// are dead-lettered as is.
+		logger().Warnf("frugal: dead-lettering frame without failure headers: %s", err)
+		deadLetter = framed
+	}
+	return publisher.Publish(d.policy.Topic, deadLetter)
+}
+
+func (d *deadLetterSubscriberTransport) getPublisher() (FPublisherTransport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.publisher == nil {
+		d.publisher, _ = d.provider.NewPublisher()
+	}
+	if !d.publisher.IsOpen() {
+		if err := d.publisher.Open(); err != nil {
+			return nil, err
+		}
+	}
+	return d.publisher, nil
+}
+
+func (d *deadLetterSubscriberTransport) closePublisher() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.publisher != nil && d.publisher.IsOpen() {
+		if err := d.publisher.Close(); err != nil {
+			logger().Warnf("frugal: error closing dead letter publisher: %s", err)
+		}
+	}
+}
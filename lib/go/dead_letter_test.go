@@ -0,0 +1,99 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures messages are dead-lettered with their failure once their handler
+// has failed the configured number of times, and acknowledged.
+func TestDeadLetterPolicy(t *testing.T) {
+	assert := assert.New(t)
+	kafka := newMockKafka()
+	provider := NewFScopeProvider(
+		NewFKafkaPublisherTransportFactoryBuilder(kafka).Build(),
+		NewFKafkaSubscriberTransportFactory(kafka, "group"),
+		NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()),
+	).WithDeadLetterPolicy(FDeadLetterPolicy{Topic: "dlq", MaxAttempts: 3})
+
+	subscriber, _ := provider.NewSubscriber()
+	attempts := 0
+	assert.Nil(subscriber.Subscribe("foo", func(thrift.TTransport) error {
+		attempts++
+		return errors.New("poison")
+	}))
+	dlq, _ := provider.NewSubscriber()
+	dead := make(chan FDeadLetterInfo, 1)
+	assert.Nil(dlq.Subscribe("dlq", ackingCallback(t, func(ctx FContext) error {
+		info, ok := DeadLetterInfo(ctx)
+		assert.True(ok)
+		dead <- info
+		return nil
+	})))
+
+	frame := newKafkaFrame(t, nil, "payload")
+	for i := 0; i < 3; i++ {
+		err := kafka.Produce("foo", nil, frame)
+		assert.Nil(err)
+	}
+	assert.Equal(3, attempts)
+	assert.Equal(FDeadLetterInfo{Topic: "foo", Attempts: 3, Error: "poison"}, <-dead)
+	assert.Equal(2, kafka.failures)
+
+	// The count restarts once a message is dead-lettered.
+	assert.Nil(kafka.Produce("foo", nil, frame))
+	assert.Equal(3, kafka.failures)
+	assert.Len(dead, 0)
+
+	assert.Nil(subscriber.Unsubscribe())
+	assert.Nil(dlq.Unsubscribe())
+}
+
+// Ensures messages which are handled before running out of attempts aren't
+// dead-lettered, and that failures are returned for redelivery.
+func TestDeadLetterPolicyRecovers(t *testing.T) {
+	assert := assert.New(t)
+	kafka := newMockKafka()
+	provider := NewFScopeProvider(
+		NewFKafkaPublisherTransportFactoryBuilder(kafka).Build(),
+		NewFKafkaSubscriberTransportFactory(kafka, "group"),
+		NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()),
+	).WithDeadLetterPolicy(FDeadLetterPolicy{Topic: "dlq", MaxAttempts: 2})
+
+	subscriber, _ := provider.NewSubscriber()
+	fail := true
+	assert.Nil(subscriber.Subscribe("foo", ackingCallback(t, func(ctx FContext) error {
+		_, ok := DeadLetterInfo(ctx)
+		assert.False(ok)
+		if fail {
+			fail = false
+			return errors.New("flaky")
+		}
+		return nil
+	})))
+
+	frame := newKafkaFrame(t, nil, "payload")
+	assert.Nil(kafka.Produce("foo", nil, frame))
+	assert.Nil(kafka.Produce("foo", nil, frame))
+	assert.Equal(1, kafka.failures)
+	for _, message := range kafka.produced {
+		assert.Equal("foo", message.topic)
+	}
+	assert.Nil(subscriber.Unsubscribe())
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// protocolJSONDebug identifies headers encoded as a JSON object. The version
+// byte is the object's opening brace, so the headers of a debug frame read as
+// plain JSON.
+const protocolJSONDebug = '{'
+
+var jsonDebugMarshaler = &jsonDebugProtocolMarshaler{}
+
+// NewFJSONDebugProtocolFactory returns an FProtocolFactory which produces a
+// human-readable frame for development and capture tooling. The headers are
+// written as a JSON object on a single line, followed by the message
+// serialized with Thrift's JSON protocol, so a frame body can be inspected
+// with any JSON tool. Debug frames are much larger and slower to process than
+// binary ones and are only understood by runtimes which support the debug
+// header encoding, so this should not be used in production. Servers using
+// this factory read frames with either header encoding.
+func NewFJSONDebugProtocolFactory() *FProtocolFactory {
+	factory := NewFProtocolFactory(thrift.NewTJSONProtocolFactory())
+	factory.marshaler = jsonDebugMarshaler
+	return factory
+}
+
+// jsonDebugProtocolMarshaler implements the protocolMarshaler interface for
+// the JSON debug header encoding. Headers are a JSON object terminated by a
+// newline. Control characters are always escaped within JSON strings, so the
+// first newline ends the headers.
+type jsonDebugProtocolMarshaler struct{}
+
+// marshalHeaders serializes the given headers map to a byte slice. Keys are
+// sorted so the encoding is deterministic.
+func (j *jsonDebugProtocolMarshaler) marshalHeaders(headers map[string]string) []byte {
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	// Marshaling a map of strings cannot fail.
+	buff, _ := json.Marshal(headers)
+	return append(buff, '\n')
+}
+
+// unmarshalHeaders reads headers from the reader into a map, enforcing the
+// given limits. The opening brace has already been consumed as the version.
+func (j *jsonDebugProtocolMarshaler) unmarshalHeaders(reader io.Reader, limits HeaderLimits) (map[string]string, error) {
+	buff := []byte{protocolJSONDebug}
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(reader, b); err != nil {
+			if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
+				return nil, err
+			}
+			return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+				fmt.Sprintf("frugal: error reading protocol headers in unmarshalHeaders: %s", err))
+		}
+		if b[0] == '\n' {
+			break
+		}
+		buff = append(buff, b[0])
+		if len(buff) > defaultMaxLength {
+			return nil, &HeaderLimitError{Size: len(buff), Limits: limits}
+		}
+	}
+
+	headers, err := j.decode(buff)
+	if err != nil {
+		return nil, err
+	}
+	if err := limits.check(headers); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// unmarshalHeadersFromFrame reads serialized headers from the byte slice into
+// a map.
+func (j *jsonDebugProtocolMarshaler) unmarshalHeadersFromFrame(frame []byte) (map[string]string, error) {
+	end, err := j.headersEnd(frame)
+	if err != nil {
+		return nil, err
+	}
+	return j.decode(append([]byte{protocolJSONDebug}, frame[:end]...))
+}
+
+// addHeadersToFrame returns a new frame containing the given headers. This
+// assumes the frame still has the frame size header at the beginning.
+func (j *jsonDebugProtocolMarshaler) addHeadersToFrame(frame []byte, headers map[string]string) ([]byte, error) {
+	existing, err := j.unmarshalHeadersFromFrame(frame[5:])
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		existing[name] = value
+	}
+	end, _ := j.headersEnd(frame[5:])
+	payload := frame[5+end+1:]
+
+	serializedHeaders := j.marshalHeaders(existing)
+	buff := make([]byte, 4, 4+len(serializedHeaders)+len(payload))
+	binary.BigEndian.PutUint32(buff, uint32(len(serializedHeaders)+len(payload)))
+	buff = append(buff, serializedHeaders...)
+	return append(buff, payload...), nil
+}
+
+// unmarshalFrame deserializes the byte slice into frame components.
+func (j *jsonDebugProtocolMarshaler) unmarshalFrame(frame []byte, components *frameComponents) error {
+	headers, err := j.unmarshalHeadersFromFrame(frame)
+	if err != nil {
+		return err
+	}
+	end, _ := j.headersEnd(frame)
+	components.headers = headers
+	components.payload = frame[end+1:]
+	return nil
+}
+
+// headersEnd returns the index of the newline terminating the headers in the
+// given frame, which starts after the version.
+func (j *jsonDebugProtocolMarshaler) headersEnd(frame []byte) (int, error) {
+	end := bytes.IndexByte(frame, '\n')
+	if end < 0 {
+		return 0, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: unterminated JSON debug protocol headers"))
+	}
+	return end, nil
+}
+
+func (j *jsonDebugProtocolMarshaler) decode(buff []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	if err := json.Unmarshal(buff, &headers); err != nil {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: invalid JSON debug protocol headers: %s", err))
+	}
+	return headers, nil
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures requests round-trip through the JSON debug protocol and the frame
+// is a line of JSON headers followed by the JSON message.
+func TestJSONDebugProtocolRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFJSONDebugProtocolFactory()
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("user", "alice")
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protocolFactory.GetProtocol(buffer)
+	assert.Nil(proto.WriteRequestHeader(ctx))
+	assert.Nil(writeConformanceMessage(proto, "conform", thrift.CALL))
+
+	frame := buffer.Bytes()
+	lines := strings.SplitN(string(frame[4:]), "\n", 2)
+	assert.Len(lines, 2)
+	var headers map[string]string
+	assert.Nil(json.Unmarshal([]byte(lines[0]), &headers))
+	assert.Equal("cid", headers[cidHeader])
+	assert.Equal("alice", headers["user"])
+	var message []interface{}
+	assert.Nil(json.Unmarshal([]byte(lines[1]), &message))
+	assert.Equal([]interface{}{1.0, "conform", 1.0, 0.0}, message[:4])
+
+	proto = protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	serverCtx, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	assert.Equal("cid", serverCtx.CorrelationID())
+	user, _ := serverCtx.RequestHeader("user")
+	assert.Equal("alice", user)
+	readConformanceMessage(t, proto, thrift.CALL)
+}
+
+// Ensures frame helpers used by transports and servers understand JSON debug
+// headers.
+func TestJSONDebugProtocolFrame(t *testing.T) {
+	assert := assert.New(t)
+	payload := []byte(`[1,"ping",1,0,{}]`)
+	frame := prependFrameSize(append(jsonDebugMarshaler.marshalHeaders(
+		map[string]string{cidHeader: "cid", opIDHeader: "1"}), payload...))
+
+	headers, err := getHeadersFromFrame(frame[4:])
+	assert.Nil(err)
+	assert.Equal(map[string]string{cidHeader: "cid", opIDHeader: "1"}, headers)
+
+	frame, err = addHeadersToFrame(frame, map[string]string{"user": "bob"})
+	assert.Nil(err)
+	assert.Equal("{\"_cid\":\"cid\",\"_opid\":\"1\",\"user\":\"bob\"}\n"+string(payload), string(frame[4:]))
+
+	components, err := unmarshalFrame(frame)
+	assert.Nil(err)
+	assert.Equal(byte(protocolJSONDebug), components.protocolVersion)
+	assert.Equal("bob", components.headers["user"])
+	assert.Equal(payload, components.payload)
+
+	_, err = getHeadersFromFrame([]byte(`{"_cid":"cid"`))
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+	_, err = getHeadersFromFrame([]byte("{\"_cid\":1}\n"))
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+}
+
+// Ensures header limits are enforced on JSON debug headers.
+func TestJSONDebugProtocolHeaderLimits(t *testing.T) {
+	assert := assert.New(t)
+	buff := jsonDebugMarshaler.marshalHeaders(map[string]string{"a": "1", "b": "2"})
+	_, err := readHeaderWithLimits(bytes.NewReader(buff), HeaderLimits{MaxCount: 1})
+	assert.True(IsErrHeaderLimit(err))
+
+	headers, err := readHeaderWithLimits(bytes.NewReader(buff), HeaderLimits{MaxCount: 2})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"a": "1", "b": "2"}, headers)
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"sync/atomic"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// drainSwitch is the draining state of a server, set with SetDraining.
+type drainSwitch struct {
+	draining int32
+}
+
+func (d *drainSwitch) set(draining bool) {
+	var value int32
+	if draining {
+		value = 1
+	}
+	atomic.StoreInt32(&d.draining, value)
+}
+
+func (d *drainSwitch) on() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+// drainingProcessor is an FProcessor which rejects new requests while its
+// server is draining. Cancel frames are still processed so requests in
+// flight can be cancelled.
+type drainingProcessor struct {
+	FProcessor
+	drain *drainSwitch
+}
+
+func newDrainingProcessor(processor FProcessor, drain *drainSwitch) *drainingProcessor {
+	return &drainingProcessor{FProcessor: processor, drain: drain}
+}
+
+func (d *drainingProcessor) Process(iprot, oprot *FProtocol) error {
+	if !d.drain.on() {
+		return d.FProcessor.Process(iprot, oprot)
+	}
+	request, err := iprot.peekRequestHeaders()
+	if err != nil {
+		return err
+	}
+	replay := headerReplay(iprot)
+	if _, ok := request.header(cancelHeader); ok {
+		return d.FProcessor.Process(replay(), oprot)
+	}
+	return rejectRequest(replay(), oprot, drainingError())
+}
+
+// drainingError returns the APPLICATION_EXCEPTION_SERVER_DRAINING error to
+// reject requests with while draining.
+func drainingError() thrift.TApplicationException {
+	return thrift.NewTApplicationException(APPLICATION_EXCEPTION_SERVER_DRAINING, "server draining, retry elsewhere")
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures the servers provided by Frugal can drain.
+var (
+	_ FDrainableServer = (*FSimpleServer)(nil)
+	_ FDrainableServer = (*fNatsServer)(nil)
+	_ FDrainableServer = (*FQUICServer)(nil)
+	_ FDrainableServer = (*FJetStreamServer)(nil)
+	_ FDrainableServer = (*FNatsHeaderServer)(nil)
+	_ FDrainableServer = (*FStdioServer)(nil)
+	_ FDrainableServer = (*FTCPServer)(nil)
+)
+
+func assertDraining(t *testing.T, err error) {
+	ex, ok := err.(thrift.TApplicationException)
+	if assert.True(t, ok) {
+		assert.Equal(t, int32(APPLICATION_EXCEPTION_SERVER_DRAINING), ex.TypeId())
+	}
+}
+
+// Ensures requests are rejected with a draining error only while draining.
+func TestDrainingProcessor(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	var draining drainSwitch
+	processor := newDrainingProcessor(NewFHealthProcessor(NewFHealthServer()), &draining)
+	transport := NewFLoopbackTransport(processor, protocolFactory)
+	assert.Nil(transport.Open())
+	client := NewFHealthClient(NewFServiceProvider(transport, protocolFactory))
+
+	status, err := client.Check(NewFContext(""), "")
+	assert.Nil(err)
+	assert.Equal(HealthServing, status)
+
+	draining.set(true)
+	_, err = client.Check(NewFContext(""), "")
+	assertDraining(t, err)
+
+	draining.set(false)
+	status, err = client.Check(NewFContext(""), "")
+	assert.Nil(err)
+	assert.Equal(HealthServing, status)
+}
+
+// Ensures a draining NATS server rejects new requests.
+func TestFStatelessNatsServerDraining(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, NewFHealthProcessor(NewFHealthServer()), protoFactory, []string{"foo"}).
+		Build()
+	go func() {
+		assert.Nil(server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+
+	tr := NewFNatsTransport(conn, "foo", "")
+	assert.Nil(tr.Open())
+	defer tr.Close()
+	client := NewFHealthClient(NewFServiceProvider(tr, protoFactory))
+
+	drainable, ok := server.(FDrainableServer)
+	assert.True(ok)
+	drainable.SetDraining(true)
+	_, err = client.Check(NewFContext(""), "")
+	assertDraining(t, err)
+
+	drainable.SetDraining(false)
+	status, err := client.Check(NewFContext(""), "")
+	assert.Nil(err)
+	assert.Equal(HealthServing, status)
+}
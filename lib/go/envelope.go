@@ -0,0 +1,442 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// protocolSealed is the header protocol version of messages sealed in an
+// envelope. After the version come a flags byte, the id of the key the
+// message was sealed with, the routing headers and the length-prefixed body.
+// Signed messages carry every header in the routing headers and are
+// followed by an HMAC-SHA256 of the envelope. Encrypted messages only carry
+// the headers transports route frames by in the clear, the body holds the
+// rest of the headers and the payload sealed with AES-GCM, which
+// authenticates the whole envelope.
+const protocolSealed = 0x03
+
+// Flags of sealed messages.
+const envelopeEncrypted = 0x01
+
+// envelopeRoutingHeaders are the headers encrypted messages carry in the
+// clear so transports can route frames without opening them.
+var envelopeRoutingHeaders = []string{cidHeader, opIDHeader, cancelHeader, priorityHeader}
+
+var sealedMarshaler = &sealedProtocolMarshaler{}
+
+// FEnvelopeKeyProvider provides the keys messages are sealed with. Keys are
+// identified so they can be rotated: messages are sealed with the current key
+// and opened with the key they name.
+type FEnvelopeKeyProvider interface {
+	// SealingKey returns the id and value of the key to seal messages with.
+	SealingKey() (id string, key []byte, err error)
+
+	// OpeningKey returns the value of the key with the given id, or an error
+	// if the key is unknown.
+	OpeningKey(id string) ([]byte, error)
+}
+
+// FEnvelopeKeyRing is an FEnvelopeKeyProvider with a fixed set of keys. It
+// must not be modified once in use.
+type FEnvelopeKeyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewFEnvelopeKeyRing creates a new FEnvelopeKeyRing which seals messages
+// with the given key.
+func NewFEnvelopeKeyRing(id string, key []byte) *FEnvelopeKeyRing {
+	return &FEnvelopeKeyRing{current: id, keys: map[string][]byte{id: key}}
+}
+
+// WithKey adds a key which messages can be opened with but aren't sealed
+// with, such as a key being rotated out or in. Returns the same
+// FEnvelopeKeyRing to allow for chaining calls.
+func (k *FEnvelopeKeyRing) WithKey(id string, key []byte) *FEnvelopeKeyRing {
+	k.keys[id] = key
+	return k
+}
+
+// SealingKey returns the id and value of the key the ring was created with.
+func (k *FEnvelopeKeyRing) SealingKey() (string, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+// OpeningKey returns the value of the key with the given id.
+func (k *FEnvelopeKeyRing) OpeningKey(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("frugal: unknown envelope key %q", id)
+	}
+	return key, nil
+}
+
+// WithEnvelope seals the messages written by FProtocols produced by this
+// factory in an envelope signed with the keys of the given provider, and
+// encrypted too if encrypt is true, so they can't be tampered with, or read,
+// by the brokers and proxies they pass through. FProtocols produced by the
+// factory only read sealed messages which they can verify, so servers reject
+// any other request before the processor runs. Unsigned cancellations are
+// rejected and frames can't be modified once sealed, so this can't be used
+// with an FTransportMux. Messages are buffered until the protocol is flushed
+// and aren't compressed. Returns the same FProtocolFactory to allow for
+// chaining calls.
+func (f *FProtocolFactory) WithEnvelope(keys FEnvelopeKeyProvider, encrypt bool) *FProtocolFactory {
+	f.envelopeKeys = keys
+	f.envelopeEncrypt = encrypt
+	return f
+}
+
+// envelopeTransport wraps the TTransport of an FProtocol to seal written
+// messages and open read ones. The FProtocol hands it the headers of each
+// message so the payload can be buffered and sealed with them on Flush, or
+// verified before the TProtocol reads it.
+type envelopeTransport struct {
+	thrift.TTransport
+	keys    FEnvelopeKeyProvider
+	encrypt bool
+
+	// headers are the headers of the message being buffered, or nil if
+	// writes pass through.
+	headers map[string]string
+	buffer  bytes.Buffer
+
+	// payload is the opened payload of the message being read.
+	payload *bytes.Reader
+}
+
+// bufferMessage buffers writes until Flush, when the message is sealed with
+// the given headers.
+func (e *envelopeTransport) bufferMessage(headers map[string]string) {
+	e.headers = headers
+	e.buffer.Reset()
+}
+
+func (e *envelopeTransport) Write(p []byte) (int, error) {
+	if e.headers != nil {
+		return e.buffer.Write(p)
+	}
+	return e.TTransport.Write(p)
+}
+
+// Flush writes the buffered message sealed in an envelope, then flushes the
+// underlying transport.
+func (e *envelopeTransport) Flush() error {
+	if e.headers != nil {
+		headers := e.headers
+		e.headers = nil
+		envelope, err := e.seal(headers, e.buffer.Bytes())
+		e.buffer.Reset()
+		if err != nil {
+			return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+				fmt.Sprintf("frugal: error sealing message: %s", err))
+		}
+		if _, err := e.TTransport.Write(envelope); err != nil {
+			return thrift.NewTTransportExceptionFromError(err)
+		}
+	}
+	return e.TTransport.Flush()
+}
+
+// seal returns the given message sealed in an envelope.
+func (e *envelopeTransport) seal(headers map[string]string, payload []byte) ([]byte, error) {
+	id, key, err := e.keys.SealingKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 255 {
+		return nil, fmt.Errorf("envelope key id %q is longer than 255 bytes", id)
+	}
+
+	routing := headers
+	var flags byte
+	if e.encrypt {
+		flags |= envelopeEncrypted
+		routing = make(map[string]string)
+		rest := make(map[string]string, len(headers))
+		for name, value := range headers {
+			rest[name] = value
+		}
+		for _, name := range envelopeRoutingHeaders {
+			if value, ok := rest[name]; ok {
+				routing[name] = value
+				delete(rest, name)
+			}
+		}
+		headers = rest
+	}
+
+	// Envelope = [version (1 byte), flags (1 byte), key id size (1 byte), key id,
+	// routing headers size (4 bytes), routing headers, body size (4 bytes), body, mac]
+	envelope := []byte{protocolSealed, flags, byte(len(id))}
+	envelope = append(envelope, id...)
+	envelope = append(envelope, v0Marshaler.marshalHeaders(routing)[1:]...)
+
+	if !e.encrypt {
+		envelope = appendEnvelopeBody(envelope, payload)
+		return append(envelope, envelopeMAC(key, envelope)...), nil
+	}
+
+	aead, err := envelopeAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(payload)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	plaintext := append(v0Marshaler.marshalHeaders(headers), payload...)
+	return appendEnvelopeBody(envelope, aead.Seal(nonce, nonce, plaintext, envelope)), nil
+}
+
+func (e *envelopeTransport) Read(p []byte) (int, error) {
+	if e.payload != nil && e.payload.Len() > 0 {
+		return e.payload.Read(p)
+	}
+	return 0, io.EOF
+}
+
+func (e *envelopeTransport) RemainingBytes() uint64 {
+	if e.payload != nil {
+		return uint64(e.payload.Len())
+	}
+	return 0
+}
+
+// readHeader reads the next message from the underlying transport and
+// verifies it, enforcing the given limits on its headers. The opened payload
+// is returned by the following reads.
+func (e *envelopeTransport) readHeader(limits HeaderLimits) (map[string]string, error) {
+	e.payload = nil
+	version, err := readProtocolVersion(e.TTransport)
+	if err != nil {
+		return nil, err
+	}
+	if version != protocolSealed {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: rejected message with header protocol version %d, expected a sealed message", version))
+	}
+
+	prefix, err := readEnvelopeBytes(e.TTransport, 2)
+	if err != nil {
+		return nil, err
+	}
+	flags := prefix[0]
+	if flags&^envelopeEncrypted != 0 {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: unsupported envelope flags %d", flags))
+	}
+	id, err := readEnvelopeBytes(e.TTransport, int(prefix[1]))
+	if err != nil {
+		return nil, err
+	}
+	routing, err := v0Marshaler.readHeaderBytes(e.TTransport, limits)
+	if err != nil {
+		return nil, err
+	}
+	size, err := readEnvelopeBytes(e.TTransport, 4)
+	if err != nil {
+		return nil, err
+	}
+	if n := binary.BigEndian.Uint32(size); n > defaultMaxLength {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.SIZE_LIMIT,
+			fmt.Errorf("frugal: envelope body size %d exceeds %d bytes", n, defaultMaxLength))
+	}
+	body, err := readEnvelopeBytes(e.TTransport, int(binary.BigEndian.Uint32(size)))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := e.keys.OpeningKey(string(id))
+	if err != nil {
+		return nil, envelopeVerificationError(err)
+	}
+	// The envelope up to the body, which is what's authenticated.
+	envelope := append([]byte{protocolSealed}, prefix...)
+	envelope = append(envelope, id...)
+	envelope = append(envelope, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(envelope[len(envelope)-4:], uint32(len(routing)))
+	envelope = append(envelope, routing...)
+
+	headers, err := v0Marshaler.unmarshalHeaders(bytes.NewReader(envelope[len(envelope)-len(routing)-4:]), limits)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&envelopeEncrypted == 0 {
+		mac, err := readEnvelopeBytes(e.TTransport, sha256.Size)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(mac, envelopeMAC(key, appendEnvelopeBody(envelope, body))) {
+			return nil, envelopeVerificationError(errors.New("signature mismatch"))
+		}
+		e.payload = bytes.NewReader(body)
+		return headers, nil
+	}
+
+	aead, err := envelopeAEAD(key)
+	if err != nil {
+		return nil, envelopeVerificationError(err)
+	}
+	if len(body) < aead.NonceSize() {
+		return nil, envelopeVerificationError(errors.New("body too short"))
+	}
+	plaintext, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], envelope)
+	if err != nil {
+		return nil, envelopeVerificationError(err)
+	}
+	reader := bytes.NewReader(plaintext)
+	sealed, err := readHeaderWithLimits(reader, limits)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range sealed {
+		headers[name] = value
+	}
+	if err := limits.check(headers); err != nil {
+		return nil, err
+	}
+	payload, _ := ioutil.ReadAll(reader)
+	e.payload = bytes.NewReader(payload)
+	return headers, nil
+}
+
+// envelopeVerificationError returns the error for a message which couldn't be
+// verified.
+func envelopeVerificationError(err error) error {
+	return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+		fmt.Errorf("frugal: envelope verification failed: %s", err))
+}
+
+// readEnvelopeBytes reads the next n bytes of an envelope from the given
+// transport. Sizes beyond the remaining bytes of the transport are rejected
+// before allocating.
+func readEnvelopeBytes(reader thrift.TTransport, n int) ([]byte, error) {
+	if uint64(n) > reader.RemainingBytes() {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: envelope size %d exceeds the available data", n))
+	}
+	buff := make([]byte, n)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
+			return nil, err
+		}
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: error reading envelope: %s", err))
+	}
+	return buff, nil
+}
+
+// appendEnvelopeBody appends the given body, prefixed by its size, to the
+// envelope.
+func appendEnvelopeBody(envelope, body []byte) []byte {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(body)))
+	return append(append(envelope, size...), body...)
+}
+
+// deriveEnvelopeKey derives a key for the given use from an envelope key, so
+// the same key isn't used for signing and encryption.
+func deriveEnvelopeKey(key []byte, use string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("frugal envelope " + use))
+	return mac.Sum(nil)
+}
+
+// envelopeMAC returns the HMAC-SHA256 of the given envelope.
+func envelopeMAC(key, envelope []byte) []byte {
+	mac := hmac.New(sha256.New, deriveEnvelopeKey(key, "signing"))
+	mac.Write(envelope)
+	return mac.Sum(nil)
+}
+
+// envelopeAEAD returns the AES-256-GCM cipher for the given envelope key.
+func envelopeAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveEnvelopeKey(key, "encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealedProtocolMarshaler implements the protocolMarshaler interface for
+// sealed messages so frame helpers can read their routing headers. These
+// aren't verified, which only FProtocols with an envelope can do.
+type sealedProtocolMarshaler struct{}
+
+// marshalHeaders isn't supported since sealing requires a key. Sealed
+// messages are written by envelopeTransport.
+func (s *sealedProtocolMarshaler) marshalHeaders(headers map[string]string) []byte {
+	return nil
+}
+
+// unmarshalHeaders returns an error since sealed messages can only be read by
+// FProtocols with an envelope, which verify them.
+func (s *sealedProtocolMarshaler) unmarshalHeaders(reader io.Reader, limits HeaderLimits) (map[string]string, error) {
+	return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+		errors.New("frugal: sealed messages require an FProtocolFactory with an envelope"))
+}
+
+// routingHeadersOffset returns the offset of the routing headers in the given
+// frame, which starts after the version.
+func (s *sealedProtocolMarshaler) routingHeadersOffset(frame []byte) (int, error) {
+	if len(frame) < 2 || len(frame) < 2+int(frame[1]) {
+		return 0, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: invalid sealed frame size %d", len(frame)))
+	}
+	return 2 + int(frame[1]), nil
+}
+
+// unmarshalHeadersFromFrame reads the routing headers from the byte slice
+// into a map.
+func (s *sealedProtocolMarshaler) unmarshalHeadersFromFrame(frame []byte) (map[string]string, error) {
+	offset, err := s.routingHeadersOffset(frame)
+	if err != nil {
+		return nil, err
+	}
+	return v0Marshaler.unmarshalHeadersFromFrame(frame[offset:])
+}
+
+// addHeadersToFrame returns an error since sealed frames can't be modified.
+func (s *sealedProtocolMarshaler) addHeadersToFrame(frame []byte, headers map[string]string) ([]byte, error) {
+	return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+		errors.New("frugal: sealed frames can't be modified"))
+}
+
+// unmarshalFrame deserializes the byte slice into frame components. The
+// headers are the routing headers and the payload is the sealed body.
+func (s *sealedProtocolMarshaler) unmarshalFrame(frame []byte, components *frameComponents) error {
+	headers, err := s.unmarshalHeadersFromFrame(frame)
+	if err != nil {
+		return err
+	}
+	offset, _ := s.routingHeadersOffset(frame)
+	components.headers = headers
+	components.payload = frame[offset+4+int(binary.BigEndian.Uint32(frame[offset:])):]
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+var envelopeKeys = NewFEnvelopeKeyRing("k1", []byte("secret"))
+
+func newEnvelopeFrame(t *testing.T, protocolFactory *FProtocolFactory) []byte {
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("user", "alice")
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protocolFactory.GetProtocol(buffer)
+	assert.Nil(t, proto.WriteRequestHeader(ctx))
+	assert.Nil(t, writeConformanceMessage(proto, "conform", thrift.CALL))
+	return buffer.Bytes()
+}
+
+func readEnvelopeFrame(protocolFactory *FProtocolFactory, frame []byte) (*FProtocol, FContext, error) {
+	proto := protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	ctx, err := proto.ReadRequestHeader()
+	return proto, ctx, err
+}
+
+// Ensures signed and encrypted messages round-trip, with encrypted messages
+// only carrying routing headers in the clear.
+func TestEnvelopeRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	for _, encrypt := range []bool{false, true} {
+		protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+			WithEnvelope(envelopeKeys, encrypt)
+		frame := newEnvelopeFrame(t, protocolFactory)
+		assert.Equal(byte(protocolSealed), frame[4])
+		assert.Equal(!encrypt, bytes.Contains(frame, []byte("alice")))
+		assert.Equal(!encrypt, bytes.Contains(frame, []byte("conform")))
+
+		headers, err := getHeadersFromFrame(frame[4:])
+		assert.Nil(err)
+		assert.Equal("cid", headers[cidHeader])
+		opID, ok, err := frameHeader(frame[4:], opIDHeader)
+		assert.Nil(err)
+		assert.True(ok)
+		assert.NotEmpty(opID)
+
+		proto, ctx, err := readEnvelopeFrame(protocolFactory, frame)
+		assert.Nil(err)
+		assert.Equal("cid", ctx.CorrelationID())
+		user, _ := ctx.RequestHeader("user")
+		assert.Equal("alice", user)
+		readConformanceMessage(t, proto, thrift.CALL)
+	}
+}
+
+// Ensures messages which have been tampered with, are sealed with an
+// unknown key or aren't sealed are rejected.
+func TestEnvelopeVerification(t *testing.T) {
+	assert := assert.New(t)
+	for _, encrypt := range []bool{false, true} {
+		protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+			WithEnvelope(envelopeKeys, encrypt)
+		frame := newEnvelopeFrame(t, protocolFactory)
+		for _, i := range []int{7, 20, len(frame) - 40, len(frame) - 1} {
+			tampered := append([]byte(nil), frame...)
+			tampered[i] ^= 0x01
+			_, _, err := readEnvelopeFrame(protocolFactory, tampered)
+			assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+		}
+
+		otherKeys := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+			WithEnvelope(NewFEnvelopeKeyRing("k1", []byte("other")), encrypt)
+		_, _, err := readEnvelopeFrame(otherKeys, frame)
+		assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+
+		unknownKey := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+			WithEnvelope(NewFEnvelopeKeyRing("k2", []byte("secret")), encrypt)
+		_, _, err = readEnvelopeFrame(unknownKey, frame)
+		assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+
+		_, _, err = readEnvelopeFrame(NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()), frame)
+		assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+	}
+
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithEnvelope(envelopeKeys, false)
+	_, _, err := readEnvelopeFrame(protocolFactory,
+		newEnvelopeFrame(t, NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())))
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+	_, _, err = readEnvelopeFrame(protocolFactory, newCancelFrame(NewFContext("cid")))
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+}
+
+// Ensures messages sealed with a key being rotated out can still be opened.
+func TestEnvelopeKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+	frame := newEnvelopeFrame(t, NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		WithEnvelope(envelopeKeys, true))
+	keys := NewFEnvelopeKeyRing("k2", []byte("new")).WithKey("k1", []byte("secret"))
+	proto, ctx, err := readEnvelopeFrame(NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		WithEnvelope(keys, true), frame)
+	assert.Nil(err)
+	assert.Equal("cid", ctx.CorrelationID())
+	readConformanceMessage(t, proto, thrift.CALL)
+
+	_, err = keys.OpeningKey("k3")
+	assert.NotNil(err)
+}
+
+// Ensures sealed frames can't be modified in transit.
+func TestEnvelopeFrameImmutable(t *testing.T) {
+	frame := newEnvelopeFrame(t, NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		WithEnvelope(envelopeKeys, false))
+	_, err := addHeadersToFrame(frame, map[string]string{"user": "mallory"})
+	assert.Equal(t, thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+}
+
+// Ensures sealed requests are verified before being routed by an
+// FServiceMux and responses are sealed.
+func TestEnvelopeServiceMux(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithEnvelope(envelopeKeys, true)
+	fallback := &serviceProcessor{name: "default"}
+	transport := NewFLoopbackTransport(NewFServiceMux(protocolFactory).WithDefault(fallback), protocolFactory)
+	assert.Nil(transport.Open())
+
+	result, err := transport.Request(NewFContext("cid"), newEnvelopeFrame(t, protocolFactory))
+	assert.Nil(err)
+	proto := protocolFactory.GetProtocol(result)
+	assert.Nil(proto.ReadResponseHeader(NewFContext("")))
+	name, err := proto.ReadString()
+	assert.Nil(err)
+	assert.Equal("default", name)
+	assert.Equal("alice", fallback.headers["user"])
+}
@@ -34,6 +34,16 @@ const (
 	// TRANSPORT_EXCEPTION_RESPONSE_TOO_LARGE is a TTransportException
 	// error type indicating the response exceeded the size limit.
 	TRANSPORT_EXCEPTION_RESPONSE_TOO_LARGE = 101
+
+	// TRANSPORT_EXCEPTION_CANCELLED is a TTransportException error type
+	// indicating the request was abandoned because its FContext was
+	// cancelled.
+	TRANSPORT_EXCEPTION_CANCELLED = 102
+
+	// TRANSPORT_EXCEPTION_CIRCUIT_OPEN is a TTransportException error type
+	// indicating the request was not sent because the circuit breaker for
+	// its method is open.
+	TRANSPORT_EXCEPTION_CIRCUIT_OPEN = 103
 )
 
 // TApplicationException types used in frugal instantiated
@@ -55,6 +65,37 @@ const (
 	// APPLICATION_EXCEPTION_RESPONSE_TOO_LARGE is a TApplicationException
 	// error type indicating the response exceeded the size limit.
 	APPLICATION_EXCEPTION_RESPONSE_TOO_LARGE = 100
+
+	// APPLICATION_EXCEPTION_SERVER_OVERLOADED is a TApplicationException
+	// error type indicating the server rejected the request because it was
+	// over its configured rate limit or its work queue was full.
+	APPLICATION_EXCEPTION_SERVER_OVERLOADED = 101
+
+	// APPLICATION_EXCEPTION_REQUEST_TOO_LARGE is a TApplicationException
+	// error type indicating the request exceeded the server's size limit.
+	APPLICATION_EXCEPTION_REQUEST_TOO_LARGE = 102
+
+	// APPLICATION_EXCEPTION_RATE_LIMITED is a TApplicationException error
+	// type indicating the server rejected the request because the method was
+	// over its configured rate or concurrency limit. The response carries a
+	// hint of when to retry, returned by RetryAfter.
+	APPLICATION_EXCEPTION_RATE_LIMITED = 103
+
+	// APPLICATION_EXCEPTION_PROCESSING_TIMEOUT is a TApplicationException
+	// error type indicating the server abandoned the request because its
+	// handler exceeded the server's maximum processing time.
+	APPLICATION_EXCEPTION_PROCESSING_TIMEOUT = 104
+
+	// APPLICATION_EXCEPTION_SERVER_DRAINING is a TApplicationException error
+	// type indicating the server rejected the request without processing it
+	// because it's draining before shutdown. The request can safely be
+	// retried against another server.
+	APPLICATION_EXCEPTION_SERVER_DRAINING = 105
+
+	// APPLICATION_EXCEPTION_STREAMING_UNSUPPORTED is a TApplicationException
+	// error type indicating the method streams its response, but the server
+	// it was called on doesn't support streamed responses.
+	APPLICATION_EXCEPTION_STREAMING_UNSUPPORTED = 106
 )
 
 // IsErrTooLarge indicates if the given error is a TTransportException
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"io"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// frameTransport is a read-only TTransport over a delivered frame. Unlike a
+// TMemoryBuffer it can hand out the unread bytes without copying them, so
+// headers and payloads can be read directly from the frame. The frame is only
+// borrowed: once the transport is released, it no longer reads from it.
+type frameTransport struct {
+	frame []byte
+	pos   int
+}
+
+// newFrameTransport returns a frameTransport reading the given frame, which
+// must not include the frame size.
+func newFrameTransport(frame []byte) *frameTransport {
+	return &frameTransport{frame: frame}
+}
+
+// next returns the next n unread bytes of the frame without copying them.
+func (f *frameTransport) next(n int) ([]byte, error) {
+	if f.frame == nil {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN, "frugal: frame released")
+	}
+	if n < 0 || n > len(f.frame)-f.pos {
+		f.pos = len(f.frame)
+		return nil, thrift.NewTTransportExceptionFromError(io.ErrUnexpectedEOF)
+	}
+	b := f.frame[f.pos : f.pos+n]
+	f.pos += n
+	return b, nil
+}
+
+// unread returns the unread bytes of the frame without copying them, or nil
+// if the transport has been released.
+func (f *frameTransport) unread() []byte {
+	if f.frame == nil {
+		return nil
+	}
+	return f.frame[f.pos:]
+}
+
+// release stops the transport from reading the frame once its lifetime has
+// ended, so protocols retained beyond it fail rather than read stale data.
+// Slices previously returned by next or unread are not affected.
+func (f *frameTransport) release() {
+	f.frame = nil
+	f.pos = 0
+}
+
+func (f *frameTransport) Read(p []byte) (int, error) {
+	if f.frame == nil {
+		return 0, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN, "frugal: frame released")
+	}
+	if f.pos == len(f.frame) {
+		return 0, thrift.NewTTransportExceptionFromError(io.EOF)
+	}
+	n := copy(p, f.frame[f.pos:])
+	f.pos += n
+	return n, nil
+}
+
+func (f *frameTransport) ReadByte() (byte, error) {
+	b, err := f.next(1)
+	if err != nil {
+		if f.frame != nil {
+			err = thrift.NewTTransportExceptionFromError(io.EOF)
+		}
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (f *frameTransport) Write(p []byte) (int, error) {
+	return 0, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN, "frugal: frame transport is read-only")
+}
+
+func (f *frameTransport) WriteByte(c byte) error {
+	_, err := f.Write([]byte{c})
+	return err
+}
+
+func (f *frameTransport) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *frameTransport) RemainingBytes() uint64 {
+	return uint64(len(f.frame) - f.pos)
+}
+
+func (f *frameTransport) Open() error {
+	return thrift.NewTTransportException(thrift.ALREADY_OPEN, "frugal: frame transport already open")
+}
+
+func (f *frameTransport) IsOpen() bool {
+	return f.frame != nil
+}
+
+func (f *frameTransport) Flush() error {
+	return nil
+}
+
+func (f *frameTransport) Close() error {
+	f.release()
+	return nil
+}
+
+// readBytes reads n bytes from the given Reader. Frames are read without
+// copying.
+func readBytes(reader io.Reader, n int) ([]byte, error) {
+	if f, ok := reader.(*frameTransport); ok {
+		return f.next(n)
+	}
+	buff := make([]byte, n)
+	_, err := io.ReadFull(reader, buff)
+	return buff, err
+}
+
+// Payload returns the unread bytes of the frame being read without copying
+// them, or nil if the protocol doesn't read from a delivered frame, such as on
+// servers which don't enable zero-copy reads. Called after the request header
+// has been read, it returns the serialized message, which lets processors
+// forward or inspect it without decoding it. The slice aliases the frame, so
+// it must not be modified, and it is only valid until the processor returns.
+func (f *FProtocol) Payload() []byte {
+	transport := f.Transport()
+	if f.compression != nil {
+		if f.compression.payload != nil {
+			return nil
+		}
+		transport = f.compression.TTransport
+	}
+	if frame, ok := transport.(*frameTransport); ok {
+		return frame.unread()
+	}
+	return nil
+}
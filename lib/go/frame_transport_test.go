@@ -0,0 +1,88 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures frameTransport reads frames and hands out unread bytes without
+// copying them.
+func TestFrameTransportRead(t *testing.T) {
+	assert := assert.New(t)
+	frame := []byte{1, 2, 3, 4, 5}
+	transport := newFrameTransport(frame)
+	assert.True(transport.IsOpen())
+
+	b, err := transport.ReadByte()
+	assert.Nil(err)
+	assert.Equal(byte(1), b)
+	next, err := transport.next(2)
+	assert.Nil(err)
+	assert.Equal([]byte{2, 3}, next)
+	assert.True(&frame[1] == &next[0])
+	assert.Equal(uint64(2), transport.RemainingBytes())
+	assert.Equal([]byte{4, 5}, transport.unread())
+
+	buff := make([]byte, 4)
+	n, err := transport.Read(buff)
+	assert.Nil(err)
+	assert.Equal(2, n)
+	_, err = transport.Read(buff)
+	assert.Equal(TRANSPORT_EXCEPTION_END_OF_FILE, err.(thrift.TTransportException).TypeId())
+	_, err = transport.next(1)
+	assert.NotNil(err)
+	_, err = transport.Write(buff)
+	assert.NotNil(err)
+}
+
+// Ensures frameTransport stops reading the frame once released.
+func TestFrameTransportRelease(t *testing.T) {
+	assert := assert.New(t)
+	transport := newFrameTransport([]byte{1, 2})
+	transport.release()
+	assert.False(transport.IsOpen())
+	assert.Nil(transport.unread())
+	_, err := transport.Read(make([]byte, 1))
+	assert.Equal(TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+	_, err = transport.ReadByte()
+	assert.Equal(TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+}
+
+// Ensures FProtocols read headers from a frame and expose the payload.
+func TestFProtocolPayload(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	ctx := NewFContext("cid")
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protocolFactory.GetProtocol(buffer)
+	assert.Nil(proto.WriteRequestHeader(ctx))
+	assert.Nil(writeConformanceMessage(proto, "conform", thrift.CALL))
+	assert.Nil(proto.Payload())
+
+	frame := buffer.Bytes()
+	headersEnd := 9 + binary.BigEndian.Uint32(frame[5:])
+	proto = protocolFactory.GetProtocol(newFrameTransport(frame[4:]))
+	serverCtx, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	assert.Equal("cid", serverCtx.CorrelationID())
+	payload := proto.Payload()
+	assert.Equal(frame[headersEnd:], payload)
+	assert.True(&frame[headersEnd] == &payload[0])
+	readConformanceMessage(t, proto, thrift.CALL)
+}
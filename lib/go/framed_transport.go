@@ -118,6 +118,20 @@ func (p *TFramedTransport) Read(buf []byte) (l int, err error) {
 	return got, thrift.NewTTransportExceptionFromError(err)
 }
 
+// waitForFrame blocks until the next frame starts to arrive, unless part of
+// the current frame has yet to be read.
+func (p *TFramedTransport) waitForFrame() error {
+	if p.frameSize > 0 {
+		return nil
+	}
+	size, err := p.readFrameHeader()
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	p.frameSize = size
+	return nil
+}
+
 // Write to the transport.
 func (p *TFramedTransport) Write(buf []byte) (int, error) {
 	n, err := p.buf.Write(buf)
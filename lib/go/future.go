@@ -0,0 +1,150 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// FFuture is the eventual result of a request made with RequestAsync. It
+// completes when the response is received, the request times out, or the
+// request's context is cancelled.
+type FFuture struct {
+	mu        sync.Mutex
+	done      chan struct{}
+	completed bool
+	response  thrift.TTransport
+	err       error
+	cleanups  []func(succeeded bool)
+}
+
+// RequestAsync transmits the given data with the given FTransport and returns
+// an FFuture for the response, so many requests can be in flight without a
+// goroutine waiting on each. On transports which deliver responses as they
+// arrive, such as NATS and loopback transports, no goroutine waits on the
+// request; timeouts and cancellation are handled as they happen. Other
+// transports are called with Request from a goroutine. Idempotent requests
+// made this way are not replayed across NATS reconnects. Generated clients
+// use this for the Async variants of their methods when they have no
+// middleware, but it can also be called with a payload written by hand.
+func RequestAsync(transport FTransport, ctx FContext, payload []byte) *FFuture {
+	future := &FFuture{done: make(chan struct{})}
+	if len(payload) == 4 {
+		// There's nothing to wait for.
+		future.complete(transport.Request(ctx, payload))
+		return future
+	}
+	bidi, ok := transport.(bidiTransport)
+	if !ok {
+		go func() {
+			future.complete(transport.Request(ctx, payload))
+		}()
+		return future
+	}
+
+	queue := newStreamQueue()
+	queue.control = func(frame []byte) bool {
+		future.complete(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame)}, nil)
+		return true
+	}
+	conn, err := bidi.openStream(ctx, payload, queue)
+	if err != nil {
+		future.complete(nil, err)
+		return future
+	}
+	timer := time.AfterFunc(ctx.Timeout(), func() {
+		future.complete(nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT,
+			"frugal: request timed out"))
+	})
+	stop := contextAfterCancel(ctx, func() {
+		future.complete(nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_CANCELLED,
+			"frugal: request cancelled"))
+	})
+	future.onComplete(func(succeeded bool) {
+		timer.Stop()
+		stop()
+		conn.close(succeeded)
+	})
+	return future
+}
+
+// Done returns a channel which is closed when the future completes.
+func (f *FFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the error the request failed with, or nil if it succeeded or
+// hasn't completed.
+func (f *FFuture) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Result waits for the future to complete and returns the response to read
+// the result from, or the error the request failed with.
+func (f *FFuture) Result() (thrift.TTransport, error) {
+	<-f.done
+	return f.response, f.err
+}
+
+// OnResult calls the given function with the response, or the error the
+// request failed with, once the future completes. If it has already
+// completed, the function is called immediately. Otherwise it's called from
+// the goroutine completing the future, such as the one delivering the
+// response, so it shouldn't block.
+func (f *FFuture) OnResult(callback func(response thrift.TTransport, err error)) {
+	f.onComplete(func(bool) {
+		callback(f.response, f.err)
+	})
+}
+
+// complete completes the future with the given result, unless it has
+// already completed.
+func (f *FFuture) complete(response thrift.TTransport, err error) {
+	f.mu.Lock()
+	if f.completed {
+		f.mu.Unlock()
+		return
+	}
+	f.completed = true
+	f.response, f.err = response, err
+	cleanups := f.cleanups
+	f.cleanups = nil
+	close(f.done)
+	f.mu.Unlock()
+
+	for _, cleanup := range cleanups {
+		cleanup(err == nil)
+	}
+}
+
+// onComplete calls the given function once the future completes, given
+// whether the request succeeded. If the future has already completed, it's
+// called immediately.
+func (f *FFuture) onComplete(cleanup func(succeeded bool)) {
+	f.mu.Lock()
+	if !f.completed {
+		f.cleanups = append(f.cleanups, cleanup)
+		f.mu.Unlock()
+		return
+	}
+	succeeded := f.err == nil
+	f.mu.Unlock()
+	cleanup(succeeded)
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// requestEcho writes a request for the echo processor with the given
+// payload.
+func requestEcho(protoFactory *FProtocolFactory, ctx FContext, payload string) []byte {
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protoFactory.GetProtocol(buffer)
+	proto.WriteRequestHeader(ctx)
+	proto.WriteBinary([]byte(payload))
+	return buffer.Bytes()
+}
+
+// assertEchoFutures asserts concurrent asynchronous requests made with the
+// given transport each receive their own response.
+func assertEchoFutures(t *testing.T, protoFactory *FProtocolFactory, transport FTransport) {
+	assert := assert.New(t)
+	contexts := make([]FContext, 10)
+	futures := make([]*FFuture, len(contexts))
+	for i := range futures {
+		contexts[i] = NewFContext("")
+		futures[i] = RequestAsync(transport, contexts[i], requestEcho(protoFactory, contexts[i], fmt.Sprint(i)))
+	}
+	for i, future := range futures {
+		<-future.Done()
+		assert.Nil(future.Err())
+		response, err := future.Result()
+		if !assert.Nil(err) {
+			continue
+		}
+		proto := protoFactory.GetProtocol(response)
+		assert.Nil(proto.ReadResponseHeader(contexts[i]))
+		result, err := proto.ReadBinary()
+		assert.Nil(err)
+		assert.Equal(fmt.Sprint(i), string(result))
+	}
+}
+
+// syncTransport hides the asynchronous support of the transport it wraps.
+type syncTransport struct {
+	FTransport
+}
+
+// Ensures asynchronous requests receive their responses over transports
+// which deliver responses as they arrive and those which don't.
+func TestRequestAsyncLoopback(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFLoopbackTransport(&echoProcessor{}, protoFactory)
+	assert.Nil(t, transport.Open())
+	defer transport.Close()
+	assertEchoFutures(t, protoFactory, transport)
+	assertEchoFutures(t, protoFactory, syncTransport{transport})
+}
+
+// Ensures asynchronous requests over NATS receive their responses, and time
+// out or are cancelled without a response.
+func TestRequestAsyncNats(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := serveNats(t, NewFNatsServerBuilder(conn, &echoProcessor{}, protoFactory, []string{"echo"}))
+	defer server.Stop()
+
+	transport := NewFNatsTransport(conn, "echo", "")
+	assert.Nil(transport.Open())
+	defer transport.Close()
+	assertEchoFutures(t, protoFactory, transport)
+
+	// Nothing responds to requests on other subjects.
+	transport = NewFNatsTransport(conn, "nobody", "")
+	assert.Nil(transport.Open())
+	defer transport.Close()
+	ctx := NewFContext("").SetTimeout(10 * time.Millisecond)
+	_, err = RequestAsync(transport, ctx, requestEcho(protoFactory, ctx, "foo")).Result()
+	assert.Equal(TRANSPORT_EXCEPTION_TIMED_OUT, err.(thrift.TTransportException).TypeId())
+
+	ctx = NewFContext("")
+	future := RequestAsync(transport, ctx, requestEcho(protoFactory, ctx, "foo"))
+	ctx.(*FContextImpl).Cancel()
+	_, err = future.Result()
+	assert.Equal(TRANSPORT_EXCEPTION_CANCELLED, err.(thrift.TTransportException).TypeId())
+	assert.Empty(transport.(*fNatsTransport).registry.(*fRegistryImpl).streams)
+}
+
+// Ensures OnResult calls back with the result of the request, whether the
+// future has completed yet or not.
+func TestFFutureOnResult(t *testing.T) {
+	assert := assert.New(t)
+	future := &FFuture{done: make(chan struct{})}
+	results := make(chan error, 2)
+	future.OnResult(func(response thrift.TTransport, err error) {
+		results <- err
+	})
+	assert.Empty(results)
+
+	ex := thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "timed out")
+	future.complete(nil, ex)
+	assert.Equal(ex, <-results)
+	future.OnResult(func(response thrift.TTransport, err error) {
+		results <- err
+	})
+	assert.Equal(ex, <-results)
+}
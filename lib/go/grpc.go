@@ -0,0 +1,448 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// GRPCStreamPath is the path of the bidirectional streaming gRPC method
+	// Frugal frames are tunneled over, to be routed to an
+	// FGRPCServerTransport.
+	GRPCStreamPath = "/frugal.Frugal/Stream"
+
+	// grpcContentType identifies gRPC messages carrying raw Frugal bytes
+	// rather than protobuf.
+	grpcContentType   = "application/grpc+frugal"
+	grpcContentPrefix = "application/grpc"
+	grpcStatusHeader  = "Grpc-Status"
+	grpcMessageHeader = "Grpc-Message"
+	grpcStatusOK      = "0"
+
+	// grpcStatusUnavailable is the gRPC status sent when the server
+	// transport is closed.
+	grpcStatusUnavailable = "14"
+)
+
+// grpcMessageReader reads the payloads of length-prefixed gRPC messages as a
+// byte stream.
+type grpcMessageReader struct {
+	reader  io.Reader
+	message io.Reader
+}
+
+func (g *grpcMessageReader) Read(buf []byte) (int, error) {
+	for {
+		if g.message == nil {
+			var prefix [5]byte
+			if _, err := io.ReadFull(g.reader, prefix[:]); err != nil {
+				return 0, err
+			}
+			if prefix[0] != 0 {
+				return 0, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+					"frugal: compressed gRPC messages are not supported")
+			}
+			g.message = io.LimitReader(g.reader, int64(binary.BigEndian.Uint32(prefix[1:])))
+		}
+		n, err := g.message.Read(buf)
+		if err == io.EOF {
+			g.message = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// writeGRPCMessage writes the given payload as an uncompressed gRPC message.
+func writeGRPCMessage(w io.Writer, payload []byte) error {
+	message := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(message[1:], uint32(len(payload)))
+	_, err := w.Write(append(message, payload...))
+	return err
+}
+
+// tGRPCTransport is a thrift.TTransport sending and receiving a byte stream
+// over a bidirectional gRPC stream. Each Flush sends the bytes written since
+// the last Flush as a message.
+type tGRPCTransport struct {
+	client *http.Client
+	url    string
+
+	mu       sync.RWMutex
+	cancel   context.CancelFunc
+	requests *io.PipeWriter
+	response *http.Response
+	reader   *grpcMessageReader
+
+	writeMu  sync.Mutex
+	writeBuf bytes.Buffer
+}
+
+// NewTGRPCTransport returns a thrift.TTransport which opens a bidirectional
+// gRPC stream to the GRPCStreamPath method of the server at the given url,
+// such as "https://example.com", when opened. Frugal frames are carried as
+// raw bytes with the "application/grpc+frugal" content type, so they pass
+// through gRPC load balancers and service meshes. The client must use
+// HTTP/2, such as one returned by NewFHTTP2Client, which is used if the
+// client is nil. Wrap the transport with NewAdapterTransport for use with
+// Frugal clients:
+//
+//	transport := frugal.NewAdapterTransport(
+//		frugal.NewTGRPCTransport(frugal.NewFHTTP2Client(tlsConfig), "https://example.com"))
+//
+// Requests are sent over the stream as they are made, and responses are
+// delivered as they arrive, in any order.
+func NewTGRPCTransport(client *http.Client, url string) thrift.TTransport {
+	if client == nil {
+		client = NewFHTTP2Client(nil)
+	}
+	return &tGRPCTransport{client: client, url: strings.TrimSuffix(url, "/") + GRPCStreamPath}
+}
+
+// Open opens the gRPC stream.
+func (g *tGRPCTransport) Open() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.response != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: gRPC transport already open")
+	}
+
+	requests, requestWriter := io.Pipe()
+	request, err := http.NewRequest(http.MethodPost, g.url, requests)
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	request.Header.Set(contentTypeHeader, grpcContentType)
+	request.Header.Set("TE", "trailers")
+	ctx, cancel := context.WithCancel(context.Background())
+	response, err := g.client.Do(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		requestWriter.Close()
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	if err := checkGRPCResponse(response); err != nil {
+		cancel()
+		requestWriter.Close()
+		response.Body.Close()
+		return err
+	}
+
+	g.cancel = cancel
+	g.requests = requestWriter
+	g.response = response
+	g.reader = &grpcMessageReader{reader: response.Body}
+	return nil
+}
+
+// checkGRPCResponse returns an error if the given response doesn't open a
+// gRPC stream.
+func checkGRPCResponse(response *http.Response) error {
+	if response.StatusCode != http.StatusOK {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: gRPC stream failed with status %d", response.StatusCode))
+	}
+	if !strings.HasPrefix(response.Header.Get(contentTypeHeader), grpcContentPrefix) {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: gRPC stream has unexpected content type %q",
+				response.Header.Get(contentTypeHeader)))
+	}
+	// A status in the headers is a trailers-only response ending the stream.
+	return grpcStatusError(response.Header)
+}
+
+// grpcStatusError returns an error for a failed gRPC status in the given
+// headers or trailers.
+func grpcStatusError(header http.Header) error {
+	status := header.Get(grpcStatusHeader)
+	if status == "" || status == grpcStatusOK {
+		return nil
+	}
+	return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+		fmt.Sprintf("frugal: gRPC stream failed with status %s: %s", status, header.Get(grpcMessageHeader)))
+}
+
+// IsOpen returns true if the stream is open.
+func (g *tGRPCTransport) IsOpen() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.response != nil
+}
+
+// Close ends the stream.
+func (g *tGRPCTransport) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.response == nil {
+		return nil
+	}
+	g.requests.Close()
+	g.cancel()
+	err := g.response.Body.Close()
+	g.response = nil
+	return thrift.NewTTransportExceptionFromError(err)
+}
+
+// Read reads the payloads of received messages. It returns an END_OF_FILE
+// TTransportException once the server ends the stream successfully.
+func (g *tGRPCTransport) Read(buf []byte) (int, error) {
+	g.mu.RLock()
+	response, reader := g.response, g.reader
+	g.mu.RUnlock()
+	if response == nil {
+		return 0, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: gRPC transport not open")
+	}
+	n, err := reader.Read(buf)
+	if err == io.EOF {
+		if statusErr := grpcStatusError(response.Trailer); statusErr != nil {
+			return n, statusErr
+		}
+	}
+	return n, thrift.NewTTransportExceptionFromError(err)
+}
+
+// Write buffers the given bytes until Flush is called.
+func (g *tGRPCTransport) Write(buf []byte) (int, error) {
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+	return g.writeBuf.Write(buf)
+}
+
+// Flush sends the buffered bytes as a message.
+func (g *tGRPCTransport) Flush() error {
+	g.mu.RLock()
+	requests := g.requests
+	open := g.response != nil
+	g.mu.RUnlock()
+	if !open {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: gRPC transport not open")
+	}
+
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+	if g.writeBuf.Len() == 0 {
+		return nil
+	}
+	err := writeGRPCMessage(requests, g.writeBuf.Bytes())
+	g.writeBuf.Reset()
+	return thrift.NewTTransportExceptionFromError(err)
+}
+
+// RemainingBytes returns the maximum uint64, as the amount of data to be read
+// is unknown.
+func (g *tGRPCTransport) RemainingBytes() uint64 {
+	return ^uint64(0)
+}
+
+// FGRPCServerTransport is a thrift.TServerTransport accepting bidirectional
+// gRPC streams opened by transports returned by NewTGRPCTransport. It is also
+// an http.Handler, which should be routed requests for GRPCStreamPath on an
+// HTTP/2 server, such as one configured with ConfigureHTTP2Server or serving
+// TLS. Use it with an FServer such as FSimpleServer:
+//
+//	transport := frugal.NewFGRPCServerTransport()
+//	mux.Handle(frugal.GRPCStreamPath, transport)
+//	server := frugal.NewFSimpleServer(processor, transport, protocolFactory)
+//	go server.Serve()
+type FGRPCServerTransport struct {
+	streams   chan thrift.TTransport
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFGRPCServerTransport creates a new FGRPCServerTransport.
+func NewFGRPCServerTransport() *FGRPCServerTransport {
+	return &FGRPCServerTransport{
+		streams: make(chan thrift.TTransport),
+		quit:    make(chan struct{}),
+	}
+}
+
+// ServeHTTP serves a gRPC stream until the client ends it or it is closed by
+// the FServer.
+func (s *FGRPCServerTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get(contentTypeHeader), grpcContentPrefix) {
+		http.Error(w, "Expected a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, grpcContentType)
+	select {
+	case <-s.quit:
+		w.Header().Set(grpcStatusHeader, grpcStatusUnavailable)
+		w.Header().Set(grpcMessageHeader, "server closed")
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	stream := newGRPCServerStream(r.Body, w, flusher)
+	select {
+	case s.streams <- stream:
+	case <-s.quit:
+		stream.Close()
+		w.Header().Set(http.TrailerPrefix+grpcStatusHeader, grpcStatusUnavailable)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	select {
+	case <-stream.done:
+	case <-r.Context().Done():
+		stream.Close()
+	}
+	w.Header().Set(http.TrailerPrefix+grpcStatusHeader, grpcStatusOK)
+}
+
+// Listen is a no-op, streams are received by ServeHTTP.
+func (s *FGRPCServerTransport) Listen() error {
+	return nil
+}
+
+// Accept returns the next gRPC stream.
+func (s *FGRPCServerTransport) Accept() (thrift.TTransport, error) {
+	select {
+	case stream := <-s.streams:
+		return stream, nil
+	case <-s.quit:
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: gRPC server transport closed")
+	}
+}
+
+// Close stops accepting streams.
+func (s *FGRPCServerTransport) Close() error {
+	s.closeOnce.Do(func() { close(s.quit) })
+	return nil
+}
+
+// Interrupt stops accepting streams.
+func (s *FGRPCServerTransport) Interrupt() error {
+	return s.Close()
+}
+
+// grpcServerStream is the server side of a gRPC stream as a thrift.TTransport.
+// The stream ends once the client stops sending or the transport is closed.
+type grpcServerStream struct {
+	reader  *grpcMessageReader
+	writer  io.Writer
+	flusher http.Flusher
+	done    chan struct{}
+
+	writeMu  sync.Mutex
+	writeBuf bytes.Buffer
+	closed   bool
+}
+
+func newGRPCServerStream(body io.Reader, w io.Writer, flusher http.Flusher) *grpcServerStream {
+	return &grpcServerStream{
+		reader:  &grpcMessageReader{reader: body},
+		writer:  w,
+		flusher: flusher,
+		done:    make(chan struct{}),
+	}
+}
+
+// Open is a no-op, the stream is already open.
+func (g *grpcServerStream) Open() error {
+	return nil
+}
+
+// IsOpen returns true until the stream ends.
+func (g *grpcServerStream) IsOpen() bool {
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+	return !g.closed
+}
+
+// Close ends the stream.
+func (g *grpcServerStream) Close() error {
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+	if !g.closed {
+		g.closed = true
+		close(g.done)
+	}
+	return nil
+}
+
+// Read reads the payloads of received messages. The stream ends once the
+// client stops sending, as responses to its requests have been sent.
+func (g *grpcServerStream) Read(buf []byte) (int, error) {
+	n, err := g.reader.Read(buf)
+	if err != nil {
+		g.Close()
+	}
+	return n, thrift.NewTTransportExceptionFromError(err)
+}
+
+// Write buffers the given bytes until Flush is called.
+func (g *grpcServerStream) Write(buf []byte) (int, error) {
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+	return g.writeBuf.Write(buf)
+}
+
+// Flush sends the buffered bytes as a message.
+func (g *grpcServerStream) Flush() error {
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+	if g.closed {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: gRPC stream closed")
+	}
+	if g.writeBuf.Len() == 0 {
+		return nil
+	}
+	err := writeGRPCMessage(g.writer, g.writeBuf.Bytes())
+	g.writeBuf.Reset()
+	if err == nil {
+		g.flusher.Flush()
+	}
+	return thrift.NewTTransportExceptionFromError(err)
+}
+
+// RemainingBytes returns the maximum uint64, as the amount of data to be read
+// is unknown.
+func (g *grpcServerStream) RemainingBytes() uint64 {
+	return ^uint64(0)
+}
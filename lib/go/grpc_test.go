@@ -0,0 +1,99 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures concurrent requests are answered over a gRPC stream using h2c.
+func TestGRPCTransportRequest(t *testing.T) {
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	serverTransport := NewFGRPCServerTransport()
+	server := NewFSimpleServer(&headerProcessor{}, serverTransport, protocolFactory)
+	go server.Serve()
+	defer server.Stop()
+	mux := http.NewServeMux()
+	mux.Handle(GRPCStreamPath, serverTransport)
+	ts := httptest.NewUnstartedServer(mux)
+	ConfigureHTTP2Server(ts.Config)
+	ts.Start()
+	defer ts.Close()
+
+	transport := NewAdapterTransport(NewTGRPCTransport(nil, ts.URL))
+	assert.Nil(t, transport.Open())
+	assert.True(t, transport.IsOpen())
+
+	users := []string{"alice", strings.Repeat("b", 1000), strings.Repeat("c", 70000)}
+	var wg sync.WaitGroup
+	for i, user := range users {
+		wg.Add(1)
+		go func(i int, user string) {
+			defer wg.Done()
+			ctx := NewFContext(fmt.Sprintf("cid-%d", i))
+			ctx.AddRequestHeader("user", user)
+			buffer := NewTMemoryOutputBuffer(0)
+			protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx)
+			result, err := transport.Request(ctx, buffer.Bytes())
+			if !assert.Nil(t, err) {
+				return
+			}
+			resultProto := protocolFactory.GetProtocol(result)
+			assert.Nil(t, resultProto.ReadResponseHeader(ctx))
+			actual, err := resultProto.ReadString()
+			assert.Nil(t, err)
+			assert.Equal(t, user, actual)
+		}(i, user)
+	}
+	wg.Wait()
+
+	assert.Nil(t, transport.Close())
+	assert.False(t, transport.IsOpen())
+}
+
+// Ensures the gRPC server transport rejects requests which aren't gRPC over
+// HTTP/2, and closed server transports end new streams as unavailable.
+func TestGRPCServerTransport(t *testing.T) {
+	serverTransport := NewFGRPCServerTransport()
+	ts := httptest.NewUnstartedServer(serverTransport)
+	ConfigureHTTP2Server(ts.Config)
+	ts.Start()
+	defer ts.Close()
+
+	response, err := http.Post(ts.URL+GRPCStreamPath, "application/json", nil)
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, response.StatusCode)
+
+	response, err = http.Post(ts.URL+GRPCStreamPath, grpcContentType, nil)
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusHTTPVersionNotSupported, response.StatusCode)
+
+	assert.Nil(t, serverTransport.Listen())
+	assert.Nil(t, serverTransport.Interrupt())
+	_, err = serverTransport.Accept()
+	assert.Error(t, err)
+	err = NewTGRPCTransport(nil, ts.URL).Open()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "status 14")
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// HeaderCodec serializes frugal headers in an alternative format, such as one
+// with packed lengths or a dictionary of well-known keys. Encoded headers are
+// written after the codec's version byte and their size, so frames remain
+// readable by any frugal process which has registered the codec and can be
+// routed by the size alone. Implementations must be safe for concurrent use.
+type HeaderCodec interface {
+	// Version returns the header protocol version identifying headers encoded
+	// by the codec. It must not be a version used by frugal.
+	Version() byte
+
+	// Encode serializes the given headers.
+	Encode(headers map[string]string) []byte
+
+	// Decode deserializes headers encoded by Encode.
+	Decode(data []byte) (map[string]string, error)
+}
+
+var (
+	headerCodecsMu sync.RWMutex
+	headerCodecs   = make(map[byte]protocolMarshaler)
+)
+
+// RegisterHeaderCodec makes headers encoded by the given codec readable by
+// every FProtocol and frugal transport in the process. Processes reading
+// frames written with FProtocolFactory.WithHeaderCodec must register the
+// codec, usually at startup. An error is returned if the codec's version is
+// used by frugal or another registered codec.
+func RegisterHeaderCodec(codec HeaderCodec) error {
+	version := codec.Version()
+	if _, err := getMarshaler(version); err == nil {
+		return fmt.Errorf("frugal: header protocol version %d is already in use", version)
+	}
+	headerCodecsMu.Lock()
+	defer headerCodecsMu.Unlock()
+	if _, ok := headerCodecs[version]; ok {
+		return fmt.Errorf("frugal: header protocol version %d is already in use", version)
+	}
+	headerCodecs[version] = &codecProtocolMarshaler{codec: codec}
+	return nil
+}
+
+// WithHeaderCodec sets the codec used to serialize headers written by
+// FProtocols produced by this factory. Headers are read with whichever codec
+// wrote them, so clients and servers can switch codecs independently once
+// every peer has registered the codec with RegisterHeaderCodec. Payloads are
+// not compressed when a codec is set. Returns the same FProtocolFactory to
+// allow for chaining calls.
+func (f *FProtocolFactory) WithHeaderCodec(codec HeaderCodec) *FProtocolFactory {
+	f.marshaler = &codecProtocolMarshaler{codec: codec}
+	return f
+}
+
+// registeredMarshaler returns the protocolMarshaler for the codec registered
+// with the given version, if any.
+func registeredMarshaler(version byte) (protocolMarshaler, bool) {
+	headerCodecsMu.RLock()
+	defer headerCodecsMu.RUnlock()
+	marshaler, ok := headerCodecs[version]
+	return marshaler, ok
+}
+
+// codecProtocolMarshaler implements the protocolMarshaler interface for a
+// HeaderCodec. Headers are serialized as the version, the size of the encoded
+// headers (4 bytes) and the encoded headers.
+type codecProtocolMarshaler struct {
+	codec HeaderCodec
+}
+
+// marshalHeaders serializes the given headers map to a byte slice.
+func (c *codecProtocolMarshaler) marshalHeaders(headers map[string]string) []byte {
+	encoded := c.codec.Encode(headers)
+	buff := make([]byte, 5+len(encoded))
+	buff[0] = c.codec.Version()
+	binary.BigEndian.PutUint32(buff[1:5], uint32(len(encoded)))
+	copy(buff[5:], encoded)
+	return buff
+}
+
+// unmarshalHeaders reads headers from the reader into a map, enforcing the
+// given limits. The size limit is checked against the encoded size before the
+// headers are read.
+func (c *codecProtocolMarshaler) unmarshalHeaders(reader io.Reader, limits HeaderLimits) (map[string]string, error) {
+	buff := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
+			return nil, err
+		}
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: error reading protocol headers in unmarshalHeaders reading header size: %s", err))
+	}
+	size := int32(binary.BigEndian.Uint32(buff))
+	if limits.MaxSize > 0 && (size < 0 || int(size) > limits.MaxSize) {
+		return nil, &HeaderLimitError{Size: int(size), Limits: limits}
+	}
+	if size < 0 || int(size) > defaultMaxLength {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: invalid v%d protocol headers size %d", c.codec.Version(), size))
+	}
+	buff = make([]byte, size)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
+			return nil, err
+		}
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: error reading protocol headers in unmarshalHeaders reading headers: %s", err))
+	}
+
+	headers, err := c.decode(buff)
+	if err != nil {
+		return nil, err
+	}
+	if err := limits.check(headers); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// unmarshalHeadersFromFrame reads serialized headers from the byte slice into
+// a map.
+func (c *codecProtocolMarshaler) unmarshalHeadersFromFrame(frame []byte) (map[string]string, error) {
+	size, err := c.headersSize(frame)
+	if err != nil {
+		return nil, err
+	}
+	return c.decode(frame[4 : 4+size])
+}
+
+// addHeadersToFrame returns a new frame containing the given headers. This
+// assumes the frame still has the frame size header at the beginning.
+func (c *codecProtocolMarshaler) addHeadersToFrame(frame []byte, headers map[string]string) ([]byte, error) {
+	existing, err := c.unmarshalHeadersFromFrame(frame[5:])
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		existing[name] = value
+	}
+	oldHeadersSize := binary.BigEndian.Uint32(frame[5:])
+	return prependFrameSize(append(c.marshalHeaders(existing), frame[9+oldHeadersSize:]...)), nil
+}
+
+// unmarshalFrame deserializes the byte slice into frame components.
+func (c *codecProtocolMarshaler) unmarshalFrame(frame []byte, components *frameComponents) error {
+	headers, err := c.unmarshalHeadersFromFrame(frame)
+	if err != nil {
+		return err
+	}
+	size, _ := c.headersSize(frame)
+	components.headers = headers
+	components.payload = frame[4+size:]
+	return nil
+}
+
+// headersSize returns the size of the encoded headers at the start of the
+// given frame, which starts after the version.
+func (c *codecProtocolMarshaler) headersSize(frame []byte) (int, error) {
+	// Need at least 4 bytes for headers size.
+	if len(frame) < 4 {
+		return 0, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: invalid v%d frame size %d", c.codec.Version(), len(frame)))
+	}
+	size := binary.BigEndian.Uint32(frame)
+	if uint64(size) > uint64(len(frame[4:])) {
+		return 0, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: v%d frame size %d does not match actual size %d", c.codec.Version(), size, len(frame[4:])))
+	}
+	return int(size), nil
+}
+
+func (c *codecProtocolMarshaler) decode(data []byte) (map[string]string, error) {
+	headers, err := c.codec.Decode(data)
+	if err != nil {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: invalid v%d protocol headers: %s", c.codec.Version(), err))
+	}
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	return headers, nil
+}
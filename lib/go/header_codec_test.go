@@ -0,0 +1,142 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// varintHeaderCodec encodes headers as varint prefixed names and values.
+type varintHeaderCodec struct {
+	version byte
+}
+
+func (v *varintHeaderCodec) Version() byte {
+	return v.version
+}
+
+func (v *varintHeaderCodec) Encode(headers map[string]string) []byte {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buff []byte
+	for _, name := range names {
+		buff = v.appendString(buff, name)
+		buff = v.appendString(buff, headers[name])
+	}
+	return buff
+}
+
+func (v *varintHeaderCodec) appendString(buff []byte, s string) []byte {
+	size := make([]byte, binary.MaxVarintLen64)
+	buff = append(buff, size[:binary.PutUvarint(size, uint64(len(s)))]...)
+	return append(buff, s...)
+}
+
+func (v *varintHeaderCodec) Decode(data []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	var pair [2]string
+	for i := 0; len(data) > 0; i++ {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return nil, errors.New("truncated header")
+		}
+		pair[i%2] = string(data[n : n+int(size)])
+		data = data[n+int(size):]
+		if i%2 == 1 {
+			headers[pair[0]] = pair[1]
+		}
+	}
+	return headers, nil
+}
+
+// Ensures headers round-trip through FProtocols with a registered codec and
+// frames can be inspected and modified with it.
+func TestHeaderCodecRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	codec := &varintHeaderCodec{version: 0x10}
+	assert.Nil(RegisterHeaderCodec(codec))
+
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithHeaderCodec(codec)
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("user", "alice")
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protocolFactory.GetProtocol(buffer)
+	assert.Nil(proto.WriteRequestHeader(ctx))
+	assert.Nil(writeConformanceMessage(proto, "conform", thrift.CALL))
+	frame := buffer.Bytes()
+	assert.Equal(byte(0x10), frame[4])
+
+	// Readers don't need the codec set to read its headers.
+	proto = NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	serverCtx, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	assert.Equal("cid", serverCtx.CorrelationID())
+	readConformanceMessage(t, proto, thrift.CALL)
+
+	frame, err = addHeadersToFrame(frame, map[string]string{"user": "bob"})
+	assert.Nil(err)
+	headers, err := getHeadersFromFrame(frame[4:])
+	assert.Nil(err)
+	assert.Equal("bob", headers["user"])
+	components, err := unmarshalFrame(frame)
+	assert.Nil(err)
+	assert.Equal(headers, components.headers)
+	proto = NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(components.payload)})
+	readConformanceMessage(t, proto, thrift.CALL)
+}
+
+// Ensures codecs can't be registered with versions already in use.
+func TestRegisterHeaderCodecVersionInUse(t *testing.T) {
+	assert := assert.New(t)
+	assert.NotNil(RegisterHeaderCodec(&varintHeaderCodec{version: protocolV0}))
+	assert.NotNil(RegisterHeaderCodec(&varintHeaderCodec{version: protocolV1}))
+	assert.NotNil(RegisterHeaderCodec(&varintHeaderCodec{version: protocolJSONDebug}))
+	assert.Nil(RegisterHeaderCodec(&varintHeaderCodec{version: 0x11}))
+	assert.NotNil(RegisterHeaderCodec(&varintHeaderCodec{version: 0x11}))
+}
+
+// Ensures limits are enforced and invalid encodings rejected for codec
+// headers.
+func TestHeaderCodecInvalidHeaders(t *testing.T) {
+	assert := assert.New(t)
+	codec := &varintHeaderCodec{version: 0x12}
+	assert.Nil(RegisterHeaderCodec(codec))
+	marshaler := &codecProtocolMarshaler{codec: codec}
+
+	buff := marshaler.marshalHeaders(map[string]string{"a": "1", "b": "2"})
+	_, err := readHeaderWithLimits(bytes.NewReader(buff), HeaderLimits{MaxSize: 4})
+	assert.True(IsErrHeaderLimit(err))
+	_, err = readHeaderWithLimits(bytes.NewReader(buff), HeaderLimits{MaxCount: 1})
+	assert.True(IsErrHeaderLimit(err))
+	headers, err := readHeaderWithLimits(bytes.NewReader(buff), HeaderLimits{})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"a": "1", "b": "2"}, headers)
+
+	_, err = getHeadersFromFrame([]byte{0x12, 0, 0, 0, 2, 5, 'a'})
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+	_, err = getHeadersFromFrame([]byte{0x12, 0, 0, 0, 9, 1})
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+}
@@ -0,0 +1,302 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// protocolV1 extends v0 of the header protocol with a byte after the version
+// identifying the compression algorithm of the payload. The headers
+// themselves are not compressed, so they can be read to route frames without
+// decompressing them.
+const protocolV1 = 0x01
+
+// Payload compression algorithms of v1 of the header protocol.
+const (
+	compressionNone = 0x00
+	compressionGzip = 0x01
+)
+
+var v1Marshaler = &v1ProtocolMarshaler{}
+
+// WithCompression gzip compresses the message payloads written by FProtocols
+// produced by this factory which are at least the given number of bytes.
+// Smaller payloads are sent uncompressed since compressing them saves little.
+// FProtocols produced by the factory also decompress payloads, so this works
+// with every transport. Compressed frames use v1 of the header protocol, so
+// clients and servers must both enable compression to exchange them. Messages
+// are buffered until the protocol is flushed. Returns the same
+// FProtocolFactory to allow for chaining calls.
+func (f *FProtocolFactory) WithCompression(threshold uint) *FProtocolFactory {
+	f.compress = true
+	f.compressionThreshold = int(threshold)
+	return f
+}
+
+// compressionTransport wraps the TTransport of an FProtocol to compress
+// written payloads and decompress read ones. The FProtocol hands it the
+// headers of each message so the payload can be buffered and compressed on
+// Flush, or decompressed before the TProtocol reads it.
+type compressionTransport struct {
+	thrift.TTransport
+	threshold int
+
+	// headers are the v0 serialized headers of the message being buffered,
+	// or nil if writes pass through.
+	headers []byte
+	buffer  bytes.Buffer
+
+	// payload is the decompressed payload of the message being read, or nil
+	// if reads pass through.
+	payload *bytes.Reader
+}
+
+// bufferMessage buffers writes until Flush, when the given serialized
+// headers are written ahead of the payload.
+func (c *compressionTransport) bufferMessage(headers []byte) {
+	c.headers = headers
+	c.buffer.Reset()
+}
+
+func (c *compressionTransport) Write(p []byte) (int, error) {
+	if c.headers != nil {
+		return c.buffer.Write(p)
+	}
+	return c.TTransport.Write(p)
+}
+
+// Flush writes the buffered message, compressing the payload if it is at
+// least the threshold and compression makes it smaller, then flushes the
+// underlying transport.
+func (c *compressionTransport) Flush() error {
+	if c.headers != nil {
+		headers, payload := c.headers, c.buffer.Bytes()
+		c.headers = nil
+		if len(payload) >= c.threshold {
+			compressed, err := gzipBytes(payload)
+			if err != nil {
+				return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+					fmt.Sprintf("frugal: error compressing payload: %s", err))
+			}
+			if len(compressed) < len(payload) {
+				headers = v1Marshaler.fromV0(headers, compressionGzip)
+				payload = compressed
+			}
+		}
+		if _, err := c.TTransport.Write(headers); err != nil {
+			return thrift.NewTTransportExceptionFromError(err)
+		}
+		if _, err := c.TTransport.Write(payload); err != nil {
+			return thrift.NewTTransportExceptionFromError(err)
+		}
+		c.buffer.Reset()
+	}
+	return c.TTransport.Flush()
+}
+
+func (c *compressionTransport) Read(p []byte) (int, error) {
+	if c.payload != nil {
+		if c.payload.Len() > 0 {
+			return c.payload.Read(p)
+		}
+		c.payload = nil
+	}
+	return c.TTransport.Read(p)
+}
+
+func (c *compressionTransport) RemainingBytes() uint64 {
+	if c.payload != nil {
+		return uint64(c.payload.Len())
+	}
+	return c.TTransport.RemainingBytes()
+}
+
+// readHeader reads the headers of the next message from the underlying
+// transport, enforcing the given limits. If the payload is compressed, it is
+// read and decompressed so the following reads return the message.
+func (c *compressionTransport) readHeader(limits HeaderLimits) (map[string]string, error) {
+	c.payload = nil
+	version, err := readProtocolVersion(c.TTransport)
+	if err != nil {
+		return nil, err
+	}
+	if version != protocolV1 {
+		marshaler, err := getMarshaler(version)
+		if err != nil {
+			return nil, err
+		}
+		return marshaler.unmarshalHeaders(c.TTransport, limits)
+	}
+
+	headers, compression, err := v1Marshaler.unmarshalHeadersWithCompression(c.TTransport, limits)
+	if err != nil || compression == compressionNone {
+		return headers, err
+	}
+
+	// The payload runs to the end of the frame. Limit reads to the frame
+	// where the transport knows its size.
+	reader := io.Reader(c.TTransport)
+	if remaining := c.TTransport.RemainingBytes(); remaining != ^uint64(0) {
+		reader = io.LimitReader(reader, int64(remaining))
+	}
+	payload, err := gunzipPayload(reader)
+	if err != nil {
+		return nil, err
+	}
+	c.payload = bytes.NewReader(payload)
+	return headers, nil
+}
+
+// gunzipPayload returns the decompressed payload read from the given Reader.
+// Payloads larger than the default maximum frame size are rejected so small
+// frames can't be used to exhaust memory.
+func gunzipPayload(reader io.Reader) ([]byte, error) {
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: error decompressing payload: %s", err))
+	}
+	// Stop at the end of the payload rather than reading on for another
+	// gzip member.
+	gz.Multistream(false)
+	payload, err := ioutil.ReadAll(io.LimitReader(gz, defaultMaxLength+1))
+	if err != nil {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: error decompressing payload: %s", err))
+	}
+	if len(payload) > defaultMaxLength {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.SIZE_LIMIT,
+			fmt.Errorf("frugal: decompressed payload exceeds %d bytes", defaultMaxLength))
+	}
+	return payload, nil
+}
+
+// v1ProtocolMarshaler implements the protocolMarshaler interface for v1 of the
+// Frugal protocol. Headers are serialized as in v0, after the version and
+// compression bytes.
+type v1ProtocolMarshaler struct{}
+
+// marshalHeaders serializes the given headers map to a byte slice for an
+// uncompressed payload.
+func (v *v1ProtocolMarshaler) marshalHeaders(headers map[string]string) []byte {
+	return v.fromV0(v0Marshaler.marshalHeaders(headers), compressionNone)
+}
+
+// fromV0 returns the given v0 serialized headers as v1 headers with the given
+// compression.
+func (v *v1ProtocolMarshaler) fromV0(headers []byte, compression byte) []byte {
+	// Header buff = [version (1 byte), compression (1 byte), size (4 bytes), headers (size bytes)]
+	buff := make([]byte, len(headers)+1)
+	buff[0] = protocolV1
+	buff[1] = compression
+	copy(buff[2:], headers[1:])
+	return buff
+}
+
+// unmarshalHeaders reads headers from the reader into a map, enforcing the
+// given limits. Compressed payloads can only be read by FProtocols with
+// compression enabled, which decompress them, so an error is returned for
+// them.
+func (v *v1ProtocolMarshaler) unmarshalHeaders(reader io.Reader, limits HeaderLimits) (map[string]string, error) {
+	headers, compression, err := v.unmarshalHeadersWithCompression(reader, limits)
+	if err != nil {
+		return nil, err
+	}
+	if compression != compressionNone {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			errors.New("frugal: compressed payloads require an FProtocolFactory with compression enabled"))
+	}
+	return headers, nil
+}
+
+// unmarshalHeadersWithCompression reads headers from the reader into a map,
+// enforcing the given limits, and returns the compression of the payload.
+func (v *v1ProtocolMarshaler) unmarshalHeadersWithCompression(reader io.Reader, limits HeaderLimits) (map[string]string, byte, error) {
+	buff := make([]byte, 1)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
+			return nil, 0, err
+		}
+		return nil, 0, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: error reading protocol headers in unmarshalHeaders reading compression: %s", err))
+	}
+	if err := checkCompression(buff[0]); err != nil {
+		return nil, 0, err
+	}
+	headers, err := v0Marshaler.unmarshalHeaders(reader, limits)
+	return headers, buff[0], err
+}
+
+// unmarshalHeadersFromFrame reads serialized headers from the byte slice into
+// a map.
+func (v *v1ProtocolMarshaler) unmarshalHeadersFromFrame(frame []byte) (map[string]string, error) {
+	// Need at least 1 byte for compression.
+	if len(frame) < 1 {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: invalid v1 frame size %d", len(frame)))
+	}
+	if err := checkCompression(frame[0]); err != nil {
+		return nil, err
+	}
+	return v0Marshaler.unmarshalHeadersFromFrame(frame[1:])
+}
+
+// addHeadersToFrame returns a new frame containing the given headers. This
+// assumes the frame still has the frame size header at the beginning. The
+// payload is left as is.
+func (v *v1ProtocolMarshaler) addHeadersToFrame(frame []byte, headers map[string]string) ([]byte, error) {
+	existing, err := v.unmarshalHeadersFromFrame(frame[5:])
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		existing[name] = value
+	}
+	oldHeadersSize := binary.BigEndian.Uint32(frame[6:])
+	serializedHeaders := v.fromV0(v0Marshaler.marshalHeaders(existing), frame[5])
+	return prependFrameSize(append(serializedHeaders, frame[10+oldHeadersSize:]...)), nil
+}
+
+// unmarshalFrame deserializes the byte slice into frame components. The
+// payload is left compressed.
+func (v *v1ProtocolMarshaler) unmarshalFrame(frame []byte, components *frameComponents) error {
+	headers, err := v.unmarshalHeadersFromFrame(frame)
+	if err != nil {
+		return err
+	}
+	components.headers = headers
+	components.payload = frame[5+binary.BigEndian.Uint32(frame[1:]):]
+	return nil
+}
+
+// checkCompression returns an error if the given compression algorithm is
+// not supported.
+func checkCompression(compression byte) error {
+	switch compression {
+	case compressionNone, compressionGzip:
+		return nil
+	default:
+		return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: unsupported payload compression %d", compression))
+	}
+}
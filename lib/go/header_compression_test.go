@@ -0,0 +1,134 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCompressionRequest(t *testing.T, protocolFactory *FProtocolFactory) []byte {
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("user", "alice")
+	// Pin the opid so frames written by different tests are the same size.
+	setRequestOpID(ctx, 1)
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protocolFactory.GetProtocol(buffer)
+	assert.Nil(t, proto.WriteRequestHeader(ctx))
+	assert.Nil(t, writeConformanceMessage(proto, "conform", thrift.CALL))
+	return buffer.Bytes()
+}
+
+// Ensures payloads above the threshold are compressed with v1 headers and
+// decompressed by FProtocols with compression enabled.
+func TestCompressionRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	frame := writeCompressionRequest(t, NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithCompression(10))
+	assert.Equal(byte(protocolV1), frame[4])
+	assert.Equal(byte(compressionGzip), frame[5])
+	uncompressed := writeCompressionRequest(t, NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()))
+	assert.True(len(frame) < len(uncompressed))
+
+	headers, err := getHeadersFromFrame(frame[4:])
+	assert.Nil(err)
+	assert.Equal("cid", headers[cidHeader])
+	assert.Equal("alice", headers["user"])
+
+	proto := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithCompression(1 << 20).
+		GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	ctx, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	assert.Equal("cid", ctx.CorrelationID())
+	readConformanceMessage(t, proto, thrift.CALL)
+
+	// Compressed payloads can't be read without compression enabled.
+	_, err = NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])}).ReadRequestHeader()
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+}
+
+// Ensures payloads below the threshold are written with v0 headers.
+func TestCompressionBelowThreshold(t *testing.T) {
+	assert := assert.New(t)
+	frame := writeCompressionRequest(t, NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithCompression(1<<20))
+	assert.Equal(byte(protocolV0), frame[4])
+	assert.Len(frame, len(writeCompressionRequest(t, NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()))))
+
+	proto := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	_, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	readConformanceMessage(t, proto, thrift.CALL)
+}
+
+// Ensures compressed messages read from a stream of frames don't consume
+// the following frame.
+func TestCompressionFramedStream(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFCompactProtocolFactory().WithCompression(0)
+	stream := thrift.NewTMemoryBuffer()
+	stream.Write(writeCompressionRequest(t, protocolFactory))
+	stream.Write(writeCompressionRequest(t, protocolFactory))
+
+	proto := protocolFactory.GetProtocol(NewTFramedTransport(stream))
+	for i := 0; i < 2; i++ {
+		ctx, err := proto.ReadRequestHeader()
+		assert.Nil(err)
+		assert.Equal("cid", ctx.CorrelationID())
+		readConformanceMessage(t, proto, thrift.CALL)
+	}
+}
+
+// Ensures headers can be added to v1 frames without touching the payload.
+func TestCompressionAddHeadersToFrame(t *testing.T) {
+	assert := assert.New(t)
+	frame := writeCompressionRequest(t, NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithCompression(0))
+	frame, err := addHeadersToFrame(frame, map[string]string{"user": "bob"})
+	assert.Nil(err)
+
+	components, err := unmarshalFrame(frame)
+	assert.Nil(err)
+	assert.Equal(byte(protocolV1), components.protocolVersion)
+	assert.Equal("bob", components.headers["user"])
+
+	proto := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithCompression(0).
+		GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	ctx, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	user, _ := ctx.RequestHeader("user")
+	assert.Equal("bob", user)
+	readConformanceMessage(t, proto, thrift.CALL)
+}
+
+// Ensures unsupported algorithms and oversized payloads are rejected.
+func TestCompressionInvalidPayload(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithCompression(0)
+	headers := v1Marshaler.fromV0(v0Marshaler.marshalHeaders(map[string]string{opIDHeader: "1"}), 0x7f)
+	_, err := protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(headers)}).ReadRequestHeader()
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+
+	payload, err := gzipBytes(make([]byte, defaultMaxLength+1))
+	assert.Nil(err)
+	headers = v1Marshaler.fromV0(v0Marshaler.marshalHeaders(map[string]string{opIDHeader: "1"}), compressionGzip)
+	_, err = protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(append(headers, payload...))}).ReadRequestHeader()
+	assert.Equal(thrift.SIZE_LIMIT, err.(thrift.TProtocolException).TypeId())
+
+	headers = v1Marshaler.fromV0(v0Marshaler.marshalHeaders(map[string]string{opIDHeader: "1"}), compressionGzip)
+	_, err = protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(append(headers, "garbage"...))}).ReadRequestHeader()
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+}
@@ -0,0 +1,291 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// scanV0Pairs calls f with each name and value of the given v0 serialized
+// header pairs, stopping if f returns false. The slices alias the given
+// bytes. An error is returned if the pairs are malformed.
+func scanV0Pairs(buff []byte, f func(name, value []byte) bool) error {
+	for i := 0; i < len(buff); {
+		name, n, ok := readV0String(buff[i:])
+		if !ok {
+			return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+				errors.New("frugal: invalid v0 protocol header name"))
+		}
+		i += n
+		value, n, ok := readV0String(buff[i:])
+		if !ok {
+			return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+				errors.New("frugal: invalid v0 protocol header value"))
+		}
+		i += n
+		if !f(name, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readV0String reads a size prefixed string from the start of the given
+// bytes, returning it and the number of bytes it spans.
+func readV0String(buff []byte) ([]byte, int, bool) {
+	if len(buff) < 4 {
+		return nil, 0, false
+	}
+	size := binary.BigEndian.Uint32(buff)
+	if uint64(size) > uint64(len(buff)-4) {
+		return nil, 0, false
+	}
+	return buff[4 : 4+size], 4 + int(size), true
+}
+
+// lookupV0Header returns the value of the named header in the given v0
+// serialized header pairs without decoding the others. If the header is
+// repeated, the last value is returned, as when the pairs are decoded.
+func lookupV0Header(buff []byte, name string) (value string, ok bool) {
+	scanV0Pairs(buff, func(n, v []byte) bool {
+		if string(n) == name {
+			value, ok = string(v), true
+		}
+		return true
+	})
+	return value, ok
+}
+
+// frameHeader returns the value of the named header in the given frame,
+// which starts after the frame size. v0 and v1 headers are read without
+// decoding the other headers.
+func frameHeader(frame []byte, name string) (string, bool, error) {
+	if len(frame) == 0 {
+		return "", false, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA, errors.New("frugal: invalid frame size 0"))
+	}
+	pairs := frame[1:]
+	switch frame[0] {
+	case protocolV1:
+		if len(pairs) < 1 {
+			return "", false, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+				fmt.Errorf("frugal: invalid v1 frame size %d", len(pairs)))
+		}
+		if err := checkCompression(pairs[0]); err != nil {
+			return "", false, err
+		}
+		pairs = pairs[1:]
+	case protocolV0:
+	default:
+		headers, err := getHeadersFromFrame(frame)
+		if err != nil {
+			return "", false, err
+		}
+		value, ok := headers[name]
+		return value, ok, nil
+	}
+
+	// Need at least 4 bytes for headers size.
+	if len(pairs) < 4 {
+		return "", false, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: invalid v0 frame size %d", len(pairs)))
+	}
+	size := binary.BigEndian.Uint32(pairs)
+	if uint64(size) > uint64(len(pairs)-4) {
+		return "", false, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: v0 frame size %d does not match actual size %d", size, len(pairs)-4))
+	}
+	pairs = pairs[4 : 4+size]
+	var (
+		value string
+		ok    bool
+	)
+	err := scanV0Pairs(pairs, func(n, v []byte) bool {
+		if string(n) == name {
+			value, ok = string(v), true
+		}
+		return true
+	})
+	return value, ok, err
+}
+
+// peekedRequest holds the request headers read from an FProtocol by a
+// processor wrapping another, for ReadRequestHeader to return the context of.
+type peekedRequest struct {
+	// plain is set if the request is from a plain Thrift client, so has no
+	// headers.
+	plain bool
+
+	// pairs are the serialized v0 headers, which are decoded lazily, if
+	// headers isn't set.
+	pairs   []byte
+	headers map[string]string
+}
+
+// header returns the named header, without decoding the others.
+func (p *peekedRequest) header(name string) (string, bool) {
+	if p.pairs != nil {
+		return lookupV0Header(p.pairs, name)
+	}
+	value, ok := p.headers[name]
+	return value, ok
+}
+
+// decoded returns all of the headers. v0 headers are decoded once, and
+// ReadRequestHeader uses the decoded headers rather than decoding them again.
+func (p *peekedRequest) decoded() map[string]string {
+	if p.pairs == nil {
+		if p.headers == nil {
+			p.headers = map[string]string{}
+		}
+		return p.headers
+	}
+	headers := make(map[string]string)
+	// The headers were validated when they were read.
+	scanV0Pairs(p.pairs, func(n, v []byte) bool {
+		headers[string(n)] = string(v)
+		return true
+	})
+	p.pairs, p.headers = nil, headers
+	return headers
+}
+
+// peekRequestHeaders reads the request headers on the protocol, detecting
+// plain Thrift requests if interop is enabled, without consuming them, so
+// processors wrapping another can inspect them before passing the protocol
+// on. The next ReadRequestHeader returns the context of the peeked headers.
+func (f *FProtocol) peekRequestHeaders() (*peekedRequest, error) {
+	if f.peeked != nil {
+		return f.peeked, nil
+	}
+	if f.interop != nil {
+		plain, err := f.interop.isPlainThrift()
+		if err != nil {
+			return nil, err
+		}
+		if plain {
+			f.peeked = &peekedRequest{plain: true}
+			return f.peeked, nil
+		}
+	}
+	pairs, headers, err := f.readRequestHeaders()
+	if err != nil {
+		return nil, err
+	}
+	f.peeked = &peekedRequest{pairs: pairs, headers: headers}
+	return f.peeked, nil
+}
+
+// readRequestHeaders reads request headers from the underlying transport,
+// enforcing the protocol's limits. v0 headers are returned serialized so they
+// can be decoded lazily, other versions are returned decoded.
+func (f *FProtocol) readRequestHeaders() ([]byte, map[string]string, error) {
+	if f.compression != nil || f.envelope != nil {
+		headers, err := f.readHeader()
+		return nil, headers, err
+	}
+	version, err := readProtocolVersion(f.Transport())
+	if err != nil {
+		return nil, nil, err
+	}
+	if version != protocolV0 {
+		marshaler, err := getMarshaler(version)
+		if err != nil {
+			return nil, nil, err
+		}
+		headers, err := marshaler.unmarshalHeaders(f.Transport(), f.headerLimits)
+		return nil, headers, err
+	}
+
+	pairs, err := v0Marshaler.readHeaderBytes(f.Transport(), f.headerLimits)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := f.Transport().(*frameTransport); ok {
+		// The context may outlive the frame.
+		pairs = append([]byte(nil), pairs...)
+	}
+	count := 0
+	if err := scanV0Pairs(pairs, func(_, _ []byte) bool {
+		count++
+		return true
+	}); err != nil {
+		return nil, nil, err
+	}
+	if err := f.headerLimits.checkCountAndSize(count, len(pairs)); err != nil {
+		return nil, nil, err
+	}
+	if pairs == nil {
+		pairs = []byte{}
+	}
+	return pairs, nil, nil
+}
+
+// setLazyRequestHeaders sets the v0 serialized request headers read by the
+// server, which are decoded when the request headers are first accessed.
+// Per-hop headers are excluded when decoding, and headers which have already
+// been set take precedence.
+func (c *FContextImpl) setLazyRequestHeaders(pairs []byte) {
+	c.mu.Lock()
+	c.lazyRequestHeaders = pairs
+	atomic.StoreInt32(&c.lazy, 1)
+	c.mu.Unlock()
+}
+
+// materializeRequestHeaders decodes lazily read request headers.
+func (c *FContextImpl) materializeRequestHeaders() {
+	if atomic.LoadInt32(&c.lazy) == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.materializeRequestHeadersLocked()
+	c.mu.Unlock()
+}
+
+// materializeRequestHeadersLocked decodes lazily read request headers. The
+// context must be locked for writing.
+func (c *FContextImpl) materializeRequestHeadersLocked() {
+	if c.lazyRequestHeaders == nil {
+		return
+	}
+	// The headers were validated when they were read.
+	scanV0Pairs(c.lazyRequestHeaders, func(n, v []byte) bool {
+		name := string(n)
+		if isPerHopRequestHeader(name) {
+			return true
+		}
+		if _, ok := c.requestHeaders[name]; !ok {
+			c.requestHeaders[name] = string(v)
+		}
+		return true
+	})
+	c.lazyRequestHeaders = nil
+	atomic.StoreInt32(&c.lazy, 0)
+}
+
+// requestHeader returns the named request header, decoding only it if the
+// request headers are read lazily. The context must be locked for reading.
+func (c *FContextImpl) requestHeader(name string) (string, bool) {
+	if value, ok := c.requestHeaders[name]; ok {
+		return value, true
+	}
+	if c.lazyRequestHeaders == nil || isPerHopRequestHeader(name) {
+		return "", false
+	}
+	return lookupV0Header(c.lazyRequestHeaders, name)
+}
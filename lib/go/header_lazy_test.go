@@ -0,0 +1,150 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeLazyRequest(t *testing.T, headers map[string]string) []byte {
+	ctx := NewFContext("cid")
+	for name, value := range headers {
+		ctx.AddRequestHeader(name, value)
+	}
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).GetProtocol(buffer)
+	assert.Nil(t, proto.WriteRequestHeader(ctx))
+	assert.Nil(t, proto.WriteString("payload"))
+	return buffer.Bytes()
+}
+
+// Ensures single headers are read from frames of each header protocol
+// version.
+func TestFrameHeader(t *testing.T) {
+	assert := assert.New(t)
+	headers := map[string]string{"user": "alice", opIDHeader: "7"}
+
+	v0 := v0Marshaler.marshalHeaders(headers)
+	v1 := v1Marshaler.marshalHeaders(headers)
+	debug := jsonDebugMarshaler.marshalHeaders(headers)
+	for _, frame := range [][]byte{v0, v1, debug} {
+		value, ok, err := frameHeader(append(frame, "payload"...), opIDHeader)
+		assert.Nil(err)
+		assert.True(ok)
+		assert.Equal("7", value)
+		_, ok, err = frameHeader(frame, "missing")
+		assert.Nil(err)
+		assert.False(ok)
+	}
+
+	_, _, err := frameHeader(nil, opIDHeader)
+	assert.NotNil(err)
+	_, _, err = frameHeader([]byte{protocolV0, 0, 0, 0, 9, 0}, opIDHeader)
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+	_, _, err = frameHeader([]byte{protocolV0, 0, 0, 0, 4, 0, 0, 0, 9}, opIDHeader)
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+	_, _, err = frameHeader([]byte{0x02}, opIDHeader)
+	assert.Equal(thrift.BAD_VERSION, err.(thrift.TProtocolException).TypeId())
+}
+
+// Ensures request headers read by servers are only decoded when accessed,
+// and decode to the same headers as eagerly read ones.
+func TestReadRequestHeaderLazy(t *testing.T) {
+	assert := assert.New(t)
+	frame := writeLazyRequest(t, map[string]string{"user": "alice", "trace": "t1"})
+	proto := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	ctx, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	payload, err := proto.ReadString()
+	assert.Nil(err)
+	assert.Equal("payload", payload)
+
+	impl := ctx.(*FContextImpl)
+	assert.Equal("cid", ctx.CorrelationID())
+	user, ok := ctx.RequestHeader("user")
+	assert.True(ok)
+	assert.Equal("alice", user)
+	_, ok = ctx.RequestHeader(remainingHeader)
+	assert.False(ok)
+	assert.Equal(defaultTimeout, ctx.Timeout())
+	responseOpID, _ := ctx.ResponseHeader(opIDHeader)
+	requestOpID, _ := ctx.RequestHeader(opIDHeader)
+	assert.NotEqual(responseOpID, requestOpID)
+	assert.NotNil(impl.lazyRequestHeaders)
+
+	// Headers set before the rest are decoded take precedence.
+	ctx.SetTimeout(defaultTimeout * 2)
+	headers := ctx.RequestHeaders()
+	assert.Nil(impl.lazyRequestHeaders)
+	assert.Equal(map[string]string{
+		cidHeader:     "cid",
+		opIDHeader:    requestOpID,
+		timeoutHeader: "10000",
+		"user":        "alice",
+		"trace":       "t1",
+	}, headers)
+}
+
+// Ensures peeked headers which have been decoded aren't decoded again when
+// the request header is read.
+func TestReadRequestHeaderPeekedDecoded(t *testing.T) {
+	assert := assert.New(t)
+	frame := writeLazyRequest(t, map[string]string{"user": "alice"})
+	proto := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	peeked, err := proto.peekRequestHeaders()
+	assert.Nil(err)
+	headers := peeked.decoded()
+	assert.Equal("alice", headers["user"])
+	assert.Nil(peeked.pairs)
+
+	ctx, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	assert.Equal("cid", ctx.CorrelationID())
+	user, ok := ctx.RequestHeader("user")
+	assert.True(ok)
+	assert.Equal("alice", user)
+	payload, err := proto.ReadString()
+	assert.Nil(err)
+	assert.Equal("payload", payload)
+}
+
+// Ensures header limits are enforced on lazily read headers and frames
+// aren't retained by contexts.
+func TestReadRequestHeaderLazyLimits(t *testing.T) {
+	assert := assert.New(t)
+	frame := writeLazyRequest(t, map[string]string{"user": "alice"})
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+
+	_, err := protocolFactory.WithHeaderLimits(HeaderLimits{MaxCount: 2}).
+		GetProtocol(newFrameTransport(frame[4:])).ReadRequestHeader()
+	assert.True(IsErrHeaderLimit(err))
+
+	ctx, err := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		GetProtocol(newFrameTransport(frame[4:])).ReadRequestHeader()
+	assert.Nil(err)
+	for i := range frame {
+		frame[i] = 0
+	}
+	user, _ := ctx.RequestHeader("user")
+	assert.Equal("alice", user)
+
+	_, err = protocolFactory.GetProtocol(newFrameTransport([]byte{protocolV0, 0, 0, 0, 4, 0, 0, 0, 9})).ReadRequestHeader()
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// HeaderLimits bounds the number and size of FContext headers. Limits can be
+// set on an FContext, in which case they are enforced as request headers are
+// added and written, or on an FProtocolFactory, in which case they are also
+// enforced as headers are decoded. A non-positive value means no limit.
+type HeaderLimits struct {
+	// MaxCount is the maximum number of headers, including those reserved
+	// by Frugal such as _cid and _opid, and those added as requests are
+	// written such as _remaining.
+	MaxCount int
+
+	// MaxSize is the maximum serialized size of the headers in bytes, as
+	// encoded by the header protocol. Each header costs 8 bytes plus the
+	// length of its name and value.
+	MaxSize int
+}
+
+// HeaderLimitError is returned when headers exceed the configured
+// HeaderLimits. It is a thrift.TProtocolException with type SIZE_LIMIT.
+type HeaderLimitError struct {
+	// Count is the number of headers, or 0 if the headers were rejected
+	// before they were decoded.
+	Count int
+
+	// Size is the serialized size of the headers in bytes.
+	Size int
+
+	// Limits are the limits which were exceeded.
+	Limits HeaderLimits
+}
+
+// Error returns a description of the exceeded limits.
+func (e *HeaderLimitError) Error() string {
+	return fmt.Sprintf("frugal: headers exceed limits (%d headers, max %d; %d bytes, max %d)",
+		e.Count, e.Limits.MaxCount, e.Size, e.Limits.MaxSize)
+}
+
+// TypeId returns the thrift.TProtocolException type for the error.
+func (e *HeaderLimitError) TypeId() int {
+	return thrift.SIZE_LIMIT
+}
+
+// IsErrHeaderLimit indicates if the given error is a *HeaderLimitError.
+func IsErrHeaderLimit(err error) bool {
+	_, ok := err.(*HeaderLimitError)
+	return ok
+}
+
+// SetHeaderLimits sets the limits enforced on request headers added to the
+// context. Returns the same FContext to allow for chaining calls.
+func (c *FContextImpl) SetHeaderLimits(limits HeaderLimits) FContext {
+	c.mu.Lock()
+	c.headerLimits = limits
+	c.mu.Unlock()
+	return c
+}
+
+// TryAddRequestHeader adds a request header to the context like
+// AddRequestHeader, but returns a *HeaderLimitError rather than discarding the
+// header if it would exceed the limits set on the context.
+func TryAddRequestHeader(ctx FContext, name, value string) error {
+	c, ok := ctx.(*FContextImpl)
+	if !ok {
+		ctx.AddRequestHeader(name, value)
+		return nil
+	}
+	if isProtectedRequestHeader(name) {
+		logger().Warnf("frugal: discarding write to reserved request header %s", name)
+		return nil
+	}
+	return c.tryAddRequestHeader(name, value)
+}
+
+// contextHeaderLimits returns the HeaderLimits set on the given context.
+func contextHeaderLimits(ctx FContext) HeaderLimits {
+	c, ok := ctx.(*FContextImpl)
+	if !ok {
+		return HeaderLimits{}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.headerLimits
+}
+
+// check returns a *HeaderLimitError if the headers exceed the limits.
+func (l HeaderLimits) check(headers map[string]string) error {
+	if l.MaxCount <= 0 && l.MaxSize <= 0 {
+		return nil
+	}
+	return l.checkCountAndSize(len(headers), int(v0Marshaler.calculateHeaderSize(headers)))
+}
+
+// checkAdd returns a *HeaderLimitError if setting the named header on the
+// given headers would exceed the limits.
+func (l HeaderLimits) checkAdd(headers map[string]string, name, value string) error {
+	if l.MaxCount <= 0 && l.MaxSize <= 0 {
+		return nil
+	}
+	count := len(headers)
+	size := int(v0Marshaler.calculateHeaderSize(headers)) + 8 + len(name) + len(value)
+	if existing, ok := headers[name]; ok {
+		size -= 8 + len(name) + len(existing)
+	} else {
+		count++
+	}
+	return l.checkCountAndSize(count, size)
+}
+
+func (l HeaderLimits) checkCountAndSize(count, size int) error {
+	if (l.MaxCount > 0 && count > l.MaxCount) || (l.MaxSize > 0 && size > l.MaxSize) {
+		return &HeaderLimitError{Count: count, Size: size, Limits: l}
+	}
+	return nil
+}
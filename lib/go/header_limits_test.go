@@ -0,0 +1,130 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures context header limits are enforced when adding request headers.
+func TestContextHeaderLimits(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("cid")
+	// _cid, _opid and _timeout are already set.
+	ctx.(*FContextImpl).SetHeaderLimits(HeaderLimits{MaxCount: 4})
+
+	assert.Nil(TryAddRequestHeader(ctx, "foo", "bar"))
+	err := TryAddRequestHeader(ctx, "baz", "qux")
+	assert.True(IsErrHeaderLimit(err))
+	assert.Equal(thrift.SIZE_LIMIT, err.(thrift.TProtocolException).TypeId())
+	assert.Equal(5, err.(*HeaderLimitError).Count)
+	_, ok := ctx.RequestHeader("baz")
+	assert.False(ok)
+
+	// Replacing a header does not change the count.
+	assert.Nil(TryAddRequestHeader(ctx, "foo", "baz"))
+
+	// AddRequestHeader discards headers exceeding the limit.
+	ctx.AddRequestHeader("baz", "qux")
+	_, ok = ctx.RequestHeader("baz")
+	assert.False(ok)
+	assert.False(IsErrHeaderLimit(errors.New("foo")))
+}
+
+// Ensures context header size limits account for replaced headers.
+func TestContextHeaderSizeLimits(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("cid")
+	size := int(v0Marshaler.calculateHeaderSize(ctx.RequestHeaders()))
+	ctx.(*FContextImpl).SetHeaderLimits(HeaderLimits{MaxSize: size + 8 + 6})
+
+	assert.Nil(TryAddRequestHeader(ctx, "foo", "bar"))
+	assert.True(IsErrHeaderLimit(TryAddRequestHeader(ctx, "foo", "barr")))
+	assert.Nil(TryAddRequestHeader(ctx, "foo", "ba"))
+
+	// Clones inherit the limits.
+	clone := Clone(ctx)
+	assert.True(IsErrHeaderLimit(TryAddRequestHeader(clone, "a", "b")))
+}
+
+// Ensures WriteRequestHeader rejects headers exceeding limits before writing.
+func TestWriteRequestHeaderLimits(t *testing.T) {
+	assert := assert.New(t)
+	transport := &thrift.TMemoryBuffer{Buffer: &bytes.Buffer{}}
+	factory := NewFProtocolFactory(tProtocolFactory)
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("foo", "bar")
+
+	proto := factory.WithHeaderLimits(HeaderLimits{MaxCount: 3}).GetProtocol(transport)
+	assert.True(IsErrHeaderLimit(proto.WriteRequestHeader(ctx)))
+	assert.Equal(0, transport.Len())
+
+	proto = factory.WithHeaderLimits(HeaderLimits{}).GetProtocol(transport)
+	ctx.(*FContextImpl).SetHeaderLimits(HeaderLimits{MaxCount: 3})
+	assert.True(IsErrHeaderLimit(proto.WriteRequestHeader(ctx)))
+	assert.Equal(0, transport.Len())
+}
+
+// Ensures WriteRequestHeader counts the headers added by the protocol against
+// the limits.
+func TestWriteRequestHeaderLimitsIncludeProtocolHeaders(t *testing.T) {
+	assert := assert.New(t)
+	transport := &thrift.TMemoryBuffer{Buffer: &bytes.Buffer{}}
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("foo", "bar")
+	limits := HeaderLimits{MaxCount: len(ctx.RequestHeaders())}
+
+	proto := NewFProtocolFactory(tProtocolFactory).WithHeaderLimits(limits).GetProtocol(transport)
+	err := proto.WriteRequestHeader(ctx)
+	assert.True(IsErrHeaderLimit(err))
+	assert.Equal(limits.MaxCount+1, err.(*HeaderLimitError).Count)
+	assert.Equal(0, transport.Len())
+
+	limits.MaxCount++
+	proto = NewFProtocolFactory(tProtocolFactory).WithHeaderLimits(limits).GetProtocol(transport)
+	assert.Nil(proto.WriteRequestHeader(ctx))
+}
+
+// Ensures ReadRequestHeader enforces protocol header limits when decoding.
+func TestReadRequestHeaderLimits(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("foo", strings.Repeat("a", 1024))
+	transport := &thrift.TMemoryBuffer{Buffer: &bytes.Buffer{}}
+	assert.Nil(NewFProtocolFactory(tProtocolFactory).GetProtocol(transport).WriteRequestHeader(ctx))
+	frame := transport.Bytes()
+
+	factory := NewFProtocolFactory(tProtocolFactory).WithHeaderLimits(HeaderLimits{MaxSize: 1024})
+	proto := factory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame)})
+	_, err := proto.ReadRequestHeader()
+	assert.True(IsErrHeaderLimit(err))
+	assert.Equal(0, err.(*HeaderLimitError).Count)
+
+	factory = NewFProtocolFactory(tProtocolFactory).WithHeaderLimits(HeaderLimits{MaxCount: 4})
+	proto = factory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame)})
+	_, err = proto.ReadRequestHeader()
+	assert.True(IsErrHeaderLimit(err))
+	assert.Equal(5, err.(*HeaderLimitError).Count)
+
+	factory = NewFProtocolFactory(tProtocolFactory).WithHeaderLimits(HeaderLimits{MaxCount: 5, MaxSize: 2048})
+	proto = factory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame)})
+	_, err = proto.ReadRequestHeader()
+	assert.Nil(err)
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// HealthService is the service id FSimpleServer serves the health service
+// under, and the NATS subject FNatsServer serves it on.
+const HealthService = "frugal.health"
+
+// FHealthStatus is the serving status of a service reported by the health
+// service.
+type FHealthStatus int32
+
+const (
+	// HealthUnknown is reported for services the health service doesn't
+	// know about.
+	HealthUnknown FHealthStatus = iota
+
+	// HealthServing is reported for services which are accepting requests.
+	HealthServing
+
+	// HealthNotServing is reported for services which are not accepting
+	// requests, such as while they are starting or shutting down.
+	HealthNotServing
+)
+
+// String returns the name of the status.
+func (s FHealthStatus) String() string {
+	switch s {
+	case HealthUnknown:
+		return "UNKNOWN"
+	case HealthServing:
+		return "SERVING"
+	case HealthNotServing:
+		return "NOT_SERVING"
+	}
+	return fmt.Sprintf("FHealthStatus(%d)", int32(s))
+}
+
+// FHealth is the handler interface of the health service. Check returns the
+// serving status of the service with the given name, or of the server as a
+// whole if the name is empty.
+type FHealth interface {
+	Check(ctx FContext, service string) (FHealthStatus, error)
+}
+
+// FHealthServer is an FHealth which reports the serving status set for each
+// service. The server as a whole is reported as serving until told otherwise.
+// It's safe for concurrent use, so statuses can be changed while it's being
+// served.
+type FHealthServer struct {
+	mu       sync.RWMutex
+	statuses map[string]FHealthStatus
+}
+
+// NewFHealthServer creates a new FHealthServer.
+func NewFHealthServer() *FHealthServer {
+	return &FHealthServer{statuses: map[string]FHealthStatus{"": HealthServing}}
+}
+
+// SetServingStatus sets the status reported for the service with the given
+// name, or for the server as a whole if the name is empty.
+func (h *FHealthServer) SetServingStatus(service string, status FHealthStatus) {
+	h.mu.Lock()
+	h.statuses[service] = status
+	h.mu.Unlock()
+}
+
+// Check returns the status set for the service with the given name, or
+// HealthUnknown if none has been set.
+func (h *FHealthServer) Check(ctx FContext, service string) (FHealthStatus, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.statuses[service], nil
+}
+
+// FHealthProcessor is the FProcessor of the health service.
+type FHealthProcessor struct {
+	*FBaseProcessor
+}
+
+// NewFHealthProcessor creates a new FHealthProcessor which serves the given
+// handler.
+func NewFHealthProcessor(handler FHealth, middleware ...ServiceMiddleware) *FHealthProcessor {
+	p := &FHealthProcessor{NewFBaseProcessor()}
+	p.AddToProcessorMap("check", &builtinFunction{
+		FBaseProcessorFunction: NewFBaseProcessorFunction(p.GetWriteMutex(),
+			NewMethod(handler, handler.Check, "Check", middleware)),
+		name: "check",
+		readArgs: func(iprot *FProtocol) ([]interface{}, error) {
+			service, err := readHealthCheckArgs(iprot)
+			return []interface{}{service}, err
+		},
+		writeResult: func(oprot *FProtocol, result interface{}) error {
+			return writeHealthCheckResult(oprot, result.(FHealthStatus))
+		},
+	})
+	return p
+}
+
+// FHealthClient is a client of the health service.
+type FHealthClient struct {
+	transport       FTransport
+	protocolFactory *FProtocolFactory
+	method          *Method
+	opts            []CallOption
+}
+
+// NewFHealthClient creates a new FHealthClient which calls the health
+// service with the given provider. For an FSimpleServer, the provider's
+// transport must be obtained from an FTransportMux with the HealthService
+// service id. For an FNatsServer, it must send requests on the HealthService
+// subject.
+func NewFHealthClient(provider *FServiceProvider, middleware ...ServiceMiddleware) *FHealthClient {
+	client := &FHealthClient{
+		transport:       provider.GetTransport(),
+		protocolFactory: provider.GetProtocolFactory(),
+	}
+	middleware = append(middleware, provider.GetMiddleware()...)
+	client.method = NewMethod(client, client.check, "check", middleware)
+	return client
+}
+
+// WithCallOptions returns a copy of the client which makes its calls with the
+// given options, in addition to those of the client.
+func (f *FHealthClient) WithCallOptions(opts ...CallOption) *FHealthClient {
+	client := *f
+	client.opts = append(append([]CallOption(nil), f.opts...), opts...)
+	return &client
+}
+
+// Check returns the serving status of the service with the given name, or of
+// the server as a whole if the name is empty.
+func (f *FHealthClient) Check(ctx FContext, service string) (FHealthStatus, error) {
+	ctx, finish := ApplyCallOptions(ctx, f.opts...)
+	defer finish()
+	ret := f.method.Invoke([]interface{}{ctx, service})
+	if len(ret) != 2 {
+		panic(fmt.Sprintf("Middleware returned %d arguments, expected 2", len(ret)))
+	}
+	return ret[0].(FHealthStatus), ret.Error()
+}
+
+func (f *FHealthClient) check(ctx FContext, service string) (FHealthStatus, error) {
+	status := HealthUnknown
+	err := callBuiltin(f.transport, f.protocolFactory, ctx, "check",
+		func(oprot *FProtocol) error {
+			return writeHealthCheckArgs(oprot, service)
+		},
+		func(iprot *FProtocol) (err error) {
+			status, err = readHealthCheckResult(iprot)
+			return err
+		})
+	return status, err
+}
+
+// writeHealthCheckArgs writes the arguments struct of the check method.
+func writeHealthCheckArgs(oprot *FProtocol, service string) error {
+	if err := oprot.WriteStructBegin("check_args"); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldBegin("service", thrift.STRING, 1); err != nil {
+		return err
+	}
+	if err := oprot.WriteString(service); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldEnd(); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldStop(); err != nil {
+		return err
+	}
+	return oprot.WriteStructEnd()
+}
+
+// readHealthCheckArgs reads the arguments struct of the check method,
+// returning the service name.
+func readHealthCheckArgs(iprot *FProtocol) (string, error) {
+	var service string
+	err := readStructFields(iprot, func(id int16, typeID thrift.TType) (bool, error) {
+		if id != 1 || typeID != thrift.STRING {
+			return false, nil
+		}
+		var err error
+		service, err = iprot.ReadString()
+		return true, err
+	})
+	return service, err
+}
+
+// writeHealthCheckResult writes the result struct of the check method.
+func writeHealthCheckResult(oprot *FProtocol, status FHealthStatus) error {
+	if err := oprot.WriteStructBegin("check_result"); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldBegin("success", thrift.I32, 0); err != nil {
+		return err
+	}
+	if err := oprot.WriteI32(int32(status)); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldEnd(); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldStop(); err != nil {
+		return err
+	}
+	return oprot.WriteStructEnd()
+}
+
+// readHealthCheckResult reads the result struct of the check method,
+// returning the status.
+func readHealthCheckResult(iprot *FProtocol) (FHealthStatus, error) {
+	var (
+		status FHealthStatus
+		isSet  bool
+	)
+	err := readStructFields(iprot, func(id int16, typeID thrift.TType) (bool, error) {
+		if id != 0 || typeID != thrift.I32 {
+			return false, nil
+		}
+		v, err := iprot.ReadI32()
+		status, isSet = FHealthStatus(v), true
+		return true, err
+	})
+	if err == nil && !isSet {
+		err = thrift.NewTApplicationException(APPLICATION_EXCEPTION_MISSING_RESULT,
+			"check failed: unknown result")
+	}
+	return status, err
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// lbProbes configures the health probes of an FLoadBalancedTransport.
+type lbProbes struct {
+	protocolFactory *FProtocolFactory
+	interval        time.Duration
+	timeout         time.Duration
+
+	// stop is closed to stop probing when the transport is closed. It's
+	// guarded by the FLoadBalancedTransport's lock.
+	stop chan struct{}
+}
+
+// WithHealthProbes actively probes each backend with a health check, written
+// with the given FProtocolFactory, every interval while the transport is
+// open. Backends which don't respond to a probe within the timeout, or report
+// they aren't serving, are marked unhealthy and skipped until a later probe
+// succeeds. Backends start out unhealthy until their first probe, which is
+// made as soon as the transport is opened or the backend is added, so cold or
+// half-dead backends are found before requests are routed to them. Backends
+// which don't serve the health service, and reject the probe as an unknown
+// method, count as healthy since they responded. Returns the same
+// FLoadBalancedTransport to allow for chaining calls.
+func (f *FLoadBalancedTransport) WithHealthProbes(protocolFactory *FProtocolFactory, interval, timeout time.Duration) *FLoadBalancedTransport {
+	f.probes = &lbProbes{protocolFactory: protocolFactory, interval: interval, timeout: timeout}
+	return f
+}
+
+// runProbes probes every backend each interval until stopped.
+func (f *FLoadBalancedTransport) runProbes(stop chan struct{}) {
+	ticker := time.NewTicker(f.probes.interval)
+	defer ticker.Stop()
+	for {
+		f.mu.Lock()
+		backends := append([]*lbBackend(nil), f.backends...)
+		f.mu.Unlock()
+		var wg sync.WaitGroup
+		for _, backend := range backends {
+			wg.Add(1)
+			go func(backend *lbBackend) {
+				f.probe(backend)
+				wg.Done()
+			}(backend)
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// probe checks the health of the given backend, marking it healthy or
+// unhealthy.
+func (f *FLoadBalancedTransport) probe(backend *lbBackend) {
+	client := NewFHealthClient(NewFServiceProvider(backend.transport, f.probes.protocolFactory))
+	status, err := client.Check(NewFContext("").SetTimeout(f.probes.timeout), "")
+	if ex, ok := err.(thrift.TApplicationException); ok && ex.TypeId() == APPLICATION_EXCEPTION_UNKNOWN_METHOD {
+		status, err = HealthServing, nil
+	}
+	healthy := err == nil && status == HealthServing
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if backend.unhealthy == !healthy {
+		return
+	}
+	backend.unhealthy = !healthy
+	switch {
+	case healthy:
+		logger().Infof("frugal: backend %s is healthy", backend.name)
+	case err != nil:
+		logger().Warnf("frugal: backend %s is unhealthy, probe failed: %s", backend.name, err)
+	default:
+		logger().Warnf("frugal: backend %s is unhealthy, status %s", backend.name, status)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// healthyBackends returns the names of the backends of the given transport
+// which are healthy.
+func healthyBackends(f *FLoadBalancedTransport) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for _, backend := range f.backends {
+		if !backend.unhealthy {
+			names = append(names, backend.name)
+		}
+	}
+	return names
+}
+
+// awaitHealthyBackends asserts the healthy backends of the given transport
+// become the given backends.
+func awaitHealthyBackends(t *testing.T, f *FLoadBalancedTransport, expected []string) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if assert.ObjectsAreEqual(expected, healthyBackends(f)) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, expected, healthyBackends(f))
+}
+
+// Ensures backends are probed before being routed requests, and are marked
+// unhealthy while probes fail or report they aren't serving.
+func TestLoadBalancedTransportHealthProbes(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	newBackend := func(processor FProcessor) FTransport {
+		return NewFLoopbackTransport(processor, protocolFactory)
+	}
+	serving := NewFHealthServer()
+	draining := NewFHealthServer()
+	draining.SetServingStatus("", HealthNotServing)
+	failing := &lbTestTransport{err: thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "timeout")}
+
+	transport := NewFLoadBalancedTransport(LoadBalanceRoundRobin).
+		WithHealthProbes(protocolFactory, 10*time.Millisecond, time.Second)
+	assert.Nil(transport.AddBackend("serving", newBackend(NewFHealthProcessor(serving)), 0))
+	assert.Nil(transport.AddBackend("draining", newBackend(NewFHealthProcessor(draining)), 0))
+	assert.Nil(transport.AddBackend("failing", failing, 0))
+	assert.Nil(transport.AddBackend("unimplemented", newBackend(NewFBaseProcessor()), 0))
+	assert.Empty(healthyBackends(transport))
+
+	assert.Nil(transport.Open())
+	defer transport.Close()
+	awaitHealthyBackends(t, transport, []string{"serving", "unimplemented"})
+	transport.mu.Lock()
+	candidates := transport.candidates(nil)
+	transport.mu.Unlock()
+	if assert.Len(candidates, 2) {
+		assert.Equal("serving", candidates[0].name)
+		assert.Equal("unimplemented", candidates[1].name)
+	}
+
+	draining.SetServingStatus("", HealthServing)
+	serving.SetServingStatus("", HealthNotServing)
+	awaitHealthyBackends(t, transport, []string{"draining", "unimplemented"})
+
+	// Backends added while open are probed before taking requests.
+	assert.Nil(transport.AddBackend("added", newBackend(NewFHealthProcessor(NewFHealthServer())), 0))
+	awaitHealthyBackends(t, transport, []string{"draining", "unimplemented", "added"})
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures the health service reports the status set for each service.
+func TestHealthService(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	health := NewFHealthServer()
+	health.SetServingStatus("store", HealthNotServing)
+	transport := NewFLoopbackTransport(NewFHealthProcessor(health), protocolFactory)
+	assert.Nil(transport.Open())
+	client := NewFHealthClient(NewFServiceProvider(transport, protocolFactory))
+
+	status, err := client.Check(NewFContext(""), "")
+	assert.Nil(err)
+	assert.Equal(HealthServing, status)
+	status, err = client.Check(NewFContext(""), "store")
+	assert.Nil(err)
+	assert.Equal(HealthNotServing, status)
+	status, err = client.Check(NewFContext(""), "albums")
+	assert.Nil(err)
+	assert.Equal(HealthUnknown, status)
+
+	health.SetServingStatus("store", HealthServing)
+	status, err = client.Check(NewFContext(""), "store")
+	assert.Nil(err)
+	assert.Equal(HealthServing, status)
+	assert.Equal("NOT_SERVING", HealthNotServing.String())
+}
+
+type failingHealth struct{}
+
+func (failingHealth) Check(ctx FContext, service string) (FHealthStatus, error) {
+	return HealthUnknown, errors.New("broken")
+}
+
+// Ensures errors returned by the health handler fail the check with an
+// exception.
+func TestHealthServiceError(t *testing.T) {
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFLoopbackTransport(NewFHealthProcessor(failingHealth{}), protocolFactory)
+	assert.Nil(t, transport.Open())
+	client := NewFHealthClient(NewFServiceProvider(transport, protocolFactory))
+
+	_, err := client.Check(NewFContext(""), "")
+	ex, ok := err.(thrift.TApplicationException)
+	if assert.True(t, ok) {
+		assert.Equal(t, int32(APPLICATION_EXCEPTION_INTERNAL_ERROR), ex.TypeId())
+	}
+}
+
+// Ensures FSimpleServer serves the health service alongside its processor.
+func TestSimpleServerHealthService(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	serverTr, err := thrift.NewTServerSocket("localhost:5536")
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := NewFHealthServer()
+	health.SetServingStatus("store", HealthServing)
+	server := NewFSimpleServer(&serviceProcessor{name: "store"}, serverTr, protocolFactory).
+		WithHealthService(health)
+	go server.Serve()
+	defer server.Stop()
+	time.Sleep(10 * time.Millisecond)
+
+	socket, err := thrift.NewTSocket("localhost:5536")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := NewAdapterTransportFactory().GetTransport(socket)
+	mux := NewFTransportMux(shared)
+	transport := mux.Transport(HealthService)
+	assert.Nil(transport.Open())
+	defer transport.Close()
+	client := NewFHealthClient(NewFServiceProvider(transport, protocolFactory))
+
+	status, err := client.Check(NewFContext(""), "store")
+	assert.Nil(err)
+	assert.Equal(HealthServing, status)
+
+	// Requests without a service id still reach the server's processor.
+	ctx := NewFContext("cid")
+	result, err := shared.Request(ctx, newServiceMuxRequest(t, ctx, ""))
+	if !assert.Nil(err) {
+		return
+	}
+	proto := protocolFactory.GetProtocol(result)
+	assert.Nil(proto.ReadResponseHeader(NewFContext("")))
+	name, err := proto.ReadString()
+	assert.Nil(err)
+	assert.Equal("store", name)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// WithHedging hedges requests marked with SetIdempotent to reduce tail
+// latency: if a request's backend hasn't responded after the given delay, the
+// request is also sent to another backend. The first successful response is
+// returned and the other request is cancelled. Requests which fail before the
+// delay elapses aren't hedged. Returns the same FLoadBalancedTransport to
+// allow for chaining calls.
+func (f *FLoadBalancedTransport) WithHedging(delay time.Duration) *FLoadBalancedTransport {
+	f.hedgeDelay = delay
+	return f
+}
+
+// hedgeResult is the outcome of one of the requests made for a hedged
+// request.
+type hedgeResult struct {
+	attempt  *hedgeContext
+	response thrift.TTransport
+	err      error
+}
+
+// hedgedRequest sends the given request to a backend, and to a second
+// backend if the first hasn't responded within the hedging delay, returning
+// the first successful response, or the last error if both fail.
+func (f *FLoadBalancedTransport) hedgedRequest(ctx FContext, data []byte) (thrift.TTransport, error) {
+	primary, err := f.acquire(nil)
+	if err != nil {
+		return nil, err
+	}
+	resultC := make(chan hedgeResult, 2)
+	attempts := []*hedgeContext{f.sendHedge(primary, ctx, data, resultC)}
+	var winner *hedgeContext
+	defer func() {
+		for _, attempt := range attempts {
+			if attempt != winner {
+				attempt.cancel()
+			}
+		}
+	}()
+
+	timer := time.NewTimer(f.hedgeDelay)
+	defer timer.Stop()
+	pending := 1
+	for {
+		select {
+		case <-timer.C:
+			backend, err := f.acquire(primary)
+			if err != nil {
+				// There is no other backend to hedge with.
+				continue
+			}
+			logger().Debugf("frugal: hedging request with correlation id %s on backend %s after %s",
+				ctx.CorrelationID(), backend.name, f.hedgeDelay)
+			attempts = append(attempts, f.sendHedge(backend, ctx, data, resultC))
+			pending++
+		case result := <-resultC:
+			pending--
+			if result.err == nil || pending == 0 {
+				// The response may still depend on the winning request's
+				// context, so it isn't cancelled.
+				winner = result.attempt
+				return result.response, result.err
+			}
+		}
+	}
+}
+
+// sendHedge sends the given request to the given backend in a goroutine,
+// returning the context to cancel it with. The outcome is sent on the given
+// channel.
+func (f *FLoadBalancedTransport) sendHedge(backend *lbBackend, ctx FContext, data []byte,
+	resultC chan<- hedgeResult) *hedgeContext {
+	attempt := newHedgeContext(ctx)
+	go func() {
+		response, err := backend.transport.Request(attempt, data)
+		attempt.finish()
+		f.release(backend, err)
+		resultC <- hedgeResult{attempt: attempt, response: response, err: err}
+	}()
+	return attempt
+}
+
+// hedgeContext is the FContext of one of the requests made for a hedged
+// request. It shares everything with the caller's FContext, including the
+// opid the request was written with, but can be cancelled on its own, so the
+// losing request can be abandoned without cancelling the caller's context.
+type hedgeContext struct {
+	FContext
+	done     chan struct{}
+	finished chan struct{}
+	once     sync.Once
+}
+
+func newHedgeContext(ctx FContext) *hedgeContext {
+	h := &hedgeContext{FContext: ctx, done: make(chan struct{}), finished: make(chan struct{})}
+	go func() {
+		select {
+		case <-contextDone(ctx):
+			h.cancel()
+		case <-h.done:
+		case <-h.finished:
+		}
+	}()
+	return h
+}
+
+// Done returns a channel which is closed when the request is cancelled,
+// either because the caller's FContext was or because it lost the hedge.
+func (h *hedgeContext) Done() <-chan struct{} {
+	return h.done
+}
+
+func (h *hedgeContext) cancel() {
+	h.once.Do(func() { close(h.done) })
+}
+
+// finish stops following the caller's FContext once the request has
+// completed. It must be called exactly once.
+func (h *hedgeContext) finish() {
+	close(h.finished)
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// delayedTransport is an FTransport which responds with its name after its
+// delay, unless the request is cancelled first.
+type delayedTransport struct {
+	lbTestTransport
+	name      string
+	delay     time.Duration
+	cancelled chan struct{}
+}
+
+func newDelayedTransport(name string, delay time.Duration) *delayedTransport {
+	return &delayedTransport{name: name, delay: delay, cancelled: make(chan struct{}, 1)}
+}
+
+func (d *delayedTransport) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	d.lbTestTransport.Request(ctx, payload)
+	select {
+	case <-time.After(d.delay):
+		buffer := thrift.NewTMemoryBuffer()
+		buffer.WriteString(d.name)
+		return buffer, nil
+	case <-contextDone(ctx):
+		d.cancelled <- struct{}{}
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_CANCELLED, "cancelled")
+	}
+}
+
+func hedgingTransport(t *testing.T, backends ...*delayedTransport) *FLoadBalancedTransport {
+	transport := NewFLoadBalancedTransport(LoadBalanceRoundRobin).WithHedging(10 * time.Millisecond)
+	for _, backend := range backends {
+		assert.Nil(t, transport.AddBackend(backend.name, backend, 0))
+	}
+	assert.Nil(t, transport.Open())
+	return transport
+}
+
+// Ensures idempotent requests which haven't been responded to within the
+// hedging delay are sent to another backend, whose response is returned, and
+// the slow request is cancelled.
+func TestHedgedRequest(t *testing.T) {
+	assert := assert.New(t)
+	slow, fast := newDelayedTransport("slow", time.Second), newDelayedTransport("fast", 0)
+	// Round robin starts with the second backend.
+	transport := hedgingTransport(t, fast, slow)
+	ctx := NewFContext("")
+	SetIdempotent(ctx)
+
+	response, err := transport.Request(ctx, nil)
+	assert.Nil(err)
+	assert.Equal("fast", response.(*thrift.TMemoryBuffer).String())
+	assert.Equal(1, slow.requestCount())
+	assert.Equal(1, fast.requestCount())
+	select {
+	case <-slow.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected slow request to be cancelled")
+	}
+}
+
+// Ensures requests which respond within the hedging delay, or aren't
+// idempotent, aren't hedged.
+func TestHedgedRequestNotHedged(t *testing.T) {
+	assert := assert.New(t)
+	slow, fast := newDelayedTransport("slow", 20*time.Millisecond), newDelayedTransport("fast", 0)
+	transport := hedgingTransport(t, slow, fast)
+	ctx := NewFContext("")
+	SetIdempotent(ctx)
+
+	response, err := transport.Request(ctx, nil)
+	assert.Nil(err)
+	assert.Equal("fast", response.(*thrift.TMemoryBuffer).String())
+	assert.Equal(0, slow.requestCount())
+
+	response, err = transport.Request(NewFContext(""), nil)
+	assert.Nil(err)
+	assert.Equal("slow", response.(*thrift.TMemoryBuffer).String())
+	assert.Equal(1, fast.requestCount())
+}
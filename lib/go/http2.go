@@ -0,0 +1,51 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// NewFHTTP2Client returns an http.Client for use with
+// NewFHTTPTransportBuilder which sends requests over HTTP/2, multiplexing
+// concurrent requests to a server over a single connection. Requests to https
+// URLs negotiate HTTP/2 over TLS using the given configuration, or the
+// default configuration if nil. Requests to http URLs use unencrypted HTTP/2
+// (h2c) with prior knowledge, so the server must accept h2c, such as one
+// configured with ConfigureHTTP2Server.
+func NewFHTTP2Client(tlsConfig *tls.Config) *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ForceAttemptHTTP2 = true
+	transport.Protocols = protocols
+	return &http.Client{Transport: transport}
+}
+
+// ConfigureHTTP2Server enables HTTP/2 on the given server serving a Frugal
+// handler, accepting unencrypted HTTP/2 (h2c) connections as well as HTTP/2
+// over TLS so internal clients can multiplex requests without TLS. HTTP/1.1
+// remains enabled for existing clients. Returns the same server to allow for
+// chaining calls.
+func ConfigureHTTP2Server(server *http.Server) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server.Protocols = protocols
+	return server
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures an HTTP/2 client multiplexes requests to an h2c server over a
+// single connection.
+func TestHTTP2Transport(t *testing.T) {
+	assert := assert.New(t)
+	response := prependFrameSize([]byte("response"))
+	var (
+		mu      sync.Mutex
+		protos  = make(map[int]int)
+		remotes = make(map[string]bool)
+	)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		protos[r.ProtoMajor]++
+		remotes[r.RemoteAddr] = true
+		mu.Unlock()
+		w.Write([]byte(base64.StdEncoding.EncodeToString(response)))
+	}))
+	ConfigureHTTP2Server(ts.Config)
+	ts.Start()
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(NewFHTTP2Client(nil), ts.URL).Build()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := transport.Request(NewFContext(""), prependFrameSize([]byte("request")))
+			if assert.Nil(err) {
+				buf := new(bytes.Buffer)
+				buf.ReadFrom(result)
+				assert.Equal("response", buf.String())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(map[int]int{2: 10}, protos)
+	assert.Equal(1, len(remotes))
+}
+
+// Ensures HTTP/1.1 clients can still reach an HTTP/2 server.
+func TestHTTP2ServerAcceptsHTTP1(t *testing.T) {
+	assert := assert.New(t)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(1, r.ProtoMajor)
+		w.Write([]byte(base64.StdEncoding.EncodeToString(prependFrameSize([]byte("response")))))
+	}))
+	ConfigureHTTP2Server(ts.Config)
+	ts.Start()
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).Build()
+	_, err := transport.Request(NewFContext(""), prependFrameSize([]byte("request")))
+	assert.Nil(err)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import "net/http"
+
+const wwwAuthenticateHeader = "WWW-Authenticate"
+
+// FHTTPAuthenticator authenticates requests to a Frugal HTTP handler before
+// their bodies are read, so unauthenticated requests are rejected without
+// decoding their payloads. It returns nil to allow the request, or an error
+// to reject it. Requests are rejected with the status code of an
+// *FHTTPAuthError, or a 401 for any other error.
+type FHTTPAuthenticator func(*http.Request) error
+
+// FHTTPAuthError rejects a request from an FHTTPAuthenticator.
+type FHTTPAuthError struct {
+	// StatusCode is the status code of the response, typically
+	// http.StatusUnauthorized or http.StatusForbidden.
+	StatusCode int
+
+	// Message is the body of the response.
+	Message string
+
+	// Challenge, if set, is sent in the WWW-Authenticate header of 401
+	// responses, such as `Bearer realm="example"`.
+	Challenge string
+}
+
+// NewHTTPUnauthorizedError returns an FHTTPAuthError rejecting a request
+// with a 401, used when the request has missing or invalid credentials.
+func NewHTTPUnauthorizedError(message, challenge string) *FHTTPAuthError {
+	return &FHTTPAuthError{StatusCode: http.StatusUnauthorized, Message: message, Challenge: challenge}
+}
+
+// NewHTTPForbiddenError returns an FHTTPAuthError rejecting a request with a
+// 403, used when the request's credentials don't grant access.
+func NewHTTPForbiddenError(message string) *FHTTPAuthError {
+	return &FHTTPAuthError{StatusCode: http.StatusForbidden, Message: message}
+}
+
+func (e *FHTTPAuthError) Error() string {
+	return e.Message
+}
+
+// WithAuthenticator authenticates each request with the given
+// FHTTPAuthenticator before reading its body. CORS preflight requests aren't
+// authenticated, as browsers don't send credentials with them.
+func WithAuthenticator(authenticator FHTTPAuthenticator) FHTTPHandlerOption {
+	return func(o *httpHandlerOptions) {
+		o.authenticator = authenticator
+	}
+}
+
+// authenticateHTTP returns a handler which calls the given handler for
+// requests the authenticator allows.
+func authenticateHTTP(handler http.HandlerFunc, authenticator FHTTPAuthenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := authenticator(r)
+		if err == nil {
+			handler(w, r)
+			return
+		}
+
+		authErr, ok := err.(*FHTTPAuthError)
+		if !ok {
+			authErr = NewHTTPUnauthorizedError(err.Error(), "")
+		}
+		if authErr.StatusCode == http.StatusUnauthorized && authErr.Challenge != "" {
+			w.Header().Set(wwwAuthenticateHeader, authErr.Challenge)
+		}
+		message := authErr.Message
+		if message == "" {
+			message = http.StatusText(authErr.StatusCode)
+		}
+		http.Error(w, message, authErr.StatusCode)
+	}
+}
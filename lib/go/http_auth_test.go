@@ -0,0 +1,120 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// unreadBody fails the test if the request body is read.
+type unreadBody struct {
+	t *testing.T
+}
+
+func (b unreadBody) Read([]byte) (int, error) {
+	b.t.Error("Expected request body not to be read")
+	return 0, errors.New("body read")
+}
+
+func newAuthRequest(t *testing.T, token string, body []byte) *http.Request {
+	encoded := base64.StdEncoding.EncodeToString(prependFrameSize(body))
+	r, err := http.NewRequest("POST", "/frugal", strings.NewReader(encoded))
+	assert.Nil(t, err)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+// Ensures requests are rejected by the authenticator before their bodies are
+// read, and allowed requests are processed.
+func TestFrugalHandlerFuncAuthenticator(t *testing.T) {
+	assert := assert.New(t)
+	authenticator := func(r *http.Request) error {
+		switch r.Header.Get("Authorization") {
+		case "":
+			return NewHTTPUnauthorizedError("missing token", `Bearer realm="frugal"`)
+		case "Bearer valid":
+			return nil
+		case "Bearer readonly":
+			return NewHTTPForbiddenError("")
+		default:
+			return errors.New("invalid token")
+		}
+	}
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := NewFrugalHandlerFunc(&mockFProcessorForHTTP{response: []byte("ok")}, protocolFactory,
+		WithAuthenticator(authenticator))
+
+	r := newAuthRequest(t, "", nil)
+	r.Body = ioutil.NopCloser(unreadBody{t})
+	w := httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Equal(`Bearer realm="frugal"`, w.Header().Get(wwwAuthenticateHeader))
+	assert.Equal("missing token\n", w.Body.String())
+
+	r = newAuthRequest(t, "readonly", nil)
+	r.Body = ioutil.NopCloser(unreadBody{t})
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.Equal("Forbidden\n", w.Body.String())
+
+	r = newAuthRequest(t, "expired", nil)
+	r.Body = ioutil.NopCloser(unreadBody{t})
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Equal("", w.Header().Get(wwwAuthenticateHeader))
+
+	w = httptest.NewRecorder()
+	handler(w, newAuthRequest(t, "valid", []byte("request")))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(base64.StdEncoding.EncodeToString(prependFrameSize([]byte("ok"))), w.Body.String())
+}
+
+// Ensures CORS preflight requests aren't authenticated, while rejections
+// carry the CORS headers browsers need to read them.
+func TestFrugalHandlerFuncAuthenticatorCORS(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := NewFrugalHandlerFunc(&mockFProcessorForHTTP{}, protocolFactory,
+		WithCORS(FHTTPCORSConfig{AllowedOrigins: []string{"*"}}),
+		WithAuthenticator(func(*http.Request) error { return NewHTTPForbiddenError("denied") }))
+
+	r, err := http.NewRequest("OPTIONS", "/frugal", nil)
+	assert.Nil(err)
+	r.Header.Set(originHeader, "https://app.example.com")
+	r.Header.Set(requestMethodHeader, "POST")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(http.StatusNoContent, w.Code)
+
+	r = newAuthRequest(t, "", nil)
+	r.Header.Set(originHeader, "https://app.example.com")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.Equal(corsWildcardOrigin, w.Header().Get(allowOriginHeader))
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+)
+
+const (
+	contentEncodingHeader = "content-encoding"
+	acceptEncodingHeader  = "accept-encoding"
+	varyHeader            = "vary"
+
+	gzipEncoding = "gzip"
+)
+
+// WithResponseCompression gzip compresses responses of at least the given
+// number of encoded bytes for clients which accept gzip encoding, such as
+// clients built with FHTTPTransportBuilder.WithCompression. Smaller responses
+// are sent uncompressed since compressing them saves little. Streamed
+// responses are not compressed. Handlers always accept gzip compressed
+// requests.
+func WithResponseCompression(threshold uint) FHTTPHandlerOption {
+	return func(o *httpHandlerOptions) {
+		o.compress = true
+		o.compressionThreshold = int(threshold)
+	}
+}
+
+// acceptsGzip indicates if the given Accept-Encoding header value includes
+// gzip with a non-zero quality.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, encoding := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(encoding, ";")
+		if !strings.EqualFold(strings.TrimSpace(parts[0]), gzipEncoding) {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipBytes returns the given data gzip compressed.
+func gzipBytes(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writer := gzip.NewWriter(buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
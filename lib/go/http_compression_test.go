@@ -0,0 +1,78 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures gzip is only accepted when listed with a non-zero quality.
+func TestAcceptsGzip(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(acceptsGzip("gzip"))
+	assert.True(acceptsGzip("deflate, GZIP;q=0.5"))
+	assert.False(acceptsGzip(""))
+	assert.False(acceptsGzip("deflate, br"))
+	assert.False(acceptsGzip("gzip;q=0"))
+	assert.False(acceptsGzip("gzip; q=0.000"))
+}
+
+// Ensures requests and responses over the compression threshold are gzip
+// compressed and smaller payloads are not.
+func TestHTTPTransportCompression(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	for size, expectCompressed := range map[int]bool{10: false, 4096: true} {
+		payload := bytes.Repeat([]byte{'a'}, size)
+		processor := &mockFProcessorForHTTP{expectedPayload: payload, response: payload}
+		handler := NewFrugalHandlerFunc(processor, protocolFactory, WithResponseCompression(1024))
+		var requestEncoding, responseEncoding string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestEncoding = r.Header.Get(contentEncodingHeader)
+			handler(w, r)
+			responseEncoding = w.Header().Get(contentEncodingHeader)
+		}))
+
+		transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).WithCompression(1024).Build()
+		result, err := transport.Request(NewFContext(""), prependFrameSize(payload))
+		assert.Nil(err)
+		assert.Equal(payload, result.(*thrift.TMemoryBuffer).Bytes())
+		assert.Equal(expectCompressed, requestEncoding == gzipEncoding)
+		assert.Equal(expectCompressed, responseEncoding == gzipEncoding)
+		ts.Close()
+	}
+}
+
+// Ensures handlers don't compress responses for clients which don't accept
+// gzip.
+func TestFrugalHandlerFuncNoCompression(t *testing.T) {
+	assert := assert.New(t)
+	payload := bytes.Repeat([]byte{'a'}, 4096)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	processor := &mockFProcessorForHTTP{response: payload}
+	ts := httptest.NewServer(NewFrugalHandlerFunc(processor, protocolFactory, WithResponseCompression(0)))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	transport := NewFHTTPTransportBuilder(client, ts.URL).Build()
+	result, err := transport.Request(NewFContext(""), prependFrameSize([]byte{1, 2, 3}))
+	assert.Nil(err)
+	assert.Equal(payload, result.(*thrift.TMemoryBuffer).Bytes())
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	originHeader                 = "Origin"
+	allowOriginHeader            = "Access-Control-Allow-Origin"
+	allowCredentialsHeader       = "Access-Control-Allow-Credentials"
+	allowMethodsHeader           = "Access-Control-Allow-Methods"
+	allowHeadersHeader           = "Access-Control-Allow-Headers"
+	exposeHeadersHeader          = "Access-Control-Expose-Headers"
+	maxAgeHeader                 = "Access-Control-Max-Age"
+	requestMethodHeader          = "Access-Control-Request-Method"
+	corsAllowedMethods           = "POST, OPTIONS"
+	corsWildcardOrigin           = "*"
+	defaultCORSPreflightDuration = 10 * time.Minute
+)
+
+// corsRequestHeaders are the request headers sent by Frugal clients, which
+// are always allowed.
+var corsRequestHeaders = []string{
+	contentTypeHeader,
+	acceptHeader,
+	contentTransferEncodingHeader,
+	contentEncodingHeader,
+	payloadLimitHeader,
+	streamHeader,
+}
+
+// corsResponseHeaders are the response headers read by Frugal clients, which
+// are always exposed.
+var corsResponseHeaders = []string{
+	contentTransferEncodingHeader,
+	contentEncodingHeader,
+	payloadLimitHeader,
+	requestSizeLimitHeader,
+	streamHeader,
+}
+
+// FHTTPCORSConfig configures cross-origin resource sharing for Frugal HTTP
+// handlers, so browser clients on other origins can call them. The headers
+// Frugal clients send and read are always allowed and exposed.
+type FHTTPCORSConfig struct {
+	// AllowedOrigins are the origins allowed to make requests, such as
+	// "https://app.example.com". "*" allows any origin.
+	AllowedOrigins []string
+
+	// AllowedHeaders are request headers allowed in addition to those sent
+	// by Frugal clients, such as "Authorization".
+	AllowedHeaders []string
+
+	// ExposedHeaders are response headers exposed to clients in addition to
+	// those read by Frugal clients.
+	ExposedHeaders []string
+
+	// AllowCredentials allows requests to include cookies and HTTP
+	// authentication.
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache preflight responses. Defaults to
+	// 10 minutes.
+	MaxAge time.Duration
+}
+
+// WithCORS enables cross-origin requests from browsers according to the given
+// configuration. Preflight requests are answered by the handler without
+// invoking the FProcessor, and requests from origins which aren't allowed are
+// rejected with a 403.
+func WithCORS(config FHTTPCORSConfig) FHTTPHandlerOption {
+	return func(o *httpHandlerOptions) {
+		o.cors = &config
+	}
+}
+
+// allowsOrigin indicates if requests from the given origin are allowed.
+func (c *FHTTPCORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == corsWildcardOrigin || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// handler returns a handler which applies the CORS configuration before
+// calling the given handler for requests which aren't preflights.
+func (c *FHTTPCORSConfig) handler(next http.HandlerFunc) http.HandlerFunc {
+	allowHeaders := strings.Join(append(append([]string{}, corsRequestHeaders...), c.AllowedHeaders...), ", ")
+	exposeHeaders := strings.Join(append(append([]string{}, corsResponseHeaders...), c.ExposedHeaders...), ", ")
+	maxAge := c.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultCORSPreflightDuration
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get(originHeader)
+		if origin == "" {
+			next(w, r)
+			return
+		}
+		w.Header().Add(varyHeader, originHeader)
+		if !c.allowsOrigin(origin) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		if c.AllowCredentials || !c.allowsAnyOrigin() {
+			w.Header().Set(allowOriginHeader, origin)
+		} else {
+			w.Header().Set(allowOriginHeader, corsWildcardOrigin)
+		}
+		if c.AllowCredentials {
+			w.Header().Set(allowCredentialsHeader, "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get(requestMethodHeader) != "" {
+			w.Header().Set(allowMethodsHeader, corsAllowedMethods)
+			w.Header().Set(allowHeadersHeader, allowHeaders)
+			w.Header().Set(maxAgeHeader, strconv.Itoa(int(maxAge/time.Second)))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set(exposeHeadersHeader, exposeHeaders)
+		next(w, r)
+	}
+}
+
+// allowsAnyOrigin indicates if the wildcard origin is allowed.
+func (c *FHTTPCORSConfig) allowsAnyOrigin() bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == corsWildcardOrigin {
+			return true
+		}
+	}
+	return false
+}
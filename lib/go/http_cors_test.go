@@ -0,0 +1,91 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCORSHandler(config FHTTPCORSConfig) http.HandlerFunc {
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	return NewFrugalHandlerFunc(&mockFProcessorForHTTP{response: []byte("ok")}, protocolFactory, WithCORS(config))
+}
+
+// Ensures preflight requests from allowed origins are answered with the
+// Frugal headers allowed.
+func TestFrugalHandlerFuncCORSPreflight(t *testing.T) {
+	assert := assert.New(t)
+	handler := newCORSHandler(FHTTPCORSConfig{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedHeaders: []string{"Authorization"},
+	})
+	r, err := http.NewRequest("OPTIONS", "/frugal", nil)
+	assert.Nil(err)
+	r.Header.Set(originHeader, "https://app.example.com")
+	r.Header.Set(requestMethodHeader, "POST")
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	assert.Equal(http.StatusNoContent, w.Code)
+	assert.Equal("https://app.example.com", w.Header().Get(allowOriginHeader))
+	assert.Equal(corsAllowedMethods, w.Header().Get(allowMethodsHeader))
+	assert.Contains(w.Header().Get(allowHeadersHeader), payloadLimitHeader)
+	assert.Contains(w.Header().Get(allowHeadersHeader), "Authorization")
+	assert.Equal("600", w.Header().Get(maxAgeHeader))
+}
+
+// Ensures requests from allowed origins are processed with the Frugal
+// response headers exposed, and requests from other origins are rejected.
+func TestFrugalHandlerFuncCORS(t *testing.T) {
+	assert := assert.New(t)
+	handler := newCORSHandler(FHTTPCORSConfig{AllowedOrigins: []string{"*"}})
+	newRequest := func(origin string) *http.Request {
+		body := base64.StdEncoding.EncodeToString(prependFrameSize([]byte("request")))
+		r, err := http.NewRequest("POST", "/frugal", strings.NewReader(body))
+		assert.Nil(err)
+		if origin != "" {
+			r.Header.Set(originHeader, origin)
+		}
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, newRequest("https://other.example.com"))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("*", w.Header().Get(allowOriginHeader))
+	assert.Contains(w.Header().Get(exposeHeadersHeader), payloadLimitHeader)
+
+	w = httptest.NewRecorder()
+	handler(w, newRequest(""))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("", w.Header().Get(allowOriginHeader))
+
+	handler = newCORSHandler(FHTTPCORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true})
+	w = httptest.NewRecorder()
+	handler(w, newRequest("https://app.example.com"))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("https://app.example.com", w.Header().Get(allowOriginHeader))
+	assert.Equal("true", w.Header().Get(allowCredentialsHeader))
+
+	w = httptest.NewRecorder()
+	handler(w, newRequest("https://evil.example.com"))
+	assert.Equal(http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"net/http"
+)
+
+// FHTTPHeaderMapping maps FContext header names to the HTTP header names they
+// are copied to and from, so infrastructure which only speaks HTTP headers,
+// such as authentication proxies and tracing sidecars, can read and set
+// FContext headers. Values received in HTTP headers take precedence over
+// those in the frame. The op id header is never mapped since it is used to
+// match responses to requests.
+type FHTTPHeaderMapping map[string]string
+
+// WithHTTPHeaderMapping copies mapped HTTP request headers into the FContext
+// request headers of requests, and mapped FContext response headers into the
+// HTTP response headers. Response headers are not copied for streamed
+// responses since the HTTP headers are sent before the response is written.
+func WithHTTPHeaderMapping(mapping FHTTPHeaderMapping) FHTTPHandlerOption {
+	return func(o *httpHandlerOptions) {
+		o.headerMapping = mapping
+	}
+}
+
+// toHTTP copies the mapped FContext headers to the given HTTP headers.
+func (m FHTTPHeaderMapping) toHTTP(headers map[string]string, dst http.Header) {
+	for name, httpName := range m {
+		if name == opIDHeader {
+			continue
+		}
+		if value, ok := headers[name]; ok {
+			dst.Set(httpName, value)
+		}
+	}
+}
+
+// fromHTTP returns the FContext headers mapped from the given HTTP headers.
+func (m FHTTPHeaderMapping) fromHTTP(src http.Header) map[string]string {
+	headers := make(map[string]string)
+	for name, httpName := range m {
+		if name == opIDHeader {
+			continue
+		}
+		if values, ok := src[http.CanonicalHeaderKey(httpName)]; ok && len(values) > 0 {
+			headers[name] = values[0]
+		}
+	}
+	return headers
+}
+
+// addToFrame returns the given frame, including its frame size, with the
+// FContext headers mapped from the given HTTP headers added.
+func (m FHTTPHeaderMapping) addToFrame(frame []byte, src http.Header) ([]byte, error) {
+	headers := m.fromHTTP(src)
+	if len(headers) == 0 {
+		return frame, nil
+	}
+	return v0Marshaler.addHeadersToFrame(frame, headers)
+}
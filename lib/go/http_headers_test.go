@@ -0,0 +1,78 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// headerProcessor responds with the "user" request header and sets a "trace"
+// response header.
+type headerProcessor struct {
+	processor
+}
+
+func (p *headerProcessor) Process(in, out *FProtocol) error {
+	ctx, err := in.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	user, _ := ctx.RequestHeader("user")
+	ctx.AddResponseHeader("trace", "t1")
+	out.WriteResponseHeader(ctx)
+	out.WriteString(user)
+	return out.Flush()
+}
+
+// Ensures mapped headers are copied between FContexts and HTTP headers on
+// both the client and the handler.
+func TestHTTPHeaderMapping(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := NewFrugalHandlerFunc(&headerProcessor{}, protocolFactory,
+		WithHTTPHeaderMapping(FHTTPHeaderMapping{"user": "X-User", "trace": "X-Trace", opIDHeader: "X-Op"}))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("cid", r.Header.Get("X-Request-Id"))
+		assert.Equal("", r.Header.Get("X-Op"))
+		// Simulate an authentication proxy setting the user.
+		r.Header.Set("X-User", "alice")
+		handler(w, r)
+		assert.Equal("t1", w.Header().Get("X-Trace"))
+	}))
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).
+		WithHeaderMapping(FHTTPHeaderMapping{cidHeader: "X-Request-Id", "span": "X-Trace", opIDHeader: "X-Op"}).
+		Build()
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("user", "mallory")
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protocolFactory.GetProtocol(buffer)
+	proto.WriteRequestHeader(ctx)
+	result, err := transport.Request(ctx, buffer.Bytes())
+	assert.Nil(err)
+
+	resultProto := protocolFactory.GetProtocol(result)
+	assert.Nil(resultProto.ReadResponseHeader(ctx))
+	user, err := resultProto.ReadString()
+	assert.Nil(err)
+	assert.Equal("alice", user)
+	span, _ := ctx.ResponseHeader("span")
+	assert.Equal("t1", span)
+}
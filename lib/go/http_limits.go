@@ -0,0 +1,73 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// requestTooLargeError is returned for requests a handler rejected for
+// exceeding its request size limit.
+type requestTooLargeError struct {
+	thrift.TTransportException
+	limit uint
+}
+
+// ServerRequestSizeLimit returns the request size limit reported by the
+// server which rejected a request with the given error, so callers can adapt
+// their requests, such as by splitting them up. The ok result is false if the
+// error was not caused by the server's request size limit.
+func ServerRequestSizeLimit(err error) (limit uint, ok bool) {
+	if e, ok := err.(*requestTooLargeError); ok {
+		return e.limit, true
+	}
+	return 0, false
+}
+
+// rejectRequestTooLarge responds to a request with a frame of the given size
+// which exceeds the given limit. The response is a Frugal response failing
+// with an APPLICATION_EXCEPTION_REQUEST_TOO_LARGE TApplicationException if
+// the request headers and method can be read from the given protocol, and a
+// plain error message otherwise.
+func rejectRequestTooLarge(w http.ResponseWriter, iprot *FProtocol, protocolFactory *FProtocolFactory,
+	size uint32, limit uint) {
+	message := fmt.Sprintf("Request size (%d) larger than limit (%d)", size, limit)
+	w.Header().Set(requestSizeLimitHeader, strconv.FormatUint(uint64(limit), 10))
+
+	ctx, err := iprot.ReadRequestHeader()
+	if err != nil {
+		http.Error(w, message, http.StatusRequestEntityTooLarge)
+		return
+	}
+	name, _, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		http.Error(w, message, http.StatusRequestEntityTooLarge)
+		return
+	}
+	output := NewTMemoryOutputBuffer(0)
+	ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_REQUEST_TOO_LARGE, message)
+	if err := writeExceptionResponse(protocolFactory.GetProtocol(output), ctx, name, ex); err != nil {
+		http.Error(w, message, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.Header().Add(contentTransferEncodingHeader, base64Encoding)
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte(base64.StdEncoding.EncodeToString(output.Bytes())))
+}
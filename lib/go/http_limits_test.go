@@ -0,0 +1,91 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// newLimitedRequest returns a framed request for the "ping" method with a
+// payload of the given size.
+func newLimitedRequest(protocolFactory *FProtocolFactory, ctx FContext, size int) []byte {
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protocolFactory.GetProtocol(buffer)
+	proto.WriteRequestHeader(ctx)
+	proto.WriteMessageBegin("ping", thrift.CALL, 0)
+	proto.WriteBinary(make([]byte, size))
+	return buffer.Bytes()
+}
+
+// Ensures handlers reject requests over their size limit with a Frugal
+// response carrying the limit.
+func TestFrugalHandlerFuncRequestSizeLimit(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := NewFrugalHandlerFunc(&mockFProcessorForHTTP{}, protocolFactory, WithHandlerRequestSizeLimit(100))
+
+	ctx := NewFContext("cid")
+	request := newLimitedRequest(protocolFactory, ctx, 200)
+	r, err := http.NewRequest("POST", "/frugal", strings.NewReader(base64.StdEncoding.EncodeToString(request)))
+	assert.Nil(err)
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal("100", w.Header().Get(requestSizeLimitHeader))
+	response, err := base64.StdEncoding.DecodeString(w.Body.String())
+	assert.Nil(err)
+	proto := protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(response[4:])})
+	assert.Nil(proto.ReadResponseHeader(ctx))
+	name, typeID, _, err := proto.ReadMessageBegin()
+	assert.Nil(err)
+	assert.Equal("ping", name)
+	assert.Equal(thrift.EXCEPTION, typeID)
+	ex, err := thrift.NewTApplicationException(0, "").Read(proto)
+	assert.Nil(err)
+	assert.Equal(int32(APPLICATION_EXCEPTION_REQUEST_TOO_LARGE), ex.TypeId())
+}
+
+// Ensures the HTTP transport returns requests rejected for exceeding the
+// handler's size limit as too large, exposing the limit.
+func TestHTTPTransportServerRequestSizeLimit(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	processor := &mockFProcessorForHTTP{response: []byte("ok")}
+	ts := httptest.NewServer(NewFrugalHandlerFunc(processor, protocolFactory, WithHandlerRequestSizeLimit(300)))
+	defer ts.Close()
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).Build()
+
+	ctx := NewFContext("")
+	_, err := transport.Request(ctx, newLimitedRequest(protocolFactory, ctx, 10))
+	assert.Nil(err)
+
+	_, err = transport.Request(ctx, newLimitedRequest(protocolFactory, ctx, 400))
+	assert.True(IsErrTooLarge(err))
+	assert.Equal(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, err.(thrift.TTransportException).TypeId())
+	limit, ok := ServerRequestSizeLimit(err)
+	assert.True(ok)
+	assert.Equal(uint(300), limit)
+
+	_, ok = ServerRequestSizeLimit(thrift.NewTTransportException(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, ""))
+	assert.False(ok)
+}
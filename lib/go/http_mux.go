@@ -0,0 +1,85 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"net/http"
+	"time"
+)
+
+// FHTTPService is an FProcessor served over HTTP and the FProtocolFactory its
+// requests and responses are encoded with.
+type FHTTPService struct {
+	Processor       FProcessor
+	ProtocolFactory *FProtocolFactory
+}
+
+// NewFrugalHandler returns a handler serving each of the given services on its
+// path, such as "/frugal/users" and "/frugal/billing", so one HTTP server can
+// expose several services. Paths follow the http.ServeMux patterns, and
+// requests to other paths receive a 404. The given options are applied to
+// every service.
+func NewFrugalHandler(services map[string]FHTTPService, options ...FHTTPHandlerOption) http.Handler {
+	mux := http.NewServeMux()
+	for path, service := range services {
+		mux.Handle(path, NewFrugalHandlerFunc(service.Processor, service.ProtocolFactory, options...))
+	}
+	return mux
+}
+
+// FHTTPRequestObserver is called once a Frugal HTTP handler has responded to a
+// request with the response status code and the time taken to respond.
+type FHTTPRequestObserver func(r *http.Request, statusCode int, duration time.Duration)
+
+// WithHTTPRequestObserver calls the given observer for each request handled,
+// such as to record metrics.
+func WithHTTPRequestObserver(observer FHTTPRequestObserver) FHTTPHandlerOption {
+	return func(o *httpHandlerOptions) {
+		o.observer = observer
+	}
+}
+
+// observeHTTP returns a handler which calls the given observer after the given
+// handler responds to each request.
+func observeHTTP(handler http.HandlerFunc, observer FHTTPRequestObserver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		handler(recorder, r)
+		observer(r, recorder.statusCode, time.Since(start))
+	}
+}
+
+// statusRecorder records the status code written to an http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(statusCode int) {
+	if !s.wroteHeader {
+		s.statusCode = statusCode
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Flush supports streamed responses if the underlying writer does.
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		s.wroteHeader = true
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures the handler routes requests to the service for their path and
+// applies shared options to every service.
+func TestNewFrugalHandler(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	var (
+		mu       sync.Mutex
+		observed = make(map[string]int)
+	)
+	handler := NewFrugalHandler(map[string]FHTTPService{
+		"/frugal/users":   {&mockFProcessorForHTTP{response: []byte("users")}, protocolFactory},
+		"/frugal/billing": {&mockFProcessorForHTTP{response: []byte("billing")}, protocolFactory},
+	}, WithHTTPRequestObserver(func(r *http.Request, statusCode int, duration time.Duration) {
+		mu.Lock()
+		observed[r.URL.Path] = statusCode
+		mu.Unlock()
+	}))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	for _, service := range []string{"users", "billing"} {
+		transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL+"/frugal/"+service).Build()
+		result, err := transport.Request(NewFContext(""), prependFrameSize([]byte("request")))
+		assert.Nil(err)
+		assert.Equal([]byte(service), result.(*thrift.TMemoryBuffer).Bytes())
+	}
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL+"/frugal/unknown").Build()
+	_, err := transport.Request(NewFContext(""), prependFrameSize([]byte("request")))
+	assert.NotNil(err)
+
+	// Observers are called after the response is sent.
+	expected := map[string]int{"/frugal/users": http.StatusOK, "/frugal/billing": http.StatusOK}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		mu.Lock()
+		done := len(observed) == len(expected)
+		mu.Unlock()
+		if done {
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(expected, observed)
+}
+
+// Ensures the request observer sees error statuses.
+func TestHTTPRequestObserverError(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	var status int
+	handler := NewFrugalHandlerFunc(&mockFProcessorForHTTP{}, protocolFactory,
+		WithHTTPRequestObserver(func(r *http.Request, statusCode int, duration time.Duration) {
+			status = statusCode
+		}))
+	r, err := http.NewRequest("POST", "/frugal", nil)
+	assert.Nil(err)
+	handler(httptest.NewRecorder(), r)
+	assert.Equal(http.StatusBadRequest, status)
+}
@@ -0,0 +1,584 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// pushTopicParam is the query parameter naming the topic a push stream
+	// subscribes to.
+	pushTopicParam = "topic"
+
+	// pushEvent is the server-sent event type carrying a base64 encoded
+	// frame, including its frame size.
+	pushEvent = "frame"
+
+	eventStreamContentType = "text/event-stream"
+
+	// defaultPushKeepAlive is how often idle push streams are sent a comment
+	// so proxies don't close them.
+	defaultPushKeepAlive = 15 * time.Second
+
+	// defaultPushBufferSize is the number of frames buffered for each push
+	// stream before frames published to it are dropped.
+	defaultPushBufferSize = 64
+
+	// pushReconnectDelay is how long subscribers wait before reconnecting a
+	// push stream which was closed by the server.
+	pushReconnectDelay = time.Second
+)
+
+// FHTTPPushHandler is an http.Handler which delivers published frames to HTTP
+// clients as server-sent events, allowing clients which can only make HTTP
+// requests to subscribe to pub/sub scopes. Clients open a stream with a GET
+// request naming the topic in the "topic" query parameter, typically using an
+// FSubscriberTransport returned by NewFHTTPSubscriberTransport. Requests
+// upgrading to a WebSocket receive each frame as a binary message instead,
+// as used by NewFWebSocketSubscriberTransport.
+//
+// FHTTPPushHandler is also an FPublisherTransportFactory. Frames published
+// with its transports are delivered to every stream subscribed to the topic
+// at the time. Frames are not stored, so streams only receive frames
+// published while they are connected. Streams which fall behind have frames
+// dropped rather than slowing down publishers.
+type FHTTPPushHandler struct {
+	mu         sync.RWMutex
+	streams    map[string]map[*pushStream]struct{}
+	bufferSize uint
+	keepAlive  time.Duration
+	sizeLimit  uint
+}
+
+type pushStream struct {
+	frames chan []byte
+}
+
+// NewFHTTPPushHandler creates a new FHTTPPushHandler.
+func NewFHTTPPushHandler() *FHTTPPushHandler {
+	return &FHTTPPushHandler{
+		streams:    make(map[string]map[*pushStream]struct{}),
+		bufferSize: defaultPushBufferSize,
+		keepAlive:  defaultPushKeepAlive,
+	}
+}
+
+// WithBufferSize sets the number of frames buffered for each stream before
+// frames published to it are dropped. Defaults to 64.
+func (h *FHTTPPushHandler) WithBufferSize(size uint) *FHTTPPushHandler {
+	h.bufferSize = size
+	return h
+}
+
+// WithKeepAlive sets how often idle streams are sent a keep-alive comment.
+// Defaults to 15 seconds. A non-positive duration disables keep-alives.
+func (h *FHTTPPushHandler) WithKeepAlive(interval time.Duration) *FHTTPPushHandler {
+	h.keepAlive = interval
+	return h
+}
+
+// WithPublishSizeLimit sets the maximum size of frames which can be published
+// with the handler's transports. Defaults to unbounded.
+func (h *FHTTPPushHandler) WithPublishSizeLimit(limit uint) *FHTTPPushHandler {
+	h.sizeLimit = limit
+	return h
+}
+
+// GetTransport returns a new FPublisherTransport delivering published frames
+// to the handler's streams.
+func (h *FHTTPPushHandler) GetTransport() FPublisherTransport {
+	return &fHTTPPushPublisherTransport{handler: h}
+}
+
+// ServeHTTP serves a push stream for the topic named in the request.
+func (h *FHTTPPushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Push streams must be opened with GET", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := r.URL.Query().Get(pushTopicParam)
+	if topic == "" {
+		http.Error(w, "Missing topic", http.StatusBadRequest)
+		return
+	}
+	if isWebSocketUpgrade(r) {
+		h.serveWebSocket(w, r, topic)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Register the stream before responding so clients receive every frame
+	// published once their request succeeds.
+	stream := h.register(topic)
+	defer h.unregister(topic, stream)
+
+	w.Header().Set(contentTypeHeader, eventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var keepAlive <-chan time.Time
+	if h.keepAlive > 0 {
+		ticker := time.NewTicker(h.keepAlive)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case frame := <-stream.frames:
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", pushEvent, base64.StdEncoding.EncodeToString(frame))
+		case <-keepAlive:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// serveWebSocket serves a push stream for the given topic over a WebSocket,
+// sending each frame as a binary message and pinging idle connections.
+func (h *FHTTPPushHandler) serveWebSocket(w http.ResponseWriter, r *http.Request, topic string) {
+	stream := h.register(topic)
+	defer h.unregister(topic, stream)
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Read from the connection to answer control frames and notice when the
+	// client closes it.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	var keepAlive <-chan time.Time
+	if h.keepAlive > 0 {
+		ticker := time.NewTicker(h.keepAlive)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+
+	for {
+		var err error
+		select {
+		case <-closed:
+			return
+		case frame := <-stream.frames:
+			err = conn.writeMessage(frame)
+		case <-keepAlive:
+			err = conn.writeFrame(conn.currentConn(), wsOpPing, nil)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (h *FHTTPPushHandler) register(topic string) *pushStream {
+	stream := &pushStream{frames: make(chan []byte, h.bufferSize)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	streams, ok := h.streams[topic]
+	if !ok {
+		streams = make(map[*pushStream]struct{})
+		h.streams[topic] = streams
+	}
+	streams[stream] = struct{}{}
+	return stream
+}
+
+func (h *FHTTPPushHandler) unregister(topic string, stream *pushStream) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.streams[topic], stream)
+	if len(h.streams[topic]) == 0 {
+		delete(h.streams, topic)
+	}
+}
+
+// streamCount returns the number of streams subscribed to the given topic.
+func (h *FHTTPPushHandler) streamCount(topic string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.streams[topic])
+}
+
+func (h *FHTTPPushHandler) publish(topic string, frame []byte) {
+	// Publishers may reuse their buffers once Publish returns.
+	frame = append([]byte(nil), frame...)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for stream := range h.streams[topic] {
+		select {
+		case stream.frames <- frame:
+		default:
+			logger().Warnf("frugal: push stream for topic %s is full, dropping frame", topic)
+		}
+	}
+}
+
+// fHTTPPushPublisherTransport implements FPublisherTransport, publishing
+// frames to the streams of an FHTTPPushHandler.
+type fHTTPPushPublisherTransport struct {
+	handler *FHTTPPushHandler
+}
+
+// Open is a no-op, streams are served by the handler.
+func (p *fHTTPPushPublisherTransport) Open() error {
+	return nil
+}
+
+// Close is a no-op, streams are served by the handler.
+func (p *fHTTPPushPublisherTransport) Close() error {
+	return nil
+}
+
+// IsOpen returns true, streams are served by the handler.
+func (p *fHTTPPushPublisherTransport) IsOpen() bool {
+	return true
+}
+
+// GetPublishSizeLimit returns the maximum allowable size of a payload
+// to be published. A non-positive number is returned to indicate an
+// unbounded allowable size.
+func (p *fHTTPPushPublisherTransport) GetPublishSizeLimit() uint {
+	return p.handler.sizeLimit
+}
+
+// Publish delivers the given frame to the streams subscribed to the topic.
+func (p *fHTTPPushPublisherTransport) Publish(topic string, data []byte) error {
+	if limit := p.handler.sizeLimit; limit > 0 && uint(len(data)) > limit {
+		return thrift.NewTTransportException(
+			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", limit, len(data)))
+	}
+	p.handler.publish(topic, data)
+	return nil
+}
+
+// FHTTPSubscriberTransportFactory produces FSubscriberTransports which
+// subscribe to topics through an FHTTPPushHandler.
+type FHTTPSubscriberTransportFactory struct {
+	client *http.Client
+	url    string
+}
+
+// NewFHTTPSubscriberTransportFactory creates a new
+// FHTTPSubscriberTransportFactory producing transports which open push
+// streams at the given url using the given client.
+func NewFHTTPSubscriberTransportFactory(client *http.Client, url string) *FHTTPSubscriberTransportFactory {
+	return &FHTTPSubscriberTransportFactory{client: client, url: url}
+}
+
+// GetTransport returns a new FSubscriberTransport.
+func (f *FHTTPSubscriberTransportFactory) GetTransport() FSubscriberTransport {
+	return NewFHTTPSubscriberTransport(f.client, f.url)
+}
+
+// FWebSocketSubscriberTransportFactory produces FSubscriberTransports which
+// subscribe to topics through an FHTTPPushHandler over WebSockets.
+type FWebSocketSubscriberTransportFactory struct {
+	url       string
+	header    http.Header
+	tlsConfig *tls.Config
+}
+
+// NewFWebSocketSubscriberTransportFactory creates a new
+// FWebSocketSubscriberTransportFactory producing transports which open push
+// streams at the given ws:// or wss:// url, sending the given header, which
+// may be nil, with the opening handshake.
+func NewFWebSocketSubscriberTransportFactory(url string, header http.Header,
+	tlsConfig *tls.Config) *FWebSocketSubscriberTransportFactory {
+	return &FWebSocketSubscriberTransportFactory{url: url, header: header, tlsConfig: tlsConfig}
+}
+
+// GetTransport returns a new FSubscriberTransport.
+func (f *FWebSocketSubscriberTransportFactory) GetTransport() FSubscriberTransport {
+	return NewFWebSocketSubscriberTransport(f.url, f.header, f.tlsConfig)
+}
+
+// fHTTPSubscriberTransport implements FSubscriberTransport, receiving frames
+// from a push stream served by an FHTTPPushHandler.
+type fHTTPSubscriberTransport struct {
+	connect    func(ctx context.Context, topic string) (io.ReadCloser, error)
+	readStream func(stream io.Reader, callback FAsyncCallback)
+
+	mu     sync.RWMutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewFHTTPSubscriberTransport creates a new FSubscriberTransport which opens a
+// push stream at the given url, the address of an FHTTPPushHandler, using the
+// given client. A nil client uses http.DefaultClient. The client must not set
+// a Timeout, as that would close the stream. Streams closed by the server are
+// reopened until Unsubscribe is called.
+func NewFHTTPSubscriberTransport(client *http.Client, url string) FSubscriberTransport {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &fHTTPSubscriberTransport{
+		connect: func(ctx context.Context, topic string) (io.ReadCloser, error) {
+			return connectEventStream(ctx, client, url, topic)
+		},
+		readStream: readPushStream,
+	}
+}
+
+// NewFWebSocketSubscriberTransport creates a new FSubscriberTransport which
+// opens a push stream over a WebSocket at the given ws:// or wss:// url, the
+// address of an FHTTPPushHandler. The given header and TLS configuration,
+// which may be nil, are used to open the connection. Streams closed by the
+// server are reopened until Unsubscribe is called.
+func NewFWebSocketSubscriberTransport(url string, header http.Header, tlsConfig *tls.Config) FSubscriberTransport {
+	return &fHTTPSubscriberTransport{
+		connect: func(ctx context.Context, topic string) (io.ReadCloser, error) {
+			return connectWebSocketStream(ctx, url, header, tlsConfig, topic)
+		},
+		readStream: readFrameStream,
+	}
+}
+
+// Subscribe opens a push stream for the given topic, returning an error if
+// the stream could not be opened.
+func (h *fHTTPSubscriberTransport) Subscribe(topic string, callback FAsyncCallback) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cancel != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: HTTP subscriber transport already open")
+	}
+	if topic == "" {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"cannot subscribe to empty topic")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	body, err := h.connect(ctx, topic)
+	if err != nil {
+		cancel()
+		return err
+	}
+	h.cancel = cancel
+	h.done = make(chan struct{})
+	go h.receive(ctx, topic, body, callback, h.done)
+	return nil
+}
+
+// pushStreamURL returns the url of the push stream for the given topic.
+func pushStreamURL(rawURL, topic string) (string, error) {
+	streamURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "", thrift.NewTTransportExceptionFromError(err)
+	}
+	query := streamURL.Query()
+	query.Set(pushTopicParam, topic)
+	streamURL.RawQuery = query.Encode()
+	return streamURL.String(), nil
+}
+
+// connectEventStream opens a server-sent event push stream for the given
+// topic, returning its body.
+func connectEventStream(ctx context.Context, client *http.Client, url, topic string) (io.ReadCloser, error) {
+	streamURL, err := pushStreamURL(url, topic)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest(http.MethodGet, streamURL, nil)
+	if err != nil {
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+	request.Header.Set(acceptHeader, eventStreamContentType)
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: push stream for topic %s returned status %d", topic, response.StatusCode))
+	}
+	return response.Body, nil
+}
+
+// connectWebSocketStream opens a WebSocket push stream for the given topic,
+// which is closed when the context is cancelled.
+func connectWebSocketStream(ctx context.Context, url string, header http.Header, tlsConfig *tls.Config,
+	topic string) (io.ReadCloser, error) {
+	streamURL, err := pushStreamURL(url, topic)
+	if err != nil {
+		return nil, err
+	}
+	conn := NewTWebSocketTransport(streamURL, header, tlsConfig)
+	if err := conn.Open(); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return &webSocketStream{TTransport: conn, stop: stop}, nil
+}
+
+// webSocketStream is a WebSocket push stream which stops watching its
+// context when closed.
+type webSocketStream struct {
+	thrift.TTransport
+	stop func() bool
+}
+
+func (s *webSocketStream) Close() error {
+	s.stop()
+	return s.TTransport.Close()
+}
+
+// receive delivers frames from the stream to the callback, reopening the
+// stream whenever it is closed, until the context is cancelled.
+func (h *fHTTPSubscriberTransport) receive(ctx context.Context, topic string,
+	body io.ReadCloser, callback FAsyncCallback, done chan struct{}) {
+	defer close(done)
+	for {
+		h.readStream(body, callback)
+		body.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pushReconnectDelay):
+			}
+			var err error
+			if body, err = h.connect(ctx, topic); err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			logger().Warnf("frugal: error reopening push stream for topic %s: %v", topic, err)
+		}
+	}
+}
+
+// readPushStream parses server-sent events from the stream, delivering the
+// frames they carry to the callback, until the stream is closed.
+func readPushStream(stream io.Reader, callback FAsyncCallback) {
+	reader := bufio.NewReader(stream)
+	var event string
+	var data bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		switch {
+		case line == "":
+			if data.Len() > 0 && (event == "" || event == pushEvent) {
+				deliverPushFrame(data.String(), callback)
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, ":"):
+			// Comment, used for keep-alives.
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimPrefix(strings.TrimPrefix(line, "event:"), " ")
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+}
+
+// readFrameStream reads frames from the stream, delivering them to the
+// callback, until the stream is closed.
+func readFrameStream(stream io.Reader, callback FAsyncCallback) {
+	frameSize := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(stream, frameSize); err != nil {
+			return
+		}
+		frame := make([]byte, 4+binary.BigEndian.Uint32(frameSize))
+		copy(frame, frameSize)
+		if _, err := io.ReadFull(stream, frame[4:]); err != nil {
+			return
+		}
+		deliverFrame(frame, callback)
+	}
+}
+
+func deliverPushFrame(encoded string, callback FAsyncCallback) {
+	frame, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(frame) < 4 {
+		logger().Warn("frugal: Discarding invalid push stream frame")
+		return
+	}
+	deliverFrame(frame, callback)
+}
+
+// deliverFrame passes the given frame, including its frame size, to the
+// callback.
+func deliverFrame(frame []byte, callback FAsyncCallback) {
+	transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])}
+	if err := callback(transport); err != nil {
+		logger().Warn("frugal: error executing callback: ", err)
+	}
+}
+
+// IsSubscribed returns true if the transport is subscribed to a topic, false
+// otherwise.
+func (h *fHTTPSubscriberTransport) IsSubscribed() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.cancel != nil
+}
+
+// Unsubscribe closes the push stream.
+func (h *fHTTPSubscriberTransport) Unsubscribe() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cancel == nil {
+		return nil
+	}
+	h.cancel()
+	<-h.done
+	h.cancel = nil
+	h.done = nil
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures frames published with an FHTTPPushHandler's transports are
+// delivered to HTTP subscribers of the topic.
+func TestHTTPPushPublishSubscribe(t *testing.T) {
+	handler := NewFHTTPPushHandler()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	received := make(chan []byte, 1)
+	subscriber := NewFHTTPSubscriberTransportFactory(nil, server.URL).GetTransport()
+	assert.Nil(t, subscriber.Subscribe("foo", func(transport thrift.TTransport) error {
+		payload, err := ioutil.ReadAll(transport)
+		received <- payload
+		return err
+	}))
+	assert.True(t, subscriber.IsSubscribed())
+	assert.Equal(t, 1, handler.streamCount("foo"))
+
+	publisher := handler.GetTransport()
+	assert.Nil(t, publisher.Open())
+	assert.Nil(t, publisher.Publish("bar", []byte{0, 0, 0, 3, 4, 5, 6}))
+	assert.Nil(t, publisher.Publish("foo", []byte{0, 0, 0, 3, 1, 2, 3}))
+
+	select {
+	case payload := <-received:
+		assert.Equal(t, []byte{1, 2, 3}, payload)
+	case <-time.After(time.Second):
+		t.Fatal("Expected frame to be delivered")
+	}
+
+	assert.Nil(t, subscriber.Unsubscribe())
+	assert.False(t, subscriber.IsSubscribed())
+	for i := 0; i < 100 && handler.streamCount("foo") > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, handler.streamCount("foo"))
+}
+
+// Ensures Subscribe returns an error if the push stream can't be opened and
+// a transport can't subscribe twice.
+func TestHTTPSubscriberTransportErrors(t *testing.T) {
+	server := httptest.NewServer(NewFHTTPPushHandler())
+	defer server.Close()
+	callback := func(thrift.TTransport) error { return nil }
+
+	subscriber := NewFHTTPSubscriberTransport(nil, server.URL)
+	assert.Error(t, subscriber.Subscribe("", callback))
+
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	assert.Error(t, NewFHTTPSubscriberTransport(nil, notFound.URL).Subscribe("foo", callback))
+
+	assert.Nil(t, subscriber.Subscribe("foo", callback))
+	err := subscriber.Subscribe("foo", callback)
+	assert.Equal(t, TRANSPORT_EXCEPTION_ALREADY_OPEN, err.(thrift.TTransportException).TypeId())
+	assert.Nil(t, subscriber.Unsubscribe())
+	assert.Nil(t, subscriber.Unsubscribe())
+}
+
+// Ensures the push handler only serves GET requests naming a topic.
+func TestHTTPPushHandlerBadRequests(t *testing.T) {
+	handler := NewFHTTPPushHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?topic=foo", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// Ensures publishing frames larger than the publish size limit fails.
+func TestHTTPPushPublishSizeLimit(t *testing.T) {
+	publisher := NewFHTTPPushHandler().WithPublishSizeLimit(5).GetTransport()
+	assert.Equal(t, uint(5), publisher.GetPublishSizeLimit())
+	err := publisher.Publish("foo", make([]byte, 6))
+	assert.Equal(t, TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, err.(thrift.TTransportException).TypeId())
+	assert.Nil(t, publisher.Publish("foo", make([]byte, 5)))
+}
+
+// Ensures frames are delivered to subscribers over WebSockets, with idle
+// connections kept alive by pings.
+func TestHTTPPushWebSocket(t *testing.T) {
+	handler := NewFHTTPPushHandler().WithKeepAlive(10 * time.Millisecond)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	received := make(chan []byte, 1)
+	subscriber := NewFWebSocketSubscriberTransportFactory(webSocketURL(server), nil, nil).GetTransport()
+	assert.Nil(t, subscriber.Subscribe("foo", func(transport thrift.TTransport) error {
+		payload, err := ioutil.ReadAll(transport)
+		received <- payload
+		return err
+	}))
+	assert.Equal(t, 1, handler.streamCount("foo"))
+
+	// Let a few pings be answered before publishing.
+	time.Sleep(50 * time.Millisecond)
+	publisher := handler.GetTransport()
+	assert.Nil(t, publisher.Publish("foo", []byte{0, 0, 0, 3, 1, 2, 3}))
+
+	select {
+	case payload := <-received:
+		assert.Equal(t, []byte{1, 2, 3}, payload)
+	case <-time.After(time.Second):
+		t.Fatal("Expected frame to be delivered")
+	}
+
+	assert.Nil(t, subscriber.Unsubscribe())
+	for i := 0; i < 100 && handler.streamCount("foo") > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, handler.streamCount("foo"))
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	defaultHTTPRetryInitialBackoff = 50 * time.Millisecond
+	defaultHTTPRetryMaxBackoff     = 2 * time.Second
+)
+
+// FHTTPRetryPolicy controls how the HTTP transport retries requests which fail
+// transiently. Retries use exponential backoff with full jitter, and all
+// attempts share the request's timeout, so a request is never retried past
+// its deadline.
+type FHTTPRetryPolicy struct {
+	// MaxAttempts is the most times a request is sent, including the first
+	// attempt. Values below two disable retries.
+	MaxAttempts uint
+
+	// RetryStatus reports whether a response with the given status code
+	// should be retried, such as any code of 500 or more to retry all server
+	// errors. The server may have processed such requests, so they are only
+	// retried if marked with SetIdempotent. If nil, 502 and 503 responses are
+	// retried, as are 504 responses to idempotent requests.
+	RetryStatus func(statusCode int) bool
+
+	// InitialBackoff is the most time waited before the first retry. Each
+	// later retry doubles it. Defaults to 50ms.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the time waited before any retry. Defaults to 2s.
+	MaxBackoff time.Duration
+}
+
+// retryable indicates if the request made with the given FContext which
+// failed with the given error should be retried. Failed connections, gateway
+// timeouts, and custom retry statuses are only retried for requests marked
+// with SetIdempotent, since the request may have reached the server. Timeouts
+// are never retried.
+func (p *FHTTPRetryPolicy) retryable(ctx FContext, err error) bool {
+	switch e := err.(type) {
+	case *httpStatusError:
+		if p.RetryStatus != nil {
+			return IsIdempotent(ctx) && p.RetryStatus(e.statusCode)
+		}
+		switch e.statusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable:
+			return true
+		case http.StatusGatewayTimeout:
+			return IsIdempotent(ctx)
+		}
+		return false
+	case thrift.TTransportException:
+		return false
+	case net.Error:
+		return !e.Timeout() && IsIdempotent(ctx)
+	default:
+		return false
+	}
+}
+
+// backoff returns a random time to wait before the given retry, starting at
+// one.
+func (p *FHTTPRetryPolicy) backoff(retry uint) time.Duration {
+	initial, max := p.InitialBackoff, p.MaxBackoff
+	if initial <= 0 {
+		initial = defaultHTTPRetryInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultHTTPRetryMaxBackoff
+	}
+	return jitteredBackoff(initial, max, retry)
+}
+
+// jitteredBackoff returns a random time to wait before the given retry,
+// starting at one, of up to the initial backoff doubled for each earlier
+// retry and capped at max.
+func jitteredBackoff(initial, max time.Duration, retry uint) time.Duration {
+	backoff := initial
+	for i := uint(1); i < retry && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// httpStatusError is returned for responses with an unsuccessful status code.
+type httpStatusError struct {
+	thrift.TTransportException
+	statusCode int
+}
+
+// do sends the given request payload, retrying according to the retry policy,
+// and returns the decoded response, or a TTransport over the response if it is
+// streamed.
+func (h *fHTTPTransport) do(fCtx FContext, requestPayload []byte) ([]byte, thrift.TTransport, error) {
+	deadline := time.Now().Add(fCtx.Timeout())
+	for attempt := uint(1); ; attempt++ {
+		response, stream, err := h.makeRequest(fCtx, requestPayload, deadline)
+		if err == nil || h.retryPolicy == nil || attempt >= h.retryPolicy.MaxAttempts ||
+			!h.retryPolicy.retryable(fCtx, err) {
+			return response, stream, err
+		}
+
+		backoff := h.retryPolicy.backoff(attempt)
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, nil, err
+		}
+		logger().Debugf("frugal: retrying HTTP request after %s: %s", backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-contextDone(fCtx):
+			timer.Stop()
+			return nil, nil, err
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFlakyServer returns a server which fails the given number of requests
+// with the given status code before succeeding, and a counter of the requests
+// it received.
+func newFlakyServer(failures int32, statusCode int) (*httptest.Server, *int32) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			http.Error(w, "unavailable", statusCode)
+			return
+		}
+		w.Write([]byte(base64.StdEncoding.EncodeToString(prependFrameSize([]byte("ok")))))
+	}))
+	return ts, &requests
+}
+
+// Ensures requests failing with a retryable status are retried up to the
+// maximum attempts.
+func TestHTTPTransportRetry(t *testing.T) {
+	assert := assert.New(t)
+	ts, requests := newFlakyServer(2, http.StatusServiceUnavailable)
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).
+		WithRetryPolicy(FHTTPRetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}).
+		Build()
+	_, err := transport.Request(NewFContext(""), prependFrameSize([]byte("request")))
+	assert.Nil(err)
+	assert.Equal(int32(3), atomic.LoadInt32(requests))
+
+	atomic.StoreInt32(requests, 0)
+	transport = NewFHTTPTransportBuilder(&http.Client{}, ts.URL).
+		WithRetryPolicy(FHTTPRetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}).
+		Build()
+	_, err = transport.Request(NewFContext(""), prependFrameSize([]byte("request")))
+	assert.NotNil(err)
+	assert.Equal(int32(2), atomic.LoadInt32(requests))
+}
+
+// Ensures requests failing with a status which isn't retryable are not
+// retried.
+func TestHTTPTransportRetryNotRetryable(t *testing.T) {
+	assert := assert.New(t)
+	ts, requests := newFlakyServer(1, http.StatusInternalServerError)
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).
+		WithRetryPolicy(FHTTPRetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}).
+		Build()
+	_, err := transport.Request(NewFContext(""), prependFrameSize([]byte("request")))
+	assert.NotNil(err)
+	assert.Equal(int32(1), atomic.LoadInt32(requests))
+
+	atomic.StoreInt32(requests, 0)
+	transport = NewFHTTPTransportBuilder(&http.Client{}, ts.URL).
+		WithRetryPolicy(FHTTPRetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			RetryStatus:    func(statusCode int) bool { return statusCode >= 500 },
+		}).
+		Build()
+	_, err = transport.Request(NewFContext(""), prependFrameSize([]byte("request")))
+	assert.NotNil(err)
+	assert.Equal(int32(1), atomic.LoadInt32(requests))
+
+	// Custom retry statuses are only retried for idempotent requests.
+	atomic.StoreInt32(requests, 0)
+	ctx := NewFContext("")
+	SetIdempotent(ctx)
+	_, err = transport.Request(ctx, prependFrameSize([]byte("request")))
+	assert.Nil(err)
+	assert.Equal(int32(2), atomic.LoadInt32(requests))
+}
+
+// Ensures requests aren't retried past their deadline.
+func TestHTTPTransportRetryDeadline(t *testing.T) {
+	assert := assert.New(t)
+	ts, requests := newFlakyServer(5, http.StatusServiceUnavailable)
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).
+		WithRetryPolicy(FHTTPRetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: time.Second}).
+		Build()
+	ctx := NewFContext("")
+	ctx.SetTimeout(20 * time.Millisecond)
+	start := time.Now()
+	_, err := transport.Request(ctx, prependFrameSize([]byte("request")))
+	assert.NotNil(err)
+	assert.True(time.Since(start) < 500*time.Millisecond)
+	assert.True(atomic.LoadInt32(requests) < 5)
+}
+
+// Ensures failed connections and gateway timeouts are only retried for
+// idempotent requests.
+func TestHTTPRetryPolicyRetryable(t *testing.T) {
+	assert := assert.New(t)
+	policy := &FHTTPRetryPolicy{}
+	connErr := &url.Error{Op: "Post", URL: "http://localhost", Err: errors.New("connection refused")}
+	ctx := NewFContext("")
+	assert.False(policy.retryable(ctx, connErr))
+	assert.False(policy.retryable(ctx, &httpStatusError{statusCode: http.StatusGatewayTimeout}))
+	assert.True(policy.retryable(ctx, &httpStatusError{statusCode: http.StatusServiceUnavailable}))
+	SetIdempotent(ctx)
+	assert.True(policy.retryable(ctx, &httpStatusError{statusCode: http.StatusGatewayTimeout}))
+	assert.True(policy.retryable(ctx, connErr))
+	assert.False(policy.retryable(ctx, errors.New("error")))
+	assert.True(policy.retryable(ctx, &httpStatusError{statusCode: http.StatusBadGateway}))
+	assert.False(policy.retryable(ctx, &httpStatusError{statusCode: http.StatusNotFound}))
+}
+
+// Ensures backoff grows exponentially up to the maximum.
+func TestHTTPRetryPolicyBackoff(t *testing.T) {
+	assert := assert.New(t)
+	policy := &FHTTPRetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		assert.True(policy.backoff(1) <= 10*time.Millisecond)
+		assert.True(policy.backoff(2) <= 20*time.Millisecond)
+		assert.True(policy.backoff(5) <= 30*time.Millisecond)
+	}
+}
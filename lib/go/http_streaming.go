@@ -0,0 +1,247 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// Header set to "true" by clients which accept streamed responses, and by
+// handlers on responses they stream. Streamed response bodies are the base64
+// encoded response without a frame size, sent with chunked transfer encoding
+// as the processor writes it. The response is split into segments, each
+// prefixed with its size, and the high bit of the size marks the final
+// segment so clients can release the body as soon as they have read it.
+const streamHeader = "x-frugal-stream"
+
+// Bit of a streamed response segment size marking the final segment.
+const lastStreamSegment = 1 << 31
+
+// The most bytes read from a streamed response body after its final segment
+// so its connection can be reused.
+const maxStreamDrain = 4096
+
+// streamResponse processes the request on the given input protocol, writing
+// the response to the client as it is produced. Responses the processor does
+// not write anything for are sent unstreamed as an empty frame.
+func streamResponse(w http.ResponseWriter, flusher http.Flusher, processor FProcessor,
+	iprot *FProtocol, protocolFactory *FProtocolFactory) {
+	stream := &httpResponseStream{w: w, flusher: flusher}
+	encoder := base64.NewEncoder(base64.StdEncoding, stream)
+	segments := &httpStreamSegments{w: encoder}
+	oprot := protocolFactory.GetProtocol(thrift.NewStreamTransportW(segments))
+	err := processor.Process(iprot, oprot)
+	if err == nil {
+		if err = oprot.Flush(); err == nil {
+			if err = segments.Close(); err == nil {
+				err = encoder.Close()
+			}
+		}
+	}
+	if err != nil {
+		if !stream.started {
+			http.Error(w,
+				fmt.Sprintf("Error processing request: %s", err),
+				http.StatusInternalServerError,
+			)
+			return
+		}
+		// The status has already been sent, so the client will fail to
+		// decode the truncated response.
+		logger().Errorf("frugal: error streaming HTTP response: %s", err)
+		return
+	}
+
+	if !stream.started {
+		w.Header().Add(contentTransferEncodingHeader, base64Encoding)
+		w.Write([]byte(base64.StdEncoding.EncodeToString(make([]byte, 4))))
+	}
+}
+
+// httpResponseStream writes to an http.ResponseWriter, flushing after each
+// write so the data is sent to the client immediately.
+type httpResponseStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+func (s *httpResponseStream) Write(p []byte) (int, error) {
+	if !s.started {
+		s.started = true
+		s.w.Header().Add(contentTransferEncodingHeader, base64Encoding)
+		s.w.Header().Add(streamHeader, "true")
+	}
+	n, err := s.w.Write(p)
+	s.flusher.Flush()
+	return n, err
+}
+
+// httpStreamSegments splits a streamed response into segments. Each write is
+// held back until the next one, so the final segment can be marked as such
+// when the writer is closed.
+type httpStreamSegments struct {
+	w       io.Writer
+	pending []byte
+}
+
+func (s *httpStreamSegments) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(s.pending) > 0 {
+		if err := s.writeSegment(0); err != nil {
+			return 0, err
+		}
+	}
+	s.pending = append(s.pending[:0], p...)
+	return len(p), nil
+}
+
+// Close writes the final segment, if anything was written.
+func (s *httpStreamSegments) Close() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	return s.writeSegment(lastStreamSegment)
+}
+
+// writeSegment writes the pending data as a segment with the given flags.
+func (s *httpStreamSegments) writeSegment(flags uint32) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(s.pending))|flags)
+	if _, err := s.w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := s.w.Write(s.pending)
+	return err
+}
+
+// newHTTPStreamTransport returns a TTransport which decodes the given
+// streamed response body as it is read, failing once more than limit bytes
+// have been decoded if limit is positive. The body and the request context
+// are released once the final segment has been read, or by closing the
+// transport or the request timing out.
+func newHTTPStreamTransport(body io.ReadCloser, cancel context.CancelFunc, limit uint) thrift.TTransport {
+	reader := &httpStreamReader{
+		decoder: base64.NewDecoder(base64.StdEncoding, body),
+		body:    body,
+		cancel:  cancel,
+		limit:   int(limit),
+	}
+	return &httpStreamTransport{
+		StreamTransport: &thrift.StreamTransport{Reader: bufio.NewReader(reader)},
+		reader:          reader,
+	}
+}
+
+// httpStreamTransport is a TTransport over a streamed response body.
+type httpStreamTransport struct {
+	*thrift.StreamTransport
+	reader *httpStreamReader
+}
+
+// Close releases the response body.
+func (h *httpStreamTransport) Close() error {
+	return h.reader.Close()
+}
+
+// httpStreamReader decodes a streamed response body, enforcing the response
+// size limit and releasing the body once its final segment has been read.
+type httpStreamReader struct {
+	decoder   io.Reader
+	body      io.ReadCloser
+	cancel    context.CancelFunc
+	limit     int
+	read      int
+	remaining int
+	last      bool
+	once      sync.Once
+}
+
+func (h *httpStreamReader) Read(p []byte) (int, error) {
+	for h.remaining == 0 {
+		if h.last {
+			h.drain()
+			return 0, io.EOF
+		}
+		if err := h.readSegmentSize(); err != nil {
+			h.Close()
+			return 0, err
+		}
+	}
+	if len(p) > h.remaining {
+		p = p[:h.remaining]
+	}
+	n, err := h.decoder.Read(p)
+	h.read += n
+	h.remaining -= n
+	if h.limit > 0 && h.read > h.limit {
+		h.Close()
+		return 0, thrift.NewTTransportException(TRANSPORT_EXCEPTION_RESPONSE_TOO_LARGE,
+			fmt.Sprintf("response exceeded %d bytes", h.limit))
+	}
+	if err == io.EOF && h.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		h.Close()
+		return n, err
+	}
+	if h.remaining == 0 && h.last {
+		h.drain()
+	}
+	return n, nil
+}
+
+// readSegmentSize reads the size of the next segment.
+func (h *httpStreamReader) readSegmentSize() error {
+	var size [4]byte
+	if _, err := io.ReadFull(h.decoder, size[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	segment := binary.BigEndian.Uint32(size[:])
+	h.last = segment&lastStreamSegment != 0
+	h.remaining = int(segment &^ lastStreamSegment)
+	return nil
+}
+
+// drain reads what remains of the body, such as base64 padding, so its
+// connection can be reused, and releases it.
+func (h *httpStreamReader) drain() {
+	io.CopyN(ioutil.Discard, h.body, maxStreamDrain)
+	h.Close()
+}
+
+func (h *httpStreamReader) Close() error {
+	var err error
+	h.once.Do(func() {
+		err = h.body.Close()
+		h.cancel()
+	})
+	return err
+}
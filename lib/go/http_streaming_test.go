@@ -0,0 +1,107 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures a streaming client receives large responses streamed by the
+// handler, and the response body is released once the response is read.
+func TestHTTPTransportResponseStreaming(t *testing.T) {
+	assert := assert.New(t)
+	response := bytes.Repeat([]byte("streamed"), 64*1024)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	ts := httptest.NewServer(NewFrugalHandlerFunc(&mockFProcessorForHTTP{response: response}, protocolFactory))
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).WithResponseStreaming().Build()
+	result, err := transport.Request(NewFContext(""), prependFrameSize([]byte{1, 2, 3}))
+	assert.Nil(err)
+	_, streamed := result.(*httpStreamTransport)
+	assert.True(streamed)
+	actual := make([]byte, len(response))
+	_, err = io.ReadFull(result, actual)
+	assert.Nil(err)
+	assert.Equal(response, actual)
+	_, err = result.(*httpStreamTransport).reader.body.Read(make([]byte, 1))
+	assert.NotNil(err)
+	assert.NotEqual(io.EOF, err)
+	assert.Nil(result.Close())
+}
+
+// Ensures streamed responses are split into segments with the final one
+// marked, and a truncated stream fails to read.
+func TestHTTPStreamSegments(t *testing.T) {
+	assert := assert.New(t)
+	var encoded bytes.Buffer
+	segments := &httpStreamSegments{w: &encoded}
+	segments.Write([]byte("foo"))
+	segments.Write(nil)
+	segments.Write([]byte("barbaz"))
+	assert.Nil(segments.Close())
+	assert.Equal(append([]byte{0, 0, 0, 3, 'f', 'o', 'o', 0x80, 0, 0, 6}, "barbaz"...), encoded.Bytes())
+
+	body := base64.StdEncoding.EncodeToString(encoded.Bytes()) + "trailing"
+	var cancelled bool
+	result := newHTTPStreamTransport(ioutil.NopCloser(bytes.NewBufferString(body)), func() { cancelled = true }, 0)
+	actual, err := ioutil.ReadAll(result.(*httpStreamTransport).reader)
+	assert.Nil(err)
+	assert.Equal("foobarbaz", string(actual))
+	assert.True(cancelled)
+
+	truncated := base64.StdEncoding.EncodeToString(encoded.Bytes()[:9])
+	result = newHTTPStreamTransport(ioutil.NopCloser(bytes.NewBufferString(truncated)), func() {}, 0)
+	_, err = ioutil.ReadAll(result.(*httpStreamTransport).reader)
+	assert.Equal(io.ErrUnexpectedEOF, err)
+}
+
+// Ensures streamed responses exceeding the response size limit fail as they
+// are read.
+func TestHTTPTransportResponseStreamingTooLarge(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	processor := &mockFProcessorForHTTP{response: make([]byte, 10000)}
+	ts := httptest.NewServer(NewFrugalHandlerFunc(processor, protocolFactory))
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).
+		WithResponseStreaming().
+		WithResponseSizeLimit(5000).
+		Build()
+	result, err := transport.Request(NewFContext(""), prependFrameSize([]byte{1, 2, 3}))
+	assert.Nil(err)
+	_, err = io.ReadFull(result, make([]byte, 10000))
+	assert.True(IsErrTooLarge(err))
+}
+
+// Ensures empty responses are sent unstreamed as an empty frame.
+func TestHTTPTransportResponseStreamingOneway(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	ts := httptest.NewServer(NewFrugalHandlerFunc(&mockFProcessorForHTTP{}, protocolFactory))
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).WithResponseStreaming().Build()
+	assert.Nil(transport.Oneway(NewFContext(""), prependFrameSize([]byte{1, 2, 3})))
+}
@@ -15,21 +15,27 @@ package frugal
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"git.apache.org/thrift.git/lib/go/thrift"
 )
 
 const (
 	payloadLimitHeader            = "x-frugal-payload-limit"
+	requestSizeLimitHeader        = "x-frugal-request-size-limit"
 	acceptHeader                  = "accept"
 	contentTypeHeader             = "content-type"
 	contentTransferEncodingHeader = "content-transfer-encoding"
@@ -42,11 +48,43 @@ var newEncoder = func(buf *bytes.Buffer) io.WriteCloser {
 	return base64.NewEncoder(base64.StdEncoding, buf)
 }
 
+// FHTTPHandlerOption configures handlers created with NewFrugalHandlerFunc.
+type FHTTPHandlerOption func(*httpHandlerOptions)
+
+type httpHandlerOptions struct {
+	compress             bool
+	compressionThreshold int
+	headerMapping        FHTTPHeaderMapping
+	observer             FHTTPRequestObserver
+	requestSizeLimit     uint
+	cors                 *FHTTPCORSConfig
+	authenticator        FHTTPAuthenticator
+}
+
+// WithHandlerRequestSizeLimit rejects requests with frames larger than the
+// given number of bytes. Rejected requests receive a 413 response carrying
+// the limit in the x-frugal-request-size-limit header and, when the request
+// headers can be read, a Frugal response failing with a TApplicationException
+// of type APPLICATION_EXCEPTION_REQUEST_TOO_LARGE. The HTTP transport returns
+// these as a TTransportException of type TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE
+// from which the limit can be read with ServerRequestSizeLimit. If set to 0
+// (the default), there is no size limit on requests.
+func WithHandlerRequestSizeLimit(limit uint) FHTTPHandlerOption {
+	return func(o *httpHandlerOptions) {
+		o.requestSizeLimit = limit
+	}
+}
+
 // NewFrugalHandlerFunc is a function that creates a ready to use Frugal handler
 // function.
-func NewFrugalHandlerFunc(processor FProcessor, protocolFactory *FProtocolFactory) http.HandlerFunc {
+func NewFrugalHandlerFunc(processor FProcessor, protocolFactory *FProtocolFactory,
+	options ...FHTTPHandlerOption) http.HandlerFunc {
+	var opts httpHandlerOptions
+	for _, option := range options {
+		option(&opts)
+	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add(contentTypeHeader, frugalContentType)
 
 		// Check for size limitation
@@ -71,7 +109,19 @@ func NewFrugalHandlerFunc(processor FProcessor, protocolFactory *FProtocolFactor
 		}
 
 		// Create a decoder based on the payload
-		decoder := base64.NewDecoder(base64.StdEncoding, r.Body)
+		var body io.Reader = r.Body
+		if strings.EqualFold(r.Header.Get(contentEncodingHeader), gzipEncoding) {
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w,
+					fmt.Sprintf("Could not decompress the request %s", err),
+					http.StatusBadRequest,
+				)
+				return
+			}
+			body = reader
+		}
+		decoder := base64.NewDecoder(base64.StdEncoding, body)
 
 		// Read out the frame size
 		// TODO: should we do something with the frame size?
@@ -84,11 +134,47 @@ func NewFrugalHandlerFunc(processor FProcessor, protocolFactory *FProtocolFactor
 			return
 		}
 
-		// Read and process frame
-		input := thrift.NewStreamTransportR(decoder)
+		// Reject frames over the size limit, and don't read more than the
+		// limit from frames which misstate their size.
+		if opts.requestSizeLimit > 0 {
+			if size := binary.BigEndian.Uint32(frameSize); size > uint32(opts.requestSizeLimit) {
+				rejectRequestTooLarge(w, protocolFactory.GetProtocol(thrift.NewStreamTransportR(decoder)),
+					protocolFactory, size, opts.requestSizeLimit)
+				return
+			}
+			decoder = io.LimitReader(decoder, int64(opts.requestSizeLimit))
+		}
+
+		// Read and process frame, adding FContext headers mapped from the
+		// HTTP headers
+		var input thrift.TTransport = thrift.NewStreamTransportR(decoder)
+		if len(opts.headerMapping) > 0 {
+			frame, err := ioutil.ReadAll(decoder)
+			if err == nil {
+				frame, err = opts.headerMapping.addToFrame(append(frameSize[:4:4], frame...), r.Header)
+			}
+			if err != nil {
+				http.Error(w,
+					fmt.Sprintf("Could not read the frugal frame bytes %s", err),
+					http.StatusBadRequest,
+				)
+				return
+			}
+			input = &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])}
+		}
+		iprot := protocolFactory.GetProtocol(input)
+
+		// Stream the response if the client accepts it. The client enforces
+		// its own size limit on streamed responses.
+		if r.Header.Get(streamHeader) == "true" {
+			if flusher, ok := w.(http.Flusher); ok {
+				streamResponse(w, flusher, processor, iprot, protocolFactory)
+				return
+			}
+		}
+
 		outBuf := new(bytes.Buffer)
 		output := &thrift.TMemoryBuffer{Buffer: outBuf}
-		iprot := protocolFactory.GetProtocol(input)
 		oprot := protocolFactory.GetProtocol(output)
 		if err := processor.Process(iprot, oprot); err != nil {
 			http.Error(w,
@@ -98,6 +184,13 @@ func NewFrugalHandlerFunc(processor FProcessor, protocolFactory *FProtocolFactor
 			return
 		}
 
+		// Copy mapped FContext response headers to the HTTP headers
+		if len(opts.headerMapping) > 0 && outBuf.Len() > 0 {
+			if headers, err := getHeadersFromFrame(outBuf.Bytes()); err == nil {
+				opts.headerMapping.toHTTP(headers, w.Header())
+			}
+		}
+
 		// If client requested a limit, check the buffer size
 		if limit > 0 && outBuf.Len() > int(limit) {
 			http.Error(w,
@@ -133,9 +226,37 @@ func NewFrugalHandlerFunc(processor FProcessor, protocolFactory *FProtocolFactor
 			return
 		}
 
+		// Compress the response if worthwhile
+		response := encoded.Bytes()
+		if opts.compress && encoded.Len() >= opts.compressionThreshold {
+			w.Header().Add(varyHeader, acceptEncodingHeader)
+			if acceptsGzip(r.Header.Get(acceptEncodingHeader)) {
+				compressed, err := gzipBytes(response)
+				if err != nil {
+					http.Error(w,
+						fmt.Sprintf("Problem compressing frugal response %s", err),
+						http.StatusInternalServerError,
+					)
+					return
+				}
+				w.Header().Add(contentEncodingHeader, gzipEncoding)
+				response = compressed
+			}
+		}
+
 		w.Header().Add(contentTransferEncodingHeader, base64Encoding)
-		w.Write(encoded.Bytes())
+		w.Write(response)
+	}
+	if opts.authenticator != nil {
+		handler = authenticateHTTP(handler, opts.authenticator)
+	}
+	if opts.cors != nil {
+		handler = opts.cors.handler(handler)
+	}
+	if opts.observer != nil {
+		return observeHTTP(handler, opts.observer)
 	}
+	return handler
 }
 
 // FHTTPTransportBuilder configures and builds HTTP FTransport instances.
@@ -145,10 +266,22 @@ type FHTTPTransportBuilder struct {
 	requestSizeLimit  uint
 	responseSizeLimit uint
 	requestHeaders    map[string]string
+	streaming         bool
+	compress          bool
+	compressThreshold uint
+	headerMapping     FHTTPHeaderMapping
+	retryPolicy       *FHTTPRetryPolicy
+	roundTripper      http.RoundTripper
+	proxy             func(*http.Request) (*url.URL, error)
+
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	tlsHandshakeTimeout time.Duration
+	dialTimeout         time.Duration
 }
 
 // NewFHTTPTransportBuilder creates a builder which configures and builds HTTP
-// FTransport instances.
+// FTransport instances. If the client is nil, a default client is used.
 func NewFHTTPTransportBuilder(client *http.Client, url string) *FHTTPTransportBuilder {
 	return &FHTTPTransportBuilder{
 		client: client,
@@ -177,14 +310,169 @@ func (h *FHTTPTransportBuilder) WithRequestHeaders(requestHeaders map[string]str
 	return h
 }
 
+// WithResponseStreaming asks handlers to stream responses with chunked
+// transfer encoding, so they are decoded as they arrive rather than buffered
+// in full first. Handlers which don't support streaming send buffered
+// responses as usual. The response size limit is enforced as streamed
+// responses are read.
+func (h *FHTTPTransportBuilder) WithResponseStreaming() *FHTTPTransportBuilder {
+	h.streaming = true
+	return h
+}
+
+// WithCompression enables gzip compression. Requests of at least the given
+// number of encoded bytes are compressed, and handlers are told gzip
+// compressed responses are accepted. Handlers must be created with this
+// version of NewFrugalHandlerFunc or later to accept compressed requests, and
+// with WithResponseCompression to compress responses.
+func (h *FHTTPTransportBuilder) WithCompression(threshold uint) *FHTTPTransportBuilder {
+	h.compress = true
+	h.compressThreshold = threshold
+	return h
+}
+
+// WithHeaderMapping copies mapped FContext request headers into the HTTP
+// request headers, and mapped HTTP response headers into the FContext response
+// headers of responses.
+func (h *FHTTPTransportBuilder) WithHeaderMapping(mapping FHTTPHeaderMapping) *FHTTPTransportBuilder {
+	h.headerMapping = mapping
+	return h
+}
+
+// WithRetryPolicy retries requests which fail transiently, such as with a 503
+// from a load balancer, according to the given policy. By default, requests
+// are not retried.
+func (h *FHTTPTransportBuilder) WithRetryPolicy(policy FHTTPRetryPolicy) *FHTTPTransportBuilder {
+	h.retryPolicy = &policy
+	return h
+}
+
+// WithRoundTripper sends requests with the given RoundTripper, such as an
+// instrumented or proxying transport, in place of the client's transport. The
+// client passed to the builder is not modified.
+func (h *FHTTPTransportBuilder) WithRoundTripper(roundTripper http.RoundTripper) *FHTTPTransportBuilder {
+	h.roundTripper = roundTripper
+	return h
+}
+
+// WithProxy sends requests through the proxy returned by the given function,
+// such as http.ProxyURL or http.ProxyFromEnvironment. This requires the
+// client's transport, or the RoundTripper set with WithRoundTripper, to be an
+// *http.Transport, which is copied rather than modified. Otherwise, the proxy
+// is ignored and a warning is logged.
+func (h *FHTTPTransportBuilder) WithProxy(proxy func(*http.Request) (*url.URL, error)) *FHTTPTransportBuilder {
+	h.proxy = proxy
+	return h
+}
+
+// WithMaxIdleConnsPerHost sets the maximum number of idle connections kept
+// open to the server for reuse. Go defaults to 2, which under load causes
+// connections to be closed and reopened, potentially exhausting ephemeral
+// ports. Like WithProxy, this requires the client's transport to be an
+// *http.Transport.
+func (h *FHTTPTransportBuilder) WithMaxIdleConnsPerHost(maxIdleConnsPerHost int) *FHTTPTransportBuilder {
+	h.maxIdleConnsPerHost = maxIdleConnsPerHost
+	return h
+}
+
+// WithIdleConnTimeout sets how long idle connections are kept open for reuse
+// before being closed. Like WithProxy, this requires the client's transport
+// to be an *http.Transport.
+func (h *FHTTPTransportBuilder) WithIdleConnTimeout(timeout time.Duration) *FHTTPTransportBuilder {
+	h.idleConnTimeout = timeout
+	return h
+}
+
+// WithTLSHandshakeTimeout sets how long to wait for a TLS handshake with the
+// server. Like WithProxy, this requires the client's transport to be an
+// *http.Transport.
+func (h *FHTTPTransportBuilder) WithTLSHandshakeTimeout(timeout time.Duration) *FHTTPTransportBuilder {
+	h.tlsHandshakeTimeout = timeout
+	return h
+}
+
+// WithDialTimeout sets how long to wait for a connection to the server to be
+// established. Like WithProxy, this requires the client's transport to be an
+// *http.Transport.
+func (h *FHTTPTransportBuilder) WithDialTimeout(timeout time.Duration) *FHTTPTransportBuilder {
+	h.dialTimeout = timeout
+	return h
+}
+
+// configuresTransport indicates if any options modifying the client's
+// *http.Transport are set.
+func (h *FHTTPTransportBuilder) configuresTransport() bool {
+	return h.proxy != nil || h.maxIdleConnsPerHost > 0 || h.idleConnTimeout > 0 ||
+		h.tlsHandshakeTimeout > 0 || h.dialTimeout > 0
+}
+
+// configureTransport applies the builder's options to the given transport.
+func (h *FHTTPTransportBuilder) configureTransport(transport *http.Transport) {
+	if h.proxy != nil {
+		transport.Proxy = h.proxy
+	}
+	if h.maxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = h.maxIdleConnsPerHost
+	}
+	if h.idleConnTimeout > 0 {
+		transport.IdleConnTimeout = h.idleConnTimeout
+	}
+	if h.tlsHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = h.tlsHandshakeTimeout
+	}
+	if h.dialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   h.dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+}
+
+// buildClient returns the client to send requests with, applying the
+// configured RoundTripper, proxy and connection options to a copy of the
+// builder's client.
+func (h *FHTTPTransportBuilder) buildClient() *http.Client {
+	client := h.client
+	if client == nil {
+		client = &http.Client{}
+	}
+	if h.roundTripper == nil && !h.configuresTransport() {
+		return client
+	}
+
+	clientCopy := *client
+	if h.roundTripper != nil {
+		clientCopy.Transport = h.roundTripper
+	}
+	if h.configuresTransport() {
+		roundTripper := clientCopy.Transport
+		if roundTripper == nil {
+			roundTripper = http.DefaultTransport
+		}
+		if transport, ok := roundTripper.(*http.Transport); ok {
+			transport = transport.Clone()
+			h.configureTransport(transport)
+			clientCopy.Transport = transport
+		} else {
+			logger().Warnf("frugal: ignoring HTTP transport options, %T is not an *http.Transport", roundTripper)
+		}
+	}
+	return &clientCopy
+}
+
 // Build a new configured HTTP FTransport.
 func (h *FHTTPTransportBuilder) Build() FTransport {
 	return &fHTTPTransport{
 		fBaseTransport:    newFBaseTransport(h.requestSizeLimit),
-		client:            h.client,
+		client:            h.buildClient(),
 		url:               h.url,
 		responseSizeLimit: h.responseSizeLimit,
 		requestHeaders:    h.requestHeaders,
+		streaming:         h.streaming,
+		compress:          h.compress,
+		compressThreshold: h.compressThreshold,
+		headerMapping:     h.headerMapping,
+		retryPolicy:       h.retryPolicy,
 	}
 }
 
@@ -200,6 +488,11 @@ type fHTTPTransport struct {
 	responseSizeLimit uint
 	isOpen            bool
 	requestHeaders	  map[string]string
+	streaming         bool
+	compress          bool
+	compressThreshold uint
+	headerMapping     FHTTPHeaderMapping
+	retryPolicy       *FHTTPRetryPolicy
 }
 
 // Open initializes the transport for use.
@@ -247,7 +540,7 @@ func (h *fHTTPTransport) Request(ctx FContext, data []byte) (thrift.TTransport,
 	}
 
 	// Make the HTTP request
-	response, err := h.makeRequest(ctx, data)
+	response, stream, err := h.do(ctx, data)
 	if err != nil {
 		if strings.HasSuffix(err.Error(), "net/http: request canceled") ||
 			strings.HasSuffix(err.Error(), "net/http: timeout awaiting response headers") ||
@@ -256,6 +549,9 @@ func (h *fHTTPTransport) Request(ctx FContext, data []byte) (thrift.TTransport,
 		}
 		return nil, thrift.NewTTransportExceptionFromError(err)
 	}
+	if stream != nil {
+		return stream, nil
+	}
 
 	// All responses should be framed with 4 bytes (uint32)
 	if len(response) < 4 {
@@ -288,23 +584,39 @@ func (h *fHTTPTransport) GetRequestSizeLimit() uint {
 func (h *fHTTPTransport) SetMonitor(monitor FTransportMonitor) {
 }
 
-func (h *fHTTPTransport) makeRequest(fCtx FContext, requestPayload []byte) ([]byte, error) {
+// makeRequest sends the given request payload once and returns the decoded
+// response, or a TTransport over the response if it is streamed.
+func (h *fHTTPTransport) makeRequest(fCtx FContext, requestPayload []byte, deadline time.Time) ([]byte, thrift.TTransport, error) {
 	// Encode request payload
 	encoded := new(bytes.Buffer)
 	encoder := newEncoder(encoded)
 	if _, err := encoder.Write(requestPayload); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if err := encoder.Close(); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	compressed := h.compress && encoded.Len() >= int(h.compressThreshold)
+	if compressed {
+		data, err := gzipBytes(encoded.Bytes())
+		if err != nil {
+			return nil, nil, err
+		}
+		encoded = bytes.NewBuffer(data)
 	}
 
-	// Initialize request
-	ctx, cancel := context.WithTimeout(context.Background(), fCtx.Timeout())
-	defer cancel()
+	// Initialize request. Streamed responses release the context once they
+	// have been read.
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	streamed := false
+	defer func() {
+		if !streamed {
+			cancel()
+		}
+	}()
 	request, err := http.NewRequest("POST", h.url, encoded)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	request = request.WithContext(ctx)
 
@@ -316,6 +628,9 @@ func (h *fHTTPTransport) makeRequest(fCtx FContext, requestPayload []byte) ([]by
 		}
 	}
 
+	// Copy mapped FContext headers
+	h.headerMapping.toHTTP(fCtx.RequestHeaders(), request.Header)
+
 	// Add request headers
 	request.Header.Add(contentTypeHeader, frugalContentType)
 	request.Header.Add(acceptHeader, frugalContentType)
@@ -323,42 +638,83 @@ func (h *fHTTPTransport) makeRequest(fCtx FContext, requestPayload []byte) ([]by
 	if h.responseSizeLimit > 0 {
 		request.Header.Add(payloadLimitHeader, strconv.FormatUint(uint64(h.responseSizeLimit), 10))
 	}
+	if h.streaming {
+		request.Header.Add(streamHeader, "true")
+	}
+	if h.compress {
+		request.Header.Add(acceptEncodingHeader, gzipEncoding)
+	}
+	if compressed {
+		request.Header.Add(contentEncodingHeader, gzipEncoding)
+	}
 
 	// Make request
 	response, err := h.client.Do(request)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Response too large
+	// Request or response too large
 	if response.StatusCode == http.StatusRequestEntityTooLarge {
-		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_RESPONSE_TOO_LARGE,
+		response.Body.Close()
+		if limitStr := response.Header.Get(requestSizeLimitHeader); limitStr != "" {
+			limit, _ := strconv.ParseUint(limitStr, 10, 64)
+			return nil, nil, &requestTooLargeError{
+				TTransportException: thrift.NewTTransportException(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+					fmt.Sprintf("request was larger than the server limit of %d bytes", limit)),
+				limit: uint(limit),
+			}
+		}
+		return nil, nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_RESPONSE_TOO_LARGE,
 			"response was too large for the transport")
 	}
 
+	// Streamed response
+	if response.StatusCode < 300 && response.Header.Get(streamHeader) == "true" {
+		streamed = true
+		return nil, newHTTPStreamTransport(response.Body, cancel, h.responseSizeLimit), nil
+	}
+
 	// Decode body
+	var bodyReader io.Reader = response.Body
+	if strings.EqualFold(response.Header.Get(contentEncodingHeader), gzipEncoding) {
+		reader, err := gzip.NewReader(response.Body)
+		if err != nil {
+			response.Body.Close()
+			return nil, nil, err
+		}
+		bodyReader = reader
+	}
 	buf := new(bytes.Buffer)
-	if _, err := buf.ReadFrom(response.Body); err != nil {
-		return nil, err
+	if _, err := buf.ReadFrom(bodyReader); err != nil {
+		return nil, nil, err
 	}
 	if err := response.Body.Close(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	body := string(buf.Bytes())
 
 	// Check bad status code
 	if response.StatusCode >= 300 {
-		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
-			fmt.Sprintf("response errored with code %d and message %s",
-				response.StatusCode, body))
+		return nil, nil, &httpStatusError{
+			TTransportException: thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+				fmt.Sprintf("response errored with code %d and message %s",
+					response.StatusCode, body)),
+			statusCode: response.StatusCode,
+		}
 	}
 
 	// Decode and return response body
 	bts, err := base64.StdEncoding.DecodeString(body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if len(h.headerMapping) > 0 && len(bts) > 4 {
+		if bts, err = h.headerMapping.addToFrame(bts, response.Header); err != nil {
+			return nil, nil, err
+		}
 	}
-	return bts, nil
+	return bts, nil, nil
 
 }
 
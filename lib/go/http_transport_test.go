@@ -22,6 +22,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -649,3 +650,83 @@ func TestHTTPTransportBadURL(t *testing.T) {
 	// Close
 	assert.Nil(transport.Close())
 }
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Ensures requests are sent with the RoundTripper given to the builder
+// without modifying the builder's client.
+func TestHTTPTransportRoundTripper(t *testing.T) {
+	assert := assert.New(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(base64.StdEncoding.EncodeToString(prependFrameSize([]byte("ok")))))
+	}))
+	defer ts.Close()
+
+	var roundTrips int
+	client := &http.Client{}
+	transport := NewFHTTPTransportBuilder(client, ts.URL).
+		WithRoundTripper(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			roundTrips++
+			return http.DefaultTransport.RoundTrip(r)
+		})).
+		Build()
+	_, err := transport.Request(NewFContext(""), prependFrameSize([]byte("request")))
+	assert.Nil(err)
+	assert.Equal(1, roundTrips)
+	assert.Nil(client.Transport)
+}
+
+// Ensures requests are sent through the proxy given to the builder.
+func TestHTTPTransportProxy(t *testing.T) {
+	assert := assert.New(t)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("frugal.invalid", r.URL.Host)
+		w.Write([]byte(base64.StdEncoding.EncodeToString(prependFrameSize([]byte("ok")))))
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.Nil(err)
+
+	transport := NewFHTTPTransportBuilder(nil, "http://frugal.invalid/frugal").
+		WithProxy(http.ProxyURL(proxyURL)).
+		Build()
+	result, err := transport.Request(NewFContext(""), prependFrameSize([]byte("request")))
+	assert.Nil(err)
+	assert.Equal([]byte("ok"), result.(*thrift.TMemoryBuffer).Bytes())
+}
+
+// Ensures connection options are applied to a copy of the client's transport.
+func TestHTTPTransportConnectionOptions(t *testing.T) {
+	assert := assert.New(t)
+	roundTripper := &http.Transport{}
+	client := &http.Client{Transport: roundTripper}
+
+	transport := NewFHTTPTransportBuilder(client, "http://localhost").
+		WithMaxIdleConnsPerHost(50).
+		WithIdleConnTimeout(time.Minute).
+		WithTLSHandshakeTimeout(5 * time.Second).
+		WithDialTimeout(time.Second).
+		Build().(*fHTTPTransport)
+
+	configured := transport.client.Transport.(*http.Transport)
+	assert.NotEqual(roundTripper, configured)
+	assert.Equal(50, configured.MaxIdleConnsPerHost)
+	assert.Equal(time.Minute, configured.IdleConnTimeout)
+	assert.Equal(5*time.Second, configured.TLSHandshakeTimeout)
+	assert.NotNil(configured.DialContext)
+	assert.Equal(0, roundTripper.MaxIdleConnsPerHost)
+	assert.Nil(roundTripper.DialContext)
+
+	// Options are ignored if the transport isn't an *http.Transport.
+	custom := roundTripperFunc(func(r *http.Request) (*http.Response, error) { return nil, nil })
+	transport = NewFHTTPTransportBuilder(nil, "http://localhost").
+		WithRoundTripper(custom).
+		WithMaxIdleConnsPerHost(50).
+		Build().(*fHTTPTransport)
+	_, ok := transport.client.Transport.(roundTripperFunc)
+	assert.True(ok)
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Header identifying a logical request across retries, used to deduplicate
+// them on the server
+const idempotencyKeyHeader = "_idempotency-key"
+
+// SetIdempotencyKey sets the key identifying the logical request made with the
+// given FContext. Retries of the request should use the same key so servers
+// using NewIdempotencyKeyMiddleware process it at most once. The key is sent
+// in the reserved "_idempotency-key" request header.
+func SetIdempotencyKey(ctx FContext, key string) {
+	setRequestHeader(ctx, idempotencyKeyHeader, key)
+}
+
+// IdempotencyKey returns the key set on the given FContext with
+// SetIdempotencyKey, or an empty string if there is none.
+func IdempotencyKey(ctx FContext) string {
+	key, _ := ctx.RequestHeader(idempotencyKeyHeader)
+	return key
+}
+
+// NewIdempotencyKeyMiddleware returns ServiceMiddleware which deduplicates
+// requests carrying an idempotency key, as set with SetIdempotencyKey. The
+// results of the first successful invocation of a method with a given key are
+// cached for the given TTL and returned for later requests with the same key
+// without invoking the handler. Requests with the same key which arrive while
+// the first is in flight wait for its results. Invocations which return an
+// error aren't cached, so a retry after a failure invokes the handler again.
+// Requests without a key are not affected. Apply it to a processor with
+// AddMiddleware:
+//
+//	processor.AddMiddleware(frugal.NewIdempotencyKeyMiddleware(10 * time.Minute))
+//
+// The cache is held in memory, so duplicates are only detected by the server
+// instance which processed the original request.
+func NewIdempotencyKeyMiddleware(ttl time.Duration) ServiceMiddleware {
+	cache := newIdempotencyCache(ttl)
+	return func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			key := IdempotencyKey(args.Context())
+			if key == "" {
+				return next(service, method, args)
+			}
+			key = method.Name + "/" + key
+			for {
+				entry, owner := cache.acquire(key)
+				if owner {
+					results := next(service, method, args)
+					cache.complete(key, entry, results)
+					return results
+				}
+				<-entry.done
+				if entry.results != nil {
+					return entry.results
+				}
+				// The first invocation failed, so try this one.
+			}
+		}
+	}
+}
+
+// idempotencyCache holds the results of invocations by idempotency key.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+// idempotencyEntry is an invocation in flight or its cached results. The done
+// channel is closed when the invocation completes, after which results is nil
+// if it failed.
+type idempotencyEntry struct {
+	done    chan struct{}
+	results Results
+	expires time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:       ttl,
+		entries:   make(map[string]*idempotencyEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// acquire returns the entry for the given key. If there is no current entry,
+// a new one is added and owner is true, in which case the caller must invoke
+// the handler and complete the entry.
+func (c *idempotencyCache) acquire(key string) (entry *idempotencyEntry, owner bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.sweep(now)
+	if entry, ok := c.entries[key]; ok && (!isClosed(entry.done) || now.Before(entry.expires)) {
+		return entry, false
+	}
+	entry = &idempotencyEntry{done: make(chan struct{})}
+	c.entries[key] = entry
+	return entry, true
+}
+
+// complete records the results of the invocation for the given entry,
+// caching them if the invocation succeeded and releasing any waiters.
+func (c *idempotencyCache) complete(key string, entry *idempotencyEntry, results Results) {
+	c.mu.Lock()
+	if results.Error() == nil {
+		entry.results = results
+		entry.expires = time.Now().Add(c.ttl)
+	} else if c.entries[key] == entry {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(entry.done)
+}
+
+// sweep removes expired entries, at most once per TTL. The caller must hold
+// the lock.
+func (c *idempotencyCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+	for key, entry := range c.entries {
+		if isClosed(entry.done) && !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// isClosed indicates if the given channel has been closed.
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
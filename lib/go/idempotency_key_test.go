@@ -0,0 +1,110 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures the idempotency key is set in a reserved request header.
+func TestSetIdempotencyKey(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("")
+	assert.Equal("", IdempotencyKey(ctx))
+	SetIdempotencyKey(ctx, "abc")
+	assert.Equal("abc", IdempotencyKey(ctx))
+	assert.True(IsReservedRequestHeader(idempotencyKeyHeader))
+}
+
+// Ensures requests with the same idempotency key are processed once and the
+// cached results returned for duplicates until the TTL elapses.
+func TestIdempotencyKeyMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	var calls int32
+	handler := NewIdempotencyKeyMiddleware(50 * time.Millisecond)(
+		func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			return Results{atomic.AddInt32(&calls, 1), nil}
+		})
+	invoke := func(key string) interface{} {
+		ctx := NewFContext("")
+		if key != "" {
+			SetIdempotencyKey(ctx, key)
+		}
+		return handler(reflect.Value{}, reflect.Method{Name: "Mutate"}, Arguments{ctx})[0]
+	}
+
+	assert.Equal(int32(1), invoke("a"))
+	assert.Equal(int32(1), invoke("a"))
+	assert.Equal(int32(2), invoke("b"))
+	assert.Equal(int32(3), invoke(""))
+	assert.Equal(int32(4), invoke(""))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(int32(5), invoke("a"))
+}
+
+// Ensures failed invocations aren't cached and concurrent duplicates wait for
+// the first invocation.
+func TestIdempotencyKeyMiddlewareFailure(t *testing.T) {
+	assert := assert.New(t)
+	var calls int32
+	release := make(chan struct{})
+	handler := NewIdempotencyKeyMiddleware(time.Minute)(
+		func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				<-release
+				return Results{nil, errors.New("error")}
+			}
+			return Results{"ok", nil}
+		})
+	invoke := func() Results {
+		ctx := NewFContext("")
+		SetIdempotencyKey(ctx, "a")
+		return handler(reflect.Value{}, reflect.Method{Name: "Mutate"}, Arguments{ctx})
+	}
+
+	var wg sync.WaitGroup
+	results := make([]Results, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = invoke()
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+	close(release)
+	wg.Wait()
+
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+	errs := 0
+	for _, result := range results {
+		if result.Error() != nil {
+			errs++
+		} else {
+			assert.Equal("ok", result[0])
+		}
+	}
+	assert.Equal(1, errs)
+	assert.Equal("ok", invoke()[0])
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,32 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+// Header marking a request as safe to send more than once ("true" if set)
+const idempotentHeader = "_idempotent"
+
+// SetIdempotent marks requests made with the given FContext as idempotent,
+// meaning the server may safely process them more than once. Transports use
+// this to decide which requests can be re-sent after a failure. The flag is
+// sent in the reserved "_idempotent" request header.
+func SetIdempotent(ctx FContext) {
+	setRequestHeader(ctx, idempotentHeader, "true")
+}
+
+// IsIdempotent returns true if the given FContext was marked with
+// SetIdempotent.
+func IsIdempotent(ctx FContext) bool {
+	value, _ := ctx.RequestHeader(idempotentHeader)
+	return value == "true"
+}
@@ -0,0 +1,30 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures SetIdempotent marks the context as idempotent with a reserved
+// header.
+func TestIdempotent(t *testing.T) {
+	ctx := NewFContext("")
+	assert.False(t, IsIdempotent(ctx))
+	SetIdempotent(ctx)
+	assert.True(t, IsIdempotent(ctx))
+	assert.True(t, IsReservedRequestHeader(idempotentHeader))
+}
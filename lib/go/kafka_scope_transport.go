@@ -0,0 +1,356 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// kafkaMaxMessageSize is the default maximum size of Kafka messages, matching
+// the broker's default message.max.bytes.
+const kafkaMaxMessageSize = 1024 * 1024
+
+// FKafkaProducer sends messages to Kafka. Frugal doesn't depend on a Kafka
+// client, so implement it with the client of your choice, such as by wrapping
+// a synchronous producer.
+type FKafkaProducer interface {
+	// Produce sends a message with the given key, which is nil when there is
+	// no partition key, and value to the given topic, returning once the
+	// message has been acknowledged.
+	Produce(topic string, key, value []byte) error
+}
+
+// FKafkaRecord is a message to send to Kafka as part of a batch.
+type FKafkaRecord struct {
+	Topic string
+	Key   []byte
+	Value []byte
+}
+
+// FKafkaBatchProducer is an FKafkaProducer which can send a batch of records
+// in one request. Kafka publisher transports use it to publish batches when
+// their producer implements it, and send each record with Produce otherwise.
+type FKafkaBatchProducer interface {
+	FKafkaProducer
+
+	// ProduceBatch sends the given records, returning once they've been
+	// acknowledged. It returns nil if they were all sent, and otherwise the
+	// error sending each record, which is nil for those that were sent.
+	ProduceBatch(records []FKafkaRecord) []error
+}
+
+// FKafkaConsumer receives messages from Kafka as a member of a consumer
+// group. Frugal doesn't depend on a Kafka client, so implement it with the
+// client of your choice.
+type FKafkaConsumer interface {
+	// Consume joins the given consumer group and calls the handler with the
+	// value of each message received from the given topic until the
+	// returned io.Closer is closed. Offsets should only be committed once
+	// the handler returns nil, so messages which fail to be handled are
+	// redelivered. An *FRedeliveryError means the handler deferred the
+	// message, which should be redelivered after its delay if possible.
+	Consume(topic, group string, handler func(value []byte) error) (io.Closer, error)
+}
+
+// FKafkaPublisherTransportFactoryBuilder configures and builds factories of
+// FPublisherTransports publishing to Kafka.
+type FKafkaPublisherTransportFactoryBuilder struct {
+	producer         FKafkaProducer
+	keyHeader        string
+	topicMapper      func(string) string
+	publishSizeLimit uint
+}
+
+// NewFKafkaPublisherTransportFactoryBuilder creates a builder which configures
+// and builds factories of FPublisherTransports publishing with the given
+// producer.
+func NewFKafkaPublisherTransportFactoryBuilder(producer FKafkaProducer) *FKafkaPublisherTransportFactoryBuilder {
+	return &FKafkaPublisherTransportFactoryBuilder{
+		producer:         producer,
+		publishSizeLimit: kafkaMaxMessageSize,
+	}
+}
+
+// WithPartitionKeyHeader uses the value of the given FContext request header
+// as the key of published messages, so messages with the same value, such
+// as a tenant or entity id, are delivered in order by the same partition.
+// Messages published without the header have no key and are spread across
+// partitions by the producer.
+func (k *FKafkaPublisherTransportFactoryBuilder) WithPartitionKeyHeader(header string) *FKafkaPublisherTransportFactoryBuilder {
+	k.keyHeader = header
+	return k
+}
+
+// WithTopicMapper maps scope topics to the Kafka topics messages are
+// published to, such as to follow an existing naming convention. Subscribers
+// must map topics the same way. By default, messages are published to the
+// scope topic unchanged.
+func (k *FKafkaPublisherTransportFactoryBuilder) WithTopicMapper(mapper func(string) string) *FKafkaPublisherTransportFactoryBuilder {
+	k.topicMapper = mapper
+	return k
+}
+
+// WithPublishSizeLimit sets the maximum size of published messages, which
+// should match the broker's message.max.bytes. Defaults to 1MB.
+func (k *FKafkaPublisherTransportFactoryBuilder) WithPublishSizeLimit(limit uint) *FKafkaPublisherTransportFactoryBuilder {
+	k.publishSizeLimit = limit
+	return k
+}
+
+// Build a new configured Kafka FPublisherTransportFactory.
+func (k *FKafkaPublisherTransportFactoryBuilder) Build() FPublisherTransportFactory {
+	return &fKafkaPublisherTransportFactory{
+		producer:         k.producer,
+		keyHeader:        k.keyHeader,
+		topicMapper:      k.topicMapper,
+		publishSizeLimit: k.publishSizeLimit,
+	}
+}
+
+type fKafkaPublisherTransportFactory struct {
+	producer         FKafkaProducer
+	keyHeader        string
+	topicMapper      func(string) string
+	publishSizeLimit uint
+}
+
+// GetTransport creates a new Kafka FPublisherTransport.
+func (k *fKafkaPublisherTransportFactory) GetTransport() FPublisherTransport {
+	return &fKafkaPublisherTransport{fKafkaPublisherTransportFactory: k}
+}
+
+// fKafkaPublisherTransport implements FPublisherTransport.
+type fKafkaPublisherTransport struct {
+	*fKafkaPublisherTransportFactory
+	mu     sync.RWMutex
+	isOpen bool
+}
+
+// Open initializes the transport.
+func (k *fKafkaPublisherTransport) Open() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.isOpen = true
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (k *fKafkaPublisherTransport) IsOpen() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.isOpen
+}
+
+// Close closes the transport. The producer is owned by the caller and is not
+// closed.
+func (k *fKafkaPublisherTransport) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.isOpen = false
+	return nil
+}
+
+// GetPublishSizeLimit returns the maximum allowable size of a payload
+// to be published. A non-positive number is returned to indicate an
+// unbounded allowable size.
+func (k *fKafkaPublisherTransport) GetPublishSizeLimit() uint {
+	return k.publishSizeLimit
+}
+
+// Publish sends the given frame to the Kafka topic for the given scope topic,
+// keyed by the configured partition key header.
+func (k *fKafkaPublisherTransport) Publish(topic string, data []byte) error {
+	if err := k.checkPublish(data); err != nil {
+		return err
+	}
+	if err := k.producer.Produce(mapKafkaTopic(k.topicMapper, topic), k.partitionKey(data), data); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	return nil
+}
+
+// PublishBatch sends the given frames to the Kafka topics for their scope
+// topics in one record batch if the producer is an FKafkaBatchProducer.
+func (k *fKafkaPublisherTransport) PublishBatch(messages []FBatchMessage) error {
+	batcher, ok := k.producer.(FKafkaBatchProducer)
+	if !ok {
+		errs := make([]error, len(messages))
+		for i, message := range messages {
+			errs[i] = k.Publish(message.Topic, message.Frame)
+		}
+		return newBatchPublishError(errs)
+	}
+
+	errs := make([]error, len(messages))
+	records := make([]FKafkaRecord, 0, len(messages))
+	indexes := make([]int, 0, len(messages))
+	for i, message := range messages {
+		if errs[i] = k.checkPublish(message.Frame); errs[i] != nil {
+			continue
+		}
+		records = append(records, FKafkaRecord{
+			Topic: mapKafkaTopic(k.topicMapper, message.Topic),
+			Key:   k.partitionKey(message.Frame),
+			Value: message.Frame,
+		})
+		indexes = append(indexes, i)
+	}
+	if len(records) > 0 {
+		for j, err := range batcher.ProduceBatch(records) {
+			if err != nil && j < len(indexes) {
+				errs[indexes[j]] = thrift.NewTTransportExceptionFromError(err)
+			}
+		}
+	}
+	return newBatchPublishError(errs)
+}
+
+// checkPublish returns an error if the given frame can't be published.
+func (k *fKafkaPublisherTransport) checkPublish(data []byte) error {
+	if !k.IsOpen() {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: Kafka FPublisherTransport not open")
+	}
+	if limit := k.publishSizeLimit; limit > 0 && uint(len(data)) > limit {
+		return thrift.NewTTransportException(
+			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", limit, len(data)))
+	}
+	return nil
+}
+
+// partitionKey returns the value of the partition key header in the given
+// frame, or nil if it isn't set.
+func (k *fKafkaPublisherTransport) partitionKey(frame []byte) []byte {
+	if k.keyHeader == "" || len(frame) < 4 {
+		return nil
+	}
+	headers, err := getHeadersFromFrame(frame[4:])
+	if err != nil {
+		return nil
+	}
+	if key, ok := headers[k.keyHeader]; ok {
+		return []byte(key)
+	}
+	return nil
+}
+
+func mapKafkaTopic(mapper func(string) string, topic string) string {
+	if mapper == nil {
+		return topic
+	}
+	return mapper(topic)
+}
+
+// FKafkaSubscriberTransportFactory creates Kafka FSubscriberTransports.
+type FKafkaSubscriberTransportFactory struct {
+	consumer    FKafkaConsumer
+	group       string
+	topicMapper func(string) string
+}
+
+// NewFKafkaSubscriberTransportFactory creates an
+// FKafkaSubscriberTransportFactory whose transports consume with the given
+// consumer as members of the given consumer group, so each message is
+// handled by one member of the group.
+func NewFKafkaSubscriberTransportFactory(consumer FKafkaConsumer, group string) *FKafkaSubscriberTransportFactory {
+	return &FKafkaSubscriberTransportFactory{consumer: consumer, group: group}
+}
+
+// WithTopicMapper maps scope topics to the Kafka topics messages are consumed
+// from, matching the mapping used by publishers.
+func (k *FKafkaSubscriberTransportFactory) WithTopicMapper(mapper func(string) string) *FKafkaSubscriberTransportFactory {
+	k.topicMapper = mapper
+	return k
+}
+
+// GetTransport creates a new Kafka FSubscriberTransport.
+func (k *FKafkaSubscriberTransportFactory) GetTransport() FSubscriberTransport {
+	return &fKafkaSubscriberTransport{
+		consumer:    k.consumer,
+		group:       k.group,
+		topicMapper: k.topicMapper,
+	}
+}
+
+// fKafkaSubscriberTransport implements FSubscriberTransport.
+type fKafkaSubscriberTransport struct {
+	consumer    FKafkaConsumer
+	group       string
+	topicMapper func(string) string
+
+	mu           sync.RWMutex
+	subscription io.Closer
+}
+
+// Subscribe joins the consumer group for the Kafka topic for the given scope
+// topic.
+func (k *fKafkaSubscriberTransport) Subscribe(topic string, callback FAsyncCallback) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.subscription != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: Kafka transport already open")
+	}
+	if topic == "" {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"cannot subscribe to empty topic")
+	}
+
+	subscription, err := k.consumer.Consume(mapKafkaTopic(k.topicMapper, topic), k.group, handleAckedMessage(callback))
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	k.subscription = subscription
+	return nil
+}
+
+// handleAckedMessage returns a handler executing the callback for each frame
+// of a broker which redelivers messages until they're acknowledged. Callback
+// errors are returned so the message isn't acknowledged.
+func handleAckedMessage(callback FAsyncCallback) func([]byte) error {
+	return func(value []byte) error {
+		if len(value) < 4 {
+			logger().Warn("frugal: Discarding invalid scope message frame")
+			return nil
+		}
+		return invokeAcked(callback, value[4:])
+	}
+}
+
+// IsSubscribed returns true if the transport is subscribed to a topic, false
+// otherwise.
+func (k *fKafkaSubscriberTransport) IsSubscribed() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.subscription != nil
+}
+
+// Unsubscribe leaves the consumer group.
+func (k *fKafkaSubscriberTransport) Unsubscribe() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.subscription == nil {
+		return nil
+	}
+	if err := k.subscription.Close(); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	k.subscription = nil
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+type kafkaMessage struct {
+	topic      string
+	key, value []byte
+}
+
+// mockKafka is an in-memory FKafkaProducer and FKafkaConsumer delivering each
+// produced message to the handlers subscribed to its topic.
+type mockKafka struct {
+	mu       sync.Mutex
+	produced []kafkaMessage
+	handlers map[string]func([]byte) error
+	failures int
+}
+
+func newMockKafka() *mockKafka {
+	return &mockKafka{handlers: make(map[string]func([]byte) error)}
+}
+
+func (m *mockKafka) Produce(topic string, key, value []byte) error {
+	m.mu.Lock()
+	m.produced = append(m.produced, kafkaMessage{topic: topic, key: key, value: value})
+	handler := m.handlers[topic]
+	m.mu.Unlock()
+	if handler != nil && handler(value) != nil {
+		m.mu.Lock()
+		m.failures++
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+func (m *mockKafka) Consume(topic, group string, handler func([]byte) error) (io.Closer, error) {
+	if group == "" {
+		return nil, errors.New("missing group")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[topic] = handler
+	return closerFunc(func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.handlers, topic)
+		return nil
+	}), nil
+}
+
+type closerFunc func() error
+
+func (c closerFunc) Close() error {
+	return c()
+}
+
+func newKafkaFrame(t *testing.T, headers map[string]string, payload string) []byte {
+	ctx := NewFContext("cid")
+	for name, value := range headers {
+		ctx.AddRequestHeader(name, value)
+	}
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).GetProtocol(buffer)
+	assert.Nil(t, proto.WriteRequestHeader(ctx))
+	assert.Nil(t, proto.WriteString(payload))
+	return buffer.Bytes()
+}
+
+// Ensures published frames are keyed by the partition key header and
+// delivered to subscribers of the mapped topic.
+func TestKafkaScopeTransportPublishSubscribe(t *testing.T) {
+	assert := assert.New(t)
+	kafka := newMockKafka()
+	mapper := func(topic string) string { return "events." + topic }
+
+	subscriber := NewFKafkaSubscriberTransportFactory(kafka, "group").WithTopicMapper(mapper).GetTransport()
+	received := make(chan []byte, 2)
+	assert.Nil(subscriber.Subscribe("foo", func(transport thrift.TTransport) error {
+		payload, err := ioutil.ReadAll(transport)
+		received <- payload
+		return err
+	}))
+	assert.True(subscriber.IsSubscribed())
+	assert.Error(subscriber.Subscribe("foo", nil))
+
+	publisher := NewFKafkaPublisherTransportFactoryBuilder(kafka).
+		WithPartitionKeyHeader("tenant").
+		WithTopicMapper(mapper).
+		Build().
+		GetTransport()
+	assert.Error(publisher.Publish("foo", newKafkaFrame(t, nil, "closed")))
+	assert.Nil(publisher.Open())
+	assert.Equal(uint(kafkaMaxMessageSize), publisher.GetPublishSizeLimit())
+
+	keyed := newKafkaFrame(t, map[string]string{"tenant": "acme"}, "keyed")
+	assert.Nil(publisher.Publish("foo", keyed))
+	unkeyed := newKafkaFrame(t, nil, "unkeyed")
+	assert.Nil(publisher.Publish("foo", unkeyed))
+
+	assert.Equal("events.foo", kafka.produced[0].topic)
+	assert.Equal([]byte("acme"), kafka.produced[0].key)
+	assert.Nil(kafka.produced[1].key)
+	assert.Equal(keyed[4:], <-received)
+	assert.Equal(unkeyed[4:], <-received)
+
+	assert.Nil(subscriber.Unsubscribe())
+	assert.False(subscriber.IsSubscribed())
+	assert.Nil(publisher.Publish("foo", unkeyed))
+	assert.Len(received, 0)
+	assert.Nil(publisher.Close())
+}
+
+// Ensures callback errors are returned to the consumer so the message isn't
+// committed, and frames over the size limit aren't published.
+func TestKafkaScopeTransportErrors(t *testing.T) {
+	assert := assert.New(t)
+	kafka := newMockKafka()
+	subscriber := NewFKafkaSubscriberTransportFactory(kafka, "group").GetTransport()
+	assert.Nil(subscriber.Subscribe("foo", func(thrift.TTransport) error { return errors.New("failed") }))
+	assert.Error(NewFKafkaSubscriberTransportFactory(kafka, "").GetTransport().Subscribe("bar", nil))
+
+	publisher := NewFKafkaPublisherTransportFactoryBuilder(kafka).WithPublishSizeLimit(100).Build().GetTransport()
+	assert.Nil(publisher.Open())
+	assert.Nil(publisher.Publish("foo", newKafkaFrame(t, nil, "x")))
+	assert.Equal(1, kafka.failures)
+
+	err := publisher.Publish("foo", make([]byte, 101))
+	assert.Equal(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, err.(thrift.TTransportException).TypeId())
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// FLambdaHandler serves frugal requests from AWS Lambda invocations, so
+// services can be deployed without running a server. It handles both API
+// Gateway proxy events, which carry a request in the same format as an
+// FHTTPTransport, and direct invocations with a payload of the form
+// {"frame": "<base64 frame>"}, which are answered in the same form.
+//
+// FLambdaHandler implements the Handler interface of the aws-lambda-go
+// package, so it can be started with:
+//
+//	lambda.StartHandler(frugal.NewFLambdaHandler(processor, protocolFactory))
+type FLambdaHandler struct {
+	processor       FProcessor
+	protocolFactory *FProtocolFactory
+	handler         http.Handler
+}
+
+// NewFLambdaHandler creates a new FLambdaHandler which processes requests with
+// the given FProcessor. API Gateway requests are served as by
+// NewFrugalHandlerFunc with the given options.
+func NewFLambdaHandler(processor FProcessor, protocolFactory *FProtocolFactory, options ...FHTTPHandlerOption) *FLambdaHandler {
+	return &FLambdaHandler{
+		processor:       processor,
+		protocolFactory: protocolFactory,
+		handler:         NewFrugalHandlerFunc(processor, protocolFactory, options...),
+	}
+}
+
+// lambdaEvent holds the fields of the invocation payloads FLambdaHandler
+// handles. Direct invocations set Frame, while API Gateway REST and HTTP API
+// events set Body.
+type lambdaEvent struct {
+	Frame           *string           `json:"frame"`
+	HTTPMethod      string            `json:"httpMethod"`
+	Path            string            `json:"path"`
+	RawPath         string            `json:"rawPath"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	RequestContext  struct {
+		HTTP struct {
+			Method string `json:"method"`
+		} `json:"http"`
+	} `json:"requestContext"`
+}
+
+// lambdaDirectResponse is the response to a direct invocation.
+type lambdaDirectResponse struct {
+	Frame string `json:"frame"`
+}
+
+// lambdaProxyResponse is the response to an API Gateway proxy event.
+type lambdaProxyResponse struct {
+	StatusCode      int               `json:"statusCode"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+}
+
+// Invoke handles the given Lambda invocation payload, returning the response
+// payload.
+func (h *FLambdaHandler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	var event lambdaEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	if event.Frame != nil {
+		return h.invokeDirect(*event.Frame)
+	}
+	return h.invokeProxy(ctx, &event)
+}
+
+// invokeDirect processes the given base64 encoded frame.
+func (h *FLambdaHandler) invokeDirect(encoded string) ([]byte, error) {
+	frame, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) < 4 {
+		return nil, errors.New("frugal: invalid frame in lambda invocation")
+	}
+	output := new(bytes.Buffer)
+	err = h.processor.Process(
+		h.protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])}),
+		h.protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: output}))
+	if err != nil {
+		logger().Warn("frugal: error processing lambda invocation: ", err)
+		return nil, err
+	}
+	return json.Marshal(lambdaDirectResponse{
+		Frame: base64.StdEncoding.EncodeToString(prependFrameSize(output.Bytes())),
+	})
+}
+
+// invokeProxy serves the request in the given API Gateway event with the HTTP
+// handler.
+func (h *FLambdaHandler) invokeProxy(ctx context.Context, event *lambdaEvent) ([]byte, error) {
+	body := []byte(event.Body)
+	if event.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(event.Body); err != nil {
+			return nil, err
+		}
+	}
+	method := event.HTTPMethod
+	if method == "" {
+		method = event.RequestContext.HTTP.Method
+	}
+	if method == "" {
+		method = http.MethodPost
+	}
+	path := event.Path
+	if path == "" {
+		path = event.RawPath
+	}
+	if path == "" {
+		path = "/"
+	}
+	request, err := http.NewRequest(method, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range event.Headers {
+		request.Header.Set(name, value)
+	}
+
+	writer := &lambdaResponseWriter{header: make(http.Header)}
+	h.handler.ServeHTTP(writer, request.WithContext(ctx))
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	headers := make(map[string]string, len(writer.header))
+	for name, values := range writer.header {
+		headers[name] = strings.Join(values, ", ")
+	}
+	response := lambdaProxyResponse{StatusCode: writer.status, Headers: headers, Body: writer.body.String()}
+	// Compressed responses aren't text, so they must be base64 encoded.
+	if writer.header.Get(contentEncodingHeader) != "" {
+		response.Body = base64.StdEncoding.EncodeToString(writer.body.Bytes())
+		response.IsBase64Encoded = true
+	}
+	return json.Marshal(response)
+}
+
+// lambdaResponseWriter is an http.ResponseWriter buffering the response to an
+// API Gateway event.
+type lambdaResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (l *lambdaResponseWriter) Header() http.Header {
+	return l.header
+}
+
+func (l *lambdaResponseWriter) Write(p []byte) (int, error) {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	return l.body.Write(p)
+}
+
+func (l *lambdaResponseWriter) WriteHeader(status int) {
+	if l.status == 0 {
+		l.status = status
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+func newLambdaRequest(t *testing.T) []byte {
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("user", "alice")
+	buffer := NewTMemoryOutputBuffer(0)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	assert.Nil(t, protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx))
+	return buffer.Bytes()
+}
+
+func readLambdaResponse(t *testing.T, encoded string) string {
+	frame, err := base64.StdEncoding.DecodeString(encoded)
+	assert.Nil(t, err)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	proto := protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	assert.Nil(t, proto.ReadResponseHeader(NewFContext("")))
+	user, err := proto.ReadString()
+	assert.Nil(t, err)
+	return user
+}
+
+// Ensures direct invocations are processed and answered with the response
+// frame.
+func TestLambdaHandlerDirect(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := NewFLambdaHandler(&headerProcessor{}, protocolFactory)
+
+	payload, _ := json.Marshal(map[string]string{
+		"frame": base64.StdEncoding.EncodeToString(newLambdaRequest(t)),
+	})
+	result, err := handler.Invoke(context.Background(), payload)
+	assert.Nil(err)
+	var response lambdaDirectResponse
+	assert.Nil(json.Unmarshal(result, &response))
+	assert.Equal("alice", readLambdaResponse(t, response.Frame))
+
+	_, err = handler.Invoke(context.Background(), []byte(`{"frame": "AAA="}`))
+	assert.NotNil(err)
+	_, err = handler.Invoke(context.Background(), []byte(`{"frame": "!"}`))
+	assert.NotNil(err)
+	_, err = handler.Invoke(context.Background(), []byte(`[]`))
+	assert.NotNil(err)
+}
+
+// Ensures API Gateway REST and HTTP API events are served like HTTP requests.
+func TestLambdaHandlerAPIGateway(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := NewFLambdaHandler(&headerProcessor{}, protocolFactory)
+	body := base64.StdEncoding.EncodeToString(newLambdaRequest(t))
+
+	for _, event := range []map[string]interface{}{
+		{
+			"httpMethod": "POST",
+			"path":       "/frugal",
+			"headers":    map[string]string{"Content-Type": frugalContentType},
+			"body":       body,
+		},
+		{
+			"rawPath":         "/frugal",
+			"requestContext":  map[string]interface{}{"http": map[string]string{"method": "POST"}},
+			"body":            base64.StdEncoding.EncodeToString([]byte(body)),
+			"isBase64Encoded": true,
+		},
+	} {
+		payload, _ := json.Marshal(event)
+		result, err := handler.Invoke(context.Background(), payload)
+		assert.Nil(err)
+		var response lambdaProxyResponse
+		assert.Nil(json.Unmarshal(result, &response))
+		assert.Equal(http.StatusOK, response.StatusCode)
+		assert.Equal(frugalContentType, response.Headers["Content-Type"])
+		assert.False(response.IsBase64Encoded)
+		assert.Equal("alice", readLambdaResponse(t, response.Body))
+	}
+
+	result, err := handler.Invoke(context.Background(), []byte(`{"httpMethod": "POST", "body": "AA=="}`))
+	assert.Nil(err)
+	var response lambdaProxyResponse
+	assert.Nil(json.Unmarshal(result, &response))
+	assert.Equal(http.StatusBadRequest, response.StatusCode)
+}
@@ -0,0 +1,382 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// FLoadBalancingPolicy controls how an FLoadBalancedTransport chooses the
+// backend for each request.
+type FLoadBalancingPolicy int
+
+const (
+	// LoadBalanceRoundRobin sends requests to each backend in turn. This is
+	// the default.
+	LoadBalanceRoundRobin FLoadBalancingPolicy = iota
+
+	// LoadBalanceLeastOutstanding sends requests to the backend with the
+	// fewest requests in flight, so slow backends receive fewer requests.
+	LoadBalanceLeastOutstanding
+
+	// LoadBalanceWeighted sends requests to each backend in proportion to its
+	// weight, interleaving them smoothly.
+	LoadBalanceWeighted
+)
+
+// FLoadBalancedTransport is an FTransport which distributes requests across a
+// set of backend FTransports, which can be added and removed at runtime.
+// Backends which keep failing can be ejected for a while with WithEjection,
+// and backends can be probed before and while receiving requests with
+// WithHealthProbes. Backends which aren't open, are ejected, or are unhealthy
+// are skipped unless no other backend is available.
+type FLoadBalancedTransport struct {
+	*fBaseTransport
+	policy        FLoadBalancingPolicy
+	ejectFailures uint
+	ejectDuration time.Duration
+	hedgeDelay    time.Duration
+	probes        *lbProbes
+
+	mu       sync.Mutex
+	backends []*lbBackend
+	next     int
+	isOpen   bool
+}
+
+// lbBackend is a backend of an FLoadBalancedTransport.
+type lbBackend struct {
+	name      string
+	transport FTransport
+	weight    int
+
+	// The following are guarded by the FLoadBalancedTransport's lock.
+	outstanding   int
+	currentWeight int
+	failures      uint
+	ejectedUntil  time.Time
+	unhealthy     bool
+}
+
+// NewFLoadBalancedTransport creates a new FLoadBalancedTransport without any
+// backends, which chooses backends with the given policy.
+func NewFLoadBalancedTransport(policy FLoadBalancingPolicy) *FLoadBalancedTransport {
+	return &FLoadBalancedTransport{
+		fBaseTransport: newFBaseTransport(0),
+		policy:         policy,
+	}
+}
+
+// WithEjection ejects backends which fail the given number of consecutive
+// requests with a transport error, such as timing out, for the given
+// duration. Returns the same FLoadBalancedTransport to allow for chaining
+// calls.
+func (f *FLoadBalancedTransport) WithEjection(failures uint, duration time.Duration) *FLoadBalancedTransport {
+	f.ejectFailures = failures
+	f.ejectDuration = duration
+	return f
+}
+
+// AddBackend adds the given FTransport as a backend with the given name and
+// weight, replacing any backend with the same name. The weight is only used
+// by LoadBalanceWeighted, and defaults to one. If the FLoadBalancedTransport
+// is open, the backend is opened if it isn't already.
+func (f *FLoadBalancedTransport) AddBackend(name string, transport FTransport, weight uint) error {
+	if weight == 0 {
+		weight = 1
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.isOpen && !transport.IsOpen() {
+		if err := transport.Open(); err != nil {
+			return err
+		}
+	}
+	backend := &lbBackend{name: name, transport: transport, weight: int(weight), unhealthy: f.probes != nil}
+	if f.isOpen && f.probes != nil {
+		go f.probe(backend)
+	}
+	for i, existing := range f.backends {
+		if existing.name == name {
+			f.backends[i] = backend
+			return nil
+		}
+	}
+	f.backends = append(f.backends, backend)
+	return nil
+}
+
+// RemoveBackend removes the backend with the given name, returning its
+// FTransport, or nil if there is no such backend. The FTransport isn't
+// closed, so requests in flight on it can complete before the caller closes
+// it.
+func (f *FLoadBalancedTransport) RemoveBackend(name string) FTransport {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, backend := range f.backends {
+		if backend.name == name {
+			f.backends = append(f.backends[:i], f.backends[i+1:]...)
+			return backend.transport
+		}
+	}
+	return nil
+}
+
+// Backends returns the names of the backends.
+func (f *FLoadBalancedTransport) Backends() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make([]string, len(f.backends))
+	for i, backend := range f.backends {
+		names[i] = backend.name
+	}
+	return names
+}
+
+// Open opens every backend which isn't already open. If any fails to open,
+// the backends opened are closed.
+func (f *FLoadBalancedTransport) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.isOpen {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: load balanced transport already open")
+	}
+	var opened []FTransport
+	for _, backend := range f.backends {
+		if backend.transport.IsOpen() {
+			continue
+		}
+		if err := backend.transport.Open(); err != nil {
+			for _, transport := range opened {
+				transport.Close()
+			}
+			return err
+		}
+		opened = append(opened, backend.transport)
+	}
+	f.isOpen = true
+	f.fBaseTransport.Open()
+	if f.probes != nil {
+		f.probes.stop = make(chan struct{})
+		go f.runProbes(f.probes.stop)
+	}
+	return nil
+}
+
+// IsOpen returns true if the transport has been opened and any backend is
+// open.
+func (f *FLoadBalancedTransport) IsOpen() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.isOpen {
+		return false
+	}
+	for _, backend := range f.backends {
+		if backend.transport.IsOpen() {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes every backend. The first error encountered is returned.
+func (f *FLoadBalancedTransport) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.isOpen {
+		return nil
+	}
+	f.isOpen = false
+	if f.probes != nil {
+		close(f.probes.stop)
+	}
+	var err error
+	for _, backend := range f.backends {
+		if closeErr := backend.transport.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	f.fBaseTransport.Close(nil)
+	return err
+}
+
+// Oneway transmits the given data on the next backend.
+func (f *FLoadBalancedTransport) Oneway(ctx FContext, data []byte) error {
+	backend, err := f.acquire(nil)
+	if err != nil {
+		return err
+	}
+	err = backend.transport.Oneway(ctx, data)
+	f.release(backend, err)
+	return err
+}
+
+// Request transmits the given data on the next backend and waits for a
+// response. With hedging, idempotent requests may also be sent to a second
+// backend.
+func (f *FLoadBalancedTransport) Request(ctx FContext, data []byte) (thrift.TTransport, error) {
+	if f.hedgeDelay > 0 && IsIdempotent(ctx) {
+		return f.hedgedRequest(ctx, data)
+	}
+	backend, err := f.acquire(nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := backend.transport.Request(ctx, data)
+	f.release(backend, err)
+	return response, err
+}
+
+// GetRequestSizeLimit returns the smallest request size limit of the
+// backends, or 0 if none of them are bounded.
+func (f *FLoadBalancedTransport) GetRequestSizeLimit() uint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var limit uint
+	for _, backend := range f.backends {
+		if backendLimit := backend.transport.GetRequestSizeLimit(); backendLimit > 0 &&
+			(limit == 0 || backendLimit < limit) {
+			limit = backendLimit
+		}
+	}
+	return limit
+}
+
+// SetMonitor is a no-op for FLoadBalancedTransport. Set monitors on its
+// backends instead.
+func (f *FLoadBalancedTransport) SetMonitor(monitor FTransportMonitor) {
+}
+
+// acquire chooses the backend for a request, other than the given backend,
+// and counts the request as outstanding on it. The request must be released.
+func (f *FLoadBalancedTransport) acquire(exclude *lbBackend) (*lbBackend, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.isOpen {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: load balanced transport not open")
+	}
+	candidates := f.candidates(exclude)
+	if len(candidates) == 0 {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: load balanced transport has no backends")
+	}
+	backend := f.choose(candidates)
+	backend.outstanding++
+	return backend, nil
+}
+
+// candidates returns the backends a request can be sent to: those which are
+// open, healthy, and not ejected, or if there are none, those which are
+// healthy and not ejected, or if there are none of those either, all of them,
+// so the request fails with a backend's error. The excluded backend is never
+// a candidate. The caller must hold the lock.
+func (f *FLoadBalancedTransport) candidates(exclude *lbBackend) []*lbBackend {
+	now := time.Now()
+	var available, admitted, all []*lbBackend
+	for _, backend := range f.backends {
+		if backend == exclude {
+			continue
+		}
+		all = append(all, backend)
+		if backend.unhealthy || now.Before(backend.ejectedUntil) {
+			continue
+		}
+		admitted = append(admitted, backend)
+		if backend.transport.IsOpen() {
+			available = append(available, backend)
+		}
+	}
+	if len(available) > 0 {
+		return available
+	}
+	if len(admitted) > 0 {
+		return admitted
+	}
+	return all
+}
+
+// choose chooses one of the given backends according to the policy. The
+// caller must hold the lock.
+func (f *FLoadBalancedTransport) choose(candidates []*lbBackend) *lbBackend {
+	f.next++
+	switch f.policy {
+	case LoadBalanceLeastOutstanding:
+		// Start at the next backend in turn so ties are spread evenly.
+		var chosen *lbBackend
+		for i := range candidates {
+			backend := candidates[(f.next+i)%len(candidates)]
+			if chosen == nil || backend.outstanding < chosen.outstanding {
+				chosen = backend
+			}
+		}
+		return chosen
+	case LoadBalanceWeighted:
+		// Smooth weighted round robin: each backend gains its weight, and
+		// the backend with the most is chosen and loses the total.
+		var chosen *lbBackend
+		total := 0
+		for _, backend := range candidates {
+			backend.currentWeight += backend.weight
+			total += backend.weight
+			if chosen == nil || backend.currentWeight > chosen.currentWeight {
+				chosen = backend
+			}
+		}
+		chosen.currentWeight -= total
+		return chosen
+	default:
+		return candidates[f.next%len(candidates)]
+	}
+}
+
+// release records the outcome of a request sent to the given backend,
+// ejecting it if it has failed too many consecutive requests.
+func (f *FLoadBalancedTransport) release(backend *lbBackend, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	backend.outstanding--
+	if !isBackendFailure(err) {
+		backend.failures = 0
+		return
+	}
+	backend.failures++
+	if f.ejectFailures > 0 && backend.failures >= f.ejectFailures {
+		logger().Warnf("frugal: ejecting backend %s for %s after %d consecutive failures: %s",
+			backend.name, f.ejectDuration, backend.failures, err)
+		backend.failures = 0
+		backend.ejectedUntil = time.Now().Add(f.ejectDuration)
+	}
+}
+
+// isBackendFailure indicates if a request which failed with the given error
+// counts against the backend it was sent to. Requests which were too large
+// or cancelled by the caller don't.
+func isBackendFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if e, ok := err.(thrift.TTransportException); ok {
+		switch e.TypeId() {
+		case TRANSPORT_EXCEPTION_CANCELLED, TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			TRANSPORT_EXCEPTION_RESPONSE_TOO_LARGE:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// lbTestTransport is an FTransport which records the requests sent on it and
+// fails them with err.
+type lbTestTransport struct {
+	mu       sync.Mutex
+	isOpen   bool
+	requests int
+	err      error
+	block    chan struct{}
+}
+
+func (l *lbTestTransport) SetMonitor(FTransportMonitor) {}
+func (l *lbTestTransport) Closed() <-chan error         { return nil }
+func (l *lbTestTransport) GetRequestSizeLimit() uint    { return 0 }
+
+func (l *lbTestTransport) Open() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.isOpen = true
+	return nil
+}
+
+func (l *lbTestTransport) IsOpen() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.isOpen
+}
+
+func (l *lbTestTransport) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.isOpen = false
+	return nil
+}
+
+func (l *lbTestTransport) Oneway(ctx FContext, payload []byte) error {
+	_, err := l.Request(ctx, payload)
+	return err
+}
+
+func (l *lbTestTransport) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	l.mu.Lock()
+	l.requests++
+	block, err := l.block, l.err
+	l.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	return nil, err
+}
+
+func (l *lbTestTransport) requestCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.requests
+}
+
+// Ensures requests are distributed evenly in turn, and backends can be added
+// and removed at runtime.
+func TestLoadBalancedTransportRoundRobin(t *testing.T) {
+	assert := assert.New(t)
+	a, b, c := &lbTestTransport{}, &lbTestTransport{}, &lbTestTransport{}
+	transport := NewFLoadBalancedTransport(LoadBalanceRoundRobin)
+	assert.Nil(transport.AddBackend("a", a, 0))
+	assert.Nil(transport.AddBackend("b", b, 0))
+	_, err := transport.Request(NewFContext(""), nil)
+	assert.Equal(TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+	assert.Nil(transport.Open())
+	assert.True(a.IsOpen())
+
+	for i := 0; i < 4; i++ {
+		_, err := transport.Request(NewFContext(""), nil)
+		assert.Nil(err)
+	}
+	assert.Equal(2, a.requestCount())
+	assert.Equal(2, b.requestCount())
+
+	assert.Nil(transport.AddBackend("c", c, 0))
+	assert.True(c.IsOpen())
+	assert.Equal(a, transport.RemoveBackend("a"))
+	assert.Nil(transport.RemoveBackend("a"))
+	assert.Equal([]string{"b", "c"}, transport.Backends())
+	for i := 0; i < 4; i++ {
+		assert.Nil(transport.Oneway(NewFContext(""), nil))
+	}
+	assert.Equal(2, a.requestCount())
+	assert.Equal(4, b.requestCount())
+	assert.Equal(2, c.requestCount())
+
+	assert.Nil(transport.Close())
+	assert.False(b.IsOpen())
+	assert.False(transport.IsOpen())
+}
+
+// Ensures requests are sent to the backend with the fewest in flight.
+func TestLoadBalancedTransportLeastOutstanding(t *testing.T) {
+	assert := assert.New(t)
+	slow, fast := &lbTestTransport{block: make(chan struct{})}, &lbTestTransport{}
+	transport := NewFLoadBalancedTransport(LoadBalanceLeastOutstanding)
+	assert.Nil(transport.AddBackend("slow", slow, 0))
+	assert.Nil(transport.AddBackend("fast", fast, 0))
+	assert.Nil(transport.Open())
+
+	done := make(chan struct{})
+	go func() {
+		for slow.requestCount() == 0 {
+			transport.Request(NewFContext(""), nil)
+		}
+		close(done)
+	}()
+	for slow.requestCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	fastRequests := fast.requestCount()
+	for i := 0; i < 3; i++ {
+		_, err := transport.Request(NewFContext(""), nil)
+		assert.Nil(err)
+	}
+	assert.Equal(fastRequests+3, fast.requestCount())
+	assert.Equal(1, slow.requestCount())
+	close(slow.block)
+	<-done
+}
+
+// Ensures requests are distributed in proportion to backend weights.
+func TestLoadBalancedTransportWeighted(t *testing.T) {
+	assert := assert.New(t)
+	heavy, light := &lbTestTransport{}, &lbTestTransport{}
+	transport := NewFLoadBalancedTransport(LoadBalanceWeighted)
+	assert.Nil(transport.AddBackend("heavy", heavy, 3))
+	assert.Nil(transport.AddBackend("light", light, 1))
+	assert.Nil(transport.Open())
+
+	for i := 0; i < 8; i++ {
+		transport.Request(NewFContext(""), nil)
+	}
+	assert.Equal(6, heavy.requestCount())
+	assert.Equal(2, light.requestCount())
+}
+
+// Ensures backends which keep failing are ejected until the ejection
+// duration elapses, and closed backends are skipped.
+func TestLoadBalancedTransportEjection(t *testing.T) {
+	assert := assert.New(t)
+	failing := &lbTestTransport{err: thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "timeout")}
+	healthy := &lbTestTransport{}
+	transport := NewFLoadBalancedTransport(LoadBalanceRoundRobin).WithEjection(2, 20*time.Millisecond)
+	assert.Nil(transport.AddBackend("failing", failing, 0))
+	assert.Nil(transport.AddBackend("healthy", healthy, 0))
+	assert.Nil(transport.Open())
+
+	for i := 0; i < 4; i++ {
+		transport.Request(NewFContext(""), nil)
+	}
+	assert.Equal(2, failing.requestCount())
+	for i := 0; i < 4; i++ {
+		transport.Request(NewFContext(""), nil)
+	}
+	assert.Equal(2, failing.requestCount())
+	assert.Equal(6, healthy.requestCount())
+
+	time.Sleep(25 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		transport.Request(NewFContext(""), nil)
+	}
+	assert.Equal(3, failing.requestCount())
+
+	failing.Close()
+	for i := 0; i < 2; i++ {
+		transport.Request(NewFContext(""), nil)
+	}
+	assert.Equal(3, failing.requestCount())
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// fLoopbackTransport implements FTransport by passing requests directly to an
+// FProcessor in the same process.
+type fLoopbackTransport struct {
+	processor       FProcessor
+	protocolFactory *FProtocolFactory
+
+	mu     sync.RWMutex
+	isOpen bool
+	closed chan error
+
+	streams *streamInboxes
+}
+
+// NewFLoopbackTransport returns an FTransport which processes requests with
+// the given FProcessor in the same process, without any network I/O. Requests
+// and responses are serialized with the given protocol factory exactly as
+// they would be over a network transport, so headers, opids and middleware
+// behave the same way. This is useful for testing services and clients
+// together and for embedding a service and its client in one binary.
+func NewFLoopbackTransport(processor FProcessor, protocolFactory *FProtocolFactory) FTransport {
+	return &fLoopbackTransport{
+		processor:       processor,
+		protocolFactory: protocolFactory,
+		streams:         newStreamInboxes(),
+	}
+}
+
+// Open prepares the transport to send data.
+func (l *fLoopbackTransport) Open() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isOpen {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: loopback transport already open")
+	}
+	l.isOpen = true
+	l.closed = make(chan error, 1)
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (l *fLoopbackTransport) IsOpen() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.isOpen
+}
+
+// Close closes the transport.
+func (l *fLoopbackTransport) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.isOpen {
+		return nil
+	}
+	l.isOpen = false
+	l.closed <- nil
+	close(l.closed)
+	return nil
+}
+
+// Closed channel receives the cause of an FTransport close (nil if clean
+// close).
+func (l *fLoopbackTransport) Closed() <-chan error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.closed
+}
+
+// SetMonitor is a no-op, the loopback transport can't fail.
+func (l *fLoopbackTransport) SetMonitor(monitor FTransportMonitor) {
+}
+
+// GetRequestSizeLimit returns 0, requests are unbounded.
+func (l *fLoopbackTransport) GetRequestSizeLimit() uint {
+	return 0
+}
+
+// Oneway processes the given data without waiting for it to complete.
+func (l *fLoopbackTransport) Oneway(ctx FContext, data []byte) error {
+	if !l.IsOpen() {
+		return l.notOpenError()
+	}
+	if len(data) == 4 {
+		return nil
+	}
+	go l.process(data, nil)
+	return nil
+}
+
+// Request processes the given data and waits for the response, respecting
+// the timeout and cancellation of the context.
+func (l *fLoopbackTransport) Request(ctx FContext, data []byte) (thrift.TTransport, error) {
+	if !l.IsOpen() {
+		return nil, l.notOpenError()
+	}
+	if len(data) == 4 {
+		return nil, nil
+	}
+
+	type result struct {
+		response []byte
+		err      error
+	}
+	resultC := make(chan result, 1)
+	go func() {
+		response, err := l.process(data, nil)
+		resultC <- result{response, err}
+	}()
+
+	select {
+	case r := <-resultC:
+		if r.err != nil {
+			return nil, thrift.NewTTransportExceptionFromError(r.err)
+		}
+		return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(r.response)}, nil
+	case <-contextDone(ctx):
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_CANCELLED, "frugal: loopback request cancelled")
+	case <-time.After(ctx.Timeout()):
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: loopback request timed out")
+	}
+}
+
+// RequestStream processes the given data and returns the stream of responses
+// to it, which are received as the processor produces them.
+func (l *fLoopbackTransport) RequestStream(ctx FContext, data []byte) (*FClientStream, error) {
+	queue := newStreamQueue()
+	conn, err := l.openStream(ctx, data, queue)
+	if err != nil {
+		return nil, err
+	}
+	return newFClientStream(ctx, queue, conn.close), nil
+}
+
+// openStream processes the given data, delivering its responses to the given
+// queue. Further frames for the stream are delivered straight to the
+// processor's stream.
+func (l *fLoopbackTransport) openStream(ctx FContext, data []byte, queue *streamQueue) (*streamConn, error) {
+	if !l.IsOpen() {
+		return nil, l.notOpenError()
+	}
+
+	sink := &streamSink{
+		protocolFactory: l.protocolFactory,
+		send: func(frame []byte) error {
+			queue.push(frame[4:])
+			return nil
+		},
+		inboxes: l.streams,
+	}
+	go func() {
+		defer sink.release()
+		if response, err := l.process(data, sink); err == nil && len(response) > 0 {
+			queue.push(response)
+		}
+	}()
+	return &streamConn{
+		send: func(frame []byte) error {
+			l.streams.deliver(frame)
+			return nil
+		},
+		close: func(bool) {},
+	}, nil
+}
+
+// process processes the given frame, including its frame size, returning the
+// response without its frame size. Streamed responses are sent to the given
+// sink, if there is one.
+func (l *fLoopbackTransport) process(data []byte, stream *streamSink) ([]byte, error) {
+	// Copy the request, as callers may reuse it once Request returns.
+	input := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(append([]byte(nil), data[4:]...))}
+	output := new(bytes.Buffer)
+	oprot := l.protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: output})
+	oprot.stream = stream
+	err := l.processor.Process(l.protocolFactory.GetProtocol(input), oprot)
+	if err != nil {
+		logger().Warn("frugal: error processing loopback request: ", err)
+	}
+	return output.Bytes(), err
+}
+
+func (l *fLoopbackTransport) notOpenError() error {
+	return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+		"frugal: loopback transport not open")
+}
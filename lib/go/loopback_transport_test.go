@@ -0,0 +1,83 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// sleepingProcessor sleeps instead of processing requests.
+type sleepingProcessor struct {
+	processor
+	delay time.Duration
+}
+
+func (p *sleepingProcessor) Process(in, out *FProtocol) error {
+	time.Sleep(p.delay)
+	return nil
+}
+
+// Ensures requests are processed in the same process with their headers.
+func TestLoopbackTransportRequest(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFLoopbackTransport(&headerProcessor{}, protocolFactory)
+
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("user", "alice")
+	buffer := NewTMemoryOutputBuffer(0)
+	protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx)
+	_, err := transport.Request(ctx, buffer.Bytes())
+	assert.Equal(TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+
+	assert.Nil(transport.Open())
+	assert.True(transport.IsOpen())
+	result, err := transport.Request(ctx, buffer.Bytes())
+	assert.Nil(err)
+	resultProto := protocolFactory.GetProtocol(result)
+	assert.Nil(resultProto.ReadResponseHeader(ctx))
+	user, err := resultProto.ReadString()
+	assert.Nil(err)
+	assert.Equal("alice", user)
+	trace, _ := ctx.ResponseHeader("trace")
+	assert.Equal("t1", trace)
+	assert.Nil(transport.Oneway(ctx, buffer.Bytes()))
+
+	closed := transport.Closed()
+	assert.Nil(transport.Close())
+	assert.False(transport.IsOpen())
+	assert.Nil(<-closed)
+}
+
+// Ensures requests respect the timeout and cancellation of their context.
+func TestLoopbackTransportTimeout(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFLoopbackTransport(&sleepingProcessor{delay: 100 * time.Millisecond}, protocolFactory)
+	assert.Nil(transport.Open())
+
+	ctx := NewFContext("cid")
+	ctx.SetTimeout(10 * time.Millisecond)
+	_, err := transport.Request(ctx, prependFrameSize([]byte("request")))
+	assert.Equal(TRANSPORT_EXCEPTION_TIMED_OUT, err.(thrift.TTransportException).TypeId())
+
+	ctx = NewFContext("cid")
+	ctx.(*FContextImpl).Cancel()
+	_, err = transport.Request(ctx, prependFrameSize([]byte("request")))
+	assert.Equal(TRANSPORT_EXCEPTION_CANCELLED, err.(thrift.TTransportException).TypeId())
+}
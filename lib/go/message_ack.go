@@ -0,0 +1,136 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// ackDecision is how a subscriber handler decided a message should be
+// acknowledged.
+type ackDecision int
+
+const (
+	// ackByResult acknowledges the message if the handler returns nil.
+	ackByResult ackDecision = iota
+	ackAlways
+	ackRedeliver
+)
+
+// messageAck records the acknowledgement decided for a message by its
+// handler.
+type messageAck struct {
+	mu       sync.Mutex
+	decision ackDecision
+	delay    time.Duration
+}
+
+func (m *messageAck) decide(decision ackDecision, delay time.Duration) {
+	m.mu.Lock()
+	m.decision = decision
+	m.delay = delay
+	m.mu.Unlock()
+}
+
+// result returns the error to give the broker for a message whose handler
+// returned the given error.
+func (m *messageAck) result(err error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch m.decision {
+	case ackAlways:
+		return nil
+	case ackRedeliver:
+		return &FRedeliveryError{Delay: m.delay}
+	}
+	return err
+}
+
+// FRedeliveryError is returned to the broker client of a subscriber transport
+// for messages whose handler called Nack or Defer, so the message is
+// redelivered. Broker clients implemented for Frugal, such as an
+// FNatsDurableConsumer, should redeliver the message after Delay if they
+// support delayed redelivery, and immediately otherwise.
+type FRedeliveryError struct {
+	// Delay is how long to wait before redelivering the message.
+	Delay time.Duration
+}
+
+// Error returns a description of the redelivery.
+func (e *FRedeliveryError) Error() string {
+	if e.Delay == 0 {
+		return "frugal: message nacked for redelivery"
+	}
+	return fmt.Sprintf("frugal: message deferred for redelivery in %s", e.Delay)
+}
+
+// Ack acknowledges the message being handled with the given FContext once the
+// handler returns, even if it returns an error. Returns false if the
+// message's subscriber transport doesn't support acknowledgement, in which
+// case the message was acknowledged on delivery.
+func Ack(ctx FContext) bool {
+	return decideAck(ctx, ackAlways, 0)
+}
+
+// Nack rejects the message being handled with the given FContext once the
+// handler returns, so it's redelivered, even if the handler returns nil.
+// Returns false if the message's subscriber transport doesn't support
+// acknowledgement, in which case the message was acknowledged on delivery.
+func Nack(ctx FContext) bool {
+	return decideAck(ctx, ackRedeliver, 0)
+}
+
+// Defer rejects the message being handled with the given FContext once the
+// handler returns, so it's redelivered after the given delay. Transports which
+// can't delay redelivery redeliver the message as with Nack. Returns false if
+// the message's subscriber transport doesn't support acknowledgement, in
+// which case the message was acknowledged on delivery.
+func Defer(ctx FContext, delay time.Duration) bool {
+	return decideAck(ctx, ackRedeliver, delay)
+}
+
+func decideAck(ctx FContext, decision ackDecision, delay time.Duration) bool {
+	c, ok := ctx.(*FContextImpl)
+	if !ok || c.ack == nil {
+		return false
+	}
+	c.ack.decide(decision, delay)
+	return true
+}
+
+// ackTransport is the transport subscriber callbacks read messages which can
+// be acknowledged from. The FContext read from it is given its messageAck.
+type ackTransport struct {
+	*thrift.TMemoryBuffer
+	ack *messageAck
+}
+
+// invokeAcked executes the callback for the given frame, excluding its frame
+// size, of a broker which redelivers messages until they're acknowledged. It
+// returns the error to give the broker: nil to acknowledge the message, or
+// the callback's error, or an *FRedeliveryError if the handler called Nack or
+// Defer, so it isn't.
+func invokeAcked(callback FAsyncCallback, frame []byte) error {
+	ack := &messageAck{}
+	err := callback(&ackTransport{TMemoryBuffer: &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame)}, ack: ack})
+	if err != nil {
+		logger().Warn("frugal: error executing callback: ", err)
+	}
+	return ack.result(err)
+}
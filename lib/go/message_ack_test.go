@@ -0,0 +1,107 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// ackingCallback returns a subscriber callback which reads the message's
+// FContext and passes it to the given handler.
+func ackingCallback(t *testing.T, handler func(FContext) error) FAsyncCallback {
+	return func(transport thrift.TTransport) error {
+		proto := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).GetProtocol(transport)
+		ctx, err := proto.ReadRequestHeader()
+		if !assert.Nil(t, err) {
+			return err
+		}
+		return handler(ctx)
+	}
+}
+
+// Ensures the acknowledgement decided by handlers overrides the error they
+// return.
+func TestInvokeAcked(t *testing.T) {
+	failed := errors.New("failed")
+	cases := []struct {
+		name     string
+		handler  func(FContext) error
+		expected error
+	}{
+		{"success", func(FContext) error { return nil }, nil},
+		{"failure", func(FContext) error { return failed }, failed},
+		{"ack", func(ctx FContext) error {
+			assert.True(t, Ack(ctx))
+			return failed
+		}, nil},
+		{"nack", func(ctx FContext) error {
+			assert.True(t, Nack(ctx))
+			return nil
+		}, &FRedeliveryError{}},
+		{"defer", func(ctx FContext) error {
+			assert.True(t, Defer(ctx, time.Minute))
+			return failed
+		}, &FRedeliveryError{Delay: time.Minute}},
+	}
+	for _, c := range cases {
+		frame := newKafkaFrame(t, nil, "payload")
+		err := invokeAcked(ackingCallback(t, c.handler), frame[4:])
+		assert.Equal(t, c.expected, err, c.name)
+	}
+}
+
+// Ensures contexts of messages which can't be acknowledged report it.
+func TestAckUnsupported(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("cid")
+	assert.False(Ack(ctx))
+	assert.False(Nack(ctx))
+	assert.False(Defer(ctx, time.Second))
+
+	frame := newKafkaFrame(t, nil, "payload")
+	transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])}
+	assert.Nil(ackingCallback(t, func(ctx FContext) error {
+		assert.False(Nack(ctx))
+		return nil
+	})(transport))
+}
+
+// Ensures deferred SQS messages are made visible again after their delay
+// rather than deleted.
+func TestSQSSubscriberDefer(t *testing.T) {
+	assert := assert.New(t)
+	queue := newMockSQSQueue()
+	done := make(chan struct{})
+	subscriber := NewFSQSSubscriberTransportFactory(queue, sqsQueueURL).GetTransport()
+	assert.Nil(subscriber.Subscribe("winners", ackingCallback(t, func(ctx FContext) error {
+		defer close(done)
+		assert.True(Defer(ctx, 5*time.Second))
+		return nil
+	})))
+	publisher := NewFSNSPublisherTransportFactory(queue, snsTopicARN).GetTransport()
+	assert.Nil(publisher.Open())
+	assert.Nil(publisher.Publish("winners", newKafkaFrame(t, nil, "payload")))
+	<-done
+	assert.Nil(subscriber.Unsubscribe())
+
+	deleted, visibility := queue.changes()
+	assert.Empty(deleted)
+	assert.Equal([]visibilityChange{{"r1", 5 * time.Second}}, visibility)
+}
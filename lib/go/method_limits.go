@@ -0,0 +1,144 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// Response header carrying the number of milliseconds after which a rate
+// limited request can be retried.
+const retryAfterHeader = "_retry-after"
+
+// defaultRetryAfter is the retry hint for requests rejected by a concurrency
+// limit when none is configured.
+const defaultRetryAfter = time.Second
+
+// FMethodLimits limits the requests a processor serves for a method so one
+// expensive method can't starve the others. Zero values disable a limit.
+type FMethodLimits struct {
+	// MaxInFlight is the number of requests for the method which can be
+	// processed at once.
+	MaxInFlight int
+
+	// RequestsPerSecond is the steady rate of requests for the method, with
+	// bursts of up to Burst requests.
+	RequestsPerSecond float64
+	Burst             uint
+
+	// RetryAfter is the retry hint sent for requests rejected by the
+	// MaxInFlight limit. It defaults to one second.
+	RetryAfter time.Duration
+}
+
+// methodLimiter enforces the FMethodLimits of a method.
+type methodLimiter struct {
+	limits   FMethodLimits
+	inFlight int64
+	bucket   *tokenBucket
+}
+
+func newMethodLimiter(limits FMethodLimits) *methodLimiter {
+	limiter := &methodLimiter{limits: limits}
+	if limits.RequestsPerSecond > 0 {
+		limiter.bucket = newTokenBucket(limits.RequestsPerSecond, limits.Burst)
+	}
+	if limiter.limits.RetryAfter <= 0 {
+		limiter.limits.RetryAfter = defaultRetryAfter
+	}
+	return limiter
+}
+
+// acquire admits a request, returning false and how long until a retry may be
+// admitted if the request is over a limit. Admitted requests must be released.
+func (m *methodLimiter) acquire() (bool, time.Duration) {
+	if m.limits.MaxInFlight > 0 {
+		if atomic.AddInt64(&m.inFlight, 1) > int64(m.limits.MaxInFlight) {
+			atomic.AddInt64(&m.inFlight, -1)
+			return false, m.limits.RetryAfter
+		}
+	}
+	if m.bucket != nil {
+		if ok, wait := m.bucket.tryTakeOrWait(); !ok {
+			m.release()
+			return false, wait
+		}
+	}
+	return true, 0
+}
+
+func (m *methodLimiter) release() {
+	if m.limits.MaxInFlight > 0 {
+		atomic.AddInt64(&m.inFlight, -1)
+	}
+}
+
+// SetMethodLimits limits the requests processed for the given method. Requests
+// over a limit are responded to with a TApplicationException of type
+// APPLICATION_EXCEPTION_RATE_LIMITED without invoking the handler, and a hint
+// of when to retry which clients can get with RetryAfter. This should only be
+// called before the server is started.
+func (f *FBaseProcessor) SetMethodLimits(method string, limits FMethodLimits) {
+	if f.methodLimits == nil {
+		f.methodLimits = make(map[string]*methodLimiter)
+	}
+	f.methodLimits[method] = newMethodLimiter(limits)
+}
+
+// admit admits the request for the given method, returning a function to
+// call once it has been processed. If the request is over the method's
+// limits, it is read and responded to with an error, and false is returned.
+func (f *FBaseProcessor) admit(ctx FContext, name string, iprot, oprot *FProtocol) (func(), bool, error) {
+	limiter, ok := f.methodLimits[name]
+	if !ok {
+		return func() {}, true, nil
+	}
+	admitted, wait := limiter.acquire()
+	if admitted {
+		return limiter.release, true, nil
+	}
+
+	if err := iprot.Skip(thrift.STRUCT); err != nil {
+		return nil, false, err
+	}
+	if err := iprot.ReadMessageEnd(); err != nil {
+		return nil, false, err
+	}
+	logger().Warnf("frugal: rate limited %s on request with correlation id %s", name, ctx.CorrelationID())
+	setResponseHeader(ctx, retryAfterHeader, strconv.FormatInt(int64(wait/time.Millisecond), 10))
+	ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_RATE_LIMITED,
+		fmt.Sprintf("rate limited: retry %s after %s", name, wait))
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	return nil, false, writeExceptionResponse(oprot, ctx, name, ex)
+}
+
+// RetryAfter returns how long the server asked the client to wait before
+// retrying the request made with the given FContext, if it was rate limited.
+func RetryAfter(ctx FContext) (time.Duration, bool) {
+	value, ok := ctx.ResponseHeader(retryAfterHeader)
+	if !ok {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// nopProcessorFunction reads the request and responds with an empty struct.
+type nopProcessorFunction struct{}
+
+func (n *nopProcessorFunction) Process(ctx FContext, in, out *FProtocol) error {
+	in.Skip(thrift.STRUCT)
+	in.ReadMessageEnd()
+	out.WriteResponseHeader(ctx)
+	out.WriteMessageBegin("ping", thrift.REPLY, 0)
+	out.WriteStructBegin("result")
+	out.WriteFieldStop()
+	out.WriteStructEnd()
+	out.WriteMessageEnd()
+	return out.Flush()
+}
+
+func (n *nopProcessorFunction) AddMiddleware(middleware ServiceMiddleware) {}
+
+// processLimited processes a ping request with the given processor and
+// returns the type of the response message, reading its headers into ctx.
+func processLimited(t *testing.T, processor FProcessor, ctx FContext) thrift.TMessageType {
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	request := &thrift.TMemoryBuffer{Buffer: new(bytes.Buffer)}
+	proto := protocolFactory.GetProtocol(request)
+	assert.Nil(t, proto.WriteRequestHeader(ctx))
+	assert.Nil(t, proto.WriteMessageBegin("ping", thrift.CALL, 0))
+	assert.Nil(t, proto.WriteStructBegin("args"))
+	assert.Nil(t, proto.WriteFieldStop())
+	assert.Nil(t, proto.WriteStructEnd())
+	assert.Nil(t, proto.WriteMessageEnd())
+
+	response := &thrift.TMemoryBuffer{Buffer: new(bytes.Buffer)}
+	assert.Nil(t, processor.Process(proto, protocolFactory.GetProtocol(response)))
+	if response.Len() == 0 {
+		return 0
+	}
+	proto = protocolFactory.GetProtocol(response)
+	assert.Nil(t, proto.ReadResponseHeader(ctx))
+	_, typeID, _, err := proto.ReadMessageBegin()
+	assert.Nil(t, err)
+	if typeID == thrift.EXCEPTION {
+		ex, err := thrift.NewTApplicationException(0, "").Read(proto)
+		assert.Nil(t, err)
+		assert.Equal(t, int32(APPLICATION_EXCEPTION_RATE_LIMITED), ex.TypeId())
+	}
+	return typeID
+}
+
+// Ensures requests over a method's rate are rejected with a retry hint and
+// methods without limits aren't limited.
+func TestMethodLimitsRate(t *testing.T) {
+	assert := assert.New(t)
+	processor := NewFBaseProcessor()
+	processor.AddToProcessorMap("ping", &nopProcessorFunction{})
+	processor.SetMethodLimits("ping", FMethodLimits{RequestsPerSecond: 1})
+
+	assert.Equal(thrift.REPLY, processLimited(t, processor, NewFContext("cid")))
+	ctx := NewFContext("cid")
+	assert.Equal(thrift.EXCEPTION, processLimited(t, processor, ctx))
+	retryAfter, ok := RetryAfter(ctx)
+	assert.True(ok)
+	assert.True(retryAfter > 900*time.Millisecond && retryAfter <= time.Second)
+
+	processor = NewFBaseProcessor()
+	processor.AddToProcessorMap("ping", &nopProcessorFunction{})
+	for i := 0; i < 3; i++ {
+		assert.Equal(thrift.REPLY, processLimited(t, processor, NewFContext("cid")))
+	}
+	_, ok = RetryAfter(NewFContext("cid"))
+	assert.False(ok)
+}
+
+// Ensures requests over a method's concurrency limit are rejected until a
+// request completes.
+func TestMethodLimitsInFlight(t *testing.T) {
+	assert := assert.New(t)
+	processor := NewFBaseProcessor()
+	blocking := &blockingProcessorFunction{started: make(chan FContext, 1), cancelled: make(chan struct{})}
+	processor.AddToProcessorMap("ping", blocking)
+	processor.SetMethodLimits("ping", FMethodLimits{MaxInFlight: 1, RetryAfter: 250 * time.Millisecond})
+
+	done := make(chan struct{})
+	go func() {
+		processLimited(t, processor, NewFContext("cid"))
+		close(done)
+	}()
+	serverCtx := <-blocking.started
+
+	ctx := NewFContext("cid")
+	assert.Equal(thrift.EXCEPTION, processLimited(t, processor, ctx))
+	retryAfter, ok := RetryAfter(ctx)
+	assert.True(ok)
+	assert.Equal(250*time.Millisecond, retryAfter)
+
+	serverCtx.(*FContextImpl).Cancel()
+	<-done
+	processor.AddToProcessorMap("ping", &nopProcessorFunction{})
+	assert.Equal(thrift.REPLY, processLimited(t, processor, NewFContext("cid")))
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import "time"
+
+// SetMethodTimeout sets how long requests for the given method may be
+// processed for. When the timeout elapses, the handler's FContext is
+// cancelled, so handlers selecting on its Done channel can stop work. The
+// context's Deadline is moved up to the timeout if it's earlier, so requests
+// the handler makes with it are bounded too. This should only be called
+// before the server is started.
+func (f *FBaseProcessor) SetMethodTimeout(method string, timeout time.Duration) {
+	if f.methodTimeouts == nil {
+		f.methodTimeouts = make(map[string]time.Duration)
+	}
+	f.methodTimeouts[method] = timeout
+}
+
+// startMethodTimeout starts the timeout of the given method for the request
+// with the given context, returning a function to stop it once the request
+// has been processed. Contexts which don't support cancellation aren't timed.
+func (f *FBaseProcessor) startMethodTimeout(ctx FContext, name string) func() {
+	timeout, ok := f.methodTimeouts[name]
+	if !ok {
+		return func() {}
+	}
+	c, ok := ctx.(*FContextImpl)
+	if !ok {
+		return func() {}
+	}
+	deadline := time.Now().Add(timeout)
+	if existing, ok := c.Deadline(); !ok || deadline.Before(existing) {
+		c.setDeadline(deadline)
+	}
+	timer := time.AfterFunc(timeout, func() {
+		logger().Warnf("frugal: %s exceeded its timeout of %s on request with correlation id %s, cancelling",
+			name, timeout, ctx.CorrelationID())
+		c.Cancel()
+	})
+	return func() { timer.Stop() }
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures handlers of a method with a timeout are cancelled when it elapses.
+func TestMethodTimeout(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := &slowHealth{cancelled: make(chan struct{})}
+	processor := NewFHealthProcessor(handler)
+	processor.SetMethodTimeout("check", 10*time.Millisecond)
+	transport := NewFLoopbackTransport(processor, protocolFactory)
+	assert.Nil(transport.Open())
+	client := NewFHealthClient(NewFServiceProvider(transport, protocolFactory))
+
+	start := time.Now()
+	status, err := client.Check(NewFContext(""), "")
+	assert.Nil(err)
+	assert.Equal(HealthServing, status)
+	assert.True(time.Since(start) >= 10*time.Millisecond)
+	select {
+	case <-handler.cancelled:
+	default:
+		t.Fatal("Expected handler to be cancelled")
+	}
+}
+
+// Ensures a method timeout moves up the deadline of the handler's context,
+// but not past the client's deadline, and only for its method.
+func TestMethodTimeoutDeadline(t *testing.T) {
+	assert := assert.New(t)
+	processor := NewFBaseProcessor()
+	processor.SetMethodTimeout("report", time.Minute)
+
+	ctx := NewFContext("").(*FContextImpl)
+	stop := processor.startMethodTimeout(ctx, "report")
+	deadline, ok := ctx.Deadline()
+	stop()
+	assert.True(ok)
+	assert.WithinDuration(time.Now().Add(time.Minute), deadline, time.Second)
+
+	ctx = NewFContext("").(*FContextImpl)
+	clientDeadline := time.Now().Add(time.Second)
+	ctx.setDeadline(clientDeadline)
+	processor.startMethodTimeout(ctx, "report")()
+	deadline, _ = ctx.Deadline()
+	assert.Equal(clientDeadline, deadline)
+
+	ctx = NewFContext("").(*FContextImpl)
+	processor.startMethodTimeout(ctx, "lookup")()
+	_, ok = ctx.Deadline()
+	assert.False(ok)
+}
@@ -79,6 +79,18 @@ func (r Results) SetError(err error) {
 	r[len(r)-1] = err
 }
 
+// errorResults returns Results for an invocation of the given method which
+// failed with the given error without being made, with zero values for its
+// other return values.
+func errorResults(method reflect.Method, err error) Results {
+	results := make(Results, method.Type.NumOut())
+	for i := range results[:len(results)-1] {
+		results[i] = reflect.Zero(method.Type.Out(i)).Interface()
+	}
+	results.SetError(err)
+	return results
+}
+
 // Invoke the Method and return its results. This should only be called by
 // generated code.
 func (m *Method) Invoke(args Arguments) Results {
@@ -0,0 +1,305 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// mqttMaxMessageSize is the default maximum size of published MQTT
+	// messages, the largest payload the protocol allows.
+	mqttMaxMessageSize = 256*1024*1024 - 1
+
+	// mqttTopicPrefix is prepended to the MQTT topics scopes are published
+	// on.
+	mqttTopicPrefix = "frugal/"
+)
+
+// FMQTTClient publishes and subscribes to MQTT topics. Frugal doesn't depend
+// on an MQTT client, so implement it with the client of your choice, such as
+// by wrapping a paho mqtt.Client and waiting on its tokens.
+type FMQTTClient interface {
+	// Publish sends the given payload to the given topic with the given QoS
+	// level, 0, 1 or 2.
+	Publish(topic string, qos byte, payload []byte) error
+
+	// Subscribe calls the handler with the payload of each message published
+	// to the given topic, requesting the given QoS level, until unsubscribed.
+	Subscribe(topic string, qos byte, handler func(payload []byte)) error
+
+	// Unsubscribe stops receiving messages published to the given topic.
+	Unsubscribe(topic string) error
+}
+
+// defaultMQTTTopicMapper maps scope topics to MQTT's "/" hierarchy, so
+// "v1.music.AlbumWinners.Winner" is published on
+// "frugal/v1/music/AlbumWinners/Winner" and consumers can subscribe to every
+// scope under a prefix with wildcards such as "frugal/v1/music/#".
+func defaultMQTTTopicMapper(topic string) string {
+	return mqttTopicPrefix + strings.Replace(topic, ".", "/", -1)
+}
+
+// mqttTopicOptions are the topic mapping and QoS options shared by MQTT
+// publishers and subscribers.
+type mqttTopicOptions struct {
+	mapper   func(string) string
+	qos      byte
+	scopeQoS map[string]byte
+}
+
+func newMQTTTopicOptions() mqttTopicOptions {
+	return mqttTopicOptions{mapper: defaultMQTTTopicMapper, scopeQoS: make(map[string]byte)}
+}
+
+// qosFor returns the QoS level for the given scope topic. Scopes are
+// identified by the topic up to its last ".", which is the scope prefix and
+// name in topics from generated code.
+func (m mqttTopicOptions) qosFor(topic string) byte {
+	if i := strings.LastIndex(topic, "."); i > 0 {
+		if qos, ok := m.scopeQoS[topic[:i]]; ok {
+			return qos
+		}
+	}
+	return m.qos
+}
+
+// FMQTTPublisherTransportFactory creates MQTT FPublisherTransports.
+type FMQTTPublisherTransportFactory struct {
+	client           FMQTTClient
+	options          mqttTopicOptions
+	publishSizeLimit uint
+}
+
+// NewFMQTTPublisherTransportFactory creates an FMQTTPublisherTransportFactory
+// whose transports publish with the given client. Scopes are published with
+// QoS 0 under "frugal/", with the "." separators of their topics replaced by
+// "/".
+func NewFMQTTPublisherTransportFactory(client FMQTTClient) *FMQTTPublisherTransportFactory {
+	return &FMQTTPublisherTransportFactory{
+		client:           client,
+		options:          newMQTTTopicOptions(),
+		publishSizeLimit: mqttMaxMessageSize,
+	}
+}
+
+// WithTopicMapper sets how scope topics are mapped to MQTT topics.
+// Subscribers must map topics the same way.
+func (m *FMQTTPublisherTransportFactory) WithTopicMapper(mapper func(string) string) *FMQTTPublisherTransportFactory {
+	m.options.mapper = mapper
+	return m
+}
+
+// WithQoS sets the QoS level, 0, 1 or 2, messages are published with unless
+// set for their scope. Defaults to 0.
+func (m *FMQTTPublisherTransportFactory) WithQoS(qos byte) *FMQTTPublisherTransportFactory {
+	m.options.qos = qos
+	return m
+}
+
+// WithScopeQoS sets the QoS level messages of the given scope are published
+// with. The scope is given as the topic prefix and scope name, such as
+// "v1.music.AlbumWinners".
+func (m *FMQTTPublisherTransportFactory) WithScopeQoS(scope string, qos byte) *FMQTTPublisherTransportFactory {
+	m.options.scopeQoS[scope] = qos
+	return m
+}
+
+// WithPublishSizeLimit sets the maximum size of published messages. Defaults
+// to the protocol's limit of 256MB, but brokers are typically configured with
+// a smaller one.
+func (m *FMQTTPublisherTransportFactory) WithPublishSizeLimit(limit uint) *FMQTTPublisherTransportFactory {
+	m.publishSizeLimit = limit
+	return m
+}
+
+// GetTransport creates a new MQTT FPublisherTransport.
+func (m *FMQTTPublisherTransportFactory) GetTransport() FPublisherTransport {
+	return &fMQTTPublisherTransport{
+		client:           m.client,
+		options:          m.options,
+		publishSizeLimit: m.publishSizeLimit,
+	}
+}
+
+// fMQTTPublisherTransport implements FPublisherTransport.
+type fMQTTPublisherTransport struct {
+	client           FMQTTClient
+	options          mqttTopicOptions
+	publishSizeLimit uint
+
+	mu     sync.RWMutex
+	isOpen bool
+}
+
+// Open initializes the transport.
+func (m *fMQTTPublisherTransport) Open() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.isOpen = true
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (m *fMQTTPublisherTransport) IsOpen() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.isOpen
+}
+
+// Close closes the transport. The client is owned by the caller and is not
+// disconnected.
+func (m *fMQTTPublisherTransport) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.isOpen = false
+	return nil
+}
+
+// GetPublishSizeLimit returns the maximum allowable size of a payload
+// to be published. A non-positive number is returned to indicate an
+// unbounded allowable size.
+func (m *fMQTTPublisherTransport) GetPublishSizeLimit() uint {
+	return m.publishSizeLimit
+}
+
+// Publish sends the given frame to the MQTT topic for the given topic with
+// the QoS level of its scope.
+func (m *fMQTTPublisherTransport) Publish(topic string, data []byte) error {
+	if !m.IsOpen() {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: MQTT FPublisherTransport not open")
+	}
+	if limit := m.publishSizeLimit; limit > 0 && uint(len(data)) > limit {
+		return thrift.NewTTransportException(
+			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", limit, len(data)))
+	}
+	if err := m.client.Publish(m.options.mapper(topic), m.options.qosFor(topic), data); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	return nil
+}
+
+// FMQTTSubscriberTransportFactory creates MQTT FSubscriberTransports.
+type FMQTTSubscriberTransportFactory struct {
+	client  FMQTTClient
+	options mqttTopicOptions
+}
+
+// NewFMQTTSubscriberTransportFactory creates an
+// FMQTTSubscriberTransportFactory whose transports subscribe with the given
+// client, requesting QoS 0 and mapping topics the same way as
+// NewFMQTTPublisherTransportFactory.
+func NewFMQTTSubscriberTransportFactory(client FMQTTClient) *FMQTTSubscriberTransportFactory {
+	return &FMQTTSubscriberTransportFactory{client: client, options: newMQTTTopicOptions()}
+}
+
+// WithTopicMapper sets how scope topics are mapped to MQTT topics, matching
+// the mapping used by publishers.
+func (m *FMQTTSubscriberTransportFactory) WithTopicMapper(mapper func(string) string) *FMQTTSubscriberTransportFactory {
+	m.options.mapper = mapper
+	return m
+}
+
+// WithQoS sets the QoS level, 0, 1 or 2, requested for subscriptions unless
+// set for their scope. Defaults to 0.
+func (m *FMQTTSubscriberTransportFactory) WithQoS(qos byte) *FMQTTSubscriberTransportFactory {
+	m.options.qos = qos
+	return m
+}
+
+// WithScopeQoS sets the QoS level requested for subscriptions to the given
+// scope, given as the topic prefix and scope name.
+func (m *FMQTTSubscriberTransportFactory) WithScopeQoS(scope string, qos byte) *FMQTTSubscriberTransportFactory {
+	m.options.scopeQoS[scope] = qos
+	return m
+}
+
+// GetTransport creates a new MQTT FSubscriberTransport.
+func (m *FMQTTSubscriberTransportFactory) GetTransport() FSubscriberTransport {
+	return &fMQTTSubscriberTransport{client: m.client, options: m.options}
+}
+
+// fMQTTSubscriberTransport implements FSubscriberTransport.
+type fMQTTSubscriberTransport struct {
+	client  FMQTTClient
+	options mqttTopicOptions
+
+	mu    sync.RWMutex
+	topic string
+}
+
+// Subscribe starts receiving messages for the given topic.
+func (m *fMQTTSubscriberTransport) Subscribe(topic string, callback FAsyncCallback) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.topic != "" {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: MQTT transport already open")
+	}
+	if topic == "" {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"cannot subscribe to empty topic")
+	}
+
+	mqttTopic := m.options.mapper(topic)
+	if err := m.client.Subscribe(mqttTopic, m.options.qosFor(topic), handleMQTTMessage(callback)); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	m.topic = mqttTopic
+	return nil
+}
+
+// handleMQTTMessage returns a handler executing the callback for each
+// received frame.
+func handleMQTTMessage(callback FAsyncCallback) func([]byte) {
+	return func(payload []byte) {
+		if len(payload) < 4 {
+			logger().Warn("frugal: Discarding invalid scope message frame")
+			return
+		}
+		transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(payload[4:])}
+		if err := callback(transport); err != nil {
+			logger().Warn("frugal: error executing callback: ", err)
+		}
+	}
+}
+
+// IsSubscribed returns true if the transport is subscribed to a topic, false
+// otherwise.
+func (m *fMQTTSubscriberTransport) IsSubscribed() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.topic != ""
+}
+
+// Unsubscribe stops receiving messages.
+func (m *fMQTTSubscriberTransport) Unsubscribe() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.topic == "" {
+		return nil
+	}
+	if err := m.client.Unsubscribe(m.topic); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	m.topic = ""
+	return nil
+}
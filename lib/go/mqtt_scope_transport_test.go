@@ -0,0 +1,132 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+type mqttSubscription struct {
+	qos     byte
+	handler func([]byte)
+}
+
+// mockMQTTClient is an in-memory FMQTTClient delivering each published
+// message to the subscribers of its topic.
+type mockMQTTClient struct {
+	mu            sync.Mutex
+	subscriptions map[string]mqttSubscription
+	published     map[string]byte
+}
+
+func newMockMQTTClient() *mockMQTTClient {
+	return &mockMQTTClient{
+		subscriptions: make(map[string]mqttSubscription),
+		published:     make(map[string]byte),
+	}
+}
+
+func (m *mockMQTTClient) Publish(topic string, qos byte, payload []byte) error {
+	m.mu.Lock()
+	m.published[topic] = qos
+	subscription, ok := m.subscriptions[topic]
+	m.mu.Unlock()
+	if ok {
+		subscription.handler(payload)
+	}
+	return nil
+}
+
+func (m *mockMQTTClient) Subscribe(topic string, qos byte, handler func([]byte)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscriptions[topic] = mqttSubscription{qos, handler}
+	return nil
+}
+
+func (m *mockMQTTClient) Unsubscribe(topic string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.subscriptions, topic)
+	return nil
+}
+
+// Ensures scopes are published on the MQTT topic hierarchy with the QoS
+// level of their scope and delivered to subscribers.
+func TestMQTTScopeTransportPublishSubscribe(t *testing.T) {
+	assert := assert.New(t)
+	client := newMockMQTTClient()
+	received := make(chan []byte, 1)
+	subscriber := NewFMQTTSubscriberTransportFactory(client).
+		WithScopeQoS("v1.music.AlbumWinners", 1).
+		GetTransport()
+	assert.Nil(subscriber.Subscribe("v1.music.AlbumWinners.Winner", func(transport thrift.TTransport) error {
+		payload, err := ioutil.ReadAll(transport)
+		received <- payload
+		return err
+	}))
+	assert.True(subscriber.IsSubscribed())
+	assert.Equal(byte(1), client.subscriptions["frugal/v1/music/AlbumWinners/Winner"].qos)
+	err := subscriber.Subscribe("v1.music.AlbumWinners.Winner", nil)
+	assert.Equal(TRANSPORT_EXCEPTION_ALREADY_OPEN, err.(thrift.TTransportException).TypeId())
+
+	publisher := NewFMQTTPublisherTransportFactory(client).
+		WithQoS(2).
+		WithScopeQoS("v1.music.AlbumWinners", 1).
+		GetTransport()
+	err = publisher.Publish("v1.music.AlbumWinners.Winner", []byte{0, 0, 0, 1, 1})
+	assert.Equal(TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+	assert.Nil(publisher.Open())
+	assert.Nil(publisher.Publish("v1.music.AlbumWinners.Winner", []byte{0, 0, 0, 1, 1}))
+	assert.Equal([]byte{1}, <-received)
+	assert.Nil(publisher.Publish("v1.music.Charts.Top", []byte{0, 0, 0, 1, 1}))
+	assert.Equal(map[string]byte{
+		"frugal/v1/music/AlbumWinners/Winner": 1,
+		"frugal/v1/music/Charts/Top":          2,
+	}, client.published)
+
+	assert.Nil(subscriber.Unsubscribe())
+	assert.False(subscriber.IsSubscribed())
+	assert.Empty(client.subscriptions)
+	assert.Nil(publisher.Close())
+}
+
+// Ensures topic mappers and publish size limits are applied.
+func TestMQTTScopeTransportOptions(t *testing.T) {
+	assert := assert.New(t)
+	client := newMockMQTTClient()
+	mapper := func(topic string) string { return strings.ToLower(topic) }
+	subscriber := NewFMQTTSubscriberTransportFactory(client).WithTopicMapper(mapper).GetTransport()
+	assert.Nil(subscriber.Subscribe("Scope.Op", func(thrift.TTransport) error { return nil }))
+	assert.Contains(client.subscriptions, "scope.op")
+	err := NewFMQTTSubscriberTransportFactory(client).GetTransport().Subscribe("", nil)
+	assert.Equal(TRANSPORT_EXCEPTION_UNKNOWN, err.(thrift.TTransportException).TypeId())
+
+	publisher := NewFMQTTPublisherTransportFactory(client).
+		WithTopicMapper(mapper).
+		WithPublishSizeLimit(10).
+		GetTransport()
+	assert.Nil(publisher.Open())
+	assert.Equal(uint(10), publisher.GetPublishSizeLimit())
+	assert.Nil(publisher.Publish("Scope.Op", []byte{0, 0, 0, 1, 1}))
+	assert.Contains(client.published, "scope.op")
+	err = publisher.Publish("Scope.Op", make([]byte, 11))
+	assert.Equal(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, err.(thrift.TTransportException).TypeId())
+}
@@ -0,0 +1,715 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// NewFMessagePackProtocolFactory returns an FProtocolFactory which serializes
+// messages with MessagePack beneath the frugal headers. The encoding is self
+// describing, so captured payloads can be decoded by any MessagePack library
+// without the IDL. A message is an array of its name, message type, sequence
+// id and body. Structs are maps of field id to value, lists and sets are
+// arrays, strings are str and binary fields are bin. Integers use the
+// smallest encoding for their value, so readers rely on the IDL for their
+// width. Element and field types reported when reading are inferred from the
+// encoding, so they may not match the IDL, and skipping doesn't rely on them.
+func NewFMessagePackProtocolFactory() *FProtocolFactory {
+	return NewFProtocolFactory(&msgpackProtocolFactory{})
+}
+
+type msgpackProtocolFactory struct{}
+
+func (m *msgpackProtocolFactory) GetProtocol(trans thrift.TTransport) thrift.TProtocol {
+	p := &msgpackProtocol{trans: trans}
+	p.TProtocol = thrift.NewTBinaryProtocol(&msgpackByteCodec{TTransport: trans, protocol: p}, false, false)
+	return p
+}
+
+// msgpackProtocol implements thrift.TProtocol with MessagePack. MessagePack
+// maps are prefixed by their size, so structs are buffered until they end.
+type msgpackProtocol struct {
+	// TProtocol only provides WriteByte and ReadByte, whose Thrift signatures
+	// clash with io.ByteWriter and io.ByteReader. It passes bytes through
+	// msgpackByteCodec, which encodes them like any other integer, and every
+	// other method is implemented below.
+	thrift.TProtocol
+
+	trans thrift.TTransport
+
+	// structs are the buffers of the structs being written, innermost last.
+	structs []*msgpackStruct
+
+	// fields are the number of unread fields of the structs being read,
+	// innermost last.
+	fields []int
+
+	// peeked is the type byte of the next value, if it has been read to
+	// infer its type.
+	peeked    byte
+	hasPeeked bool
+}
+
+type msgpackStruct struct {
+	buffer bytes.Buffer
+	fields int
+}
+
+// writer returns where values are written, which is the innermost struct
+// being written, if any.
+func (m *msgpackProtocol) writer() io.Writer {
+	if len(m.structs) > 0 {
+		return &m.structs[len(m.structs)-1].buffer
+	}
+	return m.trans
+}
+
+func (m *msgpackProtocol) write(b ...byte) error {
+	if _, err := m.writer().Write(b); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	return nil
+}
+
+// writeHeader writes a type byte followed by a big-endian size.
+func (m *msgpackProtocol) writeHeader(code byte, size uint64, width int) error {
+	b := make([]byte, 9)
+	b[0] = code
+	switch width {
+	case 1:
+		b[1] = byte(size)
+	case 2:
+		binary.BigEndian.PutUint16(b[1:], uint16(size))
+	case 4:
+		binary.BigEndian.PutUint32(b[1:], uint32(size))
+	case 8:
+		binary.BigEndian.PutUint64(b[1:], size)
+	}
+	return m.write(b[:1+width]...)
+}
+
+func (m *msgpackProtocol) writeInt(v int64) error {
+	switch {
+	case v >= 0 && v < 128:
+		return m.write(byte(v))
+	case v >= -32 && v < 0:
+		return m.write(byte(v))
+	case v >= 0 && v <= math.MaxUint8:
+		return m.writeHeader(0xcc, uint64(v), 1)
+	case v >= 0 && v <= math.MaxUint16:
+		return m.writeHeader(0xcd, uint64(v), 2)
+	case v >= 0 && v <= math.MaxUint32:
+		return m.writeHeader(0xce, uint64(v), 4)
+	case v >= 0:
+		return m.writeHeader(0xcf, uint64(v), 8)
+	case v >= math.MinInt8:
+		return m.writeHeader(0xd0, uint64(v), 1)
+	case v >= math.MinInt16:
+		return m.writeHeader(0xd1, uint64(v), 2)
+	case v >= math.MinInt32:
+		return m.writeHeader(0xd2, uint64(v), 4)
+	default:
+		return m.writeHeader(0xd3, uint64(v), 8)
+	}
+}
+
+// writeSized writes the header of a str, bin, array or map of the given
+// size. The fix code is 0 for types without a fix format of that size.
+func (m *msgpackProtocol) writeSized(size int, fix byte, fixMax int, code8, code16, code32 byte) error {
+	switch {
+	case fix != 0 && size < fixMax:
+		return m.write(fix | byte(size))
+	case code8 != 0 && size <= math.MaxUint8:
+		return m.writeHeader(code8, uint64(size), 1)
+	case size <= math.MaxUint16:
+		return m.writeHeader(code16, uint64(size), 2)
+	default:
+		return m.writeHeader(code32, uint64(size), 4)
+	}
+}
+
+func (m *msgpackProtocol) writeArrayHeader(size int) error {
+	return m.writeSized(size, 0x90, 16, 0, 0xdc, 0xdd)
+}
+
+func (m *msgpackProtocol) writeMapHeader(size int) error {
+	return m.writeSized(size, 0x80, 16, 0, 0xde, 0xdf)
+}
+
+func (m *msgpackProtocol) WriteMessageBegin(name string, typeID thrift.TMessageType, seqID int32) error {
+	if err := m.writeArrayHeader(4); err != nil {
+		return err
+	}
+	if err := m.WriteString(name); err != nil {
+		return err
+	}
+	if err := m.writeInt(int64(typeID)); err != nil {
+		return err
+	}
+	return m.writeInt(int64(seqID))
+}
+
+func (m *msgpackProtocol) WriteMessageEnd() error {
+	return nil
+}
+
+func (m *msgpackProtocol) WriteStructBegin(name string) error {
+	m.structs = append(m.structs, &msgpackStruct{})
+	return nil
+}
+
+func (m *msgpackProtocol) WriteStructEnd() error {
+	if len(m.structs) == 0 {
+		return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			errors.New("frugal: msgpack struct end without struct begin"))
+	}
+	s := m.structs[len(m.structs)-1]
+	m.structs = m.structs[:len(m.structs)-1]
+	if err := m.writeMapHeader(s.fields); err != nil {
+		return err
+	}
+	return m.write(s.buffer.Bytes()...)
+}
+
+func (m *msgpackProtocol) WriteFieldBegin(name string, typeID thrift.TType, id int16) error {
+	if len(m.structs) == 0 {
+		return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			errors.New("frugal: msgpack field outside of a struct"))
+	}
+	m.structs[len(m.structs)-1].fields++
+	return m.writeInt(int64(id))
+}
+
+func (m *msgpackProtocol) WriteFieldEnd() error {
+	return nil
+}
+
+// WriteFieldStop does nothing since struct maps are prefixed by their size.
+func (m *msgpackProtocol) WriteFieldStop() error {
+	return nil
+}
+
+func (m *msgpackProtocol) WriteMapBegin(keyType thrift.TType, valueType thrift.TType, size int) error {
+	return m.writeMapHeader(size)
+}
+
+func (m *msgpackProtocol) WriteMapEnd() error {
+	return nil
+}
+
+func (m *msgpackProtocol) WriteListBegin(elemType thrift.TType, size int) error {
+	return m.writeArrayHeader(size)
+}
+
+func (m *msgpackProtocol) WriteListEnd() error {
+	return nil
+}
+
+func (m *msgpackProtocol) WriteSetBegin(elemType thrift.TType, size int) error {
+	return m.writeArrayHeader(size)
+}
+
+func (m *msgpackProtocol) WriteSetEnd() error {
+	return nil
+}
+
+func (m *msgpackProtocol) WriteBool(value bool) error {
+	if value {
+		return m.write(0xc3)
+	}
+	return m.write(0xc2)
+}
+
+func (m *msgpackProtocol) WriteI16(value int16) error {
+	return m.writeInt(int64(value))
+}
+
+func (m *msgpackProtocol) WriteI32(value int32) error {
+	return m.writeInt(int64(value))
+}
+
+func (m *msgpackProtocol) WriteI64(value int64) error {
+	return m.writeInt(value)
+}
+
+func (m *msgpackProtocol) WriteDouble(value float64) error {
+	return m.writeHeader(0xcb, math.Float64bits(value), 8)
+}
+
+func (m *msgpackProtocol) WriteString(value string) error {
+	if err := m.writeSized(len(value), 0xa0, 32, 0xd9, 0xda, 0xdb); err != nil {
+		return err
+	}
+	return m.write([]byte(value)...)
+}
+
+func (m *msgpackProtocol) WriteBinary(value []byte) error {
+	if err := m.writeSized(len(value), 0, 0, 0xc4, 0xc5, 0xc6); err != nil {
+		return err
+	}
+	return m.write(value...)
+}
+
+// readCode reads the type byte of the next value.
+func (m *msgpackProtocol) readCode() (byte, error) {
+	if m.hasPeeked {
+		m.hasPeeked = false
+		return m.peeked, nil
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(m.trans, b); err != nil {
+		return 0, thrift.NewTTransportExceptionFromError(err)
+	}
+	return b[0], nil
+}
+
+// peekType returns the Thrift type inferred from the encoding of the next
+// value without consuming it.
+func (m *msgpackProtocol) peekType() (thrift.TType, error) {
+	code, err := m.readCode()
+	if err != nil {
+		return thrift.STOP, err
+	}
+	m.peeked, m.hasPeeked = code, true
+	switch {
+	case code <= 0x7f, code >= 0xe0, code >= 0xcc && code <= 0xd3:
+		return thrift.I64, nil
+	case code <= 0x8f, code == 0xde, code == 0xdf:
+		return thrift.STRUCT, nil
+	case code <= 0x9f, code == 0xdc, code == 0xdd:
+		return thrift.LIST, nil
+	case code <= 0xbf, code >= 0xd9 && code <= 0xdb, code >= 0xc4 && code <= 0xc6:
+		return thrift.STRING, nil
+	case code == 0xc2, code == 0xc3:
+		return thrift.BOOL, nil
+	case code == 0xca, code == 0xcb:
+		return thrift.DOUBLE, nil
+	default:
+		return thrift.VOID, nil
+	}
+}
+
+// readN reads the next n bytes of a value. Sizes beyond the remaining bytes
+// of the transport or the default maximum frame size are rejected before
+// allocating.
+func (m *msgpackProtocol) readN(n uint64) ([]byte, error) {
+	if n > uint64(defaultMaxLength) || n > m.trans.RemainingBytes() {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.SIZE_LIMIT,
+			fmt.Errorf("frugal: msgpack value size %d exceeds the available data", n))
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(m.trans, b); err != nil {
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+	return b, nil
+}
+
+func (m *msgpackProtocol) readUint(width int) (uint64, error) {
+	b, err := m.readN(uint64(width))
+	if err != nil {
+		return 0, err
+	}
+	switch width {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+func unexpectedMsgpackCode(code byte, expected string) error {
+	return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+		fmt.Errorf("frugal: unexpected msgpack type 0x%02x, expected %s", code, expected))
+}
+
+func (m *msgpackProtocol) readInt(min, max int64) (int64, error) {
+	code, err := m.readCode()
+	if err != nil {
+		return 0, err
+	}
+	var v int64
+	switch {
+	case code <= 0x7f:
+		v = int64(code)
+	case code >= 0xe0:
+		v = int64(int8(code))
+	case code >= 0xcc && code <= 0xcf:
+		u, err := m.readUint(1 << (code - 0xcc))
+		if err != nil {
+			return 0, err
+		}
+		if u > math.MaxInt64 {
+			return 0, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+				fmt.Errorf("frugal: msgpack integer %d out of range", u))
+		}
+		v = int64(u)
+	case code >= 0xd0 && code <= 0xd3:
+		width := 1 << (code - 0xd0)
+		u, err := m.readUint(width)
+		if err != nil {
+			return 0, err
+		}
+		// Sign extend from the encoded width.
+		shift := uint(64 - 8*width)
+		v = int64(u<<shift) >> shift
+	default:
+		return 0, unexpectedMsgpackCode(code, "integer")
+	}
+	if v < min || v > max {
+		return 0, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: msgpack integer %d out of range", v))
+	}
+	return v, nil
+}
+
+// readSize reads the header of an array or map and returns its size.
+func (m *msgpackProtocol) readSize(fix, code16, code32 byte, expected string) (int, error) {
+	code, err := m.readCode()
+	if err != nil {
+		return 0, err
+	}
+	var size uint64
+	switch {
+	case code&0xf0 == fix:
+		size = uint64(code & 0x0f)
+	case code == code16:
+		size, err = m.readUint(2)
+	case code == code32:
+		size, err = m.readUint(4)
+	default:
+		return 0, unexpectedMsgpackCode(code, expected)
+	}
+	if err != nil {
+		return 0, err
+	}
+	// Every element takes at least a byte.
+	if size > m.trans.RemainingBytes() {
+		return 0, thrift.NewTProtocolExceptionWithType(thrift.SIZE_LIMIT,
+			fmt.Errorf("frugal: msgpack %s size %d exceeds the available data", expected, size))
+	}
+	return int(size), nil
+}
+
+func (m *msgpackProtocol) readArrayHeader() (int, error) {
+	return m.readSize(0x90, 0xdc, 0xdd, "array")
+}
+
+func (m *msgpackProtocol) readMapHeader() (int, error) {
+	return m.readSize(0x80, 0xde, 0xdf, "map")
+}
+
+// readBytes reads a str or bin value.
+func (m *msgpackProtocol) readBytes() ([]byte, error) {
+	code, err := m.readCode()
+	if err != nil {
+		return nil, err
+	}
+	var size uint64
+	switch {
+	case code >= 0xa0 && code <= 0xbf:
+		size = uint64(code & 0x1f)
+	case code == 0xd9 || code == 0xc4:
+		size, err = m.readUint(1)
+	case code == 0xda || code == 0xc5:
+		size, err = m.readUint(2)
+	case code == 0xdb || code == 0xc6:
+		size, err = m.readUint(4)
+	default:
+		return nil, unexpectedMsgpackCode(code, "str or bin")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.readN(size)
+}
+
+func (m *msgpackProtocol) ReadMessageBegin() (string, thrift.TMessageType, int32, error) {
+	size, err := m.readArrayHeader()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if size != 4 {
+		return "", 0, 0, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: msgpack message has %d elements, expected 4", size))
+	}
+	name, err := m.ReadString()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	typeID, err := m.readInt(math.MinInt32, math.MaxInt32)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	seqID, err := m.readInt(math.MinInt32, math.MaxInt32)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return name, thrift.TMessageType(typeID), int32(seqID), nil
+}
+
+func (m *msgpackProtocol) ReadMessageEnd() error {
+	return nil
+}
+
+func (m *msgpackProtocol) ReadStructBegin() (string, error) {
+	size, err := m.readMapHeader()
+	if err != nil {
+		return "", err
+	}
+	m.fields = append(m.fields, size)
+	return "", nil
+}
+
+func (m *msgpackProtocol) ReadStructEnd() error {
+	if len(m.fields) == 0 {
+		return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			errors.New("frugal: msgpack struct end without struct begin"))
+	}
+	m.fields = m.fields[:len(m.fields)-1]
+	return nil
+}
+
+// ReadFieldBegin returns the next field of the struct being read, or STOP
+// once all of its fields have been read.
+func (m *msgpackProtocol) ReadFieldBegin() (string, thrift.TType, int16, error) {
+	if len(m.fields) == 0 {
+		return "", thrift.STOP, 0, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			errors.New("frugal: msgpack field outside of a struct"))
+	}
+	if m.fields[len(m.fields)-1] == 0 {
+		return "", thrift.STOP, 0, nil
+	}
+	m.fields[len(m.fields)-1]--
+	id, err := m.readInt(math.MinInt16, math.MaxInt16)
+	if err != nil {
+		return "", thrift.STOP, 0, err
+	}
+	typeID, err := m.peekType()
+	return "", typeID, int16(id), err
+}
+
+func (m *msgpackProtocol) ReadFieldEnd() error {
+	return nil
+}
+
+func (m *msgpackProtocol) ReadMapBegin() (thrift.TType, thrift.TType, int, error) {
+	size, err := m.readMapHeader()
+	if err != nil || size == 0 {
+		return thrift.VOID, thrift.VOID, size, err
+	}
+	keyType, err := m.peekType()
+	return keyType, thrift.VOID, size, err
+}
+
+func (m *msgpackProtocol) ReadMapEnd() error {
+	return nil
+}
+
+func (m *msgpackProtocol) ReadListBegin() (thrift.TType, int, error) {
+	size, err := m.readArrayHeader()
+	if err != nil || size == 0 {
+		return thrift.VOID, size, err
+	}
+	elemType, err := m.peekType()
+	return elemType, size, err
+}
+
+func (m *msgpackProtocol) ReadListEnd() error {
+	return nil
+}
+
+func (m *msgpackProtocol) ReadSetBegin() (thrift.TType, int, error) {
+	return m.ReadListBegin()
+}
+
+func (m *msgpackProtocol) ReadSetEnd() error {
+	return nil
+}
+
+func (m *msgpackProtocol) ReadBool() (bool, error) {
+	code, err := m.readCode()
+	if err != nil {
+		return false, err
+	}
+	switch code {
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	default:
+		return false, unexpectedMsgpackCode(code, "bool")
+	}
+}
+
+func (m *msgpackProtocol) ReadI16() (int16, error) {
+	v, err := m.readInt(math.MinInt16, math.MaxInt16)
+	return int16(v), err
+}
+
+func (m *msgpackProtocol) ReadI32() (int32, error) {
+	v, err := m.readInt(math.MinInt32, math.MaxInt32)
+	return int32(v), err
+}
+
+func (m *msgpackProtocol) ReadI64() (int64, error) {
+	return m.readInt(math.MinInt64, math.MaxInt64)
+}
+
+func (m *msgpackProtocol) ReadDouble() (float64, error) {
+	code, err := m.readCode()
+	if err != nil {
+		return 0, err
+	}
+	switch code {
+	case 0xca:
+		u, err := m.readUint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := m.readUint(8)
+		return math.Float64frombits(u), err
+	default:
+		return 0, unexpectedMsgpackCode(code, "float")
+	}
+}
+
+func (m *msgpackProtocol) ReadString() (string, error) {
+	b, err := m.readBytes()
+	return string(b), err
+}
+
+func (m *msgpackProtocol) ReadBinary() ([]byte, error) {
+	return m.readBytes()
+}
+
+// Skip skips the next value, whatever its type, since the types reported
+// when reading are inferred.
+func (m *msgpackProtocol) Skip(fieldType thrift.TType) error {
+	return m.skip(thrift.DEFAULT_RECURSION_DEPTH)
+}
+
+func (m *msgpackProtocol) skip(depth int) error {
+	if depth <= 0 {
+		return thrift.NewTProtocolExceptionWithType(thrift.DEPTH_LIMIT, errors.New("Depth limit exceeded"))
+	}
+	code, err := m.readCode()
+	if err != nil {
+		return err
+	}
+	var n uint64
+	elements := 0
+	switch {
+	case code <= 0x7f, code >= 0xe0, code == 0xc0, code == 0xc2, code == 0xc3:
+	case code <= 0x8f:
+		elements = 2 * int(code&0x0f)
+	case code <= 0x9f:
+		elements = int(code & 0x0f)
+	case code <= 0xbf:
+		n = uint64(code & 0x1f)
+	case code == 0xc4, code == 0xd9:
+		n, err = m.readUint(1)
+	case code == 0xc5, code == 0xda:
+		n, err = m.readUint(2)
+	case code == 0xc6, code == 0xdb:
+		n, err = m.readUint(4)
+	case code == 0xc7, code == 0xc8, code == 0xc9:
+		// ext: size, type, data
+		n, err = m.readUint(1 << (code - 0xc7))
+		n++
+	case code == 0xca:
+		n = 4
+	case code == 0xcb:
+		n = 8
+	case code >= 0xcc && code <= 0xcf:
+		n = 1 << (code - 0xcc)
+	case code >= 0xd0 && code <= 0xd3:
+		n = 1 << (code - 0xd0)
+	case code >= 0xd4 && code <= 0xd8:
+		// fixext: type, data
+		n = 1 + 1<<(code-0xd4)
+	case code == 0xdc, code == 0xde:
+		var size uint64
+		size, err = m.readUint(2)
+		elements = int(size)
+		if code == 0xde {
+			elements *= 2
+		}
+	case code == 0xdd, code == 0xdf:
+		var size uint64
+		size, err = m.readUint(4)
+		elements = int(size)
+		if code == 0xdf {
+			elements *= 2
+		}
+	default:
+		return unexpectedMsgpackCode(code, "a value")
+	}
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		if _, err := m.readN(n); err != nil {
+			return err
+		}
+	}
+	if uint64(elements) > m.trans.RemainingBytes() {
+		return thrift.NewTProtocolExceptionWithType(thrift.SIZE_LIMIT,
+			fmt.Errorf("frugal: msgpack size %d exceeds the available data", elements))
+	}
+	for i := 0; i < elements; i++ {
+		if err := m.skip(depth - 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *msgpackProtocol) Flush() error {
+	return thrift.NewTTransportExceptionFromError(m.trans.Flush())
+}
+
+func (m *msgpackProtocol) Transport() thrift.TTransport {
+	return m.trans
+}
+
+// msgpackByteCodec is the transport of the binary protocol which provides
+// WriteByte and ReadByte to msgpackProtocol, encoding bytes as integers.
+type msgpackByteCodec struct {
+	thrift.TTransport
+	protocol *msgpackProtocol
+}
+
+func (c *msgpackByteCodec) WriteByte(b byte) error {
+	return c.protocol.writeInt(int64(int8(b)))
+}
+
+func (c *msgpackByteCodec) ReadByte() (byte, error) {
+	v, err := c.protocol.readInt(math.MinInt8, math.MaxInt8)
+	return byte(v), err
+}
+
+func (c *msgpackByteCodec) WriteString(s string) (int, error) {
+	return c.protocol.writer().Write([]byte(s))
+}
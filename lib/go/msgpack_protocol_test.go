@@ -0,0 +1,135 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures requests round-trip through the MessagePack protocol beneath the
+// frugal headers.
+func TestMessagePackProtocolRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFMessagePackProtocolFactory()
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("user", "alice")
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protocolFactory.GetProtocol(buffer)
+	assert.Nil(proto.WriteRequestHeader(ctx))
+	assert.Nil(writeConformanceMessage(proto, "conform", thrift.CALL))
+
+	proto = protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(buffer.Bytes()[4:])})
+	serverCtx, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	assert.Equal("cid", serverCtx.CorrelationID())
+	user, _ := serverCtx.RequestHeader("user")
+	assert.Equal("alice", user)
+	readConformanceMessage(t, proto, thrift.CALL)
+}
+
+// Ensures messages are encoded as plain MessagePack that other libraries can
+// decode.
+func TestMessagePackProtocolEncoding(t *testing.T) {
+	assert := assert.New(t)
+	buffer := thrift.NewTMemoryBuffer()
+	proto := (&msgpackProtocolFactory{}).GetProtocol(buffer)
+	assert.Nil(proto.WriteMessageBegin("ping", thrift.CALL, 1))
+	assert.Nil(proto.WriteStructBegin("ping_args"))
+	assert.Nil(proto.WriteFieldBegin("a", thrift.I32, 1))
+	assert.Nil(proto.WriteI32(-1))
+	assert.Nil(proto.WriteFieldEnd())
+	assert.Nil(proto.WriteFieldBegin("b", thrift.STRING, 2))
+	assert.Nil(proto.WriteString("a"))
+	assert.Nil(proto.WriteFieldEnd())
+	assert.Nil(proto.WriteFieldBegin("c", thrift.LIST, 3))
+	assert.Nil(proto.WriteListBegin(thrift.I64, 2))
+	assert.Nil(proto.WriteI64(300))
+	assert.Nil(proto.WriteByte(-100))
+	assert.Nil(proto.WriteListEnd())
+	assert.Nil(proto.WriteFieldEnd())
+	assert.Nil(proto.WriteFieldStop())
+	assert.Nil(proto.WriteStructEnd())
+	assert.Nil(proto.WriteMessageEnd())
+
+	expected := []byte{
+		0x94, 0xa4, 'p', 'i', 'n', 'g', 0x01, 0x01,
+		0x83,
+		0x01, 0xff,
+		0x02, 0xa1, 'a',
+		0x03, 0x92, 0xcd, 0x01, 0x2c, 0xd0, 0x9c,
+	}
+	assert.Equal(expected, buffer.Bytes())
+}
+
+// Ensures unknown fields are skipped whatever their encoding and integers
+// which don't fit the read type are rejected.
+func TestMessagePackProtocolSkip(t *testing.T) {
+	assert := assert.New(t)
+	buffer := thrift.NewTMemoryBuffer()
+	proto := (&msgpackProtocolFactory{}).GetProtocol(buffer)
+	assert.Nil(proto.WriteStructBegin("s"))
+	assert.Nil(proto.WriteFieldBegin("m", thrift.MAP, 1))
+	assert.Nil(proto.WriteMapBegin(thrift.STRING, thrift.LIST, 1))
+	assert.Nil(proto.WriteString("k"))
+	assert.Nil(proto.WriteListBegin(thrift.DOUBLE, 1))
+	assert.Nil(proto.WriteDouble(1.5))
+	assert.Nil(proto.WriteListEnd())
+	assert.Nil(proto.WriteMapEnd())
+	assert.Nil(proto.WriteFieldEnd())
+	assert.Nil(proto.WriteFieldBegin("b", thrift.STRING, 2))
+	assert.Nil(proto.WriteBinary(make([]byte, 300)))
+	assert.Nil(proto.WriteFieldEnd())
+	assert.Nil(proto.WriteFieldBegin("i", thrift.I32, 3))
+	assert.Nil(proto.WriteI32(70000))
+	assert.Nil(proto.WriteFieldEnd())
+	assert.Nil(proto.WriteFieldStop())
+	assert.Nil(proto.WriteStructEnd())
+
+	_, err := proto.ReadStructBegin()
+	assert.Nil(err)
+	_, typeID, id, err := proto.ReadFieldBegin()
+	assert.Nil(err)
+	assert.Equal(int16(1), id)
+	assert.Equal(thrift.TType(thrift.STRUCT), typeID)
+	assert.Nil(proto.Skip(typeID))
+	_, typeID, id, err = proto.ReadFieldBegin()
+	assert.Nil(err)
+	assert.Equal(int16(2), id)
+	assert.Nil(proto.Skip(typeID))
+	_, typeID, id, err = proto.ReadFieldBegin()
+	assert.Nil(err)
+	assert.Equal(int16(3), id)
+	assert.Equal(thrift.TType(thrift.I64), typeID)
+	_, err = proto.ReadI16()
+	assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+	_, typeID, _, err = proto.ReadFieldBegin()
+	assert.Nil(err)
+	assert.Equal(thrift.TType(thrift.STOP), typeID)
+	assert.Nil(proto.ReadStructEnd())
+}
+
+// Ensures sizes larger than the remaining data are rejected before
+// allocating.
+func TestMessagePackProtocolSizeLimit(t *testing.T) {
+	assert := assert.New(t)
+	buffer := thrift.NewTMemoryBuffer()
+	buffer.Write([]byte{0xdb, 0x7f, 0xff, 0xff, 0xff, 'a'})
+	proto := (&msgpackProtocolFactory{}).GetProtocol(buffer)
+	_, err := proto.ReadString()
+	assert.Equal(thrift.SIZE_LIMIT, err.(thrift.TProtocolException).TypeId())
+}
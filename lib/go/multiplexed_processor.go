@@ -0,0 +1,239 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"strings"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// multiplexedSeparator separates the service name from the method name in
+// the messages of multiplexed requests, as with Thrift's
+// TMultiplexedProtocol.
+const multiplexedSeparator = ":"
+
+// NewFMultiplexedProtocolFactory returns a copy of the given FProtocolFactory
+// for clients of the service with the given name on a server using an
+// FMultiplexedProcessor. Requests are sent with the method name prefixed by
+// the service name, so clients of several services can share one FTransport,
+// one connection or subject, and one server.
+//
+//	albums := music.NewFAlbumsClient(frugal.NewFServiceProvider(transport,
+//		frugal.NewFMultiplexedProtocolFactory(protocolFactory, "albums")))
+//	store := music.NewFStoreClient(frugal.NewFServiceProvider(transport,
+//		frugal.NewFMultiplexedProtocolFactory(protocolFactory, "store")))
+func NewFMultiplexedProtocolFactory(protocolFactory *FProtocolFactory, serviceName string) *FProtocolFactory {
+	multiplexed := *protocolFactory
+	multiplexed.protoFactory = &multiplexedProtocolFactory{
+		TProtocolFactory: protocolFactory.protoFactory,
+		serviceName:      serviceName,
+	}
+	return &multiplexed
+}
+
+// multiplexedProtocolFactory produces TProtocols which prefix the method
+// names of requests with a service name.
+type multiplexedProtocolFactory struct {
+	thrift.TProtocolFactory
+	serviceName string
+}
+
+func (m *multiplexedProtocolFactory) GetProtocol(tr thrift.TTransport) thrift.TProtocol {
+	return &multiplexedProtocol{TProtocol: m.TProtocolFactory.GetProtocol(tr), serviceName: m.serviceName}
+}
+
+// multiplexedProtocol is a TProtocol which prefixes the method names of
+// requests with a service name.
+type multiplexedProtocol struct {
+	thrift.TProtocol
+	serviceName string
+}
+
+func (m *multiplexedProtocol) WriteMessageBegin(name string, typeID thrift.TMessageType, seqID int32) error {
+	if typeID == thrift.CALL || typeID == thrift.ONEWAY {
+		name = m.serviceName + multiplexedSeparator + name
+	}
+	return m.TProtocol.WriteMessageBegin(name, typeID, seqID)
+}
+
+// replayedMessageProtocol is a TProtocol which returns a message begin which
+// has already been read before reading the rest of the message.
+type replayedMessageProtocol struct {
+	thrift.TProtocol
+	name     string
+	typeID   thrift.TMessageType
+	seqID    int32
+	replayed bool
+}
+
+func (r *replayedMessageProtocol) ReadMessageBegin() (string, thrift.TMessageType, int32, error) {
+	if !r.replayed {
+		r.replayed = true
+		return r.name, r.typeID, r.seqID, nil
+	}
+	return r.TProtocol.ReadMessageBegin()
+}
+
+// FMultiplexedProcessor is an FProcessor which routes requests sent with an
+// FProtocolFactory returned by NewFMultiplexedProtocolFactory to the
+// processor registered for their service name, so several services can be
+// served by one FServer on one subject or connection. The service name is
+// taken from the prefix of the method name, as with Thrift's
+// TMultiplexedProcessor, and removed before the request is processed, so
+// responses carry the plain method name. Unlike an FServiceMux, which routes
+// requests by a header, this doesn't require clients to share an
+// FTransportMux. Requests without a service name are routed to the default
+// processor, if one is set.
+type FMultiplexedProcessor struct {
+	protocolFactory *FProtocolFactory
+
+	mu         sync.RWMutex
+	processors map[string]FProcessor
+	fallback   FProcessor
+	writeMu    sync.Mutex
+}
+
+// NewFMultiplexedProcessor creates a new FMultiplexedProcessor. It must be
+// given the protocol factory of the server it's used with.
+func NewFMultiplexedProcessor(protocolFactory *FProtocolFactory) *FMultiplexedProcessor {
+	return &FMultiplexedProcessor{protocolFactory: protocolFactory, processors: make(map[string]FProcessor)}
+}
+
+// RegisterProcessor routes requests for the service with the given name to
+// the given processor. This should only be called before the server is
+// started.
+func (m *FMultiplexedProcessor) RegisterProcessor(serviceName string, processor FProcessor) *FMultiplexedProcessor {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.processors[serviceName] = processor
+	return m
+}
+
+// WithDefault routes requests which don't have a service name to the given
+// processor.
+func (m *FMultiplexedProcessor) WithDefault(processor FProcessor) *FMultiplexedProcessor {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fallback = processor
+	return m
+}
+
+// Process reads the request headers and message begin, then processes the
+// request with the processor for its service name. Cancellations don't carry
+// a message, so they are passed to every processor.
+func (m *FMultiplexedProcessor) Process(iprot, oprot *FProtocol) error {
+	request, err := iprot.peekRequestHeaders()
+	if err != nil {
+		return err
+	}
+	replay := headerReplay(iprot)
+
+	if _, ok := request.header(cancelHeader); ok {
+		for _, processor := range m.allProcessors() {
+			if err := processor.Process(replay(), oprot); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	name, typeID, seqID, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	m.mu.RLock()
+	processor := m.fallback
+	serviceName, method := "", name
+	if i := strings.Index(name, multiplexedSeparator); i >= 0 {
+		serviceName, method = name[:i], name[i+len(multiplexedSeparator):]
+		processor = m.processors[serviceName]
+	}
+	m.mu.RUnlock()
+
+	proto := replay()
+	proto.TProtocol = &replayedMessageProtocol{TProtocol: proto.TProtocol, name: method, typeID: typeID, seqID: seqID}
+	if processor != nil {
+		return processor.Process(proto, oprot)
+	}
+	return m.unknownService(proto, oprot, serviceName)
+}
+
+// unknownService responds to a request for a service which isn't registered.
+func (m *FMultiplexedProcessor) unknownService(iprot, oprot *FProtocol, serviceName string) error {
+	ctx, err := iprot.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	name, _, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	if err := iprot.Skip(thrift.STRUCT); err != nil {
+		return err
+	}
+	if err := iprot.ReadMessageEnd(); err != nil {
+		return err
+	}
+	logger().Warnf("frugal: client invoked %s on unknown service %q on request with correlation id %s",
+		name, serviceName, ctx.CorrelationID())
+	ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN_METHOD,
+		"Unknown service "+serviceName)
+	iprot.recordError(ex)
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	return writeExceptionResponse(oprot, ctx, name, ex)
+}
+
+func (m *FMultiplexedProcessor) allProcessors() []FProcessor {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	processors := make([]FProcessor, 0, len(m.processors)+1)
+	for _, processor := range m.processors {
+		processors = append(processors, processor)
+	}
+	if m.fallback != nil {
+		processors = append(processors, m.fallback)
+	}
+	return processors
+}
+
+// AddMiddleware adds the given ServiceMiddleware to every registered
+// processor.
+func (m *FMultiplexedProcessor) AddMiddleware(middleware ServiceMiddleware) {
+	for _, processor := range m.allProcessors() {
+		processor.AddMiddleware(middleware)
+	}
+}
+
+// Annotations returns the annotations of the methods of every registered
+// processor. Methods are keyed by their multiplexed name, prefixed by their
+// service name, except for those of the default processor.
+func (m *FMultiplexedProcessor) Annotations() map[string]map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	annotations := make(map[string]map[string]string)
+	if m.fallback != nil {
+		for method, methodAnnotations := range m.fallback.Annotations() {
+			annotations[method] = methodAnnotations
+		}
+	}
+	for serviceName, processor := range m.processors {
+		for method, methodAnnotations := range processor.Annotations() {
+			annotations[serviceName+multiplexedSeparator+method] = methodAnnotations
+		}
+	}
+	return annotations
+}
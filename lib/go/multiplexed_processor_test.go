@@ -0,0 +1,94 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures requests from the clients of several services share one FTransport
+// and are routed to their service's processor by method name.
+func TestMultiplexedProcessor(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	albums := NewFHealthServer()
+	albums.SetServingStatus("", HealthNotServing)
+	fallback := NewFHealthServer()
+	fallback.SetServingStatus("", HealthUnknown)
+	albumsProcessor := NewFHealthProcessor(albums)
+	albumsProcessor.AddToAnnotationsMap("check", map[string]string{"service": "albums"})
+	fallbackProcessor := NewFHealthProcessor(fallback)
+	fallbackProcessor.AddToAnnotationsMap("check", map[string]string{"service": "default"})
+	processor := NewFMultiplexedProcessor(protocolFactory).
+		RegisterProcessor("albums", albumsProcessor).
+		RegisterProcessor("store", NewFHealthProcessor(NewFHealthServer())).
+		WithDefault(fallbackProcessor)
+	transport := NewFLoopbackTransport(processor, protocolFactory)
+	assert.Nil(transport.Open())
+
+	expected := map[string]FHealthStatus{"albums": HealthNotServing, "store": HealthServing, "": HealthUnknown}
+	for serviceName, expectedStatus := range expected {
+		clientFactory := protocolFactory
+		if serviceName != "" {
+			clientFactory = NewFMultiplexedProtocolFactory(protocolFactory, serviceName)
+		}
+		client := NewFHealthClient(NewFServiceProvider(transport, clientFactory))
+		status, err := client.Check(NewFContext(""), "")
+		assert.Nil(err)
+		assert.Equal(expectedStatus, status, serviceName)
+	}
+
+	assert.Equal(map[string]map[string]string{
+		"albums:check": {"service": "albums"},
+		"check":        {"service": "default"},
+	}, processor.Annotations())
+}
+
+// Ensures requests for unknown services fail with an exception.
+func TestMultiplexedProcessorUnknownService(t *testing.T) {
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	processor := NewFMultiplexedProcessor(protocolFactory).
+		RegisterProcessor("albums", NewFHealthProcessor(NewFHealthServer()))
+	transport := NewFLoopbackTransport(processor, protocolFactory)
+	assert.Nil(t, transport.Open())
+
+	for _, clientFactory := range []*FProtocolFactory{NewFMultiplexedProtocolFactory(protocolFactory, "store"), protocolFactory} {
+		client := NewFHealthClient(NewFServiceProvider(transport, clientFactory))
+		_, err := client.Check(NewFContext(""), "")
+		ex, ok := err.(thrift.TApplicationException)
+		if assert.True(t, ok) {
+			assert.Equal(t, int32(APPLICATION_EXCEPTION_UNKNOWN_METHOD), ex.TypeId())
+		}
+	}
+}
+
+// Ensures cancellations are passed to every processor.
+func TestMultiplexedProcessorCancel(t *testing.T) {
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	albums := &serviceProcessor{name: "albums"}
+	fallback := &serviceProcessor{name: "default"}
+	processor := NewFMultiplexedProcessor(protocolFactory).
+		RegisterProcessor("albums", albums).
+		WithDefault(fallback)
+	transport := NewFLoopbackTransport(processor, protocolFactory)
+	assert.Nil(t, transport.Open())
+
+	_, err := transport.Request(NewFContext("cid"), newCancelFrame(NewFContext("cid")))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, albums.cancelled)
+	assert.Equal(t, 1, fallback.cancelled)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// isBatch indicates if the given NATS message data holds more than one
+// frame. Batches are the concatenation of their frames, including each
+// frame's size, so the first frame of a batch is shorter than the message.
+func isBatch(data []byte) bool {
+	return len(data) > 4 && int(binary.BigEndian.Uint32(data))+4 < len(data)
+}
+
+// splitBatch returns the frames, including their frame sizes, of the given
+// batch. The frames share the batch's memory.
+func splitBatch(data []byte) ([][]byte, error) {
+	var frames [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated frame size in batch")
+		}
+		end := int(binary.BigEndian.Uint32(data)) + 4
+		if end > len(data) {
+			return nil, fmt.Errorf("frame of %d bytes exceeds batch", end-4)
+		}
+		frames = append(frames, data[:end:end])
+		data = data[end:]
+	}
+	return frames, nil
+}
+
+// natsBatcher coalesces frames published to the same subject in quick
+// succession into a single NATS message. A batch is published when it holds
+// the maximum number of frames, when the next frame would overflow the NATS
+// message size, or when the window since its first frame elapses. Transports
+// only batch frames once the negotiator has seen the server support batching.
+type natsBatcher struct {
+	window     time.Duration
+	maxFrames  int
+	publish    func(subject string, data []byte) error
+	negotiator *FFeatureNegotiator
+
+	mu      sync.Mutex
+	pending map[string]*natsBatch
+}
+
+// natsBatch is a batch of frames waiting to be published.
+type natsBatch struct {
+	data   []byte
+	frames int
+	timer  *time.Timer
+	done   chan struct{}
+	err    error
+}
+
+func newNatsBatcher(window time.Duration, maxFrames int, publish func(string, []byte) error) *natsBatcher {
+	return &natsBatcher{
+		window:    window,
+		maxFrames: maxFrames,
+		publish:   publish,
+		pending:   make(map[string]*natsBatch),
+	}
+}
+
+// add adds the given frame to the batch for the given subject and waits for
+// the batch to be published, returning the result of the publish. Frames too
+// large to share a message are published alone.
+func (b *natsBatcher) add(subject string, frame []byte) error {
+	if len(frame) > natsMaxMessageSize {
+		return b.publish(subject, frame)
+	}
+
+	var ready []*natsBatch
+	b.mu.Lock()
+	batch := b.pending[subject]
+	if batch != nil && len(batch.data)+len(frame) > natsMaxMessageSize {
+		b.detach(subject, batch)
+		ready = append(ready, batch)
+		batch = nil
+	}
+	if batch == nil {
+		batch = &natsBatch{done: make(chan struct{})}
+		b.pending[subject] = batch
+		batch.timer = time.AfterFunc(b.window, func() { b.expire(subject, batch) })
+	}
+	batch.data = append(batch.data, frame...)
+	batch.frames++
+	if b.maxFrames > 0 && batch.frames >= b.maxFrames {
+		b.detach(subject, batch)
+		ready = append(ready, batch)
+	}
+	b.mu.Unlock()
+
+	for _, full := range ready {
+		b.flush(subject, full)
+	}
+	<-batch.done
+	return batch.err
+}
+
+// detach removes the given batch from the pending batches so no more frames
+// are added to it. The caller must hold the lock.
+func (b *natsBatcher) detach(subject string, batch *natsBatch) {
+	delete(b.pending, subject)
+	batch.timer.Stop()
+}
+
+// expire publishes the given batch when its window elapses, unless it has
+// already been published for being full.
+func (b *natsBatcher) expire(subject string, batch *natsBatch) {
+	b.mu.Lock()
+	if b.pending[subject] != batch {
+		b.mu.Unlock()
+		return
+	}
+	b.detach(subject, batch)
+	b.mu.Unlock()
+	b.flush(subject, batch)
+}
+
+// flush publishes the given batch and releases the frames waiting on it.
+func (b *natsBatcher) flush(subject string, batch *natsBatch) {
+	batch.err = b.publish(subject, batch.data)
+	close(batch.done)
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures batches are split into their frames and malformed batches are
+// rejected.
+func TestSplitBatch(t *testing.T) {
+	assert := assert.New(t)
+	first := prependFrameSize([]byte("foo"))
+	second := prependFrameSize([]byte("barbaz"))
+	batch := append(append([]byte{}, first...), second...)
+	assert.False(isBatch(first))
+	assert.True(isBatch(batch))
+
+	frames, err := splitBatch(batch)
+	assert.Nil(err)
+	assert.Equal([][]byte{first, second}, frames)
+
+	_, err = splitBatch(batch[:len(batch)-1])
+	assert.NotNil(err)
+	_, err = splitBatch(append(batch, 0))
+	assert.NotNil(err)
+}
+
+// Ensures concurrent requests are published in a single NATS message when
+// batching is enabled and the server supports it, and each receives its own
+// response.
+func TestNatsTransportBatching(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, &echoProcessor{}, protoFactory, []string{"foo"}).Build()
+	go func() {
+		assert.Nil(server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+
+	var published int32
+	sub, err := conn.Subscribe("foo", func(*nats.Msg) {
+		atomic.AddInt32(&published, 1)
+	})
+	assert.Nil(err)
+	defer sub.Unsubscribe()
+
+	negotiator := NewFFeatureNegotiator()
+	clientFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithNegotiator(negotiator)
+	tr := NewFNatsTransportBuilder(conn, "foo").WithBatching(time.Second, 4, clientFactory).Build()
+	assert.Nil(tr.Open())
+	defer tr.Close()
+
+	request := func(payload string) {
+		ctx := NewFContext("")
+		buffer := NewTMemoryOutputBuffer(0)
+		proto := clientFactory.GetProtocol(buffer)
+		proto.WriteRequestHeader(ctx)
+		proto.WriteBinary([]byte(payload))
+		resultTrans, err := tr.Request(ctx, buffer.Bytes())
+		if !assert.Nil(err) {
+			return
+		}
+		resultProto := clientFactory.GetProtocol(resultTrans)
+		assert.Nil(resultProto.ReadResponseHeader(ctx))
+		result, err := resultProto.ReadBinary()
+		assert.Nil(err)
+		assert.Equal(payload, string(result))
+	}
+
+	// Requests aren't batched until the server is known to support it.
+	start := time.Now()
+	request("negotiate")
+	assert.True(time.Since(start) < 500*time.Millisecond)
+	assert.True(negotiator.Supports(FeatureBatching))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request(fmt.Sprintf("request %d", i))
+		}(i)
+	}
+	wg.Wait()
+	conn.Flush()
+	assert.Equal(int32(2), atomic.LoadInt32(&published))
+
+	assert.Panics(func() {
+		NewFNatsTransportBuilder(conn, "foo").WithBatching(time.Second, 4, nil)
+	})
+	assert.Panics(func() {
+		NewFNatsTransportBuilder(conn, "foo").
+			WithBatching(time.Second, 4, NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()))
+	})
+}
+
+// Ensures a batch which isn't filled is published once its window elapses.
+func TestNatsBatcherWindow(t *testing.T) {
+	assert := assert.New(t)
+	var published [][]byte
+	batcher := newNatsBatcher(10*time.Millisecond, 0, func(subject string, data []byte) error {
+		assert.Equal("foo", subject)
+		published = append(published, data)
+		return nil
+	})
+
+	start := time.Now()
+	assert.Nil(batcher.add("foo", prependFrameSize([]byte("foo"))))
+	assert.True(time.Since(start) >= 10*time.Millisecond)
+	assert.Equal([][]byte{prependFrameSize([]byte("foo"))}, published)
+	assert.Empty(batcher.pending)
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/mattrobenolt/gocql/uuid"
+	"github.com/nats-io/go-nats"
+)
+
+const (
+	// chunkMarker is written in place of the frame size of chunk messages.
+	// Frames are limited to the NATS message size, so it's never a valid
+	// frame size.
+	chunkMarker = 0xFFFFFFFF
+
+	// Chunk messages = [marker (4 bytes), id (8 bytes), index (4 bytes),
+	// count (4 bytes), chunk]
+	chunkHeaderSize = 20
+
+	// chunkFlushInterval is the number of chunks published before flushing
+	// the connection, which keeps a large frame from overrunning the client
+	// buffer and the NATS server.
+	chunkFlushInterval = 16
+
+	// chunkFlushTimeout is how long to wait for the NATS server to
+	// acknowledge published chunks.
+	chunkFlushTimeout = 5 * time.Second
+
+	// chunkReassemblyTimeout is how long a partially received frame is kept
+	// before it's discarded.
+	chunkReassemblyTimeout = 30 * time.Second
+)
+
+// natsChunkSize is the number of frame bytes carried by each chunk. It's a
+// var for testability purposes.
+var natsChunkSize = natsMaxMessageSize - chunkHeaderSize
+
+// chunkIDs are unique ids for frames split into chunks. They start at a
+// random value so ids from different processes sending chunks to the same
+// subject are unlikely to collide.
+var chunkIDs = func() uint64 {
+	id := uuid.RandomUUID()
+	return binary.BigEndian.Uint64(id[:8])
+}()
+
+func nextChunkID() uint64 {
+	return atomic.AddUint64(&chunkIDs, 1)
+}
+
+// isChunk indicates if the given NATS message data is a chunk of a larger
+// frame rather than a frame.
+func isChunk(data []byte) bool {
+	return len(data) >= chunkHeaderSize && binary.BigEndian.Uint32(data) == chunkMarker
+}
+
+// splitFrame splits the given frame into chunk messages with the given id.
+func splitFrame(id uint64, frame []byte) [][]byte {
+	count := (len(frame) + natsChunkSize - 1) / natsChunkSize
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * natsChunkSize
+		if end > len(frame) {
+			end = len(frame)
+		}
+		data := frame[i*natsChunkSize : end]
+		chunk := make([]byte, chunkHeaderSize+len(data))
+		binary.BigEndian.PutUint32(chunk, chunkMarker)
+		binary.BigEndian.PutUint64(chunk[4:], id)
+		binary.BigEndian.PutUint32(chunk[12:], uint32(i))
+		binary.BigEndian.PutUint32(chunk[16:], uint32(count))
+		copy(chunk[chunkHeaderSize:], data)
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// publishChunked publishes the given frame to the subject as chunk messages,
+// flushing the connection periodically for flow control.
+func publishChunked(conn *nats.Conn, subject, reply string, frame []byte) error {
+	for i, chunk := range splitFrame(nextChunkID(), frame) {
+		if err := conn.PublishRequest(subject, reply, chunk); err != nil {
+			return err
+		}
+		if (i+1)%chunkFlushInterval == 0 {
+			if err := conn.FlushTimeout(chunkFlushTimeout); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// partialFrame is a frame whose chunks are being received.
+type partialFrame struct {
+	chunks   [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// chunkAssembler reassembles frames from chunk messages, discarding frames
+// larger than its max size and frames which are not completed in time.
+type chunkAssembler struct {
+	mu      sync.Mutex
+	maxSize int
+	partial map[string]*partialFrame
+}
+
+func newChunkAssembler(maxSize int) *chunkAssembler {
+	return &chunkAssembler{maxSize: maxSize, partial: make(map[string]*partialFrame)}
+}
+
+// add adds the given chunk, received from the given source, and returns the
+// reassembled frame if it's complete. A nil frame with a nil error means more
+// chunks are needed.
+func (c *chunkAssembler) add(source string, chunk []byte) ([]byte, error) {
+	id := binary.BigEndian.Uint64(chunk[4:])
+	index := int(binary.BigEndian.Uint32(chunk[12:]))
+	count := int(binary.BigEndian.Uint32(chunk[16:]))
+	data := chunk[chunkHeaderSize:]
+	key := source + "/" + strconv.FormatUint(id, 10)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire()
+
+	if index >= count || count > c.maxSize/natsChunkSize+1 {
+		delete(c.partial, key)
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			fmt.Sprintf("frugal: chunked frame of %d chunks exceeds %d bytes", count, c.maxSize))
+	}
+	partial, ok := c.partial[key]
+	if !ok {
+		partial = &partialFrame{chunks: make([][]byte, count), started: time.Now()}
+		c.partial[key] = partial
+	}
+	if len(partial.chunks) != count {
+		delete(c.partial, key)
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: chunk count %d does not match %d", count, len(partial.chunks)))
+	}
+	if partial.chunks[index] != nil {
+		return nil, nil
+	}
+	partial.size += len(data)
+	if partial.size > c.maxSize {
+		delete(c.partial, key)
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			fmt.Sprintf("frugal: chunked frame exceeds %d bytes", c.maxSize))
+	}
+	partial.chunks[index] = append([]byte(nil), data...)
+	partial.received++
+	if partial.received < count {
+		return nil, nil
+	}
+
+	delete(c.partial, key)
+	frame := make([]byte, 0, partial.size)
+	for _, data := range partial.chunks {
+		frame = append(frame, data...)
+	}
+	return frame, nil
+}
+
+// expire discards partial frames which have not been completed in time. The
+// lock must be held.
+func (c *chunkAssembler) expire() {
+	for key, partial := range c.partial {
+		if time.Since(partial.started) > chunkReassemblyTimeout {
+			logger().Warnf("frugal: discarding chunked frame with %d of %d chunks received",
+				partial.received, len(partial.chunks))
+			delete(c.partial, key)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures frames split into chunks are reassembled regardless of the order
+// the chunks arrive in.
+func TestChunkAssembler(t *testing.T) {
+	assert := assert.New(t)
+	frame := bytes.Repeat([]byte{1, 2, 3}, natsChunkSize)
+	chunks := splitFrame(1, frame)
+	assert.Len(chunks, 3)
+	for _, chunk := range chunks {
+		assert.True(isChunk(chunk))
+		assert.True(len(chunk) <= natsMaxMessageSize)
+	}
+	assert.False(isChunk(prependFrameSize(frame)))
+
+	assembler := newChunkAssembler(len(frame))
+	for _, i := range []int{2, 0} {
+		result, err := assembler.add("foo", chunks[i])
+		assert.Nil(err)
+		assert.Nil(result)
+	}
+	// Duplicate chunks are ignored.
+	result, err := assembler.add("foo", chunks[0])
+	assert.Nil(err)
+	assert.Nil(result)
+	// Chunks from other sources are kept separate.
+	result, err = assembler.add("bar", chunks[1])
+	assert.Nil(err)
+	assert.Nil(result)
+
+	result, err = assembler.add("foo", chunks[1])
+	assert.Nil(err)
+	assert.Equal(frame, result)
+	assert.Len(assembler.partial, 1)
+}
+
+// Ensures frames larger than the assembler's max size are rejected.
+func TestChunkAssemblerTooLarge(t *testing.T) {
+	assert := assert.New(t)
+	frame := bytes.Repeat([]byte{1}, 2*natsChunkSize+1)
+	chunks := splitFrame(1, frame)
+
+	assembler := newChunkAssembler(natsChunkSize)
+	_, err := assembler.add("foo", chunks[0])
+	assert.True(IsErrTooLarge(err))
+
+	assembler = newChunkAssembler(2 * natsChunkSize)
+	_, err = assembler.add("foo", chunks[0])
+	assert.Nil(err)
+	_, err = assembler.add("foo", chunks[1])
+	assert.Nil(err)
+	_, err = assembler.add("foo", chunks[2])
+	assert.True(IsErrTooLarge(err))
+	assert.Empty(assembler.partial)
+}
+
+// echoProcessor responds to requests with the binary payload of the request.
+type echoProcessor struct {
+	processor
+}
+
+func (p *echoProcessor) Process(in, out *FProtocol) error {
+	ctx, err := in.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	payload, err := in.ReadBinary()
+	if err != nil {
+		return err
+	}
+	if err := out.WriteResponseHeader(ctx); err != nil {
+		return err
+	}
+	return out.WriteBinary(payload)
+}
+
+// Ensures requests and responses larger than the NATS message size are sent
+// as chunks when chunking is enabled.
+func TestNatsTransportChunking(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, &echoProcessor{}, protoFactory, []string{"foo"}).
+		WithChunking(4 * natsMaxMessageSize).
+		Build()
+	go func() {
+		assert.Nil(server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+
+	tr := NewFNatsTransportBuilder(conn, "foo").WithChunking(4 * natsMaxMessageSize).Build()
+	assert.Equal(uint(4*natsMaxMessageSize), tr.GetRequestSizeLimit())
+	assert.Nil(tr.Open())
+	defer tr.Close()
+
+	payload := bytes.Repeat([]byte("frugal"), natsMaxMessageSize/3)
+	ctx := NewFContext("")
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protoFactory.GetProtocol(buffer)
+	proto.WriteRequestHeader(ctx)
+	proto.WriteBinary(payload)
+	resultTrans, err := tr.Request(ctx, buffer.Bytes())
+	assert.Nil(err)
+
+	resultProto := protoFactory.GetProtocol(resultTrans)
+	assert.Nil(resultProto.ReadResponseHeader(ctx))
+	result, err := resultProto.ReadBinary()
+	assert.Nil(err)
+	assert.Equal(payload, result)
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"crypto/tls"
+
+	"github.com/nats-io/go-nats"
+)
+
+// FNatsConnectionBuilder configures and opens NATS connections, so TLS and
+// authentication can be set up without assembling nats.Options by hand. The
+// NATS transport and server builders take an established *nats.Conn rather
+// than configuring connections themselves, so TLS and authentication are
+// configured here, or with nats.Connect, and the connection passed to them:
+//
+//	conn, err := frugal.NewFNatsConnectionBuilder("tls://nats:4222").
+//		WithClientCert("client.pem", "client-key.pem").
+//		WithRootCAs("ca.pem").
+//		WithToken(token).
+//		Connect()
+//	...
+//	transport := frugal.NewFNatsTransportBuilder(conn, "service").Build()
+//
+// The vendored NATS client, go-nats 1.2.2, does not support NKeys or user
+// credentials (JWT) files, so authentication is limited to tokens and user
+// and password.
+type FNatsConnectionBuilder struct {
+	url          string
+	options      []nats.Option
+	authCallback func() (nats.Option, error)
+}
+
+// NewFNatsConnectionBuilder creates a builder which opens connections to the
+// given comma-separated NATS server URLs.
+func NewFNatsConnectionBuilder(url string) *FNatsConnectionBuilder {
+	return &FNatsConnectionBuilder{url: url}
+}
+
+// WithTLS enables TLS using the given configuration. A nil configuration
+// uses the NATS client's default, which requires TLS 1.2 and verifies the
+// server's certificate against the system's root CAs. A non-nil configuration
+// replaces any set up by earlier WithRootCAs and WithClientCert calls, which
+// add to the configuration, so it should be set first.
+func (f *FNatsConnectionBuilder) WithTLS(config *tls.Config) *FNatsConnectionBuilder {
+	if config == nil {
+		f.options = append(f.options, nats.Secure())
+	} else {
+		f.options = append(f.options, nats.Secure(config))
+	}
+	return f
+}
+
+// WithRootCAs enables TLS, verifying the server's certificate against the CA
+// certificates in the given PEM files.
+func (f *FNatsConnectionBuilder) WithRootCAs(files ...string) *FNatsConnectionBuilder {
+	f.options = append(f.options, nats.RootCAs(files...))
+	return f
+}
+
+// WithClientCert enables TLS, presenting the certificate and key in the given
+// PEM files to the server.
+func (f *FNatsConnectionBuilder) WithClientCert(certFile, keyFile string) *FNatsConnectionBuilder {
+	f.options = append(f.options, nats.ClientCert(certFile, keyFile))
+	return f
+}
+
+// WithUserInfo authenticates with the given user and password.
+func (f *FNatsConnectionBuilder) WithUserInfo(user, password string) *FNatsConnectionBuilder {
+	f.options = append(f.options, nats.UserInfo(user, password))
+	return f
+}
+
+// WithToken authenticates with the given token.
+func (f *FNatsConnectionBuilder) WithToken(token string) *FNatsConnectionBuilder {
+	f.options = append(f.options, nats.Token(token))
+	return f
+}
+
+// WithTokenCallback authenticates with the token returned by the given
+// callback, such as one read from a secret store. The callback is invoked
+// each time Connect is called, and an error returned by it fails the
+// connection. The vendored NATS client reuses the token when reconnecting.
+func (f *FNatsConnectionBuilder) WithTokenCallback(callback func() (string, error)) *FNatsConnectionBuilder {
+	f.authCallback = func() (nats.Option, error) {
+		token, err := callback()
+		if err != nil {
+			return nil, err
+		}
+		return nats.Token(token), nil
+	}
+	return f
+}
+
+// WithUserInfoCallback authenticates with the user and password returned by
+// the given callback. The callback is invoked each time Connect is called,
+// and an error returned by it fails the connection.
+func (f *FNatsConnectionBuilder) WithUserInfoCallback(callback func() (user, password string, err error)) *FNatsConnectionBuilder {
+	f.authCallback = func() (nats.Option, error) {
+		user, password, err := callback()
+		if err != nil {
+			return nil, err
+		}
+		return nats.UserInfo(user, password), nil
+	}
+	return f
+}
+
+// WithOptions adds NATS options for connection settings the builder does not
+// expose directly.
+func (f *FNatsConnectionBuilder) WithOptions(options ...nats.Option) *FNatsConnectionBuilder {
+	f.options = append(f.options, options...)
+	return f
+}
+
+// Connect opens a new NATS connection with the configured settings.
+func (f *FNatsConnectionBuilder) Connect() (*nats.Conn, error) {
+	options := f.options
+	if f.authCallback != nil {
+		option, err := f.authCallback()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options[:len(options):len(options)], option)
+	}
+	return nats.Connect(f.url, options...)
+}
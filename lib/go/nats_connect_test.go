@@ -0,0 +1,105 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// tokenAuth authorizes clients presenting a fixed token.
+type tokenAuth string
+
+func (a tokenAuth) Check(c server.ClientAuth) bool {
+	return c.GetOpts().Authorization == string(a)
+}
+
+// Ensures the connection builder authenticates with a token, including one
+// supplied by a callback, and fails when the callback does.
+func TestNatsConnectionBuilderToken(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	s.SetClientAuthMethod(tokenAuth("secret"))
+	url := fmt.Sprintf("nats://localhost:%d", defaultOptions.Port)
+
+	_, err := NewFNatsConnectionBuilder(url).WithToken("wrong").Connect()
+	assert.NotNil(err)
+
+	conn, err := NewFNatsConnectionBuilder(url).WithToken("secret").Connect()
+	assert.Nil(err)
+	conn.Close()
+
+	conn, err = NewFNatsConnectionBuilder(url).
+		WithTokenCallback(func() (string, error) { return "secret", nil }).
+		Connect()
+	assert.Nil(err)
+	conn.Close()
+
+	callbackErr := errors.New("no token")
+	_, err = NewFNatsConnectionBuilder(url).
+		WithTokenCallback(func() (string, error) { return "", callbackErr }).
+		Connect()
+	assert.Equal(callbackErr, err)
+}
+
+// Ensures the connection builder's TLS and user options are applied to the
+// NATS options.
+func TestNatsConnectionBuilderOptions(t *testing.T) {
+	assert := assert.New(t)
+	config := &tls.Config{ServerName: "nats"}
+	builder := NewFNatsConnectionBuilder("tls://localhost:4222").
+		WithTLS(config).
+		WithUserInfo("user", "pass").
+		WithOptions(nats.Name("frugal"))
+
+	opts := nats.DefaultOptions
+	for _, option := range builder.options {
+		assert.Nil(option(&opts))
+	}
+	assert.True(opts.Secure)
+	assert.Equal(config, opts.TLSConfig)
+	assert.Equal("user", opts.User)
+	assert.Equal("pass", opts.Password)
+	assert.Equal("frugal", opts.Name)
+}
+
+// Ensures a nil TLS configuration leaves the NATS client's default, which
+// verifies the server's certificate, and keeps an earlier configuration.
+func TestNatsConnectionBuilderDefaultTLS(t *testing.T) {
+	assert := assert.New(t)
+	opts := nats.DefaultOptions
+	for _, option := range NewFNatsConnectionBuilder("tls://localhost:4222").WithTLS(nil).options {
+		assert.Nil(option(&opts))
+	}
+	assert.True(opts.Secure)
+	assert.Nil(opts.TLSConfig)
+
+	config := &tls.Config{ServerName: "nats"}
+	opts = nats.DefaultOptions
+	builder := NewFNatsConnectionBuilder("tls://localhost:4222").
+		WithOptions(nats.Secure(config)).
+		WithTLS(nil)
+	for _, option := range builder.options {
+		assert.Nil(option(&opts))
+	}
+	assert.Equal(config, opts.TLSConfig)
+	assert.False(opts.TLSConfig.InsecureSkipVerify)
+}
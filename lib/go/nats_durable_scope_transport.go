@@ -0,0 +1,139 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"io"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// FNatsDurableConsumer receives messages published by NATS scope publishers
+// through a JetStream durable consumer, which remembers the last message
+// acknowledged so a subscriber which restarts resumes from where it left off.
+// Frugal's NATS client predates JetStream, so implement it with a JetStream
+// capable client, such as by wrapping a JetStream context with a stream
+// capturing the "frugal.>" subjects of the scopes.
+type FNatsDurableConsumer interface {
+	// Consume binds to the durable consumer with the given name on the given
+	// subject, creating it if it doesn't exist, and calls the handler with
+	// the data of each message delivered until the returned io.Closer is
+	// closed. Closing it must not delete the durable consumer. Messages
+	// should only be acknowledged once the handler returns nil, so messages
+	// which fail to be handled are redelivered. An *FRedeliveryError means
+	// the handler deferred the message, which should be negatively
+	// acknowledged with its delay.
+	Consume(subject, durable string, handler func(data []byte) error) (io.Closer, error)
+
+	// Delete deletes the durable consumer with the given name on the given
+	// subject, discarding its position.
+	Delete(subject, durable string) error
+}
+
+// FNatsDurableSubscriberTransportFactory creates NATS FSubscriberTransports
+// which subscribe through durable consumers.
+type FNatsDurableSubscriberTransportFactory struct {
+	consumer FNatsDurableConsumer
+	durable  string
+}
+
+// NewFNatsDurableSubscriberTransportFactory creates an
+// FNatsDurableSubscriberTransportFactory whose transports subscribe with the
+// given consumer through the durable consumer with the given name, so events
+// published while a subscriber is down are delivered once it subscribes
+// again. Subscribers sharing a durable name share its position, each message
+// being handled by one of them. Unsubscribing keeps the durable consumer;
+// removing the FSubscription deletes it.
+func NewFNatsDurableSubscriberTransportFactory(consumer FNatsDurableConsumer, durable string) *FNatsDurableSubscriberTransportFactory {
+	return &FNatsDurableSubscriberTransportFactory{consumer: consumer, durable: durable}
+}
+
+// GetTransport creates a new durable NATS FSubscriberTransport.
+func (n *FNatsDurableSubscriberTransportFactory) GetTransport() FSubscriberTransport {
+	return &fNatsDurableSubscriberTransport{consumer: n.consumer, durable: n.durable}
+}
+
+// fNatsDurableSubscriberTransport implements FSubscriberTransport.
+type fNatsDurableSubscriberTransport struct {
+	consumer FNatsDurableConsumer
+	durable  string
+
+	mu           sync.RWMutex
+	subject      string
+	subscription io.Closer
+}
+
+// Subscribe binds to the durable consumer for the subject of the given topic.
+func (n *fNatsDurableSubscriberTransport) Subscribe(topic string, callback FAsyncCallback) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subscription != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: NATS transport already open")
+	}
+	if topic == "" {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"cannot subscribe to empty subject")
+	}
+
+	subject := frugalPrefix + topic
+	subscription, err := n.consumer.Consume(subject, n.durable, handleAckedMessage(callback))
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	n.subject = subject
+	n.subscription = subscription
+	return nil
+}
+
+// IsSubscribed returns true if the transport is subscribed to a topic, false
+// otherwise.
+func (n *fNatsDurableSubscriberTransport) IsSubscribed() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.subscription != nil
+}
+
+// Unsubscribe stops consuming, keeping the durable consumer so a later
+// subscription resumes from where this one left off.
+func (n *fNatsDurableSubscriberTransport) Unsubscribe() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subscription == nil {
+		return nil
+	}
+	if err := n.subscription.Close(); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	n.subscription = nil
+	return nil
+}
+
+// Remove stops consuming and deletes the durable consumer.
+func (n *fNatsDurableSubscriberTransport) Remove() error {
+	if err := n.Unsubscribe(); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subject == "" {
+		return nil
+	}
+	if err := n.consumer.Delete(n.subject, n.durable); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	n.subject = ""
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockJetStream is an in-memory FNatsDurableConsumer which stores the
+// messages published to each subject and delivers them in order to the
+// durable consumers of the subject, remembering the position of each.
+type mockJetStream struct {
+	mu        sync.Mutex
+	messages  map[string][][]byte
+	positions map[string]int
+	handlers  map[string]func([]byte) error
+}
+
+func newMockJetStream() *mockJetStream {
+	return &mockJetStream{
+		messages:  make(map[string][][]byte),
+		positions: make(map[string]int),
+		handlers:  make(map[string]func([]byte) error),
+	}
+}
+
+func (m *mockJetStream) publish(subject string, data []byte) {
+	m.mu.Lock()
+	m.messages[subject] = append(m.messages[subject], data)
+	m.mu.Unlock()
+	m.deliver(subject)
+}
+
+// deliver delivers the messages pending for the consumers of the given
+// subject, stopping at a message which fails to be handled.
+func (m *mockJetStream) deliver(subject string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, handler := range m.handlers {
+		if !strings.HasPrefix(key, subject+"/") {
+			continue
+		}
+		for m.positions[key] < len(m.messages[subject]) {
+			if handler(m.messages[subject][m.positions[key]]) != nil {
+				break
+			}
+			m.positions[key]++
+		}
+	}
+}
+
+func (m *mockJetStream) Consume(subject, durable string, handler func([]byte) error) (io.Closer, error) {
+	key := subject + "/" + durable
+	m.mu.Lock()
+	m.handlers[key] = handler
+	m.mu.Unlock()
+	m.deliver(subject)
+	return closerFunc(func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.handlers, key)
+		return nil
+	}), nil
+}
+
+func (m *mockJetStream) Delete(subject, durable string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.positions, subject+"/"+durable)
+	return nil
+}
+
+// Ensures durable subscribers receive the messages published while they
+// weren't subscribed, and start over once their subscription is removed.
+func TestNatsDurableSubscriberTransport(t *testing.T) {
+	assert := assert.New(t)
+	jetStream := newMockJetStream()
+	factory := NewFNatsDurableSubscriberTransportFactory(jetStream, "inventory")
+	var received []string
+	fail := false
+	callback := func(transport thrift.TTransport) error {
+		proto := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).GetProtocol(transport)
+		if _, err := proto.readHeader(); err != nil {
+			return err
+		}
+		payload, err := proto.ReadString()
+		if err != nil || fail {
+			return io.ErrUnexpectedEOF
+		}
+		received = append(received, payload)
+		return nil
+	}
+	publish := func(payload string) {
+		jetStream.publish("frugal.events", newKafkaFrame(t, nil, payload))
+	}
+
+	subscriber := factory.GetTransport()
+	assert.Nil(subscriber.Subscribe("events", callback))
+	assert.True(subscriber.IsSubscribed())
+	assert.Error(subscriber.Subscribe("events", callback))
+	publish("a")
+	assert.Nil(subscriber.Unsubscribe())
+	assert.False(subscriber.IsSubscribed())
+	publish("b")
+	publish("c")
+
+	// A restarted subscriber resumes after the last message handled.
+	subscriber = factory.GetTransport()
+	assert.Nil(subscriber.Subscribe("events", callback))
+	assert.Equal([]string{"a", "b", "c"}, received)
+
+	// Messages which fail to be handled are redelivered.
+	fail = true
+	publish("d")
+	fail = false
+	jetStream.deliver("frugal.events")
+	assert.Equal([]string{"a", "b", "c", "d"}, received)
+
+	subscription := NewFSubscription("events", subscriber)
+	assert.Nil(subscription.Remove())
+	assert.False(subscriber.IsSubscribed())
+	received = nil
+	assert.Nil(subscriber.Subscribe("events", callback))
+	assert.Equal([]string{"a", "b", "c", "d"}, received)
+}
@@ -0,0 +1,324 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// FNatsHeaderConn publishes and subscribes to NATS messages carrying
+// per-message headers, which were added in NATS server 2.2. Frugal's NATS
+// client predates them, so implement it with a header capable client, such
+// as by mapping the headers onto a nats.Msg's Header.
+type FNatsHeaderConn interface {
+	// PublishMsg publishes the data with the given headers to the given
+	// subject. The reply subject may be empty.
+	PublishMsg(subject, reply string, headers map[string]string, data []byte) error
+
+	// Subscribe subscribes to the given subject, in the given queue group if
+	// it isn't empty, and calls the handler with the reply subject, headers,
+	// and data of each message received until the returned io.Closer is
+	// closed.
+	Subscribe(subject, queue string, handler func(reply string, headers map[string]string, data []byte)) (io.Closer, error)
+}
+
+// splitHeaderFrame splits the given frame into its headers and payload so the
+// headers can be sent as message headers. Frames which aren't v0, such as
+// ones with compressed headers, are returned whole without headers.
+func splitHeaderFrame(frame []byte) (map[string]string, []byte, error) {
+	if len(frame) < 5 || frame[4] != protocolV0 {
+		return nil, frame, nil
+	}
+	headers, err := v0Marshaler.unmarshalHeadersFromFrame(frame[5:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return headers, frame[9+binary.BigEndian.Uint32(frame[5:]):], nil
+}
+
+// joinHeaderFrame rebuilds the frame split by splitHeaderFrame from the given
+// message headers and data. Messages without headers carry the whole frame.
+func joinHeaderFrame(headers map[string]string, data []byte) []byte {
+	if len(headers) == 0 {
+		return data
+	}
+	return prependFrameSize(append(v0Marshaler.marshalHeaders(headers), data...))
+}
+
+// publishHeaderFrame publishes the given frame with its headers as message
+// headers.
+func publishHeaderFrame(conn FNatsHeaderConn, subject, reply string, frame []byte) error {
+	headers, payload, err := splitHeaderFrame(frame)
+	if err != nil {
+		return err
+	}
+	return conn.PublishMsg(subject, reply, headers, payload)
+}
+
+// fNatsHeaderTransport implements FTransport.
+type fNatsHeaderTransport struct {
+	*fBaseTransport
+	conn    FNatsHeaderConn
+	subject string
+	inbox   string
+
+	mu  sync.RWMutex
+	sub io.Closer
+}
+
+// NewFNatsHeaderTransport returns a new FTransport which sends the FContext
+// headers of requests as NATS message headers rather than in the payload, so
+// NATS tooling can see them, such as the correlation ID in the "_cid"
+// header, without decoding frugal frames. Responses are received on the
+// given inbox. The server must be an FNatsHeaderServer.
+func NewFNatsHeaderTransport(conn FNatsHeaderConn, subject, inbox string) FTransport {
+	return &fNatsHeaderTransport{
+		fBaseTransport: newFBaseTransport(natsMaxMessageSize),
+		conn:           conn,
+		subject:        subject,
+		inbox:          inbox,
+	}
+}
+
+// Open subscribes to the transport's inbox.
+func (f *fNatsHeaderTransport) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sub != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: NATS transport already open")
+	}
+	sub, err := f.conn.Subscribe(f.inbox, "", f.handler)
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	f.sub = sub
+	f.fBaseTransport.Open()
+	return nil
+}
+
+// handler executes the responses received on the inbox.
+func (f *fNatsHeaderTransport) handler(reply string, headers map[string]string, data []byte) {
+	frame := joinHeaderFrame(headers, data)
+	if len(frame) < 4 {
+		logger().Warn("frugal: Discarding invalid NATS response frame")
+		return
+	}
+	if err := f.ExecuteFrame(frame); err != nil {
+		logger().Warn("frugal: Could not execute frame: ", err)
+	}
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (f *fNatsHeaderTransport) IsOpen() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.sub != nil
+}
+
+// Close unsubscribes from the inbox.
+func (f *fNatsHeaderTransport) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sub == nil {
+		return nil
+	}
+	if err := f.sub.Close(); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	f.sub = nil
+	f.fBaseTransport.Close(nil)
+	return nil
+}
+
+func (f *fNatsHeaderTransport) notOpenError() error {
+	return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+		"frugal: NATS transport not open")
+}
+
+func (f *fNatsHeaderTransport) checkMessageSize(data []byte) error {
+	if limit := int(f.GetRequestSizeLimit()); len(data) > limit {
+		return thrift.NewTTransportException(
+			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			"frugal: NATS request exceeds the message size limit")
+	}
+	return nil
+}
+
+// Oneway transmits the given data and doesn't wait for a response.
+// Implementations of oneway should be threadsafe and respect the timeout
+// present on the context.
+func (f *fNatsHeaderTransport) Oneway(ctx FContext, data []byte) error {
+	if !f.IsOpen() {
+		return f.notOpenError()
+	}
+	if len(data) == 4 {
+		return nil
+	}
+	if err := f.checkMessageSize(data); err != nil {
+		return err
+	}
+	if err := publishHeaderFrame(f.conn, f.subject, "", data); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	return nil
+}
+
+// Request transmits the given data and waits for a response.
+// Implementations of request should be threadsafe and respect the timeout
+// present on the context.
+func (f *fNatsHeaderTransport) Request(ctx FContext, data []byte) (thrift.TTransport, error) {
+	if !f.IsOpen() {
+		return nil, f.notOpenError()
+	}
+	if len(data) == 4 {
+		return nil, nil
+	}
+	if err := f.checkMessageSize(data); err != nil {
+		return nil, err
+	}
+
+	resultC := make(chan []byte, 1)
+	if err := f.registry.Register(ctx, resultC); err != nil {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN, err.Error())
+	}
+	defer f.registry.Unregister(ctx)
+
+	if err := publishHeaderFrame(f.conn, f.subject, f.inbox, data); err != nil {
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+
+	select {
+	case result := <-resultC:
+		return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(result)}, nil
+	case <-contextDone(ctx):
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_CANCELLED, "frugal: nats request cancelled")
+	case <-time.After(ctx.Timeout()):
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: nats request timed out")
+	}
+}
+
+// GetRequestSizeLimit returns the maximum number of bytes that can be
+// transmitted.
+func (f *fNatsHeaderTransport) GetRequestSizeLimit() uint {
+	return uint(natsMaxMessageSize)
+}
+
+// This is a no-op for fNatsHeaderTransport
+func (f *fNatsHeaderTransport) SetMonitor(monitor FTransportMonitor) {
+}
+
+// FNatsHeaderServer is an FServer which processes requests sent by
+// FTransports created with NewFNatsHeaderTransport, reading their FContext
+// headers from the NATS message headers and sending the response headers
+// the same way. Each request is processed in its own goroutine.
+type FNatsHeaderServer struct {
+	conn            FNatsHeaderConn
+	processor       FProcessor
+	protocolFactory *FProtocolFactory
+	subject         string
+	queue           string
+	hooks           *FServerHooks
+	draining        drainSwitch
+
+	mu      sync.Mutex
+	quit    chan struct{}
+	stopped bool
+}
+
+// NewFNatsHeaderServer creates a new FNatsHeaderServer which processes the
+// requests published to the given subject, in the given queue group if it
+// isn't empty.
+func NewFNatsHeaderServer(conn FNatsHeaderConn, processor FProcessor, protocolFactory *FProtocolFactory, subject, queue string) *FNatsHeaderServer {
+	return &FNatsHeaderServer{
+		conn:            conn,
+		processor:       processor,
+		protocolFactory: protocolFactory,
+		subject:         subject,
+		queue:           queue,
+		quit:            make(chan struct{}),
+	}
+}
+
+// WithHooks registers callbacks invoked as the server starts, stops, and
+// processes requests.
+func (s *FNatsHeaderServer) WithHooks(hooks *FServerHooks) *FNatsHeaderServer {
+	s.hooks = hooks
+	return s
+}
+
+// Serve subscribes to the subject and processes requests until the server is
+// stopped.
+func (s *FNatsHeaderServer) Serve() error {
+	s.processor = newDrainingProcessor(s.processor, &s.draining)
+	s.processor = newHooksProcessor(s.processor, s.hooks)
+	sub, err := s.conn.Subscribe(s.subject, s.queue, func(reply string, headers map[string]string, data []byte) {
+		go s.handler(reply, headers, data)
+	})
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	s.hooks.started()
+	defer s.hooks.stopped()
+	<-s.quit
+	return sub.Close()
+}
+
+// Stop unsubscribes from the subject.
+func (s *FNatsHeaderServer) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.quit)
+	}
+	return nil
+}
+
+// SetDraining sets whether the server is draining. While draining, requests
+// in flight are processed, but new requests are rejected with an
+// APPLICATION_EXCEPTION_SERVER_DRAINING error.
+func (s *FNatsHeaderServer) SetDraining(draining bool) {
+	s.draining.set(draining)
+}
+
+// handler processes the request with the given headers and payload and
+// publishes its response, if any, to the given reply subject.
+func (s *FNatsHeaderServer) handler(reply string, headers map[string]string, data []byte) {
+	frame := joinHeaderFrame(headers, data)
+	if len(frame) < 4 {
+		logger().Warn("frugal: Discarding invalid NATS request frame")
+		return
+	}
+	output := NewTMemoryOutputBuffer(natsMaxMessageSize)
+	err := s.processor.Process(
+		s.protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])}),
+		s.protocolFactory.GetProtocol(output))
+	if err != nil {
+		logger().Warn("frugal: error processing NATS request: ", err)
+		return
+	}
+	if !output.HasWriteData() || reply == "" {
+		return
+	}
+	if err := publishHeaderFrame(s.conn, reply, "", output.Bytes()); err != nil {
+		logger().Warn("frugal: error publishing NATS response: ", err)
+	}
+}
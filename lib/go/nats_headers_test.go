@@ -0,0 +1,155 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// headerMessage is a message published to mockNatsHeaderConn.
+type headerMessage struct {
+	subject string
+	headers map[string]string
+	data    []byte
+}
+
+// mockNatsHeaderConn is an in-memory FNatsHeaderConn which delivers
+// messages to the subscribers of their subject as they're published.
+type mockNatsHeaderConn struct {
+	mu        sync.Mutex
+	handlers  map[string]func(reply string, headers map[string]string, data []byte)
+	published []headerMessage
+}
+
+func newMockNatsHeaderConn() *mockNatsHeaderConn {
+	return &mockNatsHeaderConn{handlers: make(map[string]func(string, map[string]string, []byte))}
+}
+
+func (m *mockNatsHeaderConn) PublishMsg(subject, reply string, headers map[string]string, data []byte) error {
+	m.mu.Lock()
+	m.published = append(m.published, headerMessage{subject: subject, headers: headers, data: data})
+	handler := m.handlers[subject]
+	m.mu.Unlock()
+	if handler != nil {
+		handler(reply, headers, data)
+	}
+	return nil
+}
+
+func (m *mockNatsHeaderConn) Subscribe(subject, queue string, handler func(string, map[string]string, []byte)) (io.Closer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[subject] = handler
+	return closerFunc(func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.handlers, subject)
+		return nil
+	}), nil
+}
+
+func (m *mockNatsHeaderConn) handlersFor(subject string) []func(string, map[string]string, []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if handler, ok := m.handlers[subject]; ok {
+		return []func(string, map[string]string, []byte){handler}
+	}
+	return nil
+}
+
+func (m *mockNatsHeaderConn) messages(subject string) []headerMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var messages []headerMessage
+	for _, message := range m.published {
+		if message.subject == subject {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// Ensures FContext headers are sent as NATS message headers in both
+// directions and rebuilt into frames for the processor and registry.
+func TestNatsHeaderTransport(t *testing.T) {
+	assert := assert.New(t)
+	conn := newMockNatsHeaderConn()
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsHeaderServer(conn, &headerProcessor{}, protocolFactory, "users", "")
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+	for len(conn.handlersFor("users")) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	transport := NewFNatsHeaderTransport(conn, "users", "_INBOX.client")
+	assert.Nil(transport.Open())
+	assert.True(transport.IsOpen())
+	assert.Error(transport.Open())
+
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("user", "alice")
+	buffer := NewTMemoryOutputBuffer(0)
+	protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx)
+	result, err := transport.Request(ctx, buffer.Bytes())
+	assert.Nil(err)
+	resultProto := protocolFactory.GetProtocol(result)
+	assert.Nil(resultProto.ReadResponseHeader(ctx))
+	actual, err := resultProto.ReadString()
+	assert.Nil(err)
+	assert.Equal("alice", actual)
+	trace, _ := ctx.ResponseHeader("trace")
+	assert.Equal("t1", trace)
+
+	requests := conn.messages("users")
+	assert.Len(requests, 1)
+	assert.Equal("cid", requests[0].headers[cidHeader])
+	assert.Equal("alice", requests[0].headers["user"])
+	assert.Empty(requests[0].data)
+	responses := conn.messages("_INBOX.client")
+	assert.Len(responses, 1)
+	assert.Equal("t1", responses[0].headers["trace"])
+
+	closed := transport.Closed()
+	assert.Nil(transport.Close())
+	assert.False(transport.IsOpen())
+	assert.Nil(<-closed)
+	assert.Nil(server.Stop())
+	assert.Nil(<-served)
+}
+
+// Ensures frames split into headers and payload are rebuilt unchanged, and
+// frames which aren't v0 are sent whole.
+func TestSplitHeaderFrame(t *testing.T) {
+	assert := assert.New(t)
+	frame := prependFrameSize(append(v0Marshaler.marshalHeaders(map[string]string{"a": "b"}), "payload"...))
+	headers, payload, err := splitHeaderFrame(frame)
+	assert.Nil(err)
+	assert.Equal(map[string]string{"a": "b"}, headers)
+	assert.Equal([]byte("payload"), payload)
+	assert.Equal(frame, joinHeaderFrame(headers, payload))
+
+	other := []byte{0, 0, 0, 2, protocolV1, 0}
+	headers, payload, err = splitHeaderFrame(other)
+	assert.Nil(err)
+	assert.Nil(headers)
+	assert.Equal(other, payload)
+	assert.Equal(other, joinHeaderFrame(headers, payload))
+}
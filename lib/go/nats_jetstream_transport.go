@@ -0,0 +1,452 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// FJetStreamClient publishes and consumes the messages of request/response
+// calls through JetStream, so requests are stored until a server processes
+// them rather than lost if no server is subscribed. Frugal's NATS client
+// predates JetStream, so implement it with a JetStream capable client, with
+// streams capturing the request subjects of services and the inbox subjects
+// of clients.
+type FJetStreamClient interface {
+	// AddStream creates the stream with the given configuration, or updates
+	// it if it exists. It's only called for streams configured with
+	// WithStreamConfig, others being created by the application.
+	AddStream(config *FJetStreamStreamConfig) error
+
+	// Publish publishes the data to the given subject, returning once the
+	// stream capturing the subject has stored it. The reply subject, which
+	// may be empty, must be delivered with the message, such as in a header.
+	Publish(subject, reply string, data []byte) error
+
+	// Consume binds to the durable consumer with the given name on the given
+	// subject, creating it with the given configuration if it doesn't exist,
+	// and calls the handler with the reply subject and data of each message
+	// delivered until the returned io.Closer is closed. A nil configuration
+	// uses the client's defaults. Closing it must not delete the durable
+	// consumer. Messages should only be acknowledged once the handler
+	// returns nil, so messages which fail to be handled are redelivered.
+	Consume(subject, durable string, config *FJetStreamConsumerConfig,
+		handler func(reply string, data []byte) error) (io.Closer, error)
+
+	// Delete deletes the durable consumer with the given name on the given
+	// subject, discarding its position.
+	Delete(subject, durable string) error
+}
+
+// FJetStreamRetention is the policy by which a JetStream stream retains
+// messages.
+type FJetStreamRetention int
+
+const (
+	// FJetStreamLimitsRetention retains messages until the stream's limits
+	// are reached.
+	FJetStreamLimitsRetention FJetStreamRetention = iota
+
+	// FJetStreamInterestRetention retains messages until every consumer has
+	// acknowledged them.
+	FJetStreamInterestRetention
+
+	// FJetStreamWorkQueueRetention retains messages until a consumer has
+	// acknowledged them.
+	FJetStreamWorkQueueRetention
+)
+
+// FJetStreamStreamConfig configures a stream capturing the request subject
+// of a service or the inbox subject of a client. Zero values use the
+// JetStream server's defaults.
+type FJetStreamStreamConfig struct {
+	// Name is the name of the stream.
+	Name string
+
+	// Subjects are the subjects the stream captures.
+	Subjects []string
+
+	// Retention is the policy by which the stream retains messages.
+	Retention FJetStreamRetention
+
+	// MaxAge is how long the stream retains messages.
+	MaxAge time.Duration
+
+	// Replicas is the number of replicas of the stream.
+	Replicas int
+}
+
+// FJetStreamConsumerConfig configures the durable consumer a server consumes
+// requests with or a client consumes responses with. Zero values use the
+// JetStream server's defaults.
+type FJetStreamConsumerConfig struct {
+	// AckWait is how long a delivered message can go unacknowledged before
+	// it's redelivered. For servers, it should exceed the time requests
+	// take to process.
+	AckWait time.Duration
+
+	// MaxDeliver is how many times a message is delivered before it's
+	// dropped.
+	MaxDeliver int
+
+	// MaxAckPending is how many delivered messages can be unacknowledged
+	// before delivery pauses.
+	MaxAckPending int
+}
+
+// jetStreamDurable returns the name of the durable consumer a client
+// consumes the responses published to the given inbox with. Durable names
+// can't contain dots.
+func jetStreamDurable(inbox string) string {
+	return strings.Replace(inbox, ".", "_", -1)
+}
+
+// FJetStreamTransportBuilder configures and builds JetStream FTransports.
+type FJetStreamTransportBuilder struct {
+	client         FJetStreamClient
+	subject        string
+	inbox          string
+	streamConfig   *FJetStreamStreamConfig
+	consumerConfig *FJetStreamConsumerConfig
+}
+
+// NewFJetStreamTransportBuilder creates a builder which configures and builds
+// JetStream FTransports, as created by NewFJetStreamTransport.
+func NewFJetStreamTransportBuilder(client FJetStreamClient, subject, inbox string) *FJetStreamTransportBuilder {
+	return &FJetStreamTransportBuilder{client: client, subject: subject, inbox: inbox}
+}
+
+// WithStreamConfig has the transport create or update the stream capturing
+// its inbox with the given configuration when it's opened.
+func (f *FJetStreamTransportBuilder) WithStreamConfig(config FJetStreamStreamConfig) *FJetStreamTransportBuilder {
+	f.streamConfig = &config
+	return f
+}
+
+// WithConsumerConfig configures the durable consumer of the transport's
+// inbox.
+func (f *FJetStreamTransportBuilder) WithConsumerConfig(config FJetStreamConsumerConfig) *FJetStreamTransportBuilder {
+	f.consumerConfig = &config
+	return f
+}
+
+// Build a new configured JetStream FTransport.
+func (f *FJetStreamTransportBuilder) Build() FTransport {
+	return &fJetStreamTransport{
+		fBaseTransport: newFBaseTransport(natsMaxMessageSize),
+		client:         f.client,
+		subject:        f.subject,
+		inbox:          f.inbox,
+		streamConfig:   f.streamConfig,
+		consumerConfig: f.consumerConfig,
+	}
+}
+
+// fJetStreamTransport implements FTransport.
+type fJetStreamTransport struct {
+	*fBaseTransport
+	client         FJetStreamClient
+	subject        string
+	inbox          string
+	streamConfig   *FJetStreamStreamConfig
+	consumerConfig *FJetStreamConsumerConfig
+
+	mu       sync.RWMutex
+	consumer io.Closer
+}
+
+// NewFJetStreamTransport returns a new FTransport which publishes requests
+// to the given subject through JetStream and consumes their responses from
+// the given inbox, which must be unique to the transport. Requests published
+// while no server is running are processed once one starts, provided they
+// haven't timed out by then. Servers process requests at least once, so
+// responses to redelivered requests are discarded. Closing the transport
+// deletes the durable consumer of its inbox. Use NewFJetStreamTransportBuilder
+// to configure the inbox's stream and consumer.
+func NewFJetStreamTransport(client FJetStreamClient, subject, inbox string) FTransport {
+	return NewFJetStreamTransportBuilder(client, subject, inbox).Build()
+}
+
+// Open consumes the responses published to the transport's inbox, first
+// creating or updating its stream if one is configured.
+func (f *fJetStreamTransport) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.consumer != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: JetStream transport already open")
+	}
+	if f.streamConfig != nil {
+		if err := f.client.AddStream(f.streamConfig); err != nil {
+			return thrift.NewTTransportExceptionFromError(err)
+		}
+	}
+	consumer, err := f.client.Consume(f.inbox, jetStreamDurable(f.inbox), f.consumerConfig, f.handler)
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	f.consumer = consumer
+	f.fBaseTransport.Open()
+	return nil
+}
+
+// handler executes the responses consumed from the inbox. Invalid frames and
+// responses to requests no longer waiting, such as ones which timed out or
+// were processed again, are acknowledged so they aren't redelivered.
+func (f *fJetStreamTransport) handler(reply string, data []byte) error {
+	if len(data) < 4 {
+		logger().Warn("frugal: Discarding invalid JetStream response frame")
+		return nil
+	}
+	if err := f.ExecuteFrame(data); err != nil {
+		logger().Debug("frugal: discarding JetStream response: ", err)
+	}
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (f *fJetStreamTransport) IsOpen() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.consumer != nil
+}
+
+// Close stops consuming responses and deletes the durable consumer of the
+// inbox.
+func (f *fJetStreamTransport) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.consumer == nil {
+		return nil
+	}
+	if err := f.consumer.Close(); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	f.consumer = nil
+	if err := f.client.Delete(f.inbox, jetStreamDurable(f.inbox)); err != nil {
+		logger().Warn("frugal: error deleting JetStream inbox consumer: ", err)
+	}
+	f.fBaseTransport.Close(nil)
+	return nil
+}
+
+func (f *fJetStreamTransport) checkMessageSize(data []byte) error {
+	if limit := int(f.GetRequestSizeLimit()); len(data) > limit {
+		return thrift.NewTTransportException(
+			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			"frugal: JetStream request exceeds the message size limit")
+	}
+	return nil
+}
+
+func (f *fJetStreamTransport) notOpenError() error {
+	return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+		"frugal: JetStream transport not open")
+}
+
+// Oneway transmits the given data and doesn't wait for a response.
+// Implementations of oneway should be threadsafe and respect the timeout
+// present on the context.
+func (f *fJetStreamTransport) Oneway(ctx FContext, data []byte) error {
+	if !f.IsOpen() {
+		return f.notOpenError()
+	}
+	if len(data) == 4 {
+		return nil
+	}
+	if err := f.checkMessageSize(data); err != nil {
+		return err
+	}
+	if err := f.client.Publish(f.subject, "", data); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	return nil
+}
+
+// Request transmits the given data and waits for a response.
+// Implementations of request should be threadsafe and respect the timeout
+// present on the context.
+func (f *fJetStreamTransport) Request(ctx FContext, data []byte) (thrift.TTransport, error) {
+	if !f.IsOpen() {
+		return nil, f.notOpenError()
+	}
+	if len(data) == 4 {
+		return nil, nil
+	}
+	if err := f.checkMessageSize(data); err != nil {
+		return nil, err
+	}
+
+	resultC := make(chan []byte, 1)
+	if err := f.registry.Register(ctx, resultC); err != nil {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN, err.Error())
+	}
+	defer f.registry.Unregister(ctx)
+
+	if err := f.client.Publish(f.subject, f.inbox, data); err != nil {
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+
+	select {
+	case result := <-resultC:
+		return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(result)}, nil
+	case <-contextDone(ctx):
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_CANCELLED, "frugal: JetStream request cancelled")
+	case <-time.After(ctx.Timeout()):
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: JetStream request timed out")
+	}
+}
+
+// GetRequestSizeLimit returns the maximum number of bytes that can be
+// transmitted.
+func (f *fJetStreamTransport) GetRequestSizeLimit() uint {
+	return uint(natsMaxMessageSize)
+}
+
+// This is a no-op for fJetStreamTransport
+func (f *fJetStreamTransport) SetMonitor(monitor FTransportMonitor) {
+}
+
+// FJetStreamServer is an FServer which processes the requests published to a
+// subject by FTransports created with NewFJetStreamTransport, consuming them
+// through a durable consumer. Requests are acknowledged once processed and
+// their responses stored, so requests published while the server is down, or
+// which fail to be processed, are delivered again. Requests may therefore be
+// processed more than once, so their handlers should be idempotent. Servers
+// sharing a durable name share its requests, each being processed by one of
+// them.
+type FJetStreamServer struct {
+	client          FJetStreamClient
+	processor       FProcessor
+	protocolFactory *FProtocolFactory
+	subject         string
+	durable         string
+	streamConfig    *FJetStreamStreamConfig
+	consumerConfig  *FJetStreamConsumerConfig
+	hooks           *FServerHooks
+	draining        drainSwitch
+
+	mu      sync.Mutex
+	quit    chan struct{}
+	stopped bool
+}
+
+// NewFJetStreamServer creates a new FJetStreamServer which processes the
+// requests published to the given subject with the given client through the
+// durable consumer with the given name.
+func NewFJetStreamServer(client FJetStreamClient, processor FProcessor, protocolFactory *FProtocolFactory, subject, durable string) *FJetStreamServer {
+	return &FJetStreamServer{
+		client:          client,
+		processor:       processor,
+		protocolFactory: protocolFactory,
+		subject:         subject,
+		durable:         durable,
+		quit:            make(chan struct{}),
+	}
+}
+
+// WithHooks registers callbacks invoked as the server starts, stops, and
+// processes requests.
+func (s *FJetStreamServer) WithHooks(hooks *FServerHooks) *FJetStreamServer {
+	s.hooks = hooks
+	return s
+}
+
+// WithStreamConfig has the server create or update the stream capturing its
+// subject with the given configuration when it starts serving.
+// FJetStreamWorkQueueRetention suits streams only consumed by servers
+// sharing a durable consumer.
+func (s *FJetStreamServer) WithStreamConfig(config FJetStreamStreamConfig) *FJetStreamServer {
+	s.streamConfig = &config
+	return s
+}
+
+// WithConsumerConfig configures the durable consumer the server consumes
+// requests with, such as how long requests can take to process before
+// they're redelivered and how many times they're delivered.
+func (s *FJetStreamServer) WithConsumerConfig(config FJetStreamConsumerConfig) *FJetStreamServer {
+	s.consumerConfig = &config
+	return s
+}
+
+// Serve consumes and processes requests until the server is stopped. The
+// durable consumer is kept, so a restarted server resumes with the requests
+// not yet processed.
+func (s *FJetStreamServer) Serve() error {
+	s.processor = newDrainingProcessor(s.processor, &s.draining)
+	s.processor = newHooksProcessor(s.processor, s.hooks)
+	if s.streamConfig != nil {
+		if err := s.client.AddStream(s.streamConfig); err != nil {
+			return thrift.NewTTransportExceptionFromError(err)
+		}
+	}
+	consumer, err := s.client.Consume(s.subject, s.durable, s.consumerConfig, s.handler)
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	s.hooks.started()
+	defer s.hooks.stopped()
+	<-s.quit
+	return consumer.Close()
+}
+
+// Stop stops consuming requests.
+func (s *FJetStreamServer) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.quit)
+	}
+	return nil
+}
+
+// SetDraining sets whether the server is draining. While draining, requests
+// in flight are processed, but new requests are rejected with an
+// APPLICATION_EXCEPTION_SERVER_DRAINING error.
+func (s *FJetStreamServer) SetDraining(draining bool) {
+	s.draining.set(draining)
+}
+
+// handler processes the given request frame and publishes its response, if
+// any, to the given reply subject. Errors leave the request unacknowledged
+// so it's redelivered.
+func (s *FJetStreamServer) handler(reply string, data []byte) error {
+	if len(data) < 4 {
+		logger().Warn("frugal: Discarding invalid JetStream request frame")
+		return nil
+	}
+	output := NewTMemoryOutputBuffer(natsMaxMessageSize)
+	err := s.processor.Process(
+		s.protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(data[4:])}),
+		s.protocolFactory.GetProtocol(output))
+	if err != nil {
+		logger().Warn("frugal: error processing JetStream request: ", err)
+		return err
+	}
+	if !output.HasWriteData() || reply == "" {
+		return nil
+	}
+	if err := s.client.Publish(reply, "", output.Bytes()); err != nil {
+		logger().Warn("frugal: error publishing JetStream response: ", err)
+		return err
+	}
+	return nil
+}
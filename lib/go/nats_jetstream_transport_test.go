@@ -0,0 +1,376 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// jetStreamMessage is a message stored by mockJetStreamClient.
+type jetStreamMessage struct {
+	reply string
+	data  []byte
+}
+
+// jetStreamConsumer is a durable consumer of mockJetStreamClient.
+type jetStreamConsumer struct {
+	subject  string
+	config   *FJetStreamConsumerConfig
+	position int
+	handler  func(reply string, data []byte) error
+	busy     bool
+}
+
+// mockJetStreamClient is an in-memory FJetStreamClient which stores the
+// messages published to each subject and delivers them in order to the
+// durable consumers of the subject, remembering the position of each.
+// Handlers are called without holding the lock, so they may publish.
+type mockJetStreamClient struct {
+	mu        sync.Mutex
+	streams   map[string]*FJetStreamStreamConfig
+	messages  map[string][]jetStreamMessage
+	consumers map[string]*jetStreamConsumer
+}
+
+func newMockJetStreamClient() *mockJetStreamClient {
+	return &mockJetStreamClient{
+		streams:   make(map[string]*FJetStreamStreamConfig),
+		messages:  make(map[string][]jetStreamMessage),
+		consumers: make(map[string]*jetStreamConsumer),
+	}
+}
+
+func (m *mockJetStreamClient) AddStream(config *FJetStreamStreamConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.streams[config.Name] = config
+	return nil
+}
+
+func (m *mockJetStreamClient) Publish(subject, reply string, data []byte) error {
+	m.mu.Lock()
+	m.messages[subject] = append(m.messages[subject], jetStreamMessage{reply: reply, data: data})
+	var consumers []*jetStreamConsumer
+	for _, consumer := range m.consumers {
+		if consumer.subject == subject {
+			consumers = append(consumers, consumer)
+		}
+	}
+	m.mu.Unlock()
+	for _, consumer := range consumers {
+		m.deliver(consumer)
+	}
+	return nil
+}
+
+// deliver delivers the messages pending for the given consumer, stopping at
+// a message which fails to be handled. Only one delivery runs per consumer
+// at a time.
+func (m *mockJetStreamClient) deliver(consumer *jetStreamConsumer) {
+	m.mu.Lock()
+	if consumer.busy {
+		m.mu.Unlock()
+		return
+	}
+	consumer.busy = true
+	for consumer.handler != nil && consumer.position < len(m.messages[consumer.subject]) {
+		message := m.messages[consumer.subject][consumer.position]
+		handler := consumer.handler
+		m.mu.Unlock()
+		err := handler(message.reply, message.data)
+		m.mu.Lock()
+		if err != nil {
+			break
+		}
+		consumer.position++
+	}
+	consumer.busy = false
+	m.mu.Unlock()
+}
+
+// redeliver delivers the messages pending for the consumers of the given
+// subject again.
+func (m *mockJetStreamClient) redeliver(subject string) {
+	m.mu.Lock()
+	var consumers []*jetStreamConsumer
+	for _, consumer := range m.consumers {
+		if consumer.subject == subject {
+			consumers = append(consumers, consumer)
+		}
+	}
+	m.mu.Unlock()
+	for _, consumer := range consumers {
+		m.deliver(consumer)
+	}
+}
+
+func (m *mockJetStreamClient) Consume(subject, durable string, config *FJetStreamConsumerConfig,
+	handler func(reply string, data []byte) error) (io.Closer, error) {
+	key := subject + "/" + durable
+	m.mu.Lock()
+	consumer, ok := m.consumers[key]
+	if !ok {
+		consumer = &jetStreamConsumer{subject: subject, config: config}
+		m.consumers[key] = consumer
+	}
+	consumer.handler = handler
+	m.mu.Unlock()
+	m.deliver(consumer)
+	return closerFunc(func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		consumer.handler = nil
+		return nil
+	}), nil
+}
+
+func (m *mockJetStreamClient) Delete(subject, durable string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.consumers, subject+"/"+durable)
+	return nil
+}
+
+func (m *mockJetStreamClient) hasConsumer(subject, durable string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.consumers[subject+"/"+durable]
+	return ok
+}
+
+func (m *mockJetStreamClient) consumerConfig(subject, durable string) *FJetStreamConsumerConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if consumer, ok := m.consumers[subject+"/"+durable]; ok {
+		return consumer.config
+	}
+	return nil
+}
+
+func (m *mockJetStreamClient) streamConfig(name string) *FJetStreamStreamConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[name]
+}
+
+// failingProcessor fails to process the first requests it receives, then
+// processes them with the wrapped processor.
+type failingProcessor struct {
+	FProcessor
+	mu       sync.Mutex
+	failures int
+}
+
+func (p *failingProcessor) Process(in, out *FProtocol) error {
+	p.mu.Lock()
+	fail := p.failures > 0
+	if fail {
+		p.failures--
+	}
+	p.mu.Unlock()
+	if fail {
+		return errors.New("processing failed")
+	}
+	return p.FProcessor.Process(in, out)
+}
+
+func (p *failingProcessor) pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failures
+}
+
+func jetStreamRequest(t *testing.T, protocolFactory *FProtocolFactory, transport FTransport, user string, timeout time.Duration) (string, error) {
+	ctx := NewFContext("cid")
+	ctx.SetTimeout(timeout)
+	ctx.AddRequestHeader("user", user)
+	buffer := NewTMemoryOutputBuffer(0)
+	assert.Nil(t, protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx))
+	result, err := transport.Request(ctx, buffer.Bytes())
+	if err != nil {
+		return "", err
+	}
+	resultProto := protocolFactory.GetProtocol(result)
+	if err := resultProto.ReadResponseHeader(ctx); err != nil {
+		return "", err
+	}
+	return resultProto.ReadString()
+}
+
+// Ensures requests published through JetStream are processed by the server
+// and their responses returned.
+func TestJetStreamTransportRequest(t *testing.T) {
+	assert := assert.New(t)
+	client := newMockJetStreamClient()
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFJetStreamServer(client, &headerProcessor{}, protocolFactory, "users", "users-server")
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+
+	transport := NewFJetStreamTransport(client, "users", "_INBOX.client")
+	_, err := jetStreamRequest(t, protocolFactory, transport, "alice", time.Second)
+	assert.Equal(TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+	assert.Nil(transport.Open())
+	assert.True(transport.IsOpen())
+	assert.Error(transport.Open())
+	for _, user := range []string{"alice", "bob"} {
+		actual, err := jetStreamRequest(t, protocolFactory, transport, user, time.Second)
+		assert.Nil(err)
+		assert.Equal(user, actual)
+	}
+
+	closed := transport.Closed()
+	assert.True(client.hasConsumer("_INBOX.client", "_INBOX_client"))
+	assert.Nil(transport.Close())
+	assert.False(transport.IsOpen())
+	assert.Nil(<-closed)
+	assert.False(client.hasConsumer("_INBOX.client", "_INBOX_client"))
+	assert.Nil(server.Stop())
+	assert.Nil(<-served)
+}
+
+// Ensures requests published while no server is running are processed once
+// one starts, and requests which fail to be processed are redelivered.
+func TestJetStreamServerRedelivery(t *testing.T) {
+	assert := assert.New(t)
+	client := newMockJetStreamClient()
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFJetStreamTransport(client, "users", "_INBOX.client")
+	assert.Nil(transport.Open())
+	defer transport.Close()
+
+	results := make(chan string, 1)
+	go func() {
+		actual, err := jetStreamRequest(t, protocolFactory, transport, "alice", 5*time.Second)
+		assert.Nil(err)
+		results <- actual
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	processor := &failingProcessor{FProcessor: &headerProcessor{}, failures: 1}
+	server := NewFJetStreamServer(client, processor, protocolFactory, "users", "users-server")
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+	for processor.pending() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-results:
+		t.Fatal("expected the failed request to be unacknowledged")
+	default:
+	}
+
+	client.redeliver("users")
+	select {
+	case actual := <-results:
+		assert.Equal("alice", actual)
+	case <-time.After(time.Second):
+		t.Fatal("expected the redelivered request to be processed")
+	}
+	assert.Nil(server.Stop())
+	assert.Nil(<-served)
+
+	// Requests published while the server is stopped are processed once it
+	// restarts with the same durable consumer.
+	go func() {
+		actual, err := jetStreamRequest(t, protocolFactory, transport, "bob", 5*time.Second)
+		assert.Nil(err)
+		results <- actual
+	}()
+	time.Sleep(10 * time.Millisecond)
+	server = NewFJetStreamServer(client, &headerProcessor{}, protocolFactory, "users", "users-server")
+	go func() { served <- server.Serve() }()
+	select {
+	case actual := <-results:
+		assert.Equal("bob", actual)
+	case <-time.After(time.Second):
+		t.Fatal("expected the request to be processed by the restarted server")
+	}
+	assert.Nil(server.Stop())
+	assert.Nil(<-served)
+}
+
+// Ensures requests time out if no server processes them in time.
+func TestJetStreamTransportTimeout(t *testing.T) {
+	assert := assert.New(t)
+	client := newMockJetStreamClient()
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFJetStreamTransport(client, "users", "_INBOX.client")
+	assert.Nil(transport.Open())
+	defer transport.Close()
+
+	_, err := jetStreamRequest(t, protocolFactory, transport, "alice", 10*time.Millisecond)
+	assert.Equal(TRANSPORT_EXCEPTION_TIMED_OUT, err.(thrift.TTransportException).TypeId())
+}
+
+// Ensures the configured streams and consumers are passed to the client.
+func TestJetStreamStreamAndConsumerConfig(t *testing.T) {
+	assert := assert.New(t)
+	client := newMockJetStreamClient()
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	serverStream := FJetStreamStreamConfig{
+		Name:      "USERS",
+		Subjects:  []string{"users"},
+		Retention: FJetStreamWorkQueueRetention,
+		Replicas:  3,
+	}
+	serverConsumer := FJetStreamConsumerConfig{AckWait: time.Minute, MaxDeliver: 5}
+	server := NewFJetStreamServer(client, &headerProcessor{}, protocolFactory, "users", "users-server").
+		WithStreamConfig(serverStream).
+		WithConsumerConfig(serverConsumer)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+
+	clientStream := FJetStreamStreamConfig{
+		Name:     "INBOX",
+		Subjects: []string{"_INBOX.>"},
+		MaxAge:   time.Hour,
+	}
+	clientConsumer := FJetStreamConsumerConfig{MaxAckPending: 10}
+	transport := NewFJetStreamTransportBuilder(client, "users", "_INBOX.client").
+		WithStreamConfig(clientStream).
+		WithConsumerConfig(clientConsumer).
+		Build()
+	assert.Nil(transport.Open())
+	actual, err := jetStreamRequest(t, protocolFactory, transport, "alice", time.Second)
+	assert.Nil(err)
+	assert.Equal("alice", actual)
+
+	assert.Equal(&serverStream, client.streamConfig("USERS"))
+	assert.Equal(&serverConsumer, client.consumerConfig("users", "users-server"))
+	assert.Equal(&clientStream, client.streamConfig("INBOX"))
+	assert.Equal(&clientConsumer, client.consumerConfig("_INBOX.client", "_INBOX_client"))
+	assert.Nil(transport.Close())
+	assert.Nil(server.Stop())
+	assert.Nil(<-served)
+}
+
+// Ensures consumers are created with the client's defaults if they aren't
+// configured.
+func TestJetStreamDefaultConsumerConfig(t *testing.T) {
+	assert := assert.New(t)
+	client := newMockJetStreamClient()
+	transport := NewFJetStreamTransport(client, "users", "_INBOX.client")
+	assert.Nil(transport.Open())
+	defer transport.Close()
+	assert.True(client.hasConsumer("_INBOX.client", "_INBOX_client"))
+	assert.Nil(client.consumerConfig("_INBOX.client", "_INBOX_client"))
+}
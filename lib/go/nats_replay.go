@@ -0,0 +1,71 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import "sync"
+
+// replayBuffer tracks the frames of in-flight idempotent requests so they
+// can be published again after a reconnect.
+type replayBuffer struct {
+	mu       sync.Mutex
+	nextID   uint64
+	requests map[uint64]replayRequest
+}
+
+// replayRequest is a request frame and the subject it was published to.
+type replayRequest struct {
+	subject string
+	frame   []byte
+}
+
+func newReplayBuffer() *replayBuffer {
+	return &replayBuffer{requests: make(map[uint64]replayRequest)}
+}
+
+// add tracks the given frame published to the given subject and returns the
+// id to remove it with.
+func (r *replayBuffer) add(subject string, frame []byte) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	r.requests[r.nextID] = replayRequest{subject: subject, frame: frame}
+	return r.nextID
+}
+
+func (r *replayBuffer) remove(id uint64) {
+	r.mu.Lock()
+	delete(r.requests, id)
+	r.mu.Unlock()
+}
+
+// replay publishes every tracked frame to its subject with the given publish
+// function. Errors are logged since the requests will still time out if their
+// frames can't be published.
+func (r *replayBuffer) replay(publish func(subject string, frame []byte) error) {
+	r.mu.Lock()
+	requests := make([]replayRequest, 0, len(r.requests))
+	for _, request := range r.requests {
+		requests = append(requests, request)
+	}
+	r.mu.Unlock()
+
+	if len(requests) > 0 {
+		logger().Infof("frugal: replaying %d in-flight requests after NATS reconnect", len(requests))
+	}
+	for _, request := range requests {
+		if err := publish(request.subject, request.frame); err != nil {
+			logger().Warnf("frugal: error replaying request after NATS reconnect: %s", err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures replayBuffer publishes the frames it tracks until they're removed.
+func TestReplayBuffer(t *testing.T) {
+	assert := assert.New(t)
+	buffer := newReplayBuffer()
+	id1 := buffer.add("foo", []byte("foo"))
+	buffer.add("bar", []byte("bar"))
+	buffer.remove(id1)
+
+	var published []string
+	buffer.replay(func(subject string, frame []byte) error {
+		published = append(published, subject+":"+string(frame))
+		return nil
+	})
+	assert.Equal([]string{"bar:bar"}, published)
+}
+
+// Ensures in-flight idempotent requests are published again when the NATS
+// connection reconnects, and other requests are not.
+func TestNatsTransportReconnectReplay(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sub, err := conn.SubscribeSync("foo")
+	assert.Nil(err)
+
+	tr := NewFNatsTransportBuilder(conn, "foo").WithReconnectReplay().Build().(*fNatsTransport)
+	assert.Nil(tr.Open())
+	defer tr.Close()
+
+	idempotent := NewFContext("")
+	SetIdempotent(idempotent)
+	idempotent.SetTimeout(100 * time.Millisecond)
+	other := NewFContext("")
+	other.SetTimeout(100 * time.Millisecond)
+	go tr.Request(idempotent, prependFrameSize([]byte("idempotent")))
+	go tr.Request(other, prependFrameSize([]byte("other")))
+	for i := 0; i < 2; i++ {
+		_, err := sub.NextMsg(50 * time.Millisecond)
+		assert.Nil(err)
+	}
+
+	tr.reconnected()
+	msg, err := sub.NextMsg(50 * time.Millisecond)
+	assert.Nil(err)
+	assert.Equal(prependFrameSize([]byte("idempotent")), msg.Data)
+	_, err = sub.NextMsg(20 * time.Millisecond)
+	assert.Equal(nats.ErrTimeout, err)
+}
@@ -108,6 +108,30 @@ func (n *fNatsPublisherTransport) Publish(topic string, data []byte) error {
 	return thrift.NewTTransportExceptionFromError(err)
 }
 
+// PublishBatch publishes the given messages and flushes them to the NATS
+// server together, returning once the server has received them.
+func (n *fNatsPublisherTransport) PublishBatch(messages []FBatchMessage) error {
+	errs := make([]error, len(messages))
+	published := false
+	for i, message := range messages {
+		if errs[i] = n.Publish(message.Topic, message.Frame); errs[i] == nil {
+			published = true
+		}
+	}
+	if !published {
+		return newBatchPublishError(errs)
+	}
+	if err := n.conn.Flush(); err != nil {
+		err = thrift.NewTTransportExceptionFromError(err)
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return newBatchPublishError(errs)
+}
+
 func (n *fNatsPublisherTransport) formattedSubject(subject string) string {
 	return fmt.Sprintf("%s%s", frugalPrefix, subject)
 }
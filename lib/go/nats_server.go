@@ -15,6 +15,9 @@ package frugal
 
 import (
 	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.apache.org/thrift.git/lib/go/thrift"
@@ -24,12 +27,37 @@ import (
 const (
 	defaultWorkQueueLen = 64
 	defaultWatermark    = 5 * time.Second
+
+	// drainPollInterval is how often a draining server checks whether its
+	// requests have been processed.
+	drainPollInterval = 10 * time.Millisecond
+)
+
+// NatsOverflowPolicy controls how an FNatsServer handles requests which exceed
+// its rate limit or arrive while its work queue is full.
+type NatsOverflowPolicy = FOverflowPolicy
+
+const (
+	// NatsOverflowBackpressure stops delivery on the subscription which
+	// received the request until the request can be queued. Further requests
+	// are buffered by the NATS client up to the subscription's pending limits,
+	// beyond which the NATS client drops them as a slow consumer. This is the
+	// default.
+	NatsOverflowBackpressure = FOverflowBackpressure
+
+	// NatsOverflowReject immediately responds to the request with a
+	// TApplicationException of type APPLICATION_EXCEPTION_SERVER_OVERLOADED
+	// so the client can fail fast or retry elsewhere.
+	NatsOverflowReject = FOverflowReject
 )
 
 type frameWrapper struct {
 	frameBytes []byte
 	timestamp  time.Time
 	reply      string
+	processor  FProcessor
+	key        string
+	cancelled  bool
 }
 
 // FNatsServerBuilder configures and builds NATS server instances.
@@ -38,10 +66,26 @@ type FNatsServerBuilder struct {
 	processor     FProcessor
 	protoFactory  *FProtocolFactory
 	subjects      []string
+	services      []natsService
 	queue         string
+	subjectQueues map[string]string
 	workerCount   uint
 	queueLen      uint
 	highWatermark time.Duration
+	prioritize    bool
+	drainTimeout  time.Duration
+	chunkLimit    uint
+	rateLimit     float64
+	rateBurst     uint
+	overflow      NatsOverflowPolicy
+	pendingMsgs   int
+	pendingBytes  int
+	namespace     string
+	zeroCopy      bool
+	admission     FAdmissionController
+	hooks         *FServerHooks
+	watermark     FWatermarkHandler
+	streaming     bool
 }
 
 // NewFNatsServerBuilder creates a builder which configures and builds NATS
@@ -56,15 +100,68 @@ func NewFNatsServerBuilder(conn *nats.Conn, processor FProcessor,
 		workerCount:   1,
 		queueLen:      defaultWorkQueueLen,
 		highWatermark: defaultWatermark,
+		watermark:     NewFLoggingWatermarkHandler(),
 	}
 }
 
+// natsService is an FProcessor and the subjects it receives requests on.
+type natsService struct {
+	processor FProcessor
+	subjects  []string
+}
+
+// WithNamespace receives requests on the server's subjects within the given
+// namespace, such as "prod" or "staging", so several environments can share a
+// NATS cluster. The namespace is joined to each subject with a ".", and
+// clients must be built with the same namespace to reach the server. Subjects
+// given to WithSubjectQueueGroup are also namespaced.
+func (f *FNatsServerBuilder) WithNamespace(namespace string) *FNatsServerBuilder {
+	f.namespace = namespace
+	return f
+}
+
+// WithService adds another FProcessor to the server which receives requests
+// on the given subjects. This allows a single server to host several
+// services, sharing its NATS connection, worker pool, and shutdown. If a
+// subject is registered more than once, the last FProcessor registered for it
+// is used.
+func (f *FNatsServerBuilder) WithService(processor FProcessor, subjects []string) *FNatsServerBuilder {
+	f.services = append(f.services, natsService{processor: processor, subjects: subjects})
+	return f
+}
+
+// WithHealthService serves the given health service on the HealthService
+// subject, within the server's namespace, alongside the server's other
+// services.
+func (f *FNatsServerBuilder) WithHealthService(health FHealth) *FNatsServerBuilder {
+	return f.WithService(NewFHealthProcessor(health), []string{HealthService})
+}
+
+// WithReflectionService serves the given reflection service on the
+// ReflectionService subject, within the server's namespace, alongside the
+// server's other services.
+func (f *FNatsServerBuilder) WithReflectionService(reflection FReflection) *FNatsServerBuilder {
+	return f.WithService(NewFReflectionProcessor(reflection), []string{ReflectionService})
+}
+
 // WithQueueGroup adds a NATS queue group to receive requests on.
 func (f *FNatsServerBuilder) WithQueueGroup(queue string) *FNatsServerBuilder {
 	f.queue = queue
 	return f
 }
 
+// WithSubjectQueueGroup sets the NATS queue group used to receive requests on
+// the given subject, overriding the queue group set with WithQueueGroup. An
+// empty queue disables queue groups for the subject, so every server
+// subscribed to it receives each request.
+func (f *FNatsServerBuilder) WithSubjectQueueGroup(subject, queue string) *FNatsServerBuilder {
+	if f.subjectQueues == nil {
+		f.subjectQueues = make(map[string]string)
+	}
+	f.subjectQueues[subject] = queue
+	return f
+}
+
 // WithWorkerCount controls the number of goroutines used to process requests.
 func (f *FNatsServerBuilder) WithWorkerCount(workerCount uint) *FNatsServerBuilder {
 	f.workerCount = workerCount
@@ -85,51 +182,223 @@ func (f *FNatsServerBuilder) WithHighWatermark(highWatermark time.Duration) *FNa
 	return f
 }
 
+// WithWatermarkHandler sets the FWatermarkHandler notified of how long each
+// request waited in the work queue, replacing the default, which logs
+// requests which waited past the high watermark.
+func (f *FNatsServerBuilder) WithWatermarkHandler(handler FWatermarkHandler) *FNatsServerBuilder {
+	f.watermark = handler
+	return f
+}
+
+// WithPriorityScheduling enables processing queued requests in order of their
+// Priority, as set with SetPriority, so bulk traffic does not starve
+// interactive requests when the work queue is backed up. Requests of the same
+// priority are processed in the order received, and each priority level has
+// its own queue of the configured queue length.
+func (f *FNatsServerBuilder) WithPriorityScheduling() *FNatsServerBuilder {
+	f.prioritize = true
+	return f
+}
+
+// WithDrainTimeout enables graceful shutdown. When the server is stopped, it
+// has the NATS server stop sending it requests, processes every request the
+// NATS server already sent, including those still buffered by the client,
+// flushes their responses and closes the NATS connection, waiting at most the
+// given timeout for requests in flight. The connection shouldn't be shared
+// with other servers or transports. By default, Stop returns immediately,
+// queued requests are dropped and the connection is left open.
+func (f *FNatsServerBuilder) WithDrainTimeout(timeout time.Duration) *FNatsServerBuilder {
+	f.drainTimeout = timeout
+	return f
+}
+
+// WithChunking enables receiving requests larger than the NATS message size
+// limit which were split into chunks by clients with chunking enabled, and
+// sending responses larger than the limit as chunks. Requests and responses
+// are limited to the given total size.
+func (f *FNatsServerBuilder) WithChunking(maxSize uint) *FNatsServerBuilder {
+	f.chunkLimit = maxSize
+	return f
+}
+
+// WithRateLimit limits the server to receiving the given number of requests
+// per second across all of its subjects, allowing bursts of up to the given
+// size. Requests over the limit are handled according to the overflow policy.
+// Cancellations are not limited.
+func (f *FNatsServerBuilder) WithRateLimit(requestsPerSecond float64, burst uint) *FNatsServerBuilder {
+	f.rateLimit = requestsPerSecond
+	f.rateBurst = burst
+	return f
+}
+
+// WithOverflowPolicy controls how requests which exceed the rate limit or
+// arrive while the work queue is full are handled. The default is
+// NatsOverflowBackpressure.
+func (f *FNatsServerBuilder) WithOverflowPolicy(policy NatsOverflowPolicy) *FNatsServerBuilder {
+	f.overflow = policy
+	return f
+}
+
+// WithPendingLimits limits the number of messages and bytes the NATS client
+// buffers for each of the server's subscriptions while the server applies
+// backpressure. Messages beyond the limits are dropped by the NATS client and
+// reported to the connection's error handler as a slow consumer. A negative
+// limit disables it, and zero keeps the NATS client's default.
+func (f *FNatsServerBuilder) WithPendingLimits(msgLimit, bytesLimit int) *FNatsServerBuilder {
+	f.pendingMsgs = msgLimit
+	f.pendingBytes = bytesLimit
+	return f
+}
+
+// WithZeroCopyReads reads requests directly from the delivered NATS message
+// rather than through a buffer, saving an allocation and copy per request.
+// Processors can get the serialized message without copying it from
+// FProtocol.Payload. Request data must not be retained after the processor
+// returns, because the input protocol stops reading the message then.
+func (f *FNatsServerBuilder) WithZeroCopyReads() *FNatsServerBuilder {
+	f.zeroCopy = true
+	return f
+}
+
+// WithAdmissionController sheds load by asking the given FAdmissionController
+// whether to process each request as a worker picks it up, before it's
+// decoded. Requests it rejects are responded to with an
+// APPLICATION_EXCEPTION_SERVER_OVERLOADED error. InFlight counts the queued
+// requests along with those being processed, and QueueWait is how long the
+// request spent in the work queue.
+func (f *FNatsServerBuilder) WithAdmissionController(controller FAdmissionController) *FNatsServerBuilder {
+	f.admission = controller
+	return f
+}
+
+// WithServerStreaming enables streaming methods, which send a stream of
+// results for a request in separate NATS messages, each limited to the NATS
+// message size unless chunking is enabled. This includes bidirectional
+// streaming methods, whose handlers also receive the items clients send
+// after the request. Without it, streaming methods fail with an
+// APPLICATION_EXCEPTION_STREAMING_UNSUPPORTED error.
+func (f *FNatsServerBuilder) WithServerStreaming() *FNatsServerBuilder {
+	f.streaming = true
+	return f
+}
+
+// WithHooks registers callbacks invoked as the server starts, stops, and
+// processes requests.
+func (f *FNatsServerBuilder) WithHooks(hooks *FServerHooks) *FNatsServerBuilder {
+	f.hooks = hooks
+	return f
+}
+
 // Build a new configured NATS FServer.
 func (f *FNatsServerBuilder) Build() FServer {
-	return &fNatsServer{
+	server := &fNatsServer{
 		conn:          f.conn,
-		processor:     f.processor,
+		processors:    make(map[string]FProcessor),
 		protoFactory:  f.protoFactory,
-		subjects:      f.subjects,
 		queue:         f.queue,
+		subjectQueues: make(map[string]string, len(f.subjectQueues)),
 		workerCount:   f.workerCount,
 		workC:         make(chan *frameWrapper, f.queueLen),
 		quit:          make(chan struct{}),
 		highWatermark: f.highWatermark,
+		watermark:     f.watermark,
+		drainTimeout:  f.drainTimeout,
+		overflow:      f.overflow,
+		pendingMsgs:   f.pendingMsgs,
+		pendingBytes:  f.pendingBytes,
+		zeroCopy:      f.zeroCopy,
+		admission:     f.admission,
+		hooks:         f.hooks,
+		streaming:     f.streaming,
+		queued:        newQueuedRequests(),
+	}
+	if f.streaming {
+		server.streams = newStreamInboxes()
+	}
+	if f.rateLimit > 0 {
+		server.limiter = newTokenBucket(f.rateLimit, f.rateBurst)
+	}
+	if f.chunkLimit > 0 {
+		server.assembler = newChunkAssembler(int(f.chunkLimit))
+	}
+	for subject, queue := range f.subjectQueues {
+		server.subjectQueues[namespacedSubject(f.namespace, subject)] = queue
 	}
+	for _, service := range append([]natsService{{processor: f.processor, subjects: f.subjects}}, f.services...) {
+		for _, subject := range service.subjects {
+			subject = namespacedSubject(f.namespace, subject)
+			if _, ok := server.processors[subject]; !ok {
+				server.subjects = append(server.subjects, subject)
+			}
+			server.processors[subject] = newHooksProcessor(service.processor, f.hooks)
+		}
+	}
+	if f.prioritize {
+		server.highC = make(chan *frameWrapper, f.queueLen)
+		server.lowC = make(chan *frameWrapper, f.queueLen)
+	}
+	return server
 }
 
 // fNatsServer implements FServer by using NATS as the underlying transport.
 // Clients must connect with the transport created by NewNatsFTransport.
 type fNatsServer struct {
 	conn          *nats.Conn
-	processor     FProcessor
+	processors    map[string]FProcessor
 	protoFactory  *FProtocolFactory
 	subjects      []string
 	queue         string
+	subjectQueues map[string]string
 	workerCount   uint
 	workC         chan *frameWrapper
+	highC         chan *frameWrapper
+	lowC          chan *frameWrapper
 	quit          chan struct{}
 	highWatermark time.Duration
+	watermark     FWatermarkHandler
+	drainTimeout  time.Duration
+	handlers      sync.RWMutex
+	subsMu        sync.Mutex
+	subscriptions []*nats.Subscription
+	pending       int64
+	assembler     *chunkAssembler
+	limiter       *tokenBucket
+	overflow      NatsOverflowPolicy
+	pendingMsgs   int
+	pendingBytes  int
+	zeroCopy      bool
+	admission     FAdmissionController
+	hooks         *FServerHooks
+	draining      drainSwitch
+	streams       *streamInboxes
+	streaming     bool
+	queued        *queuedRequests
 }
 
 // Serve starts the server.
 func (f *fNatsServer) Serve() error {
 	subscriptions := []*nats.Subscription{}
 	for _, subject := range f.subjects {
-		sub, err := f.conn.QueueSubscribe(subject, f.queue, f.handler)
+		sub, err := f.conn.QueueSubscribe(subject, f.queueGroup(subject), f.handler(f.processors[subject]))
 		if err != nil {
 			return err
 		}
+		if err := f.setPendingLimits(sub); err != nil {
+			return err
+		}
 		subscriptions = append(subscriptions, sub)
 	}
+	f.subsMu.Lock()
+	f.subscriptions = subscriptions
+	f.subsMu.Unlock()
 
 	for i := uint(0); i < f.workerCount; i++ {
 		go f.worker()
 	}
 
 	logger().Info("frugal: server running...")
+	f.hooks.started()
+	defer f.hooks.stopped()
 	<-f.quit
 	logger().Info("frugal: server stopping...")
 
@@ -140,55 +409,414 @@ func (f *fNatsServer) Serve() error {
 	return nil
 }
 
-// Stop the server.
+// setPendingLimits applies the configured pending limits to the given
+// subscription, keeping the NATS client's default for unset limits.
+func (f *fNatsServer) setPendingLimits(sub *nats.Subscription) error {
+	if f.pendingMsgs == 0 && f.pendingBytes == 0 {
+		return nil
+	}
+	msgLimit, bytesLimit, err := sub.PendingLimits()
+	if err != nil {
+		return err
+	}
+	if f.pendingMsgs != 0 {
+		msgLimit = f.pendingMsgs
+	}
+	if f.pendingBytes != 0 {
+		bytesLimit = f.pendingBytes
+	}
+	return sub.SetPendingLimits(msgLimit, bytesLimit)
+}
+
+// queueGroup returns the NATS queue group to receive requests on for the
+// given subject. An empty queue group subscribes without one.
+func (f *fNatsServer) queueGroup(subject string) string {
+	if queue, ok := f.subjectQueues[subject]; ok {
+		return queue
+	}
+	return f.queue
+}
+
+// Stop the server. If a drain timeout is configured, this blocks until
+// received requests have been processed or the timeout elapses, then closes
+// the NATS connection.
 func (f *fNatsServer) Stop() error {
+	if f.drainTimeout > 0 {
+		f.drain()
+	}
 	close(f.quit)
 	return nil
 }
 
-// handler is invoked when a request is received. The request is placed on the
-// work channel which is processed by a worker goroutine.
-func (f *fNatsServer) handler(msg *nats.Msg) {
-	if msg.Reply == "" {
-		logger().Warn("frugal: discarding invalid NATS request (no reply)")
+// SetDraining sets whether the server is draining. While draining, requests
+// in flight are processed, but new requests are rejected with an
+// APPLICATION_EXCEPTION_SERVER_DRAINING error.
+func (f *fNatsServer) SetDraining(draining bool) {
+	f.draining.set(draining)
+}
+
+// drain stops the server's subscriptions from receiving new requests, waits
+// for the requests the NATS server already sent them to be processed, flushes
+// their responses and closes the connection. The vendored NATS client can't
+// drain subscriptions, so it pauses their handlers while limiting them.
+func (f *fNatsServer) drain() {
+	deadline := time.Now().Add(f.drainTimeout)
+	f.subsMu.Lock()
+	subscriptions := f.subscriptions
+	f.subsMu.Unlock()
+
+	f.handlers.Lock()
+	received := f.limitSubscriptions(subscriptions, deadline)
+	f.handlers.Unlock()
+
+	for !f.drained(subscriptions, received) {
+		if time.Now().After(deadline) {
+			logger().Warnf("frugal: server drain timed out with %d requests unprocessed",
+				atomic.LoadInt64(&f.pending))
+			break
+		}
+		time.Sleep(drainPollInterval)
+	}
+
+	for _, sub := range subscriptions {
+		sub.Unsubscribe()
+	}
+	if err := f.conn.FlushTimeout(drainFlushTimeout(deadline)); err != nil {
+		logger().Warnf("frugal: error flushing responses while draining server: %s", err)
+	}
+	f.conn.Close()
+}
+
+// limitSubscriptions has the NATS server stop sending the given subscriptions
+// requests, returning the number of requests each has received once it has
+// received all those sent. It's called with the handlers paused, so each
+// subscription delivers at most one more request meanwhile, and unsubscribes
+// only once it has delivered all those received.
+func (f *fNatsServer) limitSubscriptions(subscriptions []*nats.Subscription, deadline time.Time) []int {
+	// Once flushed, the requests sent so far have been received. Each limit
+	// covers them and the request a paused handler can still deliver, so no
+	// subscription unsubscribes before its limit is raised to cover those
+	// sent after the flush.
+	if err := f.conn.FlushTimeout(drainFlushTimeout(deadline)); err != nil {
+		logger().Warnf("frugal: error flushing subscriptions while draining server: %s", err)
+	}
+	limits := make([]int, len(subscriptions))
+	for i, sub := range subscriptions {
+		delivered, _ := sub.Delivered()
+		limits[i] = receivedRequests(sub)
+		if limits[i] < int(delivered)+2 {
+			limits[i] = int(delivered) + 2
+		}
+		sub.AutoUnsubscribe(limits[i])
+	}
+
+	// Once flushed again, the NATS server has stopped sending requests past
+	// the limits, and each subscription is allowed to deliver all it has
+	// received.
+	if err := f.conn.FlushTimeout(drainFlushTimeout(deadline)); err != nil {
+		logger().Warnf("frugal: error flushing subscriptions while draining server: %s", err)
+	}
+	received := make([]int, len(subscriptions))
+	for i, sub := range subscriptions {
+		received[i] = receivedRequests(sub)
+		if received[i] > limits[i] {
+			sub.AutoUnsubscribe(received[i])
+		}
+	}
+	return received
+}
+
+// drained indicates if the given subscriptions have delivered the given
+// number of requests and those requests have been processed.
+func (f *fNatsServer) drained(subscriptions []*nats.Subscription, received []int) bool {
+	// Hold off the handlers so none is part way through queuing a request.
+	f.handlers.Lock()
+	defer f.handlers.Unlock()
+	for i, sub := range subscriptions {
+		if !sub.IsValid() {
+			continue
+		}
+		delivered, _ := sub.Delivered()
+		queued, _, _ := sub.Pending()
+		if queued > 0 || int(delivered) < received[i] {
+			return false
+		}
+	}
+	return atomic.LoadInt64(&f.pending) == 0
+}
+
+// receivedRequests returns the number of requests the given subscription has
+// received, whether delivered to its handler or still buffered.
+func receivedRequests(sub *nats.Subscription) int {
+	delivered, _ := sub.Delivered()
+	queued, _, _ := sub.Pending()
+	return int(delivered) + queued
+}
+
+// drainFlushTimeout returns how long to wait for a flush while draining
+// until the given deadline.
+func drainFlushTimeout(deadline time.Time) time.Duration {
+	if timeout := deadline.Sub(time.Now()); timeout > drainPollInterval {
+		return timeout
+	}
+	return drainPollInterval
+}
+
+// handler returns the NATS handler for requests to the given FProcessor. It
+// is invoked when a request is received, and places the request on the work
+// channel which is processed by a worker goroutine. Batched requests are split
+// and each request is placed on the work channel separately.
+func (f *fNatsServer) handler(processor FProcessor) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		// Draining pauses the handlers while it limits the subscriptions.
+		f.handlers.RLock()
+		defer f.handlers.RUnlock()
+		if msg.Reply == "" {
+			logger().Warn("frugal: discarding invalid NATS request (no reply)")
+			return
+		}
+		data := msg.Data
+		if isChunk(data) {
+			if f.assembler == nil {
+				logger().Warn("frugal: discarding chunked NATS request, chunking is not enabled")
+				return
+			}
+			var err error
+			if data, err = f.assembler.add(msg.Reply, data); err != nil {
+				logger().Warnf("frugal: discarding chunked NATS request: %s", err)
+				return
+			}
+			if data == nil {
+				return
+			}
+		}
+		if isBatch(data) {
+			frames, err := splitBatch(data)
+			if err != nil {
+				logger().Warnf("frugal: discarding batched NATS request: %s", err)
+				return
+			}
+			for _, frame := range frames {
+				f.handleFrame(processor, frame, msg.Reply)
+			}
+			return
+		}
+		f.handleFrame(processor, data, msg.Reply)
+	}
+}
+
+// handleFrame places the given request frame, received with the given reply
+// subject, on the work channel, unless it's rejected, is a cancellation, or
+// was sent on a bidirectional stream.
+func (f *fNatsServer) handleFrame(processor FProcessor, data []byte, reply string) {
+	// Frames sent on open streams go straight to the stream.
+	if f.streams != nil && isStreamFrame(data) {
+		f.streams.deliver(data)
+		return
+	}
+	// Cancellations are handled immediately rather than queued behind
+	// the requests they may be cancelling. Requests still queued are
+	// skipped by the workers, others are cancelled by the processor.
+	if isCancelFrame(data) {
+		if f.queued.cancel(data[4:]) {
+			return
+		}
+		if err := f.processFrame(processor, data, reply, 0); err != nil {
+			logger().Errorf("frugal: error processing cancel: %s", err.Error())
+		}
+		return
+	}
+	if f.draining.on() {
+		f.reject(data, reply, drainingError())
+		return
+	}
+	if !f.admit() {
+		return
+	}
+	if f.limiter != nil && f.overflow == NatsOverflowReject && !f.limiter.tryTake() {
+		f.reject(data, reply, overloaded("rate limit exceeded"))
+		return
+	}
+	atomic.AddInt64(&f.pending, 1)
+	frame := &frameWrapper{frameBytes: data, timestamp: time.Now(), reply: reply, processor: processor}
+	f.queued.add(frame)
+	if f.overflow == NatsOverflowReject {
+		select {
+		case f.workQueue(data) <- frame:
+		default:
+			f.queued.take(frame)
+			atomic.AddInt64(&f.pending, -1)
+			f.reject(data, reply, overloaded("work queue full"))
+		}
 		return
 	}
 	select {
-	case f.workC <- &frameWrapper{frameBytes: msg.Data, timestamp: time.Now(), reply: msg.Reply}:
+	case f.workQueue(data) <- frame:
 	case <-f.quit:
+		f.queued.take(frame)
+		atomic.AddInt64(&f.pending, -1)
 		return
 	}
 }
 
+// admit waits for the rate limit to allow another request when applying
+// backpressure. It returns false if the server stopped while waiting.
+func (f *fNatsServer) admit() bool {
+	if f.limiter == nil || f.overflow != NatsOverflowBackpressure {
+		return true
+	}
+	return f.limiter.take(f.quit)
+}
+
+// reject responds to the given request frame with the given error without
+// processing it.
+func (f *fNatsServer) reject(frame []byte, reply string, ex thrift.TApplicationException) {
+	logger().Warnf("frugal: rejecting request, %s", ex.Error())
+	iprot := f.protoFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	ctx, err := iprot.ReadRequestHeader()
+	if err != nil {
+		logger().Errorf("frugal: error reading rejected request: %s", err)
+		return
+	}
+	name, _, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		logger().Errorf("frugal: error reading rejected request: %s", err)
+		return
+	}
+
+	output := NewTMemoryOutputBuffer(natsMaxMessageSize)
+	if err := writeExceptionResponse(f.protoFactory.GetProtocol(output), ctx, name, ex); err != nil {
+		logger().Errorf("frugal: error writing rejection: %s", err)
+		return
+	}
+	if err := f.conn.Publish(reply, output.Bytes()); err != nil {
+		logger().Errorf("frugal: error publishing rejection: %s", err)
+	}
+}
+
+// workQueue returns the work channel the given frame should be placed on.
+// Without priority scheduling, all frames share the same channel.
+func (f *fNatsServer) workQueue(frame []byte) chan *frameWrapper {
+	if f.highC == nil {
+		return f.workC
+	}
+	switch priority := framePriority(frame); {
+	case priority > PriorityNormal:
+		return f.highC
+	case priority < PriorityNormal:
+		return f.lowC
+	default:
+		return f.workC
+	}
+}
+
+// nextFrame returns the next frame to process, preferring frames of higher
+// priority. The ok result is false if the server is stopping. Priority work
+// channels are nil without priority scheduling, so they are never selected.
+func (f *fNatsServer) nextFrame() (frame *frameWrapper, ok bool) {
+	select {
+	case frame = <-f.highC:
+		return frame, true
+	default:
+	}
+	select {
+	case frame = <-f.highC:
+		return frame, true
+	case frame = <-f.workC:
+		return frame, true
+	default:
+	}
+	select {
+	case <-f.quit:
+		return nil, false
+	case frame = <-f.highC:
+		return frame, true
+	case frame = <-f.workC:
+		return frame, true
+	case frame = <-f.lowC:
+		return frame, true
+	}
+}
+
 // worker should be called as a goroutine. It reads requests off the work
 // channel and processes them.
 func (f *fNatsServer) worker() {
 	for {
-		select {
-		case <-f.quit:
+		frame, ok := f.nextFrame()
+		if !ok {
 			return
-		case frame := <-f.workC:
-			dur := time.Since(frame.timestamp)
-			if dur > f.highWatermark {
-				logger().Warnf("frugal: request spent %+v in the transport buffer, your consumer might be backed up", dur)
-			}
-			if err := f.processFrame(frame.frameBytes, frame.reply); err != nil {
-				logger().Errorf("frugal: error processing request: %s", err.Error())
-			}
 		}
+		if !f.queued.take(frame) {
+			logger().Debugf("frugal: skipping request %s cancelled while queued", frame.key)
+			atomic.AddInt64(&f.pending, -1)
+			continue
+		}
+		dur := time.Since(frame.timestamp)
+		if err := f.watermark.QueueWait(dur, dur > f.highWatermark); err != nil {
+			f.reject(frame.frameBytes, frame.reply, overloaded(err.Error()))
+		} else if err := f.processFrame(frame.processor, frame.frameBytes, frame.reply, dur); err != nil {
+			logger().Errorf("frugal: error processing request: %s", err.Error())
+		}
+		atomic.AddInt64(&f.pending, -1)
+	}
+}
+
+// admitRequest asks the admission controller whether to process the request
+// read from the given protocol, which waited the given duration in the work
+// queue. The request headers are peeked, so the processor is passed the same
+// protocol without reading them again. Requests which aren't admitted are
+// rejected, while cancellations are always admitted.
+func (f *fNatsServer) admitRequest(iprot *FProtocol, frame []byte, reply string, wait time.Duration) bool {
+	peeked, err := iprot.peekRequestHeaders()
+	if err != nil {
+		// Leave the processor to fail the request.
+		return true
+	}
+	if _, ok := peeked.header(cancelHeader); ok {
+		return true
+	}
+	request := &FAdmissionRequest{InFlight: int(atomic.LoadInt64(&f.pending)), QueueWait: wait, Headers: peeked.decoded()}
+	if err := f.admission.Admit(request); err != nil {
+		f.reject(frame, reply, overloaded(err.Error()))
+		return false
 	}
+	return true
 }
 
-// processFrame invokes the FProcessor and sends the response on the given
-// subject.
-func (f *fNatsServer) processFrame(frame []byte, reply string) error {
+// processFrame invokes the given FProcessor and sends the response on the
+// given subject, once the admission controller, if any, admits the request,
+// given how long it waited in the work queue.
+func (f *fNatsServer) processFrame(processor FProcessor, frame []byte, reply string, wait time.Duration) error {
 	// Read and process frame.
-	input := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])} // Discard frame size
-	// Only allow 1MB to be buffered.
-	output := NewTMemoryOutputBuffer(natsMaxMessageSize)
+	var input thrift.TTransport = &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])} // Discard frame size
+	if f.zeroCopy {
+		frameInput := newFrameTransport(frame[4:])
+		defer frameInput.release()
+		input = frameInput
+	}
+	// Only allow 1MB to be buffered, unless responses can be chunked.
+	limit := uint(natsMaxMessageSize)
+	if f.assembler != nil {
+		limit = uint(f.assembler.maxSize)
+	}
+	output := NewTMemoryOutputBuffer(limit)
 	iprot := f.protoFactory.GetProtocol(input)
+	if f.admission != nil && !f.admitRequest(iprot, frame, reply, wait) {
+		return nil
+	}
 	oprot := f.protoFactory.GetProtocol(output)
-	if err := f.processor.Process(iprot, oprot); err != nil {
+	if f.streaming {
+		sink := &streamSink{
+			protocolFactory: f.protoFactory,
+			send: func(frame []byte) error {
+				return f.publishResponse(reply, frame)
+			},
+			inboxes: f.streams,
+		}
+		defer sink.release()
+		oprot.stream = sink
+	}
+	if err := processor.Process(iprot, oprot); err != nil {
 		return err
 	}
 
@@ -197,5 +825,19 @@ func (f *fNatsServer) processFrame(frame []byte, reply string) error {
 	}
 
 	// Send response.
-	return f.conn.Publish(reply, output.Bytes())
+	return f.publishResponse(reply, output.Bytes())
+}
+
+// publishResponse publishes the given response frame to the given subject,
+// as chunks if it's larger than the NATS message size and chunking is
+// enabled.
+func (f *fNatsServer) publishResponse(reply string, data []byte) error {
+	if len(data) > natsMaxMessageSize {
+		if f.assembler == nil || len(data) > f.assembler.maxSize {
+			return thrift.NewTTransportException(TRANSPORT_EXCEPTION_RESPONSE_TOO_LARGE,
+				fmt.Sprintf("frugal: response of %d bytes exceeds the NATS message size", len(data)))
+		}
+		return publishChunked(f.conn, reply, "", data)
+	}
+	return f.conn.Publish(reply, data)
 }
@@ -15,6 +15,8 @@ package frugal
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -86,3 +88,476 @@ func (p *processor) AddMiddleware(middleware ServiceMiddleware) {}
 func (p *processor) Annotations() map[string]map[string]string {
 	return nil
 }
+
+// Ensures queued requests are processed in priority order when priority
+// scheduling is enabled.
+func TestFNatsServerPriorityScheduling(t *testing.T) {
+	assert := assert.New(t)
+	server := NewFNatsServerBuilder(nil, nil, nil, []string{"foo"}).
+		WithPriorityScheduling().
+		Build().(*fNatsServer)
+
+	queued := []Priority{PriorityLow, PriorityNormal, PriorityHigh, PriorityNormal, PriorityHigh}
+	for _, priority := range queued {
+		ctx := NewFContext("")
+		SetPriority(ctx, priority)
+		frame := priorityFrame(t, ctx)
+		server.workQueue(frame) <- &frameWrapper{frameBytes: frame}
+	}
+
+	var processed []Priority
+	for range queued {
+		frame, ok := server.nextFrame()
+		assert.True(ok)
+		processed = append(processed, framePriority(frame.frameBytes))
+	}
+	assert.Equal([]Priority{PriorityHigh, PriorityHigh, PriorityNormal, PriorityNormal, PriorityLow}, processed)
+
+	close(server.quit)
+	_, ok := server.nextFrame()
+	assert.False(ok)
+}
+
+// Ensures all requests share one queue without priority scheduling.
+func TestFNatsServerNoPriorityScheduling(t *testing.T) {
+	server := NewFNatsServerBuilder(nil, nil, nil, []string{"foo"}).Build().(*fNatsServer)
+	ctx := NewFContext("")
+	SetPriority(ctx, PriorityHigh)
+	assert.Equal(t, server.workC, server.workQueue(priorityFrame(t, ctx)))
+}
+
+// Ensures per-subject queue groups override the server queue group.
+func TestFNatsServerSubjectQueueGroup(t *testing.T) {
+	assert := assert.New(t)
+	server := NewFNatsServerBuilder(nil, nil, nil, []string{"foo", "bar", "baz"}).
+		WithQueueGroup("queue").
+		WithSubjectQueueGroup("bar", "bar-queue").
+		WithSubjectQueueGroup("baz", "").
+		Build().(*fNatsServer)
+	assert.Equal("queue", server.queueGroup("foo"))
+	assert.Equal("bar-queue", server.queueGroup("bar"))
+	assert.Equal("", server.queueGroup("baz"))
+}
+
+// slowProcessor delays processing to simulate in-flight work, counting the
+// requests it has finished.
+type slowProcessor struct {
+	processor
+	started  chan struct{}
+	once     sync.Once
+	delay    time.Duration
+	finished int32
+}
+
+func (p *slowProcessor) Process(in, out *FProtocol) error {
+	p.once.Do(func() { close(p.started) })
+	time.Sleep(p.delay)
+	defer atomic.AddInt32(&p.finished, 1)
+	return p.processor.Process(in, out)
+}
+
+// Ensures a draining server finishes in-flight requests and sends their
+// responses before Stop returns, then closes its connection.
+func TestFStatelessNatsServerDrain(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	serverConn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	slow := &slowProcessor{processor: processor{t}, started: make(chan struct{}), delay: 50 * time.Millisecond}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(serverConn, slow, protoFactory, []string{"foo"}).
+		WithDrainTimeout(time.Second).
+		Build()
+	go func() {
+		assert.Nil(t, server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tr := NewFNatsTransport(conn, "foo", "bar").(*fNatsTransport)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	ctx := NewFContext("")
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protoFactory.GetProtocol(buffer)
+	proto.WriteRequestHeader(ctx)
+	proto.WriteBinary([]byte{1, 2, 3, 4, 5})
+	errC := make(chan error, 1)
+	go func() {
+		_, err := tr.Request(ctx, buffer.Bytes())
+		errC <- err
+	}()
+
+	<-slow.started
+	assert.Nil(t, server.Stop())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slow.finished))
+	assert.Nil(t, <-errC)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&server.(*fNatsServer).pending))
+	assert.True(t, serverConn.IsClosed())
+}
+
+// Ensures a draining server processes every request the NATS server sent it,
+// including those still buffered by the NATS client, while the rest of its
+// queue group takes over.
+func TestFStatelessNatsServerDrainUnderLoad(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	servers := make([]FServer, 2)
+	conns := make([]*nats.Conn, 2)
+	for i := range servers {
+		if conns[i], err = nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port)); err != nil {
+			t.Fatal(err)
+		}
+		defer conns[i].Close()
+		slow := &slowProcessor{processor: processor{t}, started: make(chan struct{}), delay: time.Millisecond}
+		servers[i] = serveNats(t, NewFNatsServerBuilder(conns[i], slow, protoFactory, []string{"foo"}).
+			WithQueueGroup("foo").
+			WithQueueLength(1).
+			WithDrainTimeout(5*time.Second))
+	}
+	defer servers[1].Stop()
+
+	tr := NewFNatsTransport(conn, "foo", "bar").(*fNatsTransport)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	const senders, requests = 100, 20
+	errC := make(chan error, senders*requests)
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				ctx := NewFContext("")
+				ctx.SetTimeout(time.Second)
+				buffer := NewTMemoryOutputBuffer(0)
+				proto := protoFactory.GetProtocol(buffer)
+				proto.WriteRequestHeader(ctx)
+				proto.WriteBinary([]byte{1, 2, 3, 4, 5})
+				_, err := tr.Request(ctx, buffer.Bytes())
+				errC <- err
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, servers[0].Stop())
+	assert.True(t, conns[0].IsClosed())
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		assert.Nil(t, err)
+	}
+}
+
+// namedProcessor responds to requests with its name.
+type namedProcessor struct {
+	processor
+	name string
+}
+
+func (p *namedProcessor) Process(in, out *FProtocol) error {
+	ctx, err := in.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	out.WriteResponseHeader(ctx)
+	out.WriteString(p.name)
+	return nil
+}
+
+// Ensures a server hosting several services routes requests on each subject
+// to the FProcessor registered for it.
+func TestFStatelessNatsServerMultipleServices(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, &namedProcessor{name: "foo"}, protoFactory, []string{"foo"}).
+		WithService(&namedProcessor{name: "bar"}, []string{"bar", "baz"}).
+		WithService(&namedProcessor{name: "qux"}, []string{"baz"}).
+		Build()
+	go func() {
+		assert.Nil(t, server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+	assert.Equal(t, []string{"foo", "bar", "baz"}, server.(*fNatsServer).subjects)
+
+	for subject, expected := range map[string]string{"foo": "foo", "bar": "bar", "baz": "qux"} {
+		tr := NewFNatsTransport(conn, subject, "")
+		assert.Nil(t, tr.Open())
+		ctx := NewFContext("")
+		buffer := NewTMemoryOutputBuffer(0)
+		proto := protoFactory.GetProtocol(buffer)
+		proto.WriteRequestHeader(ctx)
+		resultTrans, err := tr.Request(ctx, buffer.Bytes())
+		assert.Nil(t, err)
+		resultProto := protoFactory.GetProtocol(resultTrans)
+		assert.Nil(t, resultProto.ReadResponseHeader(ctx))
+		result, err := resultProto.ReadString()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, result)
+		tr.Close()
+	}
+}
+
+// Ensures a server rejecting overflow responds to requests over its rate
+// limit with an overloaded error instead of processing them.
+func TestFStatelessNatsServerRateLimitReject(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, &namedProcessor{name: "foo"}, protoFactory, []string{"foo"}).
+		WithRateLimit(0.001, 1).
+		WithOverflowPolicy(NatsOverflowReject).
+		Build()
+	go func() {
+		assert.Nil(server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+
+	tr := NewFNatsTransport(conn, "foo", "")
+	assert.Nil(tr.Open())
+	defer tr.Close()
+	request := func() *FProtocol {
+		ctx := NewFContext("")
+		buffer := NewTMemoryOutputBuffer(0)
+		proto := protoFactory.GetProtocol(buffer)
+		proto.WriteRequestHeader(ctx)
+		proto.WriteMessageBegin("ping", thrift.CALL, 0)
+		resultTrans, err := tr.Request(ctx, buffer.Bytes())
+		assert.Nil(err)
+		resultProto := protoFactory.GetProtocol(resultTrans)
+		assert.Nil(resultProto.ReadResponseHeader(ctx))
+		return resultProto
+	}
+
+	result, err := request().ReadString()
+	assert.Nil(err)
+	assert.Equal("foo", result)
+
+	resultProto := request()
+	name, typeID, _, err := resultProto.ReadMessageBegin()
+	assert.Nil(err)
+	assert.Equal("ping", name)
+	assert.Equal(thrift.EXCEPTION, typeID)
+	ex, err := thrift.NewTApplicationException(0, "").Read(resultProto)
+	assert.Nil(err)
+	assert.Equal(int32(APPLICATION_EXCEPTION_SERVER_OVERLOADED), ex.TypeId())
+}
+
+// Ensures a server applying backpressure delays requests over its rate limit
+// rather than rejecting them.
+func TestFStatelessNatsServerRateLimitBackpressure(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, &namedProcessor{name: "foo"}, protoFactory, []string{"foo"}).
+		WithRateLimit(20, 1).
+		WithPendingLimits(10, -1).
+		Build()
+	go func() {
+		assert.Nil(server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+	natsServer := server.(*fNatsServer)
+	natsServer.subsMu.Lock()
+	limit, _, err := natsServer.subscriptions[0].PendingLimits()
+	natsServer.subsMu.Unlock()
+	assert.Nil(err)
+	assert.Equal(10, limit)
+
+	tr := NewFNatsTransport(conn, "foo", "")
+	assert.Nil(tr.Open())
+	defer tr.Close()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		ctx := NewFContext("")
+		buffer := NewTMemoryOutputBuffer(0)
+		proto := protoFactory.GetProtocol(buffer)
+		proto.WriteRequestHeader(ctx)
+		resultTrans, err := tr.Request(ctx, buffer.Bytes())
+		assert.Nil(err)
+		resultProto := protoFactory.GetProtocol(resultTrans)
+		assert.Nil(resultProto.ReadResponseHeader(ctx))
+		result, err := resultProto.ReadString()
+		assert.Nil(err)
+		assert.Equal("foo", result)
+	}
+	assert.True(time.Since(start) >= 90*time.Millisecond)
+}
+
+// Ensures a namespaced server subscribes to its subjects within the
+// namespace and only receives requests from clients in the same namespace.
+func TestFStatelessNatsServerNamespace(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, &namedProcessor{name: "foo"}, protoFactory, []string{"foo"}).
+		WithNamespace("prod").
+		WithSubjectQueueGroup("foo", "foo-queue").
+		Build()
+	assert.Equal([]string{"prod.foo"}, server.(*fNatsServer).subjects)
+	assert.Equal("foo-queue", server.(*fNatsServer).queueGroup("prod.foo"))
+	go func() {
+		assert.Nil(server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+
+	for namespace, expectedErr := range map[string]bool{"prod.": false, "staging": true, "": true} {
+		tr := NewFNatsTransportBuilder(conn, "foo").WithNamespace(namespace).Build()
+		assert.Nil(tr.Open())
+		ctx := NewFContext("")
+		ctx.SetTimeout(50 * time.Millisecond)
+		buffer := NewTMemoryOutputBuffer(0)
+		proto := protoFactory.GetProtocol(buffer)
+		proto.WriteRequestHeader(ctx)
+		resultTrans, err := tr.Request(ctx, buffer.Bytes())
+		if expectedErr {
+			assert.NotNil(err)
+		} else if assert.Nil(err) {
+			resultProto := protoFactory.GetProtocol(resultTrans)
+			assert.Nil(resultProto.ReadResponseHeader(ctx))
+			result, err := resultProto.ReadString()
+			assert.Nil(err)
+			assert.Equal("foo", result)
+		}
+		tr.Close()
+	}
+}
+
+// payloadProcessor echoes the request payload read with FProtocol.Payload.
+type payloadProcessor struct {
+	processor
+}
+
+func (p *payloadProcessor) Process(in, out *FProtocol) error {
+	ctx, err := in.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	out.WriteResponseHeader(ctx)
+	out.Transport().Write(in.Payload())
+	return out.Flush()
+}
+
+// Ensures requests are read directly from NATS messages with zero-copy reads
+// enabled.
+func TestFStatelessNatsServerZeroCopyReads(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	processor := &payloadProcessor{processor: processor{t}}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, processor, protoFactory, []string{"foo"}).WithZeroCopyReads().Build()
+	go func() {
+		assert.Nil(t, server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+
+	tr := NewFNatsTransport(conn, "foo", "bar").(*fNatsTransport)
+	ctx := NewFContext("")
+	assert.Nil(t, tr.Open())
+
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protoFactory.GetProtocol(buffer)
+	proto.WriteRequestHeader(ctx)
+	proto.WriteBinary([]byte{1, 2, 3, 4, 5})
+	resultTrans, err := tr.Request(ctx, buffer.Bytes())
+	assert.Nil(t, err)
+
+	resultProto := protoFactory.GetProtocol(resultTrans)
+	assert.Nil(t, resultProto.ReadResponseHeader(NewFContext("")))
+	resultBytes, err := resultProto.ReadBinary()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5}, resultBytes)
+}
+
+// recordingProcessor records the correlation ids of the requests it
+// processes, without responding.
+type recordingProcessor struct {
+	processor
+	processed chan string
+}
+
+func (p *recordingProcessor) Process(in, out *FProtocol) error {
+	ctx, err := in.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	p.processed <- ctx.CorrelationID()
+	return nil
+}
+
+// Ensures requests cancelled while waiting in the work queue are skipped by
+// the workers.
+func TestFStatelessNatsServerCancelQueued(t *testing.T) {
+	assert := assert.New(t)
+	processor := &recordingProcessor{processor: processor{t}, processed: make(chan string, 2)}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(nil, processor, protoFactory, []string{"foo"}).Build().(*fNatsServer)
+
+	request := func(ctx FContext) []byte {
+		buffer := NewTMemoryOutputBuffer(0)
+		assert.Nil(protoFactory.GetProtocol(buffer).WriteRequestHeader(ctx))
+		return buffer.Bytes()
+	}
+	cancelled := NewFContext("cancelled")
+	server.handleFrame(processor, request(cancelled), "reply")
+	server.handleFrame(processor, newCancelFrame(cancelled), "")
+	server.handleFrame(processor, request(NewFContext("processed")), "reply")
+
+	go server.worker()
+	defer close(server.quit)
+	select {
+	case cid := <-processor.processed:
+		assert.Equal("processed", cid)
+	case <-time.After(time.Second):
+		t.Fatal("Expected request to be processed")
+	}
+	assert.Empty(server.queued.frames)
+}
@@ -16,6 +16,7 @@ package frugal
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"time"
 
 	"git.apache.org/thrift.git/lib/go/thrift"
@@ -44,19 +45,255 @@ func NewFNatsTransport(conn *nats.Conn, subject, inbox string) FTransport {
 		conn:           conn,
 		subject:        subject,
 		inbox:          inbox,
+		metrics:        BaseFNatsTransportMetrics{},
 	}
 }
 
+// FNatsTransportBuilder configures and builds NATS FTransports.
+type FNatsTransportBuilder struct {
+	conns       []*nats.Conn
+	subject     string
+	inbox       string
+	inboxPrefix string
+	metrics     FNatsTransportMetrics
+	chunkLimit  uint
+	replay      bool
+	router      FNatsSubjectRouter
+	namespace   string
+	batchWindow time.Duration
+	batchFrames uint
+	negotiator  *FFeatureNegotiator
+	cancelling  *FFeatureNegotiator
+}
+
+// FNatsSubjectRouter chooses the subject a request is published to based on
+// its FContext, given the subject configured on the transport, including any
+// namespace. Returning an
+// empty string or the given subject leaves the request on the configured
+// subject.
+type FNatsSubjectRouter func(ctx FContext, subject string) string
+
+// NewFNatsTransportBuilder creates a builder which configures and builds NATS
+// FTransports which publish requests to the given subject.
+func NewFNatsTransportBuilder(conn *nats.Conn, subject string) *FNatsTransportBuilder {
+	return &FNatsTransportBuilder{
+		conns:   []*nats.Conn{conn},
+		subject: subject,
+	}
+}
+
+// WithInbox sets the subject responses are received on. If not set, a unique
+// inbox is generated.
+func (f *FNatsTransportBuilder) WithInbox(inbox string) *FNatsTransportBuilder {
+	f.inbox = inbox
+	return f
+}
+
+// WithInboxPrefix sets the subject prefix of the generated inbox responses
+// are received on, which defaults to "_INBOX". The inbox is the prefix
+// followed by "." and a unique id, allowing NATS permissions to be granted on
+// a per-service prefix such as "myservice.replies.>". This is ignored if an
+// inbox is set with WithInbox.
+func (f *FNatsTransportBuilder) WithInboxPrefix(prefix string) *FNatsTransportBuilder {
+	f.inboxPrefix = prefix
+	return f
+}
+
+// WithChunking enables sending requests larger than the NATS message size
+// limit by splitting them into chunks, which are reassembled by the server.
+// Chunked responses from servers with chunking enabled are reassembled the
+// same way. Requests and responses are limited to the given total size.
+// Servers must also enable chunking with FNatsServerBuilder.WithChunking.
+func (f *FNatsTransportBuilder) WithChunking(maxSize uint) *FNatsTransportBuilder {
+	f.chunkLimit = maxSize
+	return f
+}
+
+// WithReconnectReplay enables replaying idempotent requests across NATS
+// reconnects. Requests made with a context marked with SetIdempotent are
+// tracked until they complete and are published again when the connection
+// reconnects, since responses sent while the connection was down are lost.
+// Idempotent requests are also allowed while the connection is reconnecting,
+// in which case the NATS client buffers them until it reconnects. Other
+// requests are unaffected.
+func (f *FNatsTransportBuilder) WithReconnectReplay() *FNatsTransportBuilder {
+	f.replay = true
+	return f
+}
+
+// WithNamespace publishes requests to the subject within the given namespace,
+// such as "prod" or "staging", so several environments can share a NATS
+// cluster. The namespace is joined to the subject with a ".", and servers must
+// be built with the same namespace to receive the requests.
+func (f *FNatsTransportBuilder) WithNamespace(namespace string) *FNatsTransportBuilder {
+	f.namespace = namespace
+	return f
+}
+
+// WithSubjectRouter sets a hook which can publish each request to a different
+// subject based on its FContext, such as sending requests with a
+// "_target=canary" header to a canary deployment:
+//
+//	builder.WithSubjectRouter(func(ctx frugal.FContext, subject string) string {
+//		if target, _ := ctx.RequestHeader("_target"); target == "canary" {
+//			return subject + ".canary"
+//		}
+//		return subject
+//	})
+//
+// Cancellations and replays of a request are sent to the same subject as the
+// request.
+func (f *FNatsTransportBuilder) WithSubjectRouter(router FNatsSubjectRouter) *FNatsTransportBuilder {
+	f.router = router
+	return f
+}
+
+// WithBatching coalesces requests published to the same subject within the
+// given window of each other into a single NATS message, which reduces the
+// per-message overhead of issuing many small requests. A batch is published
+// once the window since its first request elapses, once it holds the given
+// maximum number of requests, or once the next request would exceed the NATS
+// message size limit. A maximum of 0 leaves batches bounded only by size.
+// Requests wait for their batch to be published, so the window adds to their
+// latency. Responses are received individually and matched to their requests
+// by opid. Older servers process only the first request of each batch, so
+// requests are only batched once the FFeatureNegotiator set on the given
+// FProtocolFactory, which should be the client's, has seen the server support
+// FeatureBatching. Until then, and after the negotiator is reset, requests
+// are published individually. This panics if the factory has no negotiator.
+func (f *FNatsTransportBuilder) WithBatching(window time.Duration, maxRequests uint,
+	protocolFactory *FProtocolFactory) *FNatsTransportBuilder {
+	if protocolFactory == nil || protocolFactory.negotiator == nil {
+		panic("frugal: NATS request batching requires an FFeatureNegotiator")
+	}
+	f.batchWindow = window
+	f.batchFrames = maxRequests
+	f.negotiator = protocolFactory.negotiator
+	return f
+}
+
+// WithCancellation notifies the server with a cancel frame when a request
+// times out or its context is cancelled, so the server can stop processing
+// it. Older servers fail to process cancel frames, so they're only sent once
+// the FFeatureNegotiator set on the given FProtocolFactory, which should be
+// the client's, has seen the server support FeatureCancellation. This panics
+// if the factory has no negotiator.
+func (f *FNatsTransportBuilder) WithCancellation(protocolFactory *FProtocolFactory) *FNatsTransportBuilder {
+	if protocolFactory == nil || protocolFactory.negotiator == nil {
+		panic("frugal: NATS request cancellation requires an FFeatureNegotiator")
+	}
+	f.cancelling = protocolFactory.negotiator
+	return f
+}
+
+// WithConnectionPool adds connections to distribute requests across, in
+// addition to the connection the builder was created with. Requests are
+// assigned to connections in round-robin order, and each connection receives
+// responses on its own inbox subscription. When an inbox is set with
+// WithInbox, each connection's inbox is the inbox followed by "." and the
+// connection's index.
+func (f *FNatsTransportBuilder) WithConnectionPool(conns ...*nats.Conn) *FNatsTransportBuilder {
+	f.conns = append(f.conns, conns...)
+	return f
+}
+
+// WithMetrics sets the FNatsTransportMetrics which receives instrumentation
+// events from the transport. Reconnects are reported by chaining a reconnect
+// handler onto each connection when the transport is first opened.
+func (f *FNatsTransportBuilder) WithMetrics(metrics FNatsTransportMetrics) *FNatsTransportBuilder {
+	f.metrics = metrics
+	return f
+}
+
+// Build a new configured NATS FTransport.
+func (f *FNatsTransportBuilder) Build() FTransport {
+	metrics := f.metrics
+	if metrics == nil {
+		metrics = BaseFNatsTransportMetrics{}
+	}
+	subject := namespacedSubject(f.namespace, f.subject)
+	if len(f.conns) == 1 {
+		inbox := f.inbox
+		if inbox == "" && f.inboxPrefix != "" {
+			inbox = newInbox(f.inboxPrefix)
+		}
+		transport := NewFNatsTransport(f.conns[0], subject, inbox).(*fNatsTransport)
+		transport.metrics = metrics
+		transport.enableChunking(f.chunkLimit)
+		transport.enableReplay(f.replay)
+		transport.enableBatching(f.batchWindow, f.batchFrames, f.negotiator)
+		transport.cancels = f.cancelling
+		transport.router = f.router
+		return transport
+	}
+	pool := newFNatsTransportPool(f.conns, subject, f.inbox, f.inboxPrefix, metrics).(*fNatsTransportPool)
+	for _, transport := range pool.transports {
+		transport.enableChunking(f.chunkLimit)
+		transport.enableReplay(f.replay)
+		transport.enableBatching(f.batchWindow, f.batchFrames, f.negotiator)
+		transport.cancels = f.cancelling
+		transport.router = f.router
+	}
+	return pool
+}
+
+// newInbox returns a unique inbox subject with the given prefix.
+func newInbox(prefix string) string {
+	return prefix + "." + strings.TrimPrefix(nats.NewInbox(), nats.InboxPrefix)
+}
+
+// namespacedSubject returns the given subject within the given namespace. An
+// empty namespace leaves the subject unchanged.
+func namespacedSubject(namespace, subject string) string {
+	if namespace == "" {
+		return subject
+	}
+	return strings.TrimSuffix(namespace, ".") + "." + subject
+}
+
 // fNatsTransport implements FTransport. This is a "stateless" transport in the
 // sense that there is no connection with a server. A request is simply
 // published to a subject and responses are received on another subject.
 // This assumes requests/responses fit within a single NATS message.
 type fNatsTransport struct {
 	*fBaseTransport
-	conn    *nats.Conn
-	subject string
-	inbox   string
-	sub     *nats.Subscription
+	conn      *nats.Conn
+	subject   string
+	inbox     string
+	sub       *nats.Subscription
+	metrics   FNatsTransportMetrics
+	hooked    bool
+	assembler *chunkAssembler
+	replay    *replayBuffer
+	router    FNatsSubjectRouter
+	batcher   *natsBatcher
+	cancels   *FFeatureNegotiator
+}
+
+// enableReplay enables replaying idempotent requests after reconnects.
+func (f *fNatsTransport) enableReplay(replay bool) {
+	if replay {
+		f.replay = newReplayBuffer()
+	}
+}
+
+// enableBatching enables coalescing requests published within the given
+// window into batches of up to the given number of requests, once the given
+// negotiator has seen the server support batching. A zero window leaves
+// batching disabled.
+func (f *fNatsTransport) enableBatching(window time.Duration, maxFrames uint, negotiator *FFeatureNegotiator) {
+	if window > 0 {
+		f.batcher = newNatsBatcher(window, int(maxFrames), f.publish)
+		f.batcher.negotiator = negotiator
+	}
+}
+
+// enableChunking enables sending and receiving frames up to the given size
+// as chunks. A zero size leaves chunking disabled.
+func (f *fNatsTransport) enableChunking(maxSize uint) {
+	if maxSize > 0 {
+		f.assembler = newChunkAssembler(int(maxSize))
+	}
 }
 
 // Open subscribes to the configured inbox subject.
@@ -77,21 +314,67 @@ func (f *fNatsTransport) Open() error {
 		return thrift.NewTTransportExceptionFromError(err)
 	}
 	f.sub = sub
+	if _, ok := f.metrics.(BaseFNatsTransportMetrics); (!ok || f.replay != nil) && !f.hooked {
+		chainReconnectHandler(f.conn, f.reconnected)
+		f.hooked = true
+	}
 
 	f.fBaseTransport.Open()
 	return nil
 }
 
+// chainReconnectHandler calls the given callback when the connection
+// reconnects, preserving any reconnect handler already set on the connection.
+func chainReconnectHandler(conn *nats.Conn, callback func()) {
+	prev := conn.Opts.ReconnectedCB
+	conn.SetReconnectHandler(func(c *nats.Conn) {
+		callback()
+		if prev != nil {
+			prev(c)
+		}
+	})
+}
+
+// reconnected is called when the NATS connection reconnects.
+func (f *fNatsTransport) reconnected() {
+	f.metrics.Reconnected()
+	if f.replay != nil {
+		f.replay.replay(f.publish)
+	}
+}
+
 // handler receives a NATS message and executes the frame
 func (f *fNatsTransport) handler(msg *nats.Msg) {
-	if err := f.fBaseTransport.ExecuteFrame(msg.Data); err != nil {
+	frame := msg.Data
+	if isChunk(frame) {
+		if f.assembler == nil {
+			logger().Warn("frugal: discarding chunked response, chunking is not enabled")
+			return
+		}
+		var err error
+		if frame, err = f.assembler.add(msg.Subject, frame); err != nil {
+			logger().Warnf("frugal: discarding chunked response: %s", err)
+			return
+		}
+		if frame == nil {
+			return
+		}
+	}
+	f.metrics.FrameReceived(len(frame))
+	if err := f.fBaseTransport.ExecuteFrame(frame); err != nil {
 		logger().Warn("Could not execute frame", err)
 	}
 }
 
 // Returns true if the transport is open
 func (f *fNatsTransport) IsOpen() bool {
-	return f.sub != nil && f.conn.Status() == nats.CONNECTED
+	return f.isSubscribed() && f.conn.Status() == nats.CONNECTED
+}
+
+// isSubscribed returns true if the transport is subscribed to its inbox,
+// regardless of the connection status.
+func (f *fNatsTransport) isSubscribed() bool {
+	return f.sub != nil
 }
 
 // Close unsubscribes from the inbox subject.
@@ -109,10 +392,10 @@ func (f *fNatsTransport) Close() error {
 }
 
 func (f *fNatsTransport) checkMessageSize(data []byte) error {
-	if len(data) > natsMaxMessageSize {
+	if limit := int(f.GetRequestSizeLimit()); len(data) > limit {
 		return thrift.NewTTransportException(
 			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
-			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", natsMaxMessageSize, len(data)))
+			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", limit, len(data)))
 	}
 	return nil
 }
@@ -133,16 +416,64 @@ func (f *fNatsTransport) Oneway(ctx FContext, data []byte) error {
 		return err
 	}
 
-	return f.conn.PublishRequest(f.subject, f.inbox, data)
+	return f.send(f.route(ctx), data)
+}
+
+// route returns the subject to publish the request with the given context
+// to.
+func (f *fNatsTransport) route(ctx FContext) string {
+	if f.router == nil {
+		return f.subject
+	}
+	if subject := f.router(ctx, f.subject); subject != "" {
+		return subject
+	}
+	return f.subject
+}
+
+// publish sends the given frame to the given subject with the inbox as the
+// reply subject and reports the outcome to the metrics.
+func (f *fNatsTransport) publish(subject string, data []byte) error {
+	publish := f.conn.PublishRequest
+	if f.assembler != nil && len(data) > natsMaxMessageSize {
+		publish = func(subject, reply string, data []byte) error {
+			return publishChunked(f.conn, subject, reply, data)
+		}
+	}
+	if err := publish(subject, f.inbox, data); err != nil {
+		f.metrics.PublishError(err)
+		return err
+	}
+	f.metrics.FrameSent(len(data))
+	return nil
+}
+
+// send publishes the given request frame to the given subject, adding it to
+// a batch if batching is enabled and the server supports it.
+func (f *fNatsTransport) send(subject string, data []byte) error {
+	if f.batcher != nil && f.batcher.negotiator.Supports(FeatureBatching) {
+		return f.batcher.add(subject, data)
+	}
+	return f.publish(subject, data)
 }
 
 // Request transmits the given data and waits for a response.
 // Implementations of request should be threadsafe and respect the timeout
 // present the on context. The data is expected to already be framed.
 func (f *fNatsTransport) Request(ctx FContext, data []byte) (thrift.TTransport, error) {
+	start := time.Now()
+	result, err := f.request(ctx, data)
+	f.metrics.RequestCompleted(time.Since(start), err)
+	return result, err
+}
+
+func (f *fNatsTransport) request(ctx FContext, data []byte) (thrift.TTransport, error) {
 	resultC := make(chan []byte, 1)
 
-	if !f.IsOpen() {
+	// Replayable requests can be buffered by the NATS client while it
+	// reconnects.
+	replayable := f.replay != nil && IsIdempotent(ctx)
+	if !f.IsOpen() && !(replayable && f.isSubscribed() && f.conn.Status() == nats.RECONNECTING) {
 		return nil, f.getClosedConditionError("request:")
 	}
 
@@ -159,22 +490,96 @@ func (f *fNatsTransport) Request(ctx FContext, data []byte) (thrift.TTransport,
 		return nil, err
 	}
 
-	if err := f.conn.PublishRequest(f.subject, f.inbox, data); err != nil {
+	subject := f.route(ctx)
+	if replayable {
+		id := f.replay.add(subject, data)
+		defer f.replay.remove(id)
+	}
+
+	if err := f.send(subject, data); err != nil {
 		return nil, err
 	}
 
 	select {
 	case result := <-resultC:
 		return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(result)}, nil
+	case <-contextDone(ctx):
+		f.cancel(ctx, subject)
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_CANCELLED, "frugal: nats request cancelled")
 	case <-time.After(ctx.Timeout()):
+		f.cancel(ctx, subject)
 		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: nats request timed out")
 	}
 }
 
+// RequestStream transmits the given data and returns the stream of responses
+// to it. Streamed requests are not replayed across reconnects, as the server
+// would send the stream again from the start.
+func (f *fNatsTransport) RequestStream(ctx FContext, data []byte) (*FClientStream, error) {
+	queue := newStreamQueue()
+	conn, err := f.openStream(ctx, data, queue)
+	if err != nil {
+		return nil, err
+	}
+	return newFClientStream(ctx, queue, conn.close), nil
+}
+
+// openStream publishes the given request and delivers its responses to the
+// given queue. Further frames for the stream are published to the same
+// subject as the request.
+func (f *fNatsTransport) openStream(ctx FContext, data []byte, queue *streamQueue) (*streamConn, error) {
+	if !f.IsOpen() {
+		return nil, f.getClosedConditionError("request:")
+	}
+	if err := f.checkMessageSize(data); err != nil {
+		return nil, err
+	}
+
+	if err := f.registry.RegisterStream(ctx, queue); err != nil {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN, err.Error())
+	}
+	subject := f.route(ctx)
+	if err := f.send(subject, data); err != nil {
+		f.registry.Unregister(ctx)
+		return nil, err
+	}
+	return &streamConn{
+		send: func(frame []byte) error {
+			if err := f.checkMessageSize(frame); err != nil {
+				return err
+			}
+			return f.send(subject, frame)
+		},
+		close: func(finished bool) {
+			f.registry.Unregister(ctx)
+			if !finished {
+				f.cancel(ctx, subject)
+			}
+		},
+	}, nil
+}
+
+// cancel notifies the server the request in flight with the given context
+// was published to that the request has been abandoned, if cancellation is
+// enabled and the server supports it. This is best effort, so errors are only
+// logged.
+func (f *fNatsTransport) cancel(ctx FContext, subject string) {
+	if f.cancels == nil || !f.cancels.Supports(FeatureCancellation) {
+		return
+	}
+	if err := f.publish(subject, newCancelFrame(ctx)); err != nil {
+		logger().Warnf("frugal: unable to send cancel for request with correlation id %s: %s",
+			ctx.CorrelationID(), err)
+	}
+}
+
 // GetRequestSizeLimit returns the maximum number of bytes that can be
 // transmitted. Returns a non-positive number to indicate an unbounded
 // allowable size.
 func (f *fNatsTransport) GetRequestSizeLimit() uint {
+	if f.assembler != nil {
+		return uint(f.assembler.maxSize)
+	}
 	return uint(natsMaxMessageSize)
 }
 
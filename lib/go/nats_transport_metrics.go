@@ -0,0 +1,61 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import "time"
+
+// FNatsTransportMetrics receives instrumentation events from NATS
+// FTransports, providing visibility into transport health. Implementations
+// must be threadsafe since events are reported from request goroutines and
+// NATS callbacks concurrently.
+type FNatsTransportMetrics interface {
+	// FrameSent is called after a frame of the given size, including its
+	// frame size, is published.
+	FrameSent(bytes int)
+
+	// FrameReceived is called when a frame of the given size, including its
+	// frame size, is received on the inbox.
+	FrameReceived(bytes int)
+
+	// PublishError is called when publishing a frame fails.
+	PublishError(err error)
+
+	// Reconnected is called when the NATS connection used by the transport
+	// reconnects.
+	Reconnected()
+
+	// RequestCompleted is called when a request completes, with how long it
+	// took and the error it returned, if any.
+	RequestCompleted(latency time.Duration, err error)
+}
+
+// BaseFNatsTransportMetrics is an FNatsTransportMetrics which ignores all
+// events. It can be embedded in a struct which "overrides" only the events of
+// interest.
+type BaseFNatsTransportMetrics struct{}
+
+// FrameSent is a no-op.
+func (BaseFNatsTransportMetrics) FrameSent(bytes int) {}
+
+// FrameReceived is a no-op.
+func (BaseFNatsTransportMetrics) FrameReceived(bytes int) {}
+
+// PublishError is a no-op.
+func (BaseFNatsTransportMetrics) PublishError(err error) {}
+
+// Reconnected is a no-op.
+func (BaseFNatsTransportMetrics) Reconnected() {}
+
+// RequestCompleted is a no-op.
+func (BaseFNatsTransportMetrics) RequestCompleted(latency time.Duration, err error) {}
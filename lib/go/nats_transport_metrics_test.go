@@ -0,0 +1,94 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingMetrics records the FNatsTransportMetrics events it receives.
+type recordingMetrics struct {
+	BaseFNatsTransportMetrics
+	mu        sync.Mutex
+	sent      []int
+	received  []int
+	latencies []time.Duration
+	errs      []error
+}
+
+func (m *recordingMetrics) FrameSent(bytes int) {
+	m.mu.Lock()
+	m.sent = append(m.sent, bytes)
+	m.mu.Unlock()
+}
+
+func (m *recordingMetrics) FrameReceived(bytes int) {
+	m.mu.Lock()
+	m.received = append(m.received, bytes)
+	m.mu.Unlock()
+}
+
+func (m *recordingMetrics) RequestCompleted(latency time.Duration, err error) {
+	m.mu.Lock()
+	m.latencies = append(m.latencies, latency)
+	m.errs = append(m.errs, err)
+	m.mu.Unlock()
+}
+
+// Ensures NATS transport metrics receive frame and request events.
+func TestNatsTransportMetrics(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, &processor{t}, protoFactory, []string{"foo"}).Build()
+	go func() {
+		assert.Nil(server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+
+	metrics := &recordingMetrics{}
+	tr := NewFNatsTransportBuilder(conn, "foo").WithMetrics(metrics).Build()
+	assert.Nil(tr.Open())
+	defer tr.Close()
+
+	ctx := NewFContext("")
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protoFactory.GetProtocol(buffer)
+	proto.WriteRequestHeader(ctx)
+	proto.WriteBinary([]byte{1, 2, 3, 4, 5})
+	request := buffer.Bytes()
+	_, err = tr.Request(ctx, request)
+	assert.Nil(err)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	assert.Equal([]int{len(request)}, metrics.sent)
+	assert.Len(metrics.received, 1)
+	assert.Equal([]error{nil}, metrics.errs)
+	assert.True(metrics.latencies[0] > 0)
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+)
+
+// fNatsTransportPool implements FTransport by distributing requests across a
+// pool of fNatsTransports, each using its own NATS connection.
+type fNatsTransportPool struct {
+	*fBaseTransport
+	transports []*fNatsTransport
+	next       uint64
+}
+
+// newFNatsTransportPool returns an FTransport which distributes requests to
+// the given subject across the given connections.
+func newFNatsTransportPool(conns []*nats.Conn, subject, inbox, inboxPrefix string, metrics FNatsTransportMetrics) FTransport {
+	transports := make([]*fNatsTransport, len(conns))
+	for i, conn := range conns {
+		connInbox := ""
+		if inbox != "" {
+			connInbox = inbox + "." + strconv.Itoa(i)
+		} else if inboxPrefix != "" {
+			connInbox = newInbox(inboxPrefix)
+		}
+		transports[i] = NewFNatsTransport(conn, subject, connInbox).(*fNatsTransport)
+		transports[i].metrics = metrics
+	}
+	return &fNatsTransportPool{
+		fBaseTransport: newFBaseTransport(natsMaxMessageSize - 4),
+		transports:     transports,
+	}
+}
+
+// Open subscribes to the inbox of every connection in the pool. If any
+// subscription fails, the transports already opened are closed.
+func (f *fNatsTransportPool) Open() error {
+	for i, transport := range f.transports {
+		if err := transport.Open(); err != nil {
+			for _, opened := range f.transports[:i] {
+				opened.Close()
+			}
+			return err
+		}
+	}
+	f.fBaseTransport.Open()
+	return nil
+}
+
+// IsOpen returns true if any connection in the pool is open.
+func (f *fNatsTransportPool) IsOpen() bool {
+	for _, transport := range f.transports {
+		if transport.IsOpen() {
+			return true
+		}
+	}
+	return false
+}
+
+// Close unsubscribes from the inbox of every connection in the pool. The
+// first error encountered is returned.
+func (f *fNatsTransportPool) Close() error {
+	if !f.transports[0].isSubscribed() {
+		return nil
+	}
+	var err error
+	for _, transport := range f.transports {
+		if closeErr := transport.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	f.fBaseTransport.Close(nil)
+	return err
+}
+
+// Oneway transmits the given data on the next open connection in the pool.
+func (f *fNatsTransportPool) Oneway(ctx FContext, data []byte) error {
+	return f.nextTransport().Oneway(ctx, data)
+}
+
+// Request transmits the given data on the next open connection in the pool
+// and waits for a response.
+func (f *fNatsTransportPool) Request(ctx FContext, data []byte) (thrift.TTransport, error) {
+	return f.nextTransport().Request(ctx, data)
+}
+
+// RequestStream transmits the given data on the next open connection in the
+// pool and returns the stream of responses to it.
+func (f *fNatsTransportPool) RequestStream(ctx FContext, data []byte) (*FClientStream, error) {
+	return f.nextTransport().RequestStream(ctx, data)
+}
+
+// openStream opens a bidirectional stream on the next open connection in the
+// pool.
+func (f *fNatsTransportPool) openStream(ctx FContext, data []byte, queue *streamQueue) (*streamConn, error) {
+	return f.nextTransport().openStream(ctx, data, queue)
+}
+
+// GetRequestSizeLimit returns the maximum number of bytes that can be
+// transmitted.
+func (f *fNatsTransportPool) GetRequestSizeLimit() uint {
+	return f.transports[0].GetRequestSizeLimit()
+}
+
+// This is a no-op for fNatsTransportPool
+func (f *fNatsTransportPool) SetMonitor(monitor FTransportMonitor) {
+}
+
+// nextTransport returns the next open transport in round-robin order. If no
+// transport is open, the next transport is returned so its closed condition
+// error is reported.
+func (f *fNatsTransportPool) nextTransport() *fNatsTransport {
+	start := atomic.AddUint64(&f.next, 1)
+	for i := uint64(0); i < uint64(len(f.transports)); i++ {
+		transport := f.transports[(start+i)%uint64(len(f.transports))]
+		if transport.IsOpen() {
+			return transport
+		}
+	}
+	return f.transports[start%uint64(len(f.transports))]
+}
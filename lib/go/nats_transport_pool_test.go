@@ -0,0 +1,181 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures a pooled NATS transport distributes requests across its
+// connections and receives responses on each of them.
+func TestNatsTransportPool(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conns := make([]*nats.Conn, 3)
+	for i := range conns {
+		conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conns[0], &processor{t}, protoFactory, []string{"foo"}).Build()
+	go func() {
+		assert.Nil(t, server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+
+	tr := NewFNatsTransportBuilder(conns[0], "foo").
+		WithInbox("bar").
+		WithConnectionPool(conns[1:]...).
+		Build()
+	pool := tr.(*fNatsTransportPool)
+	assert.Nil(t, tr.Open())
+	assert.True(t, tr.IsOpen())
+	assert.Equal(t, "bar.0", pool.transports[0].inbox)
+	assert.Equal(t, "bar.2", pool.transports[2].inbox)
+
+	for i := 0; i < len(conns); i++ {
+		ctx := NewFContext("")
+		buffer := NewTMemoryOutputBuffer(0)
+		proto := protoFactory.GetProtocol(buffer)
+		proto.WriteRequestHeader(ctx)
+		proto.WriteBinary([]byte{1, 2, 3, 4, 5})
+		resultTrans, err := tr.Request(ctx, buffer.Bytes())
+		assert.Nil(t, err)
+
+		resultProto := protoFactory.GetProtocol(resultTrans)
+		assert.Nil(t, resultProto.ReadResponseHeader(ctx))
+		resultBytes, err := resultProto.ReadBinary()
+		assert.Nil(t, err)
+		assert.Equal(t, "foo", string(resultBytes))
+	}
+	for _, conn := range conns[1:] {
+		assert.Equal(t, uint64(1), conn.OutMsgs)
+	}
+
+	assert.Nil(t, tr.Close())
+	assert.False(t, tr.IsOpen())
+	assert.Nil(t, tr.Close())
+}
+
+// Ensures a pooled NATS transport skips connections which are not open.
+func TestNatsTransportPoolSkipsClosedConnections(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	open, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	closed, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := NewFNatsTransportBuilder(open, "foo").WithConnectionPool(closed).Build()
+	assert.Nil(t, tr.Open())
+	closed.Close()
+	pool := tr.(*fNatsTransportPool)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, open, pool.nextTransport().conn)
+	}
+	assert.True(t, tr.IsOpen())
+}
+
+// Ensures the builder returns a plain NATS transport without a pool.
+func TestNatsTransportBuilder(t *testing.T) {
+	tr := NewFNatsTransportBuilder(nil, "foo").WithInbox("bar").Build().(*fNatsTransport)
+	assert.Equal(t, "foo", tr.subject)
+	assert.Equal(t, "bar", tr.inbox)
+}
+
+// Ensures the builder generates inboxes with the configured prefix.
+func TestNatsTransportBuilderInboxPrefix(t *testing.T) {
+	assert := assert.New(t)
+	tr := NewFNatsTransportBuilder(nil, "foo").WithInboxPrefix("svc.replies").Build().(*fNatsTransport)
+	assert.True(strings.HasPrefix(tr.inbox, "svc.replies."))
+	assert.Len(tr.inbox, len("svc.replies.")+22)
+
+	tr = NewFNatsTransportBuilder(nil, "foo").WithInboxPrefix("svc.replies").WithInbox("bar").Build().(*fNatsTransport)
+	assert.Equal("bar", tr.inbox)
+
+	pool := NewFNatsTransportBuilder(nil, "foo").
+		WithInboxPrefix("svc.replies").
+		WithConnectionPool(nil).
+		Build().(*fNatsTransportPool)
+	assert.True(strings.HasPrefix(pool.transports[0].inbox, "svc.replies."))
+	assert.True(strings.HasPrefix(pool.transports[1].inbox, "svc.replies."))
+	assert.NotEqual(pool.transports[0].inbox, pool.transports[1].inbox)
+}
+
+// Ensures a NATS transport with a subject router publishes each request to
+// the subject chosen from its FContext.
+func TestNatsTransportSubjectRouter(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, &namedProcessor{name: "stable"}, protoFactory, []string{"foo"}).
+		WithService(&namedProcessor{name: "canary"}, []string{"foo.canary"}).
+		Build()
+	go func() {
+		assert.Nil(t, server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+
+	tr := NewFNatsTransportBuilder(conn, "foo").
+		WithSubjectRouter(func(ctx FContext, subject string) string {
+			if target, _ := ctx.RequestHeader("_target"); target == "canary" {
+				return subject + ".canary"
+			}
+			return ""
+		}).
+		Build()
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	for target, expected := range map[string]string{"": "stable", "canary": "canary", "other": "stable"} {
+		ctx := NewFContext("")
+		if target != "" {
+			ctx.AddRequestHeader("_target", target)
+		}
+		buffer := NewTMemoryOutputBuffer(0)
+		proto := protoFactory.GetProtocol(buffer)
+		proto.WriteRequestHeader(ctx)
+		resultTrans, err := tr.Request(ctx, buffer.Bytes())
+		assert.Nil(t, err)
+
+		resultProto := protoFactory.GetProtocol(resultTrans)
+		assert.Nil(t, resultProto.ReadResponseHeader(ctx))
+		result, err := resultProto.ReadString()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, result)
+	}
+}
@@ -37,6 +37,10 @@ func (m *mockRegistry) Register(ctx FContext, resultC chan []byte) error {
 	return nil
 }
 
+func (m *mockRegistry) RegisterStream(ctx FContext, queue *streamQueue) error {
+	return nil
+}
+
 func (m *mockRegistry) Unregister(ctx FContext) {
 }
 
@@ -207,6 +211,72 @@ func TestNatsTransportRequest(t *testing.T) {
 	msg, err := sub.NextMsg(5 * time.Millisecond)
 	assert.Nil(t, err)
 	assert.Equal(t, prependFrameSize(frame), msg.Data)
+	// Cancel frames are only sent when enabled.
+	_, err = sub.NextMsg(5 * time.Millisecond)
+	assert.Equal(t, nats.ErrTimeout, err)
+}
+
+// Ensures Request returns a cancelled error when the context is cancelled and
+// sends a cancel frame for the request to a server which supports them. No
+// server is started so the request is cancelled while in flight and the
+// frames can be inspected.
+func TestNatsTransportRequestCancelled(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	negotiator := NewFFeatureNegotiator()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithNegotiator(negotiator)
+	tr := NewFNatsTransportBuilder(conn, "foo").WithInbox("bar").
+		WithCancellation(protoFactory).Build().(*fNatsTransport)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	frame := []byte("helloworld")
+	sub, err := conn.SubscribeSync(tr.subject)
+	assert.Nil(t, err)
+	assert.Nil(t, conn.Flush())
+
+	// Cancel frames aren't sent until the server is seen to support them.
+	ctx := NewFContext("")
+	ctx.SetTimeout(5 * time.Millisecond)
+	_, err = tr.Request(ctx, prependFrameSize(frame))
+	assert.Equal(t, TRANSPORT_EXCEPTION_TIMED_OUT, err.(thrift.TTransportException).TypeId())
+	_, err = sub.NextMsg(time.Second)
+	assert.Nil(t, err)
+	_, err = sub.NextMsg(5 * time.Millisecond)
+	assert.Equal(t, nats.ErrTimeout, err)
+
+	negotiator.negotiate(FeatureCancellation, true)
+	ctx = NewFContext("")
+	requested := make(chan *nats.Msg, 1)
+	go func() {
+		// Cancel once the request has been sent.
+		msg, err := sub.NextMsg(time.Second)
+		assert.Nil(t, err)
+		requested <- msg
+		ctx.(*FContextImpl).Cancel()
+	}()
+	_, err = tr.Request(ctx, prependFrameSize(frame))
+	assert.Equal(t, TRANSPORT_EXCEPTION_CANCELLED, err.(thrift.TTransportException).TypeId())
+	msg := <-requested
+	if !assert.NotNil(t, msg) {
+		return
+	}
+	assert.Equal(t, prependFrameSize(frame), msg.Data)
+	msg, err = sub.NextMsg(time.Second)
+	assert.Nil(t, err)
+	assert.True(t, isCancelFrame(msg.Data))
+	headers, err := getHeadersFromFrame(msg.Data[4:])
+	assert.Nil(t, err)
+	assert.Equal(t, ctx.RequestHeaders()[opIDHeader], headers[opIDHeader])
+
+	assert.Panics(t, func() {
+		NewFNatsTransportBuilder(conn, "foo").WithCancellation(NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()))
+	})
 }
 
 // Ensures Request returns an error if a duplicate opid is used.
@@ -251,7 +321,7 @@ func newClientAndServer(t *testing.T, isTTransport bool) (*fNatsTransport, *fNat
 	proto := thrift.NewTJSONProtocol(mockTransport)
 	mockTProtocolFactory.On("GetProtocol", mock.AnythingOfType("*thrift.TMemoryBuffer")).Return(proto).Once()
 	mockTProtocolFactory.On("GetProtocol", mock.AnythingOfType("*frugal.TMemoryOutputBuffer")).Return(proto).Once()
-	fproto := &FProtocol{proto}
+	fproto := NewFProtocol(proto)
 	mockProcessor.On("Process", fproto, fproto).Return(nil)
 
 	go func() {
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Header listing the header protocol features supported by the sender.
+// Clients negotiating features send it with requests, and servers echo the
+// features they support in response.
+const featuresHeader = "_features"
+
+// Header protocol features which can be negotiated with FFeatureNegotiator.
+const (
+	// FeatureCompression indicates payload compression, see
+	// FProtocolFactory.WithCompression.
+	FeatureCompression = "compression"
+
+	// FeatureCancellation indicates requests can be cancelled, see
+	// FContextImpl.Cancel.
+	FeatureCancellation = "cancellation"
+
+	// FeatureBatching indicates NATS messages holding a batch of requests
+	// are split into their requests, see FNatsTransportBuilder.WithBatching.
+	FeatureBatching = "batching"
+)
+
+// isPerHopRequestHeader indicates if the named request header applies only
+// to the request it was read from, so it isn't propagated by handlers which
+// pass their FContext on to other services. Servers set a new opid in place
+// of the client's.
+func isPerHopRequestHeader(name string) bool {
+	return name == opIDHeader || name == remainingHeader || name == featuresHeader || name == serviceIDHeader
+}
+
+// FFeatureNegotiator discovers which header protocol features a server
+// supports, so clients can roll out wire format changes incrementally. Clients
+// using it advertise their features with each request, and servers of this
+// version of frugal or later respond with theirs. Servers which don't respond
+// are assumed to support none, so features are only used once the server has
+// been seen to support them. A negotiator should be shared by the FProtocols
+// of a single server, or group of servers which are upgraded together, and
+// is safe for concurrent use.
+type FFeatureNegotiator struct {
+	mu         sync.RWMutex
+	negotiated bool
+	features   map[string]bool
+}
+
+// NewFFeatureNegotiator creates an FFeatureNegotiator which has not
+// negotiated with a server yet.
+func NewFFeatureNegotiator() *FFeatureNegotiator {
+	return &FFeatureNegotiator{features: make(map[string]bool)}
+}
+
+// WithNegotiator advertises the features of FProtocols produced by this
+// factory with each request and records the server's features from responses
+// in the given FFeatureNegotiator. Compression is only used once the server
+// supports it. Servers don't need a negotiator to respond. Returns the same
+// FProtocolFactory to allow for chaining calls.
+func (f *FProtocolFactory) WithNegotiator(negotiator *FFeatureNegotiator) *FProtocolFactory {
+	f.negotiator = negotiator
+	return f
+}
+
+// Negotiated indicates if a response has been received from the server since
+// the negotiator was created or reset.
+func (n *FFeatureNegotiator) Negotiated() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.negotiated
+}
+
+// Supports indicates if the server supports the given feature. It is false
+// until the server says otherwise.
+func (n *FFeatureNegotiator) Supports(feature string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.features[feature]
+}
+
+// Features returns the features the server supports, in sorted order.
+func (n *FFeatureNegotiator) Features() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	features := make([]string, 0, len(n.features))
+	for feature := range n.features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// Reset forgets the server's features, for instance after reconnecting to a
+// server which may run a different version. Features are renegotiated with
+// the next response.
+func (n *FFeatureNegotiator) Reset() {
+	n.mu.Lock()
+	n.negotiated = false
+	n.features = make(map[string]bool)
+	n.mu.Unlock()
+}
+
+// negotiate records the features from the given features header of a
+// response. A missing header means the server predates negotiation.
+func (n *FFeatureNegotiator) negotiate(header string, ok bool) {
+	features := make(map[string]bool)
+	if ok {
+		for _, feature := range strings.Split(header, ",") {
+			if feature = strings.TrimSpace(feature); feature != "" {
+				features[feature] = true
+			}
+		}
+	}
+	n.mu.Lock()
+	n.negotiated = true
+	n.features = features
+	n.mu.Unlock()
+}
+
+// features returns the features header value for the features supported by
+// the protocol.
+func (f *FProtocol) features() string {
+	features := FeatureBatching + "," + FeatureCancellation
+	if f.compression != nil {
+		features += "," + FeatureCompression
+	}
+	return features
+}
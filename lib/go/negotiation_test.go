@@ -0,0 +1,105 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// negotiationRoundTrip sends a request from the client factory to the server
+// factory and returns the request frame and the client's response context.
+func negotiationRoundTrip(t *testing.T, client, server *FProtocolFactory) ([]byte, FContext) {
+	assert := assert.New(t)
+	ctx := NewFContext("cid")
+	request := NewTMemoryOutputBuffer(0)
+	proto := client.GetProtocol(request)
+	assert.Nil(proto.WriteRequestHeader(ctx))
+	assert.Nil(writeConformanceMessage(proto, "conform", thrift.CALL))
+	frame := request.Bytes()
+
+	proto = server.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	serverCtx, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	readConformanceMessage(t, proto, thrift.CALL)
+	_, ok := serverCtx.RequestHeader(featuresHeader)
+	assert.False(ok)
+	response := NewTMemoryOutputBuffer(0)
+	proto = server.GetProtocol(response)
+	assert.Nil(proto.WriteResponseHeader(serverCtx))
+	assert.Nil(writeConformanceMessage(proto, "conform", thrift.REPLY))
+
+	proto = client.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(response.Bytes()[4:])})
+	assert.Nil(proto.ReadResponseHeader(ctx))
+	readConformanceMessage(t, proto, thrift.REPLY)
+	return frame, ctx
+}
+
+// Ensures clients only compress requests once the server says it supports
+// compression.
+func TestNegotiationCompression(t *testing.T) {
+	assert := assert.New(t)
+	negotiator := NewFFeatureNegotiator()
+	client := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithCompression(0).WithNegotiator(negotiator)
+	server := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithCompression(0)
+	assert.False(negotiator.Negotiated())
+
+	frame, ctx := negotiationRoundTrip(t, client, server)
+	assert.Equal(byte(protocolV0), frame[4])
+	headers, err := getHeadersFromFrame(frame[4:])
+	assert.Nil(err)
+	assert.Equal("batching,cancellation,compression", headers[featuresHeader])
+	features, _ := ctx.ResponseHeader(featuresHeader)
+	assert.Equal("batching,cancellation,compression", features)
+	assert.True(negotiator.Negotiated())
+	assert.True(negotiator.Supports(FeatureCompression))
+	assert.Equal([]string{FeatureBatching, FeatureCancellation, FeatureCompression}, negotiator.Features())
+
+	frame, _ = negotiationRoundTrip(t, client, server)
+	assert.Equal(byte(protocolV1), frame[4])
+
+	negotiator.Reset()
+	assert.False(negotiator.Negotiated())
+	assert.False(negotiator.Supports(FeatureCompression))
+}
+
+// Ensures clients fall back to features supported by the server, or none if
+// the server doesn't respond with its features.
+func TestNegotiationFallback(t *testing.T) {
+	assert := assert.New(t)
+	negotiator := NewFFeatureNegotiator()
+	client := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithCompression(0).WithNegotiator(negotiator)
+	server := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+
+	negotiationRoundTrip(t, client, server)
+	assert.True(negotiator.Supports(FeatureCancellation))
+	assert.False(negotiator.Supports(FeatureCompression))
+	frame, _ := negotiationRoundTrip(t, client, server)
+	assert.Equal(byte(protocolV0), frame[4])
+
+	negotiator.negotiate("", false)
+	assert.True(negotiator.Negotiated())
+	assert.Empty(negotiator.Features())
+}
+
+// Ensures servers only respond with their features when asked.
+func TestNegotiationNotRequested(t *testing.T) {
+	factory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	_, ctx := negotiationRoundTrip(t, factory, factory)
+	_, ok := ctx.ResponseHeader(featuresHeader)
+	assert.False(t, ok)
+}
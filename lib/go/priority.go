@@ -0,0 +1,77 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Header containing the request priority (integer as string)
+const priorityHeader = "_priority"
+
+// Priority indicates how urgently a request should be processed. Servers
+// which support priority scheduling process queued requests with a higher
+// priority first. Requests without a priority have PriorityNormal.
+type Priority int
+
+const (
+	// PriorityLow is for bulk or batch traffic which can tolerate delays.
+	PriorityLow Priority = -1
+
+	// PriorityNormal is the default priority.
+	PriorityNormal Priority = 0
+
+	// PriorityHigh is for interactive traffic which should not be starved by
+	// bulk traffic.
+	PriorityHigh Priority = 1
+)
+
+// SetPriority sets the priority of requests made with the given FContext.
+// The priority is sent in the reserved "_priority" request header.
+func SetPriority(ctx FContext, priority Priority) {
+	setRequestHeader(ctx, priorityHeader, strconv.Itoa(int(priority)))
+}
+
+// GetPriority returns the priority of the given FContext, or PriorityNormal
+// if none or an invalid one is set.
+func GetPriority(ctx FContext) Priority {
+	value, ok := ctx.RequestHeader(priorityHeader)
+	if !ok {
+		return PriorityNormal
+	}
+	return parsePriority(value)
+}
+
+// framePriority returns the priority of the request in the given frame,
+// including its frame size, without processing the frame. Frames which
+// can't be read have PriorityNormal.
+func framePriority(frame []byte) Priority {
+	if len(frame) < 5 || !bytes.Contains(frame, []byte(priorityHeader)) {
+		return PriorityNormal
+	}
+	value, ok, err := frameHeader(frame[4:], priorityHeader)
+	if err != nil || !ok {
+		return PriorityNormal
+	}
+	return parsePriority(value)
+}
+
+func parsePriority(value string) Priority {
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		return PriorityNormal
+	}
+	return Priority(priority)
+}
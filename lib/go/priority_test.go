@@ -0,0 +1,56 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures SetPriority and GetPriority round trip and default to
+// PriorityNormal.
+func TestPriority(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("")
+	assert.Equal(PriorityNormal, GetPriority(ctx))
+	SetPriority(ctx, PriorityHigh)
+	assert.Equal(PriorityHigh, GetPriority(ctx))
+	SetPriority(ctx, PriorityLow)
+	assert.Equal(PriorityLow, GetPriority(ctx))
+	setRequestHeader(ctx, priorityHeader, "urgent")
+	assert.Equal(PriorityNormal, GetPriority(ctx))
+	assert.True(IsReservedRequestHeader(priorityHeader))
+}
+
+// Ensures framePriority reads the priority from a framed request.
+func TestFramePriority(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(PriorityNormal, framePriority(priorityFrame(t, NewFContext(""))))
+	ctx := NewFContext("")
+	SetPriority(ctx, PriorityHigh)
+	assert.Equal(PriorityHigh, framePriority(priorityFrame(t, ctx)))
+	assert.Equal(PriorityNormal, framePriority([]byte("_priority")))
+}
+
+func priorityFrame(t *testing.T, ctx FContext) []byte {
+	buff := &thrift.TMemoryBuffer{Buffer: new(bytes.Buffer)}
+	proto := NewFProtocol(thrift.NewTBinaryProtocolTransport(buff))
+	if err := proto.WriteRequestHeader(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return prependFrameSize(buff.Bytes())
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// SetMaxProcessingTime caps the time the processor lets a handler take for a
+// request, independent of the client's timeout. A handler which exceeds it is
+// abandoned: the request's FContext is cancelled, the client is sent a
+// TApplicationException of type APPLICATION_EXCEPTION_PROCESSING_TIMEOUT, and
+// the handler's response, if it ever returns, is discarded. Handlers write
+// their responses to a buffer while the cap is set, so the processor must be
+// given the protocol factory of the server it's used with. A zero duration,
+// the default, removes the cap. This should only be called before the server
+// is started.
+func (f *FBaseProcessor) SetMaxProcessingTime(max time.Duration, protocolFactory *FProtocolFactory) {
+	f.maxProcessingTime = max
+	f.bufferFactory = protocolFactory
+}
+
+// processCapped processes a request with the given FProcessorFunction,
+// abandoning it if the handler exceeds the maximum processing time.
+func (f *FBaseProcessor) processCapped(processor FProcessorFunction, ctx FContext, name string,
+	iprot, oprot *FProtocol) error {
+	buffer := thrift.NewTMemoryBuffer()
+	done := make(chan error, 1)
+	go func() {
+		done <- f.processFunction(processor, ctx, name, iprot, f.bufferFactory.GetProtocol(buffer))
+	}()
+
+	timer := time.NewTimer(f.maxProcessingTime)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		f.writeMu.Lock()
+		defer f.writeMu.Unlock()
+		if err2 := oprot.writeEncoded(buffer.Bytes()); err2 != nil {
+			if !IsErrTooLarge(err2) {
+				return err2
+			}
+			ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_RESPONSE_TOO_LARGE, err2.Error())
+			return writeExceptionResponse(oprot, ctx, name, ex)
+		}
+		return err
+	case <-timer.C:
+	}
+
+	logger().Errorf("frugal: abandoning %s on request with correlation id %s after exceeding the maximum processing time of %s",
+		name, ctx.CorrelationID(), f.maxProcessingTime)
+	if c, ok := ctx.(*FContextImpl); ok {
+		c.Cancel()
+	}
+	ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_PROCESSING_TIMEOUT,
+		fmt.Sprintf("%s exceeded the maximum processing time of %s", name, f.maxProcessingTime))
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	if err := writeExceptionResponse(oprot, ctx, name, ex); err != nil {
+		return err
+	}
+	return ex
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowHealth blocks checks until they are cancelled.
+type slowHealth struct {
+	cancelled chan struct{}
+}
+
+func (h *slowHealth) Check(ctx FContext, service string) (FHealthStatus, error) {
+	<-contextDone(ctx)
+	close(h.cancelled)
+	return HealthServing, nil
+}
+
+// Ensures handlers which exceed the maximum processing time are abandoned and
+// cancelled, and the client is sent a timeout exception.
+func TestMaxProcessingTime(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := &slowHealth{cancelled: make(chan struct{})}
+	processor := NewFHealthProcessor(handler)
+	processor.SetMaxProcessingTime(10*time.Millisecond, protocolFactory)
+	transport := NewFLoopbackTransport(processor, protocolFactory)
+	assert.Nil(transport.Open())
+	client := NewFHealthClient(NewFServiceProvider(transport, protocolFactory))
+
+	_, err := client.Check(NewFContext(""), "")
+	ex, ok := err.(thrift.TApplicationException)
+	if assert.True(ok) {
+		assert.Equal(int32(APPLICATION_EXCEPTION_PROCESSING_TIMEOUT), ex.TypeId())
+		assert.Equal("check exceeded the maximum processing time of 10ms", ex.Error())
+	}
+	select {
+	case <-handler.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected handler to be cancelled")
+	}
+}
+
+// Ensures responses of handlers which finish within the maximum processing
+// time are sent, including by protocols which wrap their transport.
+func TestMaxProcessingTimeWithinLimit(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithCompression(0)
+	health := NewFHealthServer()
+	health.SetServingStatus("store", HealthNotServing)
+	processor := NewFHealthProcessor(health)
+	processor.SetMaxProcessingTime(time.Second, protocolFactory)
+	transport := NewFLoopbackTransport(processor, protocolFactory)
+	assert.Nil(transport.Open())
+	client := NewFHealthClient(NewFServiceProvider(transport, protocolFactory))
+
+	for i := 0; i < 2; i++ {
+		status, err := client.Check(NewFContext(""), "store")
+		assert.Nil(err)
+		assert.Equal(HealthNotServing, status)
+	}
+}
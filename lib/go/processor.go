@@ -14,7 +14,11 @@
 package frugal
 
 import (
+	"fmt"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"time"
 
 	"git.apache.org/thrift.git/lib/go/thrift"
 )
@@ -41,9 +45,19 @@ type FProcessor interface {
 // embed this and register FProcessorFunctions. This should only be used by
 // generated code.
 type FBaseProcessor struct {
+	// slowRequests is accessed atomically, so is first to keep it aligned.
+	slowRequests uint64
+
 	writeMu        sync.Mutex
 	processMap     map[string]FProcessorFunction
 	annotationsMap map[string]map[string]string
+	inFlight       *inFlightRequests
+	methodLimits   map[string]*methodLimiter
+	methodTimeouts map[string]time.Duration
+
+	maxProcessingTime time.Duration
+	bufferFactory     *FProtocolFactory
+	slowThreshold     time.Duration
 }
 
 // NewFBaseProcessor returns a new FBaseProcessor which FProcessors can extend.
@@ -51,22 +65,46 @@ func NewFBaseProcessor() *FBaseProcessor {
 	return &FBaseProcessor{
 		processMap:     make(map[string]FProcessorFunction),
 		annotationsMap: make(map[string]map[string]string),
+		inFlight:       newInFlightRequests(),
 	}
 }
 
 // Process the request from the input protocol and write the response to the
-// output protocol.
+// output protocol. While a request is being processed, a cancel frame sent by
+// the client for it cancels its FContext. Cancel frames have no response.
 func (f *FBaseProcessor) Process(iprot, oprot *FProtocol) error {
 	ctx, err := iprot.ReadRequestHeader()
 	if err != nil {
 		return err
 	}
+	if _, ok := ctx.RequestHeader(cancelHeader); ok {
+		f.inFlight.cancel(ctx)
+		return nil
+	}
+	key := f.inFlight.add(ctx)
+	defer f.inFlight.remove(key)
 	name, _, _, err := iprot.ReadMessageBegin()
 	if err != nil {
 		return err
 	}
 	if processor, ok := f.processMap[name]; ok {
-		if err := processor.Process(ctx, iprot, oprot); err != nil {
+		release, ok, err := f.admit(ctx, name, iprot, oprot)
+		if !ok {
+			return err
+		}
+		defer release()
+		defer f.startMethodTimeout(ctx, name)()
+		process := f.processFunction
+		if f.maxProcessingTime > 0 {
+			process = f.processCapped
+		}
+		start := time.Now()
+		err = process(processor, ctx, name, iprot, oprot)
+		if f.slowThreshold > 0 {
+			f.checkSlowRequest(ctx, name, time.Since(start))
+		}
+		if err != nil {
+			iprot.recordError(err)
 			if _, ok := err.(thrift.TException); ok {
 				logger().Errorf(
 					"frugal: error occurred while processing request with correlation id %s: %s",
@@ -90,8 +128,45 @@ func (f *FBaseProcessor) Process(iprot, oprot *FProtocol) error {
 		return err
 	}
 	ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN_METHOD, "Unknown function "+name)
+	iprot.recordError(ex)
 	f.writeMu.Lock()
 	defer f.writeMu.Unlock()
+	return writeExceptionResponse(oprot, ctx, name, ex)
+}
+
+// processFunction processes a request with the given FProcessorFunction. If
+// the handler panics, the panic is logged with its stack and the request fails
+// with a TApplicationException of type APPLICATION_EXCEPTION_INTERNAL_ERROR,
+// rather than leaving the client to time out. Any response written before the
+// panic is discarded if the output transport supports it.
+func (f *FBaseProcessor) processFunction(processor FProcessorFunction, ctx FContext, name string,
+	iprot, oprot *FProtocol) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		logger().Errorf("frugal: panic while processing %s on request with correlation id %s: %v\n%s",
+			name, ctx.CorrelationID(), r, debug.Stack())
+		if buffer, ok := oprot.Transport().(interface {
+			Reset()
+		}); ok {
+			buffer.Reset()
+		}
+		ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_INTERNAL_ERROR,
+			fmt.Sprintf("Internal error processing %s: %v", name, r))
+		f.writeMu.Lock()
+		defer f.writeMu.Unlock()
+		if err = writeExceptionResponse(oprot, ctx, name, ex); err == nil {
+			err = ex
+		}
+	}()
+	return processor.Process(ctx, iprot, oprot)
+}
+
+// writeExceptionResponse writes a response to the request with the given
+// context and method name which fails with the given exception.
+func writeExceptionResponse(oprot *FProtocol, ctx FContext, name string, ex thrift.TApplicationException) error {
 	if err := oprot.WriteResponseHeader(ctx); err != nil {
 		return err
 	}
@@ -104,10 +179,7 @@ func (f *FBaseProcessor) Process(iprot, oprot *FProtocol) error {
 	if err := oprot.WriteMessageEnd(); err != nil {
 		return err
 	}
-	if err := oprot.Flush(); err != nil {
-		return err
-	}
-	return nil
+	return oprot.Flush()
 }
 
 // AddMiddleware adds the given ServiceMiddleware to the FProcessor. This
@@ -142,6 +214,17 @@ func (f *FBaseProcessor) Annotations() map[string]map[string]string {
 	return annoCopy
 }
 
+// Methods returns the sorted names of the methods registered with the
+// FProcessor.
+func (f *FBaseProcessor) Methods() []string {
+	methods := make([]string, 0, len(f.processMap))
+	for method := range f.processMap {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
 // GetWriteMutex returns the Mutex which FProcessorFunctions should use to
 // synchronize access to the output FProtocol.
 func (f *FBaseProcessor) GetWriteMutex() *sync.Mutex {
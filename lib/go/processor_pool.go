@@ -0,0 +1,111 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"sync/atomic"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// pooledProcessor is an FProcessor which limits how many requests are
+// processed at once across the connections of a server. Requests which can't
+// be processed straight away wait for a worker, up to the queue length, beyond
+// which they're handled according to the overflow policy.
+type pooledProcessor struct {
+	FProcessor
+	workers  chan struct{}
+	waiting  int64
+	queueLen int64
+	overflow FOverflowPolicy
+}
+
+func newPooledProcessor(processor FProcessor, workerCount, queueLen uint, overflow FOverflowPolicy) *pooledProcessor {
+	return &pooledProcessor{
+		FProcessor: processor,
+		workers:    make(chan struct{}, workerCount),
+		queueLen:   int64(queueLen),
+		overflow:   overflow,
+	}
+}
+
+// Process waits for a worker, then processes the request with the wrapped
+// processor. If the queue is full and the overflow policy is
+// FOverflowReject, the request is responded to with an
+// APPLICATION_EXCEPTION_SERVER_OVERLOADED error instead.
+func (p *pooledProcessor) Process(iprot, oprot *FProtocol) error {
+	var wait time.Duration
+	select {
+	case p.workers <- struct{}{}:
+	default:
+		waiting := atomic.AddInt64(&p.waiting, 1)
+		if waiting > p.queueLen && p.overflow == FOverflowReject {
+			atomic.AddInt64(&p.waiting, -1)
+			return p.reject(iprot, oprot)
+		}
+		start := time.Now()
+		p.workers <- struct{}{}
+		wait = time.Since(start)
+		atomic.AddInt64(&p.waiting, -1)
+	}
+	defer func() { <-p.workers }()
+	if admission, ok := p.FProcessor.(*admissionProcessor); ok {
+		return admission.process(iprot, oprot, wait, int(p.waitingRequests()))
+	}
+	return p.FProcessor.Process(iprot, oprot)
+}
+
+// reject reads the request and responds to it with an
+// APPLICATION_EXCEPTION_SERVER_OVERLOADED error without processing it.
+// Cancellations have no response.
+func (p *pooledProcessor) reject(iprot, oprot *FProtocol) error {
+	return rejectRequest(iprot, oprot, overloaded("work queue full"))
+}
+
+// rejectRequest reads the request and responds to it with the given error
+// without processing it. Cancellations have no response.
+func rejectRequest(iprot, oprot *FProtocol, ex thrift.TApplicationException) error {
+	ctx, err := iprot.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.RequestHeader(cancelHeader); ok {
+		return nil
+	}
+	name, _, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	if err := iprot.Skip(thrift.STRUCT); err != nil {
+		return err
+	}
+	if err := iprot.ReadMessageEnd(); err != nil {
+		return err
+	}
+	logger().Warnf("frugal: rejecting request with correlation id %s, %s", ctx.CorrelationID(), ex.Error())
+	iprot.recordError(ex)
+	return writeExceptionResponse(oprot, ctx, name, ex)
+}
+
+// overloaded returns the APPLICATION_EXCEPTION_SERVER_OVERLOADED error to
+// reject a request with for the given reason.
+func overloaded(reason string) thrift.TApplicationException {
+	return thrift.NewTApplicationException(APPLICATION_EXCEPTION_SERVER_OVERLOADED, "server overloaded: "+reason)
+}
+
+// waitingRequests returns the number of requests waiting for a worker.
+func (p *pooledProcessor) waitingRequests() int64 {
+	return atomic.LoadInt64(&p.waiting)
+}
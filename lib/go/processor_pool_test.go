@@ -0,0 +1,118 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingProcessor responds like headerProcessor once released.
+type blockingProcessor struct {
+	headerProcessor
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingProcessor) Process(in, out *FProtocol) error {
+	p.started <- struct{}{}
+	<-p.release
+	return p.headerProcessor.Process(in, out)
+}
+
+func processPooled(processor FProcessor, ctx FContext) (*TMemoryOutputBuffer, error) {
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	buffer := NewTMemoryOutputBuffer(0)
+	protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx)
+	proto := protocolFactory.GetProtocol(buffer)
+	proto.WriteMessageBegin("ping", thrift.CALL, 0)
+	proto.WriteStructBegin("args")
+	proto.WriteFieldStop()
+	proto.WriteStructEnd()
+	proto.WriteMessageEnd()
+	iprot := protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(buffer.Bytes()[4:])})
+	output := NewTMemoryOutputBuffer(0)
+	return output, processor.Process(iprot, protocolFactory.GetProtocol(output))
+}
+
+// Ensures requests wait for a worker and are rejected once the queue is full
+// with the reject policy.
+func TestPooledProcessorReject(t *testing.T) {
+	assert := assert.New(t)
+	processor := &blockingProcessor{started: make(chan struct{}, 2), release: make(chan struct{})}
+	pooled := newPooledProcessor(processor, 1, 1, FOverflowReject)
+
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := processPooled(pooled, NewFContext("cid"))
+			assert.Nil(err)
+			done <- struct{}{}
+		}()
+	}
+	<-processor.started
+	// Wait for the second request to queue.
+	for i := 0; i < 100 && pooled.waitingRequests() != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(int64(1), pooled.waitingRequests())
+
+	output, err := processPooled(pooled, NewFContext("cid"))
+	assert.Nil(err)
+	proto := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(output.Bytes()[4:])})
+	assert.Nil(proto.ReadResponseHeader(NewFContext("")))
+	name, typeID, _, err := proto.ReadMessageBegin()
+	assert.Nil(err)
+	assert.Equal("ping", name)
+	assert.Equal(thrift.EXCEPTION, typeID)
+	ex, err := thrift.NewTApplicationException(0, "").Read(proto)
+	assert.Nil(err)
+	assert.Equal(int32(APPLICATION_EXCEPTION_SERVER_OVERLOADED), ex.TypeId())
+
+	close(processor.release)
+	<-done
+	<-done
+}
+
+// Ensures requests wait for a worker regardless of the queue length with the
+// backpressure policy.
+func TestPooledProcessorBackpressure(t *testing.T) {
+	assert := assert.New(t)
+	processor := &blockingProcessor{started: make(chan struct{}, 3), release: make(chan struct{})}
+	pooled := newPooledProcessor(processor, 1, 0, FOverflowBackpressure)
+
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := processPooled(pooled, NewFContext("cid"))
+			assert.Nil(err)
+			done <- struct{}{}
+		}()
+	}
+	<-processor.started
+	select {
+	case <-processor.started:
+		t.Fatal("expected only one request to be processed at once")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(processor.release)
+	<-processor.started
+	<-done
+	<-done
+}
@@ -59,7 +59,7 @@ func TestFBaseProcessorHappyPath(t *testing.T) {
 	reads <- pingFrame[5:34] // FContext headers
 	reads <- pingFrame[34:]  // request body
 	mockTransport.reads = reads
-	proto := &FProtocol{thrift.NewTJSONProtocol(mockTransport)}
+	proto := NewFProtocol(thrift.NewTJSONProtocol(mockTransport))
 	processor := NewFBaseProcessor()
 	processorFunction := &pingProcessor{t: t, expectedProto: proto}
 	processor.AddToProcessorMap("ping", processorFunction)
@@ -87,7 +87,7 @@ func TestFBaseProcessorError(t *testing.T) {
 	reads <- pingFrame[5:34] // FContext headers
 	reads <- pingFrame[34:]  // request body
 	mockTransport.reads = reads
-	proto := &FProtocol{thrift.NewTJSONProtocol(mockTransport)}
+	proto := NewFProtocol(thrift.NewTJSONProtocol(mockTransport))
 	processor := NewFBaseProcessor()
 	err := errors.New("error")
 	processorFunction := &pingProcessor{t: t, expectedProto: proto, err: err}
@@ -107,7 +107,7 @@ func TestFBaseProcessorReadError(t *testing.T) {
 	mockTransport := new(mockTTransport)
 	err := errors.New("error")
 	mockTransport.readError = err
-	proto := &FProtocol{thrift.NewTJSONProtocol(mockTransport)}
+	proto := NewFProtocol(thrift.NewTJSONProtocol(mockTransport))
 	processor := NewFBaseProcessor()
 
 	err = processor.Process(proto, proto)
@@ -150,7 +150,7 @@ func TestFBaseProcessorNoProcessorFunction(t *testing.T) {
 	}
 	mockTransport.On("Write", responseBody).Return(len(responseBody), nil).Once()
 	mockTransport.On("Flush").Return(nil)
-	proto := &FProtocol{thrift.NewTJSONProtocol(mockTransport)}
+	proto := NewFProtocol(thrift.NewTJSONProtocol(mockTransport))
 	processor := NewFBaseProcessor()
 
 	assert.NoError(t, processor.Process(proto, proto))
@@ -186,7 +186,7 @@ func TestFBaseProcessorNoProcessorFunctionWriteError(t *testing.T) {
 	// so cant check for equality.
 	//responseCtx := []byte{0, 0, 0, 0, 29, 0, 0, 0, 5, 95, 111, 112, 105, 100, 0, 0, 0, 1, 48, 0, 0, 0, 4, 95, 99, 105, 100, 0, 0, 0, 3, 49, 50, 51}
 	mockTransport.On("Write", mock.Anything).Return(0, errors.New("error")).Once()
-	proto := &FProtocol{thrift.NewTJSONProtocol(mockTransport)}
+	proto := NewFProtocol(thrift.NewTJSONProtocol(mockTransport))
 	processor := NewFBaseProcessor()
 
 	assert.Error(t, processor.Process(proto, proto))
@@ -232,7 +232,7 @@ func TestFBaseProcessorNoProcessorFunctionFlushError(t *testing.T) {
 	}
 	mockTransport.On("Write", responseBody).Return(len(responseBody), nil).Once()
 	mockTransport.On("Flush").Return(errors.New("error"))
-	proto := &FProtocol{thrift.NewTJSONProtocol(mockTransport)}
+	proto := NewFProtocol(thrift.NewTJSONProtocol(mockTransport))
 	processor := NewFBaseProcessor()
 
 	assert.Error(t, processor.Process(proto, proto))
@@ -262,3 +262,52 @@ func TestFBaseProcessorAnnotations(t *testing.T) {
 	assert.Equal("baz", annoMap["foo"]["bar"])
 	assert.Equal("boom", annoMap["foo"]["boosh"])
 }
+
+type panickingProcessor struct{}
+
+func (p *panickingProcessor) Process(ctx FContext, iprot, oprot *FProtocol) error {
+	oprot.WriteResponseHeader(ctx)
+	panic("boom")
+}
+
+func (p *panickingProcessor) AddMiddleware(ServiceMiddleware) {}
+
+// Ensures FBaseProcessor recovers panics in FProcessorFunctions, logs them,
+// and responds with an INTERNAL_ERROR TApplicationException in place of any
+// partially written response.
+func TestFBaseProcessorPanic(t *testing.T) {
+	assert := assert.New(t)
+	tmpLogger := logrus.New()
+	var logBuf bytes.Buffer
+	tmpLogger.Out = &logBuf
+	oldLogger := logger()
+	SetLogger(tmpLogger)
+	defer func() {
+		SetLogger(oldLogger)
+	}()
+
+	protocolFactory := NewFProtocolFactory(thrift.NewTJSONProtocolFactory())
+	iprot := protocolFactory.GetProtocol(thrift.NewStreamTransportR(bytes.NewReader(pingFrame)))
+	output := NewTMemoryOutputBuffer(0)
+	oprot := protocolFactory.GetProtocol(output)
+	processor := NewFBaseProcessor()
+	processor.AddToProcessorMap("ping", &panickingProcessor{})
+
+	assert.Nil(processor.Process(iprot, oprot))
+	assert.Contains(logBuf.String(), "frugal: panic while processing ping on request with correlation id 123: boom")
+
+	proto := protocolFactory.GetProtocol(thrift.NewStreamTransportR(bytes.NewReader(output.Bytes()[4:])))
+	ctx := NewFContext("")
+	assert.Nil(proto.ReadResponseHeader(ctx))
+	name, typeID, _, err := proto.ReadMessageBegin()
+	assert.Nil(err)
+	assert.Equal("ping", name)
+	assert.Equal(thrift.EXCEPTION, typeID)
+	ex, err := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN, "").Read(proto)
+	assert.Nil(err)
+	assert.Equal(int32(APPLICATION_EXCEPTION_INTERNAL_ERROR), ex.TypeId())
+	assert.Equal("Internal error processing ping: boom", ex.Error())
+	assert.Nil(proto.ReadMessageEnd())
+	_, err = proto.ReadByte()
+	assert.Error(err)
+}
@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"git.apache.org/thrift.git/lib/go/thrift"
 )
@@ -42,8 +43,9 @@ type protocolMarshaler interface {
 	// marshalHeaders serializes the given headers map to a byte slice.
 	marshalHeaders(headers map[string]string) []byte
 
-	// unmarshalHeaders reads serialized headers from the reader into a map.
-	unmarshalHeaders(reader io.Reader) (map[string]string, error)
+	// unmarshalHeaders reads serialized headers from the reader into a map,
+	// enforcing the given limits.
+	unmarshalHeaders(reader io.Reader, limits HeaderLimits) (map[string]string, error)
 
 	// unmarshalHeadersFromFrame reads serialized headers from the byte slice
 	// into a map.
@@ -63,7 +65,16 @@ func getMarshaler(version byte) (protocolMarshaler, error) {
 	switch version {
 	case protocolV0:
 		return v0Marshaler, nil
+	case protocolV1:
+		return v1Marshaler, nil
+	case protocolJSONDebug:
+		return jsonDebugMarshaler, nil
+	case protocolSealed:
+		return sealedMarshaler, nil
 	default:
+		if marshaler, ok := registeredMarshaler(version); ok {
+			return marshaler, nil
+		}
 		return nil, thrift.NewTProtocolExceptionWithType(
 			thrift.BAD_VERSION, fmt.Errorf("frugal: unsupported protocol version %d", version))
 	}
@@ -76,17 +87,52 @@ func getMarshaler(version byte) (protocolMarshaler, error) {
 // any existing Thrift transports and protocols in a composable manner.
 type FProtocolFactory struct {
 	protoFactory thrift.TProtocolFactory
+	headerLimits HeaderLimits
+	marshaler    protocolMarshaler
+
+	compress             bool
+	compressionThreshold int
+	negotiator           *FFeatureNegotiator
+	envelopeKeys         FEnvelopeKeyProvider
+	envelopeEncrypt      bool
+	thriftInterop        bool
 }
 
 // NewFProtocolFactory creates a new FProtocolFactory with the given
 // TProtocolFactory.
 func NewFProtocolFactory(protoFactory thrift.TProtocolFactory) *FProtocolFactory {
-	return &FProtocolFactory{protoFactory}
+	return &FProtocolFactory{protoFactory: protoFactory}
+}
+
+// WithHeaderLimits sets the limits enforced on headers read and written by
+// FProtocols produced by this factory. Servers should use this to reject
+// requests carrying excessive headers at decode time. Returns the same
+// FProtocolFactory to allow for chaining calls.
+func (f *FProtocolFactory) WithHeaderLimits(limits HeaderLimits) *FProtocolFactory {
+	f.headerLimits = limits
+	return f
 }
 
 // GetProtocol returns a new FProtocol instance using the given TTransport.
 func (f *FProtocolFactory) GetProtocol(tr thrift.TTransport) *FProtocol {
-	return &FProtocol{f.protoFactory.GetProtocol(tr)}
+	proto := &FProtocol{
+		headerLimits: f.headerLimits,
+		marshaler:    f.marshaler,
+		negotiator:   f.negotiator,
+	}
+	if f.thriftInterop && f.envelopeKeys == nil {
+		proto.interop = &interopTransport{TTransport: tr}
+		tr = proto.interop
+	}
+	if f.envelopeKeys != nil {
+		proto.envelope = &envelopeTransport{TTransport: tr, keys: f.envelopeKeys, encrypt: f.envelopeEncrypt}
+		tr = proto.envelope
+	} else if f.compress {
+		proto.compression = &compressionTransport{TTransport: tr, threshold: f.compressionThreshold}
+		tr = proto.compression
+	}
+	proto.TProtocol = f.protoFactory.GetProtocol(tr)
+	return proto
 }
 
 // FProtocol is Frugal's equivalent of Thrift's TProtocol. It defines the
@@ -98,36 +144,102 @@ func (f *FProtocolFactory) GetProtocol(tr thrift.TTransport) *FProtocol {
 // protocol documentation for more details.
 type FProtocol struct {
 	thrift.TProtocol
+	headerLimits HeaderLimits
+	marshaler    protocolMarshaler
+	compression  *compressionTransport
+	envelope     *envelopeTransport
+	interop      *interopTransport
+	negotiator   *FFeatureNegotiator
+	outcome      *requestOutcome
+	stream       *streamSink
+	peeked       *peekedRequest
+}
+
+// NewFProtocol creates a new FProtocol wrapping the given TProtocol, without
+// the header limits or features configured on an FProtocolFactory.
+func NewFProtocol(tProtocol thrift.TProtocol) *FProtocol {
+	return &FProtocol{TProtocol: tProtocol}
 }
 
 // WriteRequestHeader writes the request headers set on the given Context
-// into the protocol
+// into the protocol. The time remaining until the request deadline, derived
+// from the context timeout, is included so the server knows when the client
+// will stop waiting. A *HeaderLimitError is returned if the headers written,
+// including those added by the protocol, exceed the limits of the context or
+// of the protocol.
 func (f *FProtocol) WriteRequestHeader(ctx FContext) error {
-	return f.writeHeader(ctx.RequestHeaders())
+	headers := ctx.RequestHeaders()
+	headers[remainingHeader] = formatRemaining(requestDeadline(ctx))
+	if f.negotiator != nil {
+		headers[featuresHeader] = f.features()
+	}
+	if err := contextHeaderLimits(ctx).check(headers); err != nil {
+		return err
+	}
+	if err := f.headerLimits.check(headers); err != nil {
+		return err
+	}
+	return f.writeHeader(headers)
 }
 
 // ReadRequestHeader reads the request headers on the protocol into a
-// returned Context
+// returned Context. A *HeaderLimitError is returned if the headers exceed the
+// limits of the protocol.
 func (f *FProtocol) ReadRequestHeader() (FContext, error) {
-	headers, err := readHeader(f.Transport())
+	request, err := f.peekRequestHeaders()
 	if err != nil {
 		return nil, err
 	}
+	f.peeked = nil
+	if request.plain {
+		return plainThriftContext(), nil
+	}
+	pairs, headers := request.pairs, request.headers
 
 	ctx := &FContextImpl{
 		requestHeaders:  make(map[string]string),
 		responseHeaders: make(map[string]string),
 	}
+	if tr, ok := f.Transport().(*ackTransport); ok {
+		ctx.ack = tr.ack
+	}
 
+	header := func(name string) (string, bool) {
+		value, ok := headers[name]
+		return value, ok
+	}
+	if pairs != nil {
+		// Only decode the headers the server needs, the rest are decoded if
+		// they are accessed.
+		ctx.setLazyRequestHeaders(pairs)
+		header = func(name string) (string, bool) {
+			return lookupV0Header(pairs, name)
+		}
+		if cid, ok := header(cidHeader); ok {
+			ctx.setRequestHeader(cidHeader, cid)
+		}
+	}
 	for name, value := range headers {
-		if name == opIDHeader {
+		if isPerHopRequestHeader(name) {
 			continue
 		}
-		ctx.AddRequestHeader(name, value)
+		ctx.setRequestHeader(name, value)
 	}
 
+	// Use the deadline sent by the client, falling back to the timeout for
+	// clients which don't send one.
+	deadline := time.Now().Add(ctx.Timeout())
+	if remainingStr, ok := header(remainingHeader); ok {
+		if d, err := parseRemaining(remainingStr); err == nil {
+			deadline = d
+		} else {
+			logger().Warnf("frugal: ignoring invalid %s header %q", remainingHeader, remainingStr)
+		}
+	}
+	ctx.setDeadline(deadline)
+
 	// Put op id in response headers
-	opid, ok := headers[opIDHeader]
+	opid, ok := header(opIDHeader)
 	if !ok {
 		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA, errors.New("frugal: request missing op id"))
 	}
@@ -135,46 +247,91 @@ func (f *FProtocol) ReadRequestHeader() (FContext, error) {
 
 	// Put a new opid in the request headers so this context
 	// can be used/propagated on the receiver
-	ctx.AddRequestHeader(opIDHeader, getNextOpID())
+	ctx.setRequestHeader(opIDHeader, getNextOpID())
 
 	cid := ctx.CorrelationID()
 	if cid != "" {
-		ctx.AddResponseHeader(cidHeader, cid)
+		ctx.setResponseHeader(cidHeader, cid)
+	}
+
+	// Tell clients negotiating features which this server supports.
+	if _, ok := header(featuresHeader); ok {
+		ctx.setResponseHeader(featuresHeader, f.features())
 	}
 
 	return ctx, nil
 }
 
 // WriteResponseHeader writes the response headers set on the given Context
-// into the protocol
+// into the protocol. Nothing is written for requests from plain Thrift
+// clients.
 func (f *FProtocol) WriteResponseHeader(ctx FContext) error {
+	if isPlainThriftContext(ctx) {
+		return nil
+	}
 	return f.writeHeader(ctx.ResponseHeaders())
 }
 
 // ReadResponseHeader reads the response headers on the protocol into a
 // provided Context
 func (f *FProtocol) ReadResponseHeader(ctx FContext) error {
-	headers, err := readHeader(f.Transport())
+	headers, err := f.readHeader()
 	if err != nil {
 		return err
 	}
 
 	for name, value := range headers {
 		// Don't want to overwrite the opid header we set for a
-		// propagated response
-		if name == opIDHeader {
+		// propagated response, or mark the context with the frame type of
+		// a streamed response.
+		if name == opIDHeader || name == streamItemHeader {
 			continue
 		}
-		ctx.AddResponseHeader(name, value)
+		setResponseHeader(ctx, name, value)
+	}
+
+	if f.negotiator != nil {
+		features, ok := headers[featuresHeader]
+		f.negotiator.negotiate(features, ok)
 	}
 
 	return nil
 }
 
+// readHeader deserializes headers from the underlying transport, enforcing
+// the protocol's limits. Compressed payloads are decompressed for the
+// TProtocol to read if compression is enabled, and sealed messages are
+// verified and opened if an envelope is.
+func (f *FProtocol) readHeader() (map[string]string, error) {
+	if f.envelope != nil {
+		return f.envelope.readHeader(f.headerLimits)
+	}
+	if f.compression != nil {
+		return f.compression.readHeader(f.headerLimits)
+	}
+	return readHeaderWithLimits(f.Transport(), f.headerLimits)
+}
+
 // writeHeader serializes the headers and writes them to the underlying
-// transport.
+// transport. Headers are written with the protocol's marshaler if it has one,
+// otherwise with the default header protocol version. If compression is
+// enabled, the message is buffered until Flush so the headers can indicate
+// whether the payload is compressed. If an envelope is, the message is
+// buffered until Flush so it can be sealed.
 func (f *FProtocol) writeHeader(headers map[string]string) error {
-	buff := writeMarshaler.marshalHeaders(headers)
+	if f.envelope != nil {
+		f.envelope.bufferMessage(headers)
+		return nil
+	}
+	marshaler := f.marshaler
+	if marshaler == nil {
+		if f.compression != nil && (f.negotiator == nil || f.negotiator.Supports(FeatureCompression)) {
+			f.compression.bufferMessage(v0Marshaler.marshalHeaders(headers))
+			return nil
+		}
+		marshaler = writeMarshaler
+	}
+	buff := marshaler.marshalHeaders(headers)
 	if n, err := f.Transport().Write(buff); err != nil {
 		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
 			fmt.Sprintf("frugal: error writing protocol headers in writeHeader: %s", err))
@@ -186,23 +343,60 @@ func (f *FProtocol) writeHeader(headers map[string]string) error {
 	return nil
 }
 
+// writeEncoded writes the given messages, encoded by another protocol from
+// the same FProtocolFactory, to the transport underneath any the protocol
+// wraps it with, then flushes it.
+func (f *FProtocol) writeEncoded(data []byte) error {
+	tr := f.Transport()
+	switch {
+	case f.interop != nil:
+		tr = f.interop.TTransport
+	case f.envelope != nil:
+		tr = f.envelope.TTransport
+	case f.compression != nil:
+		tr = f.compression.TTransport
+	}
+	if len(data) > 0 {
+		if _, err := tr.Write(data); err != nil {
+			return thrift.NewTTransportExceptionFromError(err)
+		}
+	}
+	return tr.Flush()
+}
+
 // readHeader deserializes headers from the given Reader.
 func readHeader(reader io.Reader) (map[string]string, error) {
-	buff := make([]byte, 1)
-	if _, err := io.ReadFull(reader, buff); err != nil {
-		if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
-			return nil, err
-		}
-		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
-			fmt.Sprintf("frugal: error reading protocol headers in readHeader: %s", err))
+	return readHeaderWithLimits(reader, HeaderLimits{})
+}
+
+// readHeaderWithLimits deserializes headers from the given Reader, enforcing
+// the given limits.
+func readHeaderWithLimits(reader io.Reader, limits HeaderLimits) (map[string]string, error) {
+	version, err := readProtocolVersion(reader)
+	if err != nil {
+		return nil, err
 	}
 
-	marshaler, err := getMarshaler(buff[0])
+	marshaler, err := getMarshaler(version)
 	if err != nil {
 		return nil, err
 	}
 
-	return marshaler.unmarshalHeaders(reader)
+	return marshaler.unmarshalHeaders(reader, limits)
+}
+
+// readProtocolVersion reads the header protocol version byte from the given
+// Reader.
+func readProtocolVersion(reader io.Reader) (byte, error) {
+	buff := make([]byte, 1)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
+			return 0, err
+		}
+		return 0, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: error reading protocol headers in readHeader: %s", err))
+	}
+	return buff[0], nil
 }
 
 // getHeadersFromFrame deserializes headers from the frame into a map.
@@ -298,8 +492,27 @@ func (v *v0ProtocolMarshaler) marshalHeaders(headers map[string]string) []byte {
 	return buff
 }
 
-// unmarshalHeaders reads headers from the reader into a map.
-func (v *v0ProtocolMarshaler) unmarshalHeaders(reader io.Reader) (map[string]string, error) {
+// unmarshalHeaders reads headers from the reader into a map, enforcing the
+// given limits. The size limit is checked before the headers are read.
+func (v *v0ProtocolMarshaler) unmarshalHeaders(reader io.Reader, limits HeaderLimits) (map[string]string, error) {
+	buff, err := v.readHeaderBytes(reader, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := v.readPairs(buff, 0, int32(len(buff)))
+	if err != nil {
+		return nil, err
+	}
+	if err := limits.check(headers); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// readHeaderBytes reads the serialized header pairs from the reader without
+// decoding them. The size limit is checked before the headers are read.
+func (v *v0ProtocolMarshaler) readHeaderBytes(reader io.Reader, limits HeaderLimits) ([]byte, error) {
 	buff := make([]byte, 4)
 	if _, err := io.ReadFull(reader, buff); err != nil {
 		if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
@@ -309,16 +522,18 @@ func (v *v0ProtocolMarshaler) unmarshalHeaders(reader io.Reader) (map[string]str
 			fmt.Sprintf("frugal: error reading protocol headers in unmarshalHeaders reading header size: %s", err))
 	}
 	size := int32(binary.BigEndian.Uint32(buff))
-	buff = make([]byte, size)
-	if _, err := io.ReadFull(reader, buff); err != nil {
+	if limits.MaxSize > 0 && (size < 0 || int(size) > limits.MaxSize) {
+		return nil, &HeaderLimitError{Size: int(size), Limits: limits}
+	}
+	buff, err := readBytes(reader, int(size))
+	if err != nil {
 		if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
 			return nil, err
 		}
 		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
 			fmt.Sprintf("frugal: error reading protocol headers in unmarshalHeaders reading headers: %s", err))
 	}
-
-	return v.readPairs(buff, 0, size)
+	return buff, nil
 }
 
 // unmarshalHeadersFromFrame reads serialized headers from the byte slice into
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"strconv"
 	"testing"
+	"time"
 
 	"git.apache.org/thrift.git/lib/go/thrift"
 	"github.com/stretchr/testify/assert"
@@ -52,7 +53,7 @@ var (
 func TestReadRequestHeaderMissingOpID(t *testing.T) {
 	assert := assert.New(t)
 	transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(basicFrame)}
-	proto := &FProtocol{tProtocolFactory.GetProtocol(transport)}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(transport))
 
 	expectedErr := thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA, errors.New("frugal: request missing op id"))
 	_, err := proto.ReadRequestHeader()
@@ -64,7 +65,7 @@ func TestReadRequestHeaderMissingOpID(t *testing.T) {
 func TestReadRequestHeader(t *testing.T) {
 	assert := assert.New(t)
 	transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frugalFrame)}
-	proto := &FProtocol{tProtocolFactory.GetProtocol(transport)}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(transport))
 
 
 	ctx, err := proto.ReadRequestHeader()
@@ -86,7 +87,7 @@ func TestReadRequestHeader(t *testing.T) {
 func TestReadResponseHeader(t *testing.T) {
 	assert := assert.New(t)
 	transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(basicFrame)}
-	proto := &FProtocol{tProtocolFactory.GetProtocol(transport)}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(transport))
 
 	ctx := NewFContext("")
 	proto.ReadResponseHeader(ctx)
@@ -101,7 +102,7 @@ func TestWriteHeaderErroredWrite(t *testing.T) {
 	mft := &mockFTransport{}
 	writeErr := errors.New("write failed")
 	mft.On("Write", basicFrame).Return(0, writeErr)
-	proto := &FProtocol{tProtocolFactory.GetProtocol(mft)}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(mft))
 	expectedErr := thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
 		fmt.Sprintf("frugal: error writing protocol headers in writeHeader: %s", writeErr))
 	assert.Equal(expectedErr, proto.writeHeader(basicHeaders))
@@ -114,7 +115,7 @@ func TestWriteHeaderBadWrite(t *testing.T) {
 	assert := assert.New(t)
 	mft := &mockFTransport{}
 	mft.On("Write", basicFrame).Return(0, nil)
-	proto := &FProtocol{tProtocolFactory.GetProtocol(mft)}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(mft))
 	expectedErr := thrift.NewTTransportException(thrift.UNKNOWN_PROTOCOL_EXCEPTION, "frugal: failed to write complete protocol headers")
 	assert.Equal(expectedErr, proto.writeHeader(basicHeaders))
 	mft.AssertExpectations(t)
@@ -125,7 +126,7 @@ func TestWriteHeader(t *testing.T) {
 	assert := assert.New(t)
 	mft := &mockFTransport{}
 	mft.On("Write", basicFrame).Return(len(basicFrame), nil)
-	proto := &FProtocol{tProtocolFactory.GetProtocol(mft)}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(mft))
 	assert.Nil(proto.writeHeader(basicHeaders))
 	mft.AssertExpectations(t)
 }
@@ -135,7 +136,7 @@ func TestWriteHeader(t *testing.T) {
 func TestWriteReadRequestHeader(t *testing.T) {
 	assert := assert.New(t)
 	transport := &thrift.TMemoryBuffer{Buffer: &bytes.Buffer{}}
-	proto := &FProtocol{tProtocolFactory.GetProtocol(transport)}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(transport))
 	ctx := NewFContext("123")
 	origOpID, err := getOpID(ctx)
 	assert.Nil(err)
@@ -166,12 +167,85 @@ func TestWriteReadRequestHeader(t *testing.T) {
 	assert.Equal(origOpID, respOpIDUint)
 }
 
+// Ensures WriteRequestHeader sends the time remaining until the request
+// deadline and ReadRequestHeader exposes the deadline on the received
+// FContext without leaking it into the headers.
+func TestWriteReadRequestHeaderDeadline(t *testing.T) {
+	assert := assert.New(t)
+	transport := &thrift.TMemoryBuffer{Buffer: &bytes.Buffer{}}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(transport))
+	ctx := NewFContext("123")
+	ctx.SetTimeout(time.Minute)
+	_, ok := ctx.Deadline()
+	assert.False(ok)
+
+	before := time.Now().Add(time.Minute - time.Millisecond)
+	assert.Nil(proto.WriteRequestHeader(ctx))
+	_, ok = ctx.RequestHeader(remainingHeader)
+	assert.False(ok)
+	headers, err := getHeadersFromFrame(transport.Bytes())
+	assert.Nil(err)
+	remaining, err := strconv.ParseInt(headers[remainingHeader], 10, 64)
+	assert.Nil(err)
+	assert.True(remaining > 59000 && remaining <= 60000)
+
+	ctx, err = proto.ReadRequestHeader()
+	assert.Nil(err)
+	after := time.Now().Add(time.Minute)
+	deadline, ok := ctx.Deadline()
+	assert.True(ok)
+	assert.False(deadline.Before(before))
+	assert.False(deadline.After(after))
+	_, ok = ctx.RequestHeader(remainingHeader)
+	assert.False(ok)
+
+	// Propagating the context should not extend the deadline.
+	ctx.SetTimeout(time.Hour)
+	assert.Nil(proto.WriteRequestHeader(ctx))
+	propagated, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	propagatedDeadline, ok := propagated.Deadline()
+	assert.True(ok)
+	assert.False(propagatedDeadline.After(deadline.Add(time.Millisecond)))
+	assert.True(propagatedDeadline.After(deadline.Add(-time.Second)))
+}
+
+// Ensures a time remaining which is invalid is ignored in favor of the
+// timeout, and one which has run out gives a deadline which has passed.
+func TestParseRemaining(t *testing.T) {
+	assert := assert.New(t)
+	_, err := parseRemaining("abc")
+	assert.Error(err)
+	_, err = parseRemaining("-1")
+	assert.Error(err)
+	deadline, err := parseRemaining("0")
+	assert.Nil(err)
+	assert.False(deadline.After(time.Now()))
+	assert.Equal("0", formatRemaining(time.Now().Add(-time.Second)))
+}
+
+// Ensures ReadRequestHeader derives a deadline from the timeout when the
+// client did not send one.
+func TestReadRequestHeaderNoDeadline(t *testing.T) {
+	assert := assert.New(t)
+	transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frugalFrame)}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(transport))
+
+	before := time.Now().Add(defaultTimeout)
+	ctx, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	deadline, ok := ctx.Deadline()
+	assert.True(ok)
+	assert.False(deadline.Before(before))
+	assert.False(deadline.After(time.Now().Add(defaultTimeout)))
+}
+
 // Ensures WriteResponseHeader properly encodes header bytes and
 // ReadResponseHeader properly decodes them.
 func TestWriteReadResponseHeader(t *testing.T) {
 	assert := assert.New(t)
 	transport := &thrift.TMemoryBuffer{Buffer: &bytes.Buffer{}}
-	proto := &FProtocol{tProtocolFactory.GetProtocol(transport)}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(transport))
 	ctx := NewFContext("123")
 	origOpID, err := getOpID(ctx)
 	assert.Nil(err)
@@ -208,8 +282,8 @@ func TestReadHeaderTransportError(t *testing.T) {
 // encoding version.
 func TestReadHeaderUnsupportedVersion(t *testing.T) {
 	assert := assert.New(t)
-	transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer([]byte{0x01, 0, 0, 0, 0})}
-	expectedErr := thrift.NewTProtocolExceptionWithType(thrift.BAD_VERSION, errors.New("frugal: unsupported protocol version 1"))
+	transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer([]byte{0x02, 0, 0, 0, 0})}
+	expectedErr := thrift.NewTProtocolExceptionWithType(thrift.BAD_VERSION, errors.New("frugal: unsupported protocol version 2"))
 	_, err := readHeader(transport)
 	assert.Equal(expectedErr, err)
 }
@@ -245,8 +319,8 @@ func TestGetHeadersFromFrameInvalidSize(t *testing.T) {
 // frame encoding version.
 func TestGetHeadersFromFrameUnsupportedVersion(t *testing.T) {
 	assert := assert.New(t)
-	expectedErr := thrift.NewTProtocolExceptionWithType(thrift.BAD_VERSION, errors.New("frugal: unsupported protocol version 1"))
-	_, err := getHeadersFromFrame([]byte{0x01, 0, 0, 0, 0})
+	expectedErr := thrift.NewTProtocolExceptionWithType(thrift.BAD_VERSION, errors.New("frugal: unsupported protocol version 2"))
+	_, err := getHeadersFromFrame([]byte{0x02, 0, 0, 0, 0})
 	assert.Equal(expectedErr, err)
 }
 
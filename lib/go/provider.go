@@ -22,6 +22,7 @@ type FScopeProvider struct {
 	subscriberTransportFactory FSubscriberTransportFactory
 	protocolFactory            *FProtocolFactory
 	middleware                 []ServiceMiddleware
+	deadLetter                 *FDeadLetterPolicy
 }
 
 // NewFScopeProvider creates a new FScopeProvider using the given factories.
@@ -46,6 +47,9 @@ func (p *FScopeProvider) NewPublisher() (FPublisherTransport, *FProtocolFactory)
 // scope subscribers.
 func (p *FScopeProvider) NewSubscriber() (FSubscriberTransport, *FProtocolFactory) {
 	transport := p.subscriberTransportFactory.GetTransport()
+	if p.deadLetter != nil {
+		transport = newDeadLetterSubscriberTransport(transport, *p.deadLetter, p)
+	}
 	return transport, p.protocolFactory
 }
 
@@ -75,6 +79,20 @@ func NewFServiceProvider(transport FTransport, protocolFactory *FProtocolFactory
 	}
 }
 
+// WithObserver reports every call made by clients created with the
+// FServiceProvider afterwards to the given observer, including its latency,
+// the sizes of its request and response, and the class of any error. The
+// observer sees calls as made by the application, so calls are timed
+// including any other middleware. This wraps the contained FTransport, so
+// GetTransport no longer returns the FTransport the FServiceProvider was
+// created with. Returns the FServiceProvider for chaining.
+func (f *FServiceProvider) WithObserver(observer FClientObserver) *FServiceProvider {
+	calls := newCallObserver(observer)
+	f.transport = &observedTransport{FTransport: f.transport, calls: calls}
+	f.middleware = append(f.middleware, calls.middleware)
+	return f
+}
+
 // GetTransport returns the contained FTransport.
 func (f *FServiceProvider) GetTransport() FTransport {
 	return f.transport
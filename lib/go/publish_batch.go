@@ -0,0 +1,169 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// FBatchMessage is a frame to publish to a topic as part of a batch.
+type FBatchMessage struct {
+	// Topic is the topic to publish the frame to.
+	Topic string
+
+	// Frame is the frame to publish, including its frame size.
+	Frame []byte
+}
+
+// FBatchPublisherTransport is an FPublisherTransport which can deliver a batch
+// of messages in one broker operation, avoiding the overhead of publishing
+// each on its own.
+type FBatchPublisherTransport interface {
+	FPublisherTransport
+
+	// PublishBatch publishes the given messages, returning nil if they were
+	// all published, or an *FBatchPublishError reporting the error of each
+	// message which wasn't.
+	PublishBatch(messages []FBatchMessage) error
+}
+
+// FBatchPublishError is returned when some messages of a batch fail to be
+// published.
+type FBatchPublishError struct {
+	// Errors holds the error publishing each message of the batch, in
+	// order, which is nil for the messages that were published.
+	Errors []error
+}
+
+// newBatchPublishError returns an *FBatchPublishError with the given errors,
+// or nil if none of them are set.
+func newBatchPublishError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return &FBatchPublishError{Errors: errs}
+		}
+	}
+	return nil
+}
+
+// Error returns the number of messages which failed and the first error.
+func (e *FBatchPublishError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errors {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("frugal: %d of %d messages failed to publish: %s", failed, len(e.Errors), first)
+}
+
+// PublishBatch publishes the given messages with the given FPublisherTransport,
+// in one broker operation if it's an FBatchPublisherTransport, and one at a
+// time otherwise. Returns nil if the messages were all published, or an
+// *FBatchPublishError reporting the error of each message which wasn't.
+func PublishBatch(transport FPublisherTransport, messages []FBatchMessage) error {
+	if batcher, ok := transport.(FBatchPublisherTransport); ok {
+		return batcher.PublishBatch(messages)
+	}
+	errs := make([]error, len(messages))
+	for i, message := range messages {
+		errs[i] = transport.Publish(message.Topic, message.Frame)
+	}
+	return newBatchPublishError(errs)
+}
+
+// FPublishBatcher is an FPublisherTransport which collects the frames
+// published with it, such as by generated scope publishers, until they're
+// delivered together by Flush. It's also an FPublisherTransportFactory which
+// returns itself, so it can be given to an FScopeProvider to batch the events
+// of the publishers created with it. Frames must not be modified once
+// published. FPublishBatcher is safe for concurrent use.
+type FPublishBatcher struct {
+	transport FPublisherTransport
+	mu        sync.Mutex
+	pending   []FBatchMessage
+}
+
+// NewFPublishBatcher creates a new FPublishBatcher delivering batches with
+// the given FPublisherTransport.
+func NewFPublishBatcher(transport FPublisherTransport) *FPublishBatcher {
+	return &FPublishBatcher{transport: transport}
+}
+
+// GetTransport returns the FPublishBatcher.
+func (b *FPublishBatcher) GetTransport() FPublisherTransport {
+	return b
+}
+
+// Open opens the underlying transport.
+func (b *FPublishBatcher) Open() error {
+	return b.transport.Open()
+}
+
+// Close closes the underlying transport. Pending frames aren't published.
+func (b *FPublishBatcher) Close() error {
+	return b.transport.Close()
+}
+
+// IsOpen returns true if the underlying transport is open, false otherwise.
+func (b *FPublishBatcher) IsOpen() bool {
+	return b.transport.IsOpen()
+}
+
+// GetPublishSizeLimit returns the maximum allowable size of a payload
+// to be published by the underlying transport.
+func (b *FPublishBatcher) GetPublishSizeLimit() uint {
+	return b.transport.GetPublishSizeLimit()
+}
+
+// Publish adds the given frame to the pending batch.
+func (b *FPublishBatcher) Publish(topic string, data []byte) error {
+	if !b.transport.IsOpen() {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: FPublishBatcher transport not open")
+	}
+	b.mu.Lock()
+	b.pending = append(b.pending, FBatchMessage{Topic: topic, Frame: data})
+	b.mu.Unlock()
+	return nil
+}
+
+// Pending returns the number of frames waiting to be published.
+func (b *FPublishBatcher) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pending)
+}
+
+// Flush publishes the pending frames as one batch. Returns nil if they were
+// all published, or an *FBatchPublishError reporting the error of each frame,
+// in the order they were published, which wasn't. Frames which fail aren't
+// retried by later flushes.
+func (b *FPublishBatcher) Flush() error {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	return PublishBatch(b.transport, pending)
+}
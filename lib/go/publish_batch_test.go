@@ -0,0 +1,147 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// batchingKafka is a mockKafka which sends batches of records, failing those
+// with the value "fail".
+type batchingKafka struct {
+	*mockKafka
+	batches int
+}
+
+func (b *batchingKafka) ProduceBatch(records []FKafkaRecord) []error {
+	b.mu.Lock()
+	b.batches++
+	b.mu.Unlock()
+	errs := make([]error, len(records))
+	for i, record := range records {
+		if string(record.Value[4:]) == "fail" {
+			errs[i] = errors.New("rejected")
+			continue
+		}
+		errs[i] = b.Produce(record.Topic, record.Key, record.Value)
+	}
+	return errs
+}
+
+// Ensures frames published with an FPublishBatcher are held until flushed,
+// then delivered in one batch reporting the error of each frame.
+func TestFPublishBatcherKafka(t *testing.T) {
+	assert := assert.New(t)
+	kafka := &batchingKafka{mockKafka: newMockKafka()}
+	batcher := NewFPublishBatcher(NewFKafkaPublisherTransportFactoryBuilder(kafka).
+		WithPublishSizeLimit(16).
+		WithPartitionKeyHeader("tenant").
+		Build().
+		GetTransport())
+	assert.Equal(batcher, batcher.GetTransport())
+	assert.Error(batcher.Publish("foo", []byte{0, 0, 0, 1, 1}))
+	assert.Nil(batcher.Open())
+	assert.True(batcher.IsOpen())
+	assert.Equal(uint(16), batcher.GetPublishSizeLimit())
+
+	ok := []byte{0, 0, 0, 2, 'o', 'k'}
+	assert.Nil(batcher.Publish("foo", ok))
+	assert.Nil(batcher.Publish("bar", []byte{0, 0, 0, 4, 'f', 'a', 'i', 'l'}))
+	assert.Nil(batcher.Publish("foo", make([]byte, 17)))
+	assert.Equal(3, batcher.Pending())
+	assert.Empty(kafka.produced)
+
+	err := batcher.Flush()
+	batchErr, isBatchErr := err.(*FBatchPublishError)
+	if assert.True(isBatchErr) {
+		assert.Len(batchErr.Errors, 3)
+		assert.Nil(batchErr.Errors[0])
+		assert.Equal("rejected", batchErr.Errors[1].Error())
+		assert.Equal(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, batchErr.Errors[2].(thrift.TTransportException).TypeId())
+		assert.Equal("frugal: 2 of 3 messages failed to publish: rejected", err.Error())
+	}
+	assert.Equal(1, kafka.batches)
+	if assert.Len(kafka.produced, 1) {
+		assert.Equal(kafkaMessage{topic: "foo", value: ok}, kafka.produced[0])
+	}
+	assert.Equal(0, batcher.Pending())
+	assert.Nil(batcher.Flush())
+	assert.Equal(1, kafka.batches)
+	assert.Nil(batcher.Close())
+}
+
+// Ensures batches are published one message at a time by transports which
+// don't support batching.
+func TestPublishBatchFallback(t *testing.T) {
+	assert := assert.New(t)
+	kafka := newMockKafka()
+	publisher := NewFKafkaPublisherTransportFactoryBuilder(kafka).Build().GetTransport()
+	messages := []FBatchMessage{{Topic: "foo", Frame: []byte{0, 0, 0, 1, 1}}, {Topic: "bar", Frame: []byte{0, 0, 0, 1, 2}}}
+	err := PublishBatch(publisher, messages)
+	assert.Len(err.(*FBatchPublishError).Errors, 2)
+	assert.Empty(kafka.produced)
+
+	assert.Nil(publisher.Open())
+	assert.Nil(PublishBatch(publisher, messages))
+	assert.Len(kafka.produced, 2)
+}
+
+// Ensures NATS batches are delivered and oversized messages reported.
+func TestNatsPublisherPublishBatch(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	received := make(chan *nats.Msg, 2)
+	sub, err := conn.ChanSubscribe(frugalPrefix+"foo", received)
+	assert.Nil(err)
+	defer sub.Unsubscribe()
+	assert.Nil(conn.Flush())
+
+	publisher := NewNatsFPublisherTransport(conn)
+	assert.Nil(publisher.Open())
+	err = PublishBatch(publisher, []FBatchMessage{
+		{Topic: "foo", Frame: []byte{0, 0, 0, 1, 1}},
+		{Topic: "foo", Frame: make([]byte, natsMaxMessageSize+1)},
+		{Topic: "foo", Frame: []byte{0, 0, 0, 1, 2}},
+	})
+	errs := err.(*FBatchPublishError).Errors
+	assert.Nil(errs[0])
+	assert.Equal(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, errs[1].(thrift.TTransportException).TypeId())
+	assert.Nil(errs[2])
+	for _, expected := range []byte{1, 2} {
+		select {
+		case msg := <-received:
+			assert.Equal([]byte{0, 0, 0, 1, expected}, msg.Data)
+		case <-time.After(time.Second):
+			t.Fatal("expected message")
+		}
+	}
+
+	conn.Close()
+	err = PublishBatch(publisher, []FBatchMessage{{Topic: "foo", Frame: []byte{0, 0, 0, 1, 1}}})
+	assert.Equal(TRANSPORT_EXCEPTION_NOT_OPEN, err.(*FBatchPublishError).Errors[0].(thrift.TTransportException).TypeId())
+}
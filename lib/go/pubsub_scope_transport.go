@@ -0,0 +1,329 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// pubSubMaxMessageSize is the default maximum size of published Pub/Sub
+	// messages, the service's limit.
+	pubSubMaxMessageSize = 10 * 1024 * 1024
+
+	pubSubReceiveRetryDelay = time.Second
+)
+
+// FPubSubPublisher publishes messages to Google Cloud Pub/Sub topics. Frugal
+// doesn't depend on the Pub/Sub client, so implement it by wrapping a
+// pubsub.Client, enabling message ordering on its topics.
+type FPubSubPublisher interface {
+	// Publish sends the given data to the topic with the given id, returning
+	// once the message has been acknowledged by the service. Messages with
+	// the same non-empty ordering key are delivered in the order they are
+	// published.
+	Publish(ctx context.Context, topic string, data []byte, orderingKey string) error
+}
+
+// FPubSubReceiveSettings controls the flow of messages to a subscriber.
+type FPubSubReceiveSettings struct {
+	// MaxOutstandingMessages limits the number of messages being handled at
+	// once. Zero uses the client's default.
+	MaxOutstandingMessages int
+
+	// MaxOutstandingBytes limits the total size of the messages being
+	// handled at once. Zero uses the client's default.
+	MaxOutstandingBytes int
+
+	// NumGoroutines is the number of goroutines pulling messages. Zero uses
+	// the client's default.
+	NumGoroutines int
+}
+
+// FPubSubReceiver receives messages from Google Cloud Pub/Sub subscriptions.
+// Frugal doesn't depend on the Pub/Sub client, so implement it by wrapping a
+// pubsub.Subscription's Receive.
+type FPubSubReceiver interface {
+	// Receive calls the handler with the data of each message received from
+	// the subscription with the given id, applying the given flow control
+	// settings, until the context is cancelled. Messages should be acked
+	// when the handler returns nil and nacked, so they are redelivered,
+	// otherwise.
+	Receive(ctx context.Context, subscription string, settings FPubSubReceiveSettings, handler func(data []byte) error) error
+}
+
+// defaultPubSubTopicMapper publishes scopes to topics named like the NATS
+// subjects they would be published to.
+func defaultPubSubTopicMapper(topic string) string {
+	return frugalPrefix + topic
+}
+
+// FPubSubPublisherTransportFactoryBuilder configures and builds factories of
+// FPublisherTransports publishing to Google Cloud Pub/Sub.
+type FPubSubPublisherTransportFactoryBuilder struct {
+	publisher        FPubSubPublisher
+	orderingHeader   string
+	topicMapper      func(string) string
+	publishSizeLimit uint
+}
+
+// NewFPubSubPublisherTransportFactoryBuilder creates a builder which
+// configures and builds factories of FPublisherTransports publishing with the
+// given publisher. By default, a scope topic is published to the Pub/Sub
+// topic with the id "frugal." followed by the scope topic, the subject it is
+// published to with NATS, so switching a provider between the two needs no
+// other changes.
+func NewFPubSubPublisherTransportFactoryBuilder(publisher FPubSubPublisher) *FPubSubPublisherTransportFactoryBuilder {
+	return &FPubSubPublisherTransportFactoryBuilder{
+		publisher:        publisher,
+		topicMapper:      defaultPubSubTopicMapper,
+		publishSizeLimit: pubSubMaxMessageSize,
+	}
+}
+
+// WithOrderingKeyHeader uses the value of the given FContext request header
+// as the ordering key of published messages, so messages with the same
+// value, such as an entity id, are delivered in order. Messages published
+// without the header are unordered.
+func (p *FPubSubPublisherTransportFactoryBuilder) WithOrderingKeyHeader(header string) *FPubSubPublisherTransportFactoryBuilder {
+	p.orderingHeader = header
+	return p
+}
+
+// WithTopicMapper sets how scope topics are mapped to Pub/Sub topic ids.
+func (p *FPubSubPublisherTransportFactoryBuilder) WithTopicMapper(mapper func(string) string) *FPubSubPublisherTransportFactoryBuilder {
+	p.topicMapper = mapper
+	return p
+}
+
+// WithPublishSizeLimit sets the maximum size of published messages. Defaults
+// to 10MB.
+func (p *FPubSubPublisherTransportFactoryBuilder) WithPublishSizeLimit(limit uint) *FPubSubPublisherTransportFactoryBuilder {
+	p.publishSizeLimit = limit
+	return p
+}
+
+// Build a new configured Pub/Sub FPublisherTransportFactory.
+func (p *FPubSubPublisherTransportFactoryBuilder) Build() FPublisherTransportFactory {
+	return &fPubSubPublisherTransportFactory{
+		publisher:        p.publisher,
+		orderingHeader:   p.orderingHeader,
+		topicMapper:      p.topicMapper,
+		publishSizeLimit: p.publishSizeLimit,
+	}
+}
+
+type fPubSubPublisherTransportFactory struct {
+	publisher        FPubSubPublisher
+	orderingHeader   string
+	topicMapper      func(string) string
+	publishSizeLimit uint
+}
+
+// GetTransport creates a new Pub/Sub FPublisherTransport.
+func (p *fPubSubPublisherTransportFactory) GetTransport() FPublisherTransport {
+	return &fPubSubPublisherTransport{fPubSubPublisherTransportFactory: p}
+}
+
+// fPubSubPublisherTransport implements FPublisherTransport.
+type fPubSubPublisherTransport struct {
+	*fPubSubPublisherTransportFactory
+	mu     sync.RWMutex
+	isOpen bool
+}
+
+// Open initializes the transport.
+func (p *fPubSubPublisherTransport) Open() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.isOpen = true
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (p *fPubSubPublisherTransport) IsOpen() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.isOpen
+}
+
+// Close closes the transport. The publisher is owned by the caller and is not
+// closed.
+func (p *fPubSubPublisherTransport) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.isOpen = false
+	return nil
+}
+
+// GetPublishSizeLimit returns the maximum allowable size of a payload
+// to be published. A non-positive number is returned to indicate an
+// unbounded allowable size.
+func (p *fPubSubPublisherTransport) GetPublishSizeLimit() uint {
+	return p.publishSizeLimit
+}
+
+// Publish sends the given frame to the Pub/Sub topic for the given scope
+// topic, ordered by the configured ordering key header.
+func (p *fPubSubPublisherTransport) Publish(topic string, data []byte) error {
+	if !p.IsOpen() {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: Pub/Sub FPublisherTransport not open")
+	}
+	if limit := p.publishSizeLimit; limit > 0 && uint(len(data)) > limit {
+		return thrift.NewTTransportException(
+			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", limit, len(data)))
+	}
+	err := p.publisher.Publish(context.Background(), p.topicMapper(topic), data, p.orderingKey(data))
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	return nil
+}
+
+// orderingKey returns the value of the ordering key header in the given
+// frame, or "" if it isn't set.
+func (p *fPubSubPublisherTransport) orderingKey(frame []byte) string {
+	if p.orderingHeader == "" || len(frame) < 4 {
+		return ""
+	}
+	headers, err := getHeadersFromFrame(frame[4:])
+	if err != nil {
+		return ""
+	}
+	return headers[p.orderingHeader]
+}
+
+// FPubSubSubscriberTransportFactory creates Pub/Sub FSubscriberTransports.
+type FPubSubSubscriberTransportFactory struct {
+	receiver           FPubSubReceiver
+	subscriptionMapper func(string) string
+	settings           FPubSubReceiveSettings
+}
+
+// NewFPubSubSubscriberTransportFactory creates an
+// FPubSubSubscriberTransportFactory whose transports receive with the given
+// receiver from the Pub/Sub subscription ids the given mapper returns for
+// scope topics. Each subscription should be attached to the topic the scope
+// is published to. As with NATS queues, subscribers sharing a subscription
+// share its messages, so give each subscriber which should receive every
+// message its own subscription.
+func NewFPubSubSubscriberTransportFactory(receiver FPubSubReceiver, subscriptionMapper func(string) string) *FPubSubSubscriberTransportFactory {
+	return &FPubSubSubscriberTransportFactory{receiver: receiver, subscriptionMapper: subscriptionMapper}
+}
+
+// WithReceiveSettings sets the flow control settings applied to receives,
+// such as to bound the memory used by a subscriber.
+func (p *FPubSubSubscriberTransportFactory) WithReceiveSettings(settings FPubSubReceiveSettings) *FPubSubSubscriberTransportFactory {
+	p.settings = settings
+	return p
+}
+
+// GetTransport creates a new Pub/Sub FSubscriberTransport.
+func (p *FPubSubSubscriberTransportFactory) GetTransport() FSubscriberTransport {
+	return &fPubSubSubscriberTransport{
+		receiver:           p.receiver,
+		subscriptionMapper: p.subscriptionMapper,
+		settings:           p.settings,
+	}
+}
+
+// fPubSubSubscriberTransport implements FSubscriberTransport.
+type fPubSubSubscriberTransport struct {
+	receiver           FPubSubReceiver
+	subscriptionMapper func(string) string
+	settings           FPubSubReceiveSettings
+
+	mu      sync.RWMutex
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// Subscribe starts receiving messages for the given topic.
+func (p *fPubSubSubscriberTransport) Subscribe(topic string, callback FAsyncCallback) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: Pub/Sub transport already open")
+	}
+	if topic == "" {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"cannot subscribe to empty topic")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.stopped = make(chan struct{})
+	go p.receive(ctx, p.subscriptionMapper(topic), callback, p.stopped)
+	return nil
+}
+
+// receive receives messages from the given subscription until the context is
+// cancelled, retrying if receiving fails.
+func (p *fPubSubSubscriberTransport) receive(ctx context.Context, subscription string, callback FAsyncCallback, stopped chan struct{}) {
+	defer close(stopped)
+	handler := handlePubSubMessage(callback)
+	for {
+		err := p.receiver.Receive(ctx, subscription, p.settings, handler)
+		if ctx.Err() != nil {
+			return
+		}
+		logger().Warnf("frugal: error receiving from Pub/Sub subscription %s, retrying: %v", subscription, err)
+		select {
+		case <-time.After(pubSubReceiveRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handlePubSubMessage returns a handler executing the callback for each
+// received frame. Callback errors are returned so the message is nacked.
+func handlePubSubMessage(callback FAsyncCallback) func([]byte) error {
+	return func(data []byte) error {
+		if len(data) < 4 {
+			logger().Warn("frugal: Discarding invalid scope message frame")
+			return nil
+		}
+		return invokeAcked(callback, data[4:])
+	}
+}
+
+// IsSubscribed returns true if the transport is subscribed to a topic, false
+// otherwise.
+func (p *fPubSubSubscriberTransport) IsSubscribed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cancel != nil
+}
+
+// Unsubscribe stops receiving messages, waiting for the receive to return.
+func (p *fPubSubSubscriberTransport) Unsubscribe() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel == nil {
+		return nil
+	}
+	p.cancel()
+	<-p.stopped
+	p.cancel = nil
+	return nil
+}
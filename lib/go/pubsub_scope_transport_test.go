@@ -0,0 +1,152 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+type pubSubMessage struct {
+	topic, orderingKey string
+	data               []byte
+}
+
+// mockPubSub is an in-memory FPubSubPublisher and FPubSubReceiver with one
+// subscription per topic.
+type mockPubSub struct {
+	mu        sync.Mutex
+	published []pubSubMessage
+	settings  FPubSubReceiveSettings
+	messages  chan pubSubMessage
+	nacked    chan []byte
+	failures  int
+}
+
+func newMockPubSub() *mockPubSub {
+	return &mockPubSub{messages: make(chan pubSubMessage, 10), nacked: make(chan []byte, 10)}
+}
+
+func (m *mockPubSub) Publish(ctx context.Context, topic string, data []byte, orderingKey string) error {
+	message := pubSubMessage{topic, orderingKey, data}
+	m.mu.Lock()
+	m.published = append(m.published, message)
+	m.mu.Unlock()
+	m.messages <- message
+	return nil
+}
+
+func (m *mockPubSub) Receive(ctx context.Context, subscription string, settings FPubSubReceiveSettings, handler func([]byte) error) error {
+	m.mu.Lock()
+	m.settings = settings
+	if m.failures > 0 {
+		m.failures--
+		m.mu.Unlock()
+		return errors.New("unavailable")
+	}
+	m.mu.Unlock()
+	for {
+		select {
+		case message := <-m.messages:
+			if subscription != message.topic+"-sub" {
+				continue
+			}
+			if err := handler(message.data); err != nil {
+				m.nacked <- message.data
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Ensures frames are published to the NATS-named topic with their ordering
+// key and delivered to subscribers with the flow control settings.
+func TestPubSubScopeTransportPublishSubscribe(t *testing.T) {
+	assert := assert.New(t)
+	pubSub := newMockPubSub()
+	pubSub.failures = 1
+	received := make(chan string, 2)
+	settings := FPubSubReceiveSettings{MaxOutstandingMessages: 10, MaxOutstandingBytes: 1024}
+	subscriber := NewFPubSubSubscriberTransportFactory(pubSub, func(topic string) string {
+		return frugalPrefix + topic + "-sub"
+	}).WithReceiveSettings(settings).GetTransport()
+	assert.Nil(subscriber.Subscribe("v1.music.AlbumWinners.Winner", func(transport thrift.TTransport) error {
+		proto := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).GetProtocol(transport)
+		ctx, err := proto.ReadRequestHeader()
+		if err != nil {
+			return err
+		}
+		payload, err := proto.ReadString()
+		received <- payload
+		if _, ok := ctx.RequestHeader("fail"); ok {
+			return errors.New("failed")
+		}
+		return err
+	}))
+	assert.True(subscriber.IsSubscribed())
+	err := subscriber.Subscribe("v1.music.AlbumWinners.Winner", nil)
+	assert.Equal(TRANSPORT_EXCEPTION_ALREADY_OPEN, err.(thrift.TTransportException).TypeId())
+
+	publisher := NewFPubSubPublisherTransportFactoryBuilder(pubSub).
+		WithOrderingKeyHeader("album").
+		Build().
+		GetTransport()
+	frame := newKafkaFrame(t, map[string]string{"album": "a1"}, "winner")
+	err = publisher.Publish("v1.music.AlbumWinners.Winner", frame)
+	assert.Equal(TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+	assert.Nil(publisher.Open())
+	assert.Equal(uint(pubSubMaxMessageSize), publisher.GetPublishSizeLimit())
+	assert.Nil(publisher.Publish("v1.music.AlbumWinners.Winner", frame))
+	assert.Equal("winner", <-received)
+	failed := newKafkaFrame(t, map[string]string{"fail": "1"}, "loser")
+	assert.Nil(publisher.Publish("v1.music.AlbumWinners.Winner", failed))
+	assert.Equal("loser", <-received)
+	assert.Equal(failed, <-pubSub.nacked)
+
+	assert.Nil(subscriber.Unsubscribe())
+	assert.False(subscriber.IsSubscribed())
+	assert.Equal(settings, pubSub.settings)
+	assert.Equal([]pubSubMessage{
+		{"frugal.v1.music.AlbumWinners.Winner", "a1", frame},
+		{"frugal.v1.music.AlbumWinners.Winner", "", failed},
+	}, pubSub.published)
+}
+
+// Ensures topic mappers and publish size limits are applied.
+func TestPubSubScopeTransportOptions(t *testing.T) {
+	assert := assert.New(t)
+	pubSub := newMockPubSub()
+	publisher := NewFPubSubPublisherTransportFactoryBuilder(pubSub).
+		WithTopicMapper(func(topic string) string { return "events-" + topic }).
+		WithPublishSizeLimit(10).
+		Build().
+		GetTransport()
+	assert.Nil(publisher.Open())
+	assert.Nil(publisher.Publish("winners", []byte{0, 0, 0, 1, 1}))
+	assert.Equal("events-winners", pubSub.published[0].topic)
+	err := publisher.Publish("winners", make([]byte, 11))
+	assert.Equal(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, err.(thrift.TTransportException).TypeId())
+	assert.Nil(publisher.Close())
+
+	subscriber := NewFPubSubSubscriberTransportFactory(pubSub, nil).GetTransport()
+	err = subscriber.Subscribe("", nil)
+	assert.Equal(TRANSPORT_EXCEPTION_UNKNOWN, err.(thrift.TTransportException).TypeId())
+	assert.Nil(subscriber.Unsubscribe())
+}
@@ -0,0 +1,423 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// FQUICStream is a bidirectional stream of a QUIC connection.
+type FQUICStream interface {
+	io.Reader
+	io.Writer
+
+	// CloseWrite finishes sending on the stream, leaving it open for
+	// reading.
+	CloseWrite() error
+
+	// Close aborts the stream in both directions, unblocking any pending
+	// reads.
+	Close() error
+}
+
+// FQUICConnection is a QUIC connection multiplexing streams.
+type FQUICConnection interface {
+	// OpenStream opens a new stream to the peer.
+	OpenStream() (FQUICStream, error)
+
+	// AcceptStream blocks until the peer opens a stream.
+	AcceptStream() (FQUICStream, error)
+
+	// Close closes the connection and all of its streams.
+	Close() error
+}
+
+// FQUICDialer establishes QUIC connections to a server.
+type FQUICDialer func() (FQUICConnection, error)
+
+// FQUICListener accepts QUIC connections from clients.
+type FQUICListener interface {
+	// Accept blocks until a client connects.
+	Accept() (FQUICConnection, error)
+
+	// Close stops listening, unblocking any pending Accept.
+	Close() error
+}
+
+// fQUICTransport implements FTransport by sending each request on its own
+// stream of a QUIC connection.
+type fQUICTransport struct {
+	dial FQUICDialer
+
+	mu     sync.RWMutex
+	conn   FQUICConnection
+	isOpen bool
+	closed chan error
+}
+
+// NewFQUICTransport returns an FTransport which sends each request on its own
+// stream of a QUIC connection established with the given dialer, so a lost
+// packet only delays the request it belongs to rather than every request on
+// the connection. If a stream can't be opened, the connection is redialed.
+//
+// QUIC itself is provided by the dialer, which typically adapts a library
+// such as quic-go. TLS and 0-RTT are configured there, for example by dialing
+// with a tls.Config holding a ClientSessionCache so reconnects can resume
+// without a full handshake. Use an FQUICServer on the server side.
+func NewFQUICTransport(dial FQUICDialer) FTransport {
+	return &fQUICTransport{dial: dial}
+}
+
+// Open dials the QUIC connection.
+func (q *fQUICTransport) Open() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.isOpen {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: quic transport already open")
+	}
+	conn, err := q.dial()
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	q.conn = conn
+	q.isOpen = true
+	q.closed = make(chan error, 1)
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (q *fQUICTransport) IsOpen() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.isOpen
+}
+
+// Close closes the transport and its QUIC connection.
+func (q *fQUICTransport) Close() error {
+	return q.close(nil)
+}
+
+func (q *fQUICTransport) close(cause error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.isOpen {
+		return nil
+	}
+	q.isOpen = false
+	if err := q.conn.Close(); err != nil {
+		logger().Warn("frugal: error closing quic connection: ", err)
+	}
+	q.closed <- cause
+	close(q.closed)
+	return nil
+}
+
+// Closed channel receives the cause of an FTransport close (nil if clean
+// close).
+func (q *fQUICTransport) Closed() <-chan error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.closed
+}
+
+// SetMonitor is a no-op, the transport redials its connection itself.
+func (q *fQUICTransport) SetMonitor(monitor FTransportMonitor) {
+}
+
+// GetRequestSizeLimit returns 0, requests are unbounded.
+func (q *fQUICTransport) GetRequestSizeLimit() uint {
+	return 0
+}
+
+// Oneway sends the given data on a new stream without waiting for a response.
+func (q *fQUICTransport) Oneway(ctx FContext, data []byte) error {
+	if len(data) == 4 {
+		return nil
+	}
+	stream, err := q.send(data)
+	if err != nil {
+		return err
+	}
+	// Aborting the stream could discard the request before it's delivered,
+	// so wait for the server to finish it instead.
+	go io.Copy(ioutil.Discard, stream)
+	return nil
+}
+
+// Request sends the given data on a new stream and waits for the response on
+// it, respecting the timeout and cancellation of the context.
+func (q *fQUICTransport) Request(ctx FContext, data []byte) (thrift.TTransport, error) {
+	if len(data) == 4 {
+		return nil, nil
+	}
+	stream, err := q.send(data)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		response []byte
+		err      error
+	}
+	resultC := make(chan result, 1)
+	go func() {
+		response, err := readQUICFrame(stream)
+		resultC <- result{response, err}
+	}()
+
+	// Closing the stream aborts the request on the server and unblocks the
+	// read of its response.
+	defer stream.Close()
+	select {
+	case r := <-resultC:
+		if r.err != nil {
+			return nil, thrift.NewTTransportExceptionFromError(r.err)
+		}
+		return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(r.response)}, nil
+	case <-contextDone(ctx):
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_CANCELLED, "frugal: quic request cancelled")
+	case <-time.After(ctx.Timeout()):
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: quic request timed out")
+	}
+}
+
+// send opens a stream and writes the given frame to it, finishing the
+// stream's send side.
+func (q *fQUICTransport) send(data []byte) (FQUICStream, error) {
+	stream, err := q.openStream()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(data); err != nil {
+		stream.Close()
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		stream.Close()
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+	return stream, nil
+}
+
+// openStream opens a stream on the current connection, redialing it once if
+// the stream can't be opened. The transport is closed if redialing fails.
+func (q *fQUICTransport) openStream() (FQUICStream, error) {
+	q.mu.RLock()
+	if !q.isOpen {
+		q.mu.RUnlock()
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: quic transport not open")
+	}
+	conn := q.conn
+	q.mu.RUnlock()
+
+	stream, err := conn.OpenStream()
+	if err == nil {
+		return stream, nil
+	}
+	logger().Warn("frugal: error opening quic stream, redialing: ", err)
+	conn, err = q.redial(conn)
+	if err != nil {
+		q.close(err)
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+	stream, err = conn.OpenStream()
+	if err != nil {
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+	return stream, nil
+}
+
+// redial replaces the given failed connection, unless another request has
+// already done so.
+func (q *fQUICTransport) redial(failed FQUICConnection) (FQUICConnection, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.isOpen {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: quic transport not open")
+	}
+	if q.conn != failed {
+		return q.conn, nil
+	}
+	failed.Close()
+	conn, err := q.dial()
+	if err != nil {
+		return nil, err
+	}
+	q.conn = conn
+	return conn, nil
+}
+
+// readQUICFrame reads a frame from the given stream, returning it without its
+// frame size.
+func readQUICFrame(stream io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(stream, size[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(stream, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// FQUICServer is an FServer which processes requests sent on the streams of
+// QUIC connections, such as by an FTransport created with NewFQUICTransport.
+// Each stream is processed in its own goroutine.
+type FQUICServer struct {
+	processor       FProcessor
+	listener        FQUICListener
+	protocolFactory *FProtocolFactory
+	hooks           *FServerHooks
+	draining        drainSwitch
+
+	mu      sync.Mutex
+	conns   map[FQUICConnection]struct{}
+	stopped bool
+}
+
+// NewFQUICServer creates a new FQUICServer which accepts connections from the
+// given listener, typically adapting a QUIC library listening with a
+// tls.Config.
+func NewFQUICServer(processor FProcessor, listener FQUICListener, protocolFactory *FProtocolFactory) *FQUICServer {
+	return &FQUICServer{
+		processor:       processor,
+		listener:        listener,
+		protocolFactory: protocolFactory,
+		conns:           make(map[FQUICConnection]struct{}),
+	}
+}
+
+// WithHooks registers callbacks invoked as the server starts, stops, and
+// processes requests.
+func (s *FQUICServer) WithHooks(hooks *FServerHooks) *FQUICServer {
+	s.hooks = hooks
+	return s
+}
+
+// Serve accepts connections until the server is stopped.
+func (s *FQUICServer) Serve() error {
+	s.processor = newDrainingProcessor(s.processor, &s.draining)
+	s.processor = newHooksProcessor(s.processor, s.hooks)
+	s.hooks.started()
+	defer s.hooks.stopped()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.isStopped() {
+				return nil
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go s.serveConnection(conn)
+	}
+}
+
+// Stop stops accepting connections and closes the open ones.
+func (s *FQUICServer) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil
+	}
+	s.stopped = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return s.listener.Close()
+}
+
+// SetDraining sets whether the server is draining. While draining, requests
+// in flight are processed, but new requests are rejected with an
+// APPLICATION_EXCEPTION_SERVER_DRAINING error.
+func (s *FQUICServer) SetDraining(draining bool) {
+	s.draining.set(draining)
+}
+
+func (s *FQUICServer) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// track records the given connection so it is closed when the server is
+// stopped, returning false if it has been already.
+func (s *FQUICServer) track(conn FQUICConnection) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *FQUICServer) serveConnection(conn FQUICConnection) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		stream, err := conn.AcceptStream()
+		if err != nil {
+			logger().Debug("frugal: quic connection closed: ", err)
+			return
+		}
+		go s.serveStream(stream)
+	}
+}
+
+// serveStream processes the request on the given stream and writes its
+// response, if any, back on it.
+func (s *FQUICServer) serveStream(stream FQUICStream) {
+	frame, err := readQUICFrame(stream)
+	if err != nil {
+		logger().Warn("frugal: error reading quic request: ", err)
+		stream.Close()
+		return
+	}
+	output := new(bytes.Buffer)
+	err = s.processor.Process(
+		s.protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame)}),
+		s.protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: output}))
+	if err != nil {
+		logger().Warn("frugal: error processing quic request: ", err)
+	}
+	if output.Len() > 0 {
+		if _, err := stream.Write(prependFrameSize(output.Bytes())); err != nil {
+			logger().Warn("frugal: error writing quic response: ", err)
+			stream.Close()
+			return
+		}
+	}
+	// Finish the stream rather than aborting it so the response is
+	// delivered.
+	stream.CloseWrite()
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// pipeQUICStream is one side of an in-memory QUIC stream.
+type pipeQUICStream struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func newPipeQUICStreams() (*pipeQUICStream, *pipeQUICStream) {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	return &pipeQUICStream{clientReader, clientWriter}, &pipeQUICStream{serverReader, serverWriter}
+}
+
+func (p *pipeQUICStream) CloseWrite() error {
+	return p.PipeWriter.Close()
+}
+
+func (p *pipeQUICStream) Close() error {
+	p.PipeWriter.CloseWithError(io.ErrClosedPipe)
+	return p.PipeReader.Close()
+}
+
+// pipeQUICConnection is one side of an in-memory QUIC connection.
+type pipeQUICConnection struct {
+	accept chan FQUICStream
+	peer   *pipeQUICConnection
+	done   chan struct{}
+	once   *sync.Once
+}
+
+func newPipeQUICConnections() (*pipeQUICConnection, *pipeQUICConnection) {
+	done := make(chan struct{})
+	once := new(sync.Once)
+	client := &pipeQUICConnection{accept: make(chan FQUICStream), done: done, once: once}
+	server := &pipeQUICConnection{accept: make(chan FQUICStream), done: done, once: once}
+	client.peer, server.peer = server, client
+	return client, server
+}
+
+func (p *pipeQUICConnection) OpenStream() (FQUICStream, error) {
+	local, remote := newPipeQUICStreams()
+	select {
+	case p.peer.accept <- remote:
+		return local, nil
+	case <-p.done:
+		return nil, errors.New("connection closed")
+	}
+}
+
+func (p *pipeQUICConnection) AcceptStream() (FQUICStream, error) {
+	select {
+	case stream := <-p.accept:
+		return stream, nil
+	case <-p.done:
+		return nil, errors.New("connection closed")
+	}
+}
+
+func (p *pipeQUICConnection) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+// pipeQUICListener accepts in-memory QUIC connections.
+type pipeQUICListener struct {
+	conns  chan FQUICConnection
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeQUICListener() *pipeQUICListener {
+	return &pipeQUICListener{conns: make(chan FQUICConnection), closed: make(chan struct{})}
+}
+
+func (p *pipeQUICListener) dial() (FQUICConnection, error) {
+	client, server := newPipeQUICConnections()
+	select {
+	case p.conns <- server:
+		return client, nil
+	case <-p.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (p *pipeQUICListener) Accept() (FQUICConnection, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case <-p.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (p *pipeQUICListener) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+// Ensures requests are sent on their own streams and processed by the server.
+func TestQUICTransportRequest(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	listener := newPipeQUICListener()
+	server := NewFQUICServer(&headerProcessor{}, listener, protocolFactory)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+
+	transport := NewFQUICTransport(listener.dial)
+	assert.Nil(transport.Open())
+	assert.True(transport.IsOpen())
+	for _, user := range []string{"alice", "bob"} {
+		ctx := NewFContext("cid")
+		ctx.AddRequestHeader("user", user)
+		buffer := NewTMemoryOutputBuffer(0)
+		protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx)
+		result, err := transport.Request(ctx, buffer.Bytes())
+		assert.Nil(err)
+		resultProto := protocolFactory.GetProtocol(result)
+		assert.Nil(resultProto.ReadResponseHeader(ctx))
+		actual, err := resultProto.ReadString()
+		assert.Nil(err)
+		assert.Equal(user, actual)
+		assert.Nil(transport.Oneway(ctx, buffer.Bytes()))
+	}
+
+	closed := transport.Closed()
+	assert.Nil(transport.Close())
+	assert.False(transport.IsOpen())
+	assert.Nil(<-closed)
+	assert.Nil(server.Stop())
+	assert.Nil(<-served)
+}
+
+// Ensures requests respect the timeout and cancellation of their context.
+func TestQUICTransportTimeout(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	listener := newPipeQUICListener()
+	server := NewFQUICServer(&sleepingProcessor{delay: 100 * time.Millisecond}, listener, protocolFactory)
+	go server.Serve()
+	defer server.Stop()
+
+	transport := NewFQUICTransport(listener.dial)
+	assert.Nil(transport.Open())
+	ctx := NewFContext("cid")
+	ctx.SetTimeout(10 * time.Millisecond)
+	_, err := transport.Request(ctx, prependFrameSize([]byte("request")))
+	assert.Equal(TRANSPORT_EXCEPTION_TIMED_OUT, err.(thrift.TTransportException).TypeId())
+
+	ctx = NewFContext("cid")
+	ctx.(*FContextImpl).Cancel()
+	_, err = transport.Request(ctx, prependFrameSize([]byte("request")))
+	assert.Equal(TRANSPORT_EXCEPTION_CANCELLED, err.(thrift.TTransportException).TypeId())
+}
+
+// Ensures the connection is redialed when streams can't be opened, and the
+// transport is closed if that fails.
+func TestQUICTransportRedial(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	listener := newPipeQUICListener()
+	server := NewFQUICServer(&headerProcessor{}, listener, protocolFactory)
+	go server.Serve()
+
+	var (
+		mu    sync.Mutex
+		conns []FQUICConnection
+	)
+	transport := NewFQUICTransport(func() (FQUICConnection, error) {
+		conn, err := listener.dial()
+		if err == nil {
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+		return conn, err
+	})
+	assert.Nil(transport.Open())
+	conns[0].Close()
+
+	ctx := NewFContext("cid")
+	buffer := NewTMemoryOutputBuffer(0)
+	protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx)
+	_, err := transport.Request(ctx, buffer.Bytes())
+	assert.Nil(err)
+	mu.Lock()
+	assert.Len(conns, 2)
+	mu.Unlock()
+
+	closed := transport.Closed()
+	assert.Nil(server.Stop())
+	_, err = transport.Request(ctx, buffer.Bytes())
+	assert.NotNil(err)
+	assert.NotNil(<-closed)
+	assert.False(transport.IsOpen())
+}
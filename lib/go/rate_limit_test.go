@@ -0,0 +1,49 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures tryTake allows bursts up to the bucket size and refills over time.
+func TestTokenBucketTryTake(t *testing.T) {
+	assert := assert.New(t)
+	bucket := newTokenBucket(100, 2)
+	assert.True(bucket.tryTake())
+	assert.True(bucket.tryTake())
+	assert.False(bucket.tryTake())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(bucket.tryTake())
+}
+
+// Ensures take waits for a token to become available and gives up when the
+// quit channel is closed.
+func TestTokenBucketTake(t *testing.T) {
+	assert := assert.New(t)
+	bucket := newTokenBucket(50, 1)
+	quit := make(chan struct{})
+	assert.True(bucket.take(quit))
+
+	start := time.Now()
+	assert.True(bucket.take(quit))
+	assert.True(time.Since(start) >= 15*time.Millisecond)
+
+	close(quit)
+	assert.False(bucket.take(quit))
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// FReconnectPolicy decides whether, and after how long, a
+// BaseFTransportMonitor attempts to reopen a transport which closed
+// uncleanly. Policies are consulted by the goroutine monitoring the
+// transport, so need not be safe for concurrent use unless shared between
+// monitors.
+type FReconnectPolicy interface {
+	// NextWait returns how long to wait before the given attempt to reopen
+	// the transport, numbered from one, given how long ago the transport
+	// closed. Returns false to stop attempting to reopen the transport.
+	NextWait(attempt uint, elapsed time.Duration) (wait time.Duration, ok bool)
+}
+
+// FBackoffReconnectPolicy is an FReconnectPolicy which waits exponentially
+// longer before each attempt to reopen a transport, optionally with jitter,
+// until a maximum number of attempts or time elapsed.
+type FBackoffReconnectPolicy struct {
+	// InitialWait is the wait before the first attempt.
+	InitialWait time.Duration
+
+	// Multiplier scales the wait before each later attempt. Values below one
+	// keep the wait constant.
+	Multiplier float64
+
+	// MaxWait, if set, caps the wait before any attempt.
+	MaxWait time.Duration
+
+	// Jitter randomizes each wait by up to the given fraction of it in either
+	// direction, such as 0.2 for 20%, so clients which lost their connections
+	// at the same time don't all reconnect at once.
+	Jitter float64
+
+	// MaxAttempts, if set, is the most attempts made.
+	MaxAttempts uint
+
+	// MaxElapsed, if set, stops attempts which would be made longer than it
+	// after the transport closed.
+	MaxElapsed time.Duration
+}
+
+// NextWait returns how long to wait before the given attempt to reopen the
+// transport, or false if the attempt exceeds MaxAttempts or MaxElapsed.
+func (p *FBackoffReconnectPolicy) NextWait(attempt uint, elapsed time.Duration) (time.Duration, bool) {
+	if attempt == 0 {
+		attempt = 1
+	}
+	if p.MaxAttempts > 0 && attempt > p.MaxAttempts {
+		return 0, false
+	}
+
+	multiplier := math.Max(p.Multiplier, 1)
+	wait := float64(p.InitialWait) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxWait > 0 {
+		wait = math.Min(wait, float64(p.MaxWait))
+	}
+	// Keep the wait representable, however many attempts have been made.
+	wait = math.Min(wait, math.MaxInt64/2)
+	if p.Jitter > 0 {
+		wait += wait * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if wait < 0 {
+		wait = 0
+	}
+
+	next := time.Duration(wait)
+	if p.MaxElapsed > 0 && elapsed+next > p.MaxElapsed {
+		return 0, false
+	}
+	return next, true
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures the backoff policy grows the wait before each attempt up to the
+// max wait, and stops at the max attempts and max elapsed.
+func TestFBackoffReconnectPolicy(t *testing.T) {
+	assert := assert.New(t)
+	policy := &FBackoffReconnectPolicy{
+		InitialWait: 100 * time.Millisecond,
+		Multiplier:  2,
+		MaxWait:     time.Second,
+		MaxAttempts: 6,
+		MaxElapsed:  time.Minute,
+	}
+	for attempt, expected := range []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second, time.Second,
+	} {
+		wait, ok := policy.NextWait(uint(attempt+1), 0)
+		assert.True(ok)
+		assert.Equal(expected, wait)
+	}
+	_, ok := policy.NextWait(7, 0)
+	assert.False(ok)
+	_, ok = policy.NextWait(2, time.Minute-100*time.Millisecond)
+	assert.False(ok)
+
+	// Without a multiplier, the wait is constant.
+	policy = &FBackoffReconnectPolicy{InitialWait: time.Second}
+	wait, ok := policy.NextWait(1000, time.Hour)
+	assert.True(ok)
+	assert.Equal(time.Second, wait)
+}
+
+// Ensures jitter keeps waits within the given fraction of the backoff.
+func TestFBackoffReconnectPolicyJitter(t *testing.T) {
+	policy := &FBackoffReconnectPolicy{InitialWait: time.Second, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		wait, ok := policy.NextWait(1, 0)
+		assert.True(t, ok)
+		assert.InDelta(t, float64(time.Second), float64(wait), float64(200*time.Millisecond))
+	}
+}
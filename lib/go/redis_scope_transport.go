@@ -0,0 +1,445 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// redisMaxMessageSize is the maximum size of a Redis bulk string.
+	redisMaxMessageSize = 512 * 1024 * 1024
+
+	defaultRedisDialTimeout = 5 * time.Second
+
+	redisMinReconnectDelay = 100 * time.Millisecond
+	redisMaxReconnectDelay = 10 * time.Second
+)
+
+// FRedisOptions configures connections to a Redis server used by Redis scope
+// transports.
+type FRedisOptions struct {
+	// Addr is the host:port of the Redis server.
+	Addr string
+
+	// Username and Password authenticate connections with AUTH if Password
+	// is set. Username requires Redis 6 ACLs and may be empty.
+	Username string
+	Password string
+
+	// TLSConfig, if set, connects to the server using TLS.
+	TLSConfig *tls.Config
+
+	// DialTimeout limits the time taken to connect. Defaults to 5 seconds.
+	DialTimeout time.Duration
+}
+
+// redisError is an error reply from the Redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "frugal: redis: " + string(e)
+}
+
+// redisConn is a minimal client for the Redis serialization protocol (RESP),
+// supporting the commands used for pub/sub.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialRedis connects and authenticates to the Redis server.
+func dialRedis(options FRedisOptions) (*redisConn, error) {
+	timeout := options.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultRedisDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if options.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", options.Addr, options.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", options.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if options.Password != "" {
+		args := []string{"AUTH", options.Password}
+		if options.Username != "" {
+			args = []string{"AUTH", options.Username, options.Password}
+		}
+		conn.SetDeadline(time.Now().Add(timeout))
+		_, err := r.do(args...)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// do sends the given command and returns its reply.
+func (r *redisConn) do(args ...string) (interface{}, error) {
+	if err := r.send(args...); err != nil {
+		return nil, err
+	}
+	return r.readReply()
+}
+
+// send writes the given command as an array of bulk strings.
+func (r *redisConn) send(args ...string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := r.conn.Write(buf.Bytes())
+	return err
+}
+
+// readReply reads a reply, returning a string for simple strings, an int64
+// for integers, a []byte or nil for bulk strings and an []interface{} for
+// arrays. Error replies are returned as a redisError.
+func (r *redisConn) readReply() (interface{}, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("frugal: redis: invalid reply")
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, count)
+		for i := range replies {
+			if replies[i], err = r.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("frugal: redis: unknown reply type %q", kind)
+}
+
+func (r *redisConn) Close() error {
+	return r.conn.Close()
+}
+
+// redisChannel returns the Redis channel for the given topic, prefixed the
+// same way as NATS subjects.
+func redisChannel(topic string) string {
+	return frugalPrefix + topic
+}
+
+// FRedisPublisherTransportFactory creates Redis FPublisherTransports.
+type FRedisPublisherTransportFactory struct {
+	options FRedisOptions
+}
+
+// NewFRedisPublisherTransportFactory creates an
+// FRedisPublisherTransportFactory whose transports publish to Redis channels
+// using PUBLISH. Topics are mapped to channels the same way as NATS subjects,
+// prefixed with "frugal.".
+func NewFRedisPublisherTransportFactory(options FRedisOptions) *FRedisPublisherTransportFactory {
+	return &FRedisPublisherTransportFactory{options: options}
+}
+
+// GetTransport creates a new Redis FPublisherTransport.
+func (r *FRedisPublisherTransportFactory) GetTransport() FPublisherTransport {
+	return &fRedisPublisherTransport{options: r.options}
+}
+
+// fRedisPublisherTransport implements FPublisherTransport. If the connection
+// fails, Publish returns the error and reconnects on the next call.
+type fRedisPublisherTransport struct {
+	options FRedisOptions
+
+	mu     sync.Mutex
+	conn   *redisConn
+	isOpen bool
+}
+
+// Open connects to the Redis server.
+func (r *fRedisPublisherTransport) Open() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.isOpen {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: Redis transport already open")
+	}
+	conn, err := dialRedis(r.options)
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	r.conn = conn
+	r.isOpen = true
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (r *fRedisPublisherTransport) IsOpen() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.isOpen
+}
+
+// Close closes the connection.
+func (r *fRedisPublisherTransport) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.isOpen = false
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return thrift.NewTTransportExceptionFromError(err)
+}
+
+// GetPublishSizeLimit returns the maximum allowable size of a payload
+// to be published. A non-positive number is returned to indicate an
+// unbounded allowable size.
+func (r *fRedisPublisherTransport) GetPublishSizeLimit() uint {
+	return redisMaxMessageSize
+}
+
+// Publish sends the given frame to the Redis channel for the topic.
+func (r *fRedisPublisherTransport) Publish(topic string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.isOpen {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: Redis FPublisherTransport not open")
+	}
+	if len(data) > redisMaxMessageSize {
+		return thrift.NewTTransportException(
+			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", redisMaxMessageSize, len(data)))
+	}
+
+	if r.conn == nil {
+		conn, err := dialRedis(r.options)
+		if err != nil {
+			return thrift.NewTTransportExceptionFromError(err)
+		}
+		r.conn = conn
+	}
+	_, err := r.conn.do("PUBLISH", redisChannel(topic), string(data))
+	if _, ok := err.(redisError); err != nil && !ok {
+		// Reconnect on the next publish.
+		r.conn.Close()
+		r.conn = nil
+	}
+	return thrift.NewTTransportExceptionFromError(err)
+}
+
+// FRedisSubscriberTransportFactory creates Redis FSubscriberTransports.
+type FRedisSubscriberTransportFactory struct {
+	options FRedisOptions
+}
+
+// NewFRedisSubscriberTransportFactory creates an
+// FRedisSubscriberTransportFactory whose transports subscribe to Redis
+// channels using SUBSCRIBE. Redis pub/sub delivers each message to every
+// subscriber connected at the time, so messages published while a
+// subscriber is reconnecting are missed.
+func NewFRedisSubscriberTransportFactory(options FRedisOptions) *FRedisSubscriberTransportFactory {
+	return &FRedisSubscriberTransportFactory{options: options}
+}
+
+// GetTransport creates a new Redis FSubscriberTransport.
+func (r *FRedisSubscriberTransportFactory) GetTransport() FSubscriberTransport {
+	return &fRedisSubscriberTransport{options: r.options}
+}
+
+// fRedisSubscriberTransport implements FSubscriberTransport. Connections which
+// fail are reopened and resubscribed until Unsubscribe is called.
+type fRedisSubscriberTransport struct {
+	options FRedisOptions
+
+	mu   sync.RWMutex
+	conn *redisConn
+	quit chan struct{}
+	done chan struct{}
+}
+
+// Subscribe connects to the Redis server and subscribes to the channel for
+// the given topic.
+func (r *fRedisSubscriberTransport) Subscribe(topic string, callback FAsyncCallback) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.quit != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: Redis transport already open")
+	}
+	if topic == "" {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"cannot subscribe to empty topic")
+	}
+
+	channel := redisChannel(topic)
+	conn, err := r.subscribe(channel)
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	r.conn = conn
+	r.quit = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.receive(channel, conn, callback, r.quit, r.done)
+	return nil
+}
+
+// subscribe opens a connection subscribed to the given channel.
+func (r *fRedisSubscriberTransport) subscribe(channel string) (*redisConn, error) {
+	conn, err := dialRedis(r.options)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.do("SUBSCRIBE", channel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// receive delivers messages from the connection to the callback, reconnecting
+// with backoff if the connection fails, until quit is closed.
+func (r *fRedisSubscriberTransport) receive(channel string, conn *redisConn, callback FAsyncCallback,
+	quit, done chan struct{}) {
+	defer close(done)
+	for {
+		err := readRedisMessages(conn, callback)
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		logger().Warnf("frugal: Redis subscription to %s failed, reconnecting: %v", channel, err)
+
+		delay := redisMinReconnectDelay
+		for {
+			select {
+			case <-quit:
+				return
+			case <-time.After(delay):
+			}
+			if conn, err = r.subscribe(channel); err == nil {
+				break
+			}
+			logger().Warnf("frugal: error resubscribing to Redis channel %s: %v", channel, err)
+			if delay *= 2; delay > redisMaxReconnectDelay {
+				delay = redisMaxReconnectDelay
+			}
+		}
+
+		r.mu.Lock()
+		select {
+		case <-quit:
+			r.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		r.conn = conn
+		r.mu.Unlock()
+	}
+}
+
+// readRedisMessages delivers pushed messages to the callback until the
+// connection fails.
+func readRedisMessages(conn *redisConn, callback FAsyncCallback) error {
+	for {
+		reply, err := conn.readReply()
+		if err != nil {
+			return err
+		}
+		push, ok := reply.([]interface{})
+		if !ok || len(push) != 3 {
+			continue
+		}
+		if kind, _ := push[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		frame, _ := push[2].([]byte)
+		if len(frame) < 4 {
+			logger().Warn("frugal: Discarding invalid scope message frame")
+			continue
+		}
+		transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])}
+		if err := callback(transport); err != nil {
+			logger().Warn("frugal: error executing callback: ", err)
+		}
+	}
+}
+
+// IsSubscribed returns true if the transport is subscribed to a topic, false
+// otherwise.
+func (r *fRedisSubscriberTransport) IsSubscribed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.quit != nil
+}
+
+// Unsubscribe closes the subscription's connection.
+func (r *fRedisSubscriberTransport) Unsubscribe() error {
+	r.mu.Lock()
+	if r.quit == nil {
+		r.mu.Unlock()
+		return nil
+	}
+	close(r.quit)
+	r.conn.Close()
+	done := r.done
+	r.quit, r.done, r.conn = nil, nil, nil
+	r.mu.Unlock()
+	<-done
+	return nil
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockRedisServer implements the AUTH, PUBLISH and SUBSCRIBE commands of a
+// Redis server.
+type mockRedisServer struct {
+	listener    net.Listener
+	password    string
+	mu          sync.Mutex
+	subscribers map[string][]net.Conn
+}
+
+func newMockRedisServer(t *testing.T, password string) *mockRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mockRedisServer{listener: listener, password: password, subscribers: make(map[string][]net.Conn)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *mockRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	authenticated := s.password == ""
+	for {
+		reply, err := r.readReply()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		switch {
+		case args[0] == "AUTH":
+			if args[len(args)-1] != s.password {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authenticated = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authenticated:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case args[0] == "SUBSCRIBE":
+			s.mu.Lock()
+			s.subscribers[args[1]] = append(s.subscribers[args[1]], conn)
+			s.mu.Unlock()
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		case args[0] == "PUBLISH":
+			s.mu.Lock()
+			subscribers := s.subscribers[args[1]]
+			for _, subscriber := range subscribers {
+				fmt.Fprintf(subscriber, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+					len(args[1]), args[1], len(args[2]), args[2])
+			}
+			s.mu.Unlock()
+			fmt.Fprintf(conn, ":%d\r\n", len(subscribers))
+		}
+	}
+}
+
+// dropSubscribers closes the connections of all subscribers.
+func (s *mockRedisServer) dropSubscribers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for channel, conns := range s.subscribers {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(s.subscribers, channel)
+	}
+}
+
+func (s *mockRedisServer) subscriberCount(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers[channel])
+}
+
+// Ensures frames published to a topic are delivered to its subscribers,
+// including after the subscriber's connection fails.
+func TestRedisScopeTransportPublishSubscribe(t *testing.T) {
+	assert := assert.New(t)
+	server := newMockRedisServer(t, "secret")
+	defer server.listener.Close()
+	options := FRedisOptions{Addr: server.listener.Addr().String(), Password: "secret"}
+
+	received := make(chan []byte, 1)
+	subscriber := NewFRedisSubscriberTransportFactory(options).GetTransport()
+	assert.Nil(subscriber.Subscribe("foo", func(transport thrift.TTransport) error {
+		payload, err := ioutil.ReadAll(transport)
+		received <- payload
+		return err
+	}))
+	assert.True(subscriber.IsSubscribed())
+	assert.Equal(1, server.subscriberCount("frugal.foo"))
+
+	publisher := NewFRedisPublisherTransportFactory(options).GetTransport()
+	assert.Nil(publisher.Open())
+	assert.True(publisher.IsOpen())
+	assert.Nil(publisher.Publish("foo", []byte{0, 0, 0, 2, 1, 2}))
+	select {
+	case payload := <-received:
+		assert.Equal([]byte{1, 2}, payload)
+	case <-time.After(time.Second):
+		t.Fatal("Expected frame to be delivered")
+	}
+
+	server.dropSubscribers()
+	for i := 0; i < 100 && server.subscriberCount("frugal.foo") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(1, server.subscriberCount("frugal.foo"))
+	assert.Nil(publisher.Publish("foo", []byte{0, 0, 0, 1, 3}))
+	select {
+	case payload := <-received:
+		assert.Equal([]byte{3}, payload)
+	case <-time.After(time.Second):
+		t.Fatal("Expected frame to be delivered after reconnecting")
+	}
+
+	assert.Nil(subscriber.Unsubscribe())
+	assert.False(subscriber.IsSubscribed())
+	assert.Nil(publisher.Close())
+	assert.Error(publisher.Publish("foo", []byte{0, 0, 0, 1, 3}))
+}
+
+// Ensures connections fail with the wrong password.
+func TestRedisScopeTransportAuthFailure(t *testing.T) {
+	server := newMockRedisServer(t, "secret")
+	defer server.listener.Close()
+	options := FRedisOptions{Addr: server.listener.Addr().String(), Password: "wrong"}
+
+	assert.Error(t, NewFRedisPublisherTransportFactory(options).GetTransport().Open())
+	err := NewFRedisSubscriberTransportFactory(options).GetTransport().Subscribe("foo", nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "WRONGPASS")
+}
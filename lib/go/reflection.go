@@ -0,0 +1,396 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// ReflectionService is the service id FSimpleServer serves the reflection
+// service under, and the NATS subject FNatsServer serves it on.
+const ReflectionService = "frugal.reflection"
+
+// FServiceDescriptor describes a service registered with a server.
+type FServiceDescriptor struct {
+	Name    string
+	Methods []*FMethodDescriptor
+}
+
+// FMethodDescriptor describes a method of a service, along with the
+// annotations defined for it in the service IDL.
+type FMethodDescriptor struct {
+	Name        string
+	Annotations map[string]string
+}
+
+// FReflection is the handler interface of the reflection service.
+// ListServices returns the services registered with the server, so tools
+// can discover what it serves at runtime.
+type FReflection interface {
+	ListServices(ctx FContext) ([]*FServiceDescriptor, error)
+}
+
+// FReflectionServer is an FReflection which describes the FProcessors
+// registered with it. It's safe for concurrent use, so services can be
+// registered while it's being served.
+type FReflectionServer struct {
+	mu       sync.RWMutex
+	services map[string]FProcessor
+}
+
+// NewFReflectionServer creates a new FReflectionServer.
+func NewFReflectionServer() *FReflectionServer {
+	return &FReflectionServer{services: make(map[string]FProcessor)}
+}
+
+// RegisterService registers the FProcessor serving the service with the
+// given name. Its methods are those registered with it, for FProcessors
+// embedding FBaseProcessor, along with those it has annotations for.
+// Returns the same FReflectionServer to allow for chaining calls.
+func (r *FReflectionServer) RegisterService(name string, processor FProcessor) *FReflectionServer {
+	r.mu.Lock()
+	r.services[name] = processor
+	r.mu.Unlock()
+	return r
+}
+
+// ListServices returns the registered services, sorted by name, with their
+// methods sorted by name.
+func (r *FReflectionServer) ListServices(ctx FContext) ([]*FServiceDescriptor, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	services := make([]*FServiceDescriptor, 0, len(r.services))
+	for name, processor := range r.services {
+		services = append(services, describeService(name, processor))
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services, nil
+}
+
+// describeService returns the descriptor of the given FProcessor.
+func describeService(name string, processor FProcessor) *FServiceDescriptor {
+	annotations := processor.Annotations()
+	var methods []string
+	if p, ok := processor.(interface {
+		Methods() []string
+	}); ok {
+		methods = p.Methods()
+	}
+	for method := range annotations {
+		if !containsString(methods, method) {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+	service := &FServiceDescriptor{Name: name, Methods: make([]*FMethodDescriptor, 0, len(methods))}
+	for _, method := range methods {
+		service.Methods = append(service.Methods, &FMethodDescriptor{
+			Name:        method,
+			Annotations: annotations[method],
+		})
+	}
+	return service
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// FReflectionProcessor is the FProcessor of the reflection service.
+type FReflectionProcessor struct {
+	*FBaseProcessor
+}
+
+// NewFReflectionProcessor creates a new FReflectionProcessor which serves
+// the given handler.
+func NewFReflectionProcessor(handler FReflection, middleware ...ServiceMiddleware) *FReflectionProcessor {
+	p := &FReflectionProcessor{NewFBaseProcessor()}
+	p.AddToProcessorMap("listServices", &builtinFunction{
+		FBaseProcessorFunction: NewFBaseProcessorFunction(p.GetWriteMutex(),
+			NewMethod(handler, handler.ListServices, "ListServices", middleware)),
+		name: "listServices",
+		readArgs: func(iprot *FProtocol) ([]interface{}, error) {
+			return nil, readStructFields(iprot, func(int16, thrift.TType) (bool, error) {
+				return false, nil
+			})
+		},
+		writeResult: func(oprot *FProtocol, result interface{}) error {
+			return writeListServicesResult(oprot, result.([]*FServiceDescriptor))
+		},
+	})
+	return p
+}
+
+// FReflectionClient is a client of the reflection service.
+type FReflectionClient struct {
+	transport       FTransport
+	protocolFactory *FProtocolFactory
+	method          *Method
+	opts            []CallOption
+}
+
+// NewFReflectionClient creates a new FReflectionClient which calls the
+// reflection service with the given provider. For an FSimpleServer, the
+// provider's transport must be obtained from an FTransportMux with the
+// ReflectionService service id. For an FNatsServer, it must send requests on
+// the ReflectionService subject.
+func NewFReflectionClient(provider *FServiceProvider, middleware ...ServiceMiddleware) *FReflectionClient {
+	client := &FReflectionClient{
+		transport:       provider.GetTransport(),
+		protocolFactory: provider.GetProtocolFactory(),
+	}
+	middleware = append(middleware, provider.GetMiddleware()...)
+	client.method = NewMethod(client, client.listServices, "listServices", middleware)
+	return client
+}
+
+// WithCallOptions returns a copy of the client which makes its calls with the
+// given options, in addition to those of the client.
+func (f *FReflectionClient) WithCallOptions(opts ...CallOption) *FReflectionClient {
+	client := *f
+	client.opts = append(append([]CallOption(nil), f.opts...), opts...)
+	return &client
+}
+
+// ListServices returns the services registered with the server.
+func (f *FReflectionClient) ListServices(ctx FContext) ([]*FServiceDescriptor, error) {
+	ctx, finish := ApplyCallOptions(ctx, f.opts...)
+	defer finish()
+	ret := f.method.Invoke([]interface{}{ctx})
+	if len(ret) != 2 {
+		panic(fmt.Sprintf("Middleware returned %d arguments, expected 2", len(ret)))
+	}
+	services, _ := ret[0].([]*FServiceDescriptor)
+	return services, ret.Error()
+}
+
+func (f *FReflectionClient) listServices(ctx FContext) ([]*FServiceDescriptor, error) {
+	var services []*FServiceDescriptor
+	err := callBuiltin(f.transport, f.protocolFactory, ctx, "listServices",
+		func(oprot *FProtocol) error {
+			return writeEmptyStruct(oprot, "listServices_args")
+		},
+		func(iprot *FProtocol) (err error) {
+			services, err = readListServicesResult(iprot)
+			return err
+		})
+	return services, err
+}
+
+// writeListServicesResult writes the result struct of the listServices
+// method.
+func writeListServicesResult(oprot *FProtocol, services []*FServiceDescriptor) error {
+	if err := oprot.WriteStructBegin("listServices_result"); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldBegin("success", thrift.LIST, 0); err != nil {
+		return err
+	}
+	if err := oprot.WriteListBegin(thrift.STRUCT, len(services)); err != nil {
+		return err
+	}
+	for _, service := range services {
+		if err := writeServiceDescriptor(oprot, service); err != nil {
+			return err
+		}
+	}
+	if err := oprot.WriteListEnd(); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldEnd(); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldStop(); err != nil {
+		return err
+	}
+	return oprot.WriteStructEnd()
+}
+
+// readListServicesResult reads the result struct of the listServices method,
+// returning the services.
+func readListServicesResult(iprot *FProtocol) ([]*FServiceDescriptor, error) {
+	var services []*FServiceDescriptor
+	set := false
+	err := readStructFields(iprot, func(id int16, typeID thrift.TType) (bool, error) {
+		if id != 0 || typeID != thrift.LIST {
+			return false, nil
+		}
+		set = true
+		_, size, err := iprot.ReadListBegin()
+		if err != nil {
+			return true, err
+		}
+		services = make([]*FServiceDescriptor, 0, size)
+		for i := 0; i < size; i++ {
+			service, err := readServiceDescriptor(iprot)
+			if err != nil {
+				return true, err
+			}
+			services = append(services, service)
+		}
+		return true, iprot.ReadListEnd()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !set {
+		return nil, thrift.NewTApplicationException(APPLICATION_EXCEPTION_MISSING_RESULT,
+			"listServices failed: unknown result")
+	}
+	return services, nil
+}
+
+func writeServiceDescriptor(oprot *FProtocol, service *FServiceDescriptor) error {
+	if err := oprot.WriteStructBegin("FServiceDescriptor"); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldBegin("name", thrift.STRING, 1); err != nil {
+		return err
+	}
+	if err := oprot.WriteString(service.Name); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldEnd(); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldBegin("methods", thrift.LIST, 2); err != nil {
+		return err
+	}
+	if err := oprot.WriteListBegin(thrift.STRUCT, len(service.Methods)); err != nil {
+		return err
+	}
+	for _, method := range service.Methods {
+		if err := writeMethodDescriptor(oprot, method); err != nil {
+			return err
+		}
+	}
+	if err := oprot.WriteListEnd(); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldEnd(); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldStop(); err != nil {
+		return err
+	}
+	return oprot.WriteStructEnd()
+}
+
+func readServiceDescriptor(iprot *FProtocol) (*FServiceDescriptor, error) {
+	service := &FServiceDescriptor{}
+	err := readStructFields(iprot, func(id int16, typeID thrift.TType) (bool, error) {
+		switch {
+		case id == 1 && typeID == thrift.STRING:
+			var err error
+			service.Name, err = iprot.ReadString()
+			return true, err
+		case id == 2 && typeID == thrift.LIST:
+			_, size, err := iprot.ReadListBegin()
+			if err != nil {
+				return true, err
+			}
+			service.Methods = make([]*FMethodDescriptor, 0, size)
+			for i := 0; i < size; i++ {
+				method, err := readMethodDescriptor(iprot)
+				if err != nil {
+					return true, err
+				}
+				service.Methods = append(service.Methods, method)
+			}
+			return true, iprot.ReadListEnd()
+		}
+		return false, nil
+	})
+	return service, err
+}
+
+func writeMethodDescriptor(oprot *FProtocol, method *FMethodDescriptor) error {
+	if err := oprot.WriteStructBegin("FMethodDescriptor"); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldBegin("name", thrift.STRING, 1); err != nil {
+		return err
+	}
+	if err := oprot.WriteString(method.Name); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldEnd(); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldBegin("annotations", thrift.MAP, 2); err != nil {
+		return err
+	}
+	if err := oprot.WriteMapBegin(thrift.STRING, thrift.STRING, len(method.Annotations)); err != nil {
+		return err
+	}
+	for k, v := range method.Annotations {
+		if err := oprot.WriteString(k); err != nil {
+			return err
+		}
+		if err := oprot.WriteString(v); err != nil {
+			return err
+		}
+	}
+	if err := oprot.WriteMapEnd(); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldEnd(); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldStop(); err != nil {
+		return err
+	}
+	return oprot.WriteStructEnd()
+}
+
+func readMethodDescriptor(iprot *FProtocol) (*FMethodDescriptor, error) {
+	method := &FMethodDescriptor{}
+	err := readStructFields(iprot, func(id int16, typeID thrift.TType) (bool, error) {
+		switch {
+		case id == 1 && typeID == thrift.STRING:
+			var err error
+			method.Name, err = iprot.ReadString()
+			return true, err
+		case id == 2 && typeID == thrift.MAP:
+			_, _, size, err := iprot.ReadMapBegin()
+			if err != nil {
+				return true, err
+			}
+			method.Annotations = make(map[string]string, size)
+			for i := 0; i < size; i++ {
+				k, err := iprot.ReadString()
+				if err != nil {
+					return true, err
+				}
+				v, err := iprot.ReadString()
+				if err != nil {
+					return true, err
+				}
+				method.Annotations[k] = v
+			}
+			return true, iprot.ReadMapEnd()
+		}
+		return false, nil
+	})
+	return method, err
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures the reflection service lists the registered services with their
+// methods and annotations.
+func TestReflectionService(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	health := NewFHealthProcessor(NewFHealthServer())
+	health.AddToAnnotationsMap("check", map[string]string{"idempotent": "true"})
+	health.AddToAnnotationsMap("watch", map[string]string{"deprecated": "true"})
+	reflection := NewFReflectionServer().
+		RegisterService(HealthService, health).
+		RegisterService("empty", NewFBaseProcessor())
+	transport := NewFLoopbackTransport(NewFReflectionProcessor(reflection), protocolFactory)
+	assert.Nil(transport.Open())
+	client := NewFReflectionClient(NewFServiceProvider(transport, protocolFactory))
+
+	services, err := client.ListServices(NewFContext(""))
+	assert.Nil(err)
+	assert.Equal([]*FServiceDescriptor{
+		{Name: "empty", Methods: []*FMethodDescriptor{}},
+		{Name: HealthService, Methods: []*FMethodDescriptor{
+			{Name: "check", Annotations: map[string]string{"idempotent": "true"}},
+			{Name: "watch", Annotations: map[string]string{"deprecated": "true"}},
+		}},
+	}, services)
+}
+
+// Ensures FBaseProcessor reports its registered methods in order.
+func TestFBaseProcessorMethods(t *testing.T) {
+	processor := NewFBaseProcessor()
+	processor.AddToProcessorMap("b", nil)
+	processor.AddToProcessorMap("a", nil)
+	assert.Equal(t, []string{"a", "b"}, processor.Methods())
+}
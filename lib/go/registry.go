@@ -46,6 +46,9 @@ type FAsyncCallback func(thrift.TTransport) error
 type fRegistry interface {
 	// Register a channel for the given Context.
 	Register(ctx FContext, resultC chan []byte) error
+	// RegisterStream registers a queue receiving every response frame for
+	// the given Context, for requests with streamed responses.
+	RegisterStream(ctx FContext, queue *streamQueue) error
 	// Unregister a callback for the given Context.
 	Unregister(FContext)
 	// Execute dispatches a single Thrift message frame.
@@ -55,12 +58,16 @@ type fRegistry interface {
 type fRegistryImpl struct {
 	mu       sync.RWMutex
 	channels map[uint64]chan []byte
+	streams  map[uint64]*streamQueue
 }
 
 // NewFRegistry creates a Registry intended for use by Frugal clients.
 // This is only to be called by generated code.
 func newFRegistry() fRegistry {
-	return &fRegistryImpl{channels: make(map[uint64]chan []byte)}
+	return &fRegistryImpl{
+		channels: make(map[uint64]chan []byte),
+		streams:  make(map[uint64]*streamQueue),
+	}
 }
 
 // Register a channel for the given Context.
@@ -72,16 +79,35 @@ func (c *fRegistryImpl) Register(ctx FContext, resultC chan []byte) error {
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if err == nil {
-		_, ok := c.channels[opID]
-		if ok {
-			return fmt.Errorf("frugal: context already registered, opid %d is in-flight for another request", opID)
-		}
+	if err == nil && c.inFlight(opID) {
+		return fmt.Errorf("frugal: context already registered, opid %d is in-flight for another request", opID)
 	}
 	c.channels[opID] = resultC
 	return nil
 }
 
+// RegisterStream registers a queue receiving every response frame for the
+// given Context.
+func (c *fRegistryImpl) RegisterStream(ctx FContext, queue *streamQueue) error {
+	opID, err := getOpID(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil && c.inFlight(opID) {
+		return fmt.Errorf("frugal: context already registered, opid %d is in-flight for another request", opID)
+	}
+	c.streams[opID] = queue
+	return nil
+}
+
+// inFlight indicates if a request with the given opid is registered. The
+// caller must hold the lock.
+func (c *fRegistryImpl) inFlight(opID uint64) bool {
+	_, ok := c.channels[opID]
+	_, streaming := c.streams[opID]
+	return ok || streaming
+}
+
 // Unregister a callback for the given Context.
 func (c *fRegistryImpl) Unregister(ctx FContext) {
 	opID, err := getOpID(ctx)
@@ -91,24 +117,30 @@ func (c *fRegistryImpl) Unregister(ctx FContext) {
 	}
 	c.mu.Lock()
 	delete(c.channels, opID)
+	delete(c.streams, opID)
 	c.mu.Unlock()
 }
 
 // Execute dispatches a single Thrift message frame.
 func (c *fRegistryImpl) Execute(frame []byte) error {
-	headers, err := getHeadersFromFrame(frame)
+	opidHeader, _, err := frameHeader(frame, opIDHeader)
 	if err != nil {
 		logger().Warn("frugal: invalid protocol frame headers:", err)
 		return err
 	}
 
-	opid, err := strconv.ParseUint(headers[opIDHeader], 10, 64)
+	opid, err := strconv.ParseUint(opidHeader, 10, 64)
 	if err != nil {
 		logger().Warn("frugal: invalid protocol frame, op id not a uint64:", err)
 		return err
 	}
 
 	c.mu.RLock()
+	if queue, ok := c.streams[opid]; ok {
+		c.mu.RUnlock()
+		queue.push(frame)
+		return nil
+	}
 	resultC, ok := c.channels[opid]
 	if !ok {
 		logger().Warn("frugal: unregistered context")
@@ -117,6 +149,12 @@ func (c *fRegistryImpl) Execute(frame []byte) error {
 	}
 	c.mu.RUnlock()
 
-	resultC <- frame
+	// A request may receive more than one response if it was replayed, so
+	// only the first is delivered.
+	select {
+	case resultC <- frame:
+	default:
+		logger().Warn("frugal: dropping duplicate response")
+	}
 	return nil
 }
@@ -51,7 +51,7 @@ func TestClientRegistry(t *testing.T) {
 	assert.Nil(registry.Register(ctx, resultC))
 	// Encode a frame with this context
 	transport := &thrift.TMemoryBuffer{Buffer: new(bytes.Buffer)}
-	proto := &FProtocol{tProtocolFactory.GetProtocol(transport)}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(transport))
 	assert.Nil(proto.writeHeader(ctx.RequestHeaders()))
 	// Pass the frame to execute
 	frame := transport.Bytes()
@@ -78,6 +78,45 @@ func TestClientRegistry(t *testing.T) {
 	assert.Nil(err)
 }
 
+// Ensures Execute drops duplicate responses rather than blocking.
+func TestClientRegistryDuplicateResponse(t *testing.T) {
+	assert := assert.New(t)
+	resultC := make(chan []byte, 1)
+	registry := newFRegistry()
+	ctx := NewFContext("")
+	assert.Nil(registry.Register(ctx, resultC))
+	transport := &thrift.TMemoryBuffer{Buffer: new(bytes.Buffer)}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(transport))
+	assert.Nil(proto.writeHeader(ctx.RequestHeaders()))
+	frame := transport.Bytes()
+
+	assert.Nil(registry.Execute(frame))
+	assert.Nil(registry.Execute(frame))
+	assert.Equal(1, len(resultC))
+}
+
+// Ensures every response for a streamed request is queued, and streamed
+// requests can't share an opid with other requests.
+func TestClientRegistryStream(t *testing.T) {
+	assert := assert.New(t)
+	queue := newStreamQueue()
+	registry := newFRegistry()
+	ctx := NewFContext("")
+	assert.Nil(registry.RegisterStream(ctx, queue))
+	assert.Error(registry.Register(ctx, make(chan []byte, 1)))
+	transport := &thrift.TMemoryBuffer{Buffer: new(bytes.Buffer)}
+	proto := NewFProtocol(tProtocolFactory.GetProtocol(transport))
+	assert.Nil(proto.writeHeader(ctx.RequestHeaders()))
+	frame := transport.Bytes()
+
+	assert.Nil(registry.Execute(frame))
+	assert.Nil(registry.Execute(frame))
+	assert.Len(queue.frames, 2)
+
+	registry.Unregister(ctx)
+	assert.Empty(registry.(*fRegistryImpl).streams)
+}
+
 type mockProcessor struct {
 	iprot *FProtocol
 	oprot *FProtocol
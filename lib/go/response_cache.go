@@ -0,0 +1,204 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Header with which servers mark a response as cacheable for the given number
+// of milliseconds
+const cacheTTLHeader = "_cache_ttl"
+
+// defaultResponseCacheSize is the number of results held by the default
+// FResponseCache of NewCacheMiddleware.
+const defaultResponseCacheSize = 1000
+
+// SetCacheable marks the response to the request with the given server
+// FContext as cacheable by clients using NewCacheMiddleware for the given
+// TTL, overriding the TTL configured for the method by the client. A TTL of
+// zero marks the response as not cacheable. The TTL is sent in the reserved
+// "_cache_ttl" response header.
+func SetCacheable(ctx FContext, ttl time.Duration) {
+	setResponseHeader(ctx, cacheTTLHeader, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+}
+
+// FResponseCache stores the results of calls for NewCacheMiddleware.
+// Implementations must be safe for concurrent use.
+type FResponseCache interface {
+	// Get returns the unexpired results cached for the given key.
+	Get(key string) (results Results, ok bool)
+
+	// Set caches the given results under the given key for the given TTL.
+	Set(key string, results Results, ttl time.Duration)
+}
+
+// FCacheConfig configures NewCacheMiddleware.
+type FCacheConfig struct {
+	// Cache stores the results of calls. Defaults to an in-memory cache of
+	// the 1000 most recently used results.
+	Cache FResponseCache
+
+	// MethodTTLs are how long the results of each method, by name, are
+	// cached for. Methods without a TTL are only cached when the server marks
+	// their responses cacheable with SetCacheable.
+	MethodTTLs map[string]time.Duration
+
+	// VaryHeaders are request headers included in cache keys, such as one
+	// identifying a tenant, so calls which only differ by them aren't served
+	// each other's results.
+	VaryHeaders []string
+}
+
+// NewCacheMiddleware returns ServiceMiddleware which caches the results of
+// successful calls, so repeated calls with the same arguments are served
+// locally without a request. Calls are keyed by method and arguments, which
+// are serialized as JSON, plus any VaryHeaders. Results are cached for the
+// TTL configured for their method, or the TTL the server marked the response
+// with using SetCacheable. Calls which fail aren't cached. It should only be
+// applied to methods whose results may be reused, such as reads of reference
+// data. Apply it to a client when creating it:
+//
+//	client := music.NewFStoreClient(provider, frugal.NewCacheMiddleware(frugal.FCacheConfig{
+//		MethodTTLs: map[string]time.Duration{"getAlbum": time.Minute},
+//	}))
+//
+// Cached results are shared by every call they're returned to, so they must
+// not be modified.
+func NewCacheMiddleware(config FCacheConfig) ServiceMiddleware {
+	if config.Cache == nil {
+		config.Cache = NewFMemoryResponseCache(defaultResponseCacheSize)
+	}
+	return func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			ctx := args.Context()
+			key, ok := cacheKey(method.Name, ctx, args[1:], config.VaryHeaders)
+			if !ok {
+				return next(service, method, args)
+			}
+			if results, ok := config.Cache.Get(key); ok {
+				return append(Results(nil), results...)
+			}
+
+			results := next(service, method, args)
+			if results.Error() != nil {
+				return results
+			}
+			ttl := config.MethodTTLs[method.Name]
+			if value, ok := ctx.ResponseHeader(cacheTTLHeader); ok {
+				millis, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					logger().Warnf("frugal: invalid cache TTL %q in response to %s", value, method.Name)
+					return results
+				}
+				ttl = time.Duration(millis) * time.Millisecond
+			}
+			if ttl > 0 {
+				config.Cache.Set(key, append(Results(nil), results...), ttl)
+			}
+			return results
+		}
+	}
+}
+
+// cacheKey returns the key caching the results of a call to the given method
+// with the given arguments, or false if the arguments can't be serialized.
+func cacheKey(method string, ctx FContext, args []interface{}, varyHeaders []string) (string, bool) {
+	serialized, err := json.Marshal(args)
+	if err != nil {
+		return "", false
+	}
+	var key bytes.Buffer
+	key.WriteString(method)
+	for _, name := range varyHeaders {
+		value, _ := ctx.RequestHeader(name)
+		key.WriteByte(0)
+		key.WriteString(value)
+	}
+	key.WriteByte(0)
+	key.Write(serialized)
+	return key.String(), true
+}
+
+// fMemoryResponseCache is an FResponseCache holding a bounded number of
+// results in memory, evicting the least recently used.
+type fMemoryResponseCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+// responseCacheEntry is an entry of an fMemoryResponseCache.
+type responseCacheEntry struct {
+	key     string
+	results Results
+	expires time.Time
+}
+
+// NewFMemoryResponseCache creates a new FResponseCache holding up to the
+// given number of results in memory, evicting the least recently used when
+// full.
+func NewFMemoryResponseCache(maxEntries uint) FResponseCache {
+	if maxEntries == 0 {
+		maxEntries = 1
+	}
+	return &fMemoryResponseCache{
+		maxEntries: int(maxEntries),
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Get returns the unexpired results cached for the given key.
+func (c *fMemoryResponseCache) Get(key string) (Results, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*responseCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry.results, true
+}
+
+// Set caches the given results under the given key for the given TTL.
+func (c *fMemoryResponseCache) Set(key string, results Results, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &responseCacheEntry{key: key, results: results, expires: time.Now().Add(ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*responseCacheEntry).key)
+	}
+}
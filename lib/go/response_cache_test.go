@@ -0,0 +1,108 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures results are cached per method, arguments, and vary headers for the
+// configured TTL, and failures aren't cached.
+func TestCacheMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	calls := 0
+	var err error
+	handler := NewCacheMiddleware(FCacheConfig{
+		MethodTTLs:  map[string]time.Duration{"getUser": 50 * time.Millisecond},
+		VaryHeaders: []string{"tenant"},
+	})(func(service reflect.Value, method reflect.Method, args Arguments) Results {
+		calls++
+		return Results{calls, err}
+	})
+	invoke := func(method, tenant string, id int) interface{} {
+		ctx := NewFContext("")
+		ctx.AddRequestHeader("tenant", tenant)
+		return handler(reflect.Value{}, reflect.Method{Name: method}, Arguments{ctx, id})[0]
+	}
+
+	assert.Equal(1, invoke("getUser", "acme", 1))
+	assert.Equal(1, invoke("getUser", "acme", 1))
+	assert.Equal(2, invoke("getUser", "acme", 2))
+	assert.Equal(3, invoke("getUser", "other", 1))
+	assert.Equal(4, invoke("setUser", "acme", 1))
+	assert.Equal(5, invoke("setUser", "acme", 1))
+
+	time.Sleep(60 * time.Millisecond)
+	err = errors.New("unavailable")
+	assert.Equal(6, invoke("getUser", "acme", 1))
+	err = nil
+	assert.Equal(7, invoke("getUser", "acme", 1))
+	assert.Equal(7, invoke("getUser", "acme", 1))
+}
+
+// Ensures the TTL servers mark responses with overrides the configured TTL.
+func TestCacheMiddlewareServerTTL(t *testing.T) {
+	assert := assert.New(t)
+	calls := 0
+	ttl := "60000"
+	handler := NewCacheMiddleware(FCacheConfig{
+		MethodTTLs: map[string]time.Duration{"getUser": time.Minute},
+	})(func(service reflect.Value, method reflect.Method, args Arguments) Results {
+		calls++
+		args.Context().AddResponseHeader(cacheTTLHeader, ttl)
+		return Results{calls, nil}
+	})
+	invoke := func(method string) interface{} {
+		return handler(reflect.Value{}, reflect.Method{Name: method}, Arguments{NewFContext("")})[0]
+	}
+
+	assert.Equal(1, invoke("listCountries"))
+	assert.Equal(1, invoke("listCountries"))
+	ttl = "0"
+	assert.Equal(2, invoke("getUser"))
+	assert.Equal(3, invoke("getUser"))
+
+	ctx := NewFContext("")
+	SetCacheable(ctx, time.Second)
+	value, _ := ctx.ResponseHeader(cacheTTLHeader)
+	assert.Equal("1000", value)
+	assert.True(IsReservedResponseHeader(cacheTTLHeader))
+}
+
+// Ensures the memory cache evicts the least recently used results and
+// expires results after their TTL.
+func TestFMemoryResponseCache(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewFMemoryResponseCache(2)
+	cache.Set("a", Results{1}, time.Minute)
+	cache.Set("b", Results{2}, time.Minute)
+	_, ok := cache.Get("a")
+	assert.True(ok)
+	cache.Set("c", Results{3}, time.Minute)
+	_, ok = cache.Get("b")
+	assert.False(ok)
+	results, ok := cache.Get("a")
+	assert.True(ok)
+	assert.Equal(Results{1}, results)
+
+	cache.Set("a", Results{4}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_, ok = cache.Get("a")
+	assert.False(ok)
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	defaultRetryInitialBackoff = 50 * time.Millisecond
+	defaultRetryMaxBackoff     = 2 * time.Second
+)
+
+// FRetryPolicy controls how NewRetryMiddleware retries calls which fail
+// transiently. Retries use exponential backoff with full jitter, and all
+// attempts share the call's FContext timeout, so a call is never retried past
+// its deadline.
+type FRetryPolicy struct {
+	// MaxAttempts is the most times a call is made, including the first
+	// attempt. Values below two disable retries.
+	MaxAttempts uint
+
+	// Retryable reports whether a call made with the given FContext which
+	// failed with the given error should be retried. If nil, DefaultRetryable
+	// is used.
+	Retryable func(ctx FContext, err error) bool
+
+	// InitialBackoff is the most time waited before the first retry. Each
+	// later retry doubles it. Defaults to 50ms.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the time waited before any retry. Defaults to 2s.
+	MaxBackoff time.Duration
+
+	// Budget, if set, limits the retries made by all calls sharing it.
+	Budget *FRetryBudget
+}
+
+// DefaultRetryable indicates if a call made with the given FContext which
+// failed with the given error should be retried. Calls the server rejected
+// without processing, because it was overloaded, rate limited, or draining,
+// are retried, as are calls which failed because the transport wasn't open.
+// Other transport failures are only retried for calls marked with
+// SetIdempotent, since the request may have reached the server. Timeouts and
+// cancellations are never retried.
+func DefaultRetryable(ctx FContext, err error) bool {
+	switch e := err.(type) {
+	case thrift.TApplicationException:
+		switch e.TypeId() {
+		case APPLICATION_EXCEPTION_SERVER_OVERLOADED, APPLICATION_EXCEPTION_RATE_LIMITED,
+			APPLICATION_EXCEPTION_SERVER_DRAINING:
+			return true
+		}
+	case thrift.TTransportException:
+		switch e.TypeId() {
+		case TRANSPORT_EXCEPTION_NOT_OPEN:
+			return true
+		case TRANSPORT_EXCEPTION_UNKNOWN, TRANSPORT_EXCEPTION_END_OF_FILE:
+			return IsIdempotent(ctx)
+		}
+	}
+	return false
+}
+
+// FRetryBudget limits the retries made by the calls sharing it to a ratio of
+// the calls made, so retries can't multiply the load on a struggling server.
+// It's safe for concurrent use.
+type FRetryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	burst  float64
+	tokens float64
+}
+
+// NewFRetryBudget creates a new FRetryBudget which allows retries of up to
+// the given ratio of calls, such as 0.1 to allow one retry for every ten
+// calls, with bursts of up to the given number of retries.
+func NewFRetryBudget(ratio float64, burst uint) *FRetryBudget {
+	return &FRetryBudget{ratio: ratio, burst: float64(burst), tokens: float64(burst)}
+}
+
+// deposit credits the budget for a call.
+func (b *FRetryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.tokens += b.ratio
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.mu.Unlock()
+}
+
+// withdraw takes a retry from the budget, returning false if it's exhausted.
+func (b *FRetryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// NewRetryMiddleware returns ServiceMiddleware which retries calls according
+// to the given policy. A retry is only made if it can start before the call's
+// FContext timeout elapses, and each retry's timeout is the time remaining.
+// Calls rejected with APPLICATION_EXCEPTION_RATE_LIMITED wait at least as
+// long as the server's RetryAfter hint. Apply it to a client when creating
+// it:
+//
+//	client := music.NewFStoreClient(provider, frugal.NewRetryMiddleware(frugal.FRetryPolicy{MaxAttempts: 3}))
+//
+// Retries reuse the call's FContext, so the response headers seen by the
+// caller are those of the last attempt.
+func NewRetryMiddleware(policy FRetryPolicy) ServiceMiddleware {
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = DefaultRetryable
+	}
+	initial, max := policy.InitialBackoff, policy.MaxBackoff
+	if initial <= 0 {
+		initial = defaultRetryInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultRetryMaxBackoff
+	}
+	return func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			ctx := args.Context()
+			timeout := ctx.Timeout()
+			deadline := time.Now().Add(timeout)
+			defer ctx.SetTimeout(timeout)
+			policy.Budget.deposit()
+			for attempt := uint(1); ; attempt++ {
+				results := next(service, method, args)
+				err := results.Error()
+				if err == nil || attempt >= policy.MaxAttempts || !retryable(ctx, err) {
+					return results
+				}
+
+				backoff := jitteredBackoff(initial, max, attempt)
+				if retryAfter, ok := retryAfterError(ctx, err); ok && retryAfter > backoff {
+					backoff = retryAfter
+				}
+				if time.Now().Add(backoff).After(deadline) || !policy.Budget.withdraw() {
+					return results
+				}
+				logger().Debugf("frugal: retrying %s after %s: %s", method.Name, backoff, err)
+				timer := time.NewTimer(backoff)
+				select {
+				case <-timer.C:
+				case <-contextDone(ctx):
+					timer.Stop()
+					return results
+				}
+				ctx.SetTimeout(time.Until(deadline))
+			}
+		}
+	}
+}
+
+// retryAfterError returns the server's hint of when a call which failed with
+// the given error can be retried, if it was rate limited.
+func retryAfterError(ctx FContext, err error) (time.Duration, bool) {
+	if ex, ok := err.(thrift.TApplicationException); !ok || ex.TypeId() != APPLICATION_EXCEPTION_RATE_LIMITED {
+		return 0, false
+	}
+	return RetryAfter(ctx)
+}
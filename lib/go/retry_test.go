@@ -0,0 +1,140 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingHandler returns an InvocationHandler which fails with the given
+// errors in turn, then succeeds, recording each call's timeout.
+func failingHandler(timeouts *[]time.Duration, errs ...error) InvocationHandler {
+	return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+		*timeouts = append(*timeouts, args.Context().Timeout())
+		if len(errs) == 0 {
+			return Results{"ok", nil}
+		}
+		err := errs[0]
+		errs = errs[1:]
+		return Results{"", err}
+	}
+}
+
+var overloadedErr = thrift.NewTApplicationException(APPLICATION_EXCEPTION_SERVER_OVERLOADED, "overloaded")
+
+// Ensures retryable failures are retried up to the maximum attempts, with the
+// remaining time as the timeout, and the original timeout restored after.
+func TestRetryMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	var timeouts []time.Duration
+	handler := NewRetryMiddleware(FRetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond})(
+		failingHandler(&timeouts, overloadedErr, overloadedErr))
+	ctx := NewFContext("").SetTimeout(time.Second)
+
+	results := handler(reflect.Value{}, reflect.Method{Name: "Get"}, Arguments{ctx})
+	assert.Nil(results.Error())
+	assert.Equal("ok", results[0])
+	assert.Len(timeouts, 3)
+	assert.Equal(time.Second, timeouts[0])
+	assert.True(timeouts[1] < time.Second)
+	assert.True(timeouts[2] < timeouts[1])
+	assert.Equal(time.Second, ctx.Timeout())
+
+	timeouts = nil
+	handler = NewRetryMiddleware(FRetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})(
+		failingHandler(&timeouts, overloadedErr, overloadedErr))
+	results = handler(reflect.Value{}, reflect.Method{Name: "Get"}, Arguments{NewFContext("")})
+	assert.Equal(overloadedErr, results.Error())
+	assert.Len(timeouts, 2)
+}
+
+// Ensures failures which aren't retryable, or can't be retried before the
+// timeout elapses, are returned without retrying.
+func TestRetryMiddlewareNotRetried(t *testing.T) {
+	assert := assert.New(t)
+	var timeouts []time.Duration
+	handler := NewRetryMiddleware(FRetryPolicy{MaxAttempts: 3})(
+		failingHandler(&timeouts, errors.New("error")))
+	results := handler(reflect.Value{}, reflect.Method{Name: "Get"}, Arguments{NewFContext("")})
+	assert.Equal(errors.New("error"), results.Error())
+	assert.Len(timeouts, 1)
+
+	timeouts = nil
+	handler = NewRetryMiddleware(FRetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second})(
+		failingHandler(&timeouts, overloadedErr))
+	ctx := NewFContext("").SetTimeout(time.Millisecond)
+	ctx.AddResponseHeader(retryAfterHeader, "1000")
+	results = handler(reflect.Value{}, reflect.Method{Name: "Get"}, Arguments{ctx})
+	assert.Equal(overloadedErr, results.Error())
+	assert.Len(timeouts, 1)
+}
+
+// Ensures rate limited calls wait for the server's retry hint.
+func TestRetryMiddlewareRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+	var timeouts []time.Duration
+	rateLimited := thrift.NewTApplicationException(APPLICATION_EXCEPTION_RATE_LIMITED, "rate limited")
+	handler := NewRetryMiddleware(FRetryPolicy{MaxAttempts: 2, InitialBackoff: time.Nanosecond})(
+		failingHandler(&timeouts, rateLimited))
+	ctx := NewFContext("")
+	ctx.AddResponseHeader(retryAfterHeader, "20")
+
+	start := time.Now()
+	results := handler(reflect.Value{}, reflect.Method{Name: "Get"}, Arguments{ctx})
+	assert.Nil(results.Error())
+	assert.True(time.Since(start) >= 20*time.Millisecond)
+}
+
+// Ensures a shared retry budget limits retries to its ratio of calls.
+func TestRetryBudget(t *testing.T) {
+	assert := assert.New(t)
+	budget := NewFRetryBudget(0.5, 1)
+	var timeouts []time.Duration
+	handler := NewRetryMiddleware(FRetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond, Budget: budget})(
+		func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			timeouts = append(timeouts, args.Context().Timeout())
+			return Results{"", overloadedErr}
+		})
+
+	// The first call can spend the burst.
+	handler(reflect.Value{}, reflect.Method{Name: "Get"}, Arguments{NewFContext("")})
+	assert.Len(timeouts, 2)
+	// Each call then only earns half a retry.
+	handler(reflect.Value{}, reflect.Method{Name: "Get"}, Arguments{NewFContext("")})
+	assert.Len(timeouts, 3)
+	handler(reflect.Value{}, reflect.Method{Name: "Get"}, Arguments{NewFContext("")})
+	assert.Len(timeouts, 5)
+}
+
+// Ensures the default classification only retries calls which weren't
+// processed or are idempotent.
+func TestDefaultRetryable(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("")
+	assert.True(DefaultRetryable(ctx, overloadedErr))
+	assert.True(DefaultRetryable(ctx, thrift.NewTApplicationException(APPLICATION_EXCEPTION_SERVER_DRAINING, "")))
+	assert.False(DefaultRetryable(ctx, thrift.NewTApplicationException(APPLICATION_EXCEPTION_INTERNAL_ERROR, "")))
+	assert.True(DefaultRetryable(ctx, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN, "")))
+	assert.False(DefaultRetryable(ctx, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "")))
+	assert.False(DefaultRetryable(ctx, thrift.NewTTransportException(TRANSPORT_EXCEPTION_END_OF_FILE, "")))
+	SetIdempotent(ctx)
+	assert.True(DefaultRetryable(ctx, thrift.NewTTransportException(TRANSPORT_EXCEPTION_END_OF_FILE, "")))
+	assert.False(DefaultRetryable(ctx, errors.New("error")))
+}
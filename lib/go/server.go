@@ -23,3 +23,37 @@ type FServer interface {
 	// servers are required to be cleanly stoppable.
 	Stop() error
 }
+
+// FOverflowPolicy controls how a server handles requests which it can't
+// accept straight away, such as those which arrive while its work queue is
+// full.
+type FOverflowPolicy int
+
+const (
+	// FOverflowBackpressure waits until the request can be accepted, which
+	// stops the server from receiving further requests in the meantime. This
+	// is the default.
+	FOverflowBackpressure FOverflowPolicy = iota
+
+	// FOverflowReject immediately responds to the request with a
+	// TApplicationException of type APPLICATION_EXCEPTION_SERVER_OVERLOADED
+	// so the client can fail fast or retry elsewhere.
+	FOverflowReject
+)
+
+// FDrainableServer is an FServer which can drain before it's stopped. The
+// servers provided by Frugal implement it, which can be checked for with a
+// type assertion:
+//
+//	if drainable, ok := server.(frugal.FDrainableServer); ok {
+//		drainable.SetDraining(true)
+//	}
+type FDrainableServer interface {
+	FServer
+
+	// SetDraining sets whether the server is draining. While draining, the
+	// server keeps processing the requests in flight, but responds to new
+	// requests with an APPLICATION_EXCEPTION_SERVER_DRAINING error, so
+	// clients can retry them against another server before it's stopped.
+	SetDraining(draining bool)
+}
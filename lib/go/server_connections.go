@@ -0,0 +1,145 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"sync"
+	"time"
+)
+
+// serverConnections tracks the client connections of a server which serves
+// framed requests over streams, so they can be closed, or drained, when it is
+// stopped.
+type serverConnections struct {
+	mu       sync.Mutex
+	conns    map[*serverConnection]struct{}
+	draining bool
+}
+
+// serverConnection is a client connection of a server. It is busy while a
+// request read from it is being processed.
+type serverConnection struct {
+	conns *serverConnections
+	close func() error
+	busy  bool
+}
+
+func newServerConnections() *serverConnections {
+	return &serverConnections{conns: make(map[*serverConnection]struct{})}
+}
+
+// add tracks a connection closed with the given function. It returns false if
+// the server is stopping, in which case the connection should be closed.
+func (s *serverConnections) add(close func() error) (*serverConnection, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return nil, false
+	}
+	conn := &serverConnection{conns: s, close: close}
+	s.conns[conn] = struct{}{}
+	return conn, true
+}
+
+// remove stops tracking the given connection once it is no longer served.
+func (s *serverConnections) remove(conn *serverConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *serverConnections) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// closeAll closes every connection, including those with requests being
+// processed, and stops new connections from being served.
+func (s *serverConnections) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+	for conn := range s.conns {
+		conn.close()
+	}
+}
+
+// drain stops new connections from being served and closes idle ones. Busy
+// connections are closed once the request being processed has been
+// responded to. This blocks until every connection has been closed, or the
+// timeout elapses, when the remaining connections are closed.
+func (s *serverConnections) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	s.mu.Lock()
+	s.draining = true
+	for conn := range s.conns {
+		if !conn.busy {
+			conn.close()
+		}
+	}
+	s.mu.Unlock()
+
+	for s.len() > 0 {
+		if time.Now().After(deadline) {
+			logger().Warnf("frugal: server drain timed out with %d connections busy", s.len())
+			break
+		}
+		time.Sleep(drainPollInterval)
+	}
+	s.closeAll()
+}
+
+// begin marks the connection busy as a request arrives on it. It returns false
+// if the server is draining, in which case the request should not be
+// processed. A nil connection is never drained.
+func (c *serverConnection) begin() bool {
+	if c == nil {
+		return true
+	}
+	c.conns.mu.Lock()
+	defer c.conns.mu.Unlock()
+	if c.conns.draining {
+		return false
+	}
+	c.busy = true
+	return true
+}
+
+// end marks the connection idle once a request has been processed. If the
+// server is draining, the connection is closed and false is returned.
+func (c *serverConnection) end() bool {
+	if c == nil {
+		return true
+	}
+	c.conns.mu.Lock()
+	defer c.conns.mu.Unlock()
+	c.busy = false
+	if c.conns.draining {
+		c.close()
+		return false
+	}
+	return true
+}
+
+// stopping indicates if the server is stopping, so errors from closing the
+// connection can be ignored.
+func (c *serverConnection) stopping() bool {
+	if c == nil {
+		return false
+	}
+	c.conns.mu.Lock()
+	defer c.conns.mu.Unlock()
+	return c.conns.draining
+}
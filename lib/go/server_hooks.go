@@ -0,0 +1,136 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import "time"
+
+// FRequestInfo describes a request processed by a server, as reported to its
+// FServerHooks.
+type FRequestInfo struct {
+	// Method is the name of the method the request is for.
+	Method string
+
+	// CorrelationID is the correlation id of the request.
+	CorrelationID string
+
+	// Duration is how long the request took to process. It's only set once
+	// the request has completed.
+	Duration time.Duration
+
+	// Err is the error which occurred processing the request, if any, such
+	// as an unexpected error returned by its handler. It's only set once the
+	// request has completed.
+	Err error
+}
+
+// FServerHooks are callbacks a server invokes as it starts, stops, and
+// processes requests, so operational tooling can observe it. Callbacks which
+// are nil are skipped. Request callbacks are invoked by the goroutines
+// processing the requests, so must be safe for concurrent use. Cancellations,
+// and requests a server rejects before passing them to its processor, aren't
+// reported.
+type FServerHooks struct {
+	// OnStart is called once the server is ready to receive requests.
+	OnStart func()
+
+	// OnStop is called when Serve returns.
+	OnStop func()
+
+	// OnRequestReceived is called before a request is processed.
+	OnRequestReceived func(info FRequestInfo)
+
+	// OnRequestCompleted is called after a request has been processed and
+	// its response, if any, written.
+	OnRequestCompleted func(info FRequestInfo)
+}
+
+func (h *FServerHooks) started() {
+	if h != nil && h.OnStart != nil {
+		h.OnStart()
+	}
+}
+
+func (h *FServerHooks) stopped() {
+	if h != nil && h.OnStop != nil {
+		h.OnStop()
+	}
+}
+
+// requestOutcome records the error which occurred processing a request,
+// which processors otherwise log rather than return.
+type requestOutcome struct {
+	err error
+}
+
+// recordError records the given error processing the request read from the
+// protocol, if its server has hooks.
+func (f *FProtocol) recordError(err error) {
+	if f.outcome != nil && err != nil {
+		f.outcome.err = err
+	}
+}
+
+// hooksProcessor is an FProcessor which reports the requests it processes to
+// a server's FServerHooks.
+type hooksProcessor struct {
+	FProcessor
+	hooks *FServerHooks
+}
+
+// newHooksProcessor returns the given processor wrapped to report requests to
+// the given hooks, or the processor itself if there are no request hooks.
+func newHooksProcessor(processor FProcessor, hooks *FServerHooks) FProcessor {
+	if hooks == nil || (hooks.OnRequestReceived == nil && hooks.OnRequestCompleted == nil) {
+		return processor
+	}
+	return &hooksProcessor{FProcessor: processor, hooks: hooks}
+}
+
+// Process reads the request headers and message begin, then processes the
+// request, invoking the request hooks around it.
+func (h *hooksProcessor) Process(iprot, oprot *FProtocol) error {
+	request, err := iprot.peekRequestHeaders()
+	if err != nil {
+		return err
+	}
+	replay := headerReplay(iprot)
+	if _, ok := request.header(cancelHeader); ok {
+		return h.FProcessor.Process(replay(), oprot)
+	}
+	name, typeID, seqID, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	proto := replay()
+	proto.TProtocol = &replayedMessageProtocol{TProtocol: proto.TProtocol, name: name, typeID: typeID, seqID: seqID}
+	outcome := &requestOutcome{}
+	proto.outcome = outcome
+
+	cid, _ := request.header(cidHeader)
+	info := FRequestInfo{Method: name, CorrelationID: cid}
+	if h.hooks.OnRequestReceived != nil {
+		h.hooks.OnRequestReceived(info)
+	}
+	start := time.Now()
+	err = h.FProcessor.Process(proto, oprot)
+	if h.hooks.OnRequestCompleted != nil {
+		info.Duration = time.Since(start)
+		info.Err = err
+		if err == nil {
+			info.Err = outcome.err
+		}
+		h.hooks.OnRequestCompleted(info)
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// healthFunc is an FHealth implemented by a function.
+type healthFunc func(ctx FContext, service string) (FHealthStatus, error)
+
+func (f healthFunc) Check(ctx FContext, service string) (FHealthStatus, error) {
+	return f(ctx, service)
+}
+
+// Ensures servers invoke their hooks as they start, stop, and process
+// requests.
+func TestServerHooks(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	events := make(chan string, 10)
+	completed := make(chan FRequestInfo, 2)
+	hooks := &FServerHooks{
+		OnStart: func() { events <- "start" },
+		OnStop:  func() { events <- "stop" },
+		OnRequestReceived: func(info FRequestInfo) {
+			events <- "received " + info.Method + " " + info.CorrelationID
+		},
+		OnRequestCompleted: func(info FRequestInfo) { completed <- info },
+	}
+	handler := healthFunc(func(ctx FContext, service string) (FHealthStatus, error) {
+		if service == "broken" {
+			return HealthUnknown, errors.New("broken")
+		}
+		return HealthServing, nil
+	})
+	server := NewFTCPServer(NewFHealthProcessor(handler), "localhost:0", protocolFactory).WithHooks(hooks)
+	addr := newTCPTestServer(t, server)
+	assert.Equal("start", <-events)
+
+	transport, err := NewFTCPTransport(addr, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(transport.Open())
+	defer transport.Close()
+	client := NewFHealthClient(NewFServiceProvider(transport, protocolFactory))
+
+	_, err = client.Check(NewFContext("cid1"), "")
+	assert.Nil(err)
+	assert.Equal("received check cid1", <-events)
+	info := <-completed
+	assert.Equal("check", info.Method)
+	assert.Equal("cid1", info.CorrelationID)
+	assert.True(info.Duration > 0)
+	assert.Nil(info.Err)
+
+	_, err = client.Check(NewFContext("cid2"), "broken")
+	assert.Error(err)
+	assert.Equal("received check cid2", <-events)
+	info = <-completed
+	if ex, ok := info.Err.(thrift.TApplicationException); assert.True(ok) {
+		assert.Equal(int32(APPLICATION_EXCEPTION_INTERNAL_ERROR), ex.TypeId())
+	}
+
+	assert.Nil(server.Stop())
+	select {
+	case event := <-events:
+		assert.Equal("stop", event)
+	case <-time.After(time.Second):
+		t.Fatal("Expected server to stop")
+	}
+}
+
+// Ensures request hooks are invoked for requests from plain Thrift clients
+// of servers with interop enabled.
+func TestServerHooksThriftInterop(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithThriftInterop()
+	received := make(chan FRequestInfo, 1)
+	completed := make(chan FRequestInfo, 1)
+	hooks := &FServerHooks{
+		OnRequestReceived:  func(info FRequestInfo) { received <- info },
+		OnRequestCompleted: func(info FRequestInfo) { completed <- info },
+	}
+	transport := NewFLoopbackTransport(newHooksProcessor(&serviceProcessor{name: "plain"}, hooks), protocolFactory)
+	assert.Nil(transport.Open())
+
+	buffer := thrift.NewTMemoryBuffer()
+	assert.Nil(writeConformanceMessage(thrift.NewTBinaryProtocolFactoryDefault().GetProtocol(buffer), "conform", thrift.CALL))
+	result, err := transport.Request(NewFContext(""), prependFrameSize(buffer.Bytes()))
+	assert.Nil(err)
+	name, err := thrift.NewTBinaryProtocolTransport(result).ReadString()
+	assert.Nil(err)
+	assert.Equal("plain", name)
+	assert.Equal("conform", (<-received).Method)
+	info := <-completed
+	assert.Equal("conform", info.Method)
+	assert.Nil(info.Err)
+}
@@ -0,0 +1,310 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// serviceIDHeader identifies the service a request sent through an
+// FTransportMux is for.
+const serviceIDHeader = "_service"
+
+// FTransportMux shares one FTransport between the clients of several
+// services, such as to make calls to every service of a server over one TCP
+// or WebSocket connection rather than one per client. Requests are stamped
+// with the id of the service they are for, so an FServiceMux on the server
+// can route them to its processor. Responses are matched to requests by
+// their op id, which is unique within a process, as usual.
+//
+//	mux := frugal.NewFTransportMux(transport)
+//	albums := music.NewFAlbumsClient(frugal.NewFServiceProvider(mux.Transport("albums"), protocolFactory))
+//	store := music.NewFStoreClient(frugal.NewFServiceProvider(mux.Transport("store"), protocolFactory))
+type FTransportMux struct {
+	transport FTransport
+
+	mu    sync.Mutex
+	users int
+}
+
+// NewFTransportMux creates a new FTransportMux sharing the given FTransport.
+func NewFTransportMux(transport FTransport) *FTransportMux {
+	return &FTransportMux{transport: transport}
+}
+
+// Transport returns an FTransport for the service with the given id, which
+// sends requests over the shared FTransport. The shared FTransport is opened
+// with the first of these which is opened, and closed with the last which is
+// closed.
+func (m *FTransportMux) Transport(serviceID string) FTransport {
+	return &fMuxTransport{mux: m, headers: map[string]string{serviceIDHeader: serviceID}}
+}
+
+func (m *FTransportMux) open() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.users == 0 && !m.transport.IsOpen() {
+		if err := m.transport.Open(); err != nil {
+			return err
+		}
+	}
+	m.users++
+	return nil
+}
+
+func (m *FTransportMux) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users--
+	if m.users > 0 || !m.transport.IsOpen() {
+		return nil
+	}
+	return m.transport.Close()
+}
+
+// fMuxTransport implements FTransport for one service of an FTransportMux.
+type fMuxTransport struct {
+	mux     *FTransportMux
+	headers map[string]string
+
+	mu     sync.RWMutex
+	isOpen bool
+}
+
+// SetMonitor sets the monitor of the shared FTransport.
+func (f *fMuxTransport) SetMonitor(monitor FTransportMonitor) {
+	f.mux.transport.SetMonitor(monitor)
+}
+
+// Closed returns the Closed channel of the shared FTransport.
+func (f *fMuxTransport) Closed() <-chan error {
+	return f.mux.transport.Closed()
+}
+
+// Open opens the shared FTransport if it isn't already.
+func (f *fMuxTransport) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.isOpen {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: transport already open")
+	}
+	if err := f.mux.open(); err != nil {
+		return err
+	}
+	f.isOpen = true
+	return nil
+}
+
+// IsOpen returns true if the transport and the shared FTransport are open.
+func (f *fMuxTransport) IsOpen() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.isOpen && f.mux.transport.IsOpen()
+}
+
+// Close closes the transport, closing the shared FTransport if no other
+// service's transport is open.
+func (f *fMuxTransport) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.isOpen {
+		return nil
+	}
+	f.isOpen = false
+	return f.mux.close()
+}
+
+// Oneway stamps the given frame with the service id and sends it over the
+// shared FTransport.
+func (f *fMuxTransport) Oneway(ctx FContext, payload []byte) error {
+	if len(payload) == 4 {
+		return nil
+	}
+	payload, err := addHeadersToFrame(payload, f.headers)
+	if err != nil {
+		return err
+	}
+	return f.mux.transport.Oneway(ctx, payload)
+}
+
+// Request stamps the given frame with the service id and sends it over the
+// shared FTransport, waiting for the response.
+func (f *fMuxTransport) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	if len(payload) == 4 {
+		return nil, nil
+	}
+	payload, err := addHeadersToFrame(payload, f.headers)
+	if err != nil {
+		return nil, err
+	}
+	return f.mux.transport.Request(ctx, payload)
+}
+
+// GetRequestSizeLimit returns the request size limit of the shared
+// FTransport.
+func (f *fMuxTransport) GetRequestSizeLimit() uint {
+	return f.mux.transport.GetRequestSizeLimit()
+}
+
+// FServiceMux is an FProcessor which routes requests sent with an
+// FTransportMux to the processor registered for their service id, so several
+// services can be served by one FServer. Requests without a service id are
+// routed to the default processor, if one is set, so clients which don't use
+// an FTransportMux can still call it.
+type FServiceMux struct {
+	protocolFactory *FProtocolFactory
+
+	mu         sync.RWMutex
+	processors map[string]FProcessor
+	fallback   FProcessor
+	writeMu    sync.Mutex
+}
+
+// NewFServiceMux creates a new FServiceMux. It must be given the protocol
+// factory of the server it's used with.
+func NewFServiceMux(protocolFactory *FProtocolFactory) *FServiceMux {
+	return &FServiceMux{protocolFactory: protocolFactory, processors: make(map[string]FProcessor)}
+}
+
+// Register routes requests for the service with the given id to the given
+// processor. This should only be called before the server is started.
+func (m *FServiceMux) Register(serviceID string, processor FProcessor) *FServiceMux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.processors[serviceID] = processor
+	return m
+}
+
+// WithDefault routes requests which don't have a service id to the given
+// processor.
+func (m *FServiceMux) WithDefault(processor FProcessor) *FServiceMux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fallback = processor
+	return m
+}
+
+// Process reads the request headers, then processes the request with the
+// processor for its service id. Cancellations don't carry a service id, so
+// they are passed to every processor.
+func (m *FServiceMux) Process(iprot, oprot *FProtocol) error {
+	request, err := iprot.peekRequestHeaders()
+	if err != nil {
+		return err
+	}
+	// Replay the headers to the processor along with the rest of the
+	// request. The service id is a per-hop header, so it isn't propagated by
+	// handlers which pass their FContext on to other services.
+	serviceID, ok := request.header(serviceIDHeader)
+	replay := headerReplay(iprot)
+
+	if _, ok := request.header(cancelHeader); ok {
+		for _, processor := range m.allProcessors() {
+			if err := processor.Process(replay(), oprot); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	m.mu.RLock()
+	processor := m.fallback
+	if ok {
+		processor = m.processors[serviceID]
+	}
+	m.mu.RUnlock()
+	if processor != nil {
+		return processor.Process(replay(), oprot)
+	}
+	return m.unknownService(replay(), oprot, serviceID)
+}
+
+// headerReplay returns a function which produces protocols reading the
+// headers peeked from the input protocol, followed by the rest of the
+// request, so the request can be passed on to other processors. The protocols
+// read from the input protocol's transport, so each protocol produced for a
+// request with a message must be read from before the next. The input
+// protocol no longer holds the peeked headers, so the next request it reads
+// is read from its transport.
+func headerReplay(iprot *FProtocol) func() *FProtocol {
+	peeked := iprot.peeked
+	iprot.peeked = nil
+	return func() *FProtocol {
+		proto := *iprot
+		proto.peeked = peeked
+		return &proto
+	}
+}
+
+// unknownService responds to a request for a service which isn't registered.
+func (m *FServiceMux) unknownService(iprot, oprot *FProtocol, serviceID string) error {
+	ctx, err := iprot.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	name, _, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	if err := iprot.Skip(thrift.STRUCT); err != nil {
+		return err
+	}
+	if err := iprot.ReadMessageEnd(); err != nil {
+		return err
+	}
+	logger().Warnf("frugal: client invoked %s on unknown service %q on request with correlation id %s",
+		name, serviceID, ctx.CorrelationID())
+	ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN_METHOD,
+		"Unknown service "+serviceID)
+	iprot.recordError(ex)
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	return writeExceptionResponse(oprot, ctx, name, ex)
+}
+
+func (m *FServiceMux) allProcessors() []FProcessor {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	processors := make([]FProcessor, 0, len(m.processors)+1)
+	for _, processor := range m.processors {
+		processors = append(processors, processor)
+	}
+	if m.fallback != nil {
+		processors = append(processors, m.fallback)
+	}
+	return processors
+}
+
+// AddMiddleware adds the given ServiceMiddleware to every registered
+// processor.
+func (m *FServiceMux) AddMiddleware(middleware ServiceMiddleware) {
+	for _, processor := range m.allProcessors() {
+		processor.AddMiddleware(middleware)
+	}
+}
+
+// Annotations returns the annotations of the methods of every registered
+// processor.
+func (m *FServiceMux) Annotations() map[string]map[string]string {
+	annotations := make(map[string]map[string]string)
+	for _, processor := range m.allProcessors() {
+		for method, methodAnnotations := range processor.Annotations() {
+			annotations[method] = methodAnnotations
+		}
+	}
+	return annotations
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// serviceProcessor responds to requests with its name.
+type serviceProcessor struct {
+	processor
+	name string
+
+	mu        sync.Mutex
+	cancelled int
+	headers   map[string]string
+}
+
+func (p *serviceProcessor) Process(in, out *FProtocol) error {
+	ctx, err := in.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := ctx.RequestHeader(cancelHeader); ok {
+		p.cancelled++
+		return nil
+	}
+	p.headers = ctx.RequestHeaders()
+	out.WriteResponseHeader(ctx)
+	out.WriteString(p.name)
+	return out.Flush()
+}
+
+func (p *serviceProcessor) Annotations() map[string]map[string]string {
+	return map[string]map[string]string{p.name: {"service": p.name}}
+}
+
+func newServiceMuxRequest(t *testing.T, ctx FContext, method string) []byte {
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).GetProtocol(buffer)
+	assert.Nil(t, proto.WriteRequestHeader(ctx))
+	if method != "" {
+		assert.Nil(t, proto.WriteMessageBegin(method, thrift.CALL, 0))
+		assert.Nil(t, proto.WriteStructBegin("args"))
+		assert.Nil(t, proto.WriteFieldStop())
+		assert.Nil(t, proto.WriteStructEnd())
+		assert.Nil(t, proto.WriteMessageEnd())
+	}
+	return buffer.Bytes()
+}
+
+// Ensures requests from the clients of several services share one
+// FTransport and are routed to their service's processor.
+func TestServiceMux(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	albums := &serviceProcessor{name: "albums"}
+	store := &serviceProcessor{name: "store"}
+	fallback := &serviceProcessor{name: "default"}
+	mux := NewFServiceMux(protocolFactory).
+		Register("albums", albums).
+		Register("store", store).
+		WithDefault(fallback)
+	assert.Equal(map[string]string{"service": "store"}, mux.Annotations()["store"])
+	shared := NewFLoopbackTransport(mux, protocolFactory)
+	transportMux := NewFTransportMux(shared)
+
+	for _, transport := range []FTransport{transportMux.Transport("albums"), transportMux.Transport("store"), shared} {
+		if transport != shared {
+			assert.Nil(transport.Open())
+		}
+		result, err := transport.Request(NewFContext("cid"), newServiceMuxRequest(t, NewFContext("cid"), ""))
+		assert.Nil(err)
+		proto := protocolFactory.GetProtocol(result)
+		assert.Nil(proto.ReadResponseHeader(NewFContext("")))
+		name, err := proto.ReadString()
+		assert.Nil(err)
+		if transport == shared {
+			assert.Equal("default", name)
+		}
+	}
+	assert.True(shared.IsOpen())
+	assert.NotContains(albums.headers, serviceIDHeader)
+
+	// Cancellations are passed to every processor.
+	_, err := shared.Request(NewFContext("cid"), newCancelFrame(NewFContext("cid")))
+	assert.Nil(err)
+	assert.Equal(1, albums.cancelled)
+	assert.Equal(1, store.cancelled)
+	assert.Equal(1, fallback.cancelled)
+}
+
+// Ensures requests for unknown services fail with an exception.
+func TestServiceMuxUnknownService(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	mux := NewFServiceMux(protocolFactory).Register("albums", &serviceProcessor{name: "albums"})
+	transport := NewFTransportMux(NewFLoopbackTransport(mux, protocolFactory)).Transport("store")
+	assert.Nil(transport.Open())
+
+	result, err := transport.Request(NewFContext("cid"), newServiceMuxRequest(t, NewFContext("cid"), "ping"))
+	assert.Nil(err)
+	proto := protocolFactory.GetProtocol(result)
+	assert.Nil(proto.ReadResponseHeader(NewFContext("")))
+	name, typeID, _, err := proto.ReadMessageBegin()
+	assert.Nil(err)
+	assert.Equal("ping", name)
+	assert.Equal(thrift.EXCEPTION, typeID)
+	ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN, "")
+	ex, err = ex.Read(proto)
+	assert.Nil(err)
+	assert.Equal(int32(APPLICATION_EXCEPTION_UNKNOWN_METHOD), ex.TypeId())
+}
+
+// Ensures the shared FTransport is opened with the first service transport
+// and closed with the last.
+func TestTransportMuxOpenClose(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	shared := NewFLoopbackTransport(&serviceProcessor{}, protocolFactory)
+	mux := NewFTransportMux(shared)
+	albums, store := mux.Transport("albums"), mux.Transport("store")
+
+	assert.False(albums.IsOpen())
+	assert.Nil(albums.Open())
+	err := albums.Open()
+	assert.Equal(TRANSPORT_EXCEPTION_ALREADY_OPEN, err.(thrift.TTransportException).TypeId())
+	assert.Nil(store.Open())
+	assert.True(shared.IsOpen())
+	assert.Nil(albums.Close())
+	assert.False(albums.IsOpen())
+	assert.True(store.IsOpen())
+	assert.Nil(store.Close())
+	assert.False(shared.IsOpen())
+}
+
+// Ensures replayed protocols read the peeked headers lazily from the input
+// protocol's transport.
+func TestHeaderReplay(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	buffer := NewTMemoryOutputBuffer(0)
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("foo", "bar")
+	assert.Nil(protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx))
+	iprot := protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(buffer.Bytes()[4:])})
+
+	request, err := iprot.peekRequestHeaders()
+	assert.Nil(err)
+	cid, ok := request.header(cidHeader)
+	assert.True(ok)
+	assert.Equal("cid", cid)
+	replay := headerReplay(iprot)
+	assert.Nil(iprot.peeked)
+
+	for i := 0; i < 2; i++ {
+		proto := replay()
+		assert.Equal(iprot.Transport(), proto.Transport())
+		read, err := proto.ReadRequestHeader()
+		assert.Nil(err)
+		assert.Equal(int32(1), read.(*FContextImpl).lazy)
+		foo, _ := read.RequestHeader("foo")
+		assert.Equal("bar", foo)
+		assert.Equal("cid", read.CorrelationID())
+	}
+}
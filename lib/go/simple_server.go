@@ -14,6 +14,8 @@
 package frugal
 
 import (
+	"time"
+
 	"git.apache.org/thrift.git/lib/go/thrift"
 )
 
@@ -24,6 +26,16 @@ type FSimpleServer struct {
 	processor       FProcessor
 	serverTransport thrift.TServerTransport
 	protocolFactory *FProtocolFactory
+	drainTimeout    time.Duration
+	conns           *serverConnections
+	workerCount     uint
+	queueLen        uint
+	overflow        FOverflowPolicy
+	health          FHealth
+	reflection      FReflection
+	admission       FAdmissionController
+	hooks           *FServerHooks
+	draining        drainSwitch
 }
 
 // NewFSimpleServer creates a new FSimpleServer which is a simple FServer that
@@ -38,9 +50,86 @@ func NewFSimpleServer(
 		serverTransport: serverTransport,
 		protocolFactory: protocolFactory,
 		quit:            make(chan struct{}, 1),
+		conns:           newServerConnections(),
 	}
 }
 
+// WithDrainTimeout enables graceful shutdown. When the server is stopped, it
+// stops accepting connections and reading requests, finishes processing the
+// requests it is serving and sends their responses, then closes the client
+// connections, waiting at most the given timeout. By default, Stop only stops
+// accepting connections. Returns the same FSimpleServer to allow for chaining
+// calls.
+func (p *FSimpleServer) WithDrainTimeout(timeout time.Duration) *FSimpleServer {
+	p.drainTimeout = timeout
+	return p
+}
+
+// WithWorkerPool limits the server to processing the given number of requests
+// at once across all of its connections. Requests which arrive while every
+// worker is busy wait for one, up to the given queue length, beyond which they
+// are handled according to the overflow policy. Requests on a connection are
+// processed in order, so a waiting request stops the server from reading
+// further requests from its connection. By default, every connection is
+// processed independently. Returns the same FSimpleServer to allow for
+// chaining calls.
+func (p *FSimpleServer) WithWorkerPool(workerCount, queueLength uint) *FSimpleServer {
+	p.workerCount = workerCount
+	p.queueLen = queueLength
+	return p
+}
+
+// WithOverflowPolicy controls how requests which arrive while the worker pool
+// queue is full are handled. FOverflowBackpressure, the default, waits for a
+// worker regardless, while FOverflowReject responds with a
+// TApplicationException of type APPLICATION_EXCEPTION_SERVER_OVERLOADED so
+// the client can retry elsewhere. Returns the same FSimpleServer to allow for
+// chaining calls.
+func (p *FSimpleServer) WithOverflowPolicy(policy FOverflowPolicy) *FSimpleServer {
+	p.overflow = policy
+	return p
+}
+
+// WithHealthService serves the given health service alongside the server's
+// processor. Health checks are routed to it by an FServiceMux, under the
+// HealthService service id, so clients must send them through an
+// FTransportMux. If the server's processor is an FServiceMux, the health
+// service is registered with it. Returns the same FSimpleServer to allow for
+// chaining calls.
+func (p *FSimpleServer) WithHealthService(health FHealth) *FSimpleServer {
+	p.health = health
+	return p
+}
+
+// WithReflectionService serves the given reflection service alongside the
+// server's processor, under the ReflectionService service id, in the same
+// way as WithHealthService. Returns the same FSimpleServer to allow for
+// chaining calls.
+func (p *FSimpleServer) WithReflectionService(reflection FReflection) *FSimpleServer {
+	p.reflection = reflection
+	return p
+}
+
+// WithAdmissionController sheds load by asking the given FAdmissionController
+// whether to process each request once its headers have been read. Requests
+// it rejects are responded to with an APPLICATION_EXCEPTION_SERVER_OVERLOADED
+// error. With a worker pool, InFlight counts the requests waiting for a
+// worker along with those being processed, and requests are checked once
+// they have a worker. Returns the same FSimpleServer to allow for chaining
+// calls.
+func (p *FSimpleServer) WithAdmissionController(controller FAdmissionController) *FSimpleServer {
+	p.admission = controller
+	return p
+}
+
+// WithHooks registers callbacks invoked as the server starts, stops, and
+// processes requests. Returns the same FSimpleServer to allow for chaining
+// calls.
+func (p *FSimpleServer) WithHooks(hooks *FServerHooks) *FSimpleServer {
+	p.hooks = hooks
+	return p
+}
+
 // Listen should not be called directly.
 func (p *FSimpleServer) listen() error {
 	return p.serverTransport.Listen()
@@ -73,27 +162,84 @@ func (p *FSimpleServer) Serve() error {
 	if err := p.listen(); err != nil {
 		return err
 	}
+	if p.health != nil || p.reflection != nil {
+		mux, ok := p.processor.(*FServiceMux)
+		if !ok {
+			mux = NewFServiceMux(p.protocolFactory).WithDefault(p.processor)
+		}
+		if p.health != nil {
+			mux.Register(HealthService, NewFHealthProcessor(p.health))
+		}
+		if p.reflection != nil {
+			mux.Register(ReflectionService, NewFReflectionProcessor(p.reflection))
+		}
+		p.processor = mux
+	}
+	if p.admission != nil {
+		p.processor = newAdmissionProcessor(p.processor, p.admission)
+	}
+	if p.workerCount > 0 {
+		p.processor = newPooledProcessor(p.processor, p.workerCount, p.queueLen, p.overflow)
+	}
+	p.processor = newDrainingProcessor(p.processor, &p.draining)
+	p.processor = newHooksProcessor(p.processor, p.hooks)
+	p.hooks.started()
+	defer p.hooks.stopped()
 	p.acceptLoop()
 	return nil
 }
 
-// Stop the server.
+// Stop the server. If a drain timeout is configured, this blocks until the
+// requests being processed have been responded to or the timeout elapses.
 func (p *FSimpleServer) Stop() error {
 	close(p.quit)
 	p.serverTransport.Interrupt()
+	if p.drainTimeout > 0 {
+		p.conns.drain(p.drainTimeout)
+	}
 	return nil
 }
 
-func (p *FSimpleServer) accept(client thrift.TTransport) error {
-	framed := NewTFramedTransport(client)
-	iprot := p.protocolFactory.GetProtocol(framed)
-	oprot := p.protocolFactory.GetProtocol(framed)
-	processor := p.processor
+// SetDraining sets whether the server is draining. While draining, requests
+// in flight are processed, but new requests are rejected with an
+// APPLICATION_EXCEPTION_SERVER_DRAINING error.
+func (p *FSimpleServer) SetDraining(draining bool) {
+	p.draining.set(draining)
+}
 
+func (p *FSimpleServer) accept(client thrift.TTransport) error {
 	logger().Debug("frugal: client connection accepted")
+	conn, ok := p.conns.add(client.Close)
+	if !ok {
+		return client.Close()
+	}
+	defer p.conns.remove(conn)
+	return serveFramed(p.processor, p.protocolFactory, NewTFramedTransport(client), conn)
+}
+
+// serveFramed processes requests read from the given framed client transport
+// until it reaches EOF or, if given a server connection, the server drains.
+func serveFramed(processor FProcessor, protocolFactory *FProtocolFactory, framed *TFramedTransport, conn *serverConnection) error {
+	iprot := protocolFactory.GetProtocol(framed)
+	oprot := protocolFactory.GetProtocol(framed)
 
 	for {
+		if err := framed.waitForFrame(); err != nil {
+			if err, ok := err.(thrift.TTransportException); ok && err.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
+				return nil
+			}
+			if conn.stopping() {
+				return nil
+			}
+			return err
+		}
+		if !conn.begin() {
+			return nil
+		}
 		err := processor.Process(iprot, oprot)
+		if !conn.end() {
+			return nil
+		}
 		if err, ok := err.(thrift.TTransportException); ok && err.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
 			return nil
 		} else if err != nil {
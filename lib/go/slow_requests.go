@@ -0,0 +1,46 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SetSlowRequestThreshold makes the processor log a warning for requests its
+// handlers take longer than the given threshold to process, along with their
+// method, correlation id, and request headers, and count them in
+// SlowRequests, so tail latency offenders are visible without tracing. A
+// zero threshold, the default, disables detection. This should only be
+// called before the server is started.
+func (f *FBaseProcessor) SetSlowRequestThreshold(threshold time.Duration) {
+	f.slowThreshold = threshold
+}
+
+// SlowRequests returns the number of requests which exceeded the slow
+// request threshold.
+func (f *FBaseProcessor) SlowRequests() uint64 {
+	return atomic.LoadUint64(&f.slowRequests)
+}
+
+// checkSlowRequest reports the request with the given context and method if
+// it took longer than the slow request threshold to process.
+func (f *FBaseProcessor) checkSlowRequest(ctx FContext, name string, duration time.Duration) {
+	if duration <= f.slowThreshold {
+		return
+	}
+	atomic.AddUint64(&f.slowRequests, 1)
+	logger().Warnf("frugal: slow request, %s took %s on request with correlation id %s, headers: %v",
+		name, duration, ctx.CorrelationID(), ctx.RequestHeaders())
+}
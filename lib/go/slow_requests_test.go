@@ -0,0 +1,64 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures requests which exceed the slow request threshold are logged and
+// counted.
+func TestSlowRequestThreshold(t *testing.T) {
+	assert := assert.New(t)
+	tmpLogger := logrus.New()
+	var logBuf bytes.Buffer
+	tmpLogger.Out = &logBuf
+	oldLogger := logger()
+	SetLogger(tmpLogger)
+	defer func() {
+		SetLogger(oldLogger)
+	}()
+
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := healthFunc(func(ctx FContext, service string) (FHealthStatus, error) {
+		if service == "slow" {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return HealthServing, nil
+	})
+	processor := NewFHealthProcessor(handler)
+	processor.SetSlowRequestThreshold(10 * time.Millisecond)
+	transport := NewFLoopbackTransport(processor, protocolFactory)
+	assert.Nil(transport.Open())
+	client := NewFHealthClient(NewFServiceProvider(transport, protocolFactory))
+
+	_, err := client.Check(NewFContext("fast"), "")
+	assert.Nil(err)
+	assert.Equal(uint64(0), processor.SlowRequests())
+
+	ctx := NewFContext("slow")
+	ctx.AddRequestHeader("user", "alice")
+	_, err = client.Check(ctx, "slow")
+	assert.Nil(err)
+	assert.Equal(uint64(1), processor.SlowRequests())
+	assert.Contains(logBuf.String(), "frugal: slow request, check took")
+	assert.Contains(logBuf.String(), "on request with correlation id slow")
+	assert.Contains(logBuf.String(), "user:alice")
+}
@@ -0,0 +1,401 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// snsMaxFrameSize is the default maximum size of frames published to
+	// SNS. Messages are limited to 256KB and frames are base64 encoded,
+	// since messages must be text.
+	snsMaxFrameSize = 256 * 1024 / 4 * 3
+
+	// sqsMaxBatchSize is the most messages SQS returns from one receive.
+	sqsMaxBatchSize = 10
+
+	defaultSQSVisibilityTimeout = 30 * time.Second
+	defaultSQSWaitTime          = 20 * time.Second
+	sqsReceiveRetryDelay        = time.Second
+)
+
+// FSNSClient publishes messages to SNS topics. Frugal doesn't depend on the
+// AWS SDK, so implement it by wrapping an SNS client's Publish.
+type FSNSClient interface {
+	// Publish sends the given message to the topic with the given ARN.
+	Publish(ctx context.Context, topicARN, message string) error
+}
+
+// FSQSMessage is a message received from an SQS queue.
+type FSQSMessage struct {
+	Body          string
+	ReceiptHandle string
+}
+
+// FSQSClient receives messages from SQS queues. Frugal doesn't depend on the
+// AWS SDK, so implement it by wrapping an SQS client.
+type FSQSClient interface {
+	// ReceiveMessages receives up to the given number of messages from the
+	// queue with the given URL, hiding them from other consumers for the
+	// given visibility timeout and long polling for up to the given wait
+	// time if none are available.
+	ReceiveMessages(ctx context.Context, queueURL string, maxMessages int,
+		visibilityTimeout, waitTime time.Duration) ([]FSQSMessage, error)
+
+	// ChangeMessageVisibility hides the message with the given receipt
+	// handle for the given timeout from now. A timeout of zero makes it
+	// available to be received again immediately.
+	ChangeMessageVisibility(ctx context.Context, queueURL, receiptHandle string, timeout time.Duration) error
+
+	// DeleteMessages deletes the messages with the given receipt handles,
+	// such as with DeleteMessageBatch.
+	DeleteMessages(ctx context.Context, queueURL string, receiptHandles []string) error
+}
+
+// FSNSPublisherTransportFactory creates SNS FPublisherTransports.
+type FSNSPublisherTransportFactory struct {
+	client           FSNSClient
+	topicMapper      func(string) string
+	publishSizeLimit uint
+}
+
+// NewFSNSPublisherTransportFactory creates an FSNSPublisherTransportFactory
+// whose transports publish with the given client to the SNS topic ARNs the
+// given mapper returns for scope topics. SNS topic names can't contain ".",
+// so there is no default mapping.
+func NewFSNSPublisherTransportFactory(client FSNSClient, topicMapper func(string) string) *FSNSPublisherTransportFactory {
+	return &FSNSPublisherTransportFactory{
+		client:           client,
+		topicMapper:      topicMapper,
+		publishSizeLimit: snsMaxFrameSize,
+	}
+}
+
+// WithPublishSizeLimit sets the maximum size of published frames. Defaults to
+// 192KB, the largest frame which fits in an SNS message once encoded.
+func (s *FSNSPublisherTransportFactory) WithPublishSizeLimit(limit uint) *FSNSPublisherTransportFactory {
+	s.publishSizeLimit = limit
+	return s
+}
+
+// GetTransport creates a new SNS FPublisherTransport.
+func (s *FSNSPublisherTransportFactory) GetTransport() FPublisherTransport {
+	return &fSNSPublisherTransport{
+		client:           s.client,
+		topicMapper:      s.topicMapper,
+		publishSizeLimit: s.publishSizeLimit,
+	}
+}
+
+// fSNSPublisherTransport implements FPublisherTransport.
+type fSNSPublisherTransport struct {
+	client           FSNSClient
+	topicMapper      func(string) string
+	publishSizeLimit uint
+
+	mu     sync.RWMutex
+	isOpen bool
+}
+
+// Open initializes the transport.
+func (s *fSNSPublisherTransport) Open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.isOpen = true
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (s *fSNSPublisherTransport) IsOpen() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.isOpen
+}
+
+// Close closes the transport. The client is owned by the caller.
+func (s *fSNSPublisherTransport) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.isOpen = false
+	return nil
+}
+
+// GetPublishSizeLimit returns the maximum allowable size of a payload
+// to be published. A non-positive number is returned to indicate an
+// unbounded allowable size.
+func (s *fSNSPublisherTransport) GetPublishSizeLimit() uint {
+	return s.publishSizeLimit
+}
+
+// Publish sends the given frame, base64 encoded, to the SNS topic for the
+// given topic.
+func (s *fSNSPublisherTransport) Publish(topic string, data []byte) error {
+	if !s.IsOpen() {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: SNS FPublisherTransport not open")
+	}
+	if limit := s.publishSizeLimit; limit > 0 && uint(len(data)) > limit {
+		return thrift.NewTTransportException(
+			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", limit, len(data)))
+	}
+	message := base64.StdEncoding.EncodeToString(data)
+	if err := s.client.Publish(context.Background(), s.topicMapper(topic), message); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	return nil
+}
+
+// FSQSSubscriberTransportFactory creates FSubscriberTransports receiving
+// scope messages from SQS queues subscribed to SNS topics.
+type FSQSSubscriberTransportFactory struct {
+	client            FSQSClient
+	queueMapper       func(string) string
+	batchSize         int
+	visibilityTimeout time.Duration
+	waitTime          time.Duration
+}
+
+// NewFSQSSubscriberTransportFactory creates an FSQSSubscriberTransportFactory
+// whose transports receive with the given client from the SQS queue URLs the
+// given mapper returns for scope topics. Each queue should be subscribed to
+// the SNS topic the scope is published to. Subscribers sharing a queue share
+// its messages, so give each subscriber which should receive every message
+// its own queue.
+func NewFSQSSubscriberTransportFactory(client FSQSClient, queueMapper func(string) string) *FSQSSubscriberTransportFactory {
+	return &FSQSSubscriberTransportFactory{
+		client:            client,
+		queueMapper:       queueMapper,
+		batchSize:         sqsMaxBatchSize,
+		visibilityTimeout: defaultSQSVisibilityTimeout,
+		waitTime:          defaultSQSWaitTime,
+	}
+}
+
+// WithBatchSize sets the number of messages received at once, up to 10, the
+// default. Messages in a batch are processed concurrently.
+func (s *FSQSSubscriberTransportFactory) WithBatchSize(size int) *FSQSSubscriberTransportFactory {
+	if size > sqsMaxBatchSize {
+		size = sqsMaxBatchSize
+	}
+	s.batchSize = size
+	return s
+}
+
+// WithVisibilityTimeout sets how long received messages are hidden from other
+// consumers. The timeout is extended while a message is being processed, so
+// it only needs to cover the time to detect a crashed subscriber. Defaults to
+// 30 seconds.
+func (s *FSQSSubscriberTransportFactory) WithVisibilityTimeout(timeout time.Duration) *FSQSSubscriberTransportFactory {
+	s.visibilityTimeout = timeout
+	return s
+}
+
+// WithWaitTime sets how long receives long poll for messages. Defaults to 20
+// seconds, the most SQS allows.
+func (s *FSQSSubscriberTransportFactory) WithWaitTime(wait time.Duration) *FSQSSubscriberTransportFactory {
+	s.waitTime = wait
+	return s
+}
+
+// GetTransport creates a new SQS FSubscriberTransport.
+func (s *FSQSSubscriberTransportFactory) GetTransport() FSubscriberTransport {
+	return &fSQSSubscriberTransport{
+		client:            s.client,
+		queueMapper:       s.queueMapper,
+		batchSize:         s.batchSize,
+		visibilityTimeout: s.visibilityTimeout,
+		waitTime:          s.waitTime,
+	}
+}
+
+// fSQSSubscriberTransport implements FSubscriberTransport.
+type fSQSSubscriberTransport struct {
+	client            FSQSClient
+	queueMapper       func(string) string
+	batchSize         int
+	visibilityTimeout time.Duration
+	waitTime          time.Duration
+
+	mu      sync.RWMutex
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// Subscribe starts receiving messages for the given topic.
+func (s *fSQSSubscriberTransport) Subscribe(topic string, callback FAsyncCallback) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: SQS transport already open")
+	}
+	if topic == "" {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"cannot subscribe to empty topic")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.stopped = make(chan struct{})
+	go s.receive(ctx, s.queueMapper(topic), callback, s.stopped)
+	return nil
+}
+
+// receive processes batches of messages from the given queue until the
+// context is cancelled.
+func (s *fSQSSubscriberTransport) receive(ctx context.Context, queueURL string, callback FAsyncCallback, stopped chan struct{}) {
+	defer close(stopped)
+	for ctx.Err() == nil {
+		messages, err := s.client.ReceiveMessages(ctx, queueURL, s.batchSize, s.visibilityTimeout, s.waitTime)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger().Warnf("frugal: error receiving from SQS queue %s, retrying: %s", queueURL, err)
+			select {
+			case <-time.After(sqsReceiveRetryDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		s.processBatch(ctx, queueURL, messages, callback)
+	}
+}
+
+// processBatch processes the given messages concurrently, then deletes the
+// ones which were handled.
+func (s *fSQSSubscriberTransport) processBatch(ctx context.Context, queueURL string, messages []FSQSMessage, callback FAsyncCallback) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		handled []string
+	)
+	for _, message := range messages {
+		wg.Add(1)
+		go func(message FSQSMessage) {
+			defer wg.Done()
+			if s.process(ctx, queueURL, message, callback) {
+				mu.Lock()
+				handled = append(handled, message.ReceiptHandle)
+				mu.Unlock()
+			}
+		}(message)
+	}
+	wg.Wait()
+	if len(handled) == 0 {
+		return
+	}
+	// Deletes use their own context so messages handled before
+	// unsubscribing aren't redelivered.
+	if err := s.client.DeleteMessages(context.Background(), queueURL, handled); err != nil {
+		logger().Warnf("frugal: error deleting messages from SQS queue %s: %s", queueURL, err)
+	}
+}
+
+// process executes the callback for the given message, extending its
+// visibility timeout until the callback returns. It returns true if the
+// message should be deleted. Messages whose callback fails are made visible
+// again so they are redelivered, or moved to the queue's dead-letter queue by
+// its redrive policy.
+func (s *fSQSSubscriberTransport) process(ctx context.Context, queueURL string, message FSQSMessage, callback FAsyncCallback) bool {
+	frame, err := decodeSQSMessage(message.Body)
+	if err != nil || len(frame) < 4 {
+		logger().Warn("frugal: Discarding invalid scope message frame")
+		return true
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.extendVisibility(ctx, queueURL, message.ReceiptHandle, done)
+
+	if err := invokeAcked(callback, frame[4:]); err != nil {
+		var delay time.Duration
+		if redelivery, ok := err.(*FRedeliveryError); ok {
+			delay = redelivery.Delay
+		}
+		if err := s.client.ChangeMessageVisibility(context.Background(), queueURL, message.ReceiptHandle, delay); err != nil {
+			logger().Warn("frugal: error releasing SQS message: ", err)
+		}
+		return false
+	}
+	return true
+}
+
+// extendVisibility extends the visibility timeout of the message with the
+// given receipt handle every half timeout until done is closed.
+func (s *fSQSSubscriberTransport) extendVisibility(ctx context.Context, queueURL, receiptHandle string, done chan struct{}) {
+	ticker := time.NewTicker(s.visibilityTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.client.ChangeMessageVisibility(ctx, queueURL, receiptHandle, s.visibilityTimeout); err != nil {
+				logger().Warn("frugal: error extending SQS message visibility: ", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// snsNotification is the envelope of SNS messages delivered to SQS without
+// raw message delivery.
+type snsNotification struct {
+	Message string
+}
+
+// decodeSQSMessage returns the frame in the given SQS message body, which is
+// either an SNS notification or, with raw message delivery, the published
+// message.
+func decodeSQSMessage(body string) ([]byte, error) {
+	if len(body) > 0 && body[0] == '{' {
+		var notification snsNotification
+		if err := json.Unmarshal([]byte(body), &notification); err != nil {
+			return nil, err
+		}
+		body = notification.Message
+	}
+	return base64.StdEncoding.DecodeString(body)
+}
+
+// IsSubscribed returns true if the transport is subscribed to a topic, false
+// otherwise.
+func (s *fSQSSubscriberTransport) IsSubscribed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cancel != nil
+}
+
+// Unsubscribe stops receiving messages, waiting for messages being processed
+// to finish.
+func (s *fSQSSubscriberTransport) Unsubscribe() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel == nil {
+		return nil
+	}
+	s.cancel()
+	<-s.stopped
+	s.cancel = nil
+	return nil
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+type visibilityChange struct {
+	receiptHandle string
+	timeout       time.Duration
+}
+
+// mockSQSQueue is an in-memory SNS topic subscribed to by an SQS queue, which
+// delivers each message until it is deleted.
+type mockSQSQueue struct {
+	mu         sync.Mutex
+	raw        bool
+	messages   chan FSQSMessage
+	published  []string
+	received   []int
+	deleted    []string
+	visibility []visibilityChange
+	sequence   int
+}
+
+func newMockSQSQueue() *mockSQSQueue {
+	return &mockSQSQueue{messages: make(chan FSQSMessage, 10)}
+}
+
+func (m *mockSQSQueue) Publish(ctx context.Context, topicARN, message string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.published = append(m.published, topicARN)
+	body := message
+	if !m.raw {
+		envelope, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": message})
+		body = string(envelope)
+	}
+	m.sequence++
+	m.messages <- FSQSMessage{Body: body, ReceiptHandle: fmt.Sprintf("r%d", m.sequence)}
+	return nil
+}
+
+func (m *mockSQSQueue) ReceiveMessages(ctx context.Context, queueURL string, maxMessages int, visibilityTimeout, waitTime time.Duration) ([]FSQSMessage, error) {
+	select {
+	case message := <-m.messages:
+		m.mu.Lock()
+		m.received = append(m.received, maxMessages)
+		m.mu.Unlock()
+		return []FSQSMessage{message}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (m *mockSQSQueue) ChangeMessageVisibility(ctx context.Context, queueURL, receiptHandle string, timeout time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.visibility = append(m.visibility, visibilityChange{receiptHandle, timeout})
+	return nil
+}
+
+func (m *mockSQSQueue) DeleteMessages(ctx context.Context, queueURL string, receiptHandles []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, receiptHandles...)
+	return nil
+}
+
+func (m *mockSQSQueue) changes() ([]string, []visibilityChange) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.deleted...), append([]visibilityChange(nil), m.visibility...)
+}
+
+func snsTopicARN(topic string) string {
+	return "arn:aws:sns:us-east-1:123456789012:" + topic
+}
+
+func sqsQueueURL(topic string) string {
+	return "https://sqs.us-east-1.amazonaws.com/123456789012/" + topic
+}
+
+// Ensures published frames are delivered to subscribers and deleted once
+// handled, and released for redelivery when the callback fails.
+func TestSNSScopeTransportPublishSubscribe(t *testing.T) {
+	assert := assert.New(t)
+	queue := newMockSQSQueue()
+	received := make(chan []byte, 2)
+	fail := true
+	subscriber := NewFSQSSubscriberTransportFactory(queue, sqsQueueURL).WithBatchSize(20).GetTransport()
+	assert.Nil(subscriber.Subscribe("winners", func(transport thrift.TTransport) error {
+		payload, _ := ioutil.ReadAll(transport)
+		received <- payload
+		if fail {
+			fail = false
+			return errors.New("failed")
+		}
+		return nil
+	}))
+	assert.True(subscriber.IsSubscribed())
+	err := subscriber.Subscribe("winners", nil)
+	assert.Equal(TRANSPORT_EXCEPTION_ALREADY_OPEN, err.(thrift.TTransportException).TypeId())
+
+	publisher := NewFSNSPublisherTransportFactory(queue, snsTopicARN).GetTransport()
+	err = publisher.Publish("winners", []byte{0, 0, 0, 1, 1})
+	assert.Equal(TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+	assert.Nil(publisher.Open())
+	assert.Equal(uint(snsMaxFrameSize), publisher.GetPublishSizeLimit())
+	assert.Nil(publisher.Publish("winners", []byte{0, 0, 0, 1, 1}))
+	assert.Nil(publisher.Publish("winners", []byte{0, 0, 0, 1, 2}))
+	assert.Equal([]byte{1}, <-received)
+	assert.Equal([]byte{2}, <-received)
+
+	assert.Nil(subscriber.Unsubscribe())
+	assert.False(subscriber.IsSubscribed())
+	deleted, visibility := queue.changes()
+	assert.Equal([]string{"r2"}, deleted)
+	assert.Equal([]visibilityChange{{"r1", 0}}, visibility)
+	assert.Equal([]string{snsTopicARN("winners"), snsTopicARN("winners")}, queue.published)
+	assert.Equal([]int{sqsMaxBatchSize, sqsMaxBatchSize}, queue.received)
+}
+
+// Ensures the visibility timeout of messages is extended while they're
+// processed.
+func TestSQSSubscriberExtendsVisibility(t *testing.T) {
+	assert := assert.New(t)
+	queue := newMockSQSQueue()
+	queue.raw = true
+	done := make(chan struct{})
+	subscriber := NewFSQSSubscriberTransportFactory(queue, sqsQueueURL).
+		WithVisibilityTimeout(20 * time.Millisecond).
+		GetTransport()
+	assert.Nil(subscriber.Subscribe("winners", func(thrift.TTransport) error {
+		time.Sleep(50 * time.Millisecond)
+		close(done)
+		return nil
+	}))
+	assert.Nil(queue.Publish(context.Background(), "", base64.StdEncoding.EncodeToString([]byte{0, 0, 0, 1, 1})))
+	<-done
+	assert.Nil(subscriber.Unsubscribe())
+
+	deleted, visibility := queue.changes()
+	assert.Equal([]string{"r1"}, deleted)
+	if assert.NotEmpty(visibility) {
+		assert.Equal(visibilityChange{"r1", 20 * time.Millisecond}, visibility[0])
+	}
+}
+
+// Ensures invalid messages are discarded and oversized frames aren't
+// published.
+func TestSNSScopeTransportErrors(t *testing.T) {
+	assert := assert.New(t)
+	queue := newMockSQSQueue()
+	queue.raw = true
+	subscriber := NewFSQSSubscriberTransportFactory(queue, sqsQueueURL).GetTransport()
+	err := subscriber.Subscribe("", nil)
+	assert.Equal(TRANSPORT_EXCEPTION_UNKNOWN, err.(thrift.TTransportException).TypeId())
+	assert.Nil(subscriber.Subscribe("winners", func(thrift.TTransport) error {
+		t.Fatal("unexpected callback")
+		return nil
+	}))
+	assert.Nil(queue.Publish(context.Background(), "", "not base64"))
+	for {
+		if deleted, _ := queue.changes(); len(deleted) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(subscriber.Unsubscribe())
+
+	publisher := NewFSNSPublisherTransportFactory(queue, snsTopicARN).WithPublishSizeLimit(10).GetTransport()
+	assert.Nil(publisher.Open())
+	err = publisher.Publish("winners", make([]byte, 11))
+	assert.Equal(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, err.(thrift.TTransportException).TypeId())
+	assert.Nil(publisher.Close())
+	assert.False(publisher.IsOpen())
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"io"
+	"os/exec"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// NewFStdioTransport returns an FTransport which exchanges frames over the
+// given streams, such as the stdout and stdin pipes of a plugin process
+// served by an FStdioServer. Closing the transport closes both streams.
+func NewFStdioTransport(r io.ReadCloser, w io.WriteCloser) FTransport {
+	return NewAdapterTransport(&stdioTransport{
+		reader: r,
+		writer: w,
+		close: func() error {
+			w.Close()
+			return r.Close()
+		},
+	})
+}
+
+// NewFProcessTransport starts the given command and returns an FTransport
+// which exchanges frames over its stdin and stdout. The command's Stdin and
+// Stdout must not be set, but Stderr can be used to collect its logs.
+// Closing the transport closes the command's stdin, signalling it to shut
+// down, and waits for it to exit. This lets plugin hosts talk to services
+// launched as child processes without a network listener.
+func NewFProcessTransport(cmd *exec.Cmd) (FTransport, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return NewAdapterTransport(&stdioTransport{
+		reader: stdout,
+		writer: stdin,
+		close: func() error {
+			// stdout is closed once the process has exited, so it is not
+			// interrupted while writing.
+			stdin.Close()
+			return cmd.Wait()
+		},
+	}), nil
+}
+
+// stdioTransport is a TTransport over a pair of streams which is opened on
+// creation.
+type stdioTransport struct {
+	reader io.Reader
+	writer io.Writer
+	close  func() error
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Open returns an ALREADY_OPEN error since the transport is opened on
+// creation, or NOT_OPEN if it has been closed.
+func (s *stdioTransport) Open() error {
+	if s.IsOpen() {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: stdio transport already open")
+	}
+	return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+		"frugal: cannot reopen stdio transport")
+}
+
+// IsOpen returns true until the transport is closed.
+func (s *stdioTransport) IsOpen() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.closed
+}
+
+// Close closes the streams.
+func (s *stdioTransport) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: stdio transport not open")
+	}
+	s.closed = true
+	return s.close()
+}
+
+func (s *stdioTransport) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	return n, thrift.NewTTransportExceptionFromError(err)
+}
+
+func (s *stdioTransport) Write(p []byte) (int, error) {
+	n, err := s.writer.Write(p)
+	return n, thrift.NewTTransportExceptionFromError(err)
+}
+
+// Flush is a no-op since writes aren't buffered.
+func (s *stdioTransport) Flush() error {
+	return nil
+}
+
+// RemainingBytes returns the max value since the size of the streams is
+// unknown.
+func (s *stdioTransport) RemainingBytes() uint64 {
+	return ^uint64(0)
+}
+
+// FStdioServer is an FServer which serves a single client over a pair of
+// streams, typically the stdin and stdout of a plugin process launched by a
+// host using NewFProcessTransport:
+//
+//	server := frugal.NewFStdioServer(processor, protocolFactory, os.Stdin, os.Stdout)
+//	if err := server.Serve(); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// Serve returns once the input stream reaches EOF, which happens when the host
+// closes its transport, so the plugin can exit. Nothing else may be written to
+// the output stream, so plugins must log to stderr.
+type FStdioServer struct {
+	processor       FProcessor
+	protocolFactory *FProtocolFactory
+	in              io.ReadCloser
+	out             io.Writer
+	hooks           *FServerHooks
+	draining        drainSwitch
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+// NewFStdioServer creates a new FStdioServer which reads requests from in and
+// writes responses to out.
+func NewFStdioServer(processor FProcessor, protocolFactory *FProtocolFactory,
+	in io.ReadCloser, out io.Writer) *FStdioServer {
+
+	return &FStdioServer{
+		processor:       processor,
+		protocolFactory: protocolFactory,
+		in:              in,
+		out:             out,
+	}
+}
+
+// WithHooks registers callbacks invoked as the server starts, stops, and
+// processes requests.
+func (s *FStdioServer) WithHooks(hooks *FServerHooks) *FStdioServer {
+	s.hooks = hooks
+	return s
+}
+
+// Serve processes requests until the input stream reaches EOF or the server
+// is stopped.
+func (s *FStdioServer) Serve() error {
+	s.hooks.started()
+	defer s.hooks.stopped()
+	processor := newDrainingProcessor(s.processor, &s.draining)
+	err := serveFramed(newHooksProcessor(processor, s.hooks), s.protocolFactory,
+		NewTFramedTransport(thrift.NewStreamTransport(s.in, s.out)), nil)
+	if s.isStopped() {
+		return nil
+	}
+	return err
+}
+
+// Stop stops the server by closing the input stream.
+func (s *FStdioServer) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil
+	}
+	s.stopped = true
+	return s.in.Close()
+}
+
+// SetDraining sets whether the server is draining. While draining, requests
+// in flight are processed, but new requests are rejected with an
+// APPLICATION_EXCEPTION_SERVER_DRAINING error.
+func (s *FStdioServer) SetDraining(draining bool) {
+	s.draining.set(draining)
+}
+
+func (s *FStdioServer) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
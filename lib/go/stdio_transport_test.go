@@ -0,0 +1,103 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"io"
+	"os/exec"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures requests are served over a pair of streams and the server returns
+// once the client closes them.
+func TestStdioTransportRequest(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	server := NewFStdioServer(&headerProcessor{}, protocolFactory, requestReader, responseWriter)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+
+	transport := NewFStdioTransport(responseReader, requestWriter)
+	assert.Nil(transport.Open())
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("user", "alice")
+	buffer := NewTMemoryOutputBuffer(0)
+	protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx)
+	result, err := transport.Request(ctx, buffer.Bytes())
+	assert.Nil(err)
+	resultProto := protocolFactory.GetProtocol(result)
+	assert.Nil(resultProto.ReadResponseHeader(ctx))
+	user, err := resultProto.ReadString()
+	assert.Nil(err)
+	assert.Equal("alice", user)
+
+	assert.Nil(transport.Close())
+	select {
+	case err := <-served:
+		assert.Nil(err)
+	case <-time.After(time.Second):
+		t.Fatal("expected server to return on EOF")
+	}
+}
+
+// Ensures Stop unblocks Serve.
+func TestStdioServerStop(t *testing.T) {
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	requestReader, _ := io.Pipe()
+	_, responseWriter := io.Pipe()
+	server := NewFStdioServer(&headerProcessor{}, protocolFactory, requestReader, responseWriter)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+
+	assert.Nil(t, server.Stop())
+	select {
+	case err := <-served:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("expected server to stop")
+	}
+}
+
+// Ensures frames are exchanged with a child process, which exits when the
+// transport is closed. cat echoes requests back, so they are received as
+// their own responses.
+func TestProcessTransport(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat not available")
+	}
+	assert := assert.New(t)
+	cmd := exec.Command("cat")
+	transport, err := NewFProcessTransport(cmd)
+	assert.Nil(err)
+	assert.Nil(transport.Open())
+
+	ctx := NewFContext("cid")
+	buffer := NewTMemoryOutputBuffer(0)
+	NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).GetProtocol(buffer).WriteRequestHeader(ctx)
+	frame := buffer.Bytes()
+	result, err := transport.Request(ctx, frame)
+	assert.Nil(err)
+	assert.Equal(frame[4:], result.(*thrift.TMemoryBuffer).Bytes())
+
+	assert.Nil(transport.Close())
+	assert.True(cmd.ProcessState.Exited())
+	_, err = NewFProcessTransport(cmd)
+	assert.NotNil(err)
+}
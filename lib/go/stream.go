@@ -0,0 +1,269 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// Header marking response frames which carry an item of a streamed response.
+// The response to a request for a streaming method is any number of item
+// frames with the request's opid, followed by the method's ordinary response,
+// which marks the end of the stream.
+//
+// Methods annotated with (stream="server") in the IDL are generated as
+// streaming methods. Each item is a message of the method's result, and the
+// generated client sends the request with RequestStream while the generated
+// FProcessorFunction sends items with an FServerStream before writing the
+// ordinary response. Only the Go generator supports the annotation.
+const streamItemHeader = "_stream_item"
+
+// FStreamingTransport is an FTransport which supports methods that respond
+// with a stream of results.
+type FStreamingTransport interface {
+	FTransport
+
+	// RequestStream transmits the given data and returns the stream of
+	// responses to it. The stream must be closed once it's no longer needed.
+	// Implementations of RequestStream should be threadsafe.
+	RequestStream(ctx FContext, payload []byte) (*FClientStream, error)
+}
+
+// RequestStream transmits the given data with the given FTransport and
+// returns the stream of responses to it. It fails with a TTransportException
+// if the transport doesn't support streamed responses.
+func RequestStream(transport FTransport, ctx FContext, payload []byte) (*FClientStream, error) {
+	streaming, ok := transport.(FStreamingTransport)
+	if !ok {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"frugal: transport does not support streamed responses")
+	}
+	return streaming.RequestStream(ctx, payload)
+}
+
+// FClientStream receives the responses to a request for a streaming method.
+// Callers read an item from each frame Recv returns until it returns the
+// final frame, which they read as the method's ordinary response.
+type FClientStream struct {
+	ctx      FContext
+	queue    *streamQueue
+	closeFn  func(finished bool)
+	consumed func()
+	once     sync.Once
+	ended    bool
+}
+
+// newFClientStream returns an FClientStream receiving the responses queued
+// for the request with the given context. The given function is called once
+// when the stream is closed, with whether its final frame was received.
+func newFClientStream(ctx FContext, queue *streamQueue, closeFn func(finished bool)) *FClientStream {
+	return &FClientStream{ctx: ctx, queue: queue, closeFn: closeFn}
+}
+
+// Recv waits up to the context's timeout for the next response frame,
+// returning a TTransport to read it from and whether it carries an item. Once
+// the final frame has been returned, the stream is closed and Recv returns a
+// TTransportException of type TRANSPORT_EXCEPTION_END_OF_FILE. Recv is not
+// threadsafe.
+func (s *FClientStream) Recv() (thrift.TTransport, bool, error) {
+	if s.ended {
+		return nil, false, thrift.NewTTransportException(TRANSPORT_EXCEPTION_END_OF_FILE,
+			"frugal: stream ended")
+	}
+	frame, err := s.queue.next(s.ctx)
+	if err == nil {
+		_, item, err := frameHeader(frame, streamItemHeader)
+		if err != nil {
+			s.close(false)
+			return nil, false, thrift.NewTTransportExceptionFromError(err)
+		}
+		if !item {
+			s.ended = true
+			s.close(true)
+		} else if s.consumed != nil {
+			s.consumed()
+		}
+		return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame)}, item, nil
+	}
+	s.close(false)
+	return nil, false, err
+}
+
+// Close stops receiving responses. If the stream hasn't ended, the server is
+// notified, where supported, so it can stop sending them.
+func (s *FClientStream) Close() error {
+	s.close(s.ended)
+	s.ended = true
+	return nil
+}
+
+func (s *FClientStream) close(finished bool) {
+	s.once.Do(func() {
+		s.closeFn(finished)
+	})
+}
+
+// streamQueue buffers the frames of a stream as they're received so
+// transports never block delivering them. Frames the control function
+// returns true for, such as flow control frames, are handled as they're
+// received rather than queued.
+type streamQueue struct {
+	mu      sync.Mutex
+	frames  [][]byte
+	ready   chan struct{}
+	control func(frame []byte) bool
+}
+
+func newStreamQueue() *streamQueue {
+	return &streamQueue{ready: make(chan struct{}, 1)}
+}
+
+// push adds the given frame, without its frame size, to the queue.
+func (q *streamQueue) push(frame []byte) {
+	if q.control != nil && q.control(frame) {
+		return
+	}
+	q.mu.Lock()
+	q.frames = append(q.frames, frame)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the oldest frame from the queue, if there is one.
+func (q *streamQueue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.frames) == 0 {
+		return nil, false
+	}
+	frame := q.frames[0]
+	q.frames = q.frames[1:]
+	return frame, true
+}
+
+// next waits up to the given context's timeout for the next frame, failing
+// if the context is cancelled first.
+func (q *streamQueue) next(ctx FContext) ([]byte, error) {
+	timeout := time.NewTimer(ctx.Timeout())
+	defer timeout.Stop()
+	for {
+		if frame, ok := q.pop(); ok {
+			return frame, nil
+		}
+		select {
+		case <-q.ready:
+		case <-contextDone(ctx):
+			return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_CANCELLED,
+				"frugal: stream cancelled")
+		case <-timeout.C:
+			return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT,
+				"frugal: stream timed out")
+		}
+	}
+}
+
+// streamSink sends the frames of streamed responses on behalf of a server.
+// Servers which support streamed responses set one on the output protocol of
+// each request. Servers which also receive the frames clients send on
+// bidirectional streams set the inboxes they deliver them to.
+type streamSink struct {
+	protocolFactory *FProtocolFactory
+	send            func(frame []byte) error
+	inboxes         *streamInboxes
+	key             string
+}
+
+// open registers the given queue to receive the frames the client sends on
+// the stream for the request with the given context.
+func (s *streamSink) open(ctx FContext, inbox *streamQueue) {
+	s.key = inFlightKey(ctx)
+	s.inboxes.add(s.key, inbox)
+}
+
+// release stops receiving frames for the request once it has been
+// processed.
+func (s *streamSink) release() {
+	if s.key != "" {
+		s.inboxes.remove(s.key)
+	}
+}
+
+// FServerStream sends the items of the response to a request for a streaming
+// method. The FProcessorFunction for the method creates one for its handler
+// to send items with, and writes the method's ordinary response once the
+// handler returns to end the stream.
+type FServerStream struct {
+	ctx     FContext
+	sink    *streamSink
+	credits *streamCredits
+	mu      sync.Mutex
+}
+
+// NewFServerStream returns an FServerStream for the request with the given
+// context, whose response is written to the given output protocol. It fails
+// with a TApplicationException of type
+// APPLICATION_EXCEPTION_STREAMING_UNSUPPORTED if the server doesn't support
+// streamed responses. It's called by the FProcessorFunction for the method
+// with the protocols it was given.
+func NewFServerStream(ctx FContext, oprot *FProtocol) (*FServerStream, error) {
+	if oprot.stream == nil || isPlainThriftContext(ctx) {
+		return nil, thrift.NewTApplicationException(APPLICATION_EXCEPTION_STREAMING_UNSUPPORTED,
+			"frugal: server does not support streamed responses")
+	}
+	return &FServerStream{ctx: ctx, sink: oprot.stream}, nil
+}
+
+// Send sends an item written to the protocol by the given function, which
+// writes the message and the item as a response to the method is written.
+// Send fails with a TTransportException of type TRANSPORT_EXCEPTION_CANCELLED
+// once the client has abandoned the stream. On bidirectional streams, Send
+// waits for the client to have room for the item. Send is threadsafe.
+func (s *FServerStream) Send(write func(*FProtocol) error) error {
+	select {
+	case <-contextDone(s.ctx):
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_CANCELLED,
+			"frugal: stream cancelled by client")
+	default:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.credits != nil {
+		if err := s.credits.acquire(s.ctx, true); err != nil {
+			return err
+		}
+	}
+
+	headers := s.ctx.ResponseHeaders()
+	headers[streamItemHeader] = "1"
+	buffer := NewTMemoryOutputBuffer(0)
+	oprot := s.sink.protocolFactory.GetProtocol(buffer)
+	if err := oprot.writeHeader(headers); err != nil {
+		return err
+	}
+	if err := write(oprot); err != nil {
+		return err
+	}
+	if err := oprot.Flush(); err != nil {
+		return err
+	}
+	return s.sink.send(buffer.Bytes())
+}
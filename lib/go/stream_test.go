@@ -0,0 +1,195 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// countProcessor streams the numbers up to the count in the request, then
+// responds with the count, as generated code for a streaming method would.
+type countProcessor struct {
+	processor
+}
+
+func (p *countProcessor) Process(iprot, oprot *FProtocol) error {
+	ctx, err := iprot.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	name, _, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	count, err := iprot.ReadI32()
+	if err != nil {
+		return err
+	}
+	iprot.ReadMessageEnd()
+
+	stream, err := NewFServerStream(ctx, oprot)
+	if err != nil {
+		return writeExceptionResponse(oprot, ctx, name, err.(thrift.TApplicationException))
+	}
+	for i := int32(0); i < count; i++ {
+		err := stream.Send(func(oprot *FProtocol) error {
+			if err := oprot.WriteMessageBegin(name, thrift.REPLY, 0); err != nil {
+				return err
+			}
+			if err := oprot.WriteI32(i); err != nil {
+				return err
+			}
+			return oprot.WriteMessageEnd()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := oprot.WriteResponseHeader(ctx); err != nil {
+		return err
+	}
+	oprot.WriteMessageBegin(name, thrift.REPLY, 0)
+	oprot.WriteI32(count)
+	oprot.WriteMessageEnd()
+	return oprot.Flush()
+}
+
+// requestCount writes a request for the given count.
+func requestCount(protoFactory *FProtocolFactory, ctx FContext, count int32) []byte {
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protoFactory.GetProtocol(buffer)
+	proto.WriteRequestHeader(ctx)
+	proto.WriteMessageBegin("count", thrift.CALL, 0)
+	proto.WriteI32(count)
+	proto.WriteMessageEnd()
+	return buffer.Bytes()
+}
+
+// recvCount receives the next frame of a count stream, returning its value.
+func recvCount(t *testing.T, protoFactory *FProtocolFactory, ctx FContext, stream *FClientStream) (int32, bool) {
+	tr, item, err := stream.Recv()
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	proto := protoFactory.GetProtocol(tr)
+	assert.Nil(t, proto.ReadResponseHeader(ctx))
+	_, typeID, _, err := proto.ReadMessageBegin()
+	assert.Nil(t, err)
+	if typeID == thrift.EXCEPTION {
+		ex, err := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN, "").Read(proto)
+		assert.Nil(t, err)
+		return ex.TypeId(), item
+	}
+	value, err := proto.ReadI32()
+	assert.Nil(t, err)
+	return value, item
+}
+
+// serveNats builds and serves the NATS server, returning once it's
+// subscribed to its subjects.
+func serveNats(t *testing.T, builder *FNatsServerBuilder) FServer {
+	started := make(chan struct{})
+	server := builder.WithHooks(&FServerHooks{OnStart: func() { close(started) }}).Build()
+	go func() {
+		assert.Nil(t, server.Serve())
+	}()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("server did not start")
+	}
+	return server
+}
+
+// assertCountStream asserts the given transport streams the numbers up to a
+// count, then ends the stream.
+func assertCountStream(t *testing.T, protoFactory *FProtocolFactory, transport FTransport) {
+	assert := assert.New(t)
+	ctx := NewFContext("")
+	stream, err := RequestStream(transport, ctx, requestCount(protoFactory, ctx, 3))
+	assert.Nil(err)
+	defer stream.Close()
+	for i := int32(0); i < 3; i++ {
+		value, item := recvCount(t, protoFactory, ctx, stream)
+		assert.True(item)
+		assert.Equal(i, value)
+	}
+	value, item := recvCount(t, protoFactory, ctx, stream)
+	assert.False(item)
+	assert.Equal(int32(3), value)
+	_, ok := ctx.ResponseHeader(streamItemHeader)
+	assert.False(ok)
+
+	_, _, err = stream.Recv()
+	assert.Equal(TRANSPORT_EXCEPTION_END_OF_FILE, err.(thrift.TTransportException).TypeId())
+}
+
+// Ensures streamed responses are received in order over the loopback
+// transport.
+func TestLoopbackTransportStream(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFLoopbackTransport(&countProcessor{}, protoFactory)
+	assert.Nil(t, transport.Open())
+	defer transport.Close()
+	assertCountStream(t, protoFactory, transport)
+}
+
+// Ensures streamed responses are received in order over NATS when the server
+// supports them, and fail otherwise.
+func TestNatsTransportStream(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	streaming := serveNats(t, NewFNatsServerBuilder(conn, &countProcessor{}, protoFactory, []string{"streaming"}).
+		WithServerStreaming())
+	defer streaming.Stop()
+	unary := serveNats(t, NewFNatsServerBuilder(conn, &countProcessor{}, protoFactory, []string{"unary"}))
+	defer unary.Stop()
+
+	transport := NewFNatsTransport(conn, "streaming", "")
+	assert.Nil(transport.Open())
+	defer transport.Close()
+	assertCountStream(t, protoFactory, transport)
+
+	transport = NewFNatsTransport(conn, "unary", "")
+	assert.Nil(transport.Open())
+	defer transport.Close()
+	ctx := NewFContext("")
+	stream, err := RequestStream(transport, ctx, requestCount(protoFactory, ctx, 3))
+	assert.Nil(err)
+	defer stream.Close()
+	value, item := recvCount(t, protoFactory, ctx, stream)
+	assert.False(item)
+	assert.Equal(int32(APPLICATION_EXCEPTION_STREAMING_UNSUPPORTED), value)
+}
+
+// Ensures requesting a stream fails on transports which don't support
+// streamed responses.
+func TestRequestStreamUnsupported(t *testing.T) {
+	transport := NewFHTTPTransportBuilder(nil, "http://localhost").Build()
+	_, err := RequestStream(transport, NewFContext(""), nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import "sync"
+
+// FSwappableProcessor is an FProcessor which delegates to a processor which
+// can be replaced while the server is running, such as to upgrade handlers
+// in place or change their middleware without draining and restarting the
+// server. To change the middleware of a processor, build a new one with the
+// new middleware and swap it in.
+//
+//	processor := frugal.NewFSwappableProcessor(music.NewFStoreProcessor(handler, middleware...))
+//	server := frugal.NewFNatsServerBuilder(conn, processor, protocolFactory, subjects).Build()
+//	...
+//	processor.Swap(music.NewFStoreProcessor(handler, newMiddleware...))
+type FSwappableProcessor struct {
+	mu         sync.RWMutex
+	processor  FProcessor
+	middleware []ServiceMiddleware
+}
+
+// NewFSwappableProcessor creates a new FSwappableProcessor which initially
+// delegates to the given processor.
+func NewFSwappableProcessor(processor FProcessor) *FSwappableProcessor {
+	return &FSwappableProcessor{processor: processor}
+}
+
+// Swap atomically replaces the processor requests are delegated to and
+// returns the previous one. Requests already being processed finish with the
+// previous processor. Middleware added with AddMiddleware is added to the new
+// processor before it's swapped in.
+func (s *FSwappableProcessor) Swap(processor FProcessor) FProcessor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, middleware := range s.middleware {
+		processor.AddMiddleware(middleware)
+	}
+	previous := s.processor
+	s.processor = processor
+	return previous
+}
+
+// Processor returns the processor requests are currently delegated to.
+func (s *FSwappableProcessor) Processor() FProcessor {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.processor
+}
+
+// Process processes the request with the current processor.
+func (s *FSwappableProcessor) Process(iprot, oprot *FProtocol) error {
+	return s.Processor().Process(iprot, oprot)
+}
+
+// AddMiddleware adds the given ServiceMiddleware to the current processor
+// and to every processor swapped in later. This should only be called before
+// the server is started.
+func (s *FSwappableProcessor) AddMiddleware(middleware ServiceMiddleware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.middleware = append(s.middleware, middleware)
+	s.processor.AddMiddleware(middleware)
+}
+
+// Annotations returns the annotations of the current processor.
+func (s *FSwappableProcessor) Annotations() map[string]map[string]string {
+	return s.Processor().Annotations()
+}
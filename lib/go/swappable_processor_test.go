@@ -0,0 +1,57 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures requests are processed by the processor most recently swapped in,
+// with the middleware added to the swappable processor.
+func TestSwappableProcessor(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	v1 := NewFHealthServer()
+	v1.SetServingStatus("", HealthNotServing)
+	processor := NewFSwappableProcessor(NewFHealthProcessor(v1))
+	var mu sync.Mutex
+	calls := 0
+	processor.AddMiddleware(func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			return next(service, method, args)
+		}
+	})
+	transport := NewFLoopbackTransport(processor, protocolFactory)
+	assert.Nil(transport.Open())
+	client := NewFHealthClient(NewFServiceProvider(transport, protocolFactory))
+
+	status, err := client.Check(NewFContext(""), "")
+	assert.Nil(err)
+	assert.Equal(HealthNotServing, status)
+
+	previous := processor.Swap(NewFHealthProcessor(NewFHealthServer()))
+	assert.IsType(&FHealthProcessor{}, previous)
+	status, err = client.Check(NewFContext(""), "")
+	assert.Nil(err)
+	assert.Equal(HealthServing, status)
+	assert.Equal(2, calls)
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// NewFTCPTransport returns an FTransport which exchanges frames with the
+// server at the given host and port, such as an FTCPServer, over a TCP
+// connection made when opened. The connection is secured with TLS if a
+// tls.Config is given. Reads and writes fail if they take longer than the
+// given timeout, unless it is zero.
+func NewFTCPTransport(hostPort string, timeout time.Duration, tlsConfig *tls.Config) (FTransport, error) {
+	if tlsConfig != nil {
+		socket, err := thrift.NewTSSLSocketTimeout(hostPort, tlsConfig, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return NewAdapterTransport(socket), nil
+	}
+	socket, err := thrift.NewTSocketTimeout(hostPort, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewAdapterTransport(socket), nil
+}
+
+// FTCPServer is an FServer which serves framed requests from clients
+// connected over TCP, such as FTransports created with NewFTCPTransport,
+// for point-to-point deployments without a broker or HTTP. Each connection is
+// served in its own goroutine.
+type FTCPServer struct {
+	processor       FProcessor
+	protocolFactory *FProtocolFactory
+	addr            string
+	tlsConfig       *tls.Config
+	maxConnections  int
+	maxFrameSize    uint32
+	idleTimeout     time.Duration
+	drainTimeout    time.Duration
+	conns           *serverConnections
+	hooks           *FServerHooks
+	draining        drainSwitch
+
+	mu       sync.Mutex
+	listener net.Listener
+	stopped  bool
+}
+
+// NewFTCPServer creates a new FTCPServer which listens on the given address.
+func NewFTCPServer(processor FProcessor, addr string, protocolFactory *FProtocolFactory) *FTCPServer {
+	return &FTCPServer{
+		processor:       processor,
+		protocolFactory: protocolFactory,
+		addr:            addr,
+		maxFrameSize:    defaultMaxLength,
+		conns:           newServerConnections(),
+	}
+}
+
+// WithTLSConfig serves connections over TLS using the given config.
+func (s *FTCPServer) WithTLSConfig(config *tls.Config) *FTCPServer {
+	s.tlsConfig = config
+	return s
+}
+
+// WithMaxConnections limits the number of connections served at once. Once
+// it's reached, no more connections are accepted until one closes, so
+// clients queue in the listen backlog. Zero, the default, means unlimited.
+func (s *FTCPServer) WithMaxConnections(max int) *FTCPServer {
+	s.maxConnections = max
+	return s
+}
+
+// WithMaxFrameSize limits the size of the requests a connection can send,
+// closing connections which exceed it. Defaults to 16MB.
+func (s *FTCPServer) WithMaxFrameSize(size uint32) *FTCPServer {
+	s.maxFrameSize = size
+	return s
+}
+
+// WithIdleTimeout closes connections which don't send or receive anything for
+// the given duration. Zero, the default, means connections are never closed
+// for being idle.
+func (s *FTCPServer) WithIdleTimeout(timeout time.Duration) *FTCPServer {
+	s.idleTimeout = timeout
+	return s
+}
+
+// WithDrainTimeout enables graceful shutdown. When the server is stopped, it
+// stops accepting connections and reading requests, finishes processing the
+// requests it is serving and sends their responses, then closes the
+// connections, waiting at most the given timeout. By default, Stop closes the
+// connections immediately.
+func (s *FTCPServer) WithDrainTimeout(timeout time.Duration) *FTCPServer {
+	s.drainTimeout = timeout
+	return s
+}
+
+// WithHooks registers callbacks invoked as the server starts, stops, and
+// processes requests.
+func (s *FTCPServer) WithHooks(hooks *FServerHooks) *FTCPServer {
+	s.hooks = hooks
+	return s
+}
+
+// Listen starts listening on the server's address. It's called by Serve if it
+// hasn't been already, but can be called first to detect errors binding the
+// address before serving in another goroutine.
+func (s *FTCPServer) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.listener = listener
+	return nil
+}
+
+// Addr returns the address the server is listening on, or nil if it isn't.
+func (s *FTCPServer) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Serve accepts connections until the server is stopped.
+func (s *FTCPServer) Serve() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+	s.processor = newDrainingProcessor(s.processor, &s.draining)
+	s.processor = newHooksProcessor(s.processor, s.hooks)
+	s.hooks.started()
+	defer s.hooks.stopped()
+
+	var slots chan struct{}
+	if s.maxConnections > 0 {
+		slots = make(chan struct{}, s.maxConnections)
+	}
+	var backoff time.Duration
+	for {
+		if slots != nil {
+			slots <- struct{}{}
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			if slots != nil {
+				<-slots
+			}
+			if s.isStopped() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// Back off on errors such as running out of file
+				// descriptors rather than spinning.
+				if backoff == 0 {
+					backoff = minAcceptBackoff
+				} else if backoff *= 2; backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				logger().Warnf("frugal: error accepting tcp connection, retrying in %s: %s", backoff, err)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+		served, ok := s.conns.add(conn.Close)
+		if !ok {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			s.serveConnection(conn, served)
+			if slots != nil {
+				<-slots
+			}
+		}()
+	}
+}
+
+// Stop stops accepting connections and closes the open ones. If a drain
+// timeout is configured, this blocks until the requests being processed have
+// been responded to or the timeout elapses.
+func (s *FTCPServer) Stop() error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil
+	}
+	s.stopped = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	if s.drainTimeout > 0 {
+		s.conns.drain(s.drainTimeout)
+	} else {
+		s.conns.closeAll()
+	}
+	return err
+}
+
+// SetDraining sets whether the server is draining. While draining, requests
+// in flight are processed, but new requests are rejected with an
+// APPLICATION_EXCEPTION_SERVER_DRAINING error.
+func (s *FTCPServer) SetDraining(draining bool) {
+	s.draining.set(draining)
+}
+
+func (s *FTCPServer) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+func (s *FTCPServer) serveConnection(conn net.Conn, served *serverConnection) {
+	defer func() {
+		s.conns.remove(served)
+		conn.Close()
+	}()
+	logger().Debug("frugal: tcp connection accepted from ", conn.RemoteAddr())
+	socket := thrift.NewTSocketFromConnTimeout(conn, s.idleTimeout)
+	err := serveFramed(s.processor, s.protocolFactory, NewTFramedTransportMaxLength(socket, s.maxFrameSize), served)
+	if err != nil && !s.isStopped() {
+		logger().Warnf("frugal: closing tcp connection from %s: %s", conn.RemoteAddr(), err)
+	}
+}
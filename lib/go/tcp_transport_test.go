@@ -0,0 +1,197 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTCPTestServer(t *testing.T, server *FTCPServer) string {
+	if err := server.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	return server.Addr().String()
+}
+
+func tcpRequest(transport FTransport, user string, timeout time.Duration) (string, error) {
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	ctx := NewFContext("cid")
+	ctx.SetTimeout(timeout)
+	ctx.AddRequestHeader("user", user)
+	buffer := NewTMemoryOutputBuffer(0)
+	protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx)
+	result, err := transport.Request(ctx, buffer.Bytes())
+	if err != nil {
+		return "", err
+	}
+	resultProto := protocolFactory.GetProtocol(result)
+	if err := resultProto.ReadResponseHeader(ctx); err != nil {
+		return "", err
+	}
+	return resultProto.ReadString()
+}
+
+// Ensures requests are served over plain and TLS connections.
+func TestTCPTransportRequest(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+
+	// Borrow httptest's self-signed certificate.
+	ts := httptest.NewTLSServer(nil)
+	ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	for _, test := range []struct {
+		server *tls.Config
+		client *tls.Config
+	}{
+		{},
+		{ts.TLS, &tls.Config{RootCAs: roots, ServerName: "example.com"}},
+	} {
+		server := NewFTCPServer(&headerProcessor{}, "127.0.0.1:0", protocolFactory).WithTLSConfig(test.server)
+		addr := newTCPTestServer(t, server)
+		transport, err := NewFTCPTransport(addr, time.Second, test.client)
+		assert.Nil(err)
+		assert.Nil(transport.Open())
+		user, err := tcpRequest(transport, "alice", time.Second)
+		assert.Nil(err)
+		assert.Equal("alice", user)
+		assert.Nil(transport.Close())
+		assert.Nil(server.Stop())
+	}
+}
+
+// Ensures no more connections are served than the limit.
+func TestTCPServerMaxConnections(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFTCPServer(&headerProcessor{}, "127.0.0.1:0", protocolFactory).WithMaxConnections(1)
+	addr := newTCPTestServer(t, server)
+	defer server.Stop()
+
+	first, _ := NewFTCPTransport(addr, time.Second, nil)
+	assert.Nil(first.Open())
+	_, err := tcpRequest(first, "alice", time.Second)
+	assert.Nil(err)
+
+	second, _ := NewFTCPTransport(addr, time.Second, nil)
+	assert.Nil(second.Open())
+	defer second.Close()
+	_, err = tcpRequest(second, "bob", 50*time.Millisecond)
+	assert.Equal(TRANSPORT_EXCEPTION_TIMED_OUT, err.(thrift.TTransportException).TypeId())
+
+	assert.Nil(first.Close())
+	user, err := tcpRequest(second, "bob", time.Second)
+	assert.Nil(err)
+	assert.Equal("bob", user)
+}
+
+// Ensures connections are closed when they send frames over the limit or are
+// idle for too long.
+func TestTCPServerConnectionLimits(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFTCPServer(&headerProcessor{}, "127.0.0.1:0", protocolFactory).
+		WithMaxFrameSize(16).
+		WithIdleTimeout(50 * time.Millisecond)
+	addr := newTCPTestServer(t, server)
+	defer server.Stop()
+
+	transport, _ := NewFTCPTransport(addr, time.Second, nil)
+	assert.Nil(transport.Open())
+	closed := transport.Closed()
+	_, err := tcpRequest(transport, "alice", time.Second)
+	assert.NotNil(err)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be closed")
+	}
+
+	transport, _ = NewFTCPTransport(addr, time.Second, nil)
+	assert.Nil(transport.Open())
+	closed = transport.Closed()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected idle connection to be closed")
+	}
+}
+
+// drainProcessor responds like headerProcessor after a delay, signalling when
+// it starts processing a request.
+type drainProcessor struct {
+	headerProcessor
+	started chan struct{}
+}
+
+func (p *drainProcessor) Process(in, out *FProtocol) error {
+	p.started <- struct{}{}
+	time.Sleep(100 * time.Millisecond)
+	return p.headerProcessor.Process(in, out)
+}
+
+// Ensures stopping a draining server waits for requests being processed to
+// be responded to and closes idle connections immediately.
+func TestTCPServerDrain(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	processor := &drainProcessor{started: make(chan struct{}, 1)}
+	server := NewFTCPServer(processor, "127.0.0.1:0", protocolFactory).WithDrainTimeout(time.Second)
+	addr := newTCPTestServer(t, server)
+
+	idle, _ := NewFTCPTransport(addr, time.Second, nil)
+	assert.Nil(idle.Open())
+	busy, _ := NewFTCPTransport(addr, time.Second, nil)
+	assert.Nil(busy.Open())
+	defer busy.Close()
+	userC := make(chan string, 1)
+	go func() {
+		user, err := tcpRequest(busy, "alice", time.Second)
+		assert.Nil(err)
+		userC <- user
+	}()
+	<-processor.started
+
+	stopped := make(chan struct{})
+	go func() {
+		assert.Nil(server.Stop())
+		close(stopped)
+	}()
+	select {
+	case <-idle.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("expected idle connection to be closed")
+	}
+	select {
+	case <-stopped:
+		t.Fatal("expected Stop to wait for the request")
+	default:
+	}
+	assert.Equal("alice", <-userC)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected Stop to return")
+	}
+}
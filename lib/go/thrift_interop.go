@@ -0,0 +1,105 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"io"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// The first byte of messages serialized by plain Thrift clients with the
+// strict binary, compact and JSON protocols. None of them is a header
+// protocol version.
+const (
+	thriftBinaryVersionByte = 0x80
+	thriftCompactProtocolID = 0x82
+	thriftJSONStart         = '['
+)
+
+// WithThriftInterop lets FProtocols produced by this factory read requests
+// from plain Apache Thrift clients, which don't send frugal headers, so one
+// server can serve both. These requests are given a new FContext, with a
+// generated correlation id and the default timeout, and their responses are
+// written without headers. The Thrift clients must use framed transports and
+// the same protocol as the factory: the strict binary, compact or JSON
+// protocol. Requests routed by an FServiceMux or sealed in an envelope can't
+// be plain Thrift, so this has no effect on them. Returns the same
+// FProtocolFactory to allow for chaining calls.
+func (f *FProtocolFactory) WithThriftInterop() *FProtocolFactory {
+	f.thriftInterop = true
+	return f
+}
+
+// interopTransport wraps the TTransport of an FProtocol so the first byte of
+// a request can be read to tell whether it has frugal headers, and then read
+// again by the TProtocol or the headers decoder.
+type interopTransport struct {
+	thrift.TTransport
+	peeked []byte
+}
+
+// isPlainThrift returns true if the next message is a plain Thrift message
+// rather than frugal headers.
+func (i *interopTransport) isPlainThrift() (bool, error) {
+	if len(i.peeked) == 0 {
+		buff := make([]byte, 1)
+		if _, err := io.ReadFull(i.TTransport, buff); err != nil {
+			return false, thrift.NewTTransportExceptionFromError(err)
+		}
+		i.peeked = buff
+	}
+	switch i.peeked[0] {
+	case thriftBinaryVersionByte, thriftCompactProtocolID, thriftJSONStart:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func (i *interopTransport) Read(p []byte) (int, error) {
+	if len(i.peeked) > 0 && len(p) > 0 {
+		n := copy(p, i.peeked)
+		i.peeked = i.peeked[n:]
+		return n, nil
+	}
+	return i.TTransport.Read(p)
+}
+
+func (i *interopTransport) RemainingBytes() uint64 {
+	remaining := i.TTransport.RemainingBytes()
+	if remaining == ^uint64(0) {
+		return remaining
+	}
+	return remaining + uint64(len(i.peeked))
+}
+
+// plainThriftContext returns the FContext of a request from a plain Thrift
+// client.
+func plainThriftContext() FContext {
+	ctx := NewFContext("").(*FContextImpl)
+	ctx.plainThrift = true
+	ctx.setDeadline(time.Now().Add(ctx.Timeout()))
+	setResponseOpID(ctx, "0")
+	ctx.setResponseHeader(cidHeader, ctx.CorrelationID())
+	return ctx
+}
+
+// isPlainThriftContext indicates if the given server context was read for a
+// request from a plain Thrift client, whose response mustn't have headers.
+func isPlainThriftContext(ctx FContext) bool {
+	c, ok := ctx.(*FContextImpl)
+	return ok && c.plainThrift
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bytes"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures requests from plain Thrift clients are given a new context and
+// frugal requests are still read as usual.
+func TestThriftInteropReadRequestHeader(t *testing.T) {
+	assert := assert.New(t)
+	for _, factory := range []thrift.TProtocolFactory{
+		thrift.NewTBinaryProtocolFactoryDefault(),
+		thrift.NewTCompactProtocolFactory(),
+		thrift.NewTJSONProtocolFactory(),
+	} {
+		buffer := thrift.NewTMemoryBuffer()
+		assert.Nil(writeConformanceMessage(factory.GetProtocol(buffer), "conform", thrift.CALL))
+		proto := NewFProtocolFactory(factory).WithThriftInterop().GetProtocol(buffer)
+		ctx, err := proto.ReadRequestHeader()
+		assert.Nil(err)
+		assert.NotEmpty(ctx.CorrelationID())
+		assert.True(isPlainThriftContext(ctx))
+		readConformanceMessage(t, proto, thrift.CALL)
+	}
+
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithThriftInterop()
+	buffer := NewTMemoryOutputBuffer(0)
+	assert.Nil(protocolFactory.GetProtocol(buffer).WriteRequestHeader(NewFContext("cid")))
+	ctx, err := protocolFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(buffer.Bytes()[4:])}).ReadRequestHeader()
+	assert.Nil(err)
+	assert.Equal("cid", ctx.CorrelationID())
+	assert.False(isPlainThriftContext(ctx))
+}
+
+// Ensures plain Thrift requests are rejected unless interop is enabled.
+func TestThriftInteropDisabled(t *testing.T) {
+	buffer := thrift.NewTMemoryBuffer()
+	assert.Nil(t, writeConformanceMessage(thrift.NewTBinaryProtocolFactoryDefault().GetProtocol(buffer), "conform", thrift.CALL))
+	_, err := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).GetProtocol(buffer).ReadRequestHeader()
+	assert.Equal(t, thrift.BAD_VERSION, err.(thrift.TProtocolException).TypeId())
+}
+
+// Ensures plain Thrift clients get responses without headers.
+func TestThriftInteropResponse(t *testing.T) {
+	assert := assert.New(t)
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithThriftInterop()
+	processor := &serviceProcessor{name: "plain"}
+	transport := NewFLoopbackTransport(processor, protocolFactory)
+	assert.Nil(transport.Open())
+
+	buffer := thrift.NewTMemoryBuffer()
+	assert.Nil(writeConformanceMessage(thrift.NewTBinaryProtocolFactoryDefault().GetProtocol(buffer), "conform", thrift.CALL))
+	result, err := transport.Request(NewFContext(""), prependFrameSize(buffer.Bytes()))
+	assert.Nil(err)
+	name, err := thrift.NewTBinaryProtocolTransport(result).ReadString()
+	assert.Nil(err)
+	assert.Equal("plain", name)
+	assert.Equal(uint64(0), result.RemainingBytes())
+}
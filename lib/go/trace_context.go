@@ -0,0 +1,167 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// TraceParentHeader is the W3C Trace Context header identifying the
+	// incoming request in a trace.
+	TraceParentHeader = "traceparent"
+
+	// TraceStateHeader is the W3C Trace Context header carrying
+	// vendor-specific trace information.
+	TraceStateHeader = "tracestate"
+
+	traceParentVersion   = 0x00
+	traceParentLength    = 55
+	traceFlagSampled     = 0x01
+	invalidTraceVersion  = 0xff
+	traceParentSeparator = "-"
+)
+
+// TraceParent is a parsed W3C Trace Context traceparent header. See
+// https://www.w3.org/TR/trace-context/ for details.
+type TraceParent struct {
+	Version  byte
+	TraceID  [16]byte
+	ParentID [8]byte
+	Flags    byte
+}
+
+// NewTraceParent returns a TraceParent starting a new trace with random trace
+// and parent ids.
+func NewTraceParent(sampled bool) (TraceParent, error) {
+	tp := TraceParent{Version: traceParentVersion}
+	if _, err := rand.Read(tp.TraceID[:]); err != nil {
+		return TraceParent{}, err
+	}
+	if _, err := rand.Read(tp.ParentID[:]); err != nil {
+		return TraceParent{}, err
+	}
+	if sampled {
+		tp.Flags = traceFlagSampled
+	}
+	return tp, nil
+}
+
+// ParseTraceParent parses a traceparent header value. Values with a version
+// newer than 00 are accepted as long as their prefix is valid, as required by
+// the specification.
+func ParseTraceParent(value string) (TraceParent, error) {
+	value = strings.TrimSpace(value)
+	invalid := fmt.Errorf("frugal: invalid %s %q", TraceParentHeader, value)
+	if len(value) < traceParentLength {
+		return TraceParent{}, invalid
+	}
+	parts := strings.SplitN(value[:traceParentLength], traceParentSeparator, 4)
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return TraceParent{}, invalid
+	}
+	for _, part := range parts {
+		if strings.ToLower(part) != part {
+			return TraceParent{}, invalid
+		}
+	}
+
+	var tp TraceParent
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || version[0] == invalidTraceVersion {
+		return TraceParent{}, invalid
+	}
+	tp.Version = version[0]
+	if tp.Version == traceParentVersion && len(value) != traceParentLength {
+		return TraceParent{}, invalid
+	}
+	if tp.Version != traceParentVersion && len(value) > traceParentLength &&
+		value[traceParentLength:traceParentLength+1] != traceParentSeparator {
+		return TraceParent{}, invalid
+	}
+	if _, err := hex.Decode(tp.TraceID[:], []byte(parts[1])); err != nil {
+		return TraceParent{}, invalid
+	}
+	if _, err := hex.Decode(tp.ParentID[:], []byte(parts[2])); err != nil {
+		return TraceParent{}, invalid
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return TraceParent{}, invalid
+	}
+	tp.Flags = flags[0]
+	if !tp.IsValid() {
+		return TraceParent{}, invalid
+	}
+	return tp, nil
+}
+
+// IsValid returns true if the trace and parent ids are not all zeros and the
+// version is not the reserved invalid version.
+func (tp TraceParent) IsValid() bool {
+	return tp.Version != invalidTraceVersion && tp.TraceID != [16]byte{} && tp.ParentID != [8]byte{}
+}
+
+// Sampled returns true if the sampled trace flag is set.
+func (tp TraceParent) Sampled() bool {
+	return tp.Flags&traceFlagSampled != 0
+}
+
+// Child returns a TraceParent for a downstream request in the same trace,
+// with a new random parent id. The returned TraceParent always uses the
+// version supported by this library.
+func (tp TraceParent) Child() (TraceParent, error) {
+	child := TraceParent{Version: traceParentVersion, TraceID: tp.TraceID, Flags: tp.Flags}
+	if _, err := rand.Read(child.ParentID[:]); err != nil {
+		return TraceParent{}, err
+	}
+	return child, nil
+}
+
+// String returns the traceparent header value.
+func (tp TraceParent) String() string {
+	return fmt.Sprintf("%02x-%s-%s-%02x", tp.Version,
+		hex.EncodeToString(tp.TraceID[:]), hex.EncodeToString(tp.ParentID[:]), tp.Flags)
+}
+
+// InjectTraceContext sets the traceparent and, if non-empty, tracestate
+// request headers on the given FContext. Returns the same FContext to allow
+// for chaining calls.
+func InjectTraceContext(ctx FContext, traceParent TraceParent, traceState string) FContext {
+	ctx.AddRequestHeader(TraceParentHeader, traceParent.String())
+	if traceState != "" {
+		ctx.AddRequestHeader(TraceStateHeader, traceState)
+	}
+	return ctx
+}
+
+// ExtractTraceContext reads the traceparent and tracestate request headers
+// from the given FContext. The ok result is false if there is no traceparent
+// header, and an error is returned if it is malformed. Per the specification,
+// the tracestate is only returned if the traceparent is valid.
+func ExtractTraceContext(ctx FContext) (traceParent TraceParent, traceState string, ok bool, err error) {
+	value, ok := ctx.RequestHeader(TraceParentHeader)
+	if !ok {
+		return TraceParent{}, "", false, nil
+	}
+	traceParent, err = ParseTraceParent(value)
+	if err != nil {
+		return TraceParent{}, "", true, err
+	}
+	traceState, _ = ctx.RequestHeader(TraceStateHeader)
+	return traceParent, strings.TrimSpace(traceState), true, nil
+}
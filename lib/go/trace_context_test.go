@@ -0,0 +1,104 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const exampleTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// Ensures ParseTraceParent parses valid values and String round trips them.
+func TestParseTraceParent(t *testing.T) {
+	assert := assert.New(t)
+	tp, err := ParseTraceParent(exampleTraceParent)
+	assert.Nil(err)
+	assert.Equal(byte(0), tp.Version)
+	assert.Equal(byte(1), tp.Flags)
+	assert.True(tp.Sampled())
+	assert.True(tp.IsValid())
+	assert.Equal(exampleTraceParent, tp.String())
+
+	// Future versions may append fields.
+	tp, err = ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	assert.Nil(err)
+	assert.Equal(byte(1), tp.Version)
+	assert.False(tp.Sampled())
+}
+
+// Ensures ParseTraceParent rejects invalid values.
+func TestParseTraceParentInvalid(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01x",
+	} {
+		_, err := ParseTraceParent(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+// Ensures NewTraceParent and Child produce valid, related trace parents.
+func TestNewTraceParentChild(t *testing.T) {
+	assert := assert.New(t)
+	tp, err := NewTraceParent(true)
+	assert.Nil(err)
+	assert.True(tp.IsValid())
+	assert.True(tp.Sampled())
+
+	child, err := tp.Child()
+	assert.Nil(err)
+	assert.Equal(tp.TraceID, child.TraceID)
+	assert.NotEqual(tp.ParentID, child.ParentID)
+	assert.Equal(tp.Flags, child.Flags)
+
+	parsed, err := ParseTraceParent(child.String())
+	assert.Nil(err)
+	assert.Equal(child, parsed)
+}
+
+// Ensures trace context can be injected into and extracted from an FContext.
+func TestInjectExtractTraceContext(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewFContext("")
+	_, _, ok, err := ExtractTraceContext(ctx)
+	assert.False(ok)
+	assert.Nil(err)
+
+	tp, _ := ParseTraceParent(exampleTraceParent)
+	assert.Equal(ctx, InjectTraceContext(ctx, tp, "congo=t61rcWkgMzE"))
+	val, _ := ctx.RequestHeader(TraceParentHeader)
+	assert.Equal(exampleTraceParent, val)
+
+	extracted, state, ok, err := ExtractTraceContext(ctx)
+	assert.True(ok)
+	assert.Nil(err)
+	assert.Equal(tp, extracted)
+	assert.Equal("congo=t61rcWkgMzE", state)
+
+	ctx.AddRequestHeader(TraceParentHeader, "garbage")
+	_, state, ok, err = ExtractTraceContext(ctx)
+	assert.True(ok)
+	assert.NotNil(err)
+	assert.Equal("", state)
+}
@@ -46,12 +46,26 @@ type FTransportMonitor interface {
 
 // BaseFTransportMonitor is a default monitor implementation that attempts to
 // re-open a closed transport with exponential backoff behavior and a capped
-// number of retries. Its behavior can be customized by embedding this struct
-// type in a new struct which "overrides" desired callbacks.
+// number of retries. Setting a Policy replaces this behavior. Its behavior can
+// also be customized by embedding this struct type in a new struct which
+// "overrides" desired callbacks.
 type BaseFTransportMonitor struct {
 	MaxReopenAttempts uint
 	InitialWait       time.Duration
 	MaxWait           time.Duration
+
+	// Policy, if set, decides whether and when to reopen the transport in
+	// place of MaxReopenAttempts, InitialWait, and MaxWait.
+	Policy FReconnectPolicy
+
+	// OnReopenAttempt, if set, is called after each attempt to reopen the
+	// transport with the number of the attempt, counting from one, and the
+	// error it failed with, or nil if it succeeded.
+	OnReopenAttempt func(attempt uint, err error)
+
+	// closedAt is when the transport last closed uncleanly, from which the
+	// time elapsed is given to the Policy.
+	closedAt time.Time
 }
 
 // NewDefaultFTransportMonitor creates a new FTransportMonitor with default
@@ -69,6 +83,11 @@ func NewDefaultFTransportMonitor() FTransportMonitor {
 // *other* than a call to Close(). Returns whether to try reopening the
 // transport and, if so, how long to wait before making the attempt.
 func (m *BaseFTransportMonitor) OnClosedUncleanly(cause error) (bool, time.Duration) {
+	if m.Policy != nil {
+		m.closedAt = time.Now()
+		wait, ok := m.Policy.NextWait(1, 0)
+		return ok, wait
+	}
 	return m.MaxReopenAttempts > 0, m.InitialWait
 }
 
@@ -77,6 +96,10 @@ func (m *BaseFTransportMonitor) OnClosedUncleanly(cause error) (bool, time.Durat
 // length of the previous wait. Returns whether to attempt to re-open the
 // transport, and how long to wait before making the attempt.
 func (m *BaseFTransportMonitor) OnReopenFailed(prevAttempts uint, prevWait time.Duration) (bool, time.Duration) {
+	if m.Policy != nil {
+		wait, ok := m.Policy.NextWait(prevAttempts+1, time.Since(m.closedAt))
+		return ok, wait
+	}
 	if prevAttempts >= m.MaxReopenAttempts {
 		return false, 0
 	}
@@ -96,6 +119,20 @@ func (m *BaseFTransportMonitor) OnClosedCleanly() {}
 // re-opened.
 func (m *BaseFTransportMonitor) OnReopenSucceeded() {}
 
+// reopenAttempted calls OnReopenAttempt, if set.
+func (m *BaseFTransportMonitor) reopenAttempted(attempt uint, err error) {
+	if m.OnReopenAttempt != nil {
+		m.OnReopenAttempt(attempt, err)
+	}
+}
+
+// reopenAttemptObserver is implemented by monitors which are told the outcome
+// of each attempt to reopen their transport, as BaseFTransportMonitor and
+// those embedding it are.
+type reopenAttemptObserver interface {
+	reopenAttempted(attempt uint, err error)
+}
+
 type monitorRunner struct {
 	monitor       FTransportMonitor
 	transport     FTransport
@@ -146,7 +183,11 @@ func (r *monitorRunner) attemptReopen(InitialWait time.Duration) bool {
 		logger().Infof("frugal: FTransportMonitor attempting to reopen after %v", wait)
 		time.Sleep(wait)
 
-		if err := r.transport.Open(); err != nil {
+		err := r.transport.Open()
+		if observer, ok := r.monitor.(reopenAttemptObserver); ok {
+			observer.reopenAttempted(prevAttempts+1, err)
+		}
+		if err != nil {
 			logger().Errorf("frugal: FTransportMonitor failed to re-open transport due to: %v", err)
 			prevAttempts++
 
@@ -428,3 +428,35 @@ func (m *mockFTransport) AssertExpectations(t *testing.T) {
 	defer m.Unlock()
 	m.Mock.AssertExpectations(t)
 }
+
+// Ensure that a monitor with a policy reopens the transport when the policy
+// says to, reporting each attempt.
+func TestAttemptReopenPolicy(t *testing.T) {
+	openErr := errors.New("connection refused")
+	var attempts []error
+	m := &BaseFTransportMonitor{
+		Policy: &FBackoffReconnectPolicy{InitialWait: time.Millisecond, Multiplier: 2, MaxAttempts: 3},
+		OnReopenAttempt: func(attempt uint, err error) {
+			assert.Equal(t, uint(len(attempts)+1), attempt)
+			attempts = append(attempts, err)
+		},
+	}
+	mft := &mockFTransport{}
+	mft.On("Open").Return(openErr).Twice()
+	mft.On("Open").Return(nil).Once()
+	mft.On("IsOpen").Return(true)
+	r := monitorRunner{monitor: m, transport: mft}
+
+	assert.True(t, r.handleUncleanClose(errors.New("closed")))
+	assert.Equal(t, []error{openErr, openErr, nil}, attempts)
+	mft.AssertExpectations(t)
+
+	// The policy gives up after three attempts.
+	attempts = nil
+	mft = &mockFTransport{}
+	mft.On("Open").Return(openErr).Times(3)
+	r = monitorRunner{monitor: m, transport: mft}
+	assert.False(t, r.handleUncleanClose(errors.New("closed")))
+	assert.Len(t, attempts, 3)
+	mft.AssertExpectations(t)
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// defaultUnixSocketMode restricts Unix sockets to their owner.
+const defaultUnixSocketMode os.FileMode = 0600
+
+// NewFUnixSocketTransport returns an FTransport which connects to the Unix
+// domain socket at the given path when opened, such as one served by an
+// FServer using an FUnixServerTransport. Reads and writes fail if they take
+// longer than the given timeout, unless it is zero. This avoids the latency
+// and port management of TCP loopback when talking to local services such as
+// sidecars.
+func NewFUnixSocketTransport(path string, timeout time.Duration) FTransport {
+	addr := &net.UnixAddr{Name: path, Net: "unix"}
+	return NewAdapterTransport(thrift.NewTSocketFromAddrTimeout(addr, timeout))
+}
+
+// FUnixServerTransport is a thrift.TServerTransport accepting connections on a
+// Unix domain socket. Use it with an FServer such as FSimpleServer:
+//
+//	transport := frugal.NewFUnixServerTransport("/var/run/service.sock")
+//	server := frugal.NewFSimpleServer(processor, transport, protocolFactory)
+//	go server.Serve()
+type FUnixServerTransport struct {
+	path string
+	mode os.FileMode
+
+	mu          sync.Mutex
+	listener    net.Listener
+	interrupted bool
+}
+
+// NewFUnixServerTransport creates a new FUnixServerTransport listening on the
+// Unix domain socket at the given path. The socket is only accessible to its
+// owner unless changed with WithFileMode.
+func NewFUnixServerTransport(path string) *FUnixServerTransport {
+	return &FUnixServerTransport{path: path, mode: defaultUnixSocketMode}
+}
+
+// WithFileMode sets the permissions of the socket, such as 0660 to allow
+// clients in the socket's group to connect.
+func (u *FUnixServerTransport) WithFileMode(mode os.FileMode) *FUnixServerTransport {
+	u.mode = mode
+	return u
+}
+
+// Listen creates the socket. A socket left behind by a server which exited
+// without closing it is removed, but one which is still being served is not.
+func (u *FUnixServerTransport) Listen() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.listener != nil {
+		return nil
+	}
+	if u.interrupted {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: Unix server transport interrupted")
+	}
+
+	if _, err := os.Stat(u.path); err == nil {
+		if conn, err := net.Dial("unix", u.path); err == nil {
+			conn.Close()
+			return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+				"frugal: Unix socket "+u.path+" is already being served")
+		}
+		if err := os.Remove(u.path); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("unix", u.path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(u.path, u.mode); err != nil {
+		listener.Close()
+		return err
+	}
+	u.listener = listener
+	return nil
+}
+
+// Accept returns the next connection.
+func (u *FUnixServerTransport) Accept() (thrift.TTransport, error) {
+	u.mu.Lock()
+	listener := u.listener
+	u.mu.Unlock()
+	if listener == nil {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: Unix server transport not listening")
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+	return thrift.NewTSocketFromConnTimeout(conn, 0), nil
+}
+
+// Close stops listening and removes the socket.
+func (u *FUnixServerTransport) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.listener == nil {
+		return nil
+	}
+	// Closing a Unix listener removes its socket.
+	err := u.listener.Close()
+	u.listener = nil
+	return err
+}
+
+// Interrupt stops listening, unblocking Accept.
+func (u *FUnixServerTransport) Interrupt() error {
+	u.mu.Lock()
+	u.interrupted = true
+	u.mu.Unlock()
+	return u.Close()
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures requests are served over a Unix domain socket, which is removed when
+// the server stops.
+func TestUnixSocketTransport(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "frugal")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frugal.sock")
+
+	// A socket left behind by a crashed server is replaced.
+	assert.Nil(ioutil.WriteFile(path, nil, 0600))
+
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	serverTransport := NewFUnixServerTransport(path).WithFileMode(0660)
+	assert.Nil(serverTransport.Listen())
+	server := NewFSimpleServer(&headerProcessor{}, serverTransport, protocolFactory)
+	go server.Serve()
+
+	info, err := os.Stat(path)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0660), info.Mode().Perm())
+	assert.Error(NewFUnixServerTransport(path).Listen())
+
+	transport := NewFUnixSocketTransport(path, time.Second)
+	assert.Nil(transport.Open())
+	ctx := NewFContext("cid")
+	ctx.AddRequestHeader("user", "alice")
+	buffer := NewTMemoryOutputBuffer(0)
+	protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx)
+	result, err := transport.Request(ctx, buffer.Bytes())
+	assert.Nil(err)
+	resultProto := protocolFactory.GetProtocol(result)
+	assert.Nil(resultProto.ReadResponseHeader(ctx))
+	user, err := resultProto.ReadString()
+	assert.Nil(err)
+	assert.Equal("alice", user)
+	assert.Nil(transport.Close())
+
+	assert.Nil(server.Stop())
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import "time"
+
+// FWatermarkHandler is notified of how long each request waited in a
+// server's work queue before a worker picked it up, so it can act on a
+// backed up server, such as by emitting metrics, signalling to scale out, or
+// shedding load.
+type FWatermarkHandler interface {
+	// QueueWait is called by the worker about to process a request, with how
+	// long it waited and whether that exceeds the server's high watermark.
+	// Returning an error sheds the request, which is responded to with an
+	// APPLICATION_EXCEPTION_SERVER_OVERLOADED error instead of being
+	// processed.
+	QueueWait(wait time.Duration, overWatermark bool) error
+}
+
+// FWatermarkFunc is an adapter to allow the use of ordinary functions as
+// FWatermarkHandlers.
+type FWatermarkFunc func(wait time.Duration, overWatermark bool) error
+
+// QueueWait calls f(wait, overWatermark).
+func (f FWatermarkFunc) QueueWait(wait time.Duration, overWatermark bool) error {
+	return f(wait, overWatermark)
+}
+
+// NewFLoggingWatermarkHandler returns the default FWatermarkHandler, which
+// logs a warning for requests which waited past the high watermark and
+// processes every request.
+func NewFLoggingWatermarkHandler() FWatermarkHandler {
+	return FWatermarkFunc(func(wait time.Duration, overWatermark bool) error {
+		if overWatermark {
+			logger().Warnf("frugal: request spent %+v in the transport buffer, your consumer might be backed up", wait)
+		}
+		return nil
+	})
+}
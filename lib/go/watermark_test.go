@@ -0,0 +1,78 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures a NATS server reports queue waits to its watermark handler, and
+// sheds the requests it returns an error for.
+func TestFStatelessNatsServerWatermarkHandler(t *testing.T) {
+	assert := assert.New(t)
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	overWatermark := make(chan bool, 2)
+	calls := 0
+	server := NewFNatsServerBuilder(conn, NewFHealthProcessor(NewFHealthServer()), protoFactory, []string{"foo"}).
+		WithHighWatermark(0).
+		WithWatermarkHandler(FWatermarkFunc(func(wait time.Duration, over bool) error {
+			overWatermark <- over
+			// Shed every request after the first.
+			if calls++; calls > 1 {
+				return errors.New("shedding")
+			}
+			return nil
+		})).
+		Build()
+	go func() {
+		assert.Nil(server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Stop()
+
+	tr := NewFNatsTransport(conn, "foo", "")
+	assert.Nil(tr.Open())
+	defer tr.Close()
+	client := NewFHealthClient(NewFServiceProvider(tr, protoFactory))
+
+	status, err := client.Check(NewFContext(""), "")
+	assert.Nil(err)
+	assert.Equal(HealthServing, status)
+	assert.True(<-overWatermark)
+
+	_, err = client.Check(NewFContext(""), "")
+	assertOverloaded(t, err)
+	assert.True(<-overWatermark)
+}
+
+// Ensures the default watermark handler processes every request.
+func TestLoggingWatermarkHandler(t *testing.T) {
+	handler := NewFLoggingWatermarkHandler()
+	assert.Nil(t, handler.QueueWait(time.Millisecond, false))
+	assert.Nil(t, handler.QueueWait(time.Minute, true))
+}
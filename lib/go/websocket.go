@@ -0,0 +1,585 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	webSocketGUID             = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	webSocketVersion          = "13"
+	webSocketProtocol         = "frugal"
+	webSocketHandshakeTimeout = 10 * time.Second
+
+	secWebSocketKeyHeader      = "Sec-WebSocket-Key"
+	secWebSocketAcceptHeader   = "Sec-WebSocket-Accept"
+	secWebSocketVersionHeader  = "Sec-WebSocket-Version"
+	secWebSocketProtocolHeader = "Sec-WebSocket-Protocol"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsMaxControlPayload = 125
+	wsUnknownSize       = ^uint64(0)
+)
+
+var errWebSocketProtocol = errors.New("frugal: WebSocket protocol error")
+
+// tWebSocketTransport is a thrift.TTransport sending and receiving a byte
+// stream over a WebSocket connection. Each Flush sends the bytes written
+// since the last Flush as a binary message, and Read returns the payloads of
+// received messages in order, so Frugal frames can span or share messages.
+type tWebSocketTransport struct {
+	url       string
+	header    http.Header
+	tlsConfig *tls.Config
+
+	mu     sync.RWMutex
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool
+
+	// message is the unread payload of the current data frame.
+	message io.Reader
+
+	writeMu  sync.Mutex
+	writeBuf bytes.Buffer
+	closing  bool
+}
+
+// NewTWebSocketTransport returns a thrift.TTransport which connects to the
+// WebSocket server at the given ws:// or wss:// url when opened, such as an
+// FWebSocketServerTransport or FHTTPPushHandler. The given header, which may
+// be nil, is sent with the opening handshake, and the given TLS
+// configuration, which may also be nil, is used for wss:// urls. Wrap the
+// transport with NewAdapterTransport for use with Frugal clients:
+//
+//	transport := frugal.NewAdapterTransport(
+//		frugal.NewTWebSocketTransport("wss://example.com/frugal", nil, nil))
+//
+// Requests are sent over the connection as they are made, and responses are
+// delivered as they arrive, in any order.
+func NewTWebSocketTransport(url string, header http.Header, tlsConfig *tls.Config) thrift.TTransport {
+	return &tWebSocketTransport{url: url, header: header, tlsConfig: tlsConfig, client: true}
+}
+
+// newWebSocketConn returns an open transport for the given connection, which
+// has completed the opening handshake.
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, client bool) *tWebSocketTransport {
+	return &tWebSocketTransport{conn: conn, reader: reader, client: client}
+}
+
+// Open connects to the server and performs the opening handshake.
+func (t *tWebSocketTransport) Open() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: WebSocket transport already open")
+	}
+	conn, reader, err := dialWebSocket(t.url, t.header, t.tlsConfig)
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	t.conn, t.reader, t.message = conn, reader, nil
+	t.writeMu.Lock()
+	t.closing = false
+	t.writeBuf.Reset()
+	t.writeMu.Unlock()
+	return nil
+}
+
+// IsOpen returns true if the transport is connected.
+func (t *tWebSocketTransport) IsOpen() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.conn != nil
+}
+
+// Close sends a close frame and closes the connection.
+func (t *tWebSocketTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	t.sendClose(t.conn)
+	err := t.conn.Close()
+	t.conn = nil
+	return thrift.NewTTransportExceptionFromError(err)
+}
+
+// sendClose sends a close frame unless one has already been sent.
+func (t *tWebSocketTransport) sendClose(conn net.Conn) {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if t.closing {
+		return
+	}
+	t.closing = true
+	t.writeFrameLocked(conn, wsOpClose, nil)
+}
+
+// currentConn returns the connection, or nil if the transport isn't open.
+func (t *tWebSocketTransport) currentConn() net.Conn {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.conn
+}
+
+// Read reads the payloads of received data messages, answering control
+// frames as they arrive. It returns an END_OF_FILE TTransportException once
+// the connection is closed.
+func (t *tWebSocketTransport) Read(buf []byte) (int, error) {
+	t.mu.RLock()
+	conn, reader := t.conn, t.reader
+	t.mu.RUnlock()
+	if conn == nil {
+		return 0, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: WebSocket transport not open")
+	}
+
+	for {
+		if t.message == nil {
+			message, err := t.nextMessage(conn, reader)
+			if err != nil {
+				return 0, thrift.NewTTransportExceptionFromError(err)
+			}
+			t.message = message
+		}
+		n, err := t.message.Read(buf)
+		if err == io.EOF {
+			t.message = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, thrift.NewTTransportExceptionFromError(err)
+	}
+}
+
+// nextMessage reads frames until a data frame arrives, returning a reader of
+// its payload.
+func (t *tWebSocketTransport) nextMessage(conn net.Conn, reader *bufio.Reader) (io.Reader, error) {
+	for {
+		opcode, payload, err := t.readFrame(reader)
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpBinary, wsOpText, wsOpContinuation:
+			return payload, nil
+		}
+
+		control, err := ioutil.ReadAll(payload)
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpPing:
+			t.writeFrame(conn, wsOpPong, control)
+		case wsOpClose:
+			t.sendClose(conn)
+			return nil, io.EOF
+		}
+	}
+}
+
+// readFrame reads a frame header, returning the frame's opcode and a reader of
+// its unmasked payload.
+func (t *tWebSocketTransport) readFrame(reader *bufio.Reader) (byte, io.Reader, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	// Clients must mask their frames, and servers must not.
+	if masked == t.client || (opcode >= wsOpClose && length > wsMaxControlPayload) {
+		return 0, nil, errWebSocketProtocol
+	}
+
+	payload := &wsPayloadReader{reader: io.LimitReader(reader, int64(length))}
+	if masked {
+		if _, err := io.ReadFull(reader, payload.mask[:]); err != nil {
+			return 0, nil, err
+		}
+		payload.masked = true
+	}
+	return opcode, payload, nil
+}
+
+// Write buffers the given bytes until Flush is called.
+func (t *tWebSocketTransport) Write(buf []byte) (int, error) {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.writeBuf.Write(buf)
+}
+
+// Flush sends the buffered bytes as a binary message.
+func (t *tWebSocketTransport) Flush() error {
+	conn := t.currentConn()
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if t.writeBuf.Len() == 0 {
+		return nil
+	}
+	err := t.writeFrameLocked(conn, wsOpBinary, t.writeBuf.Bytes())
+	t.writeBuf.Reset()
+	return thrift.NewTTransportExceptionFromError(err)
+}
+
+// RemainingBytes returns the maximum uint64, as the amount of data to be read
+// is unknown.
+func (t *tWebSocketTransport) RemainingBytes() uint64 {
+	return wsUnknownSize
+}
+
+// writeMessage sends the given payload as a binary message.
+func (t *tWebSocketTransport) writeMessage(payload []byte) error {
+	return t.writeFrame(t.currentConn(), wsOpBinary, payload)
+}
+
+func (t *tWebSocketTransport) writeFrame(conn net.Conn, opcode byte, payload []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.writeFrameLocked(conn, opcode, payload)
+}
+
+// writeFrameLocked sends a single, final frame with the given opcode and
+// payload to the given connection. Frames sent by clients are masked. The
+// caller must hold writeMu.
+func (t *tWebSocketTransport) writeFrameLocked(conn net.Conn, opcode byte, payload []byte) error {
+	if conn == nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: WebSocket transport not open")
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if t.client {
+		maskBit = 0x80
+	}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	if !t.client {
+		_, err := conn.Write(append(frame, payload...))
+		return err
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := conn.Write(frame)
+	return err
+}
+
+// wsPayloadReader reads and unmasks a frame payload.
+type wsPayloadReader struct {
+	reader io.Reader
+	masked bool
+	mask   [4]byte
+	pos    int
+}
+
+func (r *wsPayloadReader) Read(buf []byte) (int, error) {
+	n, err := r.reader.Read(buf)
+	if r.masked {
+		for i := 0; i < n; i++ {
+			buf[i] ^= r.mask[r.pos%4]
+			r.pos++
+		}
+	}
+	return n, err
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for the given key.
+func webSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// dialWebSocket connects to the WebSocket server at the given url and performs
+// the opening handshake.
+func dialWebSocket(rawURL string, header http.Header, tlsConfig *tls.Config) (net.Conn, *bufio.Reader, error) {
+	wsURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	host := wsURL.Host
+	secure := false
+	switch wsURL.Scheme {
+	case "ws", "http":
+		wsURL.Scheme = "http"
+		if wsURL.Port() == "" {
+			host = net.JoinHostPort(wsURL.Hostname(), "80")
+		}
+	case "wss", "https":
+		wsURL.Scheme = "https"
+		secure = true
+		if wsURL.Port() == "" {
+			host = net.JoinHostPort(wsURL.Hostname(), "443")
+		}
+	default:
+		return nil, nil, fmt.Errorf("frugal: unsupported WebSocket url scheme %q", wsURL.Scheme)
+	}
+
+	dialer := &net.Dialer{Timeout: webSocketHandshakeTimeout}
+	var conn net.Conn
+	if secure {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader, err := webSocketHandshake(conn, wsURL, header)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, reader, nil
+}
+
+func webSocketHandshake(conn net.Conn, wsURL *url.URL, header http.Header) (*bufio.Reader, error) {
+	conn.SetDeadline(time.Now().Add(webSocketHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	request := &http.Request{
+		Method:     http.MethodGet,
+		URL:        wsURL,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       wsURL.Host,
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set(secWebSocketKeyHeader, key)
+	request.Header.Set(secWebSocketVersionHeader, webSocketVersion)
+	request.Header.Set(secWebSocketProtocolHeader, webSocketProtocol)
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		response.Body.Close()
+		return nil, fmt.Errorf("frugal: WebSocket handshake failed with status %d", response.StatusCode)
+	}
+	if response.Header.Get(secWebSocketAcceptHeader) != webSocketAccept(key) {
+		return nil, errors.New("frugal: WebSocket handshake failed, invalid Sec-WebSocket-Accept")
+	}
+	return reader, nil
+}
+
+// isWebSocketUpgrade indicates if the given request opens a WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerContainsToken indicates if the given comma separated header contains
+// the given token, ignoring case.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket completes the opening handshake for the given WebSocket
+// request, returning the open connection. Errors are sent to the client.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*tWebSocketTransport, error) {
+	if r.Method != http.MethodGet || !isWebSocketUpgrade(r) {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errWebSocketProtocol
+	}
+	if r.Header.Get(secWebSocketVersionHeader) != webSocketVersion {
+		w.Header().Set(secWebSocketVersionHeader, webSocketVersion)
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errWebSocketProtocol
+	}
+	key := r.Header.Get(secWebSocketKeyHeader)
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errWebSocketProtocol
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket upgrade unsupported", http.StatusInternalServerError)
+		return nil, errWebSocketProtocol
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		secWebSocketAcceptHeader + ": " + webSocketAccept(key) + "\r\n"
+	if headerContainsToken(r.Header, secWebSocketProtocolHeader, webSocketProtocol) {
+		response += secWebSocketProtocolHeader + ": " + webSocketProtocol + "\r\n"
+	}
+	if _, err := io.WriteString(conn, response+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newWebSocketConn(conn, buffered.Reader, false), nil
+}
+
+// FWebSocketServerTransport is a thrift.TServerTransport accepting WebSocket
+// connections. It is also an http.Handler, which upgrades requests to
+// WebSocket connections and passes them to Accept, so it can be served
+// alongside other HTTP handlers. Use it with an FServer such as
+// FSimpleServer:
+//
+//	transport := frugal.NewFWebSocketServerTransport()
+//	http.Handle("/frugal", transport)
+//	server := frugal.NewFSimpleServer(processor, transport, protocolFactory)
+//	go server.Serve()
+type FWebSocketServerTransport struct {
+	conns     chan thrift.TTransport
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFWebSocketServerTransport creates a new FWebSocketServerTransport.
+func NewFWebSocketServerTransport() *FWebSocketServerTransport {
+	return &FWebSocketServerTransport{
+		conns: make(chan thrift.TTransport),
+		quit:  make(chan struct{}),
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection to be accepted.
+func (s *FWebSocketServerTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-s.quit:
+		http.Error(w, "Server closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	select {
+	case s.conns <- conn:
+	case <-s.quit:
+		conn.Close()
+	}
+}
+
+// Listen is a no-op, connections are received by ServeHTTP.
+func (s *FWebSocketServerTransport) Listen() error {
+	return nil
+}
+
+// Accept returns the next WebSocket connection.
+func (s *FWebSocketServerTransport) Accept() (thrift.TTransport, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.quit:
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: WebSocket server transport closed")
+	}
+}
+
+// Close stops accepting connections.
+func (s *FWebSocketServerTransport) Close() error {
+	s.closeOnce.Do(func() { close(s.quit) })
+	return nil
+}
+
+// Interrupt stops accepting connections.
+func (s *FWebSocketServerTransport) Interrupt() error {
+	return s.Close()
+}
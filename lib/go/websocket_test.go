@@ -0,0 +1,115 @@
+/*
+ * Copyright 2017 Workiva
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package frugal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+func newWebSocketServer(t *testing.T) (*httptest.Server, func()) {
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	serverTransport := NewFWebSocketServerTransport()
+	server := NewFSimpleServer(&headerProcessor{}, serverTransport, protocolFactory)
+	go server.Serve()
+	ts := httptest.NewServer(serverTransport)
+	return ts, func() {
+		assert.Nil(t, server.Stop())
+		ts.Close()
+	}
+}
+
+func webSocketURL(ts *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+// Ensures concurrent requests, including ones spanning frames with extended
+// payload lengths, are answered over a WebSocket connection.
+func TestWebSocketTransportRequest(t *testing.T) {
+	ts, stop := newWebSocketServer(t)
+	defer stop()
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+
+	transport := NewAdapterTransport(NewTWebSocketTransport(webSocketURL(ts), nil, nil))
+	assert.Nil(t, transport.Open())
+	assert.True(t, transport.IsOpen())
+
+	users := []string{"alice", strings.Repeat("b", 1000), strings.Repeat("c", 70000)}
+	var wg sync.WaitGroup
+	for i, user := range users {
+		wg.Add(1)
+		go func(i int, user string) {
+			defer wg.Done()
+			ctx := NewFContext(fmt.Sprintf("cid-%d", i))
+			ctx.AddRequestHeader("user", user)
+			buffer := NewTMemoryOutputBuffer(0)
+			protocolFactory.GetProtocol(buffer).WriteRequestHeader(ctx)
+			result, err := transport.Request(ctx, buffer.Bytes())
+			if !assert.Nil(t, err) {
+				return
+			}
+			resultProto := protocolFactory.GetProtocol(result)
+			assert.Nil(t, resultProto.ReadResponseHeader(ctx))
+			actual, err := resultProto.ReadString()
+			assert.Nil(t, err)
+			assert.Equal(t, user, actual)
+		}(i, user)
+	}
+	wg.Wait()
+
+	assert.Nil(t, transport.Close())
+	assert.False(t, transport.IsOpen())
+}
+
+// Ensures the WebSocket server transport rejects requests which aren't
+// WebSocket upgrades and stops accepting connections once closed.
+func TestWebSocketServerTransport(t *testing.T) {
+	serverTransport := NewFWebSocketServerTransport()
+	ts := httptest.NewServer(serverTransport)
+	defer ts.Close()
+
+	response, err := http.Get(ts.URL)
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	request, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	assert.Nil(t, err)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set(secWebSocketVersionHeader, "8")
+	response, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusUpgradeRequired, response.StatusCode)
+	assert.Equal(t, webSocketVersion, response.Header.Get(secWebSocketVersionHeader))
+
+	assert.Nil(t, serverTransport.Listen())
+	assert.Nil(t, serverTransport.Interrupt())
+	_, err = serverTransport.Accept()
+	assert.Error(t, err)
+	assert.Error(t, NewTWebSocketTransport(webSocketURL(ts), nil, nil).Open())
+}
+
+// Ensures the Sec-WebSocket-Accept value matches the example in RFC 6455.
+func TestWebSocketAccept(t *testing.T) {
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+}
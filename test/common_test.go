@@ -37,6 +37,8 @@ const (
 	includeVendor           = "idl/include_vendor.frugal"
 	includeVendorNoPath     = "idl/include_vendor_no_path.frugal"
 	vendorNamespace         = "idl/vendor_namespace.frugal"
+	streamingFile           = "idl/streaming.frugal"
+	invalidStream           = "idl/invalid_stream.frugal"
 )
 
 var copyFiles bool
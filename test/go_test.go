@@ -118,6 +118,26 @@ func TestValidGoVendorNamespaceTargetGenerate(t *testing.T) {
 	compareAllFiles(t, files)
 }
 
+// Ensures methods annotated as streaming are generated with functions their
+// items are passed with.
+func TestValidGoStreaming(t *testing.T) {
+	options := compiler.Options{
+		File:  streamingFile,
+		Gen:   "go:package_prefix=github.com/Workiva/frugal/test/out/,async",
+		Out:   outputDir,
+		Delim: delim,
+	}
+	if err := compiler.Compile(options); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	files := []FileComparisonPair{
+		{"expected/go/streaming/f_streamer_service.txt", filepath.Join(outputDir, "streaming", "f_streamer_service.go")},
+	}
+	copyAllFiles(t, files)
+	compareAllFiles(t, files)
+}
+
 // Ensures includes are generated in the same order
 func TestIncludeOrdering(t *testing.T) {
 	options := compiler.Options{
@@ -115,3 +115,15 @@ func TestWildcardNamespaceWithVendorAnnotation(t *testing.T) {
 		t.Fatal("Expected error")
 	}
 }
+
+func TestInvalidStream(t *testing.T) {
+	options := compiler.Options{
+		File:  invalidStream,
+		Gen:   "go",
+		Out:   outputDir,
+		Delim: delim,
+	}
+	if compiler.Compile(options) == nil {
+		t.Fatal("Expected error")
+	}
+}